@@ -0,0 +1,282 @@
+// accounting package emits start, interim and stop accounting events of calls observed by the server,
+// so billing systems are fed online instead of reading CDR files.
+// Events follow the session model of RADIUS accounting - RFC 2866 and Diameter accounting - RFC 6733,
+// NewRADIUSClient creates the reference handler that sends them to the RADIUS accounting server.
+// Accountant implements gosip.Observer, so it is passed to gosip.ServerConfig directly or with gosip.Observers.
+package accounting
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/cdr"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// DefaultQueueSize is the number of events waiting for handlers, new events are dropped when the queue is full.
+const DefaultQueueSize = 1024
+
+// EventType is the type of the accounting event.
+type EventType int
+
+const (
+	// Start is emitted at the answer of the call.
+	Start EventType = iota
+	// Interim is emitted every Config.InterimInterval while the call is in progress.
+	Interim
+	// Stop is emitted at the release of the call.
+	Stop
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Start:
+		return "Start"
+	case Interim:
+		return "Interim-Update"
+	case Stop:
+		return "Stop"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// StatusType returns the value of RADIUS Acct-Status-Type attribute - RFC 2866 5.1.
+func (t EventType) StatusType() uint32 {
+	switch t {
+	case Start:
+		return 1
+	case Interim:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// RecordType returns the value of Diameter Accounting-Record-Type AVP - RFC 6733 9.8.1.
+func (t EventType) RecordType() uint32 {
+	switch t {
+	case Start:
+		return 2
+	case Interim:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Event is the accounting event of the call.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Record describes the dialog, Record.CallID is the accounting session ID.
+	// Interim events carry the record of the answer, Stop events the completed record.
+	Record cdr.Record
+	// Duration is the time since the answer, zero for Start events and unanswered calls.
+	Duration time.Duration
+	// Sequence numbers events of the session from 0, like Diameter Accounting-Record-Number.
+	Sequence int
+}
+
+// Handler receives accounting events, like the client of the billing system.
+type Handler interface {
+	Account(event Event) error
+}
+
+// HandlerFunc is an adapter to use ordinary function as Handler.
+type HandlerFunc func(event Event) error
+
+func (f HandlerFunc) Account(event Event) error {
+	return f(event)
+}
+
+// Config describes accounting options.
+type Config struct {
+	// Handlers receive events in order, events are passed to handlers by the single worker,
+	// so handlers may block, like on requests to the accounting server.
+	Handlers []Handler
+	// InterimInterval is the interval of Interim events, zero disables them.
+	InterimInterval time.Duration
+	// Failed emits Stop events of unanswered calls without Start, like to account failed attempts.
+	Failed bool
+	// RecordTTL is a maximum lifetime of the call, default is cdr.DefaultRecordTTL.
+	RecordTTL time.Duration
+	// QueueSize limits events waiting for handlers, default is DefaultQueueSize.
+	QueueSize int
+}
+
+// Accountant emits accounting events of calls from messages passed by the server.
+type Accountant interface {
+	cdr.Recorder
+	// Close stops interim updates and waits until queued events are passed to handlers.
+	Close() error
+}
+
+type session struct {
+	rec      cdr.Record
+	timer    timing.Timer
+	sequence int
+}
+
+type accountant struct {
+	cdr.Recorder
+	handlers []Handler
+	interval time.Duration
+	failed   bool
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	queue    chan Event
+	closed   bool
+	wg       sync.WaitGroup
+
+	log log.Logger
+}
+
+// NewAccountant creates accountant and starts the worker of handlers.
+func NewAccountant(config Config, logger log.Logger) Accountant {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+
+	a := &accountant{
+		handlers: config.Handlers,
+		interval: config.InterimInterval,
+		failed:   config.Failed,
+		sessions: make(map[string]*session),
+		queue:    make(chan Event, config.QueueSize),
+	}
+	a.log = logger.
+		WithPrefix("accounting.Accountant").
+		WithFields(log.Fields{
+			"accountant_ptr": fmt.Sprintf("%p", a),
+		})
+	a.Recorder = cdr.NewRecorder(cdr.Config{
+		OnAnswer:  a.answer,
+		OnRecord:  a.release,
+		RecordTTL: config.RecordTTL,
+	}, logger)
+
+	a.wg.Add(1)
+	go a.serve()
+
+	return a
+}
+
+func (a *accountant) Log() log.Logger {
+	return a.log
+}
+
+func (a *accountant) answer(rec cdr.Record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+	if _, ok := a.sessions[rec.CallID]; ok {
+		return
+	}
+
+	s := &session{rec: rec}
+	a.sessions[rec.CallID] = s
+	a.enqueue(s, Start, rec.AnswerTime, rec)
+	if a.interval > 0 {
+		s.timer = timing.AfterFunc(a.interval, func() {
+			a.interim(s)
+		})
+	}
+}
+
+func (a *accountant) interim(s *session) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed || a.sessions[s.rec.CallID] != s {
+		return
+	}
+
+	a.enqueue(s, Interim, timing.Now(), s.rec)
+	s.timer = timing.AfterFunc(a.interval, func() {
+		a.interim(s)
+	})
+}
+
+func (a *accountant) release(rec cdr.Record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+
+	s, ok := a.sessions[rec.CallID]
+	if ok {
+		delete(a.sessions, rec.CallID)
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+	} else if !a.failed || rec.Answered() {
+		return
+	} else {
+		// failed attempts have only the Stop event
+		s = &session{}
+	}
+
+	a.enqueue(s, Stop, rec.ReleaseTime, rec)
+}
+
+// enqueue must be called under lock.
+func (a *accountant) enqueue(s *session, typ EventType, at time.Time, rec cdr.Record) {
+	event := Event{
+		Type:     typ,
+		Time:     at,
+		Record:   rec,
+		Sequence: s.sequence,
+	}
+	if typ != Start && rec.Answered() {
+		event.Duration = at.Sub(rec.AnswerTime)
+	}
+	s.sequence++
+
+	select {
+	case a.queue <- event:
+	default:
+		a.Log().Warnf("accounting queue is full, %s event of call %s dropped", typ, rec.CallID)
+	}
+}
+
+func (a *accountant) serve() {
+	defer a.wg.Done()
+
+	for event := range a.queue {
+		for _, handler := range a.handlers {
+			if err := handler.Account(event); err != nil {
+				a.Log().Errorf("account %s event of call %s failed: %s", event.Type, event.Record.CallID, err)
+			}
+		}
+	}
+}
+
+func (a *accountant) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	for key, s := range a.sessions {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		delete(a.sessions, key)
+	}
+	close(a.queue)
+	a.mu.Unlock()
+
+	a.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,14 @@
+package accounting_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAccounting(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RegisterTestingT(t)
+	RunSpecs(t, "Accounting Suite")
+}
@@ -0,0 +1,279 @@
+package accounting_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/accounting"
+	"github.com/ghettovoice/gosip/cdr"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+func request(method sip.RequestMethod, callID, toTag string) sip.Request {
+	to := "To: <sip:bob@example.com>"
+	if toTag != "" {
+		to += ";tag=" + toTag
+	}
+	req := testutils.Request([]string{
+		string(method) + " sip:bob@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+		"From: <sip:alice@example.com>;tag=alice-tag",
+		to,
+		"Call-ID: " + callID,
+		"CSeq: 1 " + string(method),
+		"",
+		"",
+	})
+	req.SetTransport("UDP")
+	req.SetSource("10.0.0.1:5060")
+
+	return req
+}
+
+var _ = Describe("Accountant", func() {
+	var (
+		clock      timing.FakeClock
+		events     chan accounting.Event
+		accountant accounting.Accountant
+		config     accounting.Config
+	)
+
+	BeforeEach(func() {
+		clock = timing.NewFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+		timing.SetClock(clock)
+		events = make(chan accounting.Event, 10)
+		config = accounting.Config{
+			Handlers: []accounting.Handler{
+				accounting.HandlerFunc(func(event accounting.Event) error {
+					events <- event
+					return nil
+				}),
+			},
+			InterimInterval: time.Minute,
+		}
+	})
+
+	JustBeforeEach(func() {
+		accountant = accounting.NewAccountant(config, testutils.NewLogrusLogger())
+	})
+
+	AfterEach(func() {
+		Expect(accountant.Close()).To(Succeed())
+		timing.SetClock(nil)
+	})
+
+	It("should emit start, interim and stop events of answered call", func() {
+		invite := request(sip.INVITE, "call-1", "")
+		accountant.MessageReceived(invite)
+		accountant.MessageSent(sip.NewResponseFromRequest("", invite, 180, "Ringing", ""))
+		clock.Advance(5 * time.Second)
+		accountant.MessageSent(sip.NewResponseFromRequest("", invite, 200, "OK", ""))
+
+		var event accounting.Event
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Type).To(Equal(accounting.Start))
+		Expect(event.Sequence).To(Equal(0))
+		Expect(event.Duration).To(BeZero())
+		Expect(event.Record.CallID).To(Equal("call-1"))
+		Expect(event.Record.FromURI).To(Equal("sip:alice@example.com"))
+		Expect(event.Record.SetupDuration()).To(Equal(5 * time.Second))
+
+		clock.Advance(time.Minute)
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Type).To(Equal(accounting.Interim))
+		Expect(event.Sequence).To(Equal(1))
+		Expect(event.Duration).To(Equal(time.Minute))
+
+		clock.BlockUntil(1)
+		clock.Advance(30 * time.Second)
+		accountant.MessageReceived(request(sip.BYE, "call-1", "bob-tag"))
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Type).To(Equal(accounting.Stop))
+		Expect(event.Sequence).To(Equal(2))
+		Expect(event.Duration).To(Equal(90 * time.Second))
+		Expect(event.Record.ReleaseCode).To(Equal(sip.StatusCode(200)))
+		Expect(clock.Timers()).To(BeZero())
+		Consistently(events).ShouldNot(Receive())
+	})
+
+	It("should skip unanswered calls", func() {
+		invite := request(sip.INVITE, "call-2", "")
+		accountant.MessageReceived(invite)
+		accountant.MessageSent(sip.NewResponseFromRequest("", invite, 486, "Busy Here", ""))
+		Consistently(events).ShouldNot(Receive())
+	})
+
+	Context("with failed attempts", func() {
+		BeforeEach(func() {
+			config.Failed = true
+		})
+
+		It("should emit stop event of unanswered call", func() {
+			invite := request(sip.INVITE, "call-3", "")
+			accountant.MessageReceived(invite)
+			accountant.MessageSent(sip.NewResponseFromRequest("", invite, 486, "Busy Here", ""))
+
+			var event accounting.Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Type).To(Equal(accounting.Stop))
+			Expect(event.Duration).To(BeZero())
+			Expect(event.Record.ReleaseCode).To(Equal(sip.StatusCode(486)))
+			Expect(event.Record.Q850Cause).To(Equal(17))
+		})
+	})
+
+	It("should map event types to RADIUS and Diameter values", func() {
+		Expect(accounting.Start.StatusType()).To(Equal(uint32(1)))
+		Expect(accounting.Interim.StatusType()).To(Equal(uint32(3)))
+		Expect(accounting.Stop.StatusType()).To(Equal(uint32(2)))
+		Expect(accounting.Start.RecordType()).To(Equal(uint32(2)))
+		Expect(accounting.Interim.RecordType()).To(Equal(uint32(3)))
+		Expect(accounting.Stop.RecordType()).To(Equal(uint32(4)))
+		Expect(accounting.Interim.String()).To(Equal("Interim-Update"))
+	})
+})
+
+var _ = Describe("RADIUS client", func() {
+	const secret = "s3cr3t"
+
+	var (
+		conn     net.PacketConn
+		requests chan []byte
+		drop     int32
+	)
+
+	attrs := func(packet []byte) map[byte][]byte {
+		values := make(map[byte][]byte)
+		for off := 20; off+2 <= len(packet); off += int(packet[off+1]) {
+			values[packet[off]] = packet[off+2 : off+int(packet[off+1])]
+		}
+		return values
+	}
+
+	BeforeEach(func() {
+		var err error
+		conn, err = net.ListenPacket("udp", "127.0.0.1:5328")
+		Expect(err).ToNot(HaveOccurred())
+		requests = make(chan []byte, 10)
+		atomic.StoreInt32(&drop, 0)
+
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				req := append([]byte{}, buf[:n]...)
+				requests <- req
+				if atomic.AddInt32(&drop, -1) >= 0 {
+					continue
+				}
+
+				res := make([]byte, 20)
+				res[0] = 5
+				res[1] = req[1]
+				binary.BigEndian.PutUint16(res[2:], 20)
+				copy(res[4:], req[4:20])
+				sum := md5.Sum(append(res, secret...))
+				copy(res[4:], sum[:])
+				_, _ = conn.WriteTo(res, addr)
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		Expect(conn.Close()).To(Succeed())
+	})
+
+	It("should send Accounting-Request with authenticator and attributes", func() {
+		client, err := accounting.NewRADIUSClient(accounting.RADIUSConfig{
+			Server:        "127.0.0.1:5328",
+			Secret:        secret,
+			NASIdentifier: "sbc-1",
+			NASIPAddress:  net.ParseIP("10.0.0.10"),
+		}, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+
+		answer := time.Now().Add(-time.Minute)
+		Expect(client.Account(accounting.Event{
+			Type: accounting.Stop,
+			Time: time.Now(),
+			Record: cdr.Record{
+				CallID:      "call-1",
+				FromURI:     "sip:alice@example.com",
+				ToURI:       "sip:bob@example.com",
+				AnswerTime:  answer,
+				ReleaseTime: time.Now(),
+				ReleaseCode: 200,
+				BytesIn:     1200,
+			},
+			Duration: time.Minute,
+		})).To(Succeed())
+
+		var req []byte
+		Expect(requests).To(Receive(&req))
+		Expect(req[0]).To(Equal(byte(4)))
+		Expect(int(binary.BigEndian.Uint16(req[2:]))).To(Equal(len(req)))
+
+		zeroed := append([]byte{}, req...)
+		copy(zeroed[4:20], make([]byte, 16))
+		sum := md5.Sum(append(zeroed, secret...))
+		Expect(bytes.Equal(req[4:20], sum[:])).To(BeTrue())
+
+		values := attrs(req)
+		Expect(binary.BigEndian.Uint32(values[40])).To(Equal(uint32(2)))
+		Expect(string(values[44])).To(Equal("call-1"))
+		Expect(string(values[31])).To(Equal("sip:alice@example.com"))
+		Expect(string(values[30])).To(Equal("sip:bob@example.com"))
+		Expect(string(values[32])).To(Equal("sbc-1"))
+		Expect(net.IP(values[4]).String()).To(Equal("10.0.0.10"))
+		Expect(binary.BigEndian.Uint32(values[46])).To(Equal(uint32(60)))
+		Expect(binary.BigEndian.Uint32(values[42])).To(Equal(uint32(1200)))
+		Expect(binary.BigEndian.Uint32(values[49])).To(Equal(uint32(1)))
+	})
+
+	It("should retransmit requests without responses", func() {
+		atomic.StoreInt32(&drop, 1)
+		client, err := accounting.NewRADIUSClient(accounting.RADIUSConfig{
+			Server:  "127.0.0.1:5328",
+			Secret:  secret,
+			Timeout: 100 * time.Millisecond,
+		}, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(client.Account(accounting.Event{
+			Type:   accounting.Start,
+			Time:   time.Now(),
+			Record: cdr.Record{CallID: "call-2"},
+		})).To(Succeed())
+		Expect(requests).To(HaveLen(2))
+	})
+
+	It("should fail without responses", func() {
+		atomic.StoreInt32(&drop, 10)
+		client, err := accounting.NewRADIUSClient(accounting.RADIUSConfig{
+			Server:  "127.0.0.1:5328",
+			Secret:  secret,
+			Timeout: 50 * time.Millisecond,
+			Retries: 1,
+		}, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(client.Account(accounting.Event{
+			Type:   accounting.Start,
+			Time:   time.Now(),
+			Record: cdr.Record{CallID: "call-3"},
+		})).ToNot(Succeed())
+		Expect(requests).To(HaveLen(2))
+	})
+})
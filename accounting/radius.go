@@ -0,0 +1,261 @@
+package accounting
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const (
+	DefaultRADIUSTimeout = 3 * time.Second
+	DefaultRADIUSRetries = 3
+)
+
+// RADIUS codes and attributes - RFC 2865, RFC 2866.
+const (
+	radiusAccountingRequest  = 4
+	radiusAccountingResponse = 5
+
+	radiusHeaderLen    = 20
+	radiusMaxPacketLen = 4096
+
+	attrNASIPAddress       = 4
+	attrCalledStationID    = 30
+	attrCallingStationID   = 31
+	attrNASIdentifier      = 32
+	attrAcctStatusType     = 40
+	attrAcctDelayTime      = 41
+	attrAcctInputOctets    = 42
+	attrAcctOutputOctets   = 43
+	attrAcctSessionID      = 44
+	attrAcctSessionTime    = 46
+	attrAcctInputPackets   = 47
+	attrAcctOutputPackets  = 48
+	attrAcctTerminateCause = 49
+	attrEventTimestamp     = 55
+
+	terminateUserRequest    = 1
+	terminateSessionTimeout = 5
+)
+
+var errInvalidResponse = errors.New("invalid RADIUS response")
+
+// RADIUSConfig describes options of the RADIUS accounting client.
+type RADIUSConfig struct {
+	// Server is the address of the accounting server, default port is 1813.
+	Server string
+	// Secret is shared with the server.
+	Secret string
+	// NASIdentifier and NASIPAddress identify the server in requests, at least one of them should be set.
+	NASIdentifier string
+	NASIPAddress  net.IP
+	// Timeout of the response, default is DefaultRADIUSTimeout.
+	Timeout time.Duration
+	// Retries is the number of retransmissions of the request, default is DefaultRADIUSRetries, negative disables them.
+	Retries int
+}
+
+type radiusClient struct {
+	config RADIUSConfig
+
+	mu sync.Mutex
+	id byte
+
+	log log.Logger
+}
+
+// NewRADIUSClient creates the handler that sends events as RADIUS Accounting-Request packets - RFC 2866.
+// The Call-ID is sent as Acct-Session-Id, From and To URIs as Calling-Station-Id and Called-Station-Id.
+func NewRADIUSClient(config RADIUSConfig, logger log.Logger) (Handler, error) {
+	if config.Server == "" {
+		return nil, errors.New("empty RADIUS server")
+	}
+	if config.Secret == "" {
+		return nil, errors.New("empty RADIUS secret")
+	}
+	if _, _, err := net.SplitHostPort(config.Server); err != nil {
+		config.Server = net.JoinHostPort(config.Server, "1813")
+	}
+	if config.NASIPAddress != nil && config.NASIPAddress.To4() == nil {
+		return nil, fmt.Errorf("NAS-IP-Address %s is not IPv4 address", config.NASIPAddress)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultRADIUSTimeout
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	} else if config.Retries == 0 {
+		config.Retries = DefaultRADIUSRetries
+	}
+
+	c := &radiusClient{config: config}
+	var id [1]byte
+	_, _ = rand.Read(id[:])
+	c.id = id[0]
+	c.log = logger.
+		WithPrefix("accounting.RADIUSClient").
+		WithFields(log.Fields{
+			"radius_client_ptr": fmt.Sprintf("%p", c),
+			"radius_server":     config.Server,
+		})
+
+	return c, nil
+}
+
+func (c *radiusClient) Log() log.Logger {
+	return c.log
+}
+
+func (c *radiusClient) nextID() byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.id++
+	return c.id
+}
+
+func (c *radiusClient) Account(event Event) error {
+	packet := c.packet(event)
+
+	conn, err := net.Dial("udp", c.config.Server)
+	if err != nil {
+		return fmt.Errorf("dial RADIUS server: %w", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, radiusMaxPacketLen)
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		if _, err = conn.Write(packet); err != nil {
+			return fmt.Errorf("send Accounting-Request: %w", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+
+		for {
+			var n int
+			n, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if err = c.verify(packet, buf[:n]); err != nil {
+				// responses of former requests and forged packets are silently discarded - RFC 2865 3
+				c.Log().Debugf("discard response of %s event of call %s: %s", event.Type, event.Record.CallID, err)
+				continue
+			}
+
+			return nil
+		}
+
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return fmt.Errorf("receive Accounting-Response: %w", err)
+		}
+	}
+
+	return fmt.Errorf("no Accounting-Response after %d attempts: %w", c.config.Retries+1, err)
+}
+
+// packet builds the Accounting-Request packet of the event, the Request Authenticator is calculated - RFC 2866 3.
+func (c *radiusClient) packet(event Event) []byte {
+	rec := event.Record
+
+	attrs := new(bytes.Buffer)
+	writeInt(attrs, attrAcctStatusType, event.Type.StatusType())
+	writeString(attrs, attrAcctSessionID, rec.CallID)
+	writeString(attrs, attrCallingStationID, rec.FromURI)
+	writeString(attrs, attrCalledStationID, rec.ToURI)
+	if c.config.NASIdentifier != "" {
+		writeString(attrs, attrNASIdentifier, c.config.NASIdentifier)
+	}
+	if ip := c.config.NASIPAddress.To4(); ip != nil {
+		writeAttr(attrs, attrNASIPAddress, ip)
+	}
+	if !event.Time.IsZero() {
+		writeInt(attrs, attrEventTimestamp, uint32(event.Time.Unix()))
+		if delay := timing.Now().Sub(event.Time); delay > 0 {
+			writeInt(attrs, attrAcctDelayTime, uint32(delay/time.Second))
+		}
+	}
+	if event.Type != Start {
+		writeInt(attrs, attrAcctSessionTime, uint32(event.Duration/time.Second))
+	}
+	if event.Type == Stop {
+		writeInt(attrs, attrAcctInputOctets, uint32(rec.BytesIn))
+		writeInt(attrs, attrAcctOutputOctets, uint32(rec.BytesOut))
+		writeInt(attrs, attrAcctInputPackets, uint32(rec.MessagesIn))
+		writeInt(attrs, attrAcctOutputPackets, uint32(rec.MessagesOut))
+		cause := uint32(terminateUserRequest)
+		if rec.Expired {
+			cause = terminateSessionTimeout
+		}
+		writeInt(attrs, attrAcctTerminateCause, cause)
+	}
+
+	packet := make([]byte, radiusHeaderLen, radiusHeaderLen+attrs.Len())
+	packet[0] = radiusAccountingRequest
+	packet[1] = c.nextID()
+	binary.BigEndian.PutUint16(packet[2:], uint16(radiusHeaderLen+attrs.Len()))
+	packet = append(packet, attrs.Bytes()...)
+
+	// MD5(Code + Identifier + Length + 16 zero octets + Attributes + Secret)
+	sum := md5.Sum(append(append([]byte{}, packet...), c.config.Secret...))
+	copy(packet[4:radiusHeaderLen], sum[:])
+
+	return packet
+}
+
+// verify checks the Response Authenticator of the response - RFC 2866 3.
+func (c *radiusClient) verify(req, res []byte) error {
+	if len(res) < radiusHeaderLen || res[0] != radiusAccountingResponse || res[1] != req[1] {
+		return errInvalidResponse
+	}
+	length := int(binary.BigEndian.Uint16(res[2:]))
+	if length < radiusHeaderLen || length > len(res) {
+		return errInvalidResponse
+	}
+	res = res[:length]
+
+	// MD5(Code + Identifier + Length + Request Authenticator + Attributes + Secret)
+	data := make([]byte, 0, length+len(c.config.Secret))
+	data = append(data, res[:4]...)
+	data = append(data, req[4:radiusHeaderLen]...)
+	data = append(data, res[radiusHeaderLen:]...)
+	data = append(data, c.config.Secret...)
+	sum := md5.Sum(data)
+	if !bytes.Equal(sum[:], res[4:radiusHeaderLen]) {
+		return fmt.Errorf("%w: authenticator mismatch", errInvalidResponse)
+	}
+
+	return nil
+}
+
+func writeAttr(buf *bytes.Buffer, typ byte, value []byte) {
+	// values longer than 253 octets are truncated
+	if len(value) > 253 {
+		value = value[:253]
+	}
+	buf.WriteByte(typ)
+	buf.WriteByte(byte(2 + len(value)))
+	buf.Write(value)
+}
+
+func writeString(buf *bytes.Buffer, typ byte, value string) {
+	if value == "" {
+		return
+	}
+	writeAttr(buf, typ, []byte(value))
+}
+
+func writeInt(buf *bytes.Buffer, typ byte, value uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], value)
+	writeAttr(buf, typ, b[:])
+}
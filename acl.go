@@ -0,0 +1,101 @@
+package gosip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// ACL restricts sources of the incoming messages by IP networks.
+// Messages from rejected sources are dropped silently by the transport layer
+// before transactions are created.
+type ACL struct {
+	// Allow lists permitted networks in CIDR notation or single IP addresses, all sources are allowed if empty.
+	Allow []string
+	// Deny lists rejected networks in CIDR notation or single IP addresses, it takes precedence over Allow.
+	Deny []string
+}
+
+// accessList is a parsed ACL.
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func (acl *ACL) compile() (*accessList, error) {
+	if acl == nil {
+		return nil, nil
+	}
+
+	allow, err := parseNetworks(acl.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("parse ACL allow list: %w", err)
+	}
+	deny, err := parseNetworks(acl.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("parse ACL deny list: %w", err)
+	}
+
+	return &accessList{allow, deny}, nil
+}
+
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// permits checks the source address of the message.
+func (al *accessList) permits(msg sip.Message) bool {
+	if al == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(msg.Source())
+	if err != nil {
+		host = msg.Source()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range al.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(al.allow) == 0 {
+		return true
+	}
+	for _, network := range al.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
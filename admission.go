@@ -0,0 +1,135 @@
+package gosip
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transaction"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// AdmissionRequest describes the new incoming request passed to the Admission.
+type AdmissionRequest struct {
+	Request sip.Request
+	// Source is a remote address of the request, like 192.168.0.1:5060.
+	Source string
+	// Transport is a network of the request, like UDP.
+	Transport string
+	// Connection identifies the connection the request is received from,
+	// it is shared by all requests of the stream connection.
+	Connection transport.ConnectionKey
+}
+
+// AdmissionVerdict is a decision of the Admission.
+type AdmissionVerdict int
+
+const (
+	// AdmissionAccept passes the request to the transaction layer and handlers.
+	AdmissionAccept AdmissionVerdict = iota
+	// AdmissionReject answers the request with the error response.
+	AdmissionReject
+	// AdmissionChallenge answers the request with '401 Unauthorized' or '407 Proxy Authentication Required'.
+	AdmissionChallenge
+)
+
+// AdmissionDecision is a result of the Admission.
+type AdmissionDecision struct {
+	Verdict AdmissionVerdict
+	// Code and Reason of the response, defaults are '403 Forbidden' for rejects
+	// and '401 Unauthorized' for challenges.
+	Code   sip.StatusCode
+	Reason string
+	// Headers are added to the response, like Retry-After or WWW-Authenticate.
+	Headers []sip.Header
+}
+
+// Accept admits the request.
+func Accept() AdmissionDecision {
+	return AdmissionDecision{Verdict: AdmissionAccept}
+}
+
+// Reject answers the request with the response code, e.g. 403 for fraud rules or 503 with Retry-After for rate limits.
+func Reject(code sip.StatusCode, reason string, headers ...sip.Header) AdmissionDecision {
+	return AdmissionDecision{
+		Verdict: AdmissionReject,
+		Code:    code,
+		Reason:  reason,
+		Headers: headers,
+	}
+}
+
+// Challenge answers the request with the challenge headers,
+// Proxy-Authenticate header switches response to '407 Proxy Authentication Required'.
+func Challenge(headers ...sip.Header) AdmissionDecision {
+	return AdmissionDecision{
+		Verdict: AdmissionChallenge,
+		Headers: headers,
+	}
+}
+
+// Admission is a policy of the incoming requests invoked before transactions are created,
+// so ACLs, rate limits and fraud rules are centralized instead of scattered across handlers.
+// In-dialog requests are passed to the Admission too, while retransmissions, CANCEL and ACK requests are not.
+type Admission interface {
+	Admit(req AdmissionRequest) AdmissionDecision
+}
+
+// AdmissionFunc is an adapter of the function to Admission.
+type AdmissionFunc func(req AdmissionRequest) AdmissionDecision
+
+func (fn AdmissionFunc) Admit(req AdmissionRequest) AdmissionDecision {
+	return fn(req)
+}
+
+// ChainAdmission combines policies, the first not accepting decision wins.
+func ChainAdmission(policies ...Admission) Admission {
+	return AdmissionFunc(func(req AdmissionRequest) AdmissionDecision {
+		for _, policy := range policies {
+			if decision := policy.Admit(req); decision.Verdict != AdmissionAccept {
+				return decision
+			}
+		}
+
+		return Accept()
+	})
+}
+
+// admit adapts the Admission to the transaction layer, responses are sent through the server.
+func (srv *server) admit(admission Admission) transaction.Admission {
+	return func(req sip.Request) sip.Response {
+		areq := AdmissionRequest{
+			Request:   req,
+			Source:    req.Source(),
+			Transport: req.Transport(),
+		}
+		if key, ok := req.Fields()["connection_key"].(transport.ConnectionKey); ok {
+			areq.Connection = key
+		}
+
+		decision := admission.Admit(areq)
+		code := decision.Code
+		switch decision.Verdict {
+		case AdmissionAccept:
+			return nil
+		case AdmissionChallenge:
+			if code == 0 {
+				code = 401
+				for _, hdr := range decision.Headers {
+					if hdr.Name() == "Proxy-Authenticate" {
+						code = 407
+						break
+					}
+				}
+			}
+		default:
+			if code == 0 {
+				code = 403
+			}
+		}
+
+		res := sip.NewReply(req, code, decision.Reason, "")
+		for _, hdr := range decision.Headers {
+			res.AppendHeader(hdr)
+		}
+
+		return res
+	}
+}
@@ -0,0 +1,14 @@
+package auth_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAuth(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RegisterTestingT(t)
+	RunSpecs(t, "Auth Suite")
+}
@@ -0,0 +1,334 @@
+// auth package implements server side digest authentication - RFC 3261 22, RFC 7616.
+package auth
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	DefaultNonceTTL  = 5 * time.Minute
+	DefaultMaxNonces = 10000
+)
+
+// ErrUserNotFound should be returned by CredentialStore when the user is unknown.
+var ErrUserNotFound = errors.New("user not found")
+
+// Credentials of the user, either HA1 or Password should be provided.
+type Credentials struct {
+	// HA1 is a precomputed H(username:realm:password), see sip.CalcHA1.
+	HA1      string
+	Password string
+}
+
+// CredentialStore provides user credentials for the realm.
+type CredentialStore interface {
+	Lookup(user, realm string) (*Credentials, error)
+}
+
+// StaticCredentials is a simple in-memory CredentialStore with user -> password map.
+type StaticCredentials map[string]string
+
+func (store StaticCredentials) Lookup(user, realm string) (*Credentials, error) {
+	if password, ok := store[user]; ok {
+		return &Credentials{Password: password}, nil
+	}
+
+	return nil, ErrUserNotFound
+}
+
+// Config describes authenticator options.
+type Config struct {
+	Realm string
+	Store CredentialStore
+	// Algorithm is a digest algorithm of challenges, MD5 or SHA-256, default is MD5.
+	// Credentials of other algorithms are challenged again, so clients can not downgrade it.
+	Algorithm string
+	// NonceTTL is a nonce lifetime, requests with expired nonces are challenged with stale=true,
+	// default is DefaultNonceTTL.
+	NonceTTL time.Duration
+	// MaxNonces is the max number of issued nonces that are kept, the oldest nonces are forgotten first,
+	// default is DefaultMaxNonces.
+	MaxNonces int
+	// Proxy enables '407 Proxy Authentication Required' challenges.
+	Proxy bool
+	// EventBus receives failed authentications, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+type Authenticator interface {
+	// Authenticate verifies request credentials.
+	// On success it returns authenticated user name and nil response,
+	// otherwise it returns challenge or rejection response that should be sent.
+	Authenticate(req sip.Request) (string, sip.Response)
+	// Handler wraps request handler, unauthenticated requests are answered with the challenge.
+	Handler(handler gosip.RequestHandler) gosip.RequestHandler
+}
+
+type authenticator struct {
+	realm     string
+	store     CredentialStore
+	algorithm string
+	nonceTTL  time.Duration
+	maxNonces int
+	proxy     bool
+	bus       eventbus.Bus
+
+	mu     sync.Mutex
+	nonces map[string]*nonceState
+	// issued orders nonces by issue time, the oldest at the back
+	issued *list.List
+
+	log log.Logger
+}
+
+type nonceState struct {
+	nonce  string
+	issued time.Time
+	// nc is the highest nonce count seen with this nonce
+	nc   uint64
+	elem *list.Element
+}
+
+// NewAuthenticator creates digest authenticator.
+func NewAuthenticator(config Config, logger log.Logger) Authenticator {
+	if config.Algorithm == "" {
+		config.Algorithm = "MD5"
+	}
+	if config.NonceTTL <= 0 {
+		config.NonceTTL = DefaultNonceTTL
+	}
+	if config.MaxNonces <= 0 {
+		config.MaxNonces = DefaultMaxNonces
+	}
+	if config.EventBus == nil {
+		config.EventBus = eventbus.Default
+	}
+
+	a := &authenticator{
+		realm:     config.Realm,
+		store:     config.Store,
+		algorithm: config.Algorithm,
+		nonceTTL:  config.NonceTTL,
+		maxNonces: config.MaxNonces,
+		proxy:     config.Proxy,
+		bus:       config.EventBus,
+		nonces:    make(map[string]*nonceState),
+		issued:    list.New(),
+	}
+	a.log = logger.WithPrefix("auth.Authenticator")
+
+	return a
+}
+
+func (a *authenticator) Log() log.Logger {
+	return a.log
+}
+
+func (a *authenticator) Handler(handler gosip.RequestHandler) gosip.RequestHandler {
+	return func(req sip.Request, tx sip.ServerTransaction) {
+		// ACK and CANCEL can not be challenged - RFC 3261 22.1
+		if req.IsAck() || req.IsCancel() {
+			handler(req, tx)
+			return
+		}
+
+		if _, res := a.Authenticate(req); res != nil {
+			if tx == nil {
+				return
+			}
+			if err := tx.Respond(res); err != nil {
+				a.Log().WithFields(req.Fields()).Errorf("respond on request failed: %s", err)
+			}
+			return
+		}
+
+		handler(req, tx)
+	}
+}
+
+func (a *authenticator) headerNames() (string, string) {
+	if a.proxy {
+		return "Proxy-Authenticate", "Proxy-Authorization"
+	}
+
+	return "WWW-Authenticate", "Authorization"
+}
+
+func (a *authenticator) Authenticate(req sip.Request) (string, sip.Response) {
+	logger := a.Log().WithFields(req.Fields())
+	_, authorizeHeaderName := a.headerNames()
+
+	var credentials *sip.Authorization
+	for _, hdr := range req.GetHeaders(authorizeHeaderName) {
+		auth := sip.AuthFromValue(hdr.Value())
+		if auth.Realm() == a.realm {
+			credentials = auth
+			break
+		}
+	}
+	if credentials == nil {
+		return "", a.challenge(req, false)
+	}
+	if !credentials.IsSupported() || credentials.Username() == "" || credentials.Response() == "" {
+		a.failed(req, credentials.Username(), "malformed credentials")
+
+		return "", a.reject(req, 400, "Bad Request")
+	}
+	if !strings.EqualFold(credentials.Algorithm(), a.algorithm) {
+		logger.Debugf("unexpected algorithm %s of %s", credentials.Algorithm(), credentials.Username())
+		a.failed(req, credentials.Username(), "unexpected algorithm")
+
+		return "", a.challenge(req, false)
+	}
+
+	creds, err := a.store.Lookup(credentials.Username(), a.realm)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			logger.Errorf("lookup credentials of %s failed: %s", credentials.Username(), err)
+
+			return "", a.reject(req, 500, "Server Internal Error")
+		}
+
+		logger.Debugf("unknown user %s", credentials.Username())
+		a.failed(req, credentials.Username(), "unknown user")
+
+		return "", a.reject(req, 403, "Forbidden")
+	}
+
+	expected := credentials.Clone().
+		SetMethod(string(req.Method())).
+		SetBody(req.Body())
+	if creds.HA1 != "" {
+		expected.SetHA1(creds.HA1)
+	} else {
+		expected.SetPassword(creds.Password)
+	}
+	if expected.CalcResponse() != credentials.Response() {
+		logger.Debugf("invalid credentials of %s", credentials.Username())
+		a.failed(req, credentials.Username(), "invalid credentials")
+
+		return "", a.challenge(req, false)
+	}
+
+	// RFC 7616 3.3. valid response with unknown or expired nonce is answered with stale=true
+	if !a.checkNonce(credentials) {
+		logger.Debugf("stale nonce of %s", credentials.Username())
+
+		return "", a.challenge(req, true)
+	}
+
+	return credentials.Username(), nil
+}
+
+func (a *authenticator) failed(req sip.Request, username, reason string) {
+	a.bus.Publish(&eventbus.AuthFailedEvent{
+		Request:  req,
+		Username: username,
+		Realm:    a.realm,
+		Reason:   reason,
+	})
+}
+
+// checkNonce validates nonce lifetime and nonce count replay.
+// Credentials without qop have no nonce count, so their nonce is accepted once.
+func (a *authenticator) checkNonce(credentials *sip.Authorization) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	state, ok := a.nonces[credentials.Nonce()]
+	if !ok {
+		return false
+	}
+	if timing.Now().Sub(state.issued) > a.nonceTTL {
+		a.forget(state)
+		return false
+	}
+
+	nc := uint64(1)
+	if credentials.Qop() != "" {
+		var err error
+		if nc, err = strconv.ParseUint(credentials.Nc(), 16, 64); err != nil {
+			return false
+		}
+	}
+	if nc <= state.nc {
+		return false
+	}
+	state.nc = nc
+
+	return true
+}
+
+func (a *authenticator) newNonce() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := timing.Now()
+	for elem := a.issued.Back(); elem != nil; elem = a.issued.Back() {
+		state := elem.Value.(*nonceState)
+		if now.Sub(state.issued) <= a.nonceTTL && a.issued.Len() < a.maxNonces {
+			break
+		}
+		a.forget(state)
+	}
+
+	state := &nonceState{nonce: util.RandString(32), issued: now}
+	state.elem = a.issued.PushFront(state)
+	a.nonces[state.nonce] = state
+
+	return state.nonce
+}
+
+func (a *authenticator) forget(state *nonceState) {
+	a.issued.Remove(state.elem)
+	delete(a.nonces, state.nonce)
+}
+
+func (a *authenticator) challenge(req sip.Request, stale bool) sip.Response {
+	authenticateHeaderName, _ := a.headerNames()
+
+	var res sip.Response
+	if a.proxy {
+		res = a.reject(req, 407, "Proxy Authentication Required")
+	} else {
+		res = a.reject(req, 401, "Unauthorized")
+	}
+
+	value := fmt.Sprintf(`Digest realm="%s",nonce="%s",algorithm=%s,qop="auth"`, a.realm, a.newNonce(), a.algorithm)
+	if stale {
+		value += ",stale=true"
+	}
+	res.AppendHeader(&sip.GenericHeader{
+		HeaderName: authenticateHeaderName,
+		Contents:   value,
+	})
+
+	return res
+}
+
+func (a *authenticator) reject(req sip.Request, code sip.StatusCode, reason string) sip.Response {
+	res := sip.NewResponseFromRequest("", req, code, reason, "")
+	if to, ok := res.To(); ok && (to.Params == nil || !to.Params.Has("tag")) {
+		to := to.Clone().(*sip.ToHeader)
+		if to.Params == nil {
+			to.Params = sip.NewParams()
+		}
+		to.Params.Add("tag", sip.String{Str: util.RandString(8)})
+		res.ReplaceHeaders("To", []sip.Header{to})
+	}
+
+	return res
+}
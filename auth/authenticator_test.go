@@ -0,0 +1,191 @@
+package auth_test
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/auth"
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Authenticator", func() {
+	var (
+		authenticator auth.Authenticator
+		bus           eventbus.Bus
+		req           sip.Request
+	)
+
+	BeforeEach(func() {
+		bus = eventbus.NewBus()
+		authenticator = auth.NewAuthenticator(auth.Config{
+			Realm:    "example.com",
+			Store:    auth.StaticCredentials{"alice": "secret"},
+			EventBus: bus,
+		}, testutils.NewLogrusLogger())
+		req = testutils.Request([]string{
+			"REGISTER sip:example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=reg-tag",
+			"To: <sip:alice@example.com>",
+			"Call-ID: auth-call-id",
+			"CSeq: 1 REGISTER",
+			"",
+			"",
+		})
+	})
+
+	It("should challenge and accept valid credentials", func() {
+		user, res := authenticator.Authenticate(req)
+		Expect(user).To(BeEmpty())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+		Expect(res.GetHeaders("WWW-Authenticate")).To(HaveLen(1))
+
+		Expect(sip.NewDigestAuthorizer("alice", "secret").AuthorizeRequest(req, res)).To(Succeed())
+		user, res = authenticator.Authenticate(req)
+		Expect(res).To(BeNil())
+		Expect(user).To(Equal("alice"))
+
+		// replayed nonce count
+		_, res = authenticator.Authenticate(req)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+		Expect(res.GetHeaders("WWW-Authenticate")[0].Value()).To(ContainSubstring("stale=true"))
+	})
+
+	It("should re-challenge invalid credentials", func() {
+		events := make(chan eventbus.Event, 2)
+		defer bus.Subscribe(func(ev eventbus.Event) {
+			events <- ev
+		}, eventbus.AuthFailed)()
+
+		_, res := authenticator.Authenticate(req)
+		Consistently(events, 50*time.Millisecond).ShouldNot(Receive())
+		Expect(sip.NewDigestAuthorizer("alice", "wrong").AuthorizeRequest(req, res)).To(Succeed())
+		_, res = authenticator.Authenticate(req)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+		Expect(res.GetHeaders("WWW-Authenticate")[0].Value()).ToNot(ContainSubstring("stale"))
+
+		var ev eventbus.Event
+		Eventually(events).Should(Receive(&ev))
+		Expect(ev).To(BeEquivalentTo(&eventbus.AuthFailedEvent{
+			Request:  req,
+			Username: "alice",
+			Realm:    "example.com",
+			Reason:   "invalid credentials",
+		}))
+	})
+
+	It("should reject unknown users", func() {
+		_, res := authenticator.Authenticate(req)
+		Expect(sip.NewDigestAuthorizer("bob", "secret").AuthorizeRequest(req, res)).To(Succeed())
+		_, res = authenticator.Authenticate(req)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(403)))
+	})
+
+	It("should verify HA1 credentials and proxy challenges", func() {
+		authenticator = auth.NewAuthenticator(auth.Config{
+			Realm:     "example.com",
+			Algorithm: "SHA-256",
+			Proxy:     true,
+			Store: credentialsFunc(func(user, realm string) (*auth.Credentials, error) {
+				return &auth.Credentials{HA1: sip.CalcHA1("SHA-256", user, realm, "secret")}, nil
+			}),
+		}, testutils.NewLogrusLogger())
+
+		_, res := authenticator.Authenticate(req)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(407)))
+		Expect(strings.Contains(res.GetHeaders("Proxy-Authenticate")[0].Value(), "SHA-256")).To(BeTrue())
+
+		Expect(sip.NewDigestAuthorizer("alice", "secret").AuthorizeRequest(req, res)).To(Succeed())
+		user, res := authenticator.Authenticate(req)
+		Expect(res).To(BeNil())
+		Expect(user).To(Equal("alice"))
+	})
+
+	It("should accept nonce without qop once", func() {
+		_, res := authenticator.Authenticate(req)
+		authorize(req, res, "", "")
+		user, res := authenticator.Authenticate(req)
+		Expect(res).To(BeNil())
+		Expect(user).To(Equal("alice"))
+
+		// replayed credentials without nonce count
+		_, res = authenticator.Authenticate(req)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+		Expect(res.GetHeaders("WWW-Authenticate")[0].Value()).To(ContainSubstring("stale=true"))
+	})
+
+	It("should forget the oldest nonces over the limit", func() {
+		authenticator = auth.NewAuthenticator(auth.Config{
+			Realm:     "example.com",
+			Store:     auth.StaticCredentials{"alice": "secret"},
+			MaxNonces: 2,
+		}, testutils.NewLogrusLogger())
+
+		_, first := authenticator.Authenticate(req)
+		_, second := authenticator.Authenticate(req)
+		_, _ = authenticator.Authenticate(req)
+
+		Expect(sip.NewDigestAuthorizer("alice", "secret").AuthorizeRequest(req, second)).To(Succeed())
+		user, res := authenticator.Authenticate(req)
+		Expect(res).To(BeNil())
+		Expect(user).To(Equal("alice"))
+
+		req.RemoveHeader("Authorization")
+		Expect(sip.NewDigestAuthorizer("alice", "secret").AuthorizeRequest(req, first)).To(Succeed())
+		_, res = authenticator.Authenticate(req)
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+		Expect(res.GetHeaders("WWW-Authenticate")[0].Value()).To(ContainSubstring("stale=true"))
+	})
+
+	It("should challenge credentials of other algorithm", func() {
+		authenticator = auth.NewAuthenticator(auth.Config{
+			Realm:     "example.com",
+			Store:     auth.StaticCredentials{"alice": "secret"},
+			Algorithm: "SHA-256",
+		}, testutils.NewLogrusLogger())
+
+		_, res := authenticator.Authenticate(req)
+		// downgraded by the client
+		authorize(req, res, "MD5", "auth")
+		user, res := authenticator.Authenticate(req)
+		Expect(user).To(BeEmpty())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(401)))
+		Expect(res.GetHeaders("WWW-Authenticate")[0].Value()).To(ContainSubstring("algorithm=SHA-256"))
+		Expect(res.GetHeaders("WWW-Authenticate")[0].Value()).ToNot(ContainSubstring("stale"))
+	})
+})
+
+// authorize answers the challenge by credentials of alice with the algorithm and qop,
+// empty algorithm keeps the algorithm of the challenge.
+func authorize(req sip.Request, challenge sip.Response, algorithm, qop string) {
+	value := challenge.GetHeaders("WWW-Authenticate")[0].Value()
+	if algorithm != "" {
+		value = regexp.MustCompile(`algorithm=[^,]+`).ReplaceAllString(value, "algorithm="+algorithm)
+	}
+	credentials := sip.AuthFromValue(value).
+		SetUsername("alice").
+		SetPassword("secret").
+		SetUri(req.Recipient().String()).
+		SetMethod(string(req.Method()))
+	credentials.SetQop(qop)
+	if qop != "" {
+		credentials.SetNc("00000001")
+		credentials.SetCNonce("cnonce")
+	}
+	credentials.SetResponse(credentials.CalcResponse())
+
+	req.RemoveHeader("Authorization")
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "Authorization", Contents: credentials.String()})
+}
+
+type credentialsFunc func(user, realm string) (*auth.Credentials, error)
+
+func (fn credentialsFunc) Lookup(user, realm string) (*auth.Credentials, error) {
+	return fn(user, realm)
+}
@@ -0,0 +1,239 @@
+// b2bua package implements back-to-back user agent building block.
+// B2BUA terminates incoming INVITE dialog (inbound leg) and originates new dialog (outbound leg),
+// relaying responses, re-INVITEs, BYEs and other in-dialog requests between them.
+// Only the listed headers pass between legs, so the topology of each side is hidden from another.
+package b2bua
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// DefaultPassHeaders are headers that are copied between legs by default.
+var DefaultPassHeaders = []string{"Content-Type", "Allow", "Supported", "Accept", "Subject"}
+
+// Leg is a side of the call.
+type Leg int
+
+const (
+	// Inbound is the leg of the incoming INVITE, B2BUA acts as UAS.
+	Inbound Leg = iota
+	// Outbound is the leg of the outgoing INVITE, B2BUA acts as UAC.
+	Outbound
+)
+
+func (leg Leg) String() string {
+	switch leg {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+// Other returns the opposite leg.
+func (leg Leg) Other() Leg {
+	if leg == Inbound {
+		return Outbound
+	}
+
+	return Inbound
+}
+
+// Config describes B2BUA options.
+type Config struct {
+	// Contact is the B2BUA Contact on both legs.
+	Contact *sip.ContactHeader
+	// Route returns target of the outbound leg for the incoming INVITE, default is Request-URI of the INVITE.
+	// Error rejects the call with 404 Not Found.
+	Route func(req sip.Request) (sip.Uri, error)
+	// PassHeaders are copied between legs, other headers are dropped, default is DefaultPassHeaders.
+	PassHeaders []string
+	// Authorizer authorizes requests of the outbound leg.
+	Authorizer sip.Authorizer
+	// OnRequest is called with each request before it is sent to the leg.
+	OnRequest func(call Call, leg Leg, req sip.Request)
+	// OnResponse is called with each response before it is sent to the leg.
+	OnResponse func(call Call, leg Leg, res sip.Response)
+	// OnBody rewrites message body relayed to the leg, e.g. SDP for media anchoring.
+	OnBody func(call Call, leg Leg, contentType, body string) string
+	// OnTerminate is called once when the call is terminated.
+	OnTerminate func(call Call)
+	// EventBus receives creation and termination of dialogs of both legs, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+// B2BUA pairs incoming and outgoing dialogs into calls.
+// Serve* methods can be passed directly to gosip.Server OnRequest.
+type B2BUA interface {
+	// ServeInvite handles initial INVITE and re-INVITEs of the established calls.
+	ServeInvite(req sip.Request, tx sip.ServerTransaction)
+	// ServeAck handles ACK on 2xx responses.
+	ServeAck(req sip.Request, tx sip.ServerTransaction)
+	// ServeBye handles BYE, the call is terminated on both legs.
+	ServeBye(req sip.Request, tx sip.ServerTransaction)
+	// ServeRequest relays other in-dialog requests like INFO, UPDATE, MESSAGE to the opposite leg.
+	ServeRequest(req sip.Request, tx sip.ServerTransaction)
+	Calls() []Call
+}
+
+type callLeg struct {
+	call *call
+	leg  Leg
+}
+
+type b2bua struct {
+	requester gosip.RequestSender
+	config    Config
+
+	mu    sync.RWMutex
+	calls map[*call]bool
+	legs  map[string]callLeg
+
+	log log.Logger
+}
+
+// NewB2BUA creates B2BUA.
+func NewB2BUA(requester gosip.RequestSender, config Config, logger log.Logger) B2BUA {
+	if config.PassHeaders == nil {
+		config.PassHeaders = DefaultPassHeaders
+	}
+	if config.Route == nil {
+		config.Route = func(req sip.Request) (sip.Uri, error) {
+			return req.Recipient().Clone(), nil
+		}
+	}
+
+	b := &b2bua{
+		requester: requester,
+		config:    config,
+		calls:     make(map[*call]bool),
+		legs:      make(map[string]callLeg),
+	}
+	b.log = logger.
+		WithPrefix("b2bua.B2BUA").
+		WithFields(log.Fields{
+			"b2bua_ptr": fmt.Sprintf("%p", b),
+		})
+
+	return b
+}
+
+func (b *b2bua) Log() log.Logger {
+	return b.log
+}
+
+func (b *b2bua) Calls() []Call {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	calls := make([]Call, 0, len(b.calls))
+	for c := range b.calls {
+		calls = append(calls, c)
+	}
+
+	return calls
+}
+
+func (b *b2bua) ServeInvite(req sip.Request, tx sip.ServerTransaction) {
+	if isInDialog(req) {
+		b.serveInDialog(req, tx)
+
+		return
+	}
+
+	c := newCall(b, req, tx)
+
+	b.mu.Lock()
+	b.calls[c] = true
+	b.mu.Unlock()
+
+	c.run()
+}
+
+func (b *b2bua) ServeAck(req sip.Request, tx sip.ServerTransaction) {
+	cl, ok := b.lookup(req)
+	if !ok {
+		b.Log().WithFields(req.Fields()).Debug("ACK does not match any call")
+
+		return
+	}
+
+	cl.call.handleAck(cl.leg, req)
+}
+
+func (b *b2bua) ServeBye(req sip.Request, tx sip.ServerTransaction) {
+	b.serveInDialog(req, tx)
+}
+
+func (b *b2bua) ServeRequest(req sip.Request, tx sip.ServerTransaction) {
+	b.serveInDialog(req, tx)
+}
+
+func (b *b2bua) serveInDialog(req sip.Request, tx sip.ServerTransaction) {
+	cl, ok := b.lookup(req)
+	if !ok {
+		b.respond(tx, sip.NewResponseFromRequest("", req, 481, "Call/Transaction Does Not Exist", ""))
+
+		return
+	}
+
+	cl.call.handleRequest(cl.leg, req, tx)
+}
+
+func (b *b2bua) lookup(req sip.Request) (callLeg, bool) {
+	dialogID, err := sip.MakeDialogIDFromMessage(req)
+	if err != nil {
+		return callLeg{}, false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	cl, ok := b.legs[dialogID]
+
+	return cl, ok
+}
+
+func (b *b2bua) register(c *call, leg Leg, dialogID string) {
+	b.mu.Lock()
+	b.legs[dialogID] = callLeg{call: c, leg: leg}
+	b.mu.Unlock()
+}
+
+func (b *b2bua) unregister(c *call) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.calls, c)
+	for id, cl := range b.legs {
+		if cl.call == c {
+			delete(b.legs, id)
+		}
+	}
+}
+
+func (b *b2bua) respond(tx sip.ServerTransaction, res sip.Response) {
+	if tx == nil {
+		return
+	}
+	if err := tx.Respond(res); err != nil {
+		b.Log().WithFields(res.Fields()).Errorf("respond '%s' failed: %s", res.Short(), err)
+	}
+}
+
+func isInDialog(req sip.Request) bool {
+	to, ok := req.To()
+	if !ok || to.Params == nil {
+		return false
+	}
+
+	return to.Params.Has("tag")
+}
@@ -0,0 +1,14 @@
+package b2bua_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestB2BUA(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RegisterTestingT(t)
+	RunSpecs(t, "B2BUA Suite")
+}
@@ -0,0 +1,242 @@
+package b2bua_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/b2bua"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+// network delivers requests to the user agent handler selected by Request-URI host.
+type network struct {
+	handlers map[string]func(req sip.Request) []sip.Response
+	requests chan sip.Request
+	acks     chan sip.Request
+}
+
+func (n *network) RequestWithContext(
+	ctx context.Context,
+	request sip.Request,
+	options ...gosip.RequestWithContextOption,
+) (sip.Response, error) {
+	opts := &gosip.RequestWithContextOptions{}
+	for _, opt := range options {
+		opt.ApplyRequestWithContext(opts)
+	}
+
+	n.requests <- request
+	var res sip.Response
+	for _, res = range n.handlers[request.Recipient().Host()](request) {
+		if opts.ResponseHandler != nil {
+			opts.ResponseHandler(res, request)
+		}
+	}
+	if !res.IsSuccess() {
+		return nil, sip.NewRequestError(uint(res.StatusCode()), res.Reason(), request, res)
+	}
+	return res, nil
+}
+
+func (n *network) Send(msg sip.Message) error {
+	if req, ok := msg.(sip.Request); ok {
+		n.acks <- req
+	}
+	return nil
+}
+
+// respond builds response of the user agent with the given To tag and Contact.
+func respond(req sip.Request, code sip.StatusCode, tag, contact, body string) sip.Response {
+	res := sip.NewResponseFromRequest("", req, code, "", "")
+	if to, ok := res.To(); ok && !to.Params.Has("tag") {
+		to.Params.Add("tag", sip.String{Str: tag})
+	}
+	res.AppendHeader(&sip.ContactHeader{Address: testutils.Request([]string{
+		"OPTIONS " + contact + " SIP/2.0", "", "",
+	}).Recipient()})
+	if body != "" {
+		res.AppendHeader(&sip.GenericHeader{HeaderName: "Content-Type", Contents: "application/sdp"})
+	}
+	res.SetBody(body, true)
+	return res
+}
+
+var _ = Describe("B2BUA", func() {
+	var (
+		net        *network
+		b          b2bua.B2BUA
+		invite     sip.Request
+		inviteTx   *testutils.MockServerTx
+		bobInvite  sip.Request
+		bobRes     sip.Response
+		terminated chan b2bua.Call
+	)
+
+	BeforeEach(func() {
+		net = &network{
+			handlers: make(map[string]func(req sip.Request) []sip.Response),
+			requests: make(chan sip.Request, 10),
+			acks:     make(chan sip.Request, 10),
+		}
+		net.handlers["10.0.0.2"] = func(req sip.Request) []sip.Response {
+			switch req.Method() {
+			case sip.INVITE:
+				bobInvite = req
+				bobRes = respond(req, 200, "bob-tag", "sip:bob@10.0.0.2:5060", "bob sdp")
+				return []sip.Response{respond(req, 180, "bob-tag", "sip:bob@10.0.0.2:5060", ""), bobRes}
+			default:
+				return []sip.Response{sip.NewResponseFromRequest("", req, 200, "OK", "")}
+			}
+		}
+
+		terminated = make(chan b2bua.Call, 1)
+		b = b2bua.NewB2BUA(net, b2bua.Config{
+			Contact: &sip.ContactHeader{Address: testutils.Request([]string{
+				"OPTIONS sip:b2bua@10.0.0.100:5060 SIP/2.0", "", "",
+			}).Recipient()},
+			Route: func(req sip.Request) (sip.Uri, error) {
+				uri := req.Recipient().Clone()
+				uri.SetHost("10.0.0.2")
+				return uri, nil
+			},
+			OnBody: func(call b2bua.Call, leg b2bua.Leg, contentType, body string) string {
+				return leg.String() + ": " + body
+			},
+			OnTerminate: func(call b2bua.Call) {
+				terminated <- call
+			},
+		}, testutils.NewLogrusLogger())
+
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: \"Alice\" <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: b2bua-call-id",
+			"CSeq: 1 INVITE",
+			"Max-Forwards: 70",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"Subject: lunch",
+			"X-Internal: secret",
+			"Content-Type: application/sdp",
+			"",
+			"alice sdp",
+		})
+		inviteTx = testutils.NewMockServerTx(invite)
+	})
+
+	It("should relay call between legs", func() {
+		b.ServeInvite(invite, inviteTx)
+
+		var req sip.Request
+		Eventually(net.requests).Should(Receive(&req))
+		Expect(req.Recipient().Host()).To(Equal("10.0.0.2"))
+		callID, _ := req.CallID()
+		Expect(string(*callID)).ToNot(Equal("b2bua-call-id"))
+		Expect(req.GetHeaders("X-Internal")).To(BeEmpty())
+		Expect(req.GetHeaders("Subject")).To(HaveLen(1))
+		Expect(req.GetHeaders("Max-Forwards")[0].Value()).To(Equal("69"))
+		Expect(req.Body()).To(Equal("outbound: alice sdp"))
+		contact, _ := req.Contact()
+		Expect(contact.Address.Host()).To(Equal("10.0.0.100"))
+
+		// outbound INVITE carries offer, so ACK is sent at once
+		var ack sip.Request
+		Eventually(net.acks).Should(Receive(&ack))
+		Expect(ack.Recipient().Host()).To(Equal("10.0.0.2"))
+
+		responses := inviteTx.Responses()
+		Expect(responses).To(HaveLen(2))
+		Expect(responses[0].StatusCode()).To(Equal(sip.StatusCode(180)))
+		res := responses[1]
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(res.Body()).To(Equal("inbound: bob sdp"))
+		to, _ := res.To()
+		Expect(to.Params.Has("tag")).To(BeTrue())
+		toTag, _ := responses[0].To()
+		Expect(toTag.Params.Equals(to.Params)).To(BeTrue())
+		contact, _ = res.Contact()
+		Expect(contact.Address.Host()).To(Equal("10.0.0.100"))
+
+		calls := b.Calls()
+		Expect(calls).To(HaveLen(1))
+		call := calls[0]
+		Expect(call.State()).To(Equal(b2bua.Established))
+		Expect(call.Dialog(b2bua.Inbound).State()).To(Equal(dialog.Confirmed))
+		Expect(call.Dialog(b2bua.Outbound).State()).To(Equal(dialog.Confirmed))
+
+		aliceDlg, err := dialog.NewUACDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		bye, err := aliceDlg.NewRequest(sip.BYE, "")
+		Expect(err).ToNot(HaveOccurred())
+		byeTx := testutils.NewMockServerTx(bye)
+		b.ServeBye(bye, byeTx)
+		Expect(byeTx.Response().StatusCode()).To(Equal(sip.StatusCode(200)))
+
+		Eventually(net.requests).Should(Receive(&req))
+		Expect(req.Method()).To(Equal(sip.BYE))
+		Expect(req.Recipient().Host()).To(Equal("10.0.0.2"))
+		Eventually(terminated).Should(Receive(Equal(call)))
+		Expect(call.Done()).To(BeClosed())
+		Expect(b.Calls()).To(BeEmpty())
+	})
+
+	It("should relay failure response", func() {
+		net.handlers["10.0.0.2"] = func(req sip.Request) []sip.Response {
+			res := respond(req, 486, "bob-tag", "sip:bob@10.0.0.2:5060", "")
+			res.AppendHeader(&sip.GenericHeader{HeaderName: "Warning", Contents: "399 bob \"internal\""})
+			return []sip.Response{res}
+		}
+
+		b.ServeInvite(invite, inviteTx)
+		res := inviteTx.Response()
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(486)))
+		Expect(res.GetHeaders("Warning")).To(BeEmpty())
+		Eventually(terminated).Should(Receive())
+		Expect(b.Calls()).To(BeEmpty())
+	})
+
+	It("should relay re-INVITE without offer", func() {
+		b.ServeInvite(invite, inviteTx)
+		Eventually(net.acks).Should(Receive())
+		res := inviteTx.Response()
+		Expect(res.IsSuccess()).To(BeTrue())
+
+		net.handlers["10.0.0.1"] = func(req sip.Request) []sip.Response {
+			return []sip.Response{respond(req, 200, "", "sip:alice@10.0.0.1:5060", "alice new sdp")}
+		}
+
+		bobDlg, err := dialog.NewUASDialog(bobInvite, bobRes, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		reinvite, err := bobDlg.NewRequest(sip.INVITE, "")
+		Expect(err).ToNot(HaveOccurred())
+		reinviteTx := testutils.NewMockServerTx(reinvite)
+		b.ServeInvite(reinvite, reinviteTx)
+
+		var req sip.Request
+		Eventually(net.requests).Should(Receive()) // initial INVITE
+		Eventually(net.requests).Should(Receive(&req))
+		Expect(req.Method()).To(Equal(sip.INVITE))
+		Expect(req.Recipient().Host()).To(Equal("10.0.0.1"))
+		Expect(req.Body()).To(BeEmpty())
+
+		res = reinviteTx.Response()
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(res.Body()).To(Equal("outbound: alice new sdp"))
+		Consistently(net.acks, "50ms").ShouldNot(Receive())
+
+		// answer from bob is relayed to alice in ACK
+		ack := sip.NewAckRequest("", reinvite, res, "", nil)
+		ack.SetBody("bob answer", true)
+		b.ServeAck(ack, nil)
+
+		Eventually(net.acks).Should(Receive(&req))
+		Expect(req.Recipient().Host()).To(Equal("10.0.0.1"))
+		Expect(req.Body()).To(Equal("inbound: bob answer"))
+	})
+})
@@ -0,0 +1,553 @@
+package b2bua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// CallState is a state of the B2BUA call.
+type CallState int
+
+const (
+	// Calling means that the outbound INVITE is in progress.
+	Calling CallState = iota
+	// Established means that both legs are confirmed.
+	Established
+	// Terminated means that both legs are released.
+	Terminated
+)
+
+func (state CallState) String() string {
+	switch state {
+	case Calling:
+		return "Calling"
+	case Established:
+		return "Established"
+	case Terminated:
+		return "Terminated"
+	default:
+		return "Unknown"
+	}
+}
+
+// Call is a pair of inbound and outbound dialogs.
+type Call interface {
+	// Request returns the initial incoming INVITE.
+	Request() sip.Request
+	// Dialog returns dialog of the leg, nil until the call is established.
+	Dialog(leg Leg) dialog.Dialog
+	State() CallState
+	// Hangup cancels the call in progress or sends BYE on both legs of the established call.
+	Hangup(ctx context.Context) error
+	// Done returns channel that is closed when the call is terminated.
+	Done() <-chan struct{}
+	String() string
+}
+
+// pendingAck is the outgoing INVITE without offer, its ACK waits for the answer from the opposite leg.
+type pendingAck struct {
+	req sip.Request
+	res sip.Response
+}
+
+type call struct {
+	b       *b2bua
+	request sip.Request
+	tx      sip.ServerTransaction
+	// To tag of the inbound leg
+	localTag string
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu      sync.RWMutex
+	state   CallState
+	dialogs map[Leg]dialog.Dialog
+	acks    map[Leg]*pendingAck
+	done    chan struct{}
+	once    sync.Once
+
+	log log.Logger
+}
+
+func newCall(b *b2bua, req sip.Request, tx sip.ServerTransaction) *call {
+	c := &call{
+		b:        b,
+		request:  req,
+		tx:       tx,
+		localTag: util.RandString(8),
+		dialogs:  make(map[Leg]dialog.Dialog),
+		acks:     make(map[Leg]*pendingAck),
+		done:     make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.log = b.Log().
+		WithPrefix("b2bua.Call").
+		WithFields(req.Fields()).
+		WithFields(log.Fields{
+			"call_ptr": fmt.Sprintf("%p", c),
+		})
+
+	return c
+}
+
+func (c *call) String() string {
+	if c == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("b2bua.Call<%s>", c.request.Short())
+}
+
+func (c *call) Log() log.Logger {
+	return c.log
+}
+
+func (c *call) Request() sip.Request {
+	return c.request
+}
+
+func (c *call) Dialog(leg Leg) dialog.Dialog {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.dialogs[leg]
+}
+
+func (c *call) State() CallState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.state
+}
+
+func (c *call) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *call) Hangup(ctx context.Context) error {
+	switch c.State() {
+	case Calling:
+		// outbound INVITE is cancelled, the failure is relayed to the inbound leg
+		c.cancel()
+
+		return nil
+	case Established:
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for _, leg := range []Leg{Inbound, Outbound} {
+			wg.Add(1)
+			go func(leg Leg) {
+				defer wg.Done()
+				errs[leg] = c.bye(ctx, leg)
+			}(leg)
+		}
+		wg.Wait()
+		c.terminate()
+
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return nil
+	}
+}
+
+// run establishes the outbound leg of the initial INVITE and relays its responses to the inbound leg.
+func (c *call) run() {
+	defer c.cancel()
+
+	target, err := c.b.config.Route(c.request)
+	if err != nil {
+		c.Log().Debugf("route call failed: %s", err)
+		c.fail(404, "Not Found")
+
+		return
+	}
+
+	maxForwards := sip.MaxForwards(70)
+	if hdrs := c.request.GetHeaders("Max-Forwards"); len(hdrs) > 0 {
+		hdr, ok := hdrs[0].(*sip.MaxForwards)
+		if ok && *hdr == 0 {
+			c.fail(483, "Too Many Hops")
+
+			return
+		}
+		if ok {
+			maxForwards = *hdr - 1
+		}
+	}
+
+	req := c.newOutboundInvite(target, maxForwards)
+	if c.b.config.OnRequest != nil {
+		c.b.config.OnRequest(c, Outbound, req)
+	}
+
+	go c.watchCancels()
+
+	res, err := c.b.requester.RequestWithContext(
+		c.ctx,
+		req,
+		gosip.WithAuthorizer(c.b.config.Authorizer),
+		gosip.WithResponseHandler(func(res sip.Response, req sip.Request) {
+			if res.IsProvisional() && res.StatusCode() > 100 {
+				c.b.respond(c.tx, c.relayResponse(Inbound, c.request, res))
+			}
+		}),
+	)
+	if err != nil {
+		c.Log().Debugf("outbound INVITE failed: %s", err)
+		c.relayError(Inbound, c.request, c.tx, err)
+		c.terminate()
+
+		return
+	}
+
+	outbound, err := dialog.NewUACDialog(req, res, c.Log(), dialog.WithEventBus(c.b.config.EventBus))
+	if err != nil {
+		c.Log().Errorf("create outbound dialog failed: %s", err)
+		c.sendAck(req, res, "")
+		c.fail(500, "Server Internal Error")
+
+		return
+	}
+
+	relayed := c.relayResponse(Inbound, c.request, res)
+	inbound, err := dialog.NewUASDialog(c.request, relayed, c.Log(), dialog.WithEventBus(c.b.config.EventBus))
+	if err != nil {
+		c.Log().Errorf("create inbound dialog failed: %s", err)
+		c.sendAck(req, res, "")
+		c.fail(500, "Server Internal Error")
+		// outbound session is established already, so it is released with BYE
+		if bye, err := outbound.NewRequest(sip.BYE, ""); err == nil {
+			_, _ = c.b.requester.RequestWithContext(context.Background(), bye)
+		}
+		outbound.Terminate()
+
+		return
+	}
+
+	inbound.AddUsage()
+	outbound.AddUsage()
+
+	c.mu.Lock()
+	c.state = Established
+	c.dialogs[Inbound] = inbound
+	c.dialogs[Outbound] = outbound
+	if req.Body() == "" {
+		c.acks[Inbound] = &pendingAck{req: req, res: res}
+	}
+	c.mu.Unlock()
+
+	c.b.register(c, Inbound, inbound.ID())
+	c.b.register(c, Outbound, outbound.ID())
+
+	c.b.respond(c.tx, relayed)
+	if req.Body() != "" {
+		c.sendAck(req, res, "")
+	}
+}
+
+// watchCancels relays CANCEL of the inbound INVITE to the outbound leg.
+func (c *call) watchCancels() {
+	select {
+	case <-c.ctx.Done():
+	case cancel, ok := <-c.tx.Cancels():
+		if !ok {
+			return
+		}
+		c.b.respond(c.tx, sip.NewResponseFromRequest("", cancel, 200, "OK", ""))
+		c.cancel()
+	}
+}
+
+// handleRequest relays in-dialog request received on the leg to the opposite leg.
+func (c *call) handleRequest(leg Leg, req sip.Request, tx sip.ServerTransaction) {
+	src := c.Dialog(leg)
+	dst := c.Dialog(leg.Other())
+	if src == nil || dst == nil {
+		c.b.respond(tx, sip.NewResponseFromRequest("", req, 481, "Call/Transaction Does Not Exist", ""))
+
+		return
+	}
+
+	if err := src.ReceiveRequest(req); err != nil {
+		c.Log().Debugf("reject in-dialog request '%s': %s", req.Short(), err)
+		c.b.respond(tx, sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""))
+
+		return
+	}
+
+	if req.Method() == sip.BYE {
+		c.b.respond(tx, sip.NewResponseFromRequest("", req, 200, "OK", ""))
+		if err := c.bye(context.Background(), leg.Other()); err != nil {
+			c.Log().Debugf("send BYE to %s leg failed: %s", leg.Other(), err)
+		}
+		c.terminate()
+
+		return
+	}
+
+	out, err := dst.NewRequest(req.Method(), c.relayBody(leg.Other(), req), c.passHeaders(req)...)
+	if err != nil {
+		c.Log().Errorf("create %s request failed: %s", req.Method(), err)
+		c.b.respond(tx, sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""))
+
+		return
+	}
+	if c.b.config.OnRequest != nil {
+		c.b.config.OnRequest(c, leg.Other(), out)
+	}
+
+	options := []gosip.RequestWithContextOption{
+		gosip.WithResponseHandler(func(res sip.Response, _ sip.Request) {
+			if res.IsProvisional() && res.StatusCode() > 100 {
+				c.b.respond(tx, c.relayResponse(leg, req, res))
+			}
+		}),
+	}
+	if leg == Inbound {
+		options = append(options, gosip.WithAuthorizer(c.b.config.Authorizer))
+	}
+
+	res, err := c.b.requester.RequestWithContext(context.Background(), out, options...)
+	if err != nil {
+		c.relayError(leg, req, tx, err)
+
+		return
+	}
+	if err := dst.ReceiveResponse(res); err != nil {
+		c.Log().Debugf("dialog rejected response '%s': %s", res.Short(), err)
+	}
+
+	c.b.respond(tx, c.relayResponse(leg, req, res))
+
+	if out.Method() == sip.INVITE {
+		if out.Body() != "" {
+			c.sendAck(out, res, "")
+		} else {
+			c.mu.Lock()
+			c.acks[leg] = &pendingAck{req: out, res: res}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// handleAck sends ACK on the pending 2xx of the opposite leg with the answer received on the leg.
+func (c *call) handleAck(leg Leg, req sip.Request) {
+	c.mu.Lock()
+	ack, ok := c.acks[leg]
+	delete(c.acks, leg)
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	c.sendAck(ack.req, ack.res, c.relayBody(leg.Other(), req), c.passHeaders(req)...)
+}
+
+func (c *call) sendAck(req sip.Request, res sip.Response, body string, hdrs ...sip.Header) {
+	ack := sip.NewAckRequest("", req, res, "", nil)
+	for _, hdr := range hdrs {
+		ack.AppendHeader(hdr)
+	}
+	ack.SetBody(body, true)
+
+	if err := c.b.requester.Send(ack); err != nil {
+		c.Log().Errorf("send ACK failed: %s", err)
+	}
+}
+
+func (c *call) bye(ctx context.Context, leg Leg) error {
+	dlg := c.Dialog(leg)
+	if dlg == nil || dlg.State() == dialog.Terminated {
+		return nil
+	}
+
+	req, err := dlg.NewRequest(sip.BYE, "")
+	if err != nil {
+		return err
+	}
+	if c.b.config.OnRequest != nil {
+		c.b.config.OnRequest(c, leg, req)
+	}
+
+	var options []gosip.RequestWithContextOption
+	if leg == Outbound {
+		options = append(options, gosip.WithAuthorizer(c.b.config.Authorizer))
+	}
+	_, err = c.b.requester.RequestWithContext(ctx, req, options...)
+
+	return err
+}
+
+func (c *call) terminate() {
+	c.once.Do(func() {
+		c.cancel()
+
+		c.mu.Lock()
+		c.state = Terminated
+		dialogs := make([]dialog.Dialog, 0, len(c.dialogs))
+		for _, dlg := range c.dialogs {
+			dialogs = append(dialogs, dlg)
+		}
+		c.acks = make(map[Leg]*pendingAck)
+		c.mu.Unlock()
+
+		for _, dlg := range dialogs {
+			dlg.ReleaseUsage()
+		}
+		c.b.unregister(c)
+		close(c.done)
+
+		c.Log().Debug("call terminated")
+
+		if c.b.config.OnTerminate != nil {
+			c.b.config.OnTerminate(c)
+		}
+	})
+}
+
+// fail rejects the initial INVITE and terminates the call.
+func (c *call) fail(code sip.StatusCode, reason string) {
+	c.b.respond(c.tx, c.newResponse(c.request, code, reason))
+	c.terminate()
+}
+
+// relayError relays the failure of the request sent to the opposite leg.
+func (c *call) relayError(leg Leg, req sip.Request, tx sip.ServerTransaction, err error) {
+	var reqErr *sip.RequestError
+	switch {
+	case errors.As(err, &reqErr) && reqErr.Response != nil && reqErr.Response.StatusCode() >= 300:
+		c.b.respond(tx, c.relayResponse(leg, req, reqErr.Response))
+	case errors.As(err, &reqErr):
+		c.b.respond(tx, c.newResponse(req, sip.StatusCode(reqErr.Code), reqErr.Reason))
+	default:
+		c.b.respond(tx, c.newResponse(req, 500, "Server Internal Error"))
+	}
+}
+
+func (c *call) newResponse(req sip.Request, code sip.StatusCode, reason string) sip.Response {
+	res := sip.NewResponseFromRequest("", req, code, reason, "")
+	c.setToTag(res)
+
+	return res
+}
+
+// relayResponse builds response to the request of the leg from the response received on the opposite leg.
+func (c *call) relayResponse(leg Leg, req sip.Request, res sip.Response) sip.Response {
+	out := c.newResponse(req, res.StatusCode(), res.Reason())
+	for _, hdr := range c.passHeaders(res) {
+		out.AppendHeader(hdr)
+	}
+	if res.StatusCode() > 100 && res.StatusCode() < 300 && c.b.config.Contact != nil {
+		out.AppendHeader(c.b.config.Contact.Clone())
+	}
+	out.SetBody(c.relayBody(leg, res), true)
+
+	if c.b.config.OnResponse != nil {
+		c.b.config.OnResponse(c, leg, out)
+	}
+
+	return out
+}
+
+// setToTag adds To tag of the inbound leg to the response on the initial INVITE.
+func (c *call) setToTag(res sip.Response) {
+	to, ok := res.To()
+	if !ok || res.StatusCode() == 100 {
+		return
+	}
+	if to.Params == nil {
+		to.Params = sip.NewParams()
+	}
+	if !to.Params.Has("tag") {
+		to.Params.Add("tag", sip.String{Str: c.localTag})
+	}
+}
+
+func (c *call) relayBody(leg Leg, msg sip.Message) string {
+	body := msg.Body()
+	if c.b.config.OnBody == nil || body == "" {
+		return body
+	}
+
+	var contentType string
+	if hdr, ok := msg.ContentType(); ok {
+		contentType = hdr.Value()
+	}
+
+	return c.b.config.OnBody(c, leg, contentType, body)
+}
+
+func (c *call) passHeaders(msg sip.Message) []sip.Header {
+	var hdrs []sip.Header
+	for _, name := range c.b.config.PassHeaders {
+		for _, hdr := range msg.GetHeaders(name) {
+			hdrs = append(hdrs, hdr.Clone())
+		}
+	}
+
+	return hdrs
+}
+
+func (c *call) newOutboundInvite(target sip.Uri, maxForwards sip.MaxForwards) sip.Request {
+	from := &sip.FromHeader{Params: sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)})}
+	if hdr, ok := c.request.From(); ok {
+		from.DisplayName = hdr.DisplayName
+		from.Address = hdr.Address.Clone()
+	}
+	to := &sip.ToHeader{Params: sip.NewParams()}
+	if hdr, ok := c.request.To(); ok {
+		to.DisplayName = hdr.DisplayName
+		to.Address = hdr.Address.Clone()
+	}
+	callID := sip.CallID(util.RandString(32))
+
+	hdrs := []sip.Header{
+		sip.ViaHeader{
+			&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       sip.DefaultProtocol,
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			},
+		},
+		&maxForwards,
+		from,
+		to,
+		&callID,
+		&sip.CSeq{SeqNo: 1, MethodName: sip.INVITE},
+	}
+	if c.b.config.Contact != nil {
+		hdrs = append(hdrs, c.b.config.Contact.Clone())
+	}
+	hdrs = append(hdrs, c.passHeaders(c.request)...)
+
+	req := sip.NewRequest(
+		"",
+		sip.INVITE,
+		target,
+		"SIP/2.0",
+		hdrs,
+		"",
+		log.Fields{
+			"call_ptr": fmt.Sprintf("%p", c),
+		},
+	)
+	req.SetBody(c.relayBody(Outbound, c.request), true)
+
+	return req
+}
@@ -0,0 +1,301 @@
+package gosip
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const (
+	DefaultBreakerWindow      = 30 * time.Second
+	DefaultBreakerMinRequests = 10
+	DefaultBreakerFailureRate = 0.5
+	DefaultBreakerOpenTimeout = 30 * time.Second
+	DefaultRetryBudget        = 0.2
+	DefaultMinRetries         = 10
+
+	// breakerBuckets is a number of buckets of the rolling window.
+	breakerBuckets = 10
+)
+
+// BreakerConfig describes the circuit breaker of destinations of outgoing requests.
+// Transport errors, timeouts and 503 responses are failures of the destination, other responses are successes.
+// When the failure rate of the destination exceeds the threshold, the breaker opens and requests to the destination
+// fail locally with 503 Service Unavailable without being sent. After the open timeout the breaker is half-open:
+// probe requests are sent, the successful probe closes the breaker and the failed one opens it again.
+type BreakerConfig struct {
+	// Window is the time window of the failure rate, default is DefaultBreakerWindow.
+	Window time.Duration
+	// MinRequests is a number of requests in the window before the breaker can open, default is DefaultBreakerMinRequests.
+	MinRequests int
+	// FailureRate is a ratio of failed requests in the window that opens the breaker, default is DefaultBreakerFailureRate.
+	FailureRate float64
+	// OpenTimeout is how long the breaker stays open before probing, default is DefaultBreakerOpenTimeout.
+	OpenTimeout time.Duration
+	// HalfOpenProbes is a number of concurrent probe requests of the half-open breaker, default is 1.
+	HalfOpenProbes int
+	// RetryBudget is a ratio of failover retries to requests in the window, so retries to next targets
+	// do not multiply the load when many destinations fail - RFC 3263 4.3. Default is DefaultRetryBudget.
+	RetryBudget float64
+	// MinRetries is a number of retries in the window allowed regardless of the budget, default is DefaultMinRetries.
+	MinRetries int
+}
+
+// BreakerState is a state of the circuit breaker of the destination.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "Closed"
+	case BreakerOpen:
+		return "Open"
+	case BreakerHalfOpen:
+		return "HalfOpen"
+	default:
+		return "Unknown"
+	}
+}
+
+type breakerResult int
+
+const (
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	// breakerIgnored is a request that tells nothing about the destination, e.g. canceled by the application
+	breakerIgnored
+)
+
+// breakers tracks circuit breakers of destinations and the retry budget of the server.
+type breakers struct {
+	config BreakerConfig
+
+	mu           sync.Mutex
+	destinations map[string]*breaker
+	retries      rollingCounts
+	lastPrune    time.Time
+}
+
+type breaker struct {
+	state    BreakerState
+	counts   rollingCounts
+	openedAt time.Time
+	probes   int
+}
+
+func newBreakers(config BreakerConfig) *breakers {
+	if config.Window <= 0 {
+		config.Window = DefaultBreakerWindow
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = DefaultBreakerMinRequests
+	}
+	if config.FailureRate <= 0 {
+		config.FailureRate = DefaultBreakerFailureRate
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	if config.HalfOpenProbes <= 0 {
+		config.HalfOpenProbes = 1
+	}
+	if config.RetryBudget <= 0 {
+		config.RetryBudget = DefaultRetryBudget
+	}
+	if config.MinRetries <= 0 {
+		config.MinRetries = DefaultMinRetries
+	}
+
+	return &breakers{
+		config:       config,
+		destinations: make(map[string]*breaker),
+		retries:      newRollingCounts(config.Window),
+		lastPrune:    timing.Now(),
+	}
+}
+
+// allow checks that the request can be sent to the destination,
+// otherwise it returns the time left before the breaker is half-open.
+func (bs *breakers) allow(dest string) (time.Duration, bool) {
+	now := timing.Now()
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b, ok := bs.destinations[dest]
+	if !ok {
+		return 0, true
+	}
+
+	if b.state == BreakerOpen {
+		left := b.openedAt.Add(bs.config.OpenTimeout).Sub(now)
+		if left > 0 {
+			return left, false
+		}
+		b.state = BreakerHalfOpen
+		b.probes = 0
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= bs.config.HalfOpenProbes {
+			return bs.config.OpenTimeout, false
+		}
+		b.probes++
+	}
+
+	return 0, true
+}
+
+// report records the result of the request allowed by allow and returns the new state of the breaker.
+func (bs *breakers) report(dest string, result breakerResult) BreakerState {
+	now := timing.Now()
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.prune(now)
+
+	b, ok := bs.destinations[dest]
+	if !ok {
+		if result == breakerIgnored {
+			return BreakerClosed
+		}
+		b = &breaker{counts: newRollingCounts(bs.config.Window)}
+		bs.destinations[dest] = b
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+		switch result {
+		case breakerSuccess:
+			b.state = BreakerClosed
+			b.counts = newRollingCounts(bs.config.Window)
+		case breakerFailure:
+			b.state = BreakerOpen
+			b.openedAt = now
+		}
+	case BreakerClosed:
+		if result == breakerIgnored {
+			break
+		}
+		b.counts.add(now, 1, boolToInt(result == breakerFailure))
+		total, failures := b.counts.sum(now)
+		if total >= bs.config.MinRequests && float64(failures) >= bs.config.FailureRate*float64(total) {
+			b.state = BreakerOpen
+			b.openedAt = now
+		}
+	}
+
+	return b.state
+}
+
+// countRequest records the first attempt of the request with failover.
+func (bs *breakers) countRequest() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.retries.add(timing.Now(), 1, 0)
+}
+
+// allowRetry spends the retry budget, it returns false if the budget is exhausted.
+func (bs *breakers) allowRetry() bool {
+	now := timing.Now()
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	requests, retries := bs.retries.sum(now)
+	if retries >= bs.config.MinRetries && float64(retries) >= bs.config.RetryBudget*float64(requests) {
+		return false
+	}
+	bs.retries.add(now, 0, 1)
+
+	return true
+}
+
+// prune removes closed breakers without requests in the window, at most once a minute.
+func (bs *breakers) prune(now time.Time) {
+	if now.Sub(bs.lastPrune) < time.Minute {
+		return
+	}
+	bs.lastPrune = now
+
+	for dest, b := range bs.destinations {
+		if total, _ := b.counts.sum(now); b.state == BreakerClosed && total == 0 {
+			delete(bs.destinations, dest)
+		}
+	}
+}
+
+// localUnavailable returns the locally generated 503 response for the request to the open destination - RFC 3261 21.5.4.
+func localUnavailable(req sip.Request, retryAfter time.Duration) sip.Response {
+	res := sip.NewResponseFromRequest("", req, 503, "Service Unavailable", "")
+	res.AppendHeader(&sip.GenericHeader{
+		HeaderName: "Retry-After",
+		Contents:   fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))),
+	})
+
+	return res
+}
+
+// rollingCounts counts events of the sliding time window split into buckets.
+type rollingCounts struct {
+	width   time.Duration
+	buckets [breakerBuckets]rollingBucket
+}
+
+type rollingBucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+func newRollingCounts(window time.Duration) rollingCounts {
+	width := window / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+
+	return rollingCounts{width: width}
+}
+
+func (rc *rollingCounts) add(now time.Time, total, failures int) {
+	start := now.Truncate(rc.width)
+	bucket := &rc.buckets[uint64(start.UnixNano()/int64(rc.width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = rollingBucket{start: start}
+	}
+	bucket.total += total
+	bucket.failures += failures
+}
+
+func (rc *rollingCounts) sum(now time.Time) (total, failures int) {
+	for _, bucket := range rc.buckets {
+		if !bucket.start.IsZero() && now.Sub(bucket.start) < rc.width*breakerBuckets {
+			total += bucket.total
+			failures += bucket.failures
+		}
+	}
+
+	return total, failures
+}
+
+func boolToInt(v bool) int {
+	if v {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,533 @@
+// cac package implements call admission control: limits of concurrent calls and call attempts per second
+// of trunks and of the whole server. Initial INVITEs over limits are rejected with 503 and Retry-After
+// by the Middleware of gosip.Mux, calls are counted until their BYE or the failure of the INVITE.
+// Limits are adjustable at runtime, the Controller exposes Prometheus metrics of calls and rejections.
+package cac
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+const (
+	DefaultRetryAfter = 5 * time.Second
+	// DefaultMaxCallDuration reclaims slots of calls whose BYE was never seen.
+	DefaultMaxCallDuration = 12 * time.Hour
+	DefaultNamespace       = "gosip"
+)
+
+// Limit is the kind of the limit.
+type Limit string
+
+const (
+	// LimitCalls limits concurrent calls.
+	LimitCalls Limit = "calls"
+	// LimitCPS limits call attempts per second.
+	LimitCPS Limit = "cps"
+)
+
+// Limits of calls, zero values are unlimited.
+type Limits struct {
+	MaxCalls int
+	MaxCPS   float64
+	// Burst is the number of call attempts admitted at once above MaxCPS, default is MaxCPS rounded up.
+	Burst int
+}
+
+// Trunk is the peer with own limits, like the carrier or the customer PBX.
+type Trunk struct {
+	Name string
+	// Sources lists networks of the trunk in CIDR notation or single IP addresses.
+	Sources []string
+	Limits  Limits
+}
+
+// LimitError is returned for calls over limits.
+type LimitError struct {
+	// Trunk is the name of the trunk of the exceeded limit, empty for global limits.
+	Trunk      string
+	Limit      Limit
+	RetryAfter time.Duration
+}
+
+func (err *LimitError) Error() string {
+	scope := "global"
+	if err.Trunk != "" {
+		scope = "trunk " + err.Trunk
+	}
+
+	return fmt.Sprintf("%s limit of %s exceeded", err.Limit, scope)
+}
+
+// Config describes call admission control options.
+type Config struct {
+	// Global limits are shared by calls of all trunks and calls from unknown sources.
+	Global Limits
+	Trunks []Trunk
+	// RetryAfter is a value of Retry-After header of calls rejected by concurrent call limits,
+	// rejections by CPS limits retry after the next call attempt is available. Default is DefaultRetryAfter.
+	RetryAfter time.Duration
+	// MaxCallDuration releases calls without BYE, default is DefaultMaxCallDuration.
+	MaxCallDuration time.Duration
+	// Namespace is a prefix of metric names, default is DefaultNamespace.
+	Namespace   string
+	ConstLabels prometheus.Labels
+}
+
+// Controller admits calls by limits.
+type Controller interface {
+	prometheus.Collector
+	// Acquire admits the call of the trunk, empty trunk is limited by global limits only.
+	// It returns *LimitError if the call is over limits, the call is counted until Release.
+	Acquire(trunk string, callID sip.CallID) error
+	// Release releases the call, like on BYE or failure of the outgoing INVITE.
+	Release(callID sip.CallID)
+	// Calls returns the number of calls of the trunk, empty trunk returns all calls.
+	Calls(trunk string) int
+	// Limits returns limits of the trunk, empty trunk returns global limits.
+	Limits(trunk string) (Limits, bool)
+	// SetLimits adjusts limits of the trunk at runtime, empty trunk adjusts global limits.
+	// Calls over the lowered limit are not released.
+	SetLimits(trunk string, limits Limits) error
+	// TrunkOf returns the name of the trunk the request is received from, empty for unknown sources.
+	TrunkOf(req sip.Request) string
+	// Middleware admits initial INVITEs and releases calls on BYE and on INVITE failures,
+	// responses must be written through the gosip.ResponseWriter.
+	Middleware() gosip.Middleware
+}
+
+// bucket is the token bucket of call attempts.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type scope struct {
+	name    string
+	limits  Limits
+	sources []*net.IPNet
+	calls   int
+	bucket  bucket
+}
+
+type call struct {
+	trunk string
+	timer timing.Timer
+}
+
+type controller struct {
+	config Config
+
+	mu     sync.Mutex
+	global *scope
+	trunks map[string]*scope
+	order  []*scope
+	calls  map[sip.CallID]*call
+
+	attempts   *prometheus.CounterVec
+	rejections *prometheus.CounterVec
+	active     *prometheus.Desc
+
+	log log.Logger
+}
+
+// NewController creates call admission control.
+func NewController(config Config, logger log.Logger) (Controller, error) {
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = DefaultRetryAfter
+	}
+	if config.MaxCallDuration <= 0 {
+		config.MaxCallDuration = DefaultMaxCallDuration
+	}
+	if config.Namespace == "" {
+		config.Namespace = DefaultNamespace
+	}
+
+	now := timing.Now()
+	c := &controller{
+		config: config,
+		global: newScope("", config.Global, now),
+		trunks: make(map[string]*scope),
+		calls:  make(map[sip.CallID]*call),
+		attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Name:        "call_attempts_total",
+			Help:        "Number of admitted call attempts by trunk, trunk is empty for unknown sources.",
+			ConstLabels: config.ConstLabels,
+		}, []string{"trunk"}),
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Name:        "call_rejections_total",
+			Help:        "Number of call attempts rejected by call admission control by trunk of the limit and limit.",
+			ConstLabels: config.ConstLabels,
+		}, []string{"trunk", "limit"}),
+		active: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "calls_active"),
+			"Number of active calls by trunk, trunk is empty for all calls.",
+			[]string{"trunk"},
+			config.ConstLabels,
+		),
+	}
+	for _, t := range config.Trunks {
+		if t.Name == "" {
+			return nil, fmt.Errorf("trunk without name")
+		}
+		if _, ok := c.trunks[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate trunk %q", t.Name)
+		}
+		sources, err := parseNetworks(t.Sources)
+		if err != nil {
+			return nil, fmt.Errorf("parse sources of trunk %q: %w", t.Name, err)
+		}
+		s := newScope(t.Name, t.Limits, now)
+		s.sources = sources
+		c.trunks[t.Name] = s
+		c.order = append(c.order, s)
+	}
+	c.log = logger.
+		WithPrefix("cac.Controller").
+		WithFields(log.Fields{
+			"controller_ptr": fmt.Sprintf("%p", c),
+		})
+
+	return c, nil
+}
+
+func newScope(name string, limits Limits, now time.Time) *scope {
+	s := &scope{name: name, bucket: bucket{last: now}}
+	s.setLimits(limits)
+	s.bucket.tokens = float64(s.limits.Burst)
+
+	return s
+}
+
+func (s *scope) setLimits(limits Limits) {
+	if limits.MaxCPS > 0 && limits.Burst <= 0 {
+		limits.Burst = int(math.Ceil(limits.MaxCPS))
+	}
+	s.limits = limits
+	if s.bucket.tokens > float64(limits.Burst) {
+		s.bucket.tokens = float64(limits.Burst)
+	}
+}
+
+// refill adds tokens of the elapsed time to the bucket.
+func (s *scope) refill(now time.Time) {
+	if s.limits.MaxCPS <= 0 {
+		return
+	}
+	if elapsed := now.Sub(s.bucket.last); elapsed > 0 {
+		s.bucket.tokens = math.Min(float64(s.limits.Burst), s.bucket.tokens+elapsed.Seconds()*s.limits.MaxCPS)
+	}
+	s.bucket.last = now
+}
+
+// check returns the limit the new call exceeds, empty if the call is admitted.
+func (s *scope) check(now time.Time) (Limit, time.Duration) {
+	if s.limits.MaxCalls > 0 && s.calls >= s.limits.MaxCalls {
+		return LimitCalls, 0
+	}
+	s.refill(now)
+	if s.limits.MaxCPS > 0 && s.bucket.tokens < 1 {
+		return LimitCPS, time.Duration((1 - s.bucket.tokens) / s.limits.MaxCPS * float64(time.Second))
+	}
+
+	return "", 0
+}
+
+func (s *scope) take() {
+	s.calls++
+	if s.limits.MaxCPS > 0 {
+		s.bucket.tokens--
+	}
+}
+
+func (c *controller) Log() log.Logger {
+	return c.log
+}
+
+func (c *controller) Acquire(trunk string, callID sip.CallID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.calls[callID]; ok {
+		return nil
+	}
+
+	scopes := []*scope{c.global}
+	if trunk != "" {
+		s, ok := c.trunks[trunk]
+		if !ok {
+			return fmt.Errorf("unknown trunk %q", trunk)
+		}
+		scopes = append(scopes, s)
+	}
+
+	now := timing.Now()
+	for _, s := range scopes {
+		if limit, wait := s.check(now); limit != "" {
+			c.rejections.WithLabelValues(s.name, string(limit)).Inc()
+			if limit == LimitCalls {
+				wait = c.config.RetryAfter
+			}
+			return &LimitError{Trunk: s.name, Limit: limit, RetryAfter: wait}
+		}
+	}
+	for _, s := range scopes {
+		s.take()
+	}
+
+	c.calls[callID] = &call{
+		trunk: trunk,
+		timer: timing.AfterFunc(c.config.MaxCallDuration, func() {
+			c.Log().Warnf("release call %s of trunk %q without BYE after %s", callID, trunk, c.config.MaxCallDuration)
+			c.Release(callID)
+		}),
+	}
+	c.attempts.WithLabelValues(trunk).Inc()
+
+	return nil
+}
+
+func (c *controller) Release(callID sip.CallID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.calls[callID]
+	if !ok {
+		return
+	}
+	delete(c.calls, callID)
+	cl.timer.Stop()
+
+	c.global.calls--
+	if s, ok := c.trunks[cl.trunk]; ok {
+		s.calls--
+	}
+}
+
+func (c *controller) Calls(trunk string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if trunk == "" {
+		return c.global.calls
+	}
+	if s, ok := c.trunks[trunk]; ok {
+		return s.calls
+	}
+
+	return 0
+}
+
+func (c *controller) Limits(trunk string) (Limits, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if trunk == "" {
+		return c.global.limits, true
+	}
+	if s, ok := c.trunks[trunk]; ok {
+		return s.limits, true
+	}
+
+	return Limits{}, false
+}
+
+func (c *controller) SetLimits(trunk string, limits Limits) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.global
+	if trunk != "" {
+		var ok bool
+		if s, ok = c.trunks[trunk]; !ok {
+			return fmt.Errorf("unknown trunk %q", trunk)
+		}
+	}
+	s.refill(timing.Now())
+	s.setLimits(limits)
+	c.Log().Infof("set limits of trunk %q to %d calls and %g CPS", trunk, limits.MaxCalls, limits.MaxCPS)
+
+	return nil
+}
+
+func (c *controller) TrunkOf(req sip.Request) string {
+	addr, _ := req.Fields()[transport.ReceivedFromField].(string)
+	if addr == "" {
+		addr = req.Source()
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return ""
+	}
+
+	for _, s := range c.order {
+		for _, network := range s.sources {
+			if network.Contains(ip) {
+				return s.name
+			}
+		}
+	}
+
+	return ""
+}
+
+func (c *controller) Middleware() gosip.Middleware {
+	return func(next gosip.HandlerFunc) gosip.HandlerFunc {
+		return func(w gosip.ResponseWriter, req sip.Request) {
+			callID, ok := req.CallID()
+			if !ok {
+				next(w, req)
+				return
+			}
+
+			switch {
+			case req.Method() == sip.BYE:
+				c.Release(*callID)
+				next(w, req)
+			case req.Method() == sip.INVITE && !inDialog(req):
+				c.admit(next, w, req, *callID)
+			default:
+				next(w, req)
+			}
+		}
+	}
+}
+
+func (c *controller) admit(next gosip.HandlerFunc, w gosip.ResponseWriter, req sip.Request, callID sip.CallID) {
+	trunk := c.TrunkOf(req)
+	if err := c.Acquire(trunk, callID); err != nil {
+		c.Log().WithFields(req.Fields()).Debugf("reject request '%s': %s", req.Short(), err)
+		retryAfter := c.config.RetryAfter
+		if limitErr, ok := err.(*LimitError); ok {
+			retryAfter = limitErr.RetryAfter
+		}
+		if err := w.Write(503, "Service Unavailable", "", &sip.GenericHeader{
+			HeaderName: "Retry-After",
+			Contents:   fmt.Sprintf("%d", int(math.Max(1, math.Ceil(retryAfter.Seconds())))),
+		}); err != nil {
+			c.Log().WithFields(req.Fields()).Warnf("failed to reject request '%s': %s", req.Short(), err)
+		}
+		return
+	}
+
+	cw := &responseWriter{ResponseWriter: w, req: req, controller: c, callID: callID}
+	if tx := w.Tx(); tx != nil {
+		// the call is released if the transaction ends without 2xx, like on CANCEL or timeout
+		go func() {
+			<-tx.Done()
+			if !cw.isAnswered() {
+				c.Release(callID)
+			}
+		}()
+	}
+	next(cw, req)
+}
+
+// responseWriter releases the call on the final error response of the INVITE.
+type responseWriter struct {
+	gosip.ResponseWriter
+	req        sip.Request
+	controller *controller
+	callID     sip.CallID
+
+	mu       sync.Mutex
+	answered bool
+}
+
+func (w *responseWriter) Write(status sip.StatusCode, reason, body string, headers ...sip.Header) error {
+	res := sip.NewResponseFromRequest("", w.req, status, reason, body)
+	for _, hdr := range headers {
+		res.AppendHeader(hdr)
+	}
+
+	return w.WriteResponse(res)
+}
+
+func (w *responseWriter) WriteResponse(res sip.Response) error {
+	code := res.StatusCode()
+	// the answer is marked before it is sent, since the transaction ends right after 2xx is sent
+	if code >= 200 && code < 300 {
+		w.mu.Lock()
+		w.answered = true
+		w.mu.Unlock()
+	}
+
+	err := w.ResponseWriter.WriteResponse(res)
+	if code >= 300 || (err != nil && code >= 200) {
+		w.controller.Release(w.callID)
+	}
+
+	return err
+}
+
+func (w *responseWriter) isAnswered() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.answered
+}
+
+func (c *controller) Describe(ch chan<- *prometheus.Desc) {
+	c.attempts.Describe(ch)
+	c.rejections.Describe(ch)
+	ch <- c.active
+}
+
+func (c *controller) Collect(ch chan<- prometheus.Metric) {
+	c.attempts.Collect(ch)
+	c.rejections.Collect(ch)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(c.global.calls), "")
+	for _, s := range c.order {
+		ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(s.calls), s.name)
+	}
+}
+
+func inDialog(req sip.Request) bool {
+	to, ok := req.To()
+	return ok && to.Params != nil && to.Params.Has("tag")
+}
+
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
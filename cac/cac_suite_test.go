@@ -0,0 +1,14 @@
+package cac_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCac(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RegisterTestingT(t)
+	RunSpecs(t, "Cac Suite")
+}
@@ -0,0 +1,186 @@
+package cac_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/cac"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+type recordingWriter struct {
+	gosip.ResponseWriter
+	req     sip.Request
+	written []sip.Response
+}
+
+func (w *recordingWriter) Tx() sip.ServerTransaction {
+	return nil
+}
+
+func (w *recordingWriter) Write(status sip.StatusCode, reason, body string, headers ...sip.Header) error {
+	res := sip.NewResponseFromRequest("", w.req, status, reason, body)
+	for _, hdr := range headers {
+		res.AppendHeader(hdr)
+	}
+	return w.WriteResponse(res)
+}
+
+func (w *recordingWriter) WriteResponse(res sip.Response) error {
+	w.written = append(w.written, res)
+	return nil
+}
+
+var _ = Describe("Controller", func() {
+	var clock timing.FakeClock
+
+	logger := testutils.NewLogrusLogger()
+
+	BeforeEach(func() {
+		clock = timing.NewFakeClock(time.Unix(0, 0))
+		timing.SetClock(clock)
+	})
+
+	AfterEach(func() {
+		timing.SetClock(nil)
+	})
+
+	request := func(method sip.RequestMethod, callID, toTag string) sip.Request {
+		to := "To: <sip:+15551234567@sbc.example.com>"
+		if toTag != "" {
+			to += ";tag=" + toTag
+		}
+		req := testutils.Request([]string{
+			string(method) + " sip:+15551234567@sbc.example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK." + callID,
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			to,
+			"Call-ID: " + callID,
+			"CSeq: 1 " + string(method),
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetSource("10.0.0.1:5060")
+		return req
+	}
+
+	It("should limit concurrent calls of trunks and of the server", func() {
+		c, err := cac.NewController(cac.Config{
+			Global: cac.Limits{MaxCalls: 3},
+			Trunks: []cac.Trunk{{Name: "carrier", Sources: []string{"10.0.0.0/8"}, Limits: cac.Limits{MaxCalls: 2}}},
+		}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(c.Acquire("carrier", "call-1")).To(Succeed())
+		Expect(c.Acquire("carrier", "call-2")).To(Succeed())
+		// the same call is counted once
+		Expect(c.Acquire("carrier", "call-2")).To(Succeed())
+
+		err = c.Acquire("carrier", "call-3")
+		Expect(err).To(Equal(&cac.LimitError{Trunk: "carrier", Limit: cac.LimitCalls, RetryAfter: cac.DefaultRetryAfter}))
+
+		Expect(c.Acquire("", "call-4")).To(Succeed())
+		err = c.Acquire("", "call-5")
+		Expect(err).To(Equal(&cac.LimitError{Limit: cac.LimitCalls, RetryAfter: cac.DefaultRetryAfter}))
+		Expect(c.Calls("")).To(Equal(3))
+		Expect(c.Calls("carrier")).To(Equal(2))
+
+		c.Release("call-1")
+		Expect(c.Acquire("carrier", "call-3")).To(Succeed())
+		Expect(c.Calls("carrier")).To(Equal(2))
+
+		Expect(c.Acquire("unknown", "call-6")).ShouldNot(Succeed())
+	})
+
+	It("should limit call attempts per second and adjust limits at runtime", func() {
+		c, err := cac.NewController(cac.Config{
+			Trunks: []cac.Trunk{{Name: "carrier", Limits: cac.Limits{MaxCPS: 2}}},
+		}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(c.Acquire("carrier", "call-1")).To(Succeed())
+		Expect(c.Acquire("carrier", "call-2")).To(Succeed())
+		err = c.Acquire("carrier", "call-3")
+		Expect(err).To(Equal(&cac.LimitError{Trunk: "carrier", Limit: cac.LimitCPS, RetryAfter: 500 * time.Millisecond}))
+
+		clock.Advance(500 * time.Millisecond)
+		Expect(c.Acquire("carrier", "call-3")).To(Succeed())
+		Expect(c.Acquire("carrier", "call-4")).ShouldNot(Succeed())
+
+		Expect(c.SetLimits("carrier", cac.Limits{})).To(Succeed())
+		Expect(c.Acquire("carrier", "call-4")).To(Succeed())
+		limits, ok := c.Limits("carrier")
+		Expect(ok).To(BeTrue())
+		Expect(limits).To(Equal(cac.Limits{}))
+
+		Expect(c.SetLimits("", cac.Limits{MaxCalls: 1})).To(Succeed())
+		Expect(c.Acquire("carrier", "call-5")).ShouldNot(Succeed())
+		Expect(c.SetLimits("unknown", cac.Limits{})).ShouldNot(Succeed())
+	})
+
+	It("should release calls without BYE after the max duration", func() {
+		c, err := cac.NewController(cac.Config{MaxCallDuration: time.Hour}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(c.Acquire("", "call-1")).To(Succeed())
+		clock.Advance(time.Hour)
+		Eventually(func() int { return c.Calls("") }).Should(Equal(0))
+	})
+
+	It("should admit INVITEs and release calls by the middleware", func() {
+		c, err := cac.NewController(cac.Config{
+			Trunks: []cac.Trunk{{Name: "carrier", Sources: []string{"10.0.0.0/8"}, Limits: cac.Limits{MaxCalls: 1}}},
+		}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var status sip.StatusCode
+		handler := c.Middleware()(func(w gosip.ResponseWriter, req sip.Request) {
+			if req.IsInvite() {
+				Expect(w.Write(status, "", "")).To(Succeed())
+			}
+		})
+
+		serve := func(req sip.Request) *recordingWriter {
+			w := &recordingWriter{req: req}
+			handler(w, req)
+			return w
+		}
+
+		Expect(c.TrunkOf(request(sip.INVITE, "call-1", ""))).To(Equal("carrier"))
+
+		// failed call is released
+		status = 486
+		w := serve(request(sip.INVITE, "call-1", ""))
+		Expect(w.written).To(HaveLen(1))
+		Expect(w.written[0].StatusCode()).To(Equal(sip.StatusCode(486)))
+		Expect(c.Calls("carrier")).To(Equal(0))
+
+		// answered call is held until BYE
+		status = 200
+		serve(request(sip.INVITE, "call-2", ""))
+		Expect(c.Calls("carrier")).To(Equal(1))
+
+		w = serve(request(sip.INVITE, "call-3", ""))
+		Expect(w.written).To(HaveLen(1))
+		Expect(w.written[0].StatusCode()).To(Equal(sip.StatusCode(503)))
+		Expect(w.written[0].GetHeaders("Retry-After")).To(HaveLen(1))
+		Expect(w.written[0].GetHeaders("Retry-After")[0].Value()).To(Equal("5"))
+
+		// re-INVITE of the call is not limited
+		w = serve(request(sip.INVITE, "call-2", "bob-tag"))
+		Expect(w.written[0].StatusCode()).To(Equal(sip.StatusCode(200)))
+
+		serve(request(sip.BYE, "call-2", "bob-tag"))
+		Expect(c.Calls("carrier")).To(Equal(0))
+
+		Expect(testutil.CollectAndCount(c, "gosip_calls_active")).To(Equal(2))
+		Expect(testutil.CollectAndCount(c, "gosip_call_rejections_total")).To(Equal(1))
+	})
+})
@@ -0,0 +1,316 @@
+// callerprefs package implements caller preferences - RFC 3841 and feature tags of contacts - RFC 3840.
+// Callers express preferences with Accept-Contact, Reject-Contact and Request-Disposition headers,
+// registrars and proxies use Select to filter and order registered contacts of the target.
+package callerprefs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// FeatureSet is a set of feature tags with their values - RFC 3840 9.
+// Value is a raw unquoted tag value, empty value is boolean TRUE.
+type FeatureSet map[string]string
+
+// baseTags are feature tags registered by RFC 3840 10, used in Contact params without '+' prefix.
+var baseTags = map[string]bool{
+	"actor":       true,
+	"application": true,
+	"audio":       true,
+	"automata":    true,
+	"class":       true,
+	"control":     true,
+	"data":        true,
+	"description": true,
+	"duplex":      true,
+	"events":      true,
+	"extensions":  true,
+	"isfocus":     true,
+	"language":    true,
+	"methods":     true,
+	"mobility":    true,
+	"priority":    true,
+	"schemes":     true,
+	"text":        true,
+	"type":        true,
+	"video":       true,
+}
+
+// IsFeatureTag checks that the param name is a feature tag: the base tag or the '+' prefixed tag - RFC 3840 9.
+func IsFeatureTag(name string) bool {
+	name = strings.ToLower(name)
+	return baseTags[name] || (strings.HasPrefix(name, "+") && len(name) > 1)
+}
+
+// FeatureSetOf returns feature tags of the Contact header params.
+func FeatureSetOf(contact *sip.ContactHeader) FeatureSet {
+	features := make(FeatureSet)
+	if contact == nil || contact.Params == nil {
+		return features
+	}
+
+	for _, name := range contact.Params.Keys() {
+		if !IsFeatureTag(name) {
+			continue
+		}
+		value, _ := contact.Params.Get(name)
+		if value != nil {
+			features[strings.ToLower(name)] = value.String()
+		} else {
+			features[strings.ToLower(name)] = ""
+		}
+	}
+
+	return features
+}
+
+// Predicate is a feature predicate of Accept-Contact or Reject-Contact value - RFC 3841 9.2.
+type Predicate struct {
+	Features FeatureSet
+	// Require discards contacts that do not match the predicate.
+	Require bool
+	// Explicit matches only contacts that explicitly declare all feature tags of the predicate.
+	Explicit bool
+}
+
+func (pred Predicate) String() string {
+	var buf strings.Builder
+	buf.WriteString("*")
+
+	names := make([]string, 0, len(pred.Features))
+	for name := range pred.Features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf.WriteString(";" + name)
+		if value := pred.Features[name]; value != "" {
+			buf.WriteString("=\"" + value + "\"")
+		}
+	}
+	if pred.Require {
+		buf.WriteString(";require")
+	}
+	if pred.Explicit {
+		buf.WriteString(";explicit")
+	}
+
+	return buf.String()
+}
+
+// AcceptContact is a value of the Accept-Contact header - RFC 3841 9.2.
+type AcceptContact []Predicate
+
+func (ac AcceptContact) String() string {
+	return joinPredicates(ac)
+}
+
+func (ac AcceptContact) Header() sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Accept-Contact",
+		Contents:   ac.String(),
+	}
+}
+
+// RejectContact is a value of the Reject-Contact header - RFC 3841 9.2.
+type RejectContact []Predicate
+
+func (rc RejectContact) String() string {
+	return joinPredicates(rc)
+}
+
+func (rc RejectContact) Header() sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Reject-Contact",
+		Contents:   rc.String(),
+	}
+}
+
+// RequestDisposition is a value of the Request-Disposition header - RFC 3841 9.1.
+// Zero value is the default behavior: proxy, cancel, fork, recurse, parallel, no-queue.
+type RequestDisposition struct {
+	Redirect   bool
+	NoCancel   bool
+	NoFork     bool
+	NoRecurse  bool
+	Sequential bool
+	Queue      bool
+}
+
+func (rd RequestDisposition) String() string {
+	directives := []string{
+		pick(rd.Redirect, "redirect", "proxy"),
+		pick(rd.NoCancel, "no-cancel", "cancel"),
+		pick(rd.NoFork, "no-fork", "fork"),
+		pick(rd.NoRecurse, "no-recurse", "recurse"),
+		pick(rd.Sequential, "sequential", "parallel"),
+		pick(rd.Queue, "queue", "no-queue"),
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+func (rd RequestDisposition) Header() sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Request-Disposition",
+		Contents:   rd.String(),
+	}
+}
+
+// ParseRequestDisposition parses Request-Disposition header value.
+func ParseRequestDisposition(value string) (RequestDisposition, error) {
+	var rd RequestDisposition
+	for _, directive := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "proxy":
+			rd.Redirect = false
+		case "redirect":
+			rd.Redirect = true
+		case "cancel":
+			rd.NoCancel = false
+		case "no-cancel":
+			rd.NoCancel = true
+		case "fork":
+			rd.NoFork = false
+		case "no-fork":
+			rd.NoFork = true
+		case "recurse":
+			rd.NoRecurse = false
+		case "no-recurse":
+			rd.NoRecurse = true
+		case "parallel":
+			rd.Sequential = false
+		case "sequential":
+			rd.Sequential = true
+		case "queue":
+			rd.Queue = true
+		case "no-queue":
+			rd.Queue = false
+		default:
+			return RequestDisposition{}, fmt.Errorf("invalid directive in Request-Disposition '%s'", value)
+		}
+	}
+
+	return rd, nil
+}
+
+// ParsePredicates parses Accept-Contact or Reject-Contact header value.
+func ParsePredicates(value string) ([]Predicate, error) {
+	var preds []Predicate
+	for _, item := range splitQuoted(value, ',') {
+		params := splitQuoted(item, ';')
+		if strings.TrimSpace(params[0]) != "*" {
+			return nil, fmt.Errorf("invalid feature predicate '%s'", item)
+		}
+
+		pred := Predicate{Features: make(FeatureSet)}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			name := strings.ToLower(strings.TrimSpace(kv[0]))
+			val := ""
+			if len(kv) == 2 {
+				val = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			}
+
+			switch {
+			case name == "require":
+				pred.Require = true
+			case name == "explicit":
+				pred.Explicit = true
+			case IsFeatureTag(name):
+				pred.Features[name] = val
+			}
+		}
+		preds = append(preds, pred)
+	}
+
+	return preds, nil
+}
+
+// GetAcceptContact returns predicates of all Accept-Contact headers of the request, also matches compact form 'a'.
+func GetAcceptContact(req sip.Request) (AcceptContact, error) {
+	return getPredicates(req, "Accept-Contact", "a")
+}
+
+// GetRejectContact returns predicates of all Reject-Contact headers of the request, also matches compact form 'j'.
+func GetRejectContact(req sip.Request) (RejectContact, error) {
+	return getPredicates(req, "Reject-Contact", "j")
+}
+
+// GetRequestDisposition returns Request-Disposition of the request, also matches compact form 'd'.
+func GetRequestDisposition(req sip.Request) (RequestDisposition, bool) {
+	hdrs := getHeaders(req, "Request-Disposition", "d")
+	if len(hdrs) == 0 {
+		return RequestDisposition{}, false
+	}
+
+	values := make([]string, 0, len(hdrs))
+	for _, hdr := range hdrs {
+		values = append(values, hdr.Value())
+	}
+	rd, err := ParseRequestDisposition(strings.Join(values, ","))
+	if err != nil {
+		return RequestDisposition{}, false
+	}
+
+	return rd, true
+}
+
+func getPredicates(req sip.Request, name, compact string) ([]Predicate, error) {
+	var preds []Predicate
+	for _, hdr := range getHeaders(req, name, compact) {
+		values, err := ParsePredicates(hdr.Value())
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+		preds = append(preds, values...)
+	}
+
+	return preds, nil
+}
+
+// getHeaders returns headers of the full and compact forms.
+func getHeaders(req sip.Request, name, compact string) []sip.Header {
+	hdrs := make([]sip.Header, 0)
+	hdrs = append(hdrs, req.GetHeaders(name)...)
+
+	return append(hdrs, req.GetHeaders(compact)...)
+}
+
+func joinPredicates(preds []Predicate) string {
+	values := make([]string, 0, len(preds))
+	for _, pred := range preds {
+		values = append(values, pred.String())
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// splitQuoted splits the value by the separator outside of quotes.
+func splitQuoted(value string, sep rune) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, r := range value {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == sep && !quoted:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, value[start:])
+}
+
+func pick(cond bool, yes, no string) string {
+	if cond {
+		return yes
+	}
+
+	return no
+}
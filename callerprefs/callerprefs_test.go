@@ -0,0 +1,152 @@
+package callerprefs_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/callerprefs"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+func invite(headers ...string) sip.Request {
+	lines := []string{
+		"INVITE sip:bob@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+		"From: <sip:alice@example.com>;tag=alice-tag",
+		"To: <sip:bob@example.com>",
+		"Call-ID: callerprefs-call-id",
+		"CSeq: 1 INVITE",
+	}
+	lines = append(lines, headers...)
+	lines = append(lines, "", "")
+
+	return testutils.Request(lines)
+}
+
+func contacts(values ...string) []*sip.ContactHeader {
+	lines := []string{
+		"SIP/2.0 200 OK",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1",
+		"From: <sip:bob@example.com>;tag=reg-tag",
+		"To: <sip:bob@example.com>;tag=to-tag",
+		"Call-ID: register-call-id",
+		"CSeq: 1 REGISTER",
+	}
+	for _, value := range values {
+		lines = append(lines, "Contact: "+value)
+	}
+	lines = append(lines, "", "")
+
+	var result []*sip.ContactHeader
+	for _, hdr := range testutils.Response(lines).GetHeaders("Contact") {
+		result = append(result, hdr.(*sip.ContactHeader))
+	}
+
+	return result
+}
+
+func uris(candidates []callerprefs.Candidate) []string {
+	result := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		result = append(result, candidate.Contact.Address.String())
+	}
+
+	return result
+}
+
+var _ = Describe("Caller preferences", func() {
+	It("should parse and format headers", func() {
+		req := invite(
+			`Accept-Contact: *;audio;require, *;methods="INVITE,BYE";explicit`,
+			`a: *;+sip.instance="<urn:uuid:1>"`,
+			`j: *;video`,
+			`Request-Disposition: redirect, no-fork`,
+		)
+
+		accept, err := callerprefs.GetAcceptContact(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(accept).To(Equal(callerprefs.AcceptContact{
+			{Features: callerprefs.FeatureSet{"audio": ""}, Require: true},
+			{Features: callerprefs.FeatureSet{"methods": "INVITE,BYE"}, Explicit: true},
+			{Features: callerprefs.FeatureSet{"+sip.instance": "<urn:uuid:1>"}},
+		}))
+		Expect(accept.String()).To(Equal(
+			`*;audio;require, *;methods="INVITE,BYE";explicit, *;+sip.instance="<urn:uuid:1>"`,
+		))
+
+		reject, err := callerprefs.GetRejectContact(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reject.Header().String()).To(Equal("Reject-Contact: *;video"))
+
+		rd, ok := callerprefs.GetRequestDisposition(req)
+		Expect(ok).To(BeTrue())
+		Expect(rd).To(Equal(callerprefs.RequestDisposition{Redirect: true, NoFork: true}))
+		Expect(rd.String()).To(Equal("redirect, cancel, no-fork, recurse, parallel, no-queue"))
+
+		_, err = callerprefs.ParsePredicates("sip:bob@example.com;audio")
+		Expect(err).To(HaveOccurred())
+		_, err = callerprefs.ParseRequestDisposition("proxy, maybe")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should match feature values", func() {
+		features := callerprefs.FeatureSet{
+			"audio":    "",
+			"methods":  "INVITE,BYE",
+			"priority": "#=5",
+			"+sip.app": "<Calendar>",
+		}
+
+		match := func(name, value string) bool {
+			_, ok := callerprefs.Match(callerprefs.Predicate{Features: callerprefs.FeatureSet{name: value}}, features)
+			return ok
+		}
+		Expect(match("audio", "")).To(BeTrue())
+		Expect(match("audio", "FALSE")).To(BeFalse())
+		Expect(match("methods", "bye")).To(BeTrue())
+		Expect(match("methods", "MESSAGE")).To(BeFalse())
+		Expect(match("methods", "!MESSAGE")).To(BeTrue())
+		Expect(match("priority", "#>=3")).To(BeTrue())
+		Expect(match("priority", "#1:4")).To(BeFalse())
+		Expect(match("+sip.app", "<Calendar>")).To(BeTrue())
+		Expect(match("+sip.app", "<calendar>")).To(BeFalse())
+		// absent tags do not prevent the match unless the predicate is explicit
+		Expect(match("video", "")).To(BeTrue())
+		_, ok := callerprefs.Match(callerprefs.Predicate{
+			Features: callerprefs.FeatureSet{"video": ""},
+			Explicit: true,
+		}, features)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should select and order contacts - RFC 3841 example", func() {
+		targets := contacts(
+			"<sip:bob@pc.example.com>;audio;video;methods=\"INVITE,BYE\";q=0.5",
+			"<sip:bob@phone.example.com>;audio;methods=\"INVITE,BYE\";q=0.5",
+			"<sip:bob@pager.example.com>;methods=\"MESSAGE\";q=0.5",
+			"<sip:bob@legacy.example.com>;q=0.2",
+			"<sip:bob@mobile.example.com>;audio;mobility=\"mobile\";q=0.5",
+		)
+
+		candidates, err := callerprefs.Select(invite(
+			"Accept-Contact: *;audio;video",
+			"Reject-Contact: *;mobility=\"mobile\"",
+		), targets)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uris(candidates)).To(Equal([]string{
+			"sip:bob@pc.example.com",
+			"sip:bob@phone.example.com",
+			"sip:bob@legacy.example.com",
+		}))
+		Expect(candidates[0].Score).To(BeNumerically("~", 1, 0.001))
+		Expect(candidates[1].Score).To(BeNumerically("~", 0.5, 0.001))
+
+		candidates, err = callerprefs.Select(invite("Accept-Contact: *;video;require;explicit"), targets)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uris(candidates)).To(Equal([]string{
+			"sip:bob@pc.example.com",
+			"sip:bob@legacy.example.com",
+		}))
+	})
+})
@@ -0,0 +1,268 @@
+package callerprefs
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Candidate is a contact that satisfies caller preferences.
+type Candidate struct {
+	Contact *sip.ContactHeader
+	// Q is a contact preference from the 'q' param, default is 1.
+	Q float64
+	// Score is an Accept-Contact score from 0 to 1 - RFC 3841 7.2.4.
+	Score float64
+}
+
+// Select applies caller preferences of the request to the target contacts - RFC 3841 7.2.
+// Contacts matched by Reject-Contact predicates, contacts that do not match required
+// Accept-Contact predicates and contacts that do not support the request method are discarded.
+// Candidates are ordered by q-value, contacts with equal q-value by Accept-Contact score.
+// Contacts without feature tags are immune to preferences and get the highest score.
+func Select(req sip.Request, contacts []*sip.ContactHeader) ([]Candidate, error) {
+	accept, err := GetAcceptContact(req)
+	if err != nil {
+		return nil, err
+	}
+	reject, err := GetRejectContact(req)
+	if err != nil {
+		return nil, err
+	}
+	implicit := implicitPredicates(req)
+
+	candidates := make([]Candidate, 0, len(contacts))
+	for _, contact := range contacts {
+		features := FeatureSetOf(contact)
+		if len(features) > 0 {
+			if rejected(features, reject) || !satisfies(features, implicit) {
+				continue
+			}
+		}
+
+		score, ok := acceptScore(features, accept)
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, Candidate{
+			Contact: contact,
+			Q:       contactQ(contact),
+			Score:   score,
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Q != candidates[j].Q {
+			return candidates[i].Q > candidates[j].Q
+		}
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	return candidates, nil
+}
+
+// Match evaluates the predicate against the feature set.
+// Returns the number of predicate tags present in the feature set and whether present tags match,
+// absent tags are ignored unless the predicate is explicit.
+func Match(pred Predicate, features FeatureSet) (int, bool) {
+	present := 0
+	for name, value := range pred.Features {
+		contactValue, ok := features[name]
+		if !ok {
+			continue
+		}
+		present++
+		if !matchValue(value, contactValue) {
+			return present, false
+		}
+	}
+	if pred.Explicit && present < len(pred.Features) {
+		return present, false
+	}
+
+	return present, true
+}
+
+// implicitPredicates are implied by the request - RFC 3841 7.2.2: the contact must support
+// the method and the event package of SUBSCRIBE.
+func implicitPredicates(req sip.Request) []Predicate {
+	preds := []Predicate{{
+		Features: FeatureSet{"methods": string(req.Method())},
+		Require:  true,
+	}}
+	if req.Method() == sip.SUBSCRIBE {
+		if hdrs := req.GetHeaders("Event"); len(hdrs) > 0 {
+			pkg := strings.TrimSpace(strings.SplitN(hdrs[0].Value(), ";", 2)[0])
+			preds = append(preds, Predicate{
+				Features: FeatureSet{"events": pkg},
+				Require:  true,
+			})
+		}
+	}
+
+	return preds
+}
+
+// rejected checks that the contact declares all tags of any Reject-Contact predicate and matches it - RFC 3841 7.2.3.
+func rejected(features FeatureSet, reject []Predicate) bool {
+	for _, pred := range reject {
+		if present, ok := Match(pred, features); ok && present == len(pred.Features) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func satisfies(features FeatureSet, preds []Predicate) bool {
+	for _, pred := range preds {
+		if _, ok := Match(pred, features); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// acceptScore computes the average score of Accept-Contact predicates - RFC 3841 7.2.4.
+// The predicate score is the fraction of its tags that the contact declares and matches.
+func acceptScore(features FeatureSet, accept []Predicate) (float64, bool) {
+	if len(accept) == 0 || len(features) == 0 {
+		return 1, true
+	}
+
+	var total float64
+	for _, pred := range accept {
+		present, ok := Match(pred, features)
+		switch {
+		case !ok && pred.Require:
+			return 0, false
+		case !ok:
+		case len(pred.Features) == 0:
+			total++
+		default:
+			total += float64(present) / float64(len(pred.Features))
+		}
+	}
+
+	return total / float64(len(accept)), true
+}
+
+func contactQ(contact *sip.ContactHeader) float64 {
+	if contact.Params != nil {
+		if val, ok := contact.Params.Get("q"); ok && val != nil {
+			if q, err := strconv.ParseFloat(val.String(), 64); err == nil && q >= 0 && q <= 1 {
+				return q
+			}
+		}
+	}
+
+	return 1
+}
+
+// term is a single value of the feature tag value list - RFC 3840 9.
+type term struct {
+	negated bool
+	// kind is one of 'b' boolean, 't' token, 's' string and 'n' numeric
+	kind  byte
+	value string
+	min   float64
+	max   float64
+}
+
+func parseTerms(value string) []term {
+	if value == "" {
+		return []term{{kind: 'b', value: "TRUE"}}
+	}
+
+	var terms []term
+	for _, item := range splitQuoted(value, ',') {
+		item = strings.TrimSpace(item)
+		t := term{}
+		if strings.HasPrefix(item, "!") {
+			t.negated = true
+			item = item[1:]
+		}
+
+		switch {
+		case strings.EqualFold(item, "TRUE") || strings.EqualFold(item, "FALSE"):
+			t.kind, t.value = 'b', strings.ToUpper(item)
+		case strings.HasPrefix(item, "<") && strings.HasSuffix(item, ">"):
+			t.kind, t.value = 's', item[1:len(item)-1]
+		case strings.HasPrefix(item, "#"):
+			var err error
+			if t.min, t.max, err = parseNumeric(item[1:]); err != nil {
+				t.kind, t.value = 't', strings.ToLower(item)
+			} else {
+				t.kind = 'n'
+			}
+		default:
+			t.kind, t.value = 't', strings.ToLower(item)
+		}
+		terms = append(terms, t)
+	}
+
+	return terms
+}
+
+// parseNumeric parses '=n', '<=n', '>=n', 'a:b' or 'n' into the closed interval.
+func parseNumeric(value string) (float64, float64, error) {
+	var (
+		min, max = math.Inf(-1), math.Inf(1)
+		num      float64
+		err      error
+	)
+	switch {
+	case strings.HasPrefix(value, "<="):
+		max, err = strconv.ParseFloat(value[2:], 64)
+	case strings.HasPrefix(value, ">="):
+		min, err = strconv.ParseFloat(value[2:], 64)
+	case strings.Contains(value, ":"):
+		parts := strings.SplitN(value, ":", 2)
+		if min, err = strconv.ParseFloat(parts[0], 64); err == nil {
+			max, err = strconv.ParseFloat(parts[1], 64)
+		}
+	default:
+		num, err = strconv.ParseFloat(strings.TrimPrefix(value, "="), 64)
+		min, max = num, num
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid numeric value '%s': %w", value, err)
+	}
+
+	return min, max, nil
+}
+
+func (t term) equals(other term) bool {
+	if t.kind != other.kind {
+		return false
+	}
+	if t.kind == 'n' {
+		return t.min <= other.max && other.min <= t.max
+	}
+
+	return t.value == other.value
+}
+
+// matchValue checks that any term of the predicate value matches the contact value.
+func matchValue(predValue, contactValue string) bool {
+	contactTerms := parseTerms(contactValue)
+	for _, pt := range parseTerms(predValue) {
+		found := false
+		for _, ct := range contactTerms {
+			if !ct.negated && pt.equals(ct) {
+				found = true
+				break
+			}
+		}
+		if found != pt.negated {
+			return true
+		}
+	}
+
+	return false
+}
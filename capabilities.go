@@ -0,0 +1,51 @@
+package gosip
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// OptionsResponder describes built-in answers on out-of-dialog OPTIONS requests - RFC 3261 11.2.
+// The response advertises capabilities of the server in Allow, Supported and Accept headers,
+// see ServerConfig.Extensions and ServerConfig.Accept.
+// OPTIONS handler registered by the application overrides the responder.
+type OptionsResponder struct {
+	// Body is an optional SDP describing media capabilities of the server.
+	Body string
+	// Status returns status of the response, like '486 Busy Here' when the new INVITE would be rejected.
+	// Nil always answers '200 OK'.
+	Status func(req sip.Request) (sip.StatusCode, string)
+}
+
+func (r *OptionsResponder) response(req sip.Request) sip.Response {
+	code, reason := sip.StatusCode(200), "OK"
+	if r.Status != nil {
+		code, reason = r.Status(req)
+	}
+
+	res := sip.NewResponseFromRequest("", req, code, reason, "")
+	if r.Body != "" && code < 300 {
+		contentType := sip.ContentType("application/sdp")
+		res.AppendHeader(&contentType)
+		res.SetBody(r.Body, true)
+	}
+
+	return res
+}
+
+// answersOptions checks that the request is out-of-dialog OPTIONS answered by the responder.
+func (srv *server) answersOptions(req sip.Request) bool {
+	if srv.optionsResponder == nil || req.Method() != sip.OPTIONS {
+		return false
+	}
+	to, ok := req.To()
+	if !ok {
+		return false
+	}
+	if to.Params != nil {
+		if _, ok := to.Params.Get("tag"); ok {
+			return false
+		}
+	}
+
+	return true
+}
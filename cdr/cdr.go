@@ -0,0 +1,432 @@
+// cdr package aggregates call detail records of INVITE dialogs observed by the server.
+// Recorder implements gosip.Observer, so it is passed to gosip.ServerConfig directly or with gosip.Observers.
+package cdr
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// DefaultRecordTTL limits duration of calls without release, like calls with lost BYE.
+const DefaultRecordTTL = 24 * time.Hour
+
+const (
+	Inbound  = "inbound"
+	Outbound = "outbound"
+
+	ReleasedLocal  = "local"
+	ReleasedRemote = "remote"
+)
+
+// Record is a call detail record of the INVITE dialog.
+type Record struct {
+	CallID     string `json:"call_id"`
+	Direction  string `json:"direction"`
+	FromURI    string `json:"from_uri"`
+	ToURI      string `json:"to_uri"`
+	RequestURI string `json:"request_uri"`
+
+	// SetupTime is the time of the initial INVITE.
+	SetupTime time.Time `json:"setup_time"`
+	// RingingTime is the time of the first 180 or 183 response, zero if there was no ringing.
+	RingingTime time.Time `json:"ringing_time"`
+	// AnswerTime is the time of the 2xx response, zero if the call was not answered.
+	AnswerTime time.Time `json:"answer_time"`
+	// ReleaseTime is the time of BYE or the final non-2xx response.
+	ReleaseTime time.Time `json:"release_time"`
+
+	// ReleaseCode is a final SIP status of the call, 200 for calls released with BYE.
+	ReleaseCode sip.StatusCode `json:"release_code"`
+	// ReleaseReason is a reason phrase of the final response or text of the Reason header.
+	ReleaseReason string `json:"release_reason,omitempty"`
+	// Q850Cause is taken from the Reason header or mapped from ReleaseCode - RFC 3326, RFC 3398.
+	Q850Cause int `json:"q850_cause,omitempty"`
+	// ReleasedBy is ReleasedLocal or ReleasedRemote side of the call.
+	ReleasedBy string `json:"released_by,omitempty"`
+	// Expired is set when the record is emitted after Config.RecordTTL without release.
+	Expired bool `json:"expired,omitempty"`
+
+	Transport       string `json:"transport"`
+	RemoteAddr      string `json:"remote_addr"`
+	MessagesIn      int    `json:"messages_in"`
+	MessagesOut     int    `json:"messages_out"`
+	BytesIn         int    `json:"bytes_in"`
+	BytesOut        int    `json:"bytes_out"`
+	Retransmissions int    `json:"retransmissions"`
+}
+
+// Answered reports whether the call was answered.
+func (rec *Record) Answered() bool {
+	return !rec.AnswerTime.IsZero()
+}
+
+// SetupDuration returns time from the INVITE to the answer or release.
+func (rec *Record) SetupDuration() time.Duration {
+	if rec.Answered() {
+		return rec.AnswerTime.Sub(rec.SetupTime)
+	}
+
+	return rec.ReleaseTime.Sub(rec.SetupTime)
+}
+
+// Duration returns billable duration of the answered call.
+func (rec *Record) Duration() time.Duration {
+	if !rec.Answered() {
+		return 0
+	}
+
+	return rec.ReleaseTime.Sub(rec.AnswerTime)
+}
+
+// Config describes CDR options.
+type Config struct {
+	// OnRecord receives completed records.
+	OnRecord func(rec Record)
+	// OnAnswer receives records of calls at the answer, like to start accounting sessions.
+	OnAnswer func(rec Record)
+	// Output receives completed records as JSON lines, like CDR file.
+	Output io.Writer
+	// RecordTTL is a maximum lifetime of the record, default is DefaultRecordTTL.
+	RecordTTL time.Duration
+}
+
+// Recorder aggregates records of calls from messages passed by the server.
+// The record is started by the initial INVITE and completed by BYE or the final non-2xx response.
+type Recorder interface {
+	gosip.Observer
+	// Active returns copies of records of calls in progress.
+	Active() []Record
+}
+
+type call struct {
+	rec   Record
+	timer timing.Timer
+}
+
+type recorder struct {
+	onRecord func(rec Record)
+	onAnswer func(rec Record)
+	ttl      time.Duration
+
+	outMu sync.Mutex
+	out   io.Writer
+
+	mu    sync.Mutex
+	calls map[string]*call
+
+	log log.Logger
+}
+
+// NewRecorder creates CDR recorder.
+func NewRecorder(config Config, logger log.Logger) Recorder {
+	if config.RecordTTL <= 0 {
+		config.RecordTTL = DefaultRecordTTL
+	}
+
+	r := &recorder{
+		onRecord: config.OnRecord,
+		onAnswer: config.OnAnswer,
+		out:      config.Output,
+		ttl:      config.RecordTTL,
+		calls:    make(map[string]*call),
+	}
+	r.log = logger.WithPrefix("cdr.Recorder")
+
+	return r
+}
+
+func (r *recorder) Log() log.Logger {
+	return r.log
+}
+
+func (r *recorder) MessageReceived(msg sip.Message) {
+	r.message(msg, true)
+}
+
+func (r *recorder) MessageSent(msg sip.Message) {
+	r.message(msg, false)
+}
+
+func (r *recorder) Retransmission(msg sip.Message) {
+	callID, ok := msg.CallID()
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	if c, ok := r.calls[callID.Value()]; ok {
+		c.rec.Retransmissions++
+	}
+	r.mu.Unlock()
+}
+
+func (r *recorder) TransactionCompleted(method sip.RequestMethod, client bool, duration time.Duration) {
+}
+
+func (r *recorder) ParseError(err error) {}
+
+func (r *recorder) DNSFailure(err error) {}
+
+func (r *recorder) Active() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records := make([]Record, 0, len(r.calls))
+	for _, c := range r.calls {
+		records = append(records, c.rec)
+	}
+
+	return records
+}
+
+func (r *recorder) message(msg sip.Message, incoming bool) {
+	callID, ok := msg.CallID()
+	if !ok {
+		return
+	}
+	cseq, ok := msg.CSeq()
+	if !ok {
+		return
+	}
+
+	now := timing.Now()
+	key := callID.Value()
+
+	r.mu.Lock()
+	c, ok := r.calls[key]
+	if !ok {
+		req, isReq := msg.(sip.Request)
+		if !isReq || !req.IsInvite() || hasToTag(req) {
+			r.mu.Unlock()
+			return
+		}
+
+		c = r.start(key, req, incoming, now)
+	}
+
+	if incoming {
+		c.rec.MessagesIn++
+		c.rec.BytesIn += len(msg.String())
+	} else {
+		c.rec.MessagesOut++
+		c.rec.BytesOut += len(msg.String())
+	}
+
+	var released, answered bool
+	switch msg := msg.(type) {
+	case sip.Request:
+		if msg.Method() == sip.BYE && c.rec.Answered() {
+			c.rec.ReleaseCode = 200
+			c.rec.Q850Cause = 16
+			c.rec.ReleasedBy = side(incoming)
+			released = true
+			applyReason(&c.rec, msg)
+		}
+	case sip.Response:
+		if cseq.MethodName != sip.INVITE || c.rec.Answered() {
+			break
+		}
+
+		switch code := msg.StatusCode(); {
+		case code == 180 || code == 183:
+			if c.rec.RingingTime.IsZero() {
+				c.rec.RingingTime = now
+			}
+		case code >= 200 && code < 300:
+			c.rec.AnswerTime = now
+			answered = true
+		case code >= 300:
+			c.rec.ReleaseCode = code
+			c.rec.ReleaseReason = msg.Reason()
+			c.rec.Q850Cause = Q850Cause(code)
+			c.rec.ReleasedBy = side(incoming)
+			released = true
+			applyReason(&c.rec, msg)
+		}
+	}
+
+	if !released {
+		rec := c.rec
+		r.mu.Unlock()
+		if answered && r.onAnswer != nil {
+			r.onAnswer(rec)
+		}
+		return
+	}
+
+	c.rec.ReleaseTime = now
+	c.timer.Stop()
+	delete(r.calls, key)
+	rec := c.rec
+	r.mu.Unlock()
+
+	r.emit(rec)
+}
+
+// start creates the record of the initial INVITE, it must be called under lock.
+func (r *recorder) start(key string, req sip.Request, incoming bool, now time.Time) *call {
+	c := &call{
+		rec: Record{
+			CallID:     key,
+			Direction:  Outbound,
+			RequestURI: req.Recipient().String(),
+			SetupTime:  now,
+			Transport:  req.Transport(),
+			RemoteAddr: req.Destination(),
+		},
+	}
+	if incoming {
+		c.rec.Direction = Inbound
+		c.rec.RemoteAddr = req.Source()
+	}
+	if from, ok := req.From(); ok && from.Address != nil {
+		c.rec.FromURI = from.Address.String()
+	}
+	if to, ok := req.To(); ok && to.Address != nil {
+		c.rec.ToURI = to.Address.String()
+	}
+
+	c.timer = timing.AfterFunc(r.ttl, func() {
+		r.mu.Lock()
+		if r.calls[key] != c {
+			r.mu.Unlock()
+			return
+		}
+		delete(r.calls, key)
+		c.rec.ReleaseTime = timing.Now()
+		c.rec.Expired = true
+		rec := c.rec
+		r.mu.Unlock()
+
+		r.emit(rec)
+	})
+	r.calls[key] = c
+
+	return c
+}
+
+func (r *recorder) emit(rec Record) {
+	if r.onRecord != nil {
+		r.onRecord(rec)
+	}
+	if r.out == nil {
+		return
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		r.Log().Errorf("marshal CDR of call %s failed: %s", rec.CallID, err)
+		return
+	}
+
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+
+	if _, err := r.out.Write(append(data, '\n')); err != nil {
+		r.Log().Errorf("write CDR of call %s failed: %s", rec.CallID, err)
+	}
+}
+
+func side(incoming bool) string {
+	if incoming {
+		return ReleasedRemote
+	}
+
+	return ReleasedLocal
+}
+
+func hasToTag(req sip.Request) bool {
+	to, ok := req.To()
+	if !ok || to.Params == nil {
+		return false
+	}
+	tag, ok := to.Params.Get("tag")
+
+	return ok && tag != nil && tag.String() != ""
+}
+
+// applyReason overrides release cause with Q.850 Reason header - RFC 3326.
+func applyReason(rec *Record, msg sip.Message) {
+	for _, hdr := range msg.GetHeaders("Reason") {
+		parts := strings.Split(hdr.Value(), ";")
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), "Q.850") {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+
+			switch strings.ToLower(kv[0]) {
+			case "cause":
+				if cause, err := strconv.Atoi(kv[1]); err == nil {
+					rec.Q850Cause = cause
+				}
+			case "text":
+				rec.ReleaseReason = strings.Trim(kv[1], `"`)
+			}
+		}
+
+		return
+	}
+}
+
+// q850Causes maps SIP status codes to Q.850 causes - RFC 3398 8.2.6.1.
+var q850Causes = map[sip.StatusCode]int{
+	200: 16,
+	400: 41,
+	401: 21,
+	402: 21,
+	403: 21,
+	404: 1,
+	405: 63,
+	406: 79,
+	407: 21,
+	408: 102,
+	410: 22,
+	413: 127,
+	414: 127,
+	415: 79,
+	416: 127,
+	420: 127,
+	480: 18,
+	481: 41,
+	482: 25,
+	483: 25,
+	484: 28,
+	485: 1,
+	486: 17,
+	487: 127,
+	488: 127,
+	500: 41,
+	501: 79,
+	502: 38,
+	503: 41,
+	504: 102,
+	505: 127,
+	513: 127,
+	600: 17,
+	603: 21,
+	604: 1,
+	606: 58,
+}
+
+// Q850Cause returns Q.850 cause of the SIP status code, unknown codes are mapped to 31 'Normal, unspecified'.
+func Q850Cause(code sip.StatusCode) int {
+	if cause, ok := q850Causes[code]; ok {
+		return cause
+	}
+
+	return 31
+}
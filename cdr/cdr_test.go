@@ -0,0 +1,119 @@
+package cdr_test
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/cdr"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Recorder", func() {
+	var (
+		recorder cdr.Recorder
+		records  []cdr.Record
+		answers  []cdr.Record
+		out      *bytes.Buffer
+	)
+
+	request := func(method sip.RequestMethod, callID, toTag string, extra ...string) sip.Request {
+		to := "To: <sip:bob@example.com>"
+		if toTag != "" {
+			to += ";tag=" + toTag
+		}
+		lines := []string{
+			string(method) + " sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			to,
+			"Call-ID: " + callID,
+			"CSeq: 1 " + string(method),
+		}
+		req := testutils.Request(append(append(lines, extra...), "", ""))
+		req.SetTransport("UDP")
+		req.SetSource("10.0.0.1:5060")
+
+		return req
+	}
+
+	BeforeEach(func() {
+		records = nil
+		answers = nil
+		out = new(bytes.Buffer)
+		recorder = cdr.NewRecorder(cdr.Config{
+			OnRecord: func(rec cdr.Record) {
+				records = append(records, rec)
+			},
+			OnAnswer: func(rec cdr.Record) {
+				answers = append(answers, rec)
+			},
+			Output: out,
+		}, testutils.NewLogrusLogger())
+	})
+
+	It("should record answered inbound call released with BYE", func() {
+		invite := request(sip.INVITE, "call-1", "")
+		recorder.MessageReceived(invite)
+		recorder.MessageSent(sip.NewResponseFromRequest("", invite, 180, "Ringing", ""))
+		recorder.MessageSent(sip.NewResponseFromRequest("", invite, 200, "OK", ""))
+		Expect(recorder.Active()).To(HaveLen(1))
+		Expect(answers).To(HaveLen(1))
+		Expect(answers[0].CallID).To(Equal("call-1"))
+		Expect(answers[0].Answered()).To(BeTrue())
+
+		recorder.MessageReceived(request(sip.BYE, "call-1", "bob-tag",
+			`Reason: Q.850;cause=16;text="Normal call clearing"`))
+
+		Expect(recorder.Active()).To(BeEmpty())
+		Expect(records).To(HaveLen(1))
+		rec := records[0]
+		Expect(rec.CallID).To(Equal("call-1"))
+		Expect(rec.Direction).To(Equal(cdr.Inbound))
+		Expect(rec.FromURI).To(Equal("sip:alice@example.com"))
+		Expect(rec.ToURI).To(Equal("sip:bob@example.com"))
+		Expect(rec.RemoteAddr).To(Equal("10.0.0.1:5060"))
+		Expect(rec.Transport).To(Equal("UDP"))
+		Expect(rec.Answered()).To(BeTrue())
+		Expect(rec.RingingTime.IsZero()).To(BeFalse())
+		Expect(rec.ReleaseCode).To(Equal(sip.StatusCode(200)))
+		Expect(rec.Q850Cause).To(Equal(16))
+		Expect(rec.ReleaseReason).To(Equal("Normal call clearing"))
+		Expect(rec.ReleasedBy).To(Equal(cdr.ReleasedRemote))
+		Expect(rec.MessagesIn).To(Equal(2))
+		Expect(rec.MessagesOut).To(Equal(2))
+
+		var decoded cdr.Record
+		Expect(json.Unmarshal(out.Bytes(), &decoded)).To(Succeed())
+		Expect(decoded.CallID).To(Equal("call-1"))
+	})
+
+	It("should record failed outbound call with mapped Q.850 cause", func() {
+		invite := request(sip.INVITE, "call-2", "")
+		recorder.MessageSent(invite)
+		recorder.Retransmission(invite)
+		recorder.MessageReceived(sip.NewResponseFromRequest("", invite, 486, "Busy Here", ""))
+
+		Expect(records).To(HaveLen(1))
+		rec := records[0]
+		Expect(rec.Direction).To(Equal(cdr.Outbound))
+		Expect(rec.Answered()).To(BeFalse())
+		Expect(rec.Duration()).To(BeZero())
+		Expect(rec.ReleaseCode).To(Equal(sip.StatusCode(486)))
+		Expect(rec.ReleaseReason).To(Equal("Busy Here"))
+		Expect(rec.Q850Cause).To(Equal(17))
+		Expect(rec.ReleasedBy).To(Equal(cdr.ReleasedRemote))
+		Expect(rec.Retransmissions).To(Equal(1))
+		Expect(answers).To(BeEmpty())
+	})
+
+	It("should ignore messages outside of recorded calls", func() {
+		recorder.MessageReceived(request(sip.BYE, "call-3", "bob-tag"))
+		recorder.MessageReceived(request(sip.INVITE, "call-3", "bob-tag"))
+		Expect(recorder.Active()).To(BeEmpty())
+		Expect(records).To(BeEmpty())
+	})
+})
@@ -0,0 +1,152 @@
+// sipload generates SIP load with the gosip stack, like SIPp uac and uas scenarios.
+//
+// Answer calls and registrations:
+//
+//	sipload -scenario uas -listen 127.0.0.1:5070
+//
+// Place 10 calls per second ramping by 10 every 5 seconds up to 200 calls per second:
+//
+//	sipload -scenario uac -listen 127.0.0.1:5060 -target 127.0.0.1:5070 -rate 10 -rate-step 10 -ramp-interval 5s -max-rate 200
+//
+// Registration storm of 10000 AORs:
+//
+//	sipload -scenario register -listen 127.0.0.1:5060 -target 127.0.0.1:5070 -users 10000 -rate 500 -total 10000
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/load"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func main() {
+	var (
+		scenario     = flag.String("scenario", "uac", "scenario: uac, uas or register")
+		network      = flag.String("transport", "udp", "transport: udp, tcp, tls, ws or wss")
+		listen       = flag.String("listen", "127.0.0.1:5060", "local listen address")
+		target       = flag.String("target", "", "address of the UAS, proxy or registrar, required for uac and register")
+		domain       = flag.String("domain", "", "host of AORs, default is the host of the target")
+		users        = flag.Int("users", 1, "number of distinct callers or registered AORs")
+		callee       = flag.String("callee", load.DefaultCallee, "user part of Request-URI of calls")
+		username     = flag.String("auth-user", "", "username of digest authentication")
+		password     = flag.String("auth-password", "", "password of digest authentication")
+		rate         = flag.Float64("rate", load.DefaultRate, "initial calls or registrations per second")
+		rateStep     = flag.Float64("rate-step", 0, "rate increase every ramp interval")
+		rampInterval = flag.Duration("ramp-interval", load.DefaultRampInterval, "interval of rate increase")
+		maxRate      = flag.Float64("max-rate", 0, "limit of rate ramp, zero is unlimited")
+		concurrency  = flag.Int("concurrency", load.DefaultConcurrency, "limit of calls or registrations in progress")
+		total        = flag.Int("total", 0, "number of calls or registrations, zero is unlimited")
+		duration     = flag.Duration("duration", 0, "duration of the load, zero is unlimited")
+		callHold     = flag.Duration("call-hold", 0, "duration of answered calls")
+		ringTime     = flag.Duration("ring-time", 0, "uas delay between 180 and the final response")
+		code         = flag.Int("code", 200, "uas final response of INVITE")
+		interval     = flag.Duration("report-interval", 5*time.Second, "interval of intermediate reports")
+		level        = flag.String("log-level", "warn", "log level")
+	)
+	flag.Parse()
+
+	logrusLogger := log.NewDefaultLogrusLogger()
+	if lvl, err := logrus.ParseLevel(*level); err == nil {
+		logrusLogger.SetLevel(log.Level(lvl))
+	}
+	logger := logrusLogger.WithPrefix("sipload")
+
+	host, _, err := net.SplitHostPort(*listen)
+	if err != nil {
+		logger.Fatalf("invalid listen address '%s': %s", *listen, err)
+	}
+
+	srv := gosip.NewServer(gosip.ServerConfig{Host: host, UserAgent: "sipload"}, nil, nil, logger)
+	defer srv.Shutdown()
+
+	if err := srv.Listen(*network, *listen); err != nil {
+		logger.Fatalf("listen %s %s failed: %s", *network, *listen, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	var report func() load.Report
+	done := make(chan load.Report, 1)
+
+	if load.Scenario(*scenario) == "uas" {
+		uas := load.NewUAS(load.UASConfig{
+			RingTime: *ringTime,
+			Code:     sip.StatusCode(*code),
+		}, logger)
+		if err := uas.Serve(srv); err != nil {
+			logger.Fatal(err)
+		}
+
+		report = uas.Report
+		go func() {
+			<-ctx.Done()
+			done <- uas.Report()
+		}()
+	} else {
+		config := load.Config{
+			Scenario:     load.Scenario(*scenario),
+			Target:       *target,
+			Transport:    *network,
+			Domain:       *domain,
+			Contact:      *listen,
+			Users:        *users,
+			Callee:       *callee,
+			Rate:         *rate,
+			RateStep:     *rateStep,
+			RampInterval: *rampInterval,
+			MaxRate:      *maxRate,
+			Concurrency:  *concurrency,
+			Total:        *total,
+			CallHold:     *callHold,
+		}
+		if *username != "" {
+			config.Authorizer = sip.NewDigestAuthorizer(*username, *password)
+		}
+
+		gen, err := load.NewGenerator(srv, config, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		report = gen.Report
+		go func() {
+			done <- gen.Run(ctx)
+		}()
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Println(report())
+		case r := <-done:
+			fmt.Println(r)
+			return
+		}
+	}
+}
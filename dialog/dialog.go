@@ -0,0 +1,676 @@
+// dialog package implements SIP dialogs - RFC 3261 12.
+package dialog
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+type State int
+
+const (
+	Early State = iota
+	Confirmed
+	Terminated
+)
+
+func (state State) String() string {
+	switch state {
+	case Early:
+		return "Early"
+	case Confirmed:
+		return "Confirmed"
+	case Terminated:
+		return "Terminated"
+	default:
+		return "Unknown"
+	}
+}
+
+// Dialog represents peer-to-peer SIP relationship between two UAs - RFC 3261 12.
+type Dialog interface {
+	// ID returns dialog ID in the form of sip.MakeDialogID(Call-ID, local tag, remote tag).
+	// It is equal to sip.MakeDialogIDFromMessage of in-dialog requests received from the remote side.
+	ID() string
+	CallID() sip.CallID
+	LocalTag() string
+	RemoteTag() string
+	LocalUri() sip.Uri
+	RemoteUri() sip.Uri
+	// LocalTarget returns local Contact URI.
+	LocalTarget() sip.Uri
+	// RemoteTarget returns remote Contact URI, used as Request-URI of in-dialog requests.
+	RemoteTarget() sip.Uri
+	RouteSet() []sip.Uri
+	LocalSeq() uint32
+	RemoteSeq() uint32
+	Secure() bool
+	// IsUAC returns true if the dialog was created by the outgoing request.
+	IsUAC() bool
+	State() State
+	// Match checks that the message belongs to the dialog.
+	Match(msg sip.Message) bool
+	// ReceiveRequest validates incoming in-dialog request and updates dialog state - RFC 3261 12.2.2.
+	ReceiveRequest(req sip.Request) error
+	// ReceiveResponse updates dialog state with the response
+	// on the dialog creating request or the in-dialog request - RFC 3261 12.1.2, 12.2.1.2.
+	ReceiveResponse(res sip.Response) error
+	// NewRequest builds new in-dialog request - RFC 3261 12.2.1.1.
+	// ACK and CANCEL requests can not be created with this method,
+	// use sip.NewAckRequest and sip.NewCancelRequest instead.
+	NewRequest(method sip.RequestMethod, body string, headers ...sip.Header) (sip.Request, error)
+	Terminate()
+	// AddUsage registers new dialog usage (INVITE session, subscription, etc.) - RFC 5057.
+	AddUsage()
+	// ReleaseUsage releases the dialog usage, the dialog is terminated when the last usage is released.
+	ReleaseUsage()
+	// Usages returns number of active dialog usages.
+	Usages() int
+	// Done returns channel that is closed when the dialog is terminated.
+	Done() <-chan struct{}
+	// Values is the application data attached to the dialog, e.g. call state.
+	sip.Values
+	String() string
+}
+
+type dialog struct {
+	callID       sip.CallID
+	localTag     string
+	remoteTag    string
+	localUri     sip.Uri
+	remoteUri    sip.Uri
+	localTarget  sip.Uri
+	remoteTarget sip.Uri
+	routeSet     []sip.Uri
+	localSeq     uint32
+	remoteSeq    uint32
+	secure       bool
+	uac          bool
+	state        State
+	// CSeq of the dialog creating INVITE
+	inviteSeq uint32
+	usages    int
+
+	done          chan struct{}
+	terminateOnce sync.Once
+	mu            sync.RWMutex
+	// bus receives creation and termination of the dialog
+	bus eventbus.Bus
+
+	sip.ValueStore
+
+	log log.Logger
+}
+
+// DialogOption configures the created dialog.
+type DialogOption interface {
+	ApplyDialog(opts *DialogOptions)
+}
+
+type DialogOptions struct {
+	// EventBus receives creation and termination of the dialog, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+// WithEventBus publishes creation and termination of the dialog to the bus, like the bus of the server.
+func WithEventBus(bus eventbus.Bus) DialogOption {
+	return withEventBus{bus}
+}
+
+type withEventBus struct {
+	bus eventbus.Bus
+}
+
+func (o withEventBus) ApplyDialog(opts *DialogOptions) {
+	if o.bus != nil {
+		opts.EventBus = o.bus
+	}
+}
+
+func dialogOptions(options []DialogOption) DialogOptions {
+	opts := DialogOptions{
+		EventBus: eventbus.Default,
+	}
+	for _, opt := range options {
+		opt.ApplyDialog(&opts)
+	}
+
+	return opts
+}
+
+// NewUACDialog creates dialog on the UAC side from the request and the 1xx (with To tag) or 2xx response - RFC 3261 12.1.2.
+func NewUACDialog(req sip.Request, res sip.Response, logger log.Logger, options ...DialogOption) (Dialog, error) {
+	if res.StatusCode() < 101 || res.StatusCode() >= 300 {
+		return nil, fmt.Errorf("response '%s' can not create dialog", res.Short())
+	}
+
+	callID, ok := res.CallID()
+	if !ok {
+		return nil, fmt.Errorf("'Call-ID' header not found in response '%s'", res.Short())
+	}
+	from, ok := req.From()
+	if !ok {
+		return nil, fmt.Errorf("'From' header not found in request '%s'", req.Short())
+	}
+	to, ok := res.To()
+	if !ok {
+		return nil, fmt.Errorf("'To' header not found in response '%s'", res.Short())
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return nil, fmt.Errorf("'CSeq' header not found in request '%s'", req.Short())
+	}
+
+	remoteTag := getTag(to.Params)
+	if remoteTag == "" {
+		return nil, fmt.Errorf("'tag' param not found in 'To' header of response '%s'", res.Short())
+	}
+
+	dlg := &dialog{
+		callID:    *callID,
+		localTag:  getTag(from.Params),
+		remoteTag: remoteTag,
+		localUri:  from.Address.Clone(),
+		remoteUri: to.Address.Clone(),
+		localSeq:  cseq.SeqNo,
+		inviteSeq: cseq.SeqNo,
+		secure:    req.Recipient().IsEncrypted(),
+		uac:       true,
+		state:     Early,
+		done:      make(chan struct{}),
+		bus:       dialogOptions(options).EventBus,
+	}
+	if contact, ok := req.Contact(); ok && contact.Address != nil {
+		dlg.localTarget = contact.Address.Clone()
+	}
+	if contact, ok := res.Contact(); ok && contact.Address != nil {
+		dlg.remoteTarget = contact.Address.Clone()
+	} else {
+		dlg.remoteTarget = req.Recipient().Clone()
+	}
+	// route set is the list of Record-Route URIs in reverse order
+	dlg.routeSet = reverseUris(recordRouteUris(res))
+	if res.IsSuccess() {
+		dlg.state = Confirmed
+	}
+
+	dlg.initLog(logger)
+	dlg.Log().Debugf("UAC dialog created in %s state", dlg.state)
+	dlg.bus.Publish(&eventbus.DialogCreatedEvent{ID: dlg.ID(), CallID: string(dlg.callID), UAC: true})
+
+	return dlg, nil
+}
+
+// NewUASDialog creates dialog on the UAS side from the request and the 1xx (with To tag) or 2xx response - RFC 3261 12.1.1.
+func NewUASDialog(req sip.Request, res sip.Response, logger log.Logger, options ...DialogOption) (Dialog, error) {
+	if res.StatusCode() < 101 || res.StatusCode() >= 300 {
+		return nil, fmt.Errorf("response '%s' can not create dialog", res.Short())
+	}
+
+	callID, ok := req.CallID()
+	if !ok {
+		return nil, fmt.Errorf("'Call-ID' header not found in request '%s'", req.Short())
+	}
+	from, ok := req.From()
+	if !ok {
+		return nil, fmt.Errorf("'From' header not found in request '%s'", req.Short())
+	}
+	to, ok := res.To()
+	if !ok {
+		return nil, fmt.Errorf("'To' header not found in response '%s'", res.Short())
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return nil, fmt.Errorf("'CSeq' header not found in request '%s'", req.Short())
+	}
+
+	localTag := getTag(to.Params)
+	if localTag == "" {
+		return nil, fmt.Errorf("'tag' param not found in 'To' header of response '%s'", res.Short())
+	}
+
+	dlg := &dialog{
+		callID:    *callID,
+		localTag:  localTag,
+		remoteTag: getTag(from.Params),
+		localUri:  to.Address.Clone(),
+		remoteUri: from.Address.Clone(),
+		remoteSeq: cseq.SeqNo,
+		inviteSeq: cseq.SeqNo,
+		secure:    req.Recipient().IsEncrypted(),
+		state:     Early,
+		done:      make(chan struct{}),
+		bus:       dialogOptions(options).EventBus,
+	}
+	if contact, ok := res.Contact(); ok && contact.Address != nil {
+		dlg.localTarget = contact.Address.Clone()
+	}
+	if contact, ok := req.Contact(); ok && contact.Address != nil {
+		dlg.remoteTarget = contact.Address.Clone()
+	}
+	dlg.routeSet = recordRouteUris(req)
+	if res.IsSuccess() {
+		dlg.state = Confirmed
+	}
+
+	dlg.initLog(logger)
+	dlg.Log().Debugf("UAS dialog created in %s state", dlg.state)
+	dlg.bus.Publish(&eventbus.DialogCreatedEvent{ID: dlg.ID(), CallID: string(dlg.callID)})
+
+	return dlg, nil
+}
+
+func (dlg *dialog) initLog(logger log.Logger) {
+	dlg.log = logger.
+		WithPrefix("dialog.Dialog").
+		WithFields(log.Fields{
+			"dialog_ptr": fmt.Sprintf("%p", dlg),
+			"dialog_id":  dlg.ID(),
+		})
+}
+
+func (dlg *dialog) Log() log.Logger {
+	return dlg.log
+}
+
+func (dlg *dialog) String() string {
+	if dlg == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("dialog.Dialog<%s>", dlg.Log().Fields())
+}
+
+func (dlg *dialog) ID() string {
+	return sip.MakeDialogID(string(dlg.callID), dlg.localTag, dlg.remoteTag)
+}
+
+func (dlg *dialog) CallID() sip.CallID {
+	return dlg.callID
+}
+
+func (dlg *dialog) LocalTag() string {
+	return dlg.localTag
+}
+
+func (dlg *dialog) RemoteTag() string {
+	return dlg.remoteTag
+}
+
+func (dlg *dialog) LocalUri() sip.Uri {
+	return dlg.localUri
+}
+
+func (dlg *dialog) RemoteUri() sip.Uri {
+	return dlg.remoteUri
+}
+
+func (dlg *dialog) LocalTarget() sip.Uri {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.localTarget
+}
+
+func (dlg *dialog) RemoteTarget() sip.Uri {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.remoteTarget
+}
+
+func (dlg *dialog) RouteSet() []sip.Uri {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	routeSet := make([]sip.Uri, len(dlg.routeSet))
+	copy(routeSet, dlg.routeSet)
+	return routeSet
+}
+
+func (dlg *dialog) LocalSeq() uint32 {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.localSeq
+}
+
+func (dlg *dialog) RemoteSeq() uint32 {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.remoteSeq
+}
+
+func (dlg *dialog) Secure() bool {
+	return dlg.secure
+}
+
+func (dlg *dialog) IsUAC() bool {
+	return dlg.uac
+}
+
+func (dlg *dialog) State() State {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.state
+}
+
+func (dlg *dialog) Done() <-chan struct{} {
+	return dlg.done
+}
+
+func (dlg *dialog) Terminate() {
+	dlg.terminateOnce.Do(func() {
+		dlg.mu.Lock()
+		dlg.state = Terminated
+		dlg.mu.Unlock()
+
+		close(dlg.done)
+
+		dlg.Log().Debug("dialog terminated")
+		dlg.bus.Publish(&eventbus.DialogTerminatedEvent{ID: dlg.ID(), CallID: string(dlg.callID), UAC: dlg.uac})
+	})
+}
+
+func (dlg *dialog) AddUsage() {
+	dlg.mu.Lock()
+	dlg.usages++
+	dlg.mu.Unlock()
+}
+
+func (dlg *dialog) ReleaseUsage() {
+	dlg.mu.Lock()
+	if dlg.usages > 0 {
+		dlg.usages--
+	}
+	usages := dlg.usages
+	dlg.mu.Unlock()
+
+	if usages == 0 {
+		dlg.Terminate()
+	}
+}
+
+func (dlg *dialog) Usages() int {
+	dlg.mu.RLock()
+	defer dlg.mu.RUnlock()
+	return dlg.usages
+}
+
+func (dlg *dialog) Match(msg sip.Message) bool {
+	callID, ok := msg.CallID()
+	if !ok || *callID != dlg.callID {
+		return false
+	}
+	from, ok := msg.From()
+	if !ok {
+		return false
+	}
+	to, ok := msg.To()
+	if !ok {
+		return false
+	}
+
+	fromTag, toTag := getTag(from.Params), getTag(to.Params)
+	switch msg.(type) {
+	case sip.Request:
+		// request from the remote side
+		return fromTag == dlg.remoteTag && (toTag == dlg.localTag || toTag == "")
+	case sip.Response:
+		// response on the local request
+		return fromTag == dlg.localTag && (toTag == dlg.remoteTag || toTag == "")
+	default:
+		return false
+	}
+}
+
+func (dlg *dialog) ReceiveRequest(req sip.Request) error {
+	if dlg.State() == Terminated {
+		return fmt.Errorf("%s is terminated", dlg)
+	}
+	if !dlg.Match(req) {
+		return &sip.UnexpectedMessageError{
+			Err: fmt.Errorf("request '%s' does not match %s", req.Short(), dlg),
+			Msg: req.String(),
+		}
+	}
+
+	cseq, ok := req.CSeq()
+	if !ok {
+		return &sip.MalformedMessageError{
+			Err: fmt.Errorf("'CSeq' header not found"),
+			Msg: req.String(),
+		}
+	}
+
+	if !req.IsAck() && !req.IsCancel() {
+		dlg.mu.Lock()
+		if dlg.remoteSeq != 0 && cseq.SeqNo <= dlg.remoteSeq {
+			dlg.mu.Unlock()
+
+			return &sip.UnexpectedMessageError{
+				Err: fmt.Errorf("request '%s' CSeq %d is out of order, remote CSeq %d", req.Short(), cseq.SeqNo, dlg.remoteSeq),
+				Msg: req.String(),
+			}
+		}
+		dlg.remoteSeq = cseq.SeqNo
+		dlg.mu.Unlock()
+	}
+
+	if IsTargetRefresh(req.Method()) {
+		if contact, ok := req.Contact(); ok && contact.Address != nil {
+			dlg.mu.Lock()
+			dlg.remoteTarget = contact.Address.Clone()
+			dlg.mu.Unlock()
+		}
+	}
+
+	if req.Method() == sip.BYE {
+		dlg.Terminate()
+	}
+
+	return nil
+}
+
+func (dlg *dialog) ReceiveResponse(res sip.Response) error {
+	if dlg.State() == Terminated {
+		return fmt.Errorf("%s is terminated", dlg)
+	}
+	if !dlg.Match(res) {
+		return &sip.UnexpectedMessageError{
+			Err: fmt.Errorf("response '%s' does not match %s", res.Short(), dlg),
+			Msg: res.String(),
+		}
+	}
+
+	cseq, ok := res.CSeq()
+	if !ok {
+		return &sip.MalformedMessageError{
+			Err: fmt.Errorf("'CSeq' header not found"),
+			Msg: res.String(),
+		}
+	}
+
+	// RFC 3261 12.2.1.2. 481 or 408 responses terminate the dialog
+	if res.StatusCode() == 481 || res.StatusCode() == 408 {
+		dlg.Terminate()
+
+		return nil
+	}
+
+	dlg.mu.Lock()
+	isInitialInvite := cseq.MethodName == sip.INVITE && cseq.SeqNo == dlg.inviteSeq
+	if dlg.state == Early && isInitialInvite {
+		switch {
+		case res.IsSuccess():
+			dlg.state = Confirmed
+			if dlg.uac {
+				dlg.routeSet = reverseUris(recordRouteUris(res))
+			}
+		case res.StatusCode() >= 300:
+			dlg.mu.Unlock()
+			dlg.Terminate()
+
+			return nil
+		}
+	}
+	if (res.IsSuccess() || (res.IsProvisional() && isInitialInvite)) && IsTargetRefresh(cseq.MethodName) {
+		if contact, ok := res.Contact(); ok && contact.Address != nil {
+			dlg.remoteTarget = contact.Address.Clone()
+		}
+	}
+	dlg.mu.Unlock()
+
+	if res.IsSuccess() && cseq.MethodName == sip.BYE {
+		dlg.Terminate()
+	}
+
+	return nil
+}
+
+func (dlg *dialog) NewRequest(method sip.RequestMethod, body string, headers ...sip.Header) (sip.Request, error) {
+	if method == sip.ACK || method == sip.CANCEL {
+		return nil, fmt.Errorf("%s request can not be created as in-dialog request", method)
+	}
+	if dlg.State() == Terminated {
+		return nil, fmt.Errorf("%s is terminated", dlg)
+	}
+
+	dlg.mu.Lock()
+	if dlg.localSeq == 0 {
+		dlg.localSeq = uint32(rand.Int31n(1 << 16))
+	}
+	dlg.localSeq++
+	seqNo := dlg.localSeq
+	remoteTarget := dlg.remoteTarget
+	localTarget := dlg.localTarget
+	routeSet := make([]sip.Uri, len(dlg.routeSet))
+	copy(routeSet, dlg.routeSet)
+	dlg.mu.Unlock()
+
+	if remoteTarget == nil {
+		return nil, fmt.Errorf("%s has no remote target", dlg)
+	}
+
+	recipient := remoteTarget.Clone()
+	// RFC 3261 12.2.1.1. strict routing, first route URI without 'lr' param
+	if len(routeSet) > 0 && !sip.IsLooseRouter(routeSet[0]) {
+		recipient = routeSet[0].Clone()
+		routeSet = append(routeSet[1:], remoteTarget.Clone())
+	}
+
+	hdrs := []sip.Header{
+		sip.ViaHeader{
+			&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       targetTransport(remoteTarget),
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			},
+		},
+	}
+	if len(routeSet) > 0 {
+		route := &sip.RouteHeader{}
+		for _, uri := range routeSet {
+			route.Addresses = append(route.Addresses, uri.Clone())
+		}
+		hdrs = append(hdrs, route)
+	}
+
+	maxForwards := sip.MaxForwards(70)
+	callID := dlg.callID
+	from := &sip.FromHeader{
+		Address: dlg.localUri.Clone(),
+		Params:  sip.NewParams(),
+	}
+	if dlg.localTag != "" {
+		from.Params.Add("tag", sip.String{Str: dlg.localTag})
+	}
+	to := &sip.ToHeader{
+		Address: dlg.remoteUri.Clone(),
+		Params:  sip.NewParams(),
+	}
+	if dlg.remoteTag != "" {
+		to.Params.Add("tag", sip.String{Str: dlg.remoteTag})
+	}
+
+	hdrs = append(hdrs,
+		&maxForwards,
+		from,
+		to,
+		&callID,
+		&sip.CSeq{SeqNo: seqNo, MethodName: method},
+	)
+	if localTarget != nil {
+		hdrs = append(hdrs, &sip.ContactHeader{
+			Address: localTarget.Clone(),
+		})
+	}
+	hdrs = append(hdrs, headers...)
+
+	req := sip.NewRequest(
+		"",
+		method,
+		recipient,
+		"SIP/2.0",
+		hdrs,
+		"",
+		log.Fields{
+			"dialog_id": dlg.ID(),
+		},
+	)
+	req.SetBody(body, true)
+
+	return req, nil
+}
+
+// IsTargetRefresh checks that the method can update dialog remote target - RFC 3261 12.2, RFC 3311, RFC 6665.
+func IsTargetRefresh(method sip.RequestMethod) bool {
+	switch method {
+	case sip.INVITE, sip.UPDATE, sip.SUBSCRIBE, sip.NOTIFY, sip.REFER:
+		return true
+	default:
+		return false
+	}
+}
+
+func getTag(params sip.Params) string {
+	if params == nil {
+		return ""
+	}
+	if tag, ok := params.Get("tag"); ok && tag != nil {
+		return tag.String()
+	}
+	return ""
+}
+
+func recordRouteUris(msg sip.Message) []sip.Uri {
+	uris := make([]sip.Uri, 0)
+	for _, hdr := range msg.GetHeaders("Record-Route") {
+		if rr, ok := hdr.(*sip.RecordRouteHeader); ok {
+			for _, uri := range rr.Addresses {
+				uris = append(uris, uri.Clone())
+			}
+		}
+	}
+	return uris
+}
+
+func reverseUris(uris []sip.Uri) []sip.Uri {
+	reversed := make([]sip.Uri, 0, len(uris))
+	for i := len(uris) - 1; i >= 0; i-- {
+		reversed = append(reversed, uris[i])
+	}
+	return reversed
+}
+
+func targetTransport(uri sip.Uri) string {
+	if uri.UriParams() != nil {
+		if tp, ok := uri.UriParams().Get("transport"); ok && tp != nil && tp.String() != "" {
+			return strings.ToUpper(tp.String())
+		}
+	}
+	return sip.DefaultProtocol
+}
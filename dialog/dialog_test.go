@@ -0,0 +1,143 @@
+package dialog_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Dialog", func() {
+	var (
+		invite sip.Request
+		ok     sip.Response
+	)
+
+	BeforeEach(func() {
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: dialog-call-id",
+			"CSeq: 10 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"Record-Route: <sip:proxy1.example.com;lr>",
+			"Record-Route: <sip:proxy2.example.com;lr>",
+			"",
+			"",
+		})
+		ok = testutils.Response([]string{
+			"SIP/2.0 200 OK",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: dialog-call-id",
+			"CSeq: 10 INVITE",
+			"Contact: <sip:bob@10.0.0.2:5060>",
+			"Record-Route: <sip:proxy1.example.com;lr>",
+			"Record-Route: <sip:proxy2.example.com;lr>",
+			"",
+			"",
+		})
+	})
+
+	Context("UAC side", func() {
+		var dlg dialog.Dialog
+
+		BeforeEach(func() {
+			var err error
+			dlg, err = dialog.NewUACDialog(invite, ok, testutils.NewLogrusLogger())
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should be confirmed with reversed route set", func() {
+			Expect(dlg.State()).To(Equal(dialog.Confirmed))
+			Expect(dlg.ID()).To(Equal(sip.MakeDialogID("dialog-call-id", "alice-tag", "bob-tag")))
+			Expect(dlg.RemoteTarget().String()).To(Equal("sip:bob@10.0.0.2:5060"))
+			Expect(dlg.RouteSet()).To(HaveLen(2))
+			Expect(dlg.RouteSet()[0].Host()).To(Equal("proxy2.example.com"))
+			Expect(dlg.RouteSet()[1].Host()).To(Equal("proxy1.example.com"))
+		})
+
+		It("should build in-dialog BYE", func() {
+			bye, err := dlg.NewRequest(sip.BYE, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bye.Recipient().String()).To(Equal("sip:bob@10.0.0.2:5060"))
+
+			cseq, _ := bye.CSeq()
+			Expect(cseq.SeqNo).To(Equal(uint32(11)))
+			Expect(cseq.MethodName).To(Equal(sip.BYE))
+
+			to, _ := bye.To()
+			tag, _ := to.Params.Get("tag")
+			Expect(tag.String()).To(Equal("bob-tag"))
+
+			routes := bye.GetHeaders("Route")
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Value()).To(Equal("<sip:proxy2.example.com;lr>, <sip:proxy1.example.com;lr>"))
+			Expect(dlg.LocalSeq()).To(Equal(uint32(11)))
+		})
+
+		It("should not build ACK", func() {
+			_, err := dlg.NewRequest(sip.ACK, "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject out of order requests", func() {
+			reinvite := func(seq string) sip.Request {
+				return testutils.Request([]string{
+					"INVITE sip:alice@10.0.0.1:5060 SIP/2.0",
+					"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=" + sip.GenerateBranch(),
+					"From: <sip:bob@example.com>;tag=bob-tag",
+					"To: <sip:alice@example.com>;tag=alice-tag",
+					"Call-ID: dialog-call-id",
+					"CSeq: " + seq + " INVITE",
+					"Contact: <sip:bob@10.0.0.3:5060>",
+					"",
+					"",
+				})
+			}
+
+			Expect(dlg.ReceiveRequest(reinvite("5"))).To(Succeed())
+			Expect(dlg.RemoteSeq()).To(Equal(uint32(5)))
+			Expect(dlg.RemoteTarget().String()).To(Equal("sip:bob@10.0.0.3:5060"))
+			Expect(dlg.ReceiveRequest(reinvite("4"))).ToNot(Succeed())
+		})
+
+		It("should be terminated by BYE", func() {
+			bye := testutils.Request([]string{
+				"BYE sip:alice@10.0.0.1:5060 SIP/2.0",
+				"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=" + sip.GenerateBranch(),
+				"From: <sip:bob@example.com>;tag=bob-tag",
+				"To: <sip:alice@example.com>;tag=alice-tag",
+				"Call-ID: dialog-call-id",
+				"CSeq: 1 BYE",
+				"",
+				"",
+			})
+			id, err := sip.MakeDialogIDFromMessage(bye)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal(dlg.ID()))
+
+			Expect(dlg.ReceiveRequest(bye)).To(Succeed())
+			Expect(dlg.State()).To(Equal(dialog.Terminated))
+			Eventually(dlg.Done()).Should(BeClosed())
+		})
+	})
+
+	Context("UAS side", func() {
+		It("should keep route set order and remote target", func() {
+			dlg, err := dialog.NewUASDialog(invite, ok, testutils.NewLogrusLogger())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dlg.IsUAC()).To(BeFalse())
+			Expect(dlg.LocalTag()).To(Equal("bob-tag"))
+			Expect(dlg.RemoteTag()).To(Equal("alice-tag"))
+			Expect(dlg.RemoteSeq()).To(Equal(uint32(10)))
+			Expect(dlg.RemoteTarget().String()).To(Equal("sip:alice@10.0.0.1:5060"))
+			Expect(dlg.RouteSet()[0].Host()).To(Equal("proxy1.example.com"))
+		})
+	})
+})
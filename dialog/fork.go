@@ -0,0 +1,311 @@
+package dialog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
+)
+
+// EarlyDialog is a dialog created by one fork of the INVITE - RFC 3261 13.2.2.4.
+// Each fork is identified by the distinct To tag of its responses.
+type EarlyDialog struct {
+	Dialog
+	// Response is the last response of the fork.
+	Response sip.Response
+	// SDP is the last session description of the fork, e.g. early media answer in 183 response.
+	SDP string
+}
+
+// InviteConfig describes dialog creating INVITE options.
+type InviteConfig struct {
+	Authorizer sip.Authorizer
+	// OnEarly is called when the fork creates the early dialog or sends new session description.
+	OnEarly func(early EarlyDialog)
+	// Accept is called on the 2xx response of the fork, false rejects the answer.
+	// Default accepts the first answer. Answers that are not accepted are acknowledged and released with BYE.
+	Accept func(answer EarlyDialog) bool
+	// EventBus receives creation and termination of dialogs of forks, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+// Invite sends the dialog creating INVITE and tracks early dialogs of its forks.
+type Invite interface {
+	// Send sends the INVITE and waits for the accepted answer, cancellation of the context sends CANCEL.
+	// Early dialogs of the other forks are released with BYE, late answers are acknowledged and released with BYE.
+	// The accepted answer is acknowledged if the INVITE carries the offer,
+	// otherwise ACK with the offer must be sent by the caller.
+	Send(ctx context.Context) (Dialog, sip.Response, error)
+	// EarlyDialogs returns early dialogs of the forks that are not terminated yet.
+	EarlyDialogs() []EarlyDialog
+}
+
+type forkState int
+
+const (
+	forkEarly forkState = iota
+	forkAccepted
+	forkRejected
+)
+
+type fork struct {
+	early EarlyDialog
+	state forkState
+	ack   sip.Request
+}
+
+type invite struct {
+	req       sip.Request
+	requester gosip.RequestSender
+	config    InviteConfig
+
+	mu       sync.Mutex
+	forks    map[string]*fork
+	order    []string
+	accepted chan *fork
+	answered bool
+
+	log log.Logger
+}
+
+// NewInvite creates dialog creating INVITE, req must be out-of-dialog INVITE request.
+func NewInvite(req sip.Request, requester gosip.RequestSender, config InviteConfig, logger log.Logger) Invite {
+	if config.Accept == nil {
+		config.Accept = func(answer EarlyDialog) bool {
+			return true
+		}
+	}
+
+	inv := &invite{
+		req:       req,
+		requester: requester,
+		config:    config,
+		forks:     make(map[string]*fork),
+		accepted:  make(chan *fork, 1),
+	}
+	inv.log = logger.
+		WithPrefix("dialog.Invite").
+		WithFields(log.Fields{
+			"invite_ptr": fmt.Sprintf("%p", inv),
+		})
+
+	return inv
+}
+
+func (inv *invite) Log() log.Logger {
+	return inv.log
+}
+
+func (inv *invite) Send(ctx context.Context) (Dialog, sip.Response, error) {
+	if inv.req.Method() != sip.INVITE {
+		return nil, nil, fmt.Errorf("request '%s' is not INVITE", inv.req.Short())
+	}
+
+	options := []gosip.RequestWithContextOption{
+		gosip.WithResponseHandler(inv.handleResponse),
+	}
+	if inv.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(inv.config.Authorizer))
+	}
+
+	if _, err := inv.requester.RequestWithContext(ctx, inv.req, options...); err != nil {
+		inv.terminateEarly(nil)
+
+		return nil, nil, err
+	}
+
+	// 2xx of the transaction was rejected, other forks still can answer until Timer M expires - RFC 6026 7.2.
+	select {
+	case f := <-inv.accepted:
+		inv.terminateEarly(f)
+
+		return f.early.Dialog, f.early.Response, nil
+	case <-ctx.Done():
+		inv.terminateEarly(nil)
+
+		return nil, nil, ctx.Err()
+	case <-timing.After(transaction.Timer_M):
+		inv.terminateEarly(nil)
+
+		return nil, nil, fmt.Errorf("no answer of '%s' is accepted", inv.req.Short())
+	}
+}
+
+func (inv *invite) EarlyDialogs() []EarlyDialog {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	dialogs := make([]EarlyDialog, 0, len(inv.forks))
+	for _, tag := range inv.order {
+		f := inv.forks[tag]
+		if f.state != forkRejected && f.early.State() != Terminated {
+			dialogs = append(dialogs, f.early)
+		}
+	}
+
+	return dialogs
+}
+
+func (inv *invite) handleResponse(res sip.Response, req sip.Request) {
+	if res.StatusCode() <= 100 || res.StatusCode() >= 300 {
+		return
+	}
+
+	to, ok := res.To()
+	if !ok {
+		return
+	}
+	tag := getTag(to.Params)
+	if tag == "" {
+		return
+	}
+
+	inv.mu.Lock()
+	f, ok := inv.forks[tag]
+	switch {
+	case !ok || (res.IsSuccess() && f.ack == nil && f.early.State() == Terminated):
+		// late answer of the released fork creates the dialog again to be released with BYE
+		dlg, err := NewUACDialog(req, res, inv.Log(), WithEventBus(inv.config.EventBus))
+		if err != nil {
+			inv.mu.Unlock()
+			inv.Log().WithFields(res.Fields()).Warnf("create early dialog failed: %s", err)
+
+			return
+		}
+		if !ok {
+			f = &fork{}
+			inv.forks[tag] = f
+			inv.order = append(inv.order, tag)
+		}
+		f.early.Dialog = dlg
+	case f.early.State() != Terminated:
+		if err := f.early.ReceiveResponse(res); err != nil {
+			inv.Log().WithFields(res.Fields()).Warnf("update early dialog failed: %s", err)
+		}
+	}
+
+	f.early.Response = res
+	sdpChanged := res.Body() != "" && res.Body() != f.early.SDP
+	if sdpChanged {
+		f.early.SDP = res.Body()
+	}
+	early := f.early
+	state := f.state
+	ack := f.ack
+	answered := inv.answered
+	inv.mu.Unlock()
+
+	if res.IsProvisional() {
+		if state == forkEarly && (!ok || sdpChanged) && inv.config.OnEarly != nil {
+			inv.config.OnEarly(early)
+		}
+
+		return
+	}
+
+	// 2xx retransmission is acknowledged again - RFC 3261 13.2.2.4
+	if ack != nil {
+		inv.send(ack)
+
+		return
+	}
+	if state == forkAccepted {
+		return
+	}
+
+	accept := state == forkEarly && !answered && inv.config.Accept(early)
+
+	inv.mu.Lock()
+	accept = accept && !inv.answered
+	if accept {
+		inv.answered = true
+		f.state = forkAccepted
+		if req.Body() != "" {
+			f.ack = sip.NewAckRequest("", req, res, "", nil)
+		}
+	} else {
+		f.state = forkRejected
+		f.ack = sip.NewAckRequest("", req, res, "", nil)
+	}
+	ack = f.ack
+	inv.mu.Unlock()
+
+	if ack != nil {
+		inv.send(ack)
+	}
+	if accept {
+		inv.accepted <- f
+
+		return
+	}
+
+	inv.Log().WithFields(res.Fields()).Debugf("answer of %s rejected", early.Dialog)
+	go inv.bye(early.Dialog)
+}
+
+// terminateEarly releases early dialogs of the forks except the accepted one.
+func (inv *invite) terminateEarly(accepted *fork) {
+	inv.mu.Lock()
+	// late answers are rejected
+	inv.answered = true
+	dialogs := make([]Dialog, 0)
+	for _, f := range inv.forks {
+		if f == accepted || f.state != forkEarly {
+			continue
+		}
+		f.state = forkRejected
+		dialogs = append(dialogs, f.early.Dialog)
+	}
+	inv.mu.Unlock()
+
+	for _, dlg := range dialogs {
+		if accepted == nil {
+			// transaction failed, the final response terminated all forks
+			dlg.Terminate()
+
+			continue
+		}
+
+		go inv.bye(dlg)
+	}
+}
+
+// bye releases the dialog of the fork - RFC 3261 15.
+func (inv *invite) bye(dlg Dialog) {
+	defer dlg.Terminate()
+
+	if dlg.State() == Terminated {
+		return
+	}
+
+	req, err := dlg.NewRequest(sip.BYE, "")
+	if err != nil {
+		inv.Log().Warnf("create BYE in %s failed: %s", dlg, err)
+
+		return
+	}
+
+	var options []gosip.RequestWithContextOption
+	if inv.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(inv.config.Authorizer))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transaction.Timer_F)
+	defer cancel()
+
+	if _, err := inv.requester.RequestWithContext(ctx, req, options...); err != nil {
+		inv.Log().Debugf("BYE in %s failed: %s", dlg, err)
+	}
+}
+
+func (inv *invite) send(ack sip.Request) {
+	if err := inv.requester.Send(ack); err != nil {
+		inv.Log().WithFields(ack.Fields()).Errorf("send ACK failed: %s", err)
+	}
+}
@@ -0,0 +1,222 @@
+package dialog_test
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+// forkingRequester answers INVITE with responses of several forks,
+// late responses are passed to the response handler by the test after the INVITE is completed.
+type forkingRequester struct {
+	responses []sip.Response
+	acks      chan sip.Request
+	byes      chan sip.Request
+
+	mu      sync.Mutex
+	invite  sip.Request
+	handler func(res sip.Response, req sip.Request)
+}
+
+func (r *forkingRequester) RequestWithContext(
+	ctx context.Context,
+	request sip.Request,
+	options ...gosip.RequestWithContextOption,
+) (sip.Response, error) {
+	if request.Method() != sip.INVITE {
+		r.byes <- request
+		return sip.NewResponseFromRequest("", request, 200, "OK", ""), nil
+	}
+
+	opts := &gosip.RequestWithContextOptions{}
+	for _, opt := range options {
+		opt.ApplyRequestWithContext(opts)
+	}
+
+	r.mu.Lock()
+	r.invite, r.handler = request, opts.ResponseHandler
+	r.mu.Unlock()
+
+	for _, res := range r.responses {
+		opts.ResponseHandler(res, request)
+		switch {
+		case res.IsSuccess():
+			return res, nil
+		case res.StatusCode() >= 300:
+			return nil, sip.NewRequestError(uint(res.StatusCode()), res.Reason(), request, res)
+		}
+	}
+
+	return nil, sip.NewRequestError(408, "Request Timeout", request, nil)
+}
+
+// late passes the response received after the INVITE transaction is completed.
+func (r *forkingRequester) late(res sip.Response) {
+	r.mu.Lock()
+	invite, handler := r.invite, r.handler
+	r.mu.Unlock()
+
+	handler(res, invite)
+}
+
+func (r *forkingRequester) Send(msg sip.Message) error {
+	if req, ok := msg.(sip.Request); ok && req.IsAck() {
+		r.acks <- req
+	}
+	return nil
+}
+
+var _ = Describe("Invite", func() {
+	var (
+		req       sip.Request
+		requester *forkingRequester
+	)
+
+	response := func(status, toTag, body string) sip.Response {
+		lines := []string{
+			"SIP/2.0 " + status,
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: fork-call-id",
+			"CSeq: 1 INVITE",
+		}
+		if toTag != "" {
+			lines[3] += ";tag=" + toTag
+			lines = append(lines, "Contact: <sip:bob@"+toTag+".example.com>")
+		}
+		if body != "" {
+			lines = append(lines, "Content-Type: application/sdp")
+		}
+		lines = append(lines, "", body)
+		return testutils.Response(lines)
+	}
+
+	BeforeEach(func() {
+		req = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: fork-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"Content-Type: application/sdp",
+			"",
+			"offer",
+		})
+		requester = &forkingRequester{
+			acks: make(chan sip.Request, 10),
+			byes: make(chan sip.Request, 10),
+		}
+	})
+
+	It("should expose early dialogs and release the forks that are not answered", func() {
+		requester.responses = []sip.Response{
+			response("100 Trying", "", ""),
+			response("183 Session Progress", "fork-1", "media 1"),
+			response("183 Session Progress", "fork-2", "media 2"),
+			response("180 Ringing", "fork-1", ""),
+			response("200 OK", "fork-2", "answer 2"),
+		}
+
+		var earlies []dialog.EarlyDialog
+		var inv dialog.Invite
+		inv = dialog.NewInvite(req, requester, dialog.InviteConfig{
+			OnEarly: func(early dialog.EarlyDialog) {
+				earlies = append(earlies, early)
+				if len(earlies) == 2 {
+					Expect(inv.EarlyDialogs()).To(HaveLen(2))
+				}
+			},
+		}, testutils.NewLogrusLogger())
+
+		dlg, res, err := inv.Send(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dlg.RemoteTag()).To(Equal("fork-2"))
+		Expect(dlg.State()).To(Equal(dialog.Confirmed))
+		Expect(res.Body()).To(Equal("answer 2"))
+
+		Expect(earlies).To(HaveLen(2))
+		Expect(earlies[0].RemoteTag()).To(Equal("fork-1"))
+		Expect(earlies[0].SDP).To(Equal("media 1"))
+		Expect(earlies[1].RemoteTag()).To(Equal("fork-2"))
+		Expect(earlies[1].SDP).To(Equal("media 2"))
+
+		var ack sip.Request
+		Eventually(requester.acks).Should(Receive(&ack))
+		Expect(ack.Recipient().String()).To(Equal("sip:bob@fork-2.example.com"))
+
+		// the early dialog of the other fork is released and its late answer is acknowledged and released again
+		var bye sip.Request
+		Eventually(requester.byes).Should(Receive(&bye))
+		Expect(bye.Recipient().String()).To(Equal("sip:bob@fork-1.example.com"))
+		requester.late(response("200 OK", "fork-1", "answer 1"))
+		Eventually(requester.acks).Should(Receive(&ack))
+		Expect(ack.Recipient().String()).To(Equal("sip:bob@fork-1.example.com"))
+		Eventually(requester.byes).Should(Receive(&bye))
+		Expect(bye.Recipient().String()).To(Equal("sip:bob@fork-1.example.com"))
+
+		Expect(inv.EarlyDialogs()).To(HaveLen(1))
+		Expect(inv.EarlyDialogs()[0].Dialog).To(Equal(dlg))
+	})
+
+	It("should wait for the answer chosen by the application", func() {
+		requester.responses = []sip.Response{
+			response("183 Session Progress", "fork-1", "media 1"),
+			response("200 OK", "fork-2", "answer 2"),
+		}
+
+		inv := dialog.NewInvite(req, requester, dialog.InviteConfig{
+			Accept: func(answer dialog.EarlyDialog) bool {
+				return answer.RemoteTag() == "fork-1"
+			},
+		}, testutils.NewLogrusLogger())
+
+		go func() {
+			defer GinkgoRecover()
+			// answer of fork-2 is rejected and released before the late answer of fork-1
+			var bye sip.Request
+			Eventually(requester.byes).Should(Receive(&bye))
+			Expect(bye.Recipient().String()).To(Equal("sip:bob@fork-2.example.com"))
+			requester.late(response("200 OK", "fork-1", "answer 1"))
+		}()
+
+		dlg, res, err := inv.Send(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dlg.RemoteTag()).To(Equal("fork-1"))
+		Expect(res.Body()).To(Equal("answer 1"))
+
+		Eventually(requester.acks).Should(Receive())
+		Eventually(requester.acks).Should(Receive())
+	})
+
+	It("should terminate early dialogs on failure", func() {
+		requester.responses = []sip.Response{
+			response("180 Ringing", "fork-1", ""),
+			response("486 Busy Here", "fork-1", ""),
+		}
+
+		var early dialog.EarlyDialog
+		inv := dialog.NewInvite(req, requester, dialog.InviteConfig{
+			OnEarly: func(e dialog.EarlyDialog) {
+				early = e
+			},
+		}, testutils.NewLogrusLogger())
+
+		_, _, err := inv.Send(context.Background())
+		reqErr, ok := err.(*sip.RequestError)
+		Expect(ok).To(BeTrue())
+		Expect(reqErr.Code).To(Equal(uint(486)))
+		Expect(early.State()).To(Equal(dialog.Terminated))
+		Expect(inv.EarlyDialogs()).To(BeEmpty())
+		Consistently(requester.byes).ShouldNot(Receive())
+	})
+})
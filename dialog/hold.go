@@ -0,0 +1,388 @@
+package dialog
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const ContentTypeSDP = "application/sdp"
+
+// MediaDirection is a direction attribute of SDP media stream - RFC 3264 5.1.
+type MediaDirection string
+
+const (
+	SendRecv MediaDirection = "sendrecv"
+	SendOnly MediaDirection = "sendonly"
+	RecvOnly MediaDirection = "recvonly"
+	Inactive MediaDirection = "inactive"
+)
+
+// Hold returns direction of the held stream: sending is stopped - RFC 3264 8.4.
+func (dir MediaDirection) Hold() MediaDirection {
+	switch dir {
+	case RecvOnly, Inactive:
+		return Inactive
+	default:
+		return SendOnly
+	}
+}
+
+// Resume returns direction of the resumed stream: sending is started again.
+func (dir MediaDirection) Resume() MediaDirection {
+	switch dir {
+	case Inactive, RecvOnly:
+		return RecvOnly
+	default:
+		return SendRecv
+	}
+}
+
+// Answer returns direction of the answer to the offered direction - RFC 3264 6.1.
+func (dir MediaDirection) Answer() MediaDirection {
+	switch dir {
+	case SendOnly:
+		return RecvOnly
+	case RecvOnly:
+		return SendOnly
+	case Inactive:
+		return Inactive
+	default:
+		return SendRecv
+	}
+}
+
+func isMediaDirection(attr string) bool {
+	switch MediaDirection(attr) {
+	case SendRecv, SendOnly, RecvOnly, Inactive:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetMediaDirection returns direction of the first media stream of SDP,
+// media level attribute overrides session level one, default is sendrecv.
+func GetMediaDirection(sdp string) MediaDirection {
+	session := SendRecv
+	inMedia := false
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if inMedia {
+				return session
+			}
+			inMedia = true
+		case strings.HasPrefix(line, "a=") && isMediaDirection(line[2:]):
+			if inMedia {
+				return MediaDirection(line[2:])
+			}
+			session = MediaDirection(line[2:])
+		}
+	}
+
+	return session
+}
+
+// IsHeld reports whether SDP puts the remote side on hold: the stream is sendonly or inactive,
+// or the connection address is 0.0.0.0 like in RFC 2543.
+func IsHeld(sdp string) bool {
+	if dir := GetMediaDirection(sdp); dir == SendOnly || dir == Inactive {
+		return true
+	}
+	for _, line := range sdpLines(sdp) {
+		if strings.HasPrefix(line, "c=") && strings.HasSuffix(strings.TrimSpace(line), " 0.0.0.0") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetMediaDirection replaces direction attributes of all media streams of SDP
+// and increments session version of the origin line - RFC 3264 8.
+func SetMediaDirection(sdp string, dir MediaDirection) string {
+	eol := "\r\n"
+	if !strings.Contains(sdp, "\r\n") {
+		eol = "\n"
+	}
+
+	lines := make([]string, 0)
+	hasMedia := false
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "a=") && isMediaDirection(line[2:]):
+			continue
+		case strings.HasPrefix(line, "o="):
+			line = incrementSessionVersion(line)
+		case strings.HasPrefix(line, "m="):
+			if hasMedia {
+				lines = append(lines, "a="+string(dir))
+			}
+			hasMedia = true
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "a="+string(dir))
+
+	return strings.Join(lines, eol) + eol
+}
+
+func sdpLines(sdp string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.ReplaceAll(sdp, "\r\n", "\n"), "\n") {
+		if line = strings.TrimRight(line, " \t"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func incrementSessionVersion(origin string) string {
+	fields := strings.Fields(origin)
+	if len(fields) != 6 {
+		return origin
+	}
+	version, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return origin
+	}
+	fields[2] = strconv.FormatUint(version+1, 10)
+
+	return strings.Join(fields, " ")
+}
+
+// HoldConfig describes hold/resume options.
+type HoldConfig struct {
+	// OfferAnswer is shared with other usages of the session, its local body is the base of hold offers.
+	// Default is OfferAnswer of the Updater or a new tracker.
+	OfferAnswer OfferAnswer
+	// Updater sends hold offers with UPDATE instead of re-INVITE.
+	Updater    Updater
+	Authorizer sip.Authorizer
+	// Headers are appended to each re-INVITE request.
+	Headers []sip.Header
+	// OnRemoteHold is called when the remote side puts the session on hold or resumes it.
+	OnRemoteHold func(dlg Dialog, held bool)
+}
+
+// Hold puts the session of the dialog on hold and resumes it with re-INVITE or UPDATE - RFC 3264 8.4, RFC 6337 5.3.
+// Hold offer is the last local session description with rewritten direction attributes,
+// so it works with any codecs.
+type Hold interface {
+	// Hold sends the offer that stops sending of the media.
+	Hold(ctx context.Context) (sip.Response, error)
+	// Resume sends the offer that starts sending of the media again.
+	Resume(ctx context.Context) (sip.Response, error)
+	IsHeld() bool
+	IsRemoteHeld() bool
+	// ReceiveOffer checks the offer received from the remote side for hold and returns the answer direction
+	// that keeps the local hold.
+	ReceiveOffer(offer string) MediaDirection
+}
+
+type hold struct {
+	dlg       Dialog
+	requester gosip.RequestSender
+	config    HoldConfig
+
+	mu         sync.Mutex
+	held       bool
+	remoteHeld bool
+
+	log log.Logger
+}
+
+// NewHold creates hold/resume handler of the dialog.
+func NewHold(dlg Dialog, requester gosip.RequestSender, config HoldConfig, logger log.Logger) Hold {
+	if config.OfferAnswer == nil {
+		if config.Updater != nil {
+			config.OfferAnswer = config.Updater.OfferAnswer()
+		} else {
+			config.OfferAnswer = NewOfferAnswer(OfferAnswerConfig{})
+		}
+	}
+
+	h := &hold{
+		dlg:       dlg,
+		requester: requester,
+		config:    config,
+	}
+	h.log = logger.
+		WithPrefix("dialog.Hold").
+		WithFields(log.Fields{
+			"dialog_id": dlg.ID(),
+			"hold_ptr":  fmt.Sprintf("%p", h),
+		})
+
+	return h
+}
+
+func (h *hold) Log() log.Logger {
+	return h.log
+}
+
+func (h *hold) IsHeld() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.held
+}
+
+func (h *hold) IsRemoteHeld() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.remoteHeld
+}
+
+func (h *hold) Hold(ctx context.Context) (sip.Response, error) {
+	return h.send(ctx, true)
+}
+
+func (h *hold) Resume(ctx context.Context) (sip.Response, error) {
+	return h.send(ctx, false)
+}
+
+func (h *hold) send(ctx context.Context, held bool) (sip.Response, error) {
+	if h.dlg.State() != Confirmed {
+		return nil, fmt.Errorf("%s is not confirmed", h.dlg)
+	}
+
+	local := h.config.OfferAnswer.LocalBody()
+	if local == "" {
+		return nil, fmt.Errorf("local session description of %s is unknown", h.dlg)
+	}
+
+	dir := GetMediaDirection(local)
+	if held {
+		dir = dir.Hold()
+	} else {
+		dir = dir.Resume()
+	}
+	offer := SetMediaDirection(local, dir)
+
+	var res sip.Response
+	var err error
+	if h.config.Updater != nil {
+		res, err = h.config.Updater.Update(ctx, ContentTypeSDP, offer)
+	} else {
+		res, err = h.reinvite(ctx, offer)
+	}
+	if err != nil {
+		return res, err
+	}
+
+	h.mu.Lock()
+	h.held = held
+	h.mu.Unlock()
+
+	h.Log().Debugf("%s hold is changed to %t", h.dlg, held)
+
+	return res, nil
+}
+
+// reinvite sends re-INVITE with the offer and acknowledges the answer, 491 is retried like UPDATE.
+func (h *hold) reinvite(ctx context.Context, offer string) (sip.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := h.invite(ctx, offer)
+		reqErr, ok := err.(*sip.RequestError)
+		if !ok || reqErr.Code != 491 || attempt >= maxGlareRetries {
+			return res, err
+		}
+
+		// RFC 3261 14.1. retry after glare
+		select {
+		case <-timing.After(GlareRetryDelay(h.dlg)):
+		case <-ctx.Done():
+			return res, err
+		}
+	}
+}
+
+func (h *hold) invite(ctx context.Context, offer string) (sip.Response, error) {
+	ct := sip.ContentType(ContentTypeSDP)
+	hdrs := []sip.Header{&ct}
+	if target := h.dlg.LocalTarget(); target != nil {
+		hdrs = append(hdrs, &sip.ContactHeader{Address: target.Clone()})
+	}
+	for _, hdr := range h.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	req, err := h.dlg.NewRequest(sip.INVITE, offer, hdrs...)
+	if err != nil {
+		return nil, err
+	}
+
+	oa := h.config.OfferAnswer
+	if err := oa.SendRequest(req); err != nil {
+		return nil, err
+	}
+
+	options := make([]gosip.RequestWithContextOption, 0)
+	if h.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(h.config.Authorizer))
+	}
+
+	res, err := h.requester.RequestWithContext(ctx, req, options...)
+	if err != nil {
+		if reqErr, ok := err.(*sip.RequestError); ok && reqErr.Response != nil {
+			_ = oa.ReceiveResponse(reqErr.Response)
+		} else {
+			oa.Rollback()
+		}
+
+		return nil, err
+	}
+
+	if err := h.dlg.ReceiveResponse(res); err != nil {
+		h.Log().WithFields(res.Fields()).Warnf("update dialog failed: %s", err)
+	}
+	if err := h.requester.Send(sip.NewAckRequest("", req, res, "", nil)); err != nil {
+		h.Log().WithFields(res.Fields()).Errorf("send ACK failed: %s", err)
+	}
+
+	if res.Body() == "" {
+		oa.Rollback()
+
+		return res, fmt.Errorf("response '%s' has no answer", res.Short())
+	}
+	if err := oa.ReceiveResponse(res); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+func (h *hold) ReceiveOffer(offer string) MediaDirection {
+	held := IsHeld(offer)
+
+	h.mu.Lock()
+	changed := h.remoteHeld != held
+	h.remoteHeld = held
+	localHeld := h.held
+	h.mu.Unlock()
+
+	if changed {
+		h.Log().Debugf("%s remote hold is changed to %t", h.dlg, held)
+		if h.config.OnRemoteHold != nil {
+			h.config.OnRemoteHold(h.dlg, held)
+		}
+	}
+
+	answer := GetMediaDirection(offer).Answer()
+	if localHeld {
+		answer = answer.Hold()
+	}
+
+	return answer
+}
@@ -0,0 +1,133 @@
+package dialog_test
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Hold", func() {
+	sdp := func(user, version string, attrs ...string) string {
+		lines := []string{
+			"v=0",
+			"o=" + user + " 1 " + version + " IN IP4 10.0.0.1",
+			"s=-",
+			"c=IN IP4 10.0.0.1",
+			"t=0 0",
+			"m=audio 49170 RTP/AVP 0",
+		}
+		return strings.Join(append(lines, attrs...), "\r\n") + "\r\n"
+	}
+
+	It("should rewrite direction attributes of SDP", func() {
+		offer := sdp("alice", "1", "a=rtpmap:0 PCMU/8000", "a=sendrecv") + "m=video 49172 RTP/AVP 31\r\na=recvonly\r\n"
+		Expect(dialog.GetMediaDirection(offer)).To(Equal(dialog.SendRecv))
+		Expect(dialog.IsHeld(offer)).To(BeFalse())
+
+		held := dialog.SetMediaDirection(offer, dialog.SendOnly)
+		Expect(held).To(Equal(strings.Join([]string{
+			"v=0",
+			"o=alice 1 2 IN IP4 10.0.0.1",
+			"s=-",
+			"c=IN IP4 10.0.0.1",
+			"t=0 0",
+			"m=audio 49170 RTP/AVP 0",
+			"a=rtpmap:0 PCMU/8000",
+			"a=sendonly",
+			"m=video 49172 RTP/AVP 31",
+			"a=sendonly",
+			"",
+		}, "\r\n")))
+		Expect(dialog.IsHeld(held)).To(BeTrue())
+		Expect(dialog.IsHeld(strings.Replace(offer, "10.0.0.1\r\nt=", "0.0.0.0\r\nt=", 1))).To(BeTrue())
+
+		Expect(dialog.SendRecv.Hold()).To(Equal(dialog.SendOnly))
+		Expect(dialog.RecvOnly.Hold()).To(Equal(dialog.Inactive))
+		Expect(dialog.Inactive.Resume()).To(Equal(dialog.RecvOnly))
+		Expect(dialog.SendOnly.Answer()).To(Equal(dialog.RecvOnly))
+	})
+
+	It("should hold and resume the session with re-INVITE", func() {
+		invite := testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: hold-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"Content-Type: application/sdp",
+			"",
+			sdp("alice", "1"),
+		})
+		res := testutils.Response([]string{
+			"SIP/2.0 200 OK",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: hold-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:bob@10.0.0.2:5060>",
+			"Content-Type: application/sdp",
+			"",
+			sdp("bob", "1"),
+		})
+
+		aliceDlg, err := dialog.NewUACDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		bobDlg, err := dialog.NewUASDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+
+		aliceOA := dialog.NewOfferAnswer(dialog.OfferAnswerConfig{})
+		Expect(aliceOA.SendRequest(invite)).To(Succeed())
+		Expect(aliceOA.ReceiveResponse(res)).To(Succeed())
+
+		remoteHolds := make(chan bool, 10)
+		toBob := testutils.NewLoopback()
+		alice := dialog.NewHold(aliceDlg, toBob, dialog.HoldConfig{OfferAnswer: aliceOA}, testutils.NewLogrusLogger())
+		bob := dialog.NewHold(bobDlg, nil, dialog.HoldConfig{
+			OnRemoteHold: func(dlg dialog.Dialog, held bool) {
+				remoteHolds <- held
+			},
+		}, testutils.NewLogrusLogger())
+
+		offers := make(chan string, 10)
+		_ = toBob.OnRequest(sip.INVITE, handle(func(req sip.Request, tx sip.ServerTransaction) error {
+			Expect(req.Method()).To(Equal(sip.INVITE))
+			Expect(bobDlg.ReceiveRequest(req)).To(Succeed())
+			offers <- req.Body()
+			dir := bob.ReceiveOffer(req.Body())
+			res := sip.NewResponseFromRequest("", req, 200, "OK", dialog.SetMediaDirection(sdp("bob", "1"), dir))
+			ct := sip.ContentType(dialog.ContentTypeSDP)
+			res.AppendHeader(&ct)
+			return tx.Respond(res)
+		}))
+
+		res, err = alice.Hold(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dialog.GetMediaDirection(res.Body())).To(Equal(dialog.RecvOnly))
+		Expect(alice.IsHeld()).To(BeTrue())
+		Expect(bob.IsRemoteHeld()).To(BeTrue())
+		Expect(remoteHolds).To(Receive(BeTrue()))
+
+		var offer string
+		Expect(offers).To(Receive(&offer))
+		Expect(offer).To(ContainSubstring("o=alice 1 2 IN IP4"))
+		Expect(dialog.GetMediaDirection(offer)).To(Equal(dialog.SendOnly))
+		Expect(aliceOA.LocalBody()).To(Equal(offer))
+
+		_, err = alice.Resume(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(alice.IsHeld()).To(BeFalse())
+		Expect(remoteHolds).To(Receive(BeFalse()))
+		Expect(offers).To(Receive(&offer))
+		Expect(offer).To(ContainSubstring("o=alice 1 3 IN IP4"))
+		Expect(dialog.GetMediaDirection(offer)).To(Equal(dialog.SendRecv))
+	})
+})
@@ -0,0 +1,283 @@
+package dialog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	ContentTypeDTMFRelay = "application/dtmf-relay"
+	ContentTypeDTMF      = "application/dtmf"
+	DefaultDTMFDuration  = 250 * time.Millisecond
+)
+
+// DTMF is a telephone-event signaled with INFO, used when RFC 2833 events can not be sent in RTP.
+type DTMF struct {
+	// Signal is one of 0-9, *, #, A-D or 16 for hook flash.
+	Signal string
+	// Duration of the tone, default is DefaultDTMFDuration.
+	Duration time.Duration
+}
+
+// String returns application/dtmf-relay body.
+func (dtmf DTMF) String() string {
+	duration := dtmf.Duration
+	if duration <= 0 {
+		duration = DefaultDTMFDuration
+	}
+
+	return fmt.Sprintf("Signal=%s\r\nDuration=%d\r\n", dtmf.Signal, duration/time.Millisecond)
+}
+
+// ParseDTMF parses application/dtmf-relay or application/dtmf body.
+func ParseDTMF(contentType, body string) (DTMF, error) {
+	var dtmf DTMF
+	switch {
+	case isMediaType(contentType, ContentTypeDTMF):
+		dtmf.Signal = strings.TrimSpace(body)
+	case isMediaType(contentType, ContentTypeDTMFRelay):
+		scanner := bufio.NewScanner(strings.NewReader(body))
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			value := strings.TrimSpace(parts[1])
+			switch strings.ToLower(strings.TrimSpace(parts[0])) {
+			case "signal":
+				dtmf.Signal = value
+			case "duration":
+				ms, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return DTMF{}, fmt.Errorf("invalid DTMF duration '%s': %w", value, err)
+				}
+				dtmf.Duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+	default:
+		return DTMF{}, fmt.Errorf("content type '%s' is not DTMF", contentType)
+	}
+
+	if !validDTMFSignal(dtmf.Signal) {
+		return DTMF{}, fmt.Errorf("invalid DTMF signal '%s'", dtmf.Signal)
+	}
+	if dtmf.Duration <= 0 {
+		dtmf.Duration = DefaultDTMFDuration
+	}
+
+	return dtmf, nil
+}
+
+func validDTMFSignal(signal string) bool {
+	if signal == "16" {
+		return true
+	}
+
+	return len(signal) == 1 && strings.Contains("0123456789*#ABCDabcd", signal)
+}
+
+// InfoConfig describes INFO options.
+type InfoConfig struct {
+	Authorizer sip.Authorizer
+	// Headers are appended to each INFO request.
+	Headers []sip.Header
+	// Packages are accepted Info packages - RFC 6086. INFO with other Info-Package is rejected with 469,
+	// INFO without Info-Package is processed in the legacy mode of RFC 2976.
+	Packages []string
+	// OnDTMF is called on INFO with DTMF body.
+	OnDTMF func(dlg Dialog, dtmf DTMF)
+	// OnInfo is called on other INFO requests. Returned *sip.RequestError rejects the request with its code,
+	// nil handler rejects bodies with 415 Unsupported Media Type.
+	OnInfo func(dlg Dialog, req sip.Request) error
+}
+
+// Info sends and receives INFO requests in the dialog - RFC 6086.
+type Info interface {
+	// Send sends INFO with the body and waits for the response.
+	Send(ctx context.Context, contentType, body string, headers ...sip.Header) (sip.Response, error)
+	// SendDTMF sends INFO with application/dtmf-relay body.
+	SendDTMF(ctx context.Context, dtmf DTMF) (sip.Response, error)
+	// HandleInfo processes incoming INFO and responds through the transaction.
+	HandleInfo(req sip.Request, tx sip.ServerTransaction) error
+}
+
+type info struct {
+	dlg       Dialog
+	requester gosip.RequestSender
+	config    InfoConfig
+
+	log log.Logger
+}
+
+// NewInfo creates INFO handler of the dialog.
+func NewInfo(dlg Dialog, requester gosip.RequestSender, config InfoConfig, logger log.Logger) Info {
+	i := &info{
+		dlg:       dlg,
+		requester: requester,
+		config:    config,
+	}
+	i.log = logger.
+		WithPrefix("dialog.Info").
+		WithFields(log.Fields{
+			"dialog_id": dlg.ID(),
+			"info_ptr":  fmt.Sprintf("%p", i),
+		})
+
+	return i
+}
+
+func (i *info) Log() log.Logger {
+	return i.log
+}
+
+func (i *info) Send(ctx context.Context, contentType, body string, headers ...sip.Header) (sip.Response, error) {
+	if i.dlg.State() == Terminated {
+		return nil, fmt.Errorf("%s is terminated", i.dlg)
+	}
+
+	hdrs := make([]sip.Header, 0)
+	if body != "" && contentType != "" {
+		ct := sip.ContentType(contentType)
+		hdrs = append(hdrs, &ct)
+	}
+	hdrs = append(hdrs, headers...)
+	for _, hdr := range i.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	req, err := i.dlg.NewRequest(sip.INFO, body, hdrs...)
+	if err != nil {
+		return nil, err
+	}
+
+	options := make([]gosip.RequestWithContextOption, 0)
+	if i.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(i.config.Authorizer))
+	}
+
+	res, err := i.requester.RequestWithContext(ctx, req, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.dlg.ReceiveResponse(res); err != nil {
+		i.Log().WithFields(res.Fields()).Warnf("update dialog failed: %s", err)
+	}
+
+	return res, nil
+}
+
+func (i *info) SendDTMF(ctx context.Context, dtmf DTMF) (sip.Response, error) {
+	if !validDTMFSignal(dtmf.Signal) {
+		return nil, fmt.Errorf("invalid DTMF signal '%s'", dtmf.Signal)
+	}
+
+	return i.Send(ctx, ContentTypeDTMFRelay, dtmf.String())
+}
+
+func (i *info) HandleInfo(req sip.Request, tx sip.ServerTransaction) error {
+	if req.Method() != sip.INFO {
+		return fmt.Errorf("request '%s' is not INFO", req.Short())
+	}
+	if i.dlg.State() == Terminated || !i.dlg.Match(req) {
+		return tx.Respond(sip.NewResponseFromRequest("", req, 481, "Call/Transaction Does Not Exist", ""))
+	}
+	if err := i.dlg.ReceiveRequest(req); err != nil {
+		_ = tx.Respond(sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""))
+
+		return err
+	}
+
+	// RFC 6086 4.2.2. unknown Info package
+	if hdrs := req.GetHeaders("Info-Package"); len(hdrs) > 0 && !i.supportsPackage(hdrs[0].Value()) {
+		res := sip.NewResponseFromRequest("", req, 469, "Bad Info Package", "")
+		res.AppendHeader(&sip.GenericHeader{
+			HeaderName: "Recv-Info",
+			Contents:   strings.Join(i.config.Packages, ", "),
+		})
+
+		return tx.Respond(res)
+	}
+
+	var contentType string
+	if hdr, ok := req.ContentType(); ok {
+		contentType = hdr.Value()
+	}
+
+	if req.Body() != "" && i.config.OnDTMF != nil &&
+		(isMediaType(contentType, ContentTypeDTMFRelay) || isMediaType(contentType, ContentTypeDTMF)) {
+		dtmf, err := ParseDTMF(contentType, req.Body())
+		if err != nil {
+			i.Log().WithFields(req.Fields()).Debugf("DTMF rejected: %s", err)
+
+			return tx.Respond(sip.NewResponseFromRequest("", req, 400, "Bad Request", ""))
+		}
+		if err := tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", "")); err != nil {
+			return err
+		}
+		i.config.OnDTMF(i.dlg, dtmf)
+
+		return nil
+	}
+
+	var err error
+	switch {
+	case i.config.OnInfo != nil:
+		err = i.config.OnInfo(i.dlg, req)
+	case req.Body() != "":
+		res := sip.NewResponseFromRequest("", req, 415, "Unsupported Media Type", "")
+		if i.config.OnDTMF != nil {
+			res.AppendHeader(&sip.GenericHeader{
+				HeaderName: "Accept",
+				Contents:   ContentTypeDTMFRelay + ", " + ContentTypeDTMF,
+			})
+		}
+
+		return tx.Respond(res)
+	}
+
+	var reqErr *sip.RequestError
+	switch {
+	case err == nil:
+		return tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+	case errors.As(err, &reqErr):
+		return tx.Respond(sip.NewResponseFromRequest("", req, sip.StatusCode(reqErr.Code), reqErr.Reason, ""))
+	default:
+		_ = tx.Respond(sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""))
+
+		return err
+	}
+}
+
+func (i *info) supportsPackage(pkg string) bool {
+	pkg = strings.TrimSpace(pkg)
+	if idx := strings.Index(pkg, ";"); idx >= 0 {
+		pkg = strings.TrimSpace(pkg[:idx])
+	}
+	for _, supported := range i.config.Packages {
+		if strings.EqualFold(supported, pkg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isMediaType compares media type of the Content-Type value ignoring params.
+func isMediaType(value, mediaType string) bool {
+	if idx := strings.Index(value, ";"); idx >= 0 {
+		value = value[:idx]
+	}
+
+	return strings.EqualFold(strings.TrimSpace(value), mediaType)
+}
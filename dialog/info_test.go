@@ -0,0 +1,121 @@
+package dialog_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Info", func() {
+	var (
+		aliceDlg, bobDlg dialog.Dialog
+		toBob            *testutils.Loopback
+	)
+
+	BeforeEach(func() {
+		invite := testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: info-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"",
+			"",
+		})
+		res := testutils.Response([]string{
+			"SIP/2.0 200 OK",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: info-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:bob@10.0.0.2:5060>",
+			"",
+			"",
+		})
+
+		var err error
+		aliceDlg, err = dialog.NewUACDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		bobDlg, err = dialog.NewUASDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		toBob = testutils.NewLoopback()
+	})
+
+	It("should parse DTMF bodies", func() {
+		dtmf, err := dialog.ParseDTMF("application/dtmf-relay", "Signal=5\r\nDuration=160\r\n")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dtmf).To(Equal(dialog.DTMF{Signal: "5", Duration: 160 * time.Millisecond}))
+
+		dtmf, err = dialog.ParseDTMF("application/dtmf", "#")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dtmf).To(Equal(dialog.DTMF{Signal: "#", Duration: dialog.DefaultDTMFDuration}))
+
+		_, err = dialog.ParseDTMF("application/dtmf-relay", "Signal=X\r\nDuration=160\r\n")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should send and receive DTMF", func() {
+		received := make(chan dialog.DTMF, 1)
+		alice := dialog.NewInfo(aliceDlg, toBob, dialog.InfoConfig{}, testutils.NewLogrusLogger())
+		bob := dialog.NewInfo(bobDlg, nil, dialog.InfoConfig{
+			OnDTMF: func(dlg dialog.Dialog, dtmf dialog.DTMF) {
+				received <- dtmf
+			},
+		}, testutils.NewLogrusLogger())
+		_ = toBob.OnRequest(sip.INFO, handle(bob.HandleInfo))
+
+		res, err := alice.SendDTMF(context.Background(), dialog.DTMF{Signal: "*", Duration: 100 * time.Millisecond})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Eventually(received).Should(Receive(Equal(dialog.DTMF{Signal: "*", Duration: 100 * time.Millisecond})))
+
+		_, err = alice.SendDTMF(context.Background(), dialog.DTMF{Signal: "Z"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject unsupported bodies and Info packages", func() {
+		alice := dialog.NewInfo(aliceDlg, toBob, dialog.InfoConfig{}, testutils.NewLogrusLogger())
+		bob := dialog.NewInfo(bobDlg, nil, dialog.InfoConfig{Packages: []string{"foo"}}, testutils.NewLogrusLogger())
+		_ = toBob.OnRequest(sip.INFO, handle(bob.HandleInfo))
+
+		_, err := alice.Send(context.Background(), "application/xml", "<x/>")
+		reqErr, ok := err.(*sip.RequestError)
+		Expect(ok).To(BeTrue())
+		Expect(reqErr.Code).To(Equal(uint(415)))
+
+		_, err = alice.Send(context.Background(), "application/foo", "foo", &sip.GenericHeader{
+			HeaderName: "Info-Package",
+			Contents:   "bar",
+		})
+		reqErr, ok = err.(*sip.RequestError)
+		Expect(ok).To(BeTrue())
+		Expect(reqErr.Code).To(Equal(uint(469)))
+		Expect(reqErr.Response.GetHeaders("Recv-Info")[0].Value()).To(Equal("foo"))
+	})
+
+	It("should respond 481 outside of the dialog", func() {
+		bob := dialog.NewInfo(bobDlg, nil, dialog.InfoConfig{}, testutils.NewLogrusLogger())
+		req := testutils.Request([]string{
+			"INFO sip:bob@10.0.0.2:5060 SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=other-tag",
+			"Call-ID: info-call-id",
+			"CSeq: 2 INFO",
+			"",
+			"",
+		})
+		tx := testutils.NewMockServerTx(req)
+		Expect(bob.HandleInfo(req, tx)).To(Succeed())
+		Expect(tx.Response().StatusCode()).To(Equal(sip.StatusCode(481)))
+	})
+})
@@ -0,0 +1,385 @@
+package dialog
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// OfferAnswerState is a state of the session description negotiation - RFC 3264, RFC 6337.
+type OfferAnswerState int
+
+const (
+	// Stable means that there is no outstanding offer.
+	Stable OfferAnswerState = iota
+	// LocalOffer means that the offer was sent and the answer is awaited.
+	LocalOffer
+	// RemoteOffer means that the offer was received and the answer is not sent yet.
+	RemoteOffer
+)
+
+func (state OfferAnswerState) String() string {
+	switch state {
+	case Stable:
+		return "Stable"
+	case LocalOffer:
+		return "LocalOffer"
+	case RemoteOffer:
+		return "RemoteOffer"
+	default:
+		return "Unknown"
+	}
+}
+
+// OfferAnswerConfig describes offer/answer tracker options.
+type OfferAnswerConfig struct {
+	// OnOffer is called on each offer received from the remote side.
+	OnOffer func(body string, msg sip.Message)
+	// OnAnswer is called on each answer received from the remote side.
+	OnAnswer func(body string, msg sip.Message)
+}
+
+// OfferAnswer tracks offer/answer exchanges of the dialog session - RFC 6337 2.
+// Bodies of INVITE, UPDATE, PRACK, ACK requests and reliable responses are classified as offers or answers
+// according to the transaction patterns:
+//   - INVITE with offer is answered in 2xx or reliable 1xx response;
+//   - INVITE without offer gets offer in 2xx or reliable 1xx response, that is answered in ACK or PRACK;
+//   - UPDATE and PRACK with offer are answered in 2xx response;
+//   - failure response discards the offer of the transaction.
+type OfferAnswer interface {
+	State() OfferAnswerState
+	// LocalBody returns the last local session description of the completed exchange.
+	LocalBody() string
+	// RemoteBody returns the last remote session description of the completed exchange.
+	RemoteBody() string
+	// SendRequest records outgoing request, error means that the request can not be sent now.
+	SendRequest(req sip.Request) error
+	// ReceiveRequest records incoming request and returns the failure response
+	// if the request conflicts with the outstanding offer - RFC 3261 14.2, RFC 3311 5.2.
+	ReceiveRequest(req sip.Request) sip.Response
+	// SendResponse records outgoing response.
+	SendResponse(res sip.Response) error
+	// ReceiveResponse records incoming response.
+	ReceiveResponse(res sip.Response) error
+	// Rollback discards outstanding offer.
+	Rollback()
+}
+
+type offerAnswer struct {
+	config OfferAnswerConfig
+
+	mu         sync.RWMutex
+	state      OfferAnswerState
+	offer      string
+	localBody  string
+	remoteBody string
+	// transaction that carries the outstanding offer or awaits the offer in the response
+	method     sip.RequestMethod
+	seq        uint32
+	awaitOffer bool
+}
+
+// NewOfferAnswer creates offer/answer tracker in Stable state.
+func NewOfferAnswer(config OfferAnswerConfig) OfferAnswer {
+	return &offerAnswer{
+		config: config,
+	}
+}
+
+func (oa *offerAnswer) State() OfferAnswerState {
+	oa.mu.RLock()
+	defer oa.mu.RUnlock()
+	return oa.state
+}
+
+func (oa *offerAnswer) LocalBody() string {
+	oa.mu.RLock()
+	defer oa.mu.RUnlock()
+	return oa.localBody
+}
+
+func (oa *offerAnswer) RemoteBody() string {
+	oa.mu.RLock()
+	defer oa.mu.RUnlock()
+	return oa.remoteBody
+}
+
+func (oa *offerAnswer) SendRequest(req sip.Request) error {
+	cseq, ok := req.CSeq()
+	if !ok {
+		return fmt.Errorf("'CSeq' header not found in request '%s'", req.Short())
+	}
+	body := req.Body()
+
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+
+	switch req.Method() {
+	case sip.INVITE:
+		if oa.state != Stable || oa.awaitOffer {
+			return fmt.Errorf("INVITE is not allowed in %s state", oa.state)
+		}
+		if body == "" {
+			oa.awaitOffer = true
+			oa.method, oa.seq = sip.INVITE, cseq.SeqNo
+
+			return nil
+		}
+
+		return oa.setOffer(LocalOffer, body, sip.INVITE, cseq.SeqNo)
+	case sip.UPDATE:
+		if body == "" {
+			return nil
+		}
+		if oa.state != Stable {
+			return fmt.Errorf("offer is not allowed in %s state", oa.state)
+		}
+
+		return oa.setOffer(LocalOffer, body, sip.UPDATE, cseq.SeqNo)
+	case sip.PRACK:
+		switch {
+		case body == "":
+			return nil
+		case oa.state == RemoteOffer:
+			return oa.setAnswer(body, true)
+		case oa.state == Stable:
+			return oa.setOffer(LocalOffer, body, sip.PRACK, cseq.SeqNo)
+		default:
+			return fmt.Errorf("offer is not allowed in %s state", oa.state)
+		}
+	case sip.ACK:
+		if body != "" && oa.state == RemoteOffer && oa.method == sip.INVITE {
+			return oa.setAnswer(body, true)
+		}
+	}
+
+	return nil
+}
+
+func (oa *offerAnswer) ReceiveRequest(req sip.Request) sip.Response {
+	cseq, ok := req.CSeq()
+	if !ok {
+		return sip.NewResponseFromRequest("", req, 400, "Bad Request", "")
+	}
+	body := req.Body()
+
+	oa.mu.Lock()
+
+	var res sip.Response
+	var offer, answer bool
+	switch req.Method() {
+	case sip.INVITE, sip.UPDATE:
+		if req.Method() == sip.UPDATE && body == "" {
+			break
+		}
+		if res = oa.checkGlare(req); res != nil {
+			break
+		}
+		if body == "" {
+			oa.awaitOffer = true
+			oa.method, oa.seq = sip.INVITE, cseq.SeqNo
+
+			break
+		}
+		_ = oa.setOffer(RemoteOffer, body, req.Method(), cseq.SeqNo)
+		offer = true
+	case sip.PRACK:
+		switch {
+		case body == "":
+		case oa.state == LocalOffer:
+			_ = oa.setAnswer(body, false)
+			answer = true
+		case oa.state == Stable:
+			_ = oa.setOffer(RemoteOffer, body, sip.PRACK, cseq.SeqNo)
+			offer = true
+		default:
+			res = sip.NewResponseFromRequest("", req, 491, "Request Pending", "")
+		}
+	case sip.ACK:
+		if body != "" && oa.state == LocalOffer && oa.method == sip.INVITE {
+			_ = oa.setAnswer(body, false)
+			answer = true
+		}
+	}
+	oa.mu.Unlock()
+
+	oa.notify(body, req, offer, answer)
+
+	return res
+}
+
+// checkGlare returns 491 if the local offer is outstanding
+// and 500 with Retry-After if the remote offer is not answered yet - RFC 3261 14.2.
+func (oa *offerAnswer) checkGlare(req sip.Request) sip.Response {
+	switch {
+	case oa.state == LocalOffer || oa.awaitOffer && oa.state == Stable && req.Method() == sip.INVITE:
+		return sip.NewResponseFromRequest("", req, 491, "Request Pending", "")
+	case oa.state == RemoteOffer:
+		res := sip.NewResponseFromRequest("", req, 500, "Server Internal Error", "")
+		res.AppendHeader(&sip.GenericHeader{
+			HeaderName: "Retry-After",
+			Contents:   strconv.Itoa(rand.Intn(11)),
+		})
+
+		return res
+	default:
+		return nil
+	}
+}
+
+func (oa *offerAnswer) SendResponse(res sip.Response) error {
+	cseq, ok := res.CSeq()
+	if !ok {
+		return fmt.Errorf("'CSeq' header not found in response '%s'", res.Short())
+	}
+
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+
+	if !oa.isPending(cseq) {
+		return nil
+	}
+	if res.StatusCode() >= 300 {
+		oa.rollback()
+
+		return nil
+	}
+	if res.Body() == "" || !isReliable(res) {
+		return nil
+	}
+
+	switch {
+	case oa.state == RemoteOffer:
+		return oa.setAnswer(res.Body(), true)
+	case oa.awaitOffer:
+		oa.awaitOffer = false
+
+		return oa.setOffer(LocalOffer, res.Body(), cseq.MethodName, cseq.SeqNo)
+	}
+
+	return nil
+}
+
+func (oa *offerAnswer) ReceiveResponse(res sip.Response) error {
+	cseq, ok := res.CSeq()
+	if !ok {
+		return fmt.Errorf("'CSeq' header not found in response '%s'", res.Short())
+	}
+
+	oa.mu.Lock()
+
+	if !oa.isPending(cseq) {
+		oa.mu.Unlock()
+
+		return nil
+	}
+	if res.StatusCode() >= 300 {
+		oa.rollback()
+		oa.mu.Unlock()
+
+		return nil
+	}
+	if res.Body() == "" || !isReliable(res) {
+		oa.mu.Unlock()
+
+		return nil
+	}
+
+	var offer, answer bool
+	var err error
+	switch {
+	case oa.state == LocalOffer:
+		err = oa.setAnswer(res.Body(), false)
+		answer = err == nil
+	case oa.awaitOffer:
+		oa.awaitOffer = false
+		err = oa.setOffer(RemoteOffer, res.Body(), cseq.MethodName, cseq.SeqNo)
+		offer = err == nil
+	}
+	oa.mu.Unlock()
+
+	oa.notify(res.Body(), res, offer, answer)
+
+	return err
+}
+
+func (oa *offerAnswer) Rollback() {
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+
+	oa.rollback()
+}
+
+func (oa *offerAnswer) rollback() {
+	oa.state = Stable
+	oa.offer = ""
+	oa.awaitOffer = false
+	oa.method, oa.seq = "", 0
+}
+
+// isPending checks that the response belongs to the transaction of the outstanding offer.
+func (oa *offerAnswer) isPending(cseq *sip.CSeq) bool {
+	return (oa.state != Stable || oa.awaitOffer) && oa.method == cseq.MethodName && oa.seq == cseq.SeqNo
+}
+
+func (oa *offerAnswer) setOffer(state OfferAnswerState, body string, method sip.RequestMethod, seq uint32) error {
+	if oa.state != Stable {
+		return fmt.Errorf("offer is not allowed in %s state", oa.state)
+	}
+	oa.state = state
+	oa.offer = body
+	oa.method, oa.seq = method, seq
+
+	return nil
+}
+
+func (oa *offerAnswer) setAnswer(body string, local bool) error {
+	expected := LocalOffer
+	if local {
+		expected = RemoteOffer
+	}
+	if oa.state != expected {
+		return fmt.Errorf("answer is not expected in %s state", oa.state)
+	}
+
+	if local {
+		oa.remoteBody, oa.localBody = oa.offer, body
+	} else {
+		oa.localBody, oa.remoteBody = oa.offer, body
+	}
+	oa.rollback()
+
+	return nil
+}
+
+func (oa *offerAnswer) notify(body string, msg sip.Message, offer, answer bool) {
+	if offer && oa.config.OnOffer != nil {
+		oa.config.OnOffer(body, msg)
+	}
+	if answer && oa.config.OnAnswer != nil {
+		oa.config.OnAnswer(body, msg)
+	}
+}
+
+// isReliable checks that the response can carry offer or answer - 2xx or reliable 1xx - RFC 3262.
+func isReliable(res sip.Response) bool {
+	if res.IsSuccess() {
+		return true
+	}
+
+	return res.IsProvisional() && len(res.GetHeaders("RSeq")) > 0
+}
+
+// GlareRetryDelay returns delay before retry of the request rejected with 491 - RFC 3261 14.1.
+// The owner of the Call-ID (dialog UAC) waits 2.1-4 seconds, another side waits 0-2 seconds.
+func GlareRetryDelay(dlg Dialog) time.Duration {
+	if dlg.IsUAC() {
+		return time.Duration(210+rand.Intn(190)) * 10 * time.Millisecond
+	}
+
+	return time.Duration(rand.Intn(200)) * 10 * time.Millisecond
+}
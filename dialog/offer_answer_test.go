@@ -0,0 +1,116 @@
+package dialog_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("OfferAnswer", func() {
+	var (
+		oa      dialog.OfferAnswer
+		offers  []string
+		answers []string
+	)
+
+	request := func(method sip.RequestMethod, seq, body string) sip.Request {
+		return testutils.Request([]string{
+			string(method) + " sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: offer-answer-call-id",
+			"CSeq: " + seq + " " + string(method),
+			"",
+			body,
+		})
+	}
+
+	response := func(req sip.Request, code sip.StatusCode, body string, hdrs ...sip.Header) sip.Response {
+		res := sip.NewResponseFromRequest("", req, code, "", body)
+		for _, hdr := range hdrs {
+			res.AppendHeader(hdr)
+		}
+		return res
+	}
+
+	BeforeEach(func() {
+		offers, answers = nil, nil
+		oa = dialog.NewOfferAnswer(dialog.OfferAnswerConfig{
+			OnOffer: func(body string, msg sip.Message) {
+				offers = append(offers, body)
+			},
+			OnAnswer: func(body string, msg sip.Message) {
+				answers = append(answers, body)
+			},
+		})
+	})
+
+	It("should handle offer in INVITE and answer in 2xx", func() {
+		invite := request(sip.INVITE, "1", "offer")
+		Expect(oa.SendRequest(invite)).To(Succeed())
+		Expect(oa.State()).To(Equal(dialog.LocalOffer))
+
+		// unreliable provisional response does not carry answer
+		Expect(oa.ReceiveResponse(response(invite, 183, "early"))).To(Succeed())
+		Expect(oa.State()).To(Equal(dialog.LocalOffer))
+
+		Expect(oa.ReceiveResponse(response(invite, 200, "answer"))).To(Succeed())
+		Expect(oa.State()).To(Equal(dialog.Stable))
+		Expect(answers).To(Equal([]string{"answer"}))
+		Expect(oa.LocalBody()).To(Equal("offer"))
+		Expect(oa.RemoteBody()).To(Equal("answer"))
+	})
+
+	It("should handle offer in 2xx and answer in ACK", func() {
+		invite := request(sip.INVITE, "1", "")
+		Expect(oa.SendRequest(invite)).To(Succeed())
+		Expect(oa.ReceiveResponse(response(invite, 200, "offer"))).To(Succeed())
+		Expect(oa.State()).To(Equal(dialog.RemoteOffer))
+		Expect(offers).To(Equal([]string{"offer"}))
+
+		Expect(oa.SendRequest(request(sip.ACK, "1", "answer"))).To(Succeed())
+		Expect(oa.State()).To(Equal(dialog.Stable))
+		Expect(oa.LocalBody()).To(Equal("answer"))
+	})
+
+	It("should handle offer in reliable 1xx and answer in PRACK", func() {
+		invite := request(sip.INVITE, "1", "")
+		Expect(oa.ReceiveRequest(invite)).To(BeNil())
+
+		rseq := &sip.GenericHeader{HeaderName: "RSeq", Contents: "1"}
+		Expect(oa.SendResponse(response(invite, 183, "offer", rseq))).To(Succeed())
+		Expect(oa.State()).To(Equal(dialog.LocalOffer))
+
+		Expect(oa.ReceiveRequest(request(sip.PRACK, "2", "answer"))).To(BeNil())
+		Expect(oa.State()).To(Equal(dialog.Stable))
+		Expect(answers).To(Equal([]string{"answer"}))
+
+		// 2xx repeats the offer of the completed exchange
+		Expect(oa.SendResponse(response(invite, 200, "offer"))).To(Succeed())
+		Expect(oa.State()).To(Equal(dialog.Stable))
+	})
+
+	It("should reject glare", func() {
+		Expect(oa.SendRequest(request(sip.UPDATE, "1", "local offer"))).To(Succeed())
+		res := oa.ReceiveRequest(request(sip.INVITE, "10", "remote offer"))
+		Expect(res).ToNot(BeNil())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(491)))
+		Expect(oa.SendRequest(request(sip.UPDATE, "2", "another offer"))).ToNot(Succeed())
+
+		oa.Rollback()
+		update := request(sip.UPDATE, "11", "remote offer")
+		Expect(oa.ReceiveRequest(update)).To(BeNil())
+		res = oa.ReceiveRequest(request(sip.UPDATE, "12", "another offer"))
+		Expect(res).ToNot(BeNil())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(500)))
+		Expect(res.GetHeaders("Retry-After")).To(HaveLen(1))
+
+		// rejected offer is discarded
+		Expect(oa.SendResponse(response(update, 488, ""))).To(Succeed())
+		Expect(oa.State()).To(Equal(dialog.Stable))
+	})
+})
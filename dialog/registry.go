@@ -0,0 +1,311 @@
+package dialog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// HangupFunc tears down the dialog on forced teardown of the registry.
+type HangupFunc func(ctx context.Context, dlg Dialog) error
+
+// DialogStore is a backend of the dialog registry.
+// Implementations should be safe for concurrent use.
+type DialogStore interface {
+	Put(dlg Dialog) error
+	Delete(id string) error
+	// Get returns the dialog by ID, nil if it is not found.
+	Get(id string) (Dialog, error)
+	// ByCallID returns all dialogs with the Call-ID, e.g. early dialogs of the forked INVITE.
+	ByCallID(callID sip.CallID) ([]Dialog, error)
+	All() ([]Dialog, error)
+}
+
+type memoryDialogStore struct {
+	mu      sync.RWMutex
+	dialogs map[string]Dialog
+	callIDs map[sip.CallID]map[string]Dialog
+}
+
+// NewMemoryDialogStore creates in-memory dialog store.
+func NewMemoryDialogStore() DialogStore {
+	return &memoryDialogStore{
+		dialogs: make(map[string]Dialog),
+		callIDs: make(map[sip.CallID]map[string]Dialog),
+	}
+}
+
+func (store *memoryDialogStore) Put(dlg Dialog) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.dialogs[dlg.ID()] = dlg
+	if store.callIDs[dlg.CallID()] == nil {
+		store.callIDs[dlg.CallID()] = make(map[string]Dialog)
+	}
+	store.callIDs[dlg.CallID()][dlg.ID()] = dlg
+
+	return nil
+}
+
+func (store *memoryDialogStore) Delete(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	dlg, ok := store.dialogs[id]
+	if !ok {
+		return nil
+	}
+	delete(store.dialogs, id)
+	delete(store.callIDs[dlg.CallID()], id)
+	if len(store.callIDs[dlg.CallID()]) == 0 {
+		delete(store.callIDs, dlg.CallID())
+	}
+
+	return nil
+}
+
+func (store *memoryDialogStore) Get(id string) (Dialog, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.dialogs[id], nil
+}
+
+func (store *memoryDialogStore) ByCallID(callID sip.CallID) ([]Dialog, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	dialogs := make([]Dialog, 0, len(store.callIDs[callID]))
+	for _, dlg := range store.callIDs[callID] {
+		dialogs = append(dialogs, dlg)
+	}
+
+	return dialogs, nil
+}
+
+func (store *memoryDialogStore) All() ([]Dialog, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	dialogs := make([]Dialog, 0, len(store.dialogs))
+	for _, dlg := range store.dialogs {
+		dialogs = append(dialogs, dlg)
+	}
+
+	return dialogs, nil
+}
+
+// RegistryConfig describes dialog registry options.
+type RegistryConfig struct {
+	// Store is a dialog store backend, default is in-memory store.
+	Store DialogStore
+	// Hangup is a teardown of dialogs added without own hangup, default sends BYE.
+	Hangup HangupFunc
+}
+
+// Registry keeps active dialogs for lookup, enumeration and administrative teardown.
+type Registry interface {
+	// Add registers the dialog, it is removed automatically when the dialog is terminated.
+	// hangup overrides the default teardown of the dialog, e.g. rejection of the early INVITE on the UAS side
+	// or hangup of both legs of the B2BUA call.
+	Add(dlg Dialog, hangup HangupFunc) error
+	Remove(id string)
+	Get(id string) (Dialog, bool)
+	// Lookup returns the dialog the in-dialog message belongs to.
+	Lookup(msg sip.Message) (Dialog, bool)
+	ByCallID(callID sip.CallID) []Dialog
+	List() []Dialog
+	Count() int
+	// Hangup tears down the dialog and terminates it even if the teardown failed.
+	Hangup(ctx context.Context, id string) error
+	// HangupAll tears down all dialogs, it returns the first failure.
+	HangupAll(ctx context.Context) error
+}
+
+type registry struct {
+	requester gosip.RequestSender
+	config    RegistryConfig
+
+	mu      sync.Mutex
+	hangups map[string]HangupFunc
+
+	log log.Logger
+}
+
+// NewRegistry creates dialog registry, requester is used to send BYE by the default hangup.
+func NewRegistry(requester gosip.RequestSender, config RegistryConfig, logger log.Logger) Registry {
+	if config.Store == nil {
+		config.Store = NewMemoryDialogStore()
+	}
+
+	r := &registry{
+		requester: requester,
+		config:    config,
+		hangups:   make(map[string]HangupFunc),
+	}
+	if r.config.Hangup == nil {
+		r.config.Hangup = r.bye
+	}
+	r.log = logger.
+		WithPrefix("dialog.Registry").
+		WithFields(log.Fields{
+			"registry_ptr": fmt.Sprintf("%p", r),
+		})
+
+	return r
+}
+
+func (r *registry) Log() log.Logger {
+	return r.log
+}
+
+func (r *registry) Add(dlg Dialog, hangup HangupFunc) error {
+	if dlg.State() == Terminated {
+		return fmt.Errorf("%s is terminated", dlg)
+	}
+	if err := r.config.Store.Put(dlg); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if hangup != nil {
+		r.hangups[dlg.ID()] = hangup
+	}
+	r.mu.Unlock()
+
+	go func() {
+		<-dlg.Done()
+		r.remove(dlg)
+	}()
+
+	return nil
+}
+
+func (r *registry) Remove(id string) {
+	if dlg, ok := r.Get(id); ok {
+		r.remove(dlg)
+	}
+}
+
+// remove deletes the dialog only if the store still holds the same object.
+func (r *registry) remove(dlg Dialog) {
+	stored, err := r.config.Store.Get(dlg.ID())
+	if err != nil || stored != dlg {
+		return
+	}
+	if err := r.config.Store.Delete(dlg.ID()); err != nil {
+		r.Log().Errorf("delete %s failed: %s", dlg, err)
+	}
+
+	r.mu.Lock()
+	delete(r.hangups, dlg.ID())
+	r.mu.Unlock()
+}
+
+func (r *registry) Get(id string) (Dialog, bool) {
+	dlg, err := r.config.Store.Get(id)
+	if err != nil {
+		r.Log().Errorf("get dialog %s failed: %s", id, err)
+
+		return nil, false
+	}
+
+	return dlg, dlg != nil
+}
+
+func (r *registry) Lookup(msg sip.Message) (Dialog, bool) {
+	callID, ok := msg.CallID()
+	if !ok {
+		return nil, false
+	}
+
+	for _, dlg := range r.ByCallID(*callID) {
+		if dlg.Match(msg) {
+			return dlg, true
+		}
+	}
+
+	return nil, false
+}
+
+func (r *registry) ByCallID(callID sip.CallID) []Dialog {
+	dialogs, err := r.config.Store.ByCallID(callID)
+	if err != nil {
+		r.Log().Errorf("get dialogs of Call-ID %s failed: %s", callID, err)
+
+		return nil
+	}
+
+	return dialogs
+}
+
+func (r *registry) List() []Dialog {
+	dialogs, err := r.config.Store.All()
+	if err != nil {
+		r.Log().Errorf("get all dialogs failed: %s", err)
+
+		return nil
+	}
+
+	return dialogs
+}
+
+func (r *registry) Count() int {
+	return len(r.List())
+}
+
+func (r *registry) Hangup(ctx context.Context, id string) error {
+	dlg, ok := r.Get(id)
+	if !ok {
+		return fmt.Errorf("dialog %s not found", id)
+	}
+
+	r.mu.Lock()
+	hangup, ok := r.hangups[id]
+	r.mu.Unlock()
+	if !ok {
+		hangup = r.config.Hangup
+	}
+
+	err := hangup(ctx, dlg)
+	if err != nil {
+		r.Log().Warnf("hangup %s failed: %s", dlg, err)
+	}
+	dlg.Terminate()
+	r.remove(dlg)
+
+	return err
+}
+
+func (r *registry) HangupAll(ctx context.Context) error {
+	var firstErr error
+	for _, dlg := range r.List() {
+		if err := r.Hangup(ctx, dlg.ID()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// bye sends BYE in the dialog - RFC 3261 15.1.1.
+// The UAS can not send BYE in the early dialog, such dialog is terminated locally.
+func (r *registry) bye(ctx context.Context, dlg Dialog) error {
+	if dlg.State() == Early && !dlg.IsUAC() {
+		return fmt.Errorf("%s is early on the UAS side, BYE is not allowed", dlg)
+	}
+
+	req, err := dlg.NewRequest(sip.BYE, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = r.requester.RequestWithContext(ctx, req)
+
+	return err
+}
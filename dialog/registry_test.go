@@ -0,0 +1,122 @@
+package dialog_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Registry", func() {
+	var (
+		invite   sip.Request
+		registry dialog.Registry
+		toBob    *testutils.Loopback
+		byes     chan sip.Request
+	)
+
+	newDialog := func(status, toTag string) dialog.Dialog {
+		res := testutils.Response([]string{
+			"SIP/2.0 " + status,
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=" + toTag,
+			"Call-ID: registry-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:bob@10.0.0.2:5060>",
+			"",
+			"",
+		})
+		dlg, err := dialog.NewUACDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		return dlg
+	}
+
+	BeforeEach(func() {
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: registry-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"",
+			"",
+		})
+		byes = make(chan sip.Request, 10)
+		toBob = testutils.NewLoopback()
+		_ = toBob.OnRequest(sip.BYE, func(req sip.Request, tx sip.ServerTransaction) {
+			byes <- req
+			_ = tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+		})
+		registry = dialog.NewRegistry(toBob, dialog.RegistryConfig{}, testutils.NewLogrusLogger())
+	})
+
+	It("should index dialogs by Call-ID and tags", func() {
+		early1 := newDialog("180 Ringing", "bob-tag-1")
+		early2 := newDialog("183 Session Progress", "bob-tag-2")
+		Expect(registry.Add(early1, nil)).To(Succeed())
+		Expect(registry.Add(early2, nil)).To(Succeed())
+
+		Expect(registry.Count()).To(Equal(2))
+		Expect(registry.ByCallID("registry-call-id")).To(ConsistOf(early1, early2))
+
+		dlg, ok := registry.Get(early2.ID())
+		Expect(ok).To(BeTrue())
+		Expect(dlg).To(Equal(early2))
+
+		req := testutils.Request([]string{
+			"INFO sip:alice@10.0.0.1:5060 SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:bob@example.com>;tag=bob-tag-1",
+			"To: <sip:alice@example.com>;tag=alice-tag",
+			"Call-ID: registry-call-id",
+			"CSeq: 1 INFO",
+			"",
+			"",
+		})
+		dlg, ok = registry.Lookup(req)
+		Expect(ok).To(BeTrue())
+		Expect(dlg).To(Equal(early1))
+	})
+
+	It("should remove terminated dialogs", func() {
+		dlg := newDialog("200 OK", "bob-tag")
+		Expect(registry.Add(dlg, nil)).To(Succeed())
+		Expect(registry.Count()).To(Equal(1))
+
+		dlg.Terminate()
+		Eventually(registry.Count).Should(BeZero())
+		Expect(registry.Add(dlg, nil)).ToNot(Succeed())
+	})
+
+	It("should hang up dialogs with BYE or own hangup", func() {
+		confirmed := newDialog("200 OK", "bob-tag-1")
+		Expect(registry.Add(confirmed, nil)).To(Succeed())
+
+		var hungUp dialog.Dialog
+		custom := newDialog("200 OK", "bob-tag-2")
+		Expect(registry.Add(custom, func(ctx context.Context, dlg dialog.Dialog) error {
+			hungUp = dlg
+			return nil
+		})).To(Succeed())
+
+		Expect(registry.Hangup(context.Background(), confirmed.ID())).To(Succeed())
+		var bye sip.Request
+		Eventually(byes).Should(Receive(&bye))
+		Expect(bye.Method()).To(Equal(sip.BYE))
+		Expect(confirmed.State()).To(Equal(dialog.Terminated))
+		Expect(registry.Count()).To(Equal(1))
+
+		Expect(registry.HangupAll(context.Background())).To(Succeed())
+		Expect(hungUp).To(Equal(custom))
+		Expect(custom.State()).To(Equal(dialog.Terminated))
+		Expect(registry.Count()).To(BeZero())
+		Consistently(byes).ShouldNot(Receive())
+	})
+})
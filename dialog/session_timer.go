@@ -0,0 +1,511 @@
+package dialog
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const (
+	// DefaultSessionExpires is the recommended session interval - RFC 4028 4.
+	DefaultSessionExpires = 30 * time.Minute
+	// MinSessionExpires is the lowest allowed session interval - RFC 4028 4.
+	MinSessionExpires = 90 * time.Second
+
+	RefresherUAC = "uac"
+	RefresherUAS = "uas"
+
+	timerOption = "timer"
+)
+
+// SessionExpires is a value of the Session-Expires header - RFC 4028 4.
+type SessionExpires struct {
+	Delta time.Duration
+	// Refresher is RefresherUAC or RefresherUAS, roles are related to the transaction that carries the header.
+	Refresher string
+}
+
+func (se SessionExpires) String() string {
+	str := strconv.Itoa(int(se.Delta / time.Second))
+	if se.Refresher != "" {
+		str += ";refresher=" + se.Refresher
+	}
+
+	return str
+}
+
+func (se SessionExpires) Header() sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Session-Expires",
+		Contents:   se.String(),
+	}
+}
+
+// ParseSessionExpires parses Session-Expires header value.
+func ParseSessionExpires(value string) (SessionExpires, error) {
+	parts := strings.Split(value, ";")
+	sec, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return SessionExpires{}, fmt.Errorf("invalid delta in Session-Expires '%s': %w", value, err)
+	}
+
+	se := SessionExpires{Delta: time.Duration(sec) * time.Second}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "refresher") {
+			se.Refresher = strings.ToLower(strings.TrimSpace(kv[1]))
+		}
+	}
+	if se.Refresher != "" && se.Refresher != RefresherUAC && se.Refresher != RefresherUAS {
+		return SessionExpires{}, fmt.Errorf("invalid refresher in Session-Expires '%s'", value)
+	}
+
+	return se, nil
+}
+
+// GetSessionExpires returns Session-Expires of the message, also matches compact form 'x'.
+func GetSessionExpires(msg sip.Message) (SessionExpires, bool) {
+	hdrs := msg.GetHeaders("Session-Expires")
+	if len(hdrs) == 0 {
+		hdrs = msg.GetHeaders("x")
+	}
+	if len(hdrs) == 0 {
+		return SessionExpires{}, false
+	}
+
+	se, err := ParseSessionExpires(hdrs[0].Value())
+	if err != nil {
+		return SessionExpires{}, false
+	}
+
+	return se, true
+}
+
+// GetMinSE returns value of the Min-SE header.
+func GetMinSE(msg sip.Message) (time.Duration, bool) {
+	hdrs := msg.GetHeaders("Min-SE")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+
+	// params are allowed by the grammar but have no meaning
+	value := strings.SplitN(hdrs[0].Value(), ";", 2)[0]
+	sec, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(sec) * time.Second, true
+}
+
+func minSEHeader(minSE time.Duration) sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Min-SE",
+		Contents:   strconv.Itoa(int(minSE / time.Second)),
+	}
+}
+
+// SessionTimerConfig describes session timer options.
+type SessionTimerConfig struct {
+	// Expires is the requested session interval, default is DefaultSessionExpires.
+	Expires time.Duration
+	// MinSE is the lowest accepted session interval, default and the lowest allowed value is MinSessionExpires.
+	MinSE time.Duration
+	// Refresher is the preferred refresher of the UAS when UAC does not choose it, default is RefresherUAC.
+	Refresher string
+	// Method of the session refresh requests: sip.UPDATE (default) or sip.INVITE.
+	Method sip.RequestMethod
+	// Body returns session description of re-INVITE refreshes.
+	Body       func() (contentType, body string)
+	Authorizer sip.Authorizer
+	// OnRefresh is called after each successful session refresh.
+	OnRefresh func(dlg Dialog, se SessionExpires)
+	// OnExpire is called when the session is expired without refresh.
+	// BYE is sent and the dialog is terminated before the callback.
+	OnExpire func(dlg Dialog)
+}
+
+// SessionTimer keeps the INVITE session alive with periodic refreshes and tears down
+// the dialog when refreshes stop - RFC 4028.
+//
+// UAC adds RequestHeaders to the INVITE, retries 422 responses after HandleTooSmall
+// and starts the timer with the 2xx response.
+// UAS checks incoming INVITE and UPDATE requests with CheckRequest, adds ResponseHeaders to the 2xx response
+// and starts the timer with it.
+// Start should be called with the 2xx response of each session refresh transaction,
+// refreshes sent by the timer itself are handled automatically.
+type SessionTimer interface {
+	// RequestHeaders returns headers of the outgoing INVITE or UPDATE request.
+	RequestHeaders() []sip.Header
+	// HandleTooSmall processes 422 response and returns true if the request should be retried
+	// with updated RequestHeaders - RFC 4028 7.4.
+	HandleTooSmall(res sip.Response) bool
+	// CheckRequest returns 422 response if the session interval of the incoming request is too small - RFC 4028 8.1.
+	CheckRequest(req sip.Request) sip.Response
+	// ResponseHeaders returns headers of the 2xx response on the incoming request - RFC 4028 9.
+	ResponseHeaders(req sip.Request) []sip.Header
+	// Start (re)starts the timer with the 2xx response of the session refresh transaction.
+	// The timer is stopped if the response has no Session-Expires header.
+	Start(dlg Dialog, res sip.Response)
+	// Interval returns negotiated session interval.
+	Interval() time.Duration
+	// IsRefresher returns true if the local side is responsible for refreshes.
+	IsRefresher() bool
+	Stop()
+}
+
+type sessionTimer struct {
+	requester gosip.RequestSender
+	config    SessionTimerConfig
+
+	mu        sync.RWMutex
+	dlg       Dialog
+	expires   time.Duration
+	minSE     time.Duration
+	interval  time.Duration
+	refresher bool
+	timer     timing.Timer
+
+	log log.Logger
+}
+
+// NewSessionTimer creates session timer.
+func NewSessionTimer(requester gosip.RequestSender, config SessionTimerConfig, logger log.Logger) SessionTimer {
+	if config.MinSE < MinSessionExpires {
+		config.MinSE = MinSessionExpires
+	}
+	if config.Expires <= 0 {
+		config.Expires = DefaultSessionExpires
+	}
+	if config.Expires < config.MinSE {
+		config.Expires = config.MinSE
+	}
+	if config.Refresher != RefresherUAS {
+		config.Refresher = RefresherUAC
+	}
+	if config.Method == "" {
+		config.Method = sip.UPDATE
+	}
+
+	st := &sessionTimer{
+		requester: requester,
+		config:    config,
+		expires:   config.Expires,
+		minSE:     config.MinSE,
+	}
+	st.log = logger.
+		WithPrefix("dialog.SessionTimer").
+		WithFields(log.Fields{
+			"session_timer_ptr": fmt.Sprintf("%p", st),
+		})
+
+	return st
+}
+
+func (st *sessionTimer) Log() log.Logger {
+	return st.log
+}
+
+func (st *sessionTimer) Interval() time.Duration {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.interval
+}
+
+func (st *sessionTimer) IsRefresher() bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.refresher
+}
+
+func (st *sessionTimer) RequestHeaders() []sip.Header {
+	st.mu.RLock()
+	se := SessionExpires{Delta: st.expires}
+	minSE := st.minSE
+	// RFC 4028 7.4. the refresher keeps its role in the refresh requests
+	if st.dlg != nil && st.refresher {
+		se.Delta = st.interval
+		se.Refresher = RefresherUAC
+	}
+	st.mu.RUnlock()
+
+	return []sip.Header{
+		&sip.SupportedHeader{Options: []string{timerOption}},
+		se.Header(),
+		minSEHeader(minSE),
+	}
+}
+
+func (st *sessionTimer) HandleTooSmall(res sip.Response) bool {
+	if res.StatusCode() != 422 {
+		return false
+	}
+	minSE, ok := GetMinSE(res)
+	if !ok {
+		return false
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	requested := st.expires
+	if st.dlg != nil && st.refresher {
+		requested = st.interval
+	}
+	if minSE <= requested {
+		return false
+	}
+
+	st.expires = minSE
+	if minSE > st.minSE {
+		st.minSE = minSE
+	}
+	if st.interval < minSE {
+		st.interval = minSE
+	}
+
+	return true
+}
+
+func (st *sessionTimer) CheckRequest(req sip.Request) sip.Response {
+	se, ok := GetSessionExpires(req)
+	if !ok || se.Delta >= st.config.MinSE {
+		return nil
+	}
+
+	res := sip.NewResponseFromRequest("", req, 422, "Session Interval Too Small", "")
+	res.AppendHeader(minSEHeader(st.config.MinSE))
+
+	return res
+}
+
+func (st *sessionTimer) ResponseHeaders(req sip.Request) []sip.Header {
+	supported := hasOption(req, "Supported", timerOption)
+
+	se, ok := GetSessionExpires(req)
+	minSE, _ := GetMinSE(req)
+	if !ok {
+		// RFC 4028 9. UAS may enable session timer that was not requested by UAC
+		se = SessionExpires{Delta: st.config.Expires}
+		if minSE > se.Delta {
+			se.Delta = minSE
+		}
+	} else if st.config.Expires < se.Delta {
+		// interval can be reduced but not below Min-SE of the request
+		se.Delta = st.config.Expires
+		if minSE > se.Delta {
+			se.Delta = minSE
+		}
+	}
+
+	switch {
+	case !supported:
+		// UAC does not support session timer, so it can not refresh
+		se.Refresher = RefresherUAS
+	case se.Refresher == "":
+		se.Refresher = st.config.Refresher
+	}
+
+	hdrs := []sip.Header{se.Header()}
+	if se.Refresher == RefresherUAC {
+		hdrs = append(hdrs, &sip.RequireHeader{Options: []string{timerOption}})
+	}
+
+	return hdrs
+}
+
+func (st *sessionTimer) Start(dlg Dialog, res sip.Response) {
+	se, ok := GetSessionExpires(res)
+	if !ok || !res.IsSuccess() {
+		st.Stop()
+
+		return
+	}
+
+	// roles in Session-Expires are related to the refresh transaction, not the dialog
+	from, _ := res.From()
+	isUAC := from != nil && getTag(from.Params) == dlg.LocalTag()
+	refresher := se.Refresher == RefresherUAS && !isUAC || se.Refresher != RefresherUAS && isUAC
+
+	st.mu.Lock()
+	first := st.dlg == nil
+	st.dlg = dlg
+	st.interval = se.Delta
+	st.refresher = refresher
+	st.mu.Unlock()
+
+	if first {
+		go func() {
+			<-dlg.Done()
+			st.Stop()
+		}()
+	}
+
+	if refresher {
+		st.schedule(se.Delta/2, st.refresh)
+	} else {
+		// RFC 4028 10. BYE is sent before expiration to give the refresher time
+		before := se.Delta / 3
+		if before > 32*time.Second {
+			before = 32 * time.Second
+		}
+		st.schedule(se.Delta-before, st.expire)
+	}
+
+	st.Log().Debugf("session timer started with interval %s, refresher %t", se.Delta, refresher)
+}
+
+func (st *sessionTimer) Stop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+}
+
+func (st *sessionTimer) schedule(delay time.Duration, fn func()) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	st.timer = timing.AfterFunc(delay, fn)
+}
+
+func (st *sessionTimer) refresh() {
+	st.mu.RLock()
+	dlg := st.dlg
+	interval := st.interval
+	st.mu.RUnlock()
+
+	if dlg == nil || dlg.State() == Terminated {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), interval/2)
+	defer cancel()
+
+	res, err := st.sendRefresh(ctx, dlg)
+	if err != nil {
+		if reqErr, ok := err.(*sip.RequestError); ok && reqErr.Response != nil && st.HandleTooSmall(reqErr.Response) {
+			res, err = st.sendRefresh(ctx, dlg)
+		}
+	}
+	if err != nil {
+		st.Log().Warnf("session refresh failed: %s", err)
+
+		if reqErr, ok := err.(*sip.RequestError); ok && (reqErr.Code == 481 || reqErr.Code == 408) {
+			st.teardown(dlg)
+
+			return
+		}
+		// RFC 4028 10. the session expires if refreshes keep failing
+		st.schedule(interval/2, st.expire)
+
+		return
+	}
+
+	st.Start(dlg, res)
+	if se, ok := GetSessionExpires(res); ok && st.config.OnRefresh != nil {
+		st.config.OnRefresh(dlg, se)
+	}
+}
+
+func (st *sessionTimer) sendRefresh(ctx context.Context, dlg Dialog) (sip.Response, error) {
+	var contentType, body string
+	if st.config.Method == sip.INVITE && st.config.Body != nil {
+		contentType, body = st.config.Body()
+	}
+
+	hdrs := st.RequestHeaders()
+	if contentType != "" {
+		ct := sip.ContentType(contentType)
+		hdrs = append(hdrs, &ct)
+	}
+
+	req, err := dlg.NewRequest(st.config.Method, body, hdrs...)
+	if err != nil {
+		return nil, err
+	}
+
+	options := make([]gosip.RequestWithContextOption, 0)
+	if st.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(st.config.Authorizer))
+	}
+
+	res, err := st.requester.RequestWithContext(ctx, req, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.IsInvite() {
+		ack := sip.NewAckRequest("", req, res, "", nil)
+		if err := st.requester.Send(ack); err != nil {
+			st.Log().Warnf("send ACK failed: %s", err)
+		}
+	}
+
+	if err := dlg.ReceiveResponse(res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (st *sessionTimer) expire() {
+	st.mu.RLock()
+	dlg := st.dlg
+	st.mu.RUnlock()
+
+	if dlg == nil || dlg.State() == Terminated {
+		return
+	}
+
+	st.Log().Warnf("session of %s expired", dlg)
+
+	st.teardown(dlg)
+}
+
+func (st *sessionTimer) teardown(dlg Dialog) {
+	st.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 32*time.Second)
+	defer cancel()
+
+	if req, err := dlg.NewRequest(sip.BYE, ""); err == nil {
+		if _, err := st.requester.RequestWithContext(ctx, req); err != nil {
+			st.Log().Debugf("send BYE failed: %s", err)
+		}
+	}
+
+	dlg.Terminate()
+
+	if st.config.OnExpire != nil {
+		st.config.OnExpire(dlg)
+	}
+}
+
+func hasOption(msg sip.Message, name, option string) bool {
+	for _, hdr := range msg.GetHeaders(name) {
+		for _, opt := range strings.Split(hdr.Value(), ",") {
+			if strings.EqualFold(strings.TrimSpace(opt), option) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
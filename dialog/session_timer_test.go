@@ -0,0 +1,163 @@
+package dialog_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+var _ = Describe("SessionTimer", func() {
+	var (
+		requester *testutils.MockRequester
+		invite    sip.Request
+	)
+
+	newResponse := func(sessionExpires string) sip.Response {
+		return testutils.Response([]string{
+			"SIP/2.0 200 OK",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: session-timer-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:bob@10.0.0.2:5060>",
+			"Session-Expires: " + sessionExpires,
+			"Require: timer",
+			"",
+			"",
+		})
+	}
+
+	BeforeEach(func() {
+		timing.MockMode = true
+		// answers echo Session-Expires header of requests
+		requester = testutils.NewMockRequester(func(req sip.Request) (sip.Response, error) {
+			res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+			if se, ok := dialog.GetSessionExpires(req); ok {
+				res.AppendHeader(se.Header())
+			}
+			return res, nil
+		})
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: session-timer-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"Supported: timer",
+			"Session-Expires: 1800",
+			"Min-SE: 90",
+			"",
+			"",
+		})
+	})
+
+	AfterEach(func() {
+		timing.MockMode = false
+	})
+
+	It("should parse Session-Expires", func() {
+		se, err := dialog.ParseSessionExpires("1800; refresher=UAS")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(se).To(Equal(dialog.SessionExpires{Delta: 30 * time.Minute, Refresher: dialog.RefresherUAS}))
+		Expect(se.String()).To(Equal("1800;refresher=uas"))
+
+		_, err = dialog.ParseSessionExpires("1800;refresher=proxy")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should negotiate session interval on UAS side", func() {
+		st := dialog.NewSessionTimer(requester, dialog.SessionTimerConfig{Expires: 600 * time.Second}, testutils.NewLogrusLogger())
+		Expect(st.CheckRequest(invite)).To(BeNil())
+
+		hdrs := st.ResponseHeaders(invite)
+		Expect(hdrs).To(HaveLen(2))
+		Expect(hdrs[0].String()).To(Equal("Session-Expires: 600;refresher=uac"))
+		Expect(hdrs[1].String()).To(Equal("Require: timer"))
+
+		invite.RemoveHeader("Supported")
+		hdrs = st.ResponseHeaders(invite)
+		Expect(hdrs).To(HaveLen(1))
+		Expect(hdrs[0].String()).To(Equal("Session-Expires: 600;refresher=uas"))
+
+		invite.ReplaceHeaders("Session-Expires", []sip.Header{dialog.SessionExpires{Delta: time.Minute}.Header()})
+		res := st.CheckRequest(invite)
+		Expect(res).ToNot(BeNil())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(422)))
+		minSE, ok := dialog.GetMinSE(res)
+		Expect(ok).To(BeTrue())
+		Expect(minSE).To(Equal(dialog.MinSessionExpires))
+	})
+
+	It("should increase session interval on 422", func() {
+		st := dialog.NewSessionTimer(requester, dialog.SessionTimerConfig{Expires: 120 * time.Second}, testutils.NewLogrusLogger())
+		res := sip.NewResponseFromRequest("", invite, 422, "Session Interval Too Small", "")
+		res.AppendHeader(&sip.GenericHeader{HeaderName: "Min-SE", Contents: "300"})
+
+		Expect(st.HandleTooSmall(res)).To(BeTrue())
+		Expect(st.HandleTooSmall(res)).To(BeFalse())
+		hdrs := st.RequestHeaders()
+		Expect(hdrs[1].String()).To(Equal("Session-Expires: 300"))
+		Expect(hdrs[2].String()).To(Equal("Min-SE: 300"))
+	})
+
+	It("should refresh session as refresher", func() {
+		res := newResponse("120;refresher=uac")
+		dlg, err := dialog.NewUACDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+
+		refreshes := make(chan dialog.SessionExpires, 1)
+		st := dialog.NewSessionTimer(requester, dialog.SessionTimerConfig{
+			OnRefresh: func(dlg dialog.Dialog, se dialog.SessionExpires) {
+				refreshes <- se
+			},
+		}, testutils.NewLogrusLogger())
+		st.Start(dlg, res)
+		Expect(st.IsRefresher()).To(BeTrue())
+		Expect(st.Interval()).To(Equal(2 * time.Minute))
+
+		timing.Elapse(time.Minute)
+		var req sip.Request
+		Eventually(requester.Received()).Should(Receive(&req))
+		Expect(req.Method()).To(Equal(sip.UPDATE))
+		se, ok := dialog.GetSessionExpires(req)
+		Expect(ok).To(BeTrue())
+		Expect(se).To(Equal(dialog.SessionExpires{Delta: 2 * time.Minute, Refresher: dialog.RefresherUAC}))
+		Eventually(refreshes).Should(Receive())
+		Expect(dlg.State()).To(Equal(dialog.Confirmed))
+		st.Stop()
+	})
+
+	It("should tear down expired session", func() {
+		res := newResponse("120;refresher=uas")
+		dlg, err := dialog.NewUACDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+
+		expired := make(chan dialog.Dialog, 1)
+		st := dialog.NewSessionTimer(requester, dialog.SessionTimerConfig{
+			OnExpire: func(dlg dialog.Dialog) {
+				expired <- dlg
+			},
+		}, testutils.NewLogrusLogger())
+		st.Start(dlg, res)
+		Expect(st.IsRefresher()).To(BeFalse())
+
+		timing.Elapse(87 * time.Second)
+		Consistently(requester.Received(), "50ms").ShouldNot(Receive())
+
+		timing.Elapse(time.Second)
+		var req sip.Request
+		Eventually(requester.Received()).Should(Receive(&req))
+		Expect(req.Method()).To(Equal(sip.BYE))
+		Eventually(expired).Should(Receive(Equal(dlg)))
+		Expect(dlg.State()).To(Equal(dialog.Terminated))
+	})
+})
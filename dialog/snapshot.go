@@ -0,0 +1,127 @@
+package dialog
+
+import (
+	"fmt"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// Snapshot is a serializable state of the dialog.
+// External dialog stores use it to share dialogs between nodes of the cluster.
+// Usages and attached values are local to the node and are not included.
+type Snapshot struct {
+	CallID       string   `json:"call_id"`
+	LocalTag     string   `json:"local_tag"`
+	RemoteTag    string   `json:"remote_tag"`
+	LocalUri     string   `json:"local_uri"`
+	RemoteUri    string   `json:"remote_uri"`
+	LocalTarget  string   `json:"local_target,omitempty"`
+	RemoteTarget string   `json:"remote_target,omitempty"`
+	RouteSet     []string `json:"route_set,omitempty"`
+	LocalSeq     uint32   `json:"local_seq"`
+	RemoteSeq    uint32   `json:"remote_seq"`
+	Secure       bool     `json:"secure,omitempty"`
+	UAC          bool     `json:"uac,omitempty"`
+	State        State    `json:"state"`
+}
+
+// SnapshotOf captures the current state of the dialog.
+func SnapshotOf(dlg Dialog) Snapshot {
+	snapshot := Snapshot{
+		CallID:    string(dlg.CallID()),
+		LocalTag:  dlg.LocalTag(),
+		RemoteTag: dlg.RemoteTag(),
+		LocalUri:  uriString(dlg.LocalUri()),
+		RemoteUri: uriString(dlg.RemoteUri()),
+		LocalSeq:  dlg.LocalSeq(),
+		RemoteSeq: dlg.RemoteSeq(),
+		Secure:    dlg.Secure(),
+		UAC:       dlg.IsUAC(),
+		State:     dlg.State(),
+	}
+	snapshot.LocalTarget = uriString(dlg.LocalTarget())
+	snapshot.RemoteTarget = uriString(dlg.RemoteTarget())
+	for _, uri := range dlg.RouteSet() {
+		snapshot.RouteSet = append(snapshot.RouteSet, uri.String())
+	}
+
+	return snapshot
+}
+
+// RestoreDialog creates dialog from the snapshot, e.g. on the node that takes over the dialog of the failed node.
+func RestoreDialog(snapshot Snapshot, logger log.Logger, options ...DialogOption) (Dialog, error) {
+	if snapshot.CallID == "" || snapshot.LocalTag == "" || snapshot.RemoteTag == "" {
+		return nil, fmt.Errorf("snapshot of dialog has no Call-ID or tags")
+	}
+	if snapshot.State == Terminated {
+		return nil, fmt.Errorf("snapshot of dialog is terminated")
+	}
+
+	dlg := &dialog{
+		callID:    sip.CallID(snapshot.CallID),
+		localTag:  snapshot.LocalTag,
+		remoteTag: snapshot.RemoteTag,
+		localSeq:  snapshot.LocalSeq,
+		remoteSeq: snapshot.RemoteSeq,
+		secure:    snapshot.Secure,
+		uac:       snapshot.UAC,
+		state:     snapshot.State,
+		done:      make(chan struct{}),
+		bus:       dialogOptions(options).EventBus,
+	}
+	// CSeq of the dialog creating INVITE is not a part of Dialog, the restored dialog assumes the current one
+	if dlg.uac {
+		dlg.inviteSeq = snapshot.LocalSeq
+	} else {
+		dlg.inviteSeq = snapshot.RemoteSeq
+	}
+
+	var err error
+	if dlg.localUri, err = parseUri(snapshot.LocalUri); err != nil {
+		return nil, err
+	}
+	if dlg.remoteUri, err = parseUri(snapshot.RemoteUri); err != nil {
+		return nil, err
+	}
+	if dlg.localTarget, err = parseUri(snapshot.LocalTarget); err != nil {
+		return nil, err
+	}
+	if dlg.remoteTarget, err = parseUri(snapshot.RemoteTarget); err != nil {
+		return nil, err
+	}
+	for _, value := range snapshot.RouteSet {
+		uri, err := parseUri(value)
+		if err != nil {
+			return nil, err
+		}
+		dlg.routeSet = append(dlg.routeSet, uri)
+	}
+
+	dlg.initLog(logger)
+	dlg.Log().Debugf("dialog restored in %s state", dlg.state)
+
+	return dlg, nil
+}
+
+func uriString(uri sip.Uri) string {
+	if uri == nil {
+		return ""
+	}
+
+	return uri.String()
+}
+
+func parseUri(value string) (sip.Uri, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	uri, err := parser.ParseUri(value)
+	if err != nil {
+		return nil, fmt.Errorf("parse dialog URI '%s': %w", value, err)
+	}
+
+	return uri, nil
+}
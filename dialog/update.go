@@ -0,0 +1,250 @@
+package dialog
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// maxGlareRetries limits retries of the requests rejected with 491.
+const maxGlareRetries = 3
+
+// UpdateConfig describes UPDATE options.
+type UpdateConfig struct {
+	// OfferAnswer is shared with other usages of the session (INVITE, PRACK), default is a new tracker.
+	OfferAnswer OfferAnswer
+	// SessionTimer is refreshed by the UPDATE transactions.
+	SessionTimer SessionTimer
+	Authorizer   sip.Authorizer
+	// Headers are appended to each UPDATE request.
+	Headers []sip.Header
+	// OnOffer is called on the incoming offer and returns the answer,
+	// error rejects the offer with 488 Not Acceptable Here.
+	OnOffer func(dlg Dialog, contentType, offer string) (answerType, answer string, err error)
+}
+
+// Updater sends and receives UPDATE requests in the early or confirmed dialog - RFC 3311.
+type Updater interface {
+	// Update sends UPDATE with the optional offer and waits for the response - RFC 3311 5.1.
+	// The answer is the body of the returned response.
+	Update(ctx context.Context, contentType, offer string) (sip.Response, error)
+	// HandleUpdate processes incoming UPDATE and responds through the transaction - RFC 3311 5.2.
+	HandleUpdate(req sip.Request, tx sip.ServerTransaction) error
+	OfferAnswer() OfferAnswer
+}
+
+type updater struct {
+	dlg       Dialog
+	requester gosip.RequestSender
+	config    UpdateConfig
+
+	log log.Logger
+}
+
+// NewUpdater creates UPDATE handler of the dialog.
+func NewUpdater(dlg Dialog, requester gosip.RequestSender, config UpdateConfig, logger log.Logger) Updater {
+	if config.OfferAnswer == nil {
+		config.OfferAnswer = NewOfferAnswer(OfferAnswerConfig{})
+	}
+
+	u := &updater{
+		dlg:       dlg,
+		requester: requester,
+		config:    config,
+	}
+	u.log = logger.
+		WithPrefix("dialog.Updater").
+		WithFields(log.Fields{
+			"dialog_id":   dlg.ID(),
+			"updater_ptr": fmt.Sprintf("%p", u),
+		})
+
+	return u
+}
+
+func (u *updater) Log() log.Logger {
+	return u.log
+}
+
+func (u *updater) OfferAnswer() OfferAnswer {
+	return u.config.OfferAnswer
+}
+
+func (u *updater) Update(ctx context.Context, contentType, offer string) (sip.Response, error) {
+	if u.dlg.State() == Terminated {
+		return nil, fmt.Errorf("%s is terminated", u.dlg)
+	}
+
+	var res sip.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		res, err = u.update(ctx, contentType, offer)
+		reqErr, ok := err.(*sip.RequestError)
+		if !ok || reqErr.Response == nil {
+			return res, err
+		}
+
+		switch {
+		case reqErr.Code == 422 && u.config.SessionTimer != nil && attempt == 0:
+			// RFC 4028 7.4. retry with the increased session interval
+			if !u.config.SessionTimer.HandleTooSmall(reqErr.Response) {
+				return res, err
+			}
+		case reqErr.Code == 491 && attempt < maxGlareRetries:
+			// RFC 3261 14.1. retry after glare
+			select {
+			case <-timing.After(GlareRetryDelay(u.dlg)):
+			case <-ctx.Done():
+				return res, err
+			}
+		default:
+			return res, err
+		}
+	}
+}
+
+func (u *updater) update(ctx context.Context, contentType, offer string) (sip.Response, error) {
+	hdrs := make([]sip.Header, 0)
+	if offer != "" && contentType != "" {
+		ct := sip.ContentType(contentType)
+		hdrs = append(hdrs, &ct)
+	}
+	if u.config.SessionTimer != nil {
+		hdrs = append(hdrs, u.config.SessionTimer.RequestHeaders()...)
+	}
+	for _, hdr := range u.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	req, err := u.dlg.NewRequest(sip.UPDATE, offer, hdrs...)
+	if err != nil {
+		return nil, err
+	}
+
+	oa := u.config.OfferAnswer
+	// RFC 3311 5.1. UPDATE with offer can not be sent while another offer is outstanding
+	if err := oa.SendRequest(req); err != nil {
+		return nil, err
+	}
+
+	options := make([]gosip.RequestWithContextOption, 0)
+	if u.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(u.config.Authorizer))
+	}
+
+	res, err := u.requester.RequestWithContext(ctx, req, options...)
+	if err != nil {
+		if reqErr, ok := err.(*sip.RequestError); ok && reqErr.Response != nil {
+			_ = oa.ReceiveResponse(reqErr.Response)
+		} else if offer != "" {
+			oa.Rollback()
+		}
+
+		return nil, err
+	}
+
+	if err := u.dlg.ReceiveResponse(res); err != nil {
+		u.Log().WithFields(res.Fields()).Warnf("update dialog failed: %s", err)
+	}
+
+	if offer != "" && res.Body() == "" {
+		oa.Rollback()
+
+		return res, fmt.Errorf("response '%s' has no answer", res.Short())
+	}
+	if err := oa.ReceiveResponse(res); err != nil {
+		return res, err
+	}
+
+	if u.config.SessionTimer != nil {
+		u.config.SessionTimer.Start(u.dlg, res)
+	}
+
+	return res, nil
+}
+
+func (u *updater) HandleUpdate(req sip.Request, tx sip.ServerTransaction) error {
+	if req.Method() != sip.UPDATE {
+		return fmt.Errorf("request '%s' is not UPDATE", req.Short())
+	}
+	if u.dlg.State() == Terminated || !u.dlg.Match(req) {
+		return tx.Respond(sip.NewResponseFromRequest("", req, 481, "Call/Transaction Does Not Exist", ""))
+	}
+	if err := u.dlg.ReceiveRequest(req); err != nil {
+		_ = tx.Respond(sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""))
+
+		return err
+	}
+
+	st := u.config.SessionTimer
+	if st != nil {
+		if res := st.CheckRequest(req); res != nil {
+			return tx.Respond(res)
+		}
+	}
+
+	oa := u.config.OfferAnswer
+	if res := oa.ReceiveRequest(req); res != nil {
+		return tx.Respond(res)
+	}
+
+	var answerType, answer string
+	if offer := req.Body(); offer != "" {
+		var contentType string
+		if hdr, ok := req.ContentType(); ok {
+			contentType = hdr.Value()
+		}
+
+		var err error
+		if u.config.OnOffer == nil {
+			err = fmt.Errorf("offer handler is not set")
+		} else {
+			answerType, answer, err = u.config.OnOffer(u.dlg, contentType, offer)
+		}
+		if err == nil && answer == "" {
+			err = fmt.Errorf("empty answer")
+		}
+		if err != nil {
+			u.Log().WithFields(req.Fields()).Warnf("offer rejected: %s", err)
+
+			res := sip.NewResponseFromRequest("", req, 488, "Not Acceptable Here", "")
+			_ = oa.SendResponse(res)
+
+			return tx.Respond(res)
+		}
+	}
+
+	res := sip.NewResponseFromRequest("", req, 200, "OK", answer)
+	if answerType != "" {
+		ct := sip.ContentType(answerType)
+		res.AppendHeader(&ct)
+	}
+	if target := u.dlg.LocalTarget(); target != nil {
+		res.AppendHeader(&sip.ContactHeader{Address: target.Clone()})
+	}
+	if st != nil {
+		for _, hdr := range st.ResponseHeaders(req) {
+			res.AppendHeader(hdr)
+		}
+	}
+
+	if err := oa.SendResponse(res); err != nil {
+		oa.Rollback()
+		_ = tx.Respond(sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""))
+
+		return err
+	}
+	if err := tx.Respond(res); err != nil {
+		return err
+	}
+
+	if st != nil {
+		st.Start(u.dlg, res)
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package dialog_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// handle adapts handlers of dialog package to gosip.RequestHandler.
+func handle(handler func(req sip.Request, tx sip.ServerTransaction) error) gosip.RequestHandler {
+	return func(req sip.Request, tx sip.ServerTransaction) {
+		_ = handler(req, tx)
+	}
+}
+
+var _ = Describe("Updater", func() {
+	var (
+		aliceDlg, bobDlg dialog.Dialog
+		toAlice, toBob   *testutils.Loopback
+	)
+
+	newDialogs := func(status string) {
+		invite := testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: update-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"",
+			"",
+		})
+		res := testutils.Response([]string{
+			"SIP/2.0 " + status,
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: update-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:bob@10.0.0.2:5060>",
+			"",
+			"",
+		})
+
+		var err error
+		aliceDlg, err = dialog.NewUACDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		bobDlg, err = dialog.NewUASDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	answerer := func(dlg dialog.Dialog, contentType, offer string) (string, string, error) {
+		return contentType, fmt.Sprintf("answer to %s", offer), nil
+	}
+
+	BeforeEach(func() {
+		timing.MockMode = true
+		toAlice = testutils.NewLoopback()
+		toBob = testutils.NewLoopback()
+	})
+
+	AfterEach(func() {
+		timing.MockMode = false
+	})
+
+	It("should exchange offer and answer in early dialog", func() {
+		newDialogs("183 Session Progress")
+		Expect(aliceDlg.State()).To(Equal(dialog.Early))
+
+		alice := dialog.NewUpdater(aliceDlg, toBob, dialog.UpdateConfig{}, testutils.NewLogrusLogger())
+		bob := dialog.NewUpdater(bobDlg, toAlice, dialog.UpdateConfig{OnOffer: answerer}, testutils.NewLogrusLogger())
+		_ = toBob.OnRequest(sip.UPDATE, handle(bob.HandleUpdate))
+
+		res, err := alice.Update(context.Background(), "application/sdp", "offer 1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.Body()).To(Equal("answer to offer 1"))
+		Expect(alice.OfferAnswer().State()).To(Equal(dialog.Stable))
+		Expect(alice.OfferAnswer().LocalBody()).To(Equal("offer 1"))
+		Expect(alice.OfferAnswer().RemoteBody()).To(Equal("answer to offer 1"))
+		Expect(bob.OfferAnswer().LocalBody()).To(Equal("answer to offer 1"))
+
+		// UPDATE without offer
+		_, err = alice.Update(context.Background(), "", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(alice.OfferAnswer().RemoteBody()).To(Equal("answer to offer 1"))
+	})
+
+	It("should retry UPDATE after glare", func() {
+		newDialogs("200 OK")
+
+		alice := dialog.NewUpdater(aliceDlg, toBob, dialog.UpdateConfig{}, testutils.NewLogrusLogger())
+		bob := dialog.NewUpdater(bobDlg, toAlice, dialog.UpdateConfig{OnOffer: answerer}, testutils.NewLogrusLogger())
+		codes := make(chan sip.StatusCode, 10)
+		_ = toBob.OnRequest(sip.UPDATE, func(req sip.Request, tx sip.ServerTransaction) {
+			_ = bob.HandleUpdate(req, tx)
+			codes <- tx.(*testutils.MockServerTx).Response().StatusCode()
+		})
+
+		bobOffer, err := bobDlg.NewRequest(sip.UPDATE, "bob offer")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bob.OfferAnswer().SendRequest(bobOffer)).To(Succeed())
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := alice.Update(context.Background(), "application/sdp", "alice offer")
+			done <- err
+		}()
+		Eventually(codes).Should(Receive(Equal(sip.StatusCode(491))))
+		Expect(alice.OfferAnswer().State()).To(Equal(dialog.Stable))
+
+		// bob's offer is rejected, so alice's retry succeeds
+		bob.OfferAnswer().Rollback()
+		Eventually(func() bool {
+			timing.Elapse(time.Second)
+			select {
+			case err := <-done:
+				Expect(err).ToNot(HaveOccurred())
+				return true
+			default:
+				return false
+			}
+		}).Should(BeTrue())
+		Expect(alice.OfferAnswer().RemoteBody()).To(Equal("answer to alice offer"))
+	})
+
+	It("should refresh session timer", func() {
+		newDialogs("200 OK")
+
+		aliceTimer := dialog.NewSessionTimer(toBob, dialog.SessionTimerConfig{Expires: 120 * time.Second}, testutils.NewLogrusLogger())
+		bobTimer := dialog.NewSessionTimer(toAlice, dialog.SessionTimerConfig{MinSE: 300 * time.Second}, testutils.NewLogrusLogger())
+		alice := dialog.NewUpdater(aliceDlg, toBob, dialog.UpdateConfig{SessionTimer: aliceTimer}, testutils.NewLogrusLogger())
+		bob := dialog.NewUpdater(bobDlg, toAlice, dialog.UpdateConfig{SessionTimer: bobTimer}, testutils.NewLogrusLogger())
+		_ = toBob.OnRequest(sip.UPDATE, handle(bob.HandleUpdate))
+
+		res, err := alice.Update(context.Background(), "", "")
+		Expect(err).ToNot(HaveOccurred())
+		se, ok := dialog.GetSessionExpires(res)
+		Expect(ok).To(BeTrue())
+		Expect(se.Refresher).To(Equal(dialog.RefresherUAC))
+		Expect(aliceTimer.Interval()).To(Equal(300 * time.Second))
+		Expect(aliceTimer.IsRefresher()).To(BeTrue())
+		Expect(bobTimer.IsRefresher()).To(BeFalse())
+
+		aliceTimer.Stop()
+		bobTimer.Stop()
+	})
+})
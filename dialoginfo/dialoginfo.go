@@ -0,0 +1,303 @@
+// dialoginfo package implements "dialog" event package - RFC 4235.
+// It is commonly used for Busy Lamp Field and shared line monitoring.
+package dialoginfo
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sync"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	EventPackage = "dialog"
+	ContentType  = "application/dialog-info+xml"
+
+	dialogInfoNamespace = "urn:ietf:params:xml:ns:dialog-info"
+)
+
+// Document states.
+const (
+	Full    = "full"
+	Partial = "partial"
+)
+
+// Dialog states - RFC 4235 3.7.1.
+const (
+	Trying     = "trying"
+	Proceeding = "proceeding"
+	Early      = "early"
+	Confirmed  = "confirmed"
+	Terminated = "terminated"
+)
+
+// Dialog directions.
+const (
+	Initiator = "initiator"
+	Recipient = "recipient"
+)
+
+// DialogInfo is a dialog-info+xml document - RFC 4235 4.
+type DialogInfo struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:dialog-info dialog-info"`
+	Version uint32   `xml:"version,attr"`
+	State   string   `xml:"state,attr"`
+	Entity  string   `xml:"entity,attr"`
+	Dialogs []Dialog `xml:"dialog"`
+}
+
+type Dialog struct {
+	ID        string       `xml:"id,attr"`
+	CallID    string       `xml:"call-id,attr,omitempty"`
+	LocalTag  string       `xml:"local-tag,attr,omitempty"`
+	RemoteTag string       `xml:"remote-tag,attr,omitempty"`
+	Direction string       `xml:"direction,attr,omitempty"`
+	State     DialogState  `xml:"state"`
+	Duration  uint32       `xml:"duration,omitempty"`
+	Local     *Participant `xml:"local,omitempty"`
+	Remote    *Participant `xml:"remote,omitempty"`
+}
+
+type DialogState struct {
+	Event string `xml:"event,attr,omitempty"`
+	Code  int    `xml:"code,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type Participant struct {
+	Identity *Identity `xml:"identity,omitempty"`
+	Target   *Target   `xml:"target,omitempty"`
+}
+
+type Identity struct {
+	Display string `xml:"display,attr,omitempty"`
+	URI     string `xml:",chardata"`
+}
+
+type Target struct {
+	URI string `xml:"uri,attr"`
+}
+
+// Encode serializes document to XML.
+func (info *DialogInfo) Encode() (string, error) {
+	data, err := xml.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encode dialog-info: %w", err)
+	}
+
+	return xml.Header + string(data), nil
+}
+
+// Busy checks that the entity has at least one not terminated dialog.
+func (info *DialogInfo) Busy() bool {
+	for _, dlg := range info.Dialogs {
+		if dlg.State.Value != Terminated {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Decode parses dialog-info+xml document.
+func Decode(body string) (*DialogInfo, error) {
+	info := new(DialogInfo)
+	if err := xml.Unmarshal([]byte(body), info); err != nil {
+		return nil, fmt.Errorf("decode dialog-info: %w", err)
+	}
+	if info.XMLName.Space != dialogInfoNamespace {
+		return nil, fmt.Errorf("decode dialog-info: unexpected namespace '%s'", info.XMLName.Space)
+	}
+	if info.State != Full && info.State != Partial {
+		return nil, fmt.Errorf("decode dialog-info: invalid state '%s'", info.State)
+	}
+
+	return info, nil
+}
+
+// FromDialog builds dialog element from the SIP dialog.
+// State should be one of RFC 4235 dialog states, dialog package does not track trying and proceeding states.
+func FromDialog(dlg dialog.Dialog, state string) Dialog {
+	direction := Recipient
+	if dlg.IsUAC() {
+		direction = Initiator
+	}
+
+	elem := Dialog{
+		ID:        dlg.ID(),
+		CallID:    string(dlg.CallID()),
+		LocalTag:  dlg.LocalTag(),
+		RemoteTag: dlg.RemoteTag(),
+		Direction: direction,
+		State:     DialogState{Value: state},
+		Local:     &Participant{Identity: &Identity{URI: dlg.LocalUri().String()}},
+		Remote:    &Participant{Identity: &Identity{URI: dlg.RemoteUri().String()}},
+	}
+	if target := dlg.LocalTarget(); target != nil {
+		elem.Local.Target = &Target{URI: target.String()}
+	}
+	if target := dlg.RemoteTarget(); target != nil {
+		elem.Remote.Target = &Target{URI: target.String()}
+	}
+
+	return elem
+}
+
+// StateOf maps dialog package state to RFC 4235 dialog state.
+func StateOf(dlg dialog.Dialog) string {
+	switch dlg.State() {
+	case dialog.Early:
+		return Early
+	case dialog.Confirmed:
+		return Confirmed
+	default:
+		return Terminated
+	}
+}
+
+// View is a subscriber side state of the monitored entity, it applies full and partial documents - RFC 4235 4.1.
+type View struct {
+	mu      sync.RWMutex
+	version uint32
+	synced  bool
+	entity  string
+	dialogs map[string]Dialog
+}
+
+func NewView() *View {
+	return &View{
+		dialogs: make(map[string]Dialog),
+	}
+}
+
+// Apply updates the view with received document.
+// Returns false if the document is outdated or partial document is received without full state,
+// in this case the subscriber should refresh the subscription to get full state.
+func (view *View) Apply(info *DialogInfo) bool {
+	view.mu.Lock()
+	defer view.mu.Unlock()
+
+	switch info.State {
+	case Full:
+		if view.synced && info.Version <= view.version {
+			return false
+		}
+		view.dialogs = make(map[string]Dialog)
+	case Partial:
+		if !view.synced || info.Version != view.version+1 {
+			return false
+		}
+	default:
+		return false
+	}
+
+	view.synced = true
+	view.version = info.Version
+	view.entity = info.Entity
+	for _, dlg := range info.Dialogs {
+		if dlg.State.Value == Terminated {
+			delete(view.dialogs, dlg.ID)
+		} else {
+			view.dialogs[dlg.ID] = dlg
+		}
+	}
+
+	return true
+}
+
+// Dialogs returns active dialogs of the entity.
+func (view *View) Dialogs() []Dialog {
+	view.mu.RLock()
+	defer view.mu.RUnlock()
+
+	dialogs := make([]Dialog, 0, len(view.dialogs))
+	for _, dlg := range view.dialogs {
+		dialogs = append(dialogs, dlg)
+	}
+
+	return dialogs
+}
+
+// Busy checks that the entity has active dialogs.
+func (view *View) Busy() bool {
+	view.mu.RLock()
+	defer view.mu.RUnlock()
+
+	return len(view.dialogs) > 0
+}
+
+// Reset drops the state, e.g. on a new subscription.
+func (view *View) Reset() {
+	view.mu.Lock()
+	defer view.mu.Unlock()
+
+	view.synced = false
+	view.version = 0
+	view.dialogs = make(map[string]Dialog)
+}
+
+// SubscriptionConfig builds subscriber config for dialogs of the entity - RFC 4235 3.
+func SubscriptionConfig(subscriber, entity *sip.Address, contact *sip.ContactHeader) event.ClientConfig {
+	return event.ClientConfig{
+		From:    subscriber,
+		To:      entity,
+		Contact: contact,
+		Event:   event.Event{Package: EventPackage},
+		Accept:  []string{ContentType},
+	}
+}
+
+// ParseNotify decodes dialog-info of the NOTIFY request.
+// Returns nil document if NOTIFY has no body.
+func ParseNotify(req sip.Request) (*DialogInfo, error) {
+	if req.Body() == "" {
+		return nil, nil
+	}
+
+	return Decode(req.Body())
+}
+
+// Notifier sends full state documents with increasing versions to the subscription - RFC 4235 4.1.
+type Notifier struct {
+	sub     event.ServerSubscription
+	entity  string
+	mu      sync.Mutex
+	version uint32
+}
+
+func NewNotifier(sub event.ServerSubscription, entity string) *Notifier {
+	return &Notifier{
+		sub:    sub,
+		entity: entity,
+	}
+}
+
+// Document builds the next full state document, version is incremented on each call.
+func (n *Notifier) Document(dialogs []Dialog) *DialogInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	info := &DialogInfo{
+		Version: n.version,
+		State:   Full,
+		Entity:  n.entity,
+		Dialogs: dialogs,
+	}
+	n.version++
+
+	return info
+}
+
+// Notify sends full state of the entity dialogs.
+func (n *Notifier) Notify(ctx context.Context, dialogs []Dialog) error {
+	body, err := n.Document(dialogs).Encode()
+	if err != nil {
+		return err
+	}
+
+	return n.sub.Notify(ctx, ContentType, body)
+}
@@ -0,0 +1,96 @@
+package dialoginfo_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/dialoginfo"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("DialogInfo", func() {
+	It("should decode RFC 4235 example", func() {
+		info, err := dialoginfo.Decode(`<?xml version="1.0"?>
+<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="0" state="full" entity="sip:alice@example.com">
+  <dialog id="as7d900as8" call-id="a84b4c76e66710" local-tag="1928301774" direction="initiator">
+    <state>trying</state>
+    <local><identity display="Alice">sip:alice@example.com</identity><target uri="sip:alice@pc33.example.com"/></local>
+  </dialog>
+</dialog-info>`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Entity).To(Equal("sip:alice@example.com"))
+		Expect(info.Dialogs).To(HaveLen(1))
+		Expect(info.Dialogs[0].State.Value).To(Equal(dialoginfo.Trying))
+		Expect(info.Dialogs[0].Local.Identity.Display).To(Equal("Alice"))
+		Expect(info.Dialogs[0].Local.Target.URI).To(Equal("sip:alice@pc33.example.com"))
+		Expect(info.Busy()).To(BeTrue())
+	})
+
+	It("should build document from dialog", func() {
+		invite := testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: blf-call",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1>",
+			"",
+			"",
+		})
+		ringing := testutils.Response([]string{
+			"SIP/2.0 180 Ringing",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: blf-call",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:bob@10.0.0.2>",
+			"",
+			"",
+		})
+		dlg, err := dialog.NewUACDialog(invite, ringing, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+
+		elem := dialoginfo.FromDialog(dlg, dialoginfo.StateOf(dlg))
+		Expect(elem.State.Value).To(Equal(dialoginfo.Early))
+		Expect(elem.Direction).To(Equal(dialoginfo.Initiator))
+		Expect(elem.Remote.Target.URI).To(Equal("sip:bob@10.0.0.2"))
+
+		notifier := dialoginfo.NewNotifier(nil, "sip:alice@example.com")
+		Expect(notifier.Document(nil).Version).To(Equal(uint32(0)))
+		doc := notifier.Document([]dialoginfo.Dialog{elem})
+		Expect(doc.Version).To(Equal(uint32(1)))
+
+		body, err := doc.Encode()
+		Expect(err).ToNot(HaveOccurred())
+		decoded, err := dialoginfo.Decode(body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded.Dialogs[0].CallID).To(Equal("blf-call"))
+	})
+
+	It("should apply full and partial documents to view", func() {
+		view := dialoginfo.NewView()
+		partial := &dialoginfo.DialogInfo{Version: 1, State: dialoginfo.Partial}
+		Expect(view.Apply(partial)).To(BeFalse())
+
+		Expect(view.Apply(&dialoginfo.DialogInfo{
+			Version: 0,
+			State:   dialoginfo.Full,
+			Dialogs: []dialoginfo.Dialog{{ID: "d1", State: dialoginfo.DialogState{Value: dialoginfo.Confirmed}}},
+		})).To(BeTrue())
+		Expect(view.Busy()).To(BeTrue())
+
+		Expect(view.Apply(&dialoginfo.DialogInfo{
+			Version: 1,
+			State:   dialoginfo.Partial,
+			Dialogs: []dialoginfo.Dialog{{ID: "d1", State: dialoginfo.DialogState{Value: dialoginfo.Terminated}}},
+		})).To(BeTrue())
+		Expect(view.Busy()).To(BeFalse())
+
+		// outdated
+		Expect(view.Apply(&dialoginfo.DialogInfo{Version: 1, State: dialoginfo.Full})).To(BeFalse())
+	})
+})
@@ -0,0 +1,94 @@
+package dialplan
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalidNumber is returned for numbers that can't be normalized to E.164.
+var ErrInvalidNumber = errors.New("invalid number")
+
+// Country describes numbering of the country, dialed national and international numbers are normalized by it.
+type Country struct {
+	// Code is the country calling code, like "1" of NANP or "44" of the United Kingdom - ITU-T E.164.
+	Code string
+	// InternationalPrefix is dialed before international numbers, like "011" of NANP or "00".
+	InternationalPrefix string
+	// TrunkPrefix is dialed before national numbers, like "1" of NANP or "0".
+	TrunkPrefix string
+	// NationalLengths are lengths of national significant numbers, empty accepts numbers of any length.
+	NationalLengths []int
+}
+
+// Countries returns profiles of countries by ISO 3166 codes.
+func Countries() map[string]Country {
+	nanp := Country{Code: "1", InternationalPrefix: "011", TrunkPrefix: "1", NationalLengths: []int{10}}
+
+	return map[string]Country{
+		"US": nanp,
+		"CA": nanp,
+		"GB": {Code: "44", InternationalPrefix: "00", TrunkPrefix: "0", NationalLengths: []int{9, 10}},
+		"DE": {Code: "49", InternationalPrefix: "00", TrunkPrefix: "0"},
+		"FR": {Code: "33", InternationalPrefix: "00", TrunkPrefix: "0", NationalLengths: []int{9}},
+		"AU": {Code: "61", InternationalPrefix: "0011", TrunkPrefix: "0", NationalLengths: []int{9}},
+		"RU": {Code: "7", InternationalPrefix: "810", TrunkPrefix: "8", NationalLengths: []int{10}},
+	}
+}
+
+// Digits strips visual separators of the dialed number, like spaces, dashes, dots and parentheses - RFC 3966 5.1.1.
+func Digits(number string) string {
+	return strings.Map(func(c rune) rune {
+		switch c {
+		case ' ', '-', '.', '(', ')', '/':
+			return -1
+		}
+		return c
+	}, strings.TrimSpace(number))
+}
+
+// Normalize converts the number dialed in the country to E.164 with leading '+'.
+func (country Country) Normalize(number string) (string, error) {
+	digits := Digits(number)
+	switch {
+	case strings.HasPrefix(digits, "+"):
+		return e164(digits[1:])
+	case country.InternationalPrefix != "" && strings.HasPrefix(digits, country.InternationalPrefix):
+		return e164(strings.TrimPrefix(digits, country.InternationalPrefix))
+	case country.Code == "":
+		return "", ErrInvalidNumber
+	case country.TrunkPrefix != "" && strings.HasPrefix(digits, country.TrunkPrefix) &&
+		country.national(strings.TrimPrefix(digits, country.TrunkPrefix)):
+		return e164(country.Code + strings.TrimPrefix(digits, country.TrunkPrefix))
+	case country.national(digits):
+		return e164(country.Code + digits)
+	default:
+		return "", ErrInvalidNumber
+	}
+}
+
+func (country Country) national(digits string) bool {
+	if len(country.NationalLengths) == 0 {
+		return true
+	}
+	for _, l := range country.NationalLengths {
+		if len(digits) == l {
+			return true
+		}
+	}
+
+	return false
+}
+
+// e164 validates digits of the international number, E.164 numbers have at most 15 digits.
+func e164(digits string) (string, error) {
+	if len(digits) == 0 || len(digits) > 15 || digits[0] == '0' {
+		return "", ErrInvalidNumber
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return "", ErrInvalidNumber
+		}
+	}
+
+	return "+" + digits, nil
+}
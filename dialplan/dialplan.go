@@ -0,0 +1,191 @@
+// dialplan package implements dial plans of SIP applications: digit translations of dialed numbers,
+// E.164 normalization by country profiles and routing of numbers by the longest prefix.
+// Plans plug into routing hooks, like proxy.Config.TargetSet or b2bua.Config.Route.
+package dialplan
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/proxy"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// ErrNoRoute is returned for numbers without the route.
+var ErrNoRoute = errors.New("no route of number")
+
+// Translation rewrites dialed numbers with the prefix, like "9" of the outside line of PBXes
+// or "*67" of the calling line restriction.
+type Translation struct {
+	Prefix string
+	// Strip is the number of leading digits removed.
+	Strip int
+	// Prepend is inserted before the number after the strip.
+	Prepend string
+}
+
+// Route routes numbers with the prefix, like "+44" or the short code "112".
+type Route struct {
+	// Name of the route is logged with routed requests, like the name of the trunk.
+	Name   string
+	Prefix string
+	// Uri is the template of the target, {number} is replaced by the routed number
+	// and {digits} by the number without '+', like sip:{number}@gw.example.com;user=phone.
+	Uri string
+}
+
+// Config describes the dial plan.
+type Config struct {
+	// Country normalizes national and international numbers to E.164, numbers that can't be normalized,
+	// like short codes, are routed as they are translated.
+	Country Country
+	// Translations are applied before normalization, the translation of the longest prefix wins.
+	Translations []Translation
+	// Routes of numbers, the route of the longest prefix wins.
+	Routes []Route
+}
+
+// Plan routes dialed numbers.
+type Plan interface {
+	// Translate applies the translation of the number.
+	Translate(number string) string
+	// Normalize translates the number and normalizes it to E.164,
+	// numbers that can't be normalized are returned translated with ErrInvalidNumber.
+	Normalize(number string) (string, error)
+	// Route returns the target of the number and its route.
+	Route(number string) (sip.Uri, Route, error)
+	// RouteRequest returns the target of the user of the Request-URI, it fits b2bua.Config.Route.
+	RouteRequest(req sip.Request) (sip.Uri, error)
+	// TargetSet returns the proxy target set, requests without routes are rejected with 404 Not Found.
+	TargetSet() proxy.TargetSet
+}
+
+type plan struct {
+	country      Country
+	translations Trie
+	routes       Trie
+
+	log log.Logger
+}
+
+// NewPlan creates the dial plan.
+func NewPlan(config Config, logger log.Logger) (Plan, error) {
+	p := &plan{
+		country:      config.Country,
+		translations: NewTrie(),
+		routes:       NewTrie(),
+	}
+
+	for _, translation := range config.Translations {
+		if translation.Strip < 0 {
+			return nil, fmt.Errorf("translation of prefix %q has negative strip", translation.Prefix)
+		}
+		p.translations.Insert(translation.Prefix, translation)
+	}
+	for _, route := range config.Routes {
+		if matched, _, ok := p.routes.Match(route.Prefix); ok && matched == route.Prefix {
+			return nil, fmt.Errorf("duplicate route of prefix %q", route.Prefix)
+		}
+		if _, err := target(route, "+1"); err != nil {
+			return nil, fmt.Errorf("route %q of prefix %q: %w", route.Name, route.Prefix, err)
+		}
+		p.routes.Insert(route.Prefix, route)
+	}
+
+	p.log = logger.
+		WithPrefix("dialplan.Plan").
+		WithFields(log.Fields{
+			"plan_ptr": fmt.Sprintf("%p", p),
+		})
+
+	return p, nil
+}
+
+func (p *plan) Log() log.Logger {
+	return p.log
+}
+
+func (p *plan) Translate(number string) string {
+	number = Digits(number)
+	_, value, ok := p.translations.Match(number)
+	if !ok {
+		return number
+	}
+
+	translation := value.(Translation)
+	if translation.Strip > len(number) {
+		translation.Strip = len(number)
+	}
+
+	return translation.Prepend + number[translation.Strip:]
+}
+
+func (p *plan) Normalize(number string) (string, error) {
+	translated := p.Translate(number)
+	normalized, err := p.country.Normalize(translated)
+	if err != nil {
+		return translated, err
+	}
+
+	return normalized, nil
+}
+
+func (p *plan) Route(number string) (sip.Uri, Route, error) {
+	normalized, _ := p.Normalize(number)
+	_, value, ok := p.routes.Match(normalized)
+	if !ok {
+		return nil, Route{}, ErrNoRoute
+	}
+
+	route := value.(Route)
+	uri, err := target(route, normalized)
+	if err != nil {
+		return nil, route, err
+	}
+
+	return uri, route, nil
+}
+
+// target builds the target URI of the route.
+func target(route Route, number string) (sip.Uri, error) {
+	uri := strings.NewReplacer(
+		"{number}", number,
+		"{digits}", strings.TrimPrefix(number, "+"),
+	).Replace(route.Uri)
+
+	return parser.ParseUri(uri)
+}
+
+func (p *plan) RouteRequest(req sip.Request) (sip.Uri, error) {
+	recipient := req.Recipient()
+	if recipient == nil || recipient.User() == nil {
+		return nil, ErrNoRoute
+	}
+
+	number := recipient.User().String()
+	uri, route, err := p.Route(number)
+	if err != nil {
+		return nil, err
+	}
+	p.Log().WithFields(req.Fields()).Debugf("route %s of request '%s' by route %q to %s",
+		number, req.Short(), route.Name, uri)
+
+	return uri, nil
+}
+
+func (p *plan) TargetSet() proxy.TargetSet {
+	return proxy.TargetSetFunc(func(req sip.Request) ([]proxy.Target, error) {
+		uri, err := p.RouteRequest(req)
+		if err != nil {
+			if errors.Is(err, ErrNoRoute) {
+				return nil, sip.NewRequestError(404, "Not Found", req, nil)
+			}
+			return nil, err
+		}
+
+		return []proxy.Target{{Uri: uri, Q: 1}}, nil
+	})
+}
@@ -0,0 +1,150 @@
+package dialplan_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialplan"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Trie", func() {
+	It("should match numbers by the longest prefix", func() {
+		t := dialplan.NewTrie()
+		t.Insert("+1", "nanp")
+		t.Insert("+1555", "test")
+		t.Insert("+44", "uk")
+		Expect(t.Len()).To(Equal(3))
+
+		prefix, value, ok := t.Match("+15551234567")
+		Expect(ok).To(BeTrue())
+		Expect(prefix).To(Equal("+1555"))
+		Expect(value).To(Equal("test"))
+
+		prefix, value, ok = t.Match("+12125550000")
+		Expect(ok).To(BeTrue())
+		Expect(prefix).To(Equal("+1"))
+		Expect(value).To(Equal("nanp"))
+
+		_, _, ok = t.Match("+33123456789")
+		Expect(ok).To(BeFalse())
+
+		Expect(t.Remove("+1555")).To(BeTrue())
+		Expect(t.Remove("+1555")).To(BeFalse())
+		prefix, _, _ = t.Match("+15551234567")
+		Expect(prefix).To(Equal("+1"))
+		Expect(t.Len()).To(Equal(2))
+	})
+})
+
+var _ = Describe("Country", func() {
+	It("should normalize dialed numbers to E.164", func() {
+		us := dialplan.Countries()["US"]
+		for number, expected := range map[string]string{
+			"(212) 555-0100":   "+12125550100",
+			"1-212-555-0100":   "+12125550100",
+			"011 44 20 7946 0": "+442079460",
+			"+44 20 7946 0000": "+442079460000",
+		} {
+			normalized, err := us.Normalize(number)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(normalized).To(Equal(expected))
+		}
+
+		uk := dialplan.Countries()["GB"]
+		normalized, err := uk.Normalize("020 7946 0000")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(normalized).To(Equal("+442079460000"))
+
+		_, err = us.Normalize("911")
+		Expect(err).To(MatchError(dialplan.ErrInvalidNumber))
+	})
+})
+
+var _ = Describe("Plan", func() {
+	logger := testutils.NewLogrusLogger()
+
+	newPlan := func() dialplan.Plan {
+		p, err := dialplan.NewPlan(dialplan.Config{
+			Country: dialplan.Countries()["US"],
+			Translations: []dialplan.Translation{
+				// outside line of the PBX
+				{Prefix: "9", Strip: 1},
+				// emergency calls are dialed without the outside line
+				{Prefix: "911"},
+				{Prefix: "*67", Strip: 3},
+			},
+			Routes: []dialplan.Route{
+				{Name: "domestic", Prefix: "+1", Uri: "sip:{number}@domestic.example.com;user=phone"},
+				{Name: "international", Prefix: "+", Uri: "sip:{digits}@intl.example.com"},
+				{Name: "emergency", Prefix: "911", Uri: "sip:sos@psap.example.com"},
+			},
+		}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+		return p
+	}
+
+	It("should translate, normalize and route numbers", func() {
+		p := newPlan()
+		Expect(p.Translate("9-212-555-0100")).To(Equal("2125550100"))
+
+		uri, route, err := p.Route("9 (212) 555-0100")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(route.Name).To(Equal("domestic"))
+		Expect(uri.String()).To(Equal("sip:+12125550100@domestic.example.com;user=phone"))
+
+		uri, route, err = p.Route("*67 011 44 20 7946 0000")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(route.Name).To(Equal("international"))
+		Expect(uri.String()).To(Equal("sip:442079460000@intl.example.com"))
+
+		uri, route, err = p.Route("911")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(route.Name).To(Equal("emergency"))
+		Expect(uri.String()).To(Equal("sip:sos@psap.example.com"))
+
+		_, _, err = p.Route("411")
+		Expect(err).To(MatchError(dialplan.ErrNoRoute))
+	})
+
+	It("should route requests of the proxy target set", func() {
+		p := newPlan()
+		request := func(uri string) sip.Request {
+			return testutils.Request([]string{
+				"INVITE " + uri + " SIP/2.0",
+				"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK.abc",
+				"From: <sip:alice@example.com>;tag=alice-tag",
+				"To: <" + uri + ">",
+				"Call-ID: call-1",
+				"CSeq: 1 INVITE",
+				"Content-Length: 0",
+				"",
+				"",
+			})
+		}
+
+		targets, err := p.TargetSet().Targets(request("sip:92125550100@pbx.example.com"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(targets).To(HaveLen(1))
+		Expect(targets[0].Uri.String()).To(Equal("sip:+12125550100@domestic.example.com;user=phone"))
+
+		_, err = p.TargetSet().Targets(request("sip:411@pbx.example.com"))
+		var reqErr *sip.RequestError
+		Expect(err).To(BeAssignableToTypeOf(reqErr))
+		Expect(err.(*sip.RequestError).Code).To(Equal(uint(404)))
+	})
+
+	It("should reject invalid routes", func() {
+		_, err := dialplan.NewPlan(dialplan.Config{Routes: []dialplan.Route{
+			{Prefix: "+1", Uri: "sip:{number}@a.example.com"},
+			{Prefix: "+1", Uri: "sip:{number}@b.example.com"},
+		}}, logger)
+		Expect(err).Should(HaveOccurred())
+
+		_, err = dialplan.NewPlan(dialplan.Config{Routes: []dialplan.Route{
+			{Prefix: "+1", Uri: "gw.example.com"},
+		}}, logger)
+		Expect(err).Should(HaveOccurred())
+	})
+})
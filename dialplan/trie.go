@@ -0,0 +1,106 @@
+package dialplan
+
+import "sync"
+
+// Trie maps number prefixes to values and matches numbers by the longest prefix,
+// like routes or translations of the dial plan.
+type Trie interface {
+	// Insert maps the prefix to the value, the value of the same prefix is replaced.
+	Insert(prefix string, value interface{})
+	// Remove removes the prefix, returns false if the prefix is not in the trie.
+	Remove(prefix string) bool
+	// Match returns the longest prefix of the number and its value.
+	Match(number string) (prefix string, value interface{}, ok bool)
+	Len() int
+}
+
+type node struct {
+	children map[byte]*node
+	value    interface{}
+	set      bool
+}
+
+type trie struct {
+	mu   sync.RWMutex
+	root *node
+	len  int
+}
+
+// NewTrie creates prefix trie.
+func NewTrie() Trie {
+	return &trie{root: &node{}}
+}
+
+func (t *trie) Insert(prefix string, value interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.root
+	for i := 0; i < len(prefix); i++ {
+		if n.children == nil {
+			n.children = make(map[byte]*node)
+		}
+		child, ok := n.children[prefix[i]]
+		if !ok {
+			child = &node{}
+			n.children[prefix[i]] = child
+		}
+		n = child
+	}
+	if !n.set {
+		t.len++
+	}
+	n.value, n.set = value, true
+}
+
+func (t *trie) Remove(prefix string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.root
+	for i := 0; i < len(prefix) && n != nil; i++ {
+		n = n.children[prefix[i]]
+	}
+	if n == nil || !n.set {
+		return false
+	}
+	// empty nodes are kept, dial plans are rarely shrunk
+	n.value, n.set = nil, false
+	t.len--
+
+	return true
+}
+
+func (t *trie) Match(number string) (string, interface{}, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var (
+		value interface{}
+		end   = -1
+	)
+	n := t.root
+	if n.set {
+		value, end = n.value, 0
+	}
+	for i := 0; i < len(number); i++ {
+		if n = n.children[number[i]]; n == nil {
+			break
+		}
+		if n.set {
+			value, end = n.value, i+1
+		}
+	}
+	if end == -1 {
+		return "", nil, false
+	}
+
+	return number[:end], value, true
+}
+
+func (t *trie) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.len
+}
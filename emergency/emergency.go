@@ -0,0 +1,232 @@
+// emergency package implements recognition and handling of emergency calls - RFC 5031, RFC 6881.
+// Requests to urn:service:sos and local emergency numbers are marked with priority and location of the caller
+// and bypass authentication, rate limits and other protection of the server.
+package emergency
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const (
+	// ServiceSOS is a top-level emergency service of the service URN - RFC 5031 4.2.
+	ServiceSOS = "sos"
+	// PriorityEmergency is a value of Priority header of emergency requests - RFC 3261 20.26.
+	PriorityEmergency = "emergency"
+	// DefaultResourcePriority is a value of Resource-Priority header of emergency requests - RFC 7135.
+	DefaultResourcePriority = "esnet.1"
+	DefaultCallTTL          = 4 * time.Hour
+)
+
+// IsSOS reports whether the URI is urn:service:sos or its sub-service like urn:service:sos.police - RFC 5031 4.2.
+func IsSOS(uri sip.Uri) bool {
+	urn, ok := uri.(*sip.UrnUri)
+	if !ok || !strings.EqualFold(urn.FNid, "service") {
+		return false
+	}
+
+	service := strings.ToLower(urn.FNss)
+
+	return service == ServiceSOS || strings.HasPrefix(service, ServiceSOS+".")
+}
+
+// Geolocation is the location of the caller conveyed with emergency request - RFC 6442.
+type Geolocation struct {
+	// Uris are location references: cid URIs of PIDF-LO body parts or http/https URIs of location by reference.
+	Uris []string
+	// Routing allows using the location for routing of the request.
+	Routing bool
+}
+
+// Config describes emergency policy options.
+type Config struct {
+	// Numbers are local emergency dial strings like 911 or 112 recognized in the user part of SIP URIs.
+	Numbers []string
+	// ResourcePriority is a value of Resource-Priority header of marked requests, default is DefaultResourcePriority.
+	ResourcePriority string
+	// Geolocation is called for each marked request to attach location of the caller, nil result attaches nothing.
+	// The hook may also add PIDF-LO body parts referenced by cid URIs to the request.
+	Geolocation func(req sip.Request) *Geolocation
+	// CallTTL limits tracking of emergency calls whose in-dialog requests bypass protection, default is DefaultCallTTL.
+	CallTTL time.Duration
+}
+
+// Policy recognizes emergency requests and exempts them from protection of the server.
+type Policy interface {
+	// IsEmergency reports whether the request is emergency: Request-URI or To URI is the SOS service URN
+	// or the emergency number, or the request belongs to the emergency call passed through Bypass.
+	IsEmergency(req sip.Request) bool
+	// Mark adds Priority, Resource-Priority and Geolocation headers to the outgoing emergency request - RFC 6881 5.
+	Mark(req sip.Request)
+	// Bypass returns handler that passes emergency requests to the bypass handler and other requests
+	// to the protected handler, like the one wrapped by auth.Authenticator.
+	Bypass(protected, bypass gosip.RequestHandler) gosip.RequestHandler
+}
+
+type policy struct {
+	config Config
+
+	mu    sync.Mutex
+	calls map[sip.CallID]timing.Timer
+
+	log log.Logger
+}
+
+// NewPolicy creates emergency policy.
+func NewPolicy(config Config, logger log.Logger) Policy {
+	if config.ResourcePriority == "" {
+		config.ResourcePriority = DefaultResourcePriority
+	}
+	if config.CallTTL <= 0 {
+		config.CallTTL = DefaultCallTTL
+	}
+
+	p := &policy{
+		config: config,
+		calls:  make(map[sip.CallID]timing.Timer),
+	}
+	p.log = logger.
+		WithPrefix("emergency.Policy").
+		WithFields(log.Fields{
+			"policy_ptr": fmt.Sprintf("%p", p),
+		})
+
+	return p
+}
+
+func (p *policy) Log() log.Logger {
+	return p.log
+}
+
+func (p *policy) IsEmergency(req sip.Request) bool {
+	if p.isEmergencyUri(req.Recipient()) {
+		return true
+	}
+	if to, ok := req.To(); ok && p.isEmergencyUri(to.Address) {
+		return true
+	}
+
+	callID, ok := req.CallID()
+	if !ok {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok = p.calls[*callID]
+
+	return ok
+}
+
+func (p *policy) isEmergencyUri(uri sip.Uri) bool {
+	if uri == nil {
+		return false
+	}
+	if IsSOS(uri) {
+		return true
+	}
+	if _, ok := uri.(*sip.SipUri); !ok || uri.User() == nil {
+		return false
+	}
+
+	user := uri.User().String()
+	for _, number := range p.config.Numbers {
+		if user == number {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *policy) Mark(req sip.Request) {
+	req.RemoveHeader("Priority")
+	req.RemoveHeader("Resource-Priority")
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "Priority", Contents: PriorityEmergency})
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "Resource-Priority", Contents: p.config.ResourcePriority})
+
+	if p.config.Geolocation == nil {
+		return
+	}
+	location := p.config.Geolocation(req)
+	if location == nil || len(location.Uris) == 0 {
+		return
+	}
+
+	refs := make([]string, 0, len(location.Uris))
+	for _, uri := range location.Uris {
+		refs = append(refs, "<"+uri+">")
+	}
+	routing := "no"
+	if location.Routing {
+		routing = "yes"
+	}
+
+	req.RemoveHeader("Geolocation")
+	req.RemoveHeader("Geolocation-Routing")
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "Geolocation", Contents: strings.Join(refs, ", ")})
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "Geolocation-Routing", Contents: routing})
+}
+
+func (p *policy) Bypass(protected, bypass gosip.RequestHandler) gosip.RequestHandler {
+	return func(req sip.Request, tx sip.ServerTransaction) {
+		if !p.IsEmergency(req) {
+			protected(req, tx)
+			return
+		}
+
+		p.Log().WithFields(req.Fields()).Debugf("emergency request '%s' bypasses protection", req.Short())
+		p.track(req)
+		bypass(req, tx)
+	}
+}
+
+// Classifier returns classifier of gosip.QueueConfig that puts emergency requests recognized by the policy
+// ahead of other requests, other requests are classified by gosip.ClassifyRequest.
+func Classifier(policy Policy) func(req sip.Request) gosip.Priority {
+	return func(req sip.Request) gosip.Priority {
+		if policy.IsEmergency(req) {
+			return gosip.PriorityEmergency
+		}
+
+		return gosip.ClassifyRequest(req)
+	}
+}
+
+// track remembers Call-ID of the emergency call, so its in-dialog requests also bypass protection.
+func (p *policy) track(req sip.Request) {
+	callID, ok := req.CallID()
+	if !ok {
+		return
+	}
+	key := *callID
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if timer, ok := p.calls[key]; ok {
+		if req.Method() == sip.BYE {
+			timer.Stop()
+			delete(p.calls, key)
+		}
+
+		return
+	}
+	if req.Method() != sip.INVITE {
+		return
+	}
+
+	p.calls[key] = timing.AfterFunc(p.config.CallTTL, func() {
+		p.mu.Lock()
+		delete(p.calls, key)
+		p.mu.Unlock()
+	})
+}
@@ -0,0 +1,94 @@
+package emergency_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/emergency"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Policy", func() {
+	var policy emergency.Policy
+
+	request := func(method sip.RequestMethod, uri, callID string) sip.Request {
+		return testutils.Request([]string{
+			string(method) + " " + uri + " SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <" + uri + ">",
+			"Call-ID: " + callID,
+			"CSeq: 1 " + string(method),
+			"",
+			"",
+		})
+	}
+
+	BeforeEach(func() {
+		policy = emergency.NewPolicy(emergency.Config{
+			Numbers: []string{"112", "911"},
+			Geolocation: func(req sip.Request) *emergency.Geolocation {
+				return &emergency.Geolocation{
+					Uris:    []string{"cid:alice-location@example.com", "https://lis.example.com/alice"},
+					Routing: true,
+				}
+			},
+		}, testutils.NewLogrusLogger())
+	})
+
+	It("should recognize emergency requests", func() {
+		Expect(emergency.IsSOS(&sip.UrnUri{FNid: "service", FNss: "sos"})).To(BeTrue())
+		Expect(emergency.IsSOS(&sip.UrnUri{FNid: "Service", FNss: "SOS.police"})).To(BeTrue())
+		Expect(emergency.IsSOS(&sip.UrnUri{FNid: "service", FNss: "counseling"})).To(BeFalse())
+		Expect(emergency.IsSOS(&sip.UrnUri{FNid: "service", FNss: "sosa"})).To(BeFalse())
+
+		Expect(policy.IsEmergency(request(sip.INVITE, "urn:service:sos.fire", "call-1"))).To(BeTrue())
+		Expect(policy.IsEmergency(request(sip.INVITE, "sip:112@example.com", "call-2"))).To(BeTrue())
+		Expect(policy.IsEmergency(request(sip.INVITE, "sip:bob@example.com", "call-3"))).To(BeFalse())
+	})
+
+	It("should classify emergency requests for the queue", func() {
+		classify := emergency.Classifier(policy)
+		Expect(classify(request(sip.INVITE, "sip:911@example.com", "call-1"))).To(Equal(gosip.PriorityEmergency))
+		Expect(classify(request(sip.INVITE, "sip:bob@example.com", "call-2"))).To(Equal(gosip.PriorityNew))
+		Expect(classify(request(sip.OPTIONS, "sip:bob@example.com", "call-3"))).To(Equal(gosip.PriorityNormal))
+	})
+
+	It("should mark emergency requests", func() {
+		req := request(sip.INVITE, "urn:service:sos", "call-1")
+		policy.Mark(req)
+		policy.Mark(req)
+
+		Expect(req.GetHeaders("Priority")).To(HaveLen(1))
+		Expect(req.GetHeaders("Priority")[0].Value()).To(Equal("emergency"))
+		Expect(req.GetHeaders("Resource-Priority")[0].Value()).To(Equal(emergency.DefaultResourcePriority))
+		Expect(req.GetHeaders("Geolocation")).To(HaveLen(1))
+		Expect(req.GetHeaders("Geolocation")[0].Value()).To(
+			Equal("<cid:alice-location@example.com>, <https://lis.example.com/alice>"))
+		Expect(req.GetHeaders("Geolocation-Routing")[0].Value()).To(Equal("yes"))
+	})
+
+	It("should bypass protection for emergency calls", func() {
+		var protected, bypassed []sip.RequestMethod
+		handler := policy.Bypass(
+			func(req sip.Request, tx sip.ServerTransaction) {
+				protected = append(protected, req.Method())
+			},
+			func(req sip.Request, tx sip.ServerTransaction) {
+				bypassed = append(bypassed, req.Method())
+			},
+		)
+
+		handler(request(sip.INVITE, "urn:service:sos", "sos-call"), nil)
+		handler(request(sip.INVITE, "sip:bob@example.com", "other-call"), nil)
+		// in-dialog requests of the emergency call are matched by Call-ID
+		handler(request(sip.INFO, "sip:alice@10.0.0.1", "sos-call"), nil)
+		handler(request(sip.BYE, "sip:alice@10.0.0.1", "sos-call"), nil)
+		handler(request(sip.BYE, "sip:alice@10.0.0.1", "sos-call"), nil)
+
+		Expect(bypassed).To(Equal([]sip.RequestMethod{sip.INVITE, sip.INFO, sip.BYE}))
+		Expect(protected).To(Equal([]sip.RequestMethod{sip.INVITE, sip.BYE}))
+	})
+})
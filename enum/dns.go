@@ -0,0 +1,293 @@
+package enum
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	dnsHeaderLen   = 12
+	dnsTypeNAPTR   = 35
+	dnsClassIN     = 1
+	dnsFlagRD      = 0x0100
+	dnsFlagTC      = 0x0200
+	dnsRCodeMask   = 0x000f
+	dnsRCodeNXName = 3
+	dnsMessageMax  = 65535
+	dnsMaxPointers = 16
+)
+
+// NAPTR is the naming authority pointer record - RFC 3403 4.1.
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Services    string
+	Regexp      string
+	Replacement string
+}
+
+// Lookup returns NAPTR records of the domain, the domain without records returns ErrNotFound.
+// It is the extension point of the resolver, like lookups through the cache of the carrier.
+type Lookup func(ctx context.Context, domain string) ([]NAPTR, error)
+
+// DNSLookup queries NAPTR records from the DNS servers over UDP, truncated answers are queried again over TCP.
+// Servers are tried in order, empty servers are read from /etc/resolv.conf.
+func DNSLookup(servers []string, timeout time.Duration) Lookup {
+	if len(servers) == 0 {
+		servers = systemServers()
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return func(ctx context.Context, domain string) ([]NAPTR, error) {
+		var lastErr error
+		for _, server := range servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			records, err := queryNAPTR(ctx, server, domain, timeout)
+			if err == nil || errors.Is(err, ErrNotFound) {
+				return records, err
+			}
+			lastErr = err
+		}
+
+		return nil, fmt.Errorf("lookup NAPTR of %s: %w", domain, lastErr)
+	}
+}
+
+func systemServers() []string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return []string{"127.0.0.1:53"}
+	}
+	defer file.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+
+	return servers
+}
+
+func queryNAPTR(ctx context.Context, server, domain string, timeout time.Duration) ([]NAPTR, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := buildQuery(id, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := exchange(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) >= dnsHeaderLen && binary.BigEndian.Uint16(res[2:])&dnsFlagTC != 0 {
+		if res, err = exchange(ctx, "tcp", server, query); err != nil {
+			return nil, err
+		}
+	}
+
+	return parseResponse(id, res)
+}
+
+func exchange(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		// messages are prefixed by the length - RFC 1035 4.2.2
+		msg := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		copy(msg[2:], query)
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		res := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, res); err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMessageMax)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func buildQuery(id uint16, domain string) ([]byte, error) {
+	query := make([]byte, dnsHeaderLen, dnsHeaderLen+len(domain)+6)
+	binary.BigEndian.PutUint16(query[0:], id)
+	binary.BigEndian.PutUint16(query[2:], dnsFlagRD)
+	binary.BigEndian.PutUint16(query[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain %q", domain)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, dnsTypeNAPTR, 0, dnsClassIN)
+
+	return query, nil
+}
+
+var errMalformed = errors.New("malformed DNS response")
+
+func parseResponse(id uint16, res []byte) ([]NAPTR, error) {
+	if len(res) < dnsHeaderLen || binary.BigEndian.Uint16(res) != id {
+		return nil, errMalformed
+	}
+	switch rcode := binary.BigEndian.Uint16(res[2:]) & dnsRCodeMask; rcode {
+	case 0:
+	case dnsRCodeNXName:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("DNS server responded with rcode %d", rcode)
+	}
+
+	qdCount := int(binary.BigEndian.Uint16(res[4:]))
+	anCount := int(binary.BigEndian.Uint16(res[6:]))
+	off := dnsHeaderLen
+	for i := 0; i < qdCount; i++ {
+		var err error
+		if _, off, err = readName(res, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	var records []NAPTR
+	for i := 0; i < anCount; i++ {
+		var err error
+		if _, off, err = readName(res, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(res) {
+			return nil, errMalformed
+		}
+		typ := binary.BigEndian.Uint16(res[off:])
+		rdLen := int(binary.BigEndian.Uint16(res[off+8:]))
+		off += 10
+		if off+rdLen > len(res) {
+			return nil, errMalformed
+		}
+		if typ == dnsTypeNAPTR {
+			record, err := parseNAPTR(res, off, off+rdLen)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+		off += rdLen
+	}
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return records, nil
+}
+
+func parseNAPTR(msg []byte, off, end int) (NAPTR, error) {
+	var record NAPTR
+	if off+4 > end {
+		return record, errMalformed
+	}
+	record.Order = binary.BigEndian.Uint16(msg[off:])
+	record.Preference = binary.BigEndian.Uint16(msg[off+2:])
+	off += 4
+
+	for _, field := range []*string{&record.Flags, &record.Services, &record.Regexp} {
+		if off >= end || off+1+int(msg[off]) > end {
+			return record, errMalformed
+		}
+		*field = string(msg[off+1 : off+1+int(msg[off])])
+		off += 1 + int(msg[off])
+	}
+
+	replacement, _, err := readName(msg, off)
+	if err != nil {
+		return record, err
+	}
+	record.Replacement = replacement
+
+	return record, nil
+}
+
+// readName reads the domain name at the offset and returns the offset after it, compression is followed.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end == -1 {
+				end = off + 1
+			}
+			if len(labels) == 0 {
+				return ".", end, nil
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || pointers >= dnsMaxPointers {
+				return "", 0, errMalformed
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			pointers++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// enum package resolves E.164 numbers to SIP URIs by NAPTR records of ENUM domains - RFC 6116.
+// Carrier-routing applications rewrite Request-URIs of dialed numbers by RouteRequest,
+// then the server resolves the rewritten URI to transport targets by RFC 3263.
+// Domains are looked up in e164.arpa or private suffixes of carriers, results are cached.
+package enum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+const (
+	DefaultSuffix      = "e164.arpa"
+	DefaultCacheTTL    = 5 * time.Minute
+	DefaultNegativeTTL = time.Minute
+	DefaultCacheSize   = 10000
+	DefaultTimeout     = 3 * time.Second
+	// MaxRedirects limits non-terminal records followed by the resolution - RFC 6116 3.4.
+	MaxRedirects = 5
+)
+
+var (
+	// ErrNotFound is returned for numbers without SIP URIs in ENUM domains.
+	ErrNotFound = errors.New("ENUM record not found")
+	// ErrInvalidNumber is returned for numbers that are not E.164 numbers.
+	ErrInvalidNumber = errors.New("invalid E.164 number")
+)
+
+// Config describes ENUM resolver options.
+type Config struct {
+	// Suffixes are ENUM domains tried in order, like the private suffix of the carrier before the public one,
+	// default is DefaultSuffix.
+	Suffixes []string
+	// Services are enumservices of records resolved to URIs, like "sip" of E2U+sip or "pstn:sip", default is "sip".
+	Services []string
+	// Lookup queries NAPTR records, default is DNSLookup of servers of the system with Timeout.
+	Lookup  Lookup
+	Timeout time.Duration
+	// CacheTTL is a lifetime of cached URIs, default is DefaultCacheTTL.
+	CacheTTL time.Duration
+	// NegativeTTL is a lifetime of cached misses, default is DefaultNegativeTTL.
+	NegativeTTL time.Duration
+	// CacheSize limits the number of cached numbers, default is DefaultCacheSize.
+	CacheSize int
+}
+
+// Resolver resolves E.164 numbers to SIP URIs.
+type Resolver interface {
+	// Resolve returns the SIP URI of the number, numbers are E.164 with leading '+', visual separators are ignored.
+	Resolve(ctx context.Context, number string) (sip.Uri, error)
+	// RouteRequest replaces the Request-URI with E.164 number in the user part, like sip:+15551234567@gw;user=phone,
+	// by the resolved URI. It returns false if the Request-URI is not a number or the number has no URI,
+	// so the request is routed by defaults, like to the PSTN gateway.
+	RouteRequest(ctx context.Context, req sip.Request) (bool, error)
+}
+
+type cacheEntry struct {
+	uri     sip.Uri
+	err     error
+	expires time.Time
+}
+
+type resolver struct {
+	config   Config
+	services map[string]bool
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+
+	log log.Logger
+}
+
+// NewResolver creates ENUM resolver.
+func NewResolver(config Config, logger log.Logger) Resolver {
+	if len(config.Suffixes) == 0 {
+		config.Suffixes = []string{DefaultSuffix}
+	}
+	if len(config.Services) == 0 {
+		config.Services = []string{"sip"}
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.Lookup == nil {
+		config.Lookup = DNSLookup(nil, config.Timeout)
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = DefaultCacheTTL
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = DefaultNegativeTTL
+	}
+	if config.CacheSize <= 0 {
+		config.CacheSize = DefaultCacheSize
+	}
+
+	r := &resolver{
+		config:   config,
+		services: make(map[string]bool, len(config.Services)),
+		cache:    make(map[string]cacheEntry),
+	}
+	for _, service := range config.Services {
+		r.services["e2u+"+strings.ToLower(service)] = true
+	}
+	r.log = logger.
+		WithPrefix("enum.Resolver").
+		WithFields(log.Fields{
+			"resolver_ptr": fmt.Sprintf("%p", r),
+		})
+
+	return r
+}
+
+func (r *resolver) Log() log.Logger {
+	return r.log
+}
+
+// Domain returns the ENUM domain of the number under the suffix - RFC 6116 2.4,
+// like 7.6.5.4.3.2.1.5.5.5.1.e164.arpa of +15551234567.
+func Domain(number, suffix string) (string, error) {
+	aus, err := normalize(number)
+	if err != nil {
+		return "", err
+	}
+
+	digits := aus[1:]
+	labels := make([]string, 0, len(digits)+1)
+	for i := len(digits) - 1; i >= 0; i-- {
+		labels = append(labels, digits[i:i+1])
+	}
+	labels = append(labels, strings.Trim(suffix, "."))
+
+	return strings.Join(labels, "."), nil
+}
+
+// normalize returns the application unique string of the number - RFC 6116 2.1, i.e. '+' and digits.
+func normalize(number string) (string, error) {
+	var b strings.Builder
+	for i, c := range strings.TrimSpace(number) {
+		switch {
+		case c == '+' && i == 0:
+			b.WriteRune(c)
+		case '0' <= c && c <= '9':
+			b.WriteRune(c)
+		case c == '-' || c == '.' || c == ' ' || c == '(' || c == ')':
+		default:
+			return "", ErrInvalidNumber
+		}
+	}
+
+	aus := b.String()
+	if !strings.HasPrefix(aus, "+") || len(aus) < 2 || len(aus) > 16 {
+		return "", ErrInvalidNumber
+	}
+
+	return aus, nil
+}
+
+func (r *resolver) Resolve(ctx context.Context, number string) (sip.Uri, error) {
+	aus, err := normalize(number)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	entry, ok := r.cache[aus]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return entry.uri.Clone(), nil
+	}
+
+	uri, err := r.resolve(ctx, aus)
+	switch {
+	case err == nil:
+		r.store(aus, cacheEntry{uri: uri, expires: time.Now().Add(r.config.CacheTTL)})
+		return uri.Clone(), nil
+	case errors.Is(err, ErrNotFound):
+		r.store(aus, cacheEntry{err: err, expires: time.Now().Add(r.config.NegativeTTL)})
+	}
+
+	return nil, err
+}
+
+func (r *resolver) store(aus string, entry cacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.cache[aus]; !ok && len(r.cache) >= r.config.CacheSize {
+		now := time.Now()
+		for key, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, key)
+			}
+		}
+		// all entries are fresh, evict an arbitrary one
+		for key := range r.cache {
+			if len(r.cache) < r.config.CacheSize {
+				break
+			}
+			delete(r.cache, key)
+		}
+	}
+	r.cache[aus] = entry
+}
+
+// resolve tries suffixes in order, the first suffix with the URI wins.
+func (r *resolver) resolve(ctx context.Context, aus string) (sip.Uri, error) {
+	for _, suffix := range r.config.Suffixes {
+		domain, err := Domain(aus, suffix)
+		if err != nil {
+			return nil, err
+		}
+
+		uri, err := r.resolveDomain(ctx, aus, domain)
+		if err == nil {
+			r.Log().Debugf("resolved %s to %s in %s", aus, uri, suffix)
+			return uri, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// resolveDomain applies records of the domain in order - RFC 3403 4.1, following non-terminal records.
+func (r *resolver) resolveDomain(ctx context.Context, aus, domain string) (sip.Uri, error) {
+	for redirects := 0; redirects <= MaxRedirects; redirects++ {
+		records, err := r.config.Lookup(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Order != records[j].Order {
+				return records[i].Order < records[j].Order
+			}
+			return records[i].Preference < records[j].Preference
+		})
+
+		next := ""
+		for _, record := range records {
+			flags := strings.ToLower(record.Flags)
+			if flags == "" && record.Replacement != "" && record.Replacement != "." {
+				// non-terminal record continues the resolution in the replacement domain
+				if next == "" {
+					next = record.Replacement
+				}
+				continue
+			}
+			if flags != "u" || !r.services[strings.ToLower(record.Services)] {
+				continue
+			}
+
+			target, err := applyRegexp(record.Regexp, aus)
+			if err != nil {
+				r.Log().Warnf("skip NAPTR record of %s: %s", domain, err)
+				continue
+			}
+			uri, err := parser.ParseUri(target)
+			if err != nil {
+				r.Log().Warnf("skip NAPTR record of %s with URI %s: %s", domain, target, err)
+				continue
+			}
+
+			return uri, nil
+		}
+		if next == "" {
+			return nil, ErrNotFound
+		}
+		domain = next
+	}
+
+	return nil, ErrNotFound
+}
+
+// backReference matches back-references \1-\9 of substitution expressions.
+var backReference = regexp.MustCompile(`\\([1-9])`)
+
+// applyRegexp applies the substitution expression of the record, like !^.*$!sip:info@example.com! - RFC 3402 3.2.
+func applyRegexp(expr, aus string) (string, error) {
+	if len(expr) < 3 {
+		return "", fmt.Errorf("invalid regexp %q", expr)
+	}
+	delim := expr[:1]
+	parts := strings.Split(expr[1:], delim)
+	if len(parts) != 3 || (parts[2] != "" && parts[2] != "i") {
+		return "", fmt.Errorf("invalid regexp %q", expr)
+	}
+
+	pattern := parts[0]
+	if parts[2] == "i" {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid regexp %q: %w", expr, err)
+	}
+	match := re.FindStringSubmatchIndex(aus)
+	if match == nil {
+		return "", fmt.Errorf("regexp %q does not match %s", expr, aus)
+	}
+
+	template := backReference.ReplaceAllString(strings.Replace(parts[1], "$", "$$", -1), "${$1}")
+	// the matched part of the string is substituted
+	return aus[:match[0]] + string(re.ExpandString(nil, template, aus, match)) + aus[match[1]:], nil
+}
+
+func (r *resolver) RouteRequest(ctx context.Context, req sip.Request) (bool, error) {
+	recipient := req.Recipient()
+	if recipient == nil || recipient.User() == nil {
+		return false, nil
+	}
+	number := recipient.User().String()
+	if !strings.HasPrefix(number, "+") {
+		return false, nil
+	}
+
+	uri, err := r.Resolve(ctx, number)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidNumber) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	r.Log().WithFields(req.Fields()).Debugf("route request '%s' of %s to %s", req.Short(), number, uri)
+	req.SetRecipient(uri)
+
+	return true, nil
+}
@@ -0,0 +1,161 @@
+package enum_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/enum"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+// naptrResponse builds the DNS response on the query with NAPTR records.
+func naptrResponse(query []byte, records ...enum.NAPTR) []byte {
+	res := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(res[2:], 0x8180)
+	binary.BigEndian.PutUint16(res[6:], uint16(len(records)))
+	for _, record := range records {
+		// the name points to the question
+		res = append(res, 0xc0, 12, 0, 35, 0, 1, 0, 0, 0, 60)
+		var rdata []byte
+		rdata = append(rdata, byte(record.Order>>8), byte(record.Order), byte(record.Preference>>8), byte(record.Preference))
+		for _, field := range []string{record.Flags, record.Services, record.Regexp} {
+			rdata = append(rdata, byte(len(field)))
+			rdata = append(rdata, field...)
+		}
+		rdata = append(rdata, 0)
+		res = append(res, byte(len(rdata)>>8), byte(len(rdata)))
+		res = append(res, rdata...)
+	}
+
+	return res
+}
+
+var _ = Describe("Resolver", func() {
+	logger := testutils.NewLogrusLogger()
+	ctx := context.Background()
+
+	It("should build ENUM domains of numbers", func() {
+		domain, err := enum.Domain("+1 (555) 123-4567", enum.DefaultSuffix)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(domain).To(Equal("7.6.5.4.3.2.1.5.5.5.1.e164.arpa"))
+
+		_, err = enum.Domain("5551234567", enum.DefaultSuffix)
+		Expect(err).To(MatchError(enum.ErrInvalidNumber))
+	})
+
+	It("should resolve numbers by records in order and cache results", func() {
+		var lookups int32
+		r := enum.NewResolver(enum.Config{
+			Suffixes: []string{"e164.carrier.net", enum.DefaultSuffix},
+			Lookup: func(ctx context.Context, domain string) ([]enum.NAPTR, error) {
+				atomic.AddInt32(&lookups, 1)
+				if strings.HasSuffix(domain, ".e164.carrier.net") {
+					return nil, enum.ErrNotFound
+				}
+				return []enum.NAPTR{
+					{Order: 100, Preference: 20, Flags: "u", Services: "E2U+sip", Regexp: "!^.*$!sip:backup@example.com!"},
+					{Order: 100, Preference: 10, Flags: "u", Services: "E2U+sip", Regexp: `!^\+1(.*)$!sip:\1@gw.example.com!`},
+					{Order: 10, Preference: 10, Flags: "u", Services: "E2U+email:mailto", Regexp: "!^.*$!mailto:info@example.com!"},
+				}, nil
+			},
+		}, logger)
+
+		uri, err := r.Resolve(ctx, "+15551234567")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(uri.String()).To(Equal("sip:5551234567@gw.example.com"))
+		Expect(atomic.LoadInt32(&lookups)).To(Equal(int32(2)))
+
+		uri, err = r.Resolve(ctx, "+1-555-123-4567")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(uri.String()).To(Equal("sip:5551234567@gw.example.com"))
+		Expect(atomic.LoadInt32(&lookups)).To(Equal(int32(2)))
+	})
+
+	It("should follow non-terminal records", func() {
+		r := enum.NewResolver(enum.Config{
+			Lookup: func(ctx context.Context, domain string) ([]enum.NAPTR, error) {
+				if domain == "numbers.example.com" {
+					return []enum.NAPTR{{Flags: "U", Services: "e2u+sip", Regexp: "!^.*$!sip:pbx@example.com!"}}, nil
+				}
+				return []enum.NAPTR{{Replacement: "numbers.example.com"}}, nil
+			},
+		}, logger)
+
+		uri, err := r.Resolve(ctx, "+442079460000")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(uri.String()).To(Equal("sip:pbx@example.com"))
+	})
+
+	It("should route requests to resolved URIs and keep other requests", func() {
+		r := enum.NewResolver(enum.Config{
+			Lookup: func(ctx context.Context, domain string) ([]enum.NAPTR, error) {
+				if domain == "7.6.5.4.3.2.1.5.5.5.1.e164.arpa" {
+					return []enum.NAPTR{{Flags: "u", Services: "E2U+sip", Regexp: "!^.*$!sip:bob@carrier.example.com!"}}, nil
+				}
+				return nil, enum.ErrNotFound
+			},
+		}, logger)
+
+		request := func(uri string) []string {
+			return []string{
+				"INVITE " + uri + " SIP/2.0",
+				"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK.abc",
+				"From: <sip:alice@example.com>;tag=alice-tag",
+				"To: <" + uri + ">",
+				"Call-ID: call-1",
+				"CSeq: 1 INVITE",
+				"Content-Length: 0",
+				"",
+				"",
+			}
+		}
+
+		req := testutils.Request(request("sip:+15551234567@gw.example.com;user=phone"))
+		routed, err := r.RouteRequest(ctx, req)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(routed).To(BeTrue())
+		Expect(req.Recipient().String()).To(Equal("sip:bob@carrier.example.com"))
+
+		req = testutils.Request(request("sip:+15550000000@gw.example.com;user=phone"))
+		routed, err = r.RouteRequest(ctx, req)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(routed).To(BeFalse())
+		Expect(req.Recipient().String()).To(Equal("sip:+15550000000@gw.example.com;user=phone"))
+
+		req = testutils.Request(request("sip:bob@example.com"))
+		routed, err = r.RouteRequest(ctx, req)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(routed).To(BeFalse())
+	})
+
+	It("should query NAPTR records over DNS", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:5327")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, _ = conn.WriteTo(naptrResponse(buf[:n], enum.NAPTR{
+					Order: 10, Preference: 10, Flags: "u", Services: "E2U+sip", Regexp: "!^.*$!sip:info@example.com!",
+				}), addr)
+			}
+		}()
+
+		records, err := enum.DNSLookup([]string{"127.0.0.1:5327"}, time.Second)(ctx, "7.6.5.4.3.2.1.5.5.5.1.e164.arpa")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(records).To(Equal([]enum.NAPTR{{
+			Order: 10, Preference: 10, Flags: "u", Services: "E2U+sip", Regexp: "!^.*$!sip:info@example.com!", Replacement: ".",
+		}}))
+	})
+})
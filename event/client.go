@@ -0,0 +1,461 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// ClientConfig describes subscriber options.
+type ClientConfig struct {
+	// Target is a Request-URI of the initial SUBSCRIBE, default is To URI.
+	Target sip.Uri
+	// From is a subscriber address.
+	From *sip.Address
+	// To is an address of the subscribed resource.
+	To      *sip.Address
+	Contact *sip.ContactHeader
+	Event   Event
+	// Accept is a list of acceptable NOTIFY body types.
+	Accept []string
+	// Expires is a requested subscription duration, default is DefaultExpires.
+	Expires time.Duration
+	// RefreshBefore defines how long before expiry the subscription is refreshed, default is DefaultRefreshBefore.
+	RefreshBefore time.Duration
+	Authorizer    sip.Authorizer
+	// Headers are appended to each SUBSCRIBE request.
+	Headers []sip.Header
+	// Body of SUBSCRIBE requests, used by some event packages as a filter.
+	Body string
+	// Dialog is an existing dialog that is shared with the subscription - RFC 5057.
+	Dialog dialog.Dialog
+	// OnNotify is called on each accepted NOTIFY request.
+	OnNotify func(sub ClientSubscription, req sip.Request, state SubscriptionState)
+	// OnTerminate is called once when the subscription is terminated.
+	OnTerminate func(sub ClientSubscription, state SubscriptionState)
+	// EventBus receives creation and termination of the dialog of the subscription, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+// ClientSubscription is the subscriber side of the subscription - RFC 6665 4.1.
+type ClientSubscription interface {
+	Event() Event
+	State() State
+	// Dialog returns subscription dialog, it is created by the 2xx response to the initial SUBSCRIBE
+	// and is nil before it, NOTIFY requests received before the response do not create the dialog.
+	Dialog() dialog.Dialog
+	// Subscribe sends initial SUBSCRIBE and waits for the response.
+	// The subscription is automatically refreshed until it is terminated.
+	Subscribe(ctx context.Context) error
+	// Refresh sends in-dialog SUBSCRIBE - RFC 6665 4.1.2.2.
+	Refresh(ctx context.Context) error
+	// Unsubscribe sends SUBSCRIBE with Expires: 0 - RFC 6665 4.1.2.3.
+	Unsubscribe(ctx context.Context) error
+	// Match checks that the NOTIFY request belongs to the subscription.
+	Match(req sip.Request) bool
+	// HandleNotify processes NOTIFY request and builds the response - RFC 6665 4.1.3.
+	HandleNotify(req sip.Request) sip.Response
+	Done() <-chan struct{}
+	String() string
+}
+
+type clientSubscription struct {
+	requester gosip.Requester
+	config    ClientConfig
+	callID    sip.CallID
+	localTag  string
+
+	mu            sync.RWMutex
+	state         State
+	dlg           dialog.Dialog
+	timer         timing.Timer
+	done          chan struct{}
+	terminateOnce sync.Once
+
+	log log.Logger
+}
+
+// NewClientSubscription creates subscriber side subscription.
+func NewClientSubscription(requester gosip.Requester, config ClientConfig, logger log.Logger) ClientSubscription {
+	if config.Expires <= 0 {
+		config.Expires = DefaultExpires
+	}
+	if config.RefreshBefore <= 0 {
+		config.RefreshBefore = DefaultRefreshBefore
+	}
+	if config.Target == nil && config.To != nil {
+		config.Target = config.To.Uri.Clone()
+	}
+
+	sub := &clientSubscription{
+		requester: requester,
+		config:    config,
+		callID:    sip.CallID(util.RandString(32)),
+		localTag:  util.RandString(8),
+		done:      make(chan struct{}),
+	}
+	if config.Dialog != nil {
+		sub.dlg = config.Dialog
+		sub.callID = config.Dialog.CallID()
+		sub.localTag = config.Dialog.LocalTag()
+		config.Dialog.AddUsage()
+	}
+	sub.log = logger.
+		WithPrefix("event.ClientSubscription").
+		WithFields(log.Fields{
+			"event":            config.Event.String(),
+			"subscription_ptr": fmt.Sprintf("%p", sub),
+		})
+
+	return sub
+}
+
+func (sub *clientSubscription) Log() log.Logger {
+	return sub.log
+}
+
+func (sub *clientSubscription) String() string {
+	return fmt.Sprintf("ClientSubscription<%s, %s>", sub.config.Event, sub.State())
+}
+
+func (sub *clientSubscription) Event() Event {
+	return sub.config.Event
+}
+
+func (sub *clientSubscription) State() State {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	return sub.state
+}
+
+func (sub *clientSubscription) Dialog() dialog.Dialog {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	return sub.dlg
+}
+
+func (sub *clientSubscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+func (sub *clientSubscription) Subscribe(ctx context.Context) error {
+	if sub.State() == Terminated {
+		return fmt.Errorf("%s is terminated", sub)
+	}
+	if sub.Dialog() != nil {
+		return sub.Refresh(ctx)
+	}
+
+	req := sub.newInitialRequest()
+	res, err := sub.requester.RequestWithContext(ctx, req, sub.requestOptions()...)
+	if err != nil {
+		sub.terminate(SubscriptionState{State: Terminated, Reason: ReasonRejected})
+
+		return err
+	}
+
+	sub.mu.Lock()
+	if sub.dlg == nil {
+		dlg, err := dialog.NewUACDialog(req, res, sub.Log(), dialog.WithEventBus(sub.config.EventBus))
+		if err != nil {
+			sub.mu.Unlock()
+			sub.terminate(SubscriptionState{State: Terminated})
+
+			return err
+		}
+		dlg.AddUsage()
+		sub.dlg = dlg
+	}
+	if sub.state == Init {
+		sub.state = Pending
+	}
+	sub.mu.Unlock()
+
+	sub.schedule(responseExpires(res, sub.config.Expires))
+
+	return nil
+}
+
+func (sub *clientSubscription) Refresh(ctx context.Context) error {
+	return sub.refresh(ctx, sub.config.Expires)
+}
+
+func (sub *clientSubscription) Unsubscribe(ctx context.Context) error {
+	sub.stopTimer()
+
+	if sub.Dialog() == nil {
+		sub.terminate(SubscriptionState{State: Terminated})
+
+		return nil
+	}
+
+	err := sub.refresh(ctx, 0)
+	if err != nil {
+		sub.terminate(SubscriptionState{State: Terminated})
+	}
+
+	return err
+}
+
+func (sub *clientSubscription) refresh(ctx context.Context, expires time.Duration) error {
+	dlg := sub.Dialog()
+	if dlg == nil {
+		return fmt.Errorf("%s has no dialog", sub)
+	}
+	if sub.State() == Terminated {
+		return fmt.Errorf("%s is terminated", sub)
+	}
+
+	req, err := dlg.NewRequest(sip.SUBSCRIBE, sub.config.Body, sub.requestHeaders(expires)...)
+	if err != nil {
+		return err
+	}
+
+	res, err := sub.requester.RequestWithContext(ctx, req, sub.requestOptions()...)
+	if err != nil {
+		// RFC 6665 4.1.2.2. 481 means that the subscription does not exist anymore
+		if reqErr, ok := err.(*sip.RequestError); ok && (reqErr.Code == 481 || reqErr.Code == 408) {
+			sub.terminate(SubscriptionState{State: Terminated, Reason: ReasonNoResource})
+		} else if expires > 0 {
+			sub.schedule(sub.config.RefreshBefore)
+		}
+
+		return err
+	}
+
+	if expires > 0 {
+		sub.schedule(responseExpires(res, expires))
+	}
+
+	return nil
+}
+
+func (sub *clientSubscription) Match(req sip.Request) bool {
+	if req.Method() != sip.NOTIFY {
+		return false
+	}
+	if event, ok := GetEvent(req); !ok || !event.Equals(sub.config.Event) {
+		return false
+	}
+
+	if dlg := sub.Dialog(); dlg != nil {
+		return dlg.Match(req)
+	}
+
+	// RFC 6665 4.1.2.4. NOTIFY can arrive before the response on SUBSCRIBE
+	callID, ok := req.CallID()
+	if !ok || *callID != sub.callID {
+		return false
+	}
+	to, ok := req.To()
+
+	return ok && getTag(to.Params) == sub.localTag
+}
+
+func (sub *clientSubscription) HandleNotify(req sip.Request) sip.Response {
+	if _, ok := GetEvent(req); !ok {
+		return sip.NewResponseFromRequest("", req, 489, "Bad Event", "")
+	}
+	if !sub.Match(req) || sub.State() == Terminated {
+		return sip.NewResponseFromRequest("", req, 481, "Subscription Does Not Exist", "")
+	}
+
+	ss, ok := GetSubscriptionState(req)
+	if !ok {
+		return sip.NewResponseFromRequest("", req, 400, "Bad Request", "")
+	}
+
+	if dlg := sub.Dialog(); dlg != nil {
+		if err := dlg.ReceiveRequest(req); err != nil {
+			sub.Log().WithFields(req.Fields()).Warnf("NOTIFY rejected: %s", err)
+
+			return sip.NewResponseFromRequest("", req, 500, "Server Internal Error", "")
+		}
+	}
+
+	sub.mu.Lock()
+	if ss.State != Terminated {
+		sub.state = ss.State
+	}
+	sub.mu.Unlock()
+
+	if sub.config.OnNotify != nil {
+		sub.config.OnNotify(sub, req, ss)
+	}
+
+	switch ss.State {
+	case Terminated:
+		sub.terminate(ss)
+	default:
+		if ss.Expires > 0 {
+			sub.schedule(ss.Expires)
+		}
+	}
+
+	return sip.NewResponseFromRequest("", req, 200, "OK", "")
+}
+
+func (sub *clientSubscription) newInitialRequest() sip.Request {
+	to := sub.config.To.AsToHeader()
+	to.Params = sip.NewParams()
+	from := sub.config.From.AsFromHeader()
+	from.Params = sip.NewParams().Add("tag", sip.String{Str: sub.localTag})
+	maxForwards := sip.MaxForwards(70)
+	callID := sub.callID
+
+	hdrs := []sip.Header{
+		sip.ViaHeader{
+			&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       sip.DefaultProtocol,
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			},
+		},
+		&maxForwards,
+		from,
+		to,
+		&callID,
+		&sip.CSeq{SeqNo: uint32(rand.Int31n(1<<16)) + 1, MethodName: sip.SUBSCRIBE},
+	}
+	if sub.config.Contact != nil {
+		hdrs = append(hdrs, sub.config.Contact.Clone())
+	}
+	hdrs = append(hdrs, sub.requestHeaders(sub.config.Expires)...)
+
+	req := sip.NewRequest(
+		"",
+		sip.SUBSCRIBE,
+		sub.config.Target.Clone(),
+		"SIP/2.0",
+		hdrs,
+		"",
+		log.Fields{
+			"subscription_ptr": fmt.Sprintf("%p", sub),
+		},
+	)
+	req.SetBody(sub.config.Body, true)
+
+	return req
+}
+
+func (sub *clientSubscription) requestHeaders(expires time.Duration) []sip.Header {
+	expiresHdr := sip.Expires(uint32(expires / time.Second))
+	hdrs := []sip.Header{
+		sub.config.Event.Header(),
+		&expiresHdr,
+	}
+	if len(sub.config.Accept) > 0 {
+		hdrs = append(hdrs, &sip.GenericHeader{
+			HeaderName: "Accept",
+			Contents:   strings.Join(sub.config.Accept, ", "),
+		})
+	}
+	for _, hdr := range sub.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	return hdrs
+}
+
+func (sub *clientSubscription) requestOptions() []gosip.RequestWithContextOption {
+	options := make([]gosip.RequestWithContextOption, 0)
+	if sub.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(sub.config.Authorizer))
+	}
+
+	return options
+}
+
+func (sub *clientSubscription) schedule(expires time.Duration) {
+	delay := expires - sub.config.RefreshBefore
+	if expires <= 2*sub.config.RefreshBefore {
+		delay = expires / 2
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.state == Terminated {
+		return
+	}
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	sub.timer = timing.AfterFunc(delay, func() {
+		if err := sub.Refresh(context.Background()); err != nil {
+			sub.Log().Warnf("refresh subscription failed: %s", err)
+		}
+	})
+}
+
+func (sub *clientSubscription) stopTimer() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.timer != nil {
+		sub.timer.Stop()
+		sub.timer = nil
+	}
+}
+
+func (sub *clientSubscription) terminate(ss SubscriptionState) {
+	sub.terminateOnce.Do(func() {
+		sub.mu.Lock()
+		sub.state = Terminated
+		if sub.timer != nil {
+			sub.timer.Stop()
+			sub.timer = nil
+		}
+		dlg := sub.dlg
+		sub.mu.Unlock()
+
+		if dlg != nil {
+			dlg.ReleaseUsage()
+		}
+
+		close(sub.done)
+
+		sub.Log().Debugf("subscription terminated, reason '%s'", ss.Reason)
+
+		if sub.config.OnTerminate != nil {
+			sub.config.OnTerminate(sub, ss)
+		}
+	})
+}
+
+// ShouldResubscribe checks that a new subscription can be created after termination
+// and returns a delay before the attempt - RFC 6665 4.1.3.
+func ShouldResubscribe(ss SubscriptionState) (bool, time.Duration) {
+	switch ss.Reason {
+	case ReasonDeactivated, ReasonTimeout:
+		return true, 0
+	case ReasonProbation, ReasonGiveUp:
+		return true, ss.RetryAfter
+	case ReasonRejected, ReasonNoResource, ReasonInvariant:
+		return false, 0
+	default:
+		return true, ss.RetryAfter
+	}
+}
+
+func responseExpires(res sip.Response, requested time.Duration) time.Duration {
+	if expires, ok := getExpires(res); ok && expires > 0 {
+		return expires
+	}
+
+	return requested
+}
@@ -0,0 +1,230 @@
+// event package implements SIP-specific event notification framework - RFC 6665.
+// It is the base for event packages like presence, message-summary and dialog.
+package event
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	DefaultExpires       = time.Hour
+	DefaultRefreshBefore = 30 * time.Second
+)
+
+// Subscription-State reasons - RFC 6665 4.1.3.
+const (
+	ReasonDeactivated = "deactivated"
+	ReasonProbation   = "probation"
+	ReasonRejected    = "rejected"
+	ReasonTimeout     = "timeout"
+	ReasonGiveUp      = "giveup"
+	ReasonNoResource  = "noresource"
+	ReasonInvariant   = "invariant"
+)
+
+type State int
+
+const (
+	Init State = iota
+	Pending
+	Active
+	Terminated
+)
+
+func (state State) String() string {
+	switch state {
+	case Init:
+		return "init"
+	case Pending:
+		return "pending"
+	case Active:
+		return "active"
+	case Terminated:
+		return "terminated"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a value of the Event header - RFC 6665 8.2.1.
+type Event struct {
+	Package string
+	ID      string
+}
+
+func (event Event) String() string {
+	if event.ID == "" {
+		return event.Package
+	}
+
+	return fmt.Sprintf("%s;id=%s", event.Package, event.ID)
+}
+
+// Equals compares event package names case-insensitively and ids exactly.
+func (event Event) Equals(other Event) bool {
+	return strings.EqualFold(event.Package, other.Package) && event.ID == other.ID
+}
+
+func (event Event) Header() sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Event",
+		Contents:   event.String(),
+	}
+}
+
+// ParseEvent parses Event header value.
+func ParseEvent(value string) (Event, error) {
+	parts := strings.Split(value, ";")
+	event := Event{Package: strings.TrimSpace(parts[0])}
+	if event.Package == "" {
+		return event, fmt.Errorf("empty event package in '%s'", value)
+	}
+
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "id") {
+			event.ID = strings.TrimSpace(kv[1])
+		}
+	}
+
+	return event, nil
+}
+
+// GetEvent returns Event of the message, 'o' compact form is supported.
+func GetEvent(msg sip.Message) (Event, bool) {
+	hdrs := msg.GetHeaders("Event")
+	if len(hdrs) == 0 {
+		hdrs = msg.GetHeaders("o")
+	}
+	if len(hdrs) == 0 {
+		return Event{}, false
+	}
+
+	event, err := ParseEvent(hdrs[0].Value())
+	if err != nil {
+		return Event{}, false
+	}
+
+	return event, true
+}
+
+// SubscriptionState is a value of the Subscription-State header - RFC 6665 8.2.3.
+type SubscriptionState struct {
+	State      State
+	Expires    time.Duration
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (ss SubscriptionState) String() string {
+	str := ss.State.String()
+	if ss.State == Terminated {
+		if ss.Reason != "" {
+			str += ";reason=" + ss.Reason
+		}
+		if ss.RetryAfter > 0 {
+			str += fmt.Sprintf(";retry-after=%d", int(ss.RetryAfter/time.Second))
+		}
+	} else {
+		str += fmt.Sprintf(";expires=%d", int(ss.Expires/time.Second))
+	}
+
+	return str
+}
+
+func (ss SubscriptionState) Header() sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Subscription-State",
+		Contents:   ss.String(),
+	}
+}
+
+// ParseSubscriptionState parses Subscription-State header value.
+// Unknown states are treated as pending - RFC 6665 4.1.3.
+func ParseSubscriptionState(value string) (SubscriptionState, error) {
+	parts := strings.Split(value, ";")
+	ss := SubscriptionState{}
+	switch strings.ToLower(strings.TrimSpace(parts[0])) {
+	case "active":
+		ss.State = Active
+	case "pending":
+		ss.State = Pending
+	case "terminated":
+		ss.State = Terminated
+	case "":
+		return ss, fmt.Errorf("empty subscription state in '%s'", value)
+	default:
+		ss.State = Pending
+	}
+
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := strings.ToLower(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "reason":
+			ss.Reason = strings.ToLower(val)
+		case "expires", "retry-after":
+			sec, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return ss, fmt.Errorf("invalid %s param in '%s': %w", key, value, err)
+			}
+			if key == "expires" {
+				ss.Expires = time.Duration(sec) * time.Second
+			} else {
+				ss.RetryAfter = time.Duration(sec) * time.Second
+			}
+		}
+	}
+
+	return ss, nil
+}
+
+// GetSubscriptionState returns Subscription-State of the NOTIFY request.
+func GetSubscriptionState(msg sip.Message) (SubscriptionState, bool) {
+	hdrs := msg.GetHeaders("Subscription-State")
+	if len(hdrs) == 0 {
+		return SubscriptionState{}, false
+	}
+
+	ss, err := ParseSubscriptionState(hdrs[0].Value())
+	if err != nil {
+		return SubscriptionState{}, false
+	}
+
+	return ss, true
+}
+
+func getExpires(msg sip.Message) (time.Duration, bool) {
+	hdrs := msg.GetHeaders("Expires")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+	if expires, ok := hdrs[0].(*sip.Expires); ok {
+		return time.Duration(*expires) * time.Second, true
+	}
+	sec, err := strconv.ParseUint(strings.TrimSpace(hdrs[0].Value()), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(sec) * time.Second, true
+}
+
+func getTag(params sip.Params) string {
+	if params == nil {
+		return ""
+	}
+	if tag, ok := params.Get("tag"); ok && tag != nil {
+		return tag.String()
+	}
+
+	return ""
+}
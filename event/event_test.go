@@ -0,0 +1,178 @@
+package event_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Event", func() {
+	It("should parse Subscription-State", func() {
+		ss, err := event.ParseSubscriptionState("terminated;reason=probation;retry-after=30")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ss.State).To(Equal(event.Terminated))
+		Expect(ss.Reason).To(Equal(event.ReasonProbation))
+		Expect(ss.RetryAfter).To(Equal(30 * time.Second))
+		Expect(ss.String()).To(Equal("terminated;reason=probation;retry-after=30"))
+
+		ok, delay := event.ShouldResubscribe(ss)
+		Expect(ok).To(BeTrue())
+		Expect(delay).To(Equal(30 * time.Second))
+
+		ev, err := event.ParseEvent("presence;id=12")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ev.Equals(event.Event{Package: "Presence", ID: "12"})).To(BeTrue())
+	})
+
+	Describe("Manager", func() {
+		var (
+			clientManager event.Manager
+			serverManager event.Manager
+			notifies      chan string
+			serverSubs    chan event.ServerSubscription
+		)
+
+		BeforeEach(func() {
+			logger := testutils.NewLogrusLogger()
+			notifies = make(chan string, 10)
+			serverSubs = make(chan event.ServerSubscription, 10)
+
+			toClient := testutils.NewLoopback()
+			toServer := testutils.NewLoopback()
+
+			clientManager = event.NewManager(toServer, event.ManagerConfig{}, logger)
+			serverManager = event.NewManager(toClient, event.ManagerConfig{
+				Packages: []string{"message-summary"},
+				Server: event.ServerConfig{
+					Contact: &sip.ContactHeader{Address: &sip.SipUri{FHost: "10.0.0.2"}},
+					CurrentState: func(sub event.ServerSubscription) (string, string) {
+						return "application/simple-message-summary", "Messages-Waiting: yes\r\n"
+					},
+				},
+				OnSubscribe: func(sub event.ServerSubscription, tx sip.ServerTransaction) {
+					Expect(sub.Accept(context.Background(), tx, event.Active)).To(Succeed())
+					serverSubs <- sub
+				},
+			}, logger)
+
+			_ = toClient.OnRequest(sip.NOTIFY, clientManager.ServeNotify)
+			_ = toServer.OnRequest(sip.SUBSCRIBE, serverManager.ServeSubscribe)
+		})
+
+		newConfig := func(pkg string) event.ClientConfig {
+			return event.ClientConfig{
+				From:    &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"}},
+				To:      &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"}},
+				Contact: &sip.ContactHeader{Address: &sip.SipUri{FHost: "10.0.0.1"}},
+				Event:   event.Event{Package: pkg},
+				Expires: time.Hour,
+				OnNotify: func(sub event.ClientSubscription, req sip.Request, state event.SubscriptionState) {
+					notifies <- state.State.String() + ":" + req.Body()
+				},
+			}
+		}
+
+		It("should subscribe, notify and unsubscribe", func() {
+			sub, err := clientManager.Subscribe(context.Background(), newConfig("message-summary"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sub.State()).To(Equal(event.Active))
+			Expect(<-notifies).To(Equal("active:Messages-Waiting: yes\r\n"))
+
+			serverSub := <-serverSubs
+			Expect(serverSub.Expires()).To(BeNumerically(">", 59*time.Minute))
+			Expect(serverSub.Notify(context.Background(), "application/simple-message-summary", "Messages-Waiting: no\r\n")).To(Succeed())
+			Expect(<-notifies).To(Equal("active:Messages-Waiting: no\r\n"))
+
+			Expect(sub.Refresh(context.Background())).To(Succeed())
+			Expect(<-notifies).To(ContainSubstring("active:"))
+
+			Expect(sub.Unsubscribe(context.Background())).To(Succeed())
+			Expect(<-notifies).To(ContainSubstring("terminated:"))
+			Eventually(sub.Done()).Should(BeClosed())
+			Eventually(serverSub.Done()).Should(BeClosed())
+			Expect(sub.Dialog().Usages()).To(Equal(0))
+		})
+
+		It("should share dialog between subscriptions", func() {
+			sub1, err := clientManager.Subscribe(context.Background(), newConfig("message-summary"))
+			Expect(err).ToNot(HaveOccurred())
+			<-notifies
+
+			config := newConfig("message-summary")
+			config.Event.ID = "2"
+			config.Dialog = sub1.Dialog()
+			sub2, err := clientManager.Subscribe(context.Background(), config)
+			Expect(err).ToNot(HaveOccurred())
+			<-notifies
+			Expect(sub2.Dialog()).To(Equal(sub1.Dialog()))
+			Expect(sub1.Dialog().Usages()).To(Equal(2))
+
+			serverSub1, serverSub2 := <-serverSubs, <-serverSubs
+			Expect(serverSub1.Dialog()).To(Equal(serverSub2.Dialog()))
+
+			Expect(sub1.Unsubscribe(context.Background())).To(Succeed())
+			<-notifies
+			Eventually(sub1.Done()).Should(BeClosed())
+			Expect(sub2.State()).To(Equal(event.Active))
+			Expect(sub2.Dialog().Usages()).To(Equal(1))
+		})
+
+		It("should reject unsupported packages", func() {
+			_, err := clientManager.Subscribe(context.Background(), newConfig("presence"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*sip.RequestError).Code).To(Equal(uint(489)))
+		})
+
+		It("should apply out-of-dialog NOTIFY policy", func() {
+			notify := func(from string) sip.Request {
+				return testutils.Request([]string{
+					"NOTIFY sip:alice@10.0.0.1 SIP/2.0",
+					"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=" + sip.GenerateBranch(),
+					"From: <sip:" + from + "@example.com>;tag=server-tag",
+					"To: <sip:alice@example.com>",
+					"Call-ID: unsolicited",
+					"CSeq: 1 NOTIFY",
+					"Event: message-summary",
+					"Subscription-State: active",
+					"",
+					"",
+				})
+			}
+			serve := func(m event.Manager, req sip.Request) sip.StatusCode {
+				tx := testutils.NewMockServerTx(req)
+				m.ServeNotify(req, tx)
+				return tx.Response().StatusCode()
+			}
+
+			Expect(serve(clientManager, notify("voicemail"))).To(Equal(sip.StatusCode(481)))
+
+			received := make(chan sip.Request, 1)
+			m := event.NewManager(nil, event.ManagerConfig{
+				OutOfDialogNotify: event.OutOfDialogPolicy{
+					Accept: true,
+					Authorize: func(req sip.Request) error {
+						if from, _ := req.From(); from.Address.User().String() != "voicemail" {
+							return sip.NewRequestError(603, "Decline", req, nil)
+						}
+						return nil
+					},
+				},
+				OnNotify: func(req sip.Request, tx sip.ServerTransaction) {
+					received <- req
+					Expect(tx.Respond(sip.NewResponseFromRequest("", req, 202, "Accepted", ""))).To(Succeed())
+				},
+			}, testutils.NewLogrusLogger())
+
+			Expect(serve(m, notify("voicemail"))).To(Equal(sip.StatusCode(202)))
+			Expect(received).To(Receive())
+			Expect(serve(m, notify("mallory"))).To(Equal(sip.StatusCode(603)))
+			Expect(received).ToNot(Receive())
+		})
+	})
+})
@@ -0,0 +1,287 @@
+package event
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// ManagerConfig describes subscription manager options.
+type ManagerConfig struct {
+	// Packages is a list of supported event packages, SUBSCRIBE for other packages are rejected with 489.
+	// Empty list allows any package.
+	Packages []string
+	// Server is a template config of the notifier subscriptions, Dialog field is managed by the manager.
+	Server ServerConfig
+	// OnSubscribe is called on each new incoming subscription,
+	// handler should Accept or Reject the subscription through the transaction.
+	OnSubscribe func(sub ServerSubscription, tx sip.ServerTransaction)
+	// OutOfDialogNotify is a policy of NOTIFY requests without To tag that match no subscription,
+	// by default they are rejected with 481.
+	OutOfDialogNotify OutOfDialogPolicy
+	// OnNotify is called on each allowed out-of-dialog NOTIFY,
+	// handler should respond through the transaction. Default is 200 OK.
+	OnNotify func(req sip.Request, tx sip.ServerTransaction)
+}
+
+// Manager routes SUBSCRIBE and NOTIFY requests to subscriptions
+// and shares dialogs between subscriptions and other dialog usages - RFC 6665 4.5.2, RFC 5057.
+type Manager interface {
+	// Subscribe creates and starts new client subscription.
+	Subscribe(ctx context.Context, config ClientConfig) (ClientSubscription, error)
+	// AddDialog registers existing dialog, so incoming subscriptions can share it.
+	AddDialog(dlg dialog.Dialog)
+	// ServeSubscribe handles SUBSCRIBE request, can be passed directly to gosip.Server OnRequest.
+	ServeSubscribe(req sip.Request, tx sip.ServerTransaction)
+	// ServeNotify handles NOTIFY request, can be passed directly to gosip.Server OnRequest.
+	ServeNotify(req sip.Request, tx sip.ServerTransaction)
+	ClientSubscriptions() []ClientSubscription
+	ServerSubscriptions() []ServerSubscription
+}
+
+type manager struct {
+	requester gosip.Requester
+	config    ManagerConfig
+
+	mu      sync.RWMutex
+	clients map[ClientSubscription]bool
+	servers map[ServerSubscription]bool
+	dialogs map[string]dialog.Dialog
+
+	log log.Logger
+}
+
+// NewManager creates subscription manager.
+func NewManager(requester gosip.Requester, config ManagerConfig, logger log.Logger) Manager {
+	m := &manager{
+		requester: requester,
+		config:    config,
+		clients:   make(map[ClientSubscription]bool),
+		servers:   make(map[ServerSubscription]bool),
+		dialogs:   make(map[string]dialog.Dialog),
+	}
+	m.log = logger.WithPrefix("event.Manager")
+
+	return m
+}
+
+func (m *manager) Log() log.Logger {
+	return m.log
+}
+
+func (m *manager) Subscribe(ctx context.Context, config ClientConfig) (ClientSubscription, error) {
+	sub := NewClientSubscription(m.requester, config, m.Log())
+
+	m.mu.Lock()
+	m.clients[sub] = true
+	m.mu.Unlock()
+
+	go func() {
+		<-sub.Done()
+
+		m.mu.Lock()
+		delete(m.clients, sub)
+		m.mu.Unlock()
+	}()
+
+	if err := sub.Subscribe(ctx); err != nil {
+		return nil, err
+	}
+
+	if dlg := sub.Dialog(); dlg != nil {
+		m.AddDialog(dlg)
+	}
+
+	return sub, nil
+}
+
+func (m *manager) AddDialog(dlg dialog.Dialog) {
+	m.mu.Lock()
+	if _, ok := m.dialogs[dlg.ID()]; ok {
+		m.mu.Unlock()
+		return
+	}
+	m.dialogs[dlg.ID()] = dlg
+	m.mu.Unlock()
+
+	go func() {
+		<-dlg.Done()
+
+		m.mu.Lock()
+		delete(m.dialogs, dlg.ID())
+		m.mu.Unlock()
+	}()
+}
+
+func (m *manager) ClientSubscriptions() []ClientSubscription {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	subs := make([]ClientSubscription, 0, len(m.clients))
+	for sub := range m.clients {
+		subs = append(subs, sub)
+	}
+
+	return subs
+}
+
+func (m *manager) ServerSubscriptions() []ServerSubscription {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	subs := make([]ServerSubscription, 0, len(m.servers))
+	for sub := range m.servers {
+		subs = append(subs, sub)
+	}
+
+	return subs
+}
+
+func (m *manager) ServeNotify(req sip.Request, tx sip.ServerTransaction) {
+	var res sip.Response
+	if _, ok := GetEvent(req); !ok {
+		res = sip.NewResponseFromRequest("", req, 489, "Bad Event", "")
+	} else {
+		for _, sub := range m.ClientSubscriptions() {
+			if sub.Match(req) {
+				res = sub.HandleNotify(req)
+				if dlg := sub.Dialog(); dlg != nil {
+					m.AddDialog(dlg)
+				}
+				break
+			}
+		}
+	}
+	if res == nil {
+		to, _ := req.To()
+		if to != nil && getTag(to.Params) != "" {
+			res = sip.NewResponseFromRequest("", req, 481, "Subscription Does Not Exist", "")
+		} else {
+			res = m.config.OutOfDialogNotify.Check(req, 481, "Subscription Does Not Exist")
+		}
+	}
+	if res == nil {
+		if m.config.OnNotify != nil {
+			m.config.OnNotify(req, tx)
+
+			return
+		}
+		res = sip.NewResponseFromRequest("", req, 200, "OK", "")
+	}
+
+	m.respond(tx, res)
+}
+
+func (m *manager) ServeSubscribe(req sip.Request, tx sip.ServerTransaction) {
+	event, ok := GetEvent(req)
+	if !ok || !m.isSupported(event) {
+		res := sip.NewResponseFromRequest("", req, 489, "Bad Event", "")
+		if len(m.config.Packages) > 0 {
+			res.AppendHeader(&sip.GenericHeader{
+				HeaderName: "Allow-Events",
+				Contents:   strings.Join(m.config.Packages, ", "),
+			})
+		}
+		m.respond(tx, res)
+
+		return
+	}
+
+	to, _ := req.To()
+	if to == nil || getTag(to.Params) == "" {
+		m.newServerSubscription(req, tx, m.config.Server)
+
+		return
+	}
+
+	// in-dialog SUBSCRIBE: refresh of the existing subscription or new subscription in the existing dialog
+	dialogID, err := sip.MakeDialogIDFromMessage(req)
+	if err != nil {
+		m.respond(tx, sip.NewResponseFromRequest("", req, 400, "Bad Request", ""))
+
+		return
+	}
+
+	for _, sub := range m.ServerSubscriptions() {
+		if sub.Event().Equals(event) && sub.Dialog() != nil && sub.Dialog().ID() == dialogID {
+			if err := sub.HandleSubscribe(context.Background(), req, tx); err != nil {
+				m.Log().WithFields(req.Fields()).Warnf("handle SUBSCRIBE failed: %s", err)
+			}
+
+			return
+		}
+	}
+
+	m.mu.RLock()
+	dlg, ok := m.dialogs[dialogID]
+	m.mu.RUnlock()
+	if !ok {
+		m.respond(tx, sip.NewResponseFromRequest("", req, 481, "Subscription Does Not Exist", ""))
+
+		return
+	}
+
+	config := m.config.Server
+	config.Dialog = dlg
+	m.newServerSubscription(req, tx, config)
+}
+
+func (m *manager) newServerSubscription(req sip.Request, tx sip.ServerTransaction, config ServerConfig) {
+	sub, err := NewServerSubscription(req, m.requester, config, m.Log())
+	if err != nil {
+		m.respond(tx, sip.NewResponseFromRequest("", req, 400, "Bad Request", ""))
+
+		return
+	}
+
+	m.mu.Lock()
+	m.servers[sub] = true
+	m.mu.Unlock()
+
+	go func() {
+		<-sub.Done()
+
+		m.mu.Lock()
+		delete(m.servers, sub)
+		m.mu.Unlock()
+	}()
+
+	if m.config.OnSubscribe == nil {
+		_ = sub.Reject(tx, 489, "Bad Event")
+
+		return
+	}
+
+	m.config.OnSubscribe(sub, tx)
+
+	if dlg := sub.Dialog(); dlg != nil {
+		m.AddDialog(dlg)
+	}
+}
+
+func (m *manager) isSupported(event Event) bool {
+	if len(m.config.Packages) == 0 {
+		return true
+	}
+	for _, pkg := range m.config.Packages {
+		if strings.EqualFold(pkg, event.Package) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *manager) respond(tx sip.ServerTransaction, res sip.Response) {
+	if tx == nil {
+		return
+	}
+	if err := tx.Respond(res); err != nil {
+		m.Log().WithFields(res.Fields()).Errorf("respond '%s' failed: %s", res.Short(), err)
+	}
+}
@@ -0,0 +1,40 @@
+package event
+
+import (
+	"errors"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// OutOfDialogPolicy describes handling of requests that usually belong to a dialog but are received outside of any,
+// like out-of-dialog REFER used for click-to-dial or unsolicited NOTIFY.
+type OutOfDialogPolicy struct {
+	// Accept enables handling of out-of-dialog requests, by default they are rejected.
+	Accept bool
+	// Authorize is called for each accepted out-of-dialog request.
+	// Returned *sip.RequestError rejects the request with its code, other errors reject it with 403 Forbidden.
+	Authorize func(req sip.Request) error
+}
+
+// Check returns the response that rejects the out-of-dialog request or nil if the request is allowed.
+// The code and the reason are used when the policy does not accept out-of-dialog requests.
+func (policy OutOfDialogPolicy) Check(req sip.Request, code sip.StatusCode, reason string) sip.Response {
+	if !policy.Accept {
+		return sip.NewResponseFromRequest("", req, code, reason, "")
+	}
+	if policy.Authorize == nil {
+		return nil
+	}
+
+	err := policy.Authorize(req)
+	if err == nil {
+		return nil
+	}
+
+	var reqErr *sip.RequestError
+	if !errors.As(err, &reqErr) {
+		reqErr = sip.NewRequestError(403, "Forbidden", req, nil)
+	}
+
+	return sip.NewResponseFromRequest("", req, sip.StatusCode(reqErr.Code), reqErr.Reason, "")
+}
@@ -0,0 +1,445 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	DefaultMinExpires = time.Minute
+	DefaultMaxExpires = 24 * time.Hour
+)
+
+// ServerConfig describes notifier options.
+type ServerConfig struct {
+	// Contact is a notifier Contact.
+	Contact *sip.ContactHeader
+	// DefaultExpires is used when SUBSCRIBE has no Expires header, default is DefaultExpires.
+	DefaultExpires time.Duration
+	// MinExpires is the shortest allowed subscription duration, default is DefaultMinExpires.
+	MinExpires time.Duration
+	// MaxExpires is the longest allowed subscription duration, default is DefaultMaxExpires.
+	MaxExpires time.Duration
+	// Headers are appended to each NOTIFY request.
+	Headers []sip.Header
+	// Dialog is an existing dialog that is shared with the subscription - RFC 5057.
+	Dialog dialog.Dialog
+	// CurrentState returns the resource state that is sent in automatic NOTIFY requests
+	// on subscription acceptance, refresh and termination.
+	CurrentState func(sub ServerSubscription) (contentType string, body string)
+	// OnTerminate is called once when the subscription is terminated.
+	OnTerminate func(sub ServerSubscription, state SubscriptionState)
+	// EventBus receives creation and termination of the dialog of the subscription, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+// ServerSubscription is the notifier side of the subscription - RFC 6665 4.2.
+type ServerSubscription interface {
+	Event() Event
+	State() State
+	// Request returns the initial SUBSCRIBE request.
+	Request() sip.Request
+	Dialog() dialog.Dialog
+	// Expires returns remaining subscription duration.
+	Expires() time.Duration
+	// Accept responds on the initial SUBSCRIBE and sends the first NOTIFY - RFC 6665 4.2.1.1.
+	// State should be Active or Pending.
+	Accept(ctx context.Context, tx sip.ServerTransaction, state State) error
+	// Reject responds on the initial SUBSCRIBE with the failure response.
+	Reject(tx sip.ServerTransaction, code sip.StatusCode, reason string) error
+	// HandleSubscribe processes refreshing or terminating SUBSCRIBE - RFC 6665 4.2.1.2, 4.2.1.3.
+	HandleSubscribe(ctx context.Context, req sip.Request, tx sip.ServerTransaction) error
+	// SetState changes subscription state and sends NOTIFY with the current resource state.
+	SetState(ctx context.Context, state State) error
+	// Notify sends NOTIFY with the provided body - RFC 6665 4.2.2.
+	Notify(ctx context.Context, contentType, body string) error
+	// Terminate sends final NOTIFY with terminated state.
+	Terminate(ctx context.Context, reason string, retryAfter time.Duration) error
+	Done() <-chan struct{}
+	String() string
+}
+
+type serverSubscription struct {
+	requester gosip.Requester
+	config    ServerConfig
+	event     Event
+	request   sip.Request
+
+	mu            sync.RWMutex
+	state         State
+	dlg           dialog.Dialog
+	expiresAt     time.Time
+	timer         timing.Timer
+	done          chan struct{}
+	terminateOnce sync.Once
+
+	log log.Logger
+}
+
+// NewServerSubscription creates notifier side subscription from the initial SUBSCRIBE request.
+func NewServerSubscription(
+	req sip.Request,
+	requester gosip.Requester,
+	config ServerConfig,
+	logger log.Logger,
+) (ServerSubscription, error) {
+	if req.Method() != sip.SUBSCRIBE {
+		return nil, fmt.Errorf("request '%s' is not SUBSCRIBE", req.Short())
+	}
+	event, ok := GetEvent(req)
+	if !ok {
+		return nil, fmt.Errorf("'Event' header not found in request '%s'", req.Short())
+	}
+
+	if config.DefaultExpires <= 0 {
+		config.DefaultExpires = DefaultExpires
+	}
+	if config.MinExpires <= 0 {
+		config.MinExpires = DefaultMinExpires
+	}
+	if config.MaxExpires <= 0 {
+		config.MaxExpires = DefaultMaxExpires
+	}
+
+	sub := &serverSubscription{
+		requester: requester,
+		config:    config,
+		event:     event,
+		request:   req,
+		dlg:       config.Dialog,
+		done:      make(chan struct{}),
+	}
+	sub.log = logger.
+		WithPrefix("event.ServerSubscription").
+		WithFields(log.Fields{
+			"event":            event.String(),
+			"subscription_ptr": fmt.Sprintf("%p", sub),
+		})
+
+	return sub, nil
+}
+
+func (sub *serverSubscription) Log() log.Logger {
+	return sub.log
+}
+
+func (sub *serverSubscription) String() string {
+	return fmt.Sprintf("ServerSubscription<%s, %s>", sub.event, sub.State())
+}
+
+func (sub *serverSubscription) Event() Event {
+	return sub.event
+}
+
+func (sub *serverSubscription) State() State {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	return sub.state
+}
+
+func (sub *serverSubscription) Request() sip.Request {
+	return sub.request
+}
+
+func (sub *serverSubscription) Dialog() dialog.Dialog {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	return sub.dlg
+}
+
+func (sub *serverSubscription) Expires() time.Duration {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+
+	if sub.state == Terminated || sub.expiresAt.IsZero() {
+		return 0
+	}
+	if left := sub.expiresAt.Sub(timing.Now()); left > 0 {
+		return left
+	}
+
+	return 0
+}
+
+func (sub *serverSubscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+func (sub *serverSubscription) Accept(ctx context.Context, tx sip.ServerTransaction, state State) error {
+	if state != Active && state != Pending {
+		return fmt.Errorf("subscription can not be accepted in %s state", state)
+	}
+	if sub.State() != Init {
+		return fmt.Errorf("%s is already accepted", sub)
+	}
+
+	expires, res := sub.checkExpires(sub.request)
+	if res != nil {
+		_ = tx.Respond(res)
+		sub.terminate(SubscriptionState{State: Terminated, Reason: ReasonRejected})
+
+		return fmt.Errorf("subscription rejected with '%s'", res.Short())
+	}
+
+	res = newResponse(sub.request, 200, "OK")
+	if sub.config.Contact != nil {
+		res.AppendHeader(sub.config.Contact.Clone())
+	}
+	expiresHdr := sip.Expires(uint32(expires / time.Second))
+	res.AppendHeader(&expiresHdr)
+
+	sub.mu.Lock()
+	if sub.dlg == nil {
+		dlg, err := dialog.NewUASDialog(sub.request, res, sub.Log(), dialog.WithEventBus(sub.config.EventBus))
+		if err != nil {
+			sub.mu.Unlock()
+
+			return err
+		}
+		sub.dlg = dlg
+	} else if err := sub.dlg.ReceiveRequest(sub.request); err != nil {
+		sub.mu.Unlock()
+
+		return err
+	}
+	sub.dlg.AddUsage()
+	sub.state = state
+	sub.mu.Unlock()
+
+	if err := tx.Respond(res); err != nil {
+		sub.terminate(SubscriptionState{State: Terminated})
+
+		return err
+	}
+
+	sub.schedule(expires)
+
+	return sub.notifyCurrentState(ctx)
+}
+
+func (sub *serverSubscription) Reject(tx sip.ServerTransaction, code sip.StatusCode, reason string) error {
+	sub.terminate(SubscriptionState{State: Terminated, Reason: ReasonRejected})
+
+	return tx.Respond(newResponse(sub.request, code, reason))
+}
+
+func (sub *serverSubscription) HandleSubscribe(ctx context.Context, req sip.Request, tx sip.ServerTransaction) error {
+	dlg := sub.Dialog()
+	if dlg == nil || sub.State() == Terminated {
+		return tx.Respond(sip.NewResponseFromRequest("", req, 481, "Subscription Does Not Exist", ""))
+	}
+	if err := dlg.ReceiveRequest(req); err != nil {
+		_ = tx.Respond(sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""))
+
+		return err
+	}
+
+	expires, res := sub.checkExpires(req)
+	if res != nil {
+		return tx.Respond(res)
+	}
+
+	res = sip.NewResponseFromRequest("", req, 200, "OK", "")
+	if sub.config.Contact != nil {
+		res.AppendHeader(sub.config.Contact.Clone())
+	}
+	expiresHdr := sip.Expires(uint32(expires / time.Second))
+	res.AppendHeader(&expiresHdr)
+	if err := tx.Respond(res); err != nil {
+		return err
+	}
+
+	// RFC 6665 4.2.1.3. unsubscribe is answered with final NOTIFY
+	if expires == 0 {
+		return sub.Terminate(ctx, ReasonTimeout, 0)
+	}
+
+	sub.schedule(expires)
+
+	return sub.notifyCurrentState(ctx)
+}
+
+func (sub *serverSubscription) SetState(ctx context.Context, state State) error {
+	if state == Terminated {
+		return sub.Terminate(ctx, "", 0)
+	}
+
+	sub.mu.Lock()
+	sub.state = state
+	sub.mu.Unlock()
+
+	return sub.notifyCurrentState(ctx)
+}
+
+func (sub *serverSubscription) Notify(ctx context.Context, contentType, body string) error {
+	sub.mu.RLock()
+	ss := SubscriptionState{State: sub.state}
+	sub.mu.RUnlock()
+
+	if ss.State == Init || ss.State == Terminated {
+		return fmt.Errorf("NOTIFY can not be sent in %s state", ss.State)
+	}
+	ss.Expires = sub.Expires()
+
+	return sub.sendNotify(ctx, ss, contentType, body)
+}
+
+func (sub *serverSubscription) Terminate(ctx context.Context, reason string, retryAfter time.Duration) error {
+	if sub.State() == Terminated {
+		return nil
+	}
+
+	ss := SubscriptionState{State: Terminated, Reason: reason, RetryAfter: retryAfter}
+
+	var err error
+	if sub.State() != Init && sub.Dialog() != nil {
+		var contentType, body string
+		if sub.config.CurrentState != nil {
+			contentType, body = sub.config.CurrentState(sub)
+		}
+		err = sub.sendNotify(ctx, ss, contentType, body)
+	}
+
+	sub.terminate(ss)
+
+	return err
+}
+
+func (sub *serverSubscription) notifyCurrentState(ctx context.Context) error {
+	var contentType, body string
+	if sub.config.CurrentState != nil {
+		contentType, body = sub.config.CurrentState(sub)
+	}
+
+	return sub.Notify(ctx, contentType, body)
+}
+
+func (sub *serverSubscription) sendNotify(ctx context.Context, ss SubscriptionState, contentType, body string) error {
+	dlg := sub.Dialog()
+	if dlg == nil {
+		return fmt.Errorf("%s has no dialog", sub)
+	}
+
+	hdrs := []sip.Header{
+		sub.event.Header(),
+		ss.Header(),
+	}
+	if contentType != "" {
+		ct := sip.ContentType(contentType)
+		hdrs = append(hdrs, &ct)
+	}
+	for _, hdr := range sub.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	req, err := dlg.NewRequest(sip.NOTIFY, body, hdrs...)
+	if err != nil {
+		return err
+	}
+
+	_, err = sub.requester.RequestWithContext(ctx, req)
+	if err != nil {
+		// RFC 6665 4.2.2. 481 and other failures remove the subscription
+		if reqErr, ok := err.(*sip.RequestError); ok && (reqErr.Code == 481 || reqErr.Code == 408 || reqErr.Code >= 500) {
+			sub.terminate(SubscriptionState{State: Terminated, Reason: ReasonNoResource})
+		}
+	}
+
+	return err
+}
+
+// checkExpires returns granted subscription duration or the failure response.
+func (sub *serverSubscription) checkExpires(req sip.Request) (time.Duration, sip.Response) {
+	expires, ok := getExpires(req)
+	if !ok {
+		expires = sub.config.DefaultExpires
+	}
+	if expires > 0 && expires < sub.config.MinExpires {
+		res := newResponse(req, 423, "Interval Too Brief")
+		res.AppendHeader(&sip.GenericHeader{
+			HeaderName: "Min-Expires",
+			Contents:   fmt.Sprintf("%d", int(sub.config.MinExpires/time.Second)),
+		})
+
+		return 0, res
+	}
+	if expires > sub.config.MaxExpires {
+		expires = sub.config.MaxExpires
+	}
+
+	return expires, nil
+}
+
+func (sub *serverSubscription) schedule(expires time.Duration) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.state == Terminated {
+		return
+	}
+
+	sub.expiresAt = timing.Now().Add(expires)
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	sub.timer = timing.AfterFunc(expires, func() {
+		sub.Log().Debug("subscription expired")
+
+		if err := sub.Terminate(context.Background(), ReasonTimeout, 0); err != nil {
+			sub.Log().Warnf("send final NOTIFY failed: %s", err)
+		}
+	})
+}
+
+func (sub *serverSubscription) terminate(ss SubscriptionState) {
+	sub.terminateOnce.Do(func() {
+		sub.mu.Lock()
+		prev := sub.state
+		sub.state = Terminated
+		if sub.timer != nil {
+			sub.timer.Stop()
+			sub.timer = nil
+		}
+		dlg := sub.dlg
+		sub.mu.Unlock()
+
+		if dlg != nil && prev != Init {
+			dlg.ReleaseUsage()
+		}
+
+		close(sub.done)
+
+		sub.Log().Debugf("subscription terminated, reason '%s'", ss.Reason)
+
+		if sub.config.OnTerminate != nil {
+			sub.config.OnTerminate(sub, ss)
+		}
+	})
+}
+
+// newResponse builds response on the dialog creating request with To tag.
+func newResponse(req sip.Request, code sip.StatusCode, reason string) sip.Response {
+	res := sip.NewResponseFromRequest("", req, code, reason, "")
+	if to, ok := res.To(); ok && getTag(to.Params) == "" {
+		to := to.Clone().(*sip.ToHeader)
+		if to.Params == nil {
+			to.Params = sip.NewParams()
+		}
+		to.Params.Add("tag", sip.String{Str: util.RandString(8)})
+		res.ReplaceHeaders("To", []sip.Header{to})
+	}
+
+	return res
+}
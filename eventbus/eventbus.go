@@ -0,0 +1,237 @@
+// eventbus package delivers internal events of the SIP stack to subscribers,
+// so applications can react to lifecycle of connections, listeners, registrations, dialogs,
+// transactions and authentication without parsing logs.
+// Stack components publish events to the bus of the server, see gosip.WithEventBus, or to the Default bus.
+package eventbus
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Type is a type of the event.
+type Type string
+
+const (
+	ConnectionUp          Type = "connection.up"
+	ConnectionDown        Type = "connection.down"
+	ConnectionReconnected Type = "connection.reconnected"
+	ListenerFailed        Type = "listener.failed"
+	RegistrationExpired   Type = "registration.expired"
+	DialogCreated         Type = "dialog.created"
+	DialogTerminated      Type = "dialog.terminated"
+	TransactionTimeout    Type = "transaction.timeout"
+	AuthFailed            Type = "auth.failed"
+)
+
+// Event is published to the bus, concrete events are pointers to the event structs of this package.
+type Event interface {
+	Type() Type
+}
+
+// ConnectionUpEvent is published when the transport connection is opened or accepted.
+type ConnectionUpEvent struct {
+	Network    string
+	LocalAddr  string
+	RemoteAddr string
+}
+
+func (ev *ConnectionUpEvent) Type() Type { return ConnectionUp }
+
+// ConnectionDownEvent is published when the transport connection is closed.
+type ConnectionDownEvent struct {
+	Network    string
+	LocalAddr  string
+	RemoteAddr string
+}
+
+func (ev *ConnectionDownEvent) Type() Type { return ConnectionDown }
+
+// ConnectionReconnectedEvent is published when the broken outgoing connection is re-established by the transport,
+// it follows ConnectionUpEvent of the new connection.
+type ConnectionReconnectedEvent struct {
+	Network    string
+	LocalAddr  string
+	RemoteAddr string
+}
+
+func (ev *ConnectionReconnectedEvent) Type() Type { return ConnectionReconnected }
+
+// ListenerFailedEvent is published when the listener is broken and stops accepting connections.
+type ListenerFailedEvent struct {
+	Network string
+	Addr    string
+	Err     error
+}
+
+func (ev *ListenerFailedEvent) Type() Type { return ListenerFailed }
+
+// RegistrationExpiredEvent is published when the registrar removes expired binding of the AOR.
+type RegistrationExpiredEvent struct {
+	AOR     string
+	Contact *sip.ContactHeader
+	CallID  string
+}
+
+func (ev *RegistrationExpiredEvent) Type() Type { return RegistrationExpired }
+
+// DialogCreatedEvent is published when the dialog is created.
+type DialogCreatedEvent struct {
+	ID     string
+	CallID string
+	UAC    bool
+}
+
+func (ev *DialogCreatedEvent) Type() Type { return DialogCreated }
+
+// DialogTerminatedEvent is published when the dialog is terminated.
+type DialogTerminatedEvent struct {
+	ID     string
+	CallID string
+	UAC    bool
+}
+
+func (ev *DialogTerminatedEvent) Type() Type { return DialogTerminated }
+
+// TransactionTimeoutEvent is published when the transaction is timed out.
+type TransactionTimeoutEvent struct {
+	Key    string
+	Method sip.RequestMethod
+	Client bool
+}
+
+func (ev *TransactionTimeoutEvent) Type() Type { return TransactionTimeout }
+
+// AuthFailedEvent is published when the request is rejected because of wrong credentials,
+// requests without credentials are only challenged and don't fail.
+type AuthFailedEvent struct {
+	Request  sip.Request
+	Username string
+	Realm    string
+	Reason   string
+}
+
+func (ev *AuthFailedEvent) Type() Type { return AuthFailed }
+
+// DefaultQueueSize is the number of events queued for each subscription.
+const DefaultQueueSize = 1024
+
+// Handler receives events. Events of the subscription are delivered in order from its own goroutine,
+// so the slow handler delays only own events and never blocks the publisher.
+// Events published while the queue of the subscription is full are dropped.
+type Handler func(ev Event)
+
+type Bus interface {
+	// Publish queues the event to subscribers of its type, it does not block.
+	Publish(ev Event)
+	// Subscribe registers the handler of events of the types, events of all types are delivered if types are empty.
+	// Returned function cancels the subscription, queued events are discarded.
+	Subscribe(handler Handler, types ...Type) func()
+	// Dropped returns number of events dropped since queues of subscriptions were full.
+	Dropped() uint64
+}
+
+// Default is the bus where stack components publish events unless the bus is configured.
+var Default = NewBus()
+
+type subscription struct {
+	handler Handler
+	types   map[Type]bool
+	events  chan Event
+	done    chan struct{}
+}
+
+func (sub *subscription) deliver() {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case ev := <-sub.events:
+			select {
+			case <-sub.done:
+				return
+			default:
+			}
+			sub.handler(ev)
+		}
+	}
+}
+
+type bus struct {
+	mu sync.RWMutex
+	// subs is replaced on each change, so Publish iterates over the snapshot without lock
+	subs    []*subscription
+	size    int
+	dropped uint64
+}
+
+// NewBus creates event bus with queues of DefaultQueueSize events.
+func NewBus() Bus {
+	return NewBusSize(DefaultQueueSize)
+}
+
+// NewBusSize creates event bus with queues of the size.
+func NewBusSize(size int) Bus {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+
+	return &bus{size: size}
+}
+
+func (b *bus) Publish(ev Event) {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+
+	for _, sub := range subs {
+		if len(sub.types) == 0 || sub.types[ev.Type()] {
+			select {
+			case sub.events <- ev:
+			default:
+				atomic.AddUint64(&b.dropped, 1)
+			}
+		}
+	}
+}
+
+func (b *bus) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+func (b *bus) Subscribe(handler Handler, types ...Type) func() {
+	sub := &subscription{
+		handler: handler,
+		types:   make(map[Type]bool, len(types)),
+		events:  make(chan Event, b.size),
+		done:    make(chan struct{}),
+	}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	b.mu.Lock()
+	b.subs = append(append([]*subscription{}, b.subs...), sub)
+	b.mu.Unlock()
+
+	go sub.deliver()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			subs := make([]*subscription, 0, len(b.subs))
+			for _, s := range b.subs {
+				if s != sub {
+					subs = append(subs, s)
+				}
+			}
+			b.subs = subs
+			close(sub.done)
+		})
+	}
+}
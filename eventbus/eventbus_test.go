@@ -0,0 +1,90 @@
+package eventbus_test
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/eventbus"
+)
+
+// recorder collects events delivered to the handler.
+type recorder struct {
+	mu     sync.Mutex
+	events []eventbus.Event
+}
+
+func (r *recorder) handle(ev eventbus.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *recorder) Events() []eventbus.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]eventbus.Event(nil), r.events...)
+}
+
+var _ = Describe("Bus", func() {
+	var bus eventbus.Bus
+
+	BeforeEach(func() {
+		bus = eventbus.NewBus()
+	})
+
+	It("should deliver events of subscribed types until unsubscribe", func() {
+		all, dialogs := new(recorder), new(recorder)
+		unsubscribeAll := bus.Subscribe(all.handle)
+		unsubscribeDialogs := bus.Subscribe(dialogs.handle, eventbus.DialogCreated, eventbus.DialogTerminated)
+
+		created := &eventbus.DialogCreatedEvent{ID: "dialog-1", CallID: "call-1"}
+		up := &eventbus.ConnectionUpEvent{Network: "tcp", LocalAddr: "10.0.0.1:5060", RemoteAddr: "10.0.0.2:40000"}
+		bus.Publish(created)
+		bus.Publish(up)
+		Eventually(all.Events).Should(Equal([]eventbus.Event{created, up}))
+		Eventually(dialogs.Events).Should(Equal([]eventbus.Event{created}))
+
+		unsubscribeDialogs()
+		unsubscribeDialogs()
+		terminated := &eventbus.DialogTerminatedEvent{ID: "dialog-1", CallID: "call-1"}
+		bus.Publish(terminated)
+		Eventually(all.Events).Should(HaveLen(3))
+		Consistently(dialogs.Events, 50*time.Millisecond).Should(HaveLen(1))
+
+		unsubscribeAll()
+		bus.Publish(up)
+		Consistently(all.Events, 50*time.Millisecond).Should(HaveLen(3))
+	})
+
+	It("should not block the publisher on the slow handler", func() {
+		bus = eventbus.NewBusSize(2)
+		entered, release := make(chan struct{}, 1), make(chan struct{})
+		slow, fast := new(recorder), new(recorder)
+		defer bus.Subscribe(func(ev eventbus.Event) {
+			select {
+			case entered <- struct{}{}:
+			default:
+			}
+			<-release
+			slow.handle(ev)
+		})()
+		defer bus.Subscribe(fast.handle)()
+
+		bus.Publish(&eventbus.DialogCreatedEvent{ID: "dialog-1"})
+		Eventually(entered).Should(Receive())
+		for i := 2; i <= 5; i++ {
+			bus.Publish(&eventbus.DialogCreatedEvent{ID: "dialog-1"})
+			// the fast handler keeps up with the publisher
+			Eventually(fast.Events).Should(HaveLen(i))
+		}
+
+		// the first event is handled, 2 are queued and others are dropped
+		close(release)
+		Eventually(slow.Events).Should(HaveLen(3))
+		Consistently(slow.Events, 50*time.Millisecond).Should(HaveLen(3))
+		Expect(bus.Dropped()).To(Equal(uint64(2)))
+	})
+})
@@ -0,0 +1,302 @@
+package gosip
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// FailoverMode is the order resolved targets of the request are attempted in.
+type FailoverMode int
+
+const (
+	// FailoverSerial tries targets one by one in the order of the lookup - RFC 3263 4.3.
+	FailoverSerial FailoverMode = iota
+	// FailoverParallel sends the request to all targets of the same SRV priority at once,
+	// the first target that responds wins and requests to other targets are canceled.
+	// Targets of the next priority are tried only if all targets of the priority fail.
+	// Since requests to losers may be answered before they are canceled, it suits requests
+	// without side effects, like OPTIONS or REGISTER, better than INVITE.
+	FailoverParallel
+	// FailoverWeighted tries targets one by one, targets of the same SRV priority are ordered
+	// by the weighted random selection - RFC 2782 on each request, so requests are spread by SRV weights.
+	FailoverWeighted
+)
+
+func (mode FailoverMode) String() string {
+	switch mode {
+	case FailoverSerial:
+		return "serial"
+	case FailoverParallel:
+		return "parallel"
+	case FailoverWeighted:
+		return "weighted"
+	default:
+		return fmt.Sprintf("FailoverMode(%d)", int(mode))
+	}
+}
+
+// FailoverPolicy controls how resolved targets of the request are attempted.
+type FailoverPolicy struct {
+	Mode FailoverMode
+	// AttemptTimeout moves to the next target if the target does not respond in time,
+	// instead of waiting for the transaction timeout that is 32 seconds with default timers.
+	// The attempt is not limited once the target responds, even provisionally. Zero disables it.
+	AttemptTimeout time.Duration
+}
+
+// FailoverTimeoutError is the error of the attempt that was not responded within FailoverPolicy.AttemptTimeout.
+type FailoverTimeoutError struct {
+	Target         string
+	AttemptTimeout time.Duration
+}
+
+func (err *FailoverTimeoutError) Timeout() bool   { return true }
+func (err *FailoverTimeoutError) Temporary() bool { return true }
+func (err *FailoverTimeoutError) Error() string {
+	return fmt.Sprintf("target %s did not respond in %s", err.Target, err.AttemptTimeout)
+}
+
+// RFC 3263 - 4.3. Tries resolved targets by the policy
+// until the request is completed without 503 response, transport error or timeout.
+func (srv *server) requestWithFailover(
+	ctx context.Context,
+	request sip.Request,
+	policy FailoverPolicy,
+	options ...RequestWithContextOption,
+) (sip.Response, error) {
+	uri := requestTargetUri(request)
+	if uri == nil {
+		return srv.requestToDestination(ctx, request, options...)
+	}
+
+	targets, err := transport.LookupTargets(ctx, srv.dnsResolver, request.Transport(), uri.FHost, uri.FPort)
+	if err != nil && srv.observer != nil {
+		srv.observer.DNSFailure(err)
+	}
+	if err != nil || len(targets) == 0 {
+		return srv.requestToDestination(ctx, request, options...)
+	}
+
+	if srv.breakers != nil {
+		srv.breakers.countRequest()
+	}
+
+	var groups [][]*transport.Target
+	switch policy.Mode {
+	case FailoverParallel:
+		groups = priorityGroups(targets)
+	case FailoverWeighted:
+		for _, group := range priorityGroups(targets) {
+			for _, target := range weightedOrder(group) {
+				groups = append(groups, []*transport.Target{target})
+			}
+		}
+	default:
+		for _, target := range targets {
+			groups = append(groups, []*transport.Target{target})
+		}
+	}
+
+	var res sip.Response
+	for i, group := range groups {
+		if i > 0 && srv.breakers != nil && !srv.breakers.allowRetry() {
+			srv.Log().WithFields(request.Fields()).Debugf("retry budget is exhausted, skip target %s", group[0].Addr())
+
+			return res, err
+		}
+
+		res, err = srv.raceTargets(ctx, request, group, policy.AttemptTimeout, options...)
+		if err == nil || ctx.Err() != nil || !isFailoverError(err) {
+			return res, err
+		}
+
+		if i < len(groups)-1 {
+			srv.Log().WithFields(request.Fields()).Debugf(
+				"request to %s failed, trying next target %s: %s",
+				group[0].Addr(),
+				groups[i+1][0].Addr(),
+				err,
+			)
+		}
+	}
+
+	return res, err
+}
+
+// raceTargets sends the request to all targets at once, the first target that responds
+// or completes the request without the failover error wins and requests to others are canceled.
+func (srv *server) raceTargets(
+	ctx context.Context,
+	request sip.Request,
+	targets []*transport.Target,
+	timeout time.Duration,
+	options ...RequestWithContextOption,
+) (sip.Response, error) {
+	if len(targets) == 1 {
+		return srv.attemptTarget(ctx, request, targets[0], timeout, nil, options...)
+	}
+
+	type result struct {
+		res sip.Response
+		err error
+	}
+
+	cancels := make([]context.CancelFunc, len(targets))
+	attemptCtxs := make([]context.Context, len(targets))
+	for i := range targets {
+		attemptCtxs[i], cancels[i] = context.WithCancel(ctx)
+	}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	// winner is the index of the winner plus one
+	var winner int32
+	win := func(i int) {
+		if !atomic.CompareAndSwapInt32(&winner, 0, int32(i+1)) {
+			return
+		}
+		for j, cancel := range cancels {
+			if j != i {
+				cancel()
+			}
+		}
+	}
+
+	results := make([]result, len(targets))
+	wg := sync.WaitGroup{}
+	wg.Add(len(targets))
+	for i, target := range targets {
+		go func(i int, target *transport.Target) {
+			defer wg.Done()
+
+			res, err := srv.attemptTarget(attemptCtxs[i], request, target, timeout, func() { win(i) }, options...)
+			if err == nil || !isFailoverError(err) {
+				win(i)
+			}
+			results[i] = result{res, err}
+		}(i, target)
+	}
+	wg.Wait()
+
+	if i := int(atomic.LoadInt32(&winner)) - 1; i >= 0 {
+		return results[i].res, results[i].err
+	}
+
+	last := results[len(results)-1]
+	return last.res, last.err
+}
+
+// attemptTarget sends the copy of the request to the target,
+// responded is called on the first response to the attempt.
+func (srv *server) attemptTarget(
+	ctx context.Context,
+	request sip.Request,
+	target *transport.Target,
+	timeout time.Duration,
+	responded func(),
+	options ...RequestWithContextOption,
+) (sip.Response, error) {
+	req := sip.CopyRequest(request)
+	req.SetDestination(target.Addr())
+	if viaHop, ok := req.ViaHop(); ok && viaHop.Params != nil && viaHop.Params.Has("branch") {
+		viaHop.Params.Add("branch", sip.String{Str: sip.GenerateBranch()})
+	}
+
+	if timeout <= 0 && responded == nil {
+		return srv.requestToDestination(ctx, req, options...)
+	}
+
+	optionsHash := &RequestWithContextOptions{}
+	for _, opt := range options {
+		opt.ApplyRequestWithContext(optionsHash)
+	}
+	handler := optionsHash.ResponseHandler
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var state int32 // 1 - responded, 2 - timed out
+	options = append(options[:len(options):len(options)], WithResponseHandler(func(res sip.Response, request sip.Request) {
+		if atomic.CompareAndSwapInt32(&state, 0, 1) && responded != nil {
+			responded()
+		}
+		if handler != nil {
+			handler(res, request)
+		}
+	}))
+	if timeout > 0 {
+		timer := timing.AfterFunc(timeout, func() {
+			if atomic.CompareAndSwapInt32(&state, 0, 2) {
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+
+	res, err := srv.requestToDestination(attemptCtx, req, options...)
+	if atomic.LoadInt32(&state) == 2 && ctx.Err() == nil {
+		return nil, &FailoverTimeoutError{Target: target.Addr(), AttemptTimeout: timeout}
+	}
+
+	return res, err
+}
+
+// priorityGroups splits targets ordered by SRV priority to groups of the same priority.
+func priorityGroups(targets []*transport.Target) [][]*transport.Target {
+	groups := make([][]*transport.Target, 0)
+	for i, target := range targets {
+		if i == 0 || target.Priority != targets[i-1].Priority {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], target)
+	}
+
+	return groups
+}
+
+// weightedOrder orders targets of the same priority by the weighted random selection - RFC 2782.
+func weightedOrder(targets []*transport.Target) []*transport.Target {
+	left := make([]*transport.Target, 0, len(targets))
+	// targets with zero weight go first, so they are selected only by zero
+	for _, target := range targets {
+		if target.Weight == 0 {
+			left = append(left, target)
+		}
+	}
+	for _, target := range targets {
+		if target.Weight > 0 {
+			left = append(left, target)
+		}
+	}
+
+	ordered := make([]*transport.Target, 0, len(targets))
+	for len(left) > 0 {
+		sum := 0
+		for _, target := range left {
+			sum += int(target.Weight)
+		}
+		n := rand.Intn(sum + 1)
+		i := 0
+		for running := 0; i < len(left)-1; i++ {
+			running += int(left[i].Weight)
+			if running >= n {
+				break
+			}
+		}
+		ordered = append(ordered, left[i])
+		left = append(left[:i], left[i+1:]...)
+	}
+
+	return ordered
+}
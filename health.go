@@ -0,0 +1,282 @@
+package gosip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+const DefaultHealthDNSTimeout = 2 * time.Second
+
+// HealthConfig describes thresholds of the readiness check.
+type HealthConfig struct {
+	// DNSName is resolved by the readiness check to verify DNS resolver, empty name disables the check.
+	DNSName string
+	// DNSTimeout is a timeout of the DNS check, default is DefaultHealthDNSTimeout.
+	DNSTimeout time.Duration
+	// MaxConnections is a saturation limit of open transport connections, zero disables the check.
+	MaxConnections int
+	// MaxTransactions is a limit of the transaction backlog, zero disables the check.
+	MaxTransactions int
+}
+
+// HealthCheck is a result of the single check of the server.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Details string `json:"details,omitempty"`
+}
+
+// HealthReport is a result of the liveness or readiness check, it is OK when all checks are OK.
+type HealthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+func newHealthReport(checks ...HealthCheck) HealthReport {
+	report := HealthReport{
+		OK:     true,
+		Checks: checks,
+	}
+	for _, check := range checks {
+		if !check.OK {
+			report.OK = false
+		}
+	}
+
+	return report
+}
+
+// listenerStatus tracks the listener started by the server,
+// runtime failures are received from the event bus of the server and matched by the network and the local address,
+// so events of sockets of other servers in the process are ignored.
+type listenerStatus struct {
+	network string
+	addr    string
+	// local is the local address of the listener socket, see localAddrKey
+	local string
+	err   error
+}
+
+// localAddrKey normalizes the local address of the socket, unspecified hosts like "0.0.0.0" and "[::]" are equal.
+func localAddrKey(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			host = ""
+		} else {
+			host = ip.String()
+		}
+	}
+
+	return net.JoinHostPort(strings.ToLower(host), port), true
+}
+
+type listenerStatuses struct {
+	mu        sync.RWMutex
+	listeners []*listenerStatus
+}
+
+func (ls *listenerStatuses) add(network, addr string) {
+	target, err := transport.NewTargetFromAddr(addr)
+	if err != nil {
+		return
+	}
+	target = transport.FillTargetHostAndPort(network, target)
+	local, ok := localAddrKey(target.Addr())
+	if !ok {
+		return
+	}
+
+	ls.mu.Lock()
+	ls.listeners = append(ls.listeners, &listenerStatus{
+		network: strings.ToLower(network),
+		addr:    target.Addr(),
+		local:   local,
+	})
+	ls.mu.Unlock()
+}
+
+func (ls *listenerStatuses) remove(network, addr string) {
+	target, err := transport.NewTargetFromAddr(addr)
+	if err != nil {
+		return
+	}
+	target = transport.FillTargetHostAndPort(network, target)
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for i, listener := range ls.listeners {
+		if listener.network == strings.ToLower(network) && listener.addr == target.Addr() {
+			ls.listeners = append(ls.listeners[:i:i], ls.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func (ls *listenerStatuses) fail(network, addr string, err error) {
+	local, ok := localAddrKey(addr)
+	if !ok {
+		return
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for _, listener := range ls.listeners {
+		if listener.network == strings.ToLower(network) && listener.local == local && listener.err == nil {
+			listener.err = err
+		}
+	}
+}
+
+func (ls *listenerStatuses) onEvent(ev eventbus.Event) {
+	switch ev := ev.(type) {
+	case *eventbus.ListenerFailedEvent:
+		ls.fail(ev.Network, ev.Addr, ev.Err)
+	case *eventbus.ConnectionDownEvent:
+		// UDP listener is a connection without remote address,
+		// listeners closed by the server are removed before close, so their events match nothing
+		if ev.RemoteAddr == "" {
+			ls.fail(ev.Network, ev.LocalAddr, fmt.Errorf("socket closed"))
+		}
+	}
+}
+
+func (ls *listenerStatuses) check() HealthCheck {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	check := HealthCheck{Name: "listeners", OK: len(ls.listeners) > 0}
+	if len(ls.listeners) == 0 {
+		check.Details = "no listeners"
+		return check
+	}
+
+	details := make([]string, 0, len(ls.listeners))
+	for _, listener := range ls.listeners {
+		if listener.err != nil {
+			check.OK = false
+			details = append(details, fmt.Sprintf("%s %s failed: %s", listener.network, listener.addr, listener.err))
+		} else {
+			details = append(details, fmt.Sprintf("%s %s up", listener.network, listener.addr))
+		}
+	}
+	check.Details = strings.Join(details, "; ")
+
+	return check
+}
+
+// Health reports liveness of the server: the server and its transport and transaction layers are running.
+func (srv *server) Health() HealthReport {
+	return newHealthReport(srv.livenessChecks()...)
+}
+
+func (srv *server) livenessChecks() []HealthCheck {
+	checks := []HealthCheck{
+		{Name: "server", OK: srv.running.IsSet()},
+		{Name: "transport", OK: !isDone(srv.tp.Done())},
+		{Name: "transaction", OK: !isDone(srv.tx.Done())},
+	}
+	if !checks[0].OK {
+		checks[0].Details = "server is stopped"
+	}
+
+	return checks
+}
+
+// Ready reports readiness of the server to handle traffic: liveness, draining, listeners,
+// DNS resolver, connection pool saturation and transaction backlog.
+func (srv *server) Ready() HealthReport {
+	checks := srv.livenessChecks()
+
+	draining := HealthCheck{Name: "draining", OK: !srv.draining.IsSet()}
+	if !draining.OK {
+		draining.Details = "server is draining"
+	}
+	checks = append(checks, draining, srv.listeners.check())
+
+	if srv.health.DNSName != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), srv.health.DNSTimeout)
+		_, err := srv.dnsResolver.LookupHost(ctx, srv.health.DNSName)
+		cancel()
+
+		dns := HealthCheck{Name: "dns", OK: err == nil}
+		if err != nil {
+			dns.Details = err.Error()
+		}
+		checks = append(checks, dns)
+	}
+
+	var connections int
+	if counter, ok := srv.tp.(transport.ConnectionCounter); ok {
+		for _, count := range counter.OpenConnections() {
+			connections += count
+		}
+	}
+	checks = append(checks, limitCheck("connections", connections, srv.health.MaxConnections))
+	checks = append(checks, limitCheck("transactions", srv.tx.Count(), srv.health.MaxTransactions))
+
+	return newHealthReport(checks...)
+}
+
+// limitCheck fails when the value reaches the limit, zero limit only reports the value.
+func limitCheck(name string, value, limit int) HealthCheck {
+	if limit <= 0 {
+		return HealthCheck{Name: name, OK: true, Details: fmt.Sprint(value)}
+	}
+
+	return HealthCheck{
+		Name:    name,
+		OK:      value < limit,
+		Details: fmt.Sprintf("%d of %d", value, limit),
+	}
+}
+
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewHealthHandler creates HTTP handler of the server probes, like Kubernetes liveness and readiness probes.
+// It serves '/healthz' with Health and '/readyz' with Ready reports in JSON,
+// the status is '200 OK' when the report is OK and '503 Service Unavailable' otherwise.
+func NewHealthHandler(srv Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, srv.Health())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, srv.Ready())
+	})
+
+	return mux
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.OK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(report)
+}
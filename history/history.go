@@ -0,0 +1,325 @@
+// history package keeps the last messages of recent calls in memory, so operators dump the signaling ladder
+// of the failed call without full packet capture. Store implements gosip.Observer,
+// so it is passed to gosip.ServerConfig directly or with gosip.Observers, NewHandler serves it over HTTP.
+package history
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/redact"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const (
+	DefaultMaxMessages = 50
+	DefaultMaxCalls    = 1000
+	DefaultTimeFormat  = "2006/01/02 15:04:05.000000"
+)
+
+const (
+	Received = "received"
+	Sent     = "sent"
+)
+
+// Config describes history options.
+type Config struct {
+	// MaxMessages is the number of the last messages kept per call, default is DefaultMaxMessages.
+	MaxMessages int
+	// MaxCalls limits the number of calls, calls with the oldest messages are evicted first,
+	// default is DefaultMaxCalls.
+	MaxCalls int
+	// MaxAge evicts calls without messages for the duration, zero keeps calls until they are evicted by MaxCalls.
+	MaxAge time.Duration
+}
+
+// Entry is the message of the call.
+type Entry struct {
+	Time        time.Time `json:"time"`
+	Direction   string    `json:"direction"`
+	Transport   string    `json:"transport"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	// Short is the start line of the message, like "INVITE sip:bob@example.com SIP/2.0".
+	Short string `json:"short"`
+	// Message is the full message redacted by the current policy of redact package.
+	Message string `json:"message"`
+}
+
+// Call describes the call in the history.
+type Call struct {
+	CallID string    `json:"call_id"`
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+	// Messages is the number of messages of the call including dropped from the history.
+	Messages int `json:"messages"`
+}
+
+// Store keeps the last messages of calls.
+type Store interface {
+	gosip.Observer
+	// Calls returns calls in the history, the most recent first.
+	Calls() []Call
+	// Messages returns the kept messages of the call in order.
+	Messages(callID string) ([]Entry, bool)
+	// Dump writes messages of the call in ngrep-like format of siptrace package.
+	Dump(w io.Writer, callID string) error
+	// Clear removes all calls.
+	Clear()
+}
+
+type call struct {
+	Call
+	// entries is the ring buffer, next is the index of the oldest entry when the buffer is full.
+	entries []Entry
+	next    int
+	// elem is the element of the call in the LRU list
+	elem *list.Element
+}
+
+type store struct {
+	maxMessages int
+	maxCalls    int
+	maxAge      time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*call
+	// lru orders calls by the last message, the most recent first
+	lru *list.List
+}
+
+// NewStore creates message history.
+func NewStore(config Config) Store {
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = DefaultMaxMessages
+	}
+	if config.MaxCalls <= 0 {
+		config.MaxCalls = DefaultMaxCalls
+	}
+
+	return &store{
+		maxMessages: config.MaxMessages,
+		maxCalls:    config.MaxCalls,
+		maxAge:      config.MaxAge,
+		calls:       make(map[string]*call),
+		lru:         list.New(),
+	}
+}
+
+func (s *store) MessageReceived(msg sip.Message) {
+	s.add(msg, Received, msg.Source(), msg.Destination())
+}
+
+func (s *store) MessageSent(msg sip.Message) {
+	src := msg.Source()
+	if src == "" {
+		// sent-by of the outgoing request is filled by the transport layer
+		if viaHop, ok := msg.ViaHop(); ok {
+			src = viaHop.Host
+			if viaHop.Port != nil {
+				src = fmt.Sprintf("%s:%d", src, *viaHop.Port)
+			}
+		}
+	}
+
+	s.add(msg, Sent, src, msg.Destination())
+}
+
+func (s *store) Retransmission(msg sip.Message) {}
+
+func (s *store) TransactionCompleted(method sip.RequestMethod, client bool, duration time.Duration) {}
+
+func (s *store) ParseError(err error) {}
+
+func (s *store) DNSFailure(err error) {}
+
+func (s *store) add(msg sip.Message, direction, src, dest string) {
+	callID, ok := msg.CallID()
+	if !ok {
+		return
+	}
+
+	now := timing.Now()
+	entry := Entry{
+		Time:        now,
+		Direction:   direction,
+		Transport:   msg.Transport(),
+		Source:      src,
+		Destination: dest,
+		Short:       msg.StartLine(),
+		Message:     redact.CurrentPolicy().Redact(msg.String()),
+	}
+	key := callID.Value()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.calls[key]
+	if !ok {
+		s.evict(now)
+		c = &call{
+			Call:    Call{CallID: key, First: now},
+			entries: make([]Entry, 0, s.maxMessages),
+		}
+		c.elem = s.lru.PushFront(c)
+		s.calls[key] = c
+	} else {
+		s.lru.MoveToFront(c.elem)
+	}
+	c.Last = now
+	c.Messages++
+	if len(c.entries) < s.maxMessages {
+		c.entries = append(c.entries, entry)
+	} else {
+		c.entries[c.next] = entry
+		c.next = (c.next + 1) % s.maxMessages
+	}
+}
+
+// evict removes expired calls and the oldest call when the history is full, it must be called under lock.
+func (s *store) evict(now time.Time) {
+	for elem := s.lru.Back(); elem != nil; elem = s.lru.Back() {
+		c := elem.Value.(*call)
+		if len(s.calls) < s.maxCalls && (s.maxAge <= 0 || now.Sub(c.Last) <= s.maxAge) {
+			return
+		}
+
+		s.lru.Remove(elem)
+		delete(s.calls, c.CallID)
+	}
+}
+
+// lookup returns the call if it is not expired, it must be called under lock.
+func (s *store) lookup(callID string) (*call, bool) {
+	c, ok := s.calls[callID]
+	if !ok || (s.maxAge > 0 && timing.Now().Sub(c.Last) > s.maxAge) {
+		return nil, false
+	}
+
+	return c, true
+}
+
+func (s *store) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	calls := make([]Call, 0, len(s.calls))
+	for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+		c := elem.Value.(*call)
+		if _, ok := s.lookup(c.CallID); !ok {
+			// the rest of calls are older
+			break
+		}
+		calls = append(calls, c.Call)
+	}
+
+	return calls
+}
+
+func (s *store) Messages(callID string) ([]Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.lookup(callID)
+	if !ok {
+		return nil, false
+	}
+
+	entries := make([]Entry, 0, len(c.entries))
+	entries = append(entries, c.entries[c.next:]...)
+	entries = append(entries, c.entries[:c.next]...)
+
+	return entries, true
+}
+
+func (s *store) Dump(w io.Writer, callID string) error {
+	entries, ok := s.Messages(callID)
+	if !ok {
+		return fmt.Errorf("call %s not found", callID)
+	}
+
+	for _, entry := range entries {
+		if _, err := io.WriteString(w, format(entry)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *store) Clear() {
+	s.mu.Lock()
+	s.calls = make(map[string]*call)
+	s.lru.Init()
+	s.mu.Unlock()
+}
+
+// format prints the entry with header line like siptrace.Sink.
+func format(entry Entry) string {
+	tp := entry.Transport
+	if tp == "" {
+		tp = "?"
+	}
+	arrow := "<<<"
+	if entry.Direction == Sent {
+		arrow = ">>>"
+	}
+
+	return fmt.Sprintf("%s %s %s -> %s %s %s\n%s\n\n",
+		strings.ToUpper(tp[:1]),
+		entry.Time.Format(DefaultTimeFormat),
+		entry.Source,
+		entry.Destination,
+		arrow,
+		entry.Direction,
+		strings.TrimRight(strings.ReplaceAll(entry.Message, "\r\n", "\n"), "\n"),
+	)
+}
+
+// NewHandler creates HTTP handler of the history, it is mounted with http.StripPrefix, like at "/debug/sip/calls/".
+// It serves the list of calls in JSON at the root and messages of the call at "/<call-id>",
+// in JSON or in ngrep-like text with "?format=text".
+func NewHandler(s Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		callID := strings.TrimPrefix(r.URL.Path, "/")
+		if callID == "" {
+			writeJSON(w, s.Calls())
+			return
+		}
+
+		entries, ok := s.Messages(callID)
+		if !ok {
+			http.Error(w, fmt.Sprintf("call %s not found", callID), http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, entry := range entries {
+				_, _ = io.WriteString(w, format(entry))
+			}
+			return
+		}
+
+		writeJSON(w, entries)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
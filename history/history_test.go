@@ -0,0 +1,164 @@
+package history_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/history"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		clock  timing.FakeClock
+		store  history.Store
+		config history.Config
+	)
+
+	request := func(method sip.RequestMethod, callID string) sip.Request {
+		req := testutils.Request([]string{
+			string(method) + " sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: " + callID,
+			"CSeq: 1 " + string(method),
+			"",
+			"",
+		})
+		req.SetTransport("UDP")
+		req.SetSource("10.0.0.1:5060")
+		req.SetDestination("10.0.0.2:5060")
+
+		return req
+	}
+
+	BeforeEach(func() {
+		clock = timing.NewFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+		timing.SetClock(clock)
+		config = history.Config{MaxMessages: 3, MaxCalls: 2}
+	})
+
+	JustBeforeEach(func() {
+		store = history.NewStore(config)
+	})
+
+	AfterEach(func() {
+		timing.SetClock(nil)
+	})
+
+	It("should keep the last messages of the call in order", func() {
+		invite := request(sip.INVITE, "call-1")
+		store.MessageReceived(invite)
+		clock.Advance(time.Second)
+		store.MessageSent(sip.NewResponseFromRequest("", invite, 100, "Trying", ""))
+		store.MessageSent(sip.NewResponseFromRequest("", invite, 180, "Ringing", ""))
+		clock.Advance(time.Second)
+		store.MessageSent(sip.NewResponseFromRequest("", invite, 486, "Busy Here", ""))
+
+		entries, ok := store.Messages("call-1")
+		Expect(ok).To(BeTrue())
+		Expect(entries).To(HaveLen(3))
+		Expect(entries[0].Short).To(Equal("SIP/2.0 100 Trying"))
+		Expect(entries[0].Direction).To(Equal(history.Sent))
+		Expect(entries[2].Short).To(Equal("SIP/2.0 486 Busy Here"))
+
+		calls := store.Calls()
+		Expect(calls).To(HaveLen(1))
+		Expect(calls[0].Messages).To(Equal(4))
+		Expect(calls[0].Last.Sub(calls[0].First)).To(Equal(2 * time.Second))
+
+		out := new(bytes.Buffer)
+		Expect(store.Dump(out, "call-1")).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(">>> sent\nSIP/2.0 486 Busy Here\n"))
+		Expect(store.Dump(out, "call-2")).ToNot(Succeed())
+	})
+
+	It("should evict the oldest call", func() {
+		store.MessageReceived(request(sip.INVITE, "call-1"))
+		clock.Advance(time.Second)
+		store.MessageReceived(request(sip.INVITE, "call-2"))
+		clock.Advance(time.Second)
+		store.MessageReceived(request(sip.BYE, "call-1"))
+		clock.Advance(time.Second)
+		store.MessageReceived(request(sip.INVITE, "call-3"))
+
+		_, ok := store.Messages("call-2")
+		Expect(ok).To(BeFalse())
+		calls := store.Calls()
+		Expect(calls).To(HaveLen(2))
+		Expect(calls[0].CallID).To(Equal("call-3"))
+		Expect(calls[1].CallID).To(Equal("call-1"))
+
+		store.Clear()
+		Expect(store.Calls()).To(BeEmpty())
+	})
+
+	Context("with max age", func() {
+		BeforeEach(func() {
+			config.MaxAge = time.Minute
+		})
+
+		It("should expire idle calls", func() {
+			store.MessageReceived(request(sip.INVITE, "call-1"))
+			clock.Advance(2 * time.Minute)
+			_, ok := store.Messages("call-1")
+			Expect(ok).To(BeFalse())
+			Expect(store.Calls()).To(BeEmpty())
+		})
+
+		It("should evict idle calls before recent ones", func() {
+			store.MessageReceived(request(sip.INVITE, "call-1"))
+			store.MessageReceived(request(sip.INVITE, "call-2"))
+			clock.Advance(2 * time.Minute)
+			store.MessageReceived(request(sip.INVITE, "call-3"))
+			store.MessageReceived(request(sip.INVITE, "call-4"))
+
+			calls := store.Calls()
+			Expect(calls).To(HaveLen(2))
+			Expect(calls[0].CallID).To(Equal("call-4"))
+			Expect(calls[1].CallID).To(Equal("call-3"))
+		})
+	})
+
+	It("should serve calls over HTTP", func() {
+		store.MessageReceived(request(sip.INVITE, "call-1"))
+		handler := history.NewHandler(store)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		Expect(rec.Code).To(Equal(200))
+		var calls []history.Call
+		Expect(json.Unmarshal(rec.Body.Bytes(), &calls)).To(Succeed())
+		Expect(calls).To(HaveLen(1))
+		Expect(calls[0].CallID).To(Equal("call-1"))
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/call-1", nil))
+		Expect(rec.Code).To(Equal(200))
+		var entries []history.Entry
+		Expect(json.Unmarshal(rec.Body.Bytes(), &entries)).To(Succeed())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Source).To(Equal("10.0.0.1:5060"))
+		Expect(entries[0].Message).To(ContainSubstring("Call-ID: call-1"))
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/call-1?format=text", nil))
+		Expect(rec.Body.String()).To(HavePrefix("U 2020/01/01 12:00:00.000000 10.0.0.1:5060 -> 10.0.0.2:5060 <<< received\n"))
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/call-2", nil))
+		Expect(rec.Code).To(Equal(404))
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("DELETE", "/", nil))
+		Expect(rec.Code).To(Equal(405))
+	})
+})
@@ -0,0 +1,522 @@
+// hmr package implements header manipulation rules of SBC-like deployments, like HMR of session border controllers.
+// Rules add, remove and replace headers and URI params of messages matched by method, direction and peer,
+// they are loaded from the JSON config, so interop fixes are deployed without recompiling.
+// Incoming requests and responses on them are manipulated by the Middleware of gosip.Mux,
+// outgoing requests are manipulated by Apply, like by OnRequest of b2bua.Config.
+package hmr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// Direction of the message relative to the server.
+type Direction string
+
+const (
+	// Inbound messages are received from peers.
+	Inbound Direction = "inbound"
+	// Outbound messages are sent to peers.
+	Outbound Direction = "outbound"
+)
+
+// Operation of the action.
+type Operation string
+
+const (
+	// Add adds the header with the value, the header is not added if the message already has it.
+	Add Operation = "add"
+	// Remove removes all headers of the name.
+	Remove Operation = "remove"
+	// Replace replaces values of headers of the name, matches of the pattern are replaced if the pattern is set,
+	// otherwise all headers of the name are replaced by the single header with the value.
+	Replace Operation = "replace"
+	// SetParam sets the param of the URI.
+	SetParam Operation = "set-param"
+	// RemoveParam removes the param of the URI.
+	RemoveParam Operation = "remove-param"
+)
+
+// URI targets of param operations.
+const (
+	RequestUri = "request-uri"
+	FromUri    = "from"
+	ToUri      = "to"
+	ContactUri = "contact"
+)
+
+// Match selects messages the rule is applied to, empty fields match all messages.
+type Match struct {
+	// Methods are methods of requests and methods of CSeq of responses.
+	Methods   []string  `json:"methods,omitempty"`
+	Direction Direction `json:"direction,omitempty"`
+	// Peers lists networks of peers in CIDR notation or single IP addresses.
+	Peers []string `json:"peers,omitempty"`
+	// StatusCodes match responses with the codes only, requests are not matched if they are set.
+	StatusCodes []sip.StatusCode `json:"status_codes,omitempty"`
+	// Header matches messages with the header, its value must match Pattern if it is set.
+	Header  string `json:"header,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Action manipulates the message.
+type Action struct {
+	Operation Operation `json:"operation"`
+	// Header is the name of the header of header operations.
+	Header string `json:"header,omitempty"`
+	// Uri is the URI of param operations, one of RequestUri, FromUri, ToUri or ContactUri.
+	Uri   string `json:"uri,omitempty"`
+	Param string `json:"param,omitempty"`
+	// Value is the value of the header or the param, Replace expands submatches of Pattern in it like $1.
+	Value string `json:"value,omitempty"`
+	// Pattern is the regular expression of Replace.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Rule applies actions to matched messages.
+type Rule struct {
+	// Name of the rule is logged with manipulated messages.
+	Name    string   `json:"name"`
+	Match   Match    `json:"match"`
+	Actions []Action `json:"actions"`
+}
+
+// Config describes header manipulation rules, they are applied in order.
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadConfig reads the JSON config, unknown fields are rejected to catch typos of rules.
+func LoadConfig(r io.Reader) (Config, error) {
+	var config Config
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, fmt.Errorf("decode header manipulation rules: %w", err)
+	}
+
+	return config, nil
+}
+
+// LoadConfigFile reads the JSON config from the file.
+func LoadConfigFile(path string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer file.Close()
+
+	return LoadConfig(file)
+}
+
+// Engine applies header manipulation rules.
+type Engine interface {
+	// Apply applies rules matched by the message of the direction, returns the number of applied rules.
+	Apply(msg sip.Message, direction Direction) int
+	// Middleware applies Inbound rules to requests before the handler and Outbound rules to responses written by it.
+	Middleware() gosip.Middleware
+	// Reload replaces rules, the current rules are kept if the config is invalid.
+	Reload(config Config) error
+}
+
+type action struct {
+	Action
+	pattern *regexp.Regexp
+}
+
+type rule struct {
+	name    string
+	match   Match
+	methods map[string]bool
+	peers   []*net.IPNet
+	pattern *regexp.Regexp
+	actions []action
+}
+
+type engine struct {
+	mu    sync.RWMutex
+	rules []*rule
+
+	log log.Logger
+}
+
+// NewEngine creates header manipulation engine of rules.
+func NewEngine(config Config, logger log.Logger) (Engine, error) {
+	e := &engine{}
+	if err := e.Reload(config); err != nil {
+		return nil, err
+	}
+	e.log = logger.
+		WithPrefix("hmr.Engine").
+		WithFields(log.Fields{
+			"engine_ptr": fmt.Sprintf("%p", e),
+		})
+
+	return e, nil
+}
+
+func (e *engine) Log() log.Logger {
+	return e.log
+}
+
+func (e *engine) Reload(config Config) error {
+	rules := make([]*rule, 0, len(config.Rules))
+	for i, r := range config.Rules {
+		compiled, err := compileRule(r)
+		if err != nil {
+			return fmt.Errorf("rule %d %q: %w", i, r.Name, err)
+		}
+		rules = append(rules, compiled)
+	}
+
+	e.mu.Lock()
+	e.rules = rules
+	e.mu.Unlock()
+
+	return nil
+}
+
+func compileRule(r Rule) (*rule, error) {
+	compiled := &rule{name: r.Name, match: r.Match}
+
+	switch r.Match.Direction {
+	case "", Inbound, Outbound:
+	default:
+		return nil, fmt.Errorf("invalid direction %q", r.Match.Direction)
+	}
+	if len(r.Match.Methods) > 0 {
+		compiled.methods = make(map[string]bool, len(r.Match.Methods))
+		for _, method := range r.Match.Methods {
+			compiled.methods[strings.ToUpper(method)] = true
+		}
+	}
+	peers, err := parseNetworks(r.Match.Peers)
+	if err != nil {
+		return nil, fmt.Errorf("parse peers: %w", err)
+	}
+	compiled.peers = peers
+	if r.Match.Pattern != "" {
+		if r.Match.Header == "" {
+			return nil, fmt.Errorf("match pattern without header")
+		}
+		if compiled.pattern, err = regexp.Compile(r.Match.Pattern); err != nil {
+			return nil, fmt.Errorf("compile match pattern: %w", err)
+		}
+	}
+
+	for i, a := range r.Actions {
+		compiledAction := action{Action: a}
+		switch a.Operation {
+		case Add, Remove, Replace:
+			if a.Header == "" {
+				return nil, fmt.Errorf("action %d: %s without header", i, a.Operation)
+			}
+			if a.Pattern != "" {
+				if compiledAction.pattern, err = regexp.Compile(a.Pattern); err != nil {
+					return nil, fmt.Errorf("action %d: compile pattern: %w", i, err)
+				}
+			}
+		case SetParam, RemoveParam:
+			switch a.Uri {
+			case RequestUri, FromUri, ToUri, ContactUri:
+			default:
+				return nil, fmt.Errorf("action %d: invalid uri %q", i, a.Uri)
+			}
+			if a.Param == "" {
+				return nil, fmt.Errorf("action %d: %s without param", i, a.Operation)
+			}
+		default:
+			return nil, fmt.Errorf("action %d: invalid operation %q", i, a.Operation)
+		}
+		compiled.actions = append(compiled.actions, compiledAction)
+	}
+
+	return compiled, nil
+}
+
+func (e *engine) Apply(msg sip.Message, direction Direction) int {
+	e.mu.RLock()
+	rules := e.rules
+	e.mu.RUnlock()
+
+	applied := 0
+	for _, r := range rules {
+		if !r.matches(msg, direction) {
+			continue
+		}
+		for _, a := range r.actions {
+			if err := a.apply(msg); err != nil {
+				e.Log().WithFields(msg.Fields()).Warnf("rule %q failed to %s on message '%s': %s",
+					r.name, a.Operation, msg.Short(), err)
+			}
+		}
+		applied++
+		e.Log().WithFields(msg.Fields()).Debugf("applied rule %q to %s message '%s'", r.name, direction, msg.Short())
+	}
+
+	return applied
+}
+
+func (e *engine) Middleware() gosip.Middleware {
+	return func(next gosip.HandlerFunc) gosip.HandlerFunc {
+		return func(w gosip.ResponseWriter, req sip.Request) {
+			e.Apply(req, Inbound)
+			next(&responseWriter{ResponseWriter: w, req: req, engine: e}, req)
+		}
+	}
+}
+
+// responseWriter applies Outbound rules to responses written by the handler.
+type responseWriter struct {
+	gosip.ResponseWriter
+	req    sip.Request
+	engine *engine
+}
+
+func (w *responseWriter) Write(status sip.StatusCode, reason, body string, headers ...sip.Header) error {
+	res := sip.NewResponseFromRequest("", w.req, status, reason, body)
+	for _, hdr := range headers {
+		res.AppendHeader(hdr)
+	}
+
+	return w.WriteResponse(res)
+}
+
+func (w *responseWriter) WriteResponse(res sip.Response) error {
+	w.engine.Apply(res, Outbound)
+
+	return w.ResponseWriter.WriteResponse(res)
+}
+
+func (r *rule) matches(msg sip.Message, direction Direction) bool {
+	if r.match.Direction != "" && r.match.Direction != direction {
+		return false
+	}
+
+	res, isResponse := msg.(sip.Response)
+	if len(r.match.StatusCodes) > 0 {
+		if !isResponse || !containsCode(r.match.StatusCodes, res.StatusCode()) {
+			return false
+		}
+	}
+	if r.methods != nil && !r.methods[string(methodOf(msg))] {
+		return false
+	}
+	if len(r.peers) > 0 && !containsIP(r.peers, peerOf(msg, direction)) {
+		return false
+	}
+	if r.match.Header != "" {
+		hdrs := msg.GetHeaders(r.match.Header)
+		if len(hdrs) == 0 {
+			return false
+		}
+		if r.pattern != nil {
+			matched := false
+			for _, hdr := range hdrs {
+				if r.pattern.MatchString(hdr.Value()) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (a action) apply(msg sip.Message) error {
+	switch a.Operation {
+	case Add:
+		if len(msg.GetHeaders(a.Header)) > 0 {
+			return nil
+		}
+		hdrs, err := parser.ParseHeader(a.Header + ": " + a.Value)
+		if err != nil {
+			return err
+		}
+		for _, hdr := range hdrs {
+			msg.AppendHeader(hdr)
+		}
+	case Remove:
+		msg.RemoveHeader(a.Header)
+	case Replace:
+		current := msg.GetHeaders(a.Header)
+		if len(current) == 0 {
+			return nil
+		}
+		values := []string{a.Value}
+		if a.pattern != nil {
+			values = make([]string, 0, len(current))
+			for _, hdr := range current {
+				values = append(values, a.pattern.ReplaceAllString(hdr.Value(), a.Value))
+			}
+		}
+		hdrs := make([]sip.Header, 0, len(values))
+		for _, value := range values {
+			parsed, err := parser.ParseHeader(a.Header + ": " + value)
+			if err != nil {
+				return err
+			}
+			hdrs = append(hdrs, parsed...)
+		}
+		msg.ReplaceHeaders(current[0].Name(), hdrs)
+	case SetParam, RemoveParam:
+		a.applyParam(msg)
+	}
+
+	return nil
+}
+
+// applyParam edits clones of URIs, since URIs and headers may be shared by messages.
+func (a action) applyParam(msg sip.Message) {
+	edit := func(uri sip.Uri) sip.Uri {
+		uri = uri.Clone()
+		params := uri.UriParams()
+		if params == nil {
+			params = sip.NewParams()
+		} else {
+			params = params.Clone()
+		}
+		if a.Operation == SetParam {
+			var value sip.MaybeString
+			if a.Value != "" {
+				value = sip.String{Str: a.Value}
+			}
+			params.Add(a.Param, value)
+		} else {
+			params.Remove(a.Param)
+		}
+		uri.SetUriParams(params)
+
+		return uri
+	}
+
+	switch a.Uri {
+	case RequestUri:
+		if req, ok := msg.(sip.Request); ok && req.Recipient() != nil {
+			req.SetRecipient(edit(req.Recipient()))
+		}
+	case FromUri:
+		if from, ok := msg.From(); ok && from.Address != nil {
+			from = from.Clone().(*sip.FromHeader)
+			from.Address = edit(from.Address)
+			msg.ReplaceHeaders("From", []sip.Header{from})
+		}
+	case ToUri:
+		if to, ok := msg.To(); ok && to.Address != nil {
+			to = to.Clone().(*sip.ToHeader)
+			to.Address = edit(to.Address)
+			msg.ReplaceHeaders("To", []sip.Header{to})
+		}
+	case ContactUri:
+		hdrs := msg.GetHeaders("Contact")
+		contacts := make([]sip.Header, 0, len(hdrs))
+		for _, hdr := range hdrs {
+			if contact, ok := hdr.(*sip.ContactHeader); ok && contact.Address != nil && !contact.Address.IsWildcard() {
+				contact = contact.Clone().(*sip.ContactHeader)
+				if uri, ok := edit(contact.Address).(sip.ContactUri); ok {
+					contact.Address = uri
+				}
+				hdr = contact
+			}
+			contacts = append(contacts, hdr)
+		}
+		if len(contacts) > 0 {
+			msg.ReplaceHeaders("Contact", contacts)
+		}
+	}
+}
+
+func methodOf(msg sip.Message) sip.RequestMethod {
+	if req, ok := msg.(sip.Request); ok {
+		return req.Method()
+	}
+	if cseq, ok := msg.CSeq(); ok {
+		return cseq.MethodName
+	}
+
+	return ""
+}
+
+// peerOf returns the address of the peer the message is received from or sent to.
+func peerOf(msg sip.Message, direction Direction) string {
+	receivedFrom, _ := msg.Fields()[transport.ReceivedFromField].(string)
+	if direction == Inbound {
+		if receivedFrom != "" {
+			return receivedFrom
+		}
+		return msg.Source()
+	}
+	if dest := msg.Destination(); dest != "" {
+		return dest
+	}
+
+	return receivedFrom
+}
+
+func containsCode(codes []sip.StatusCode, code sip.StatusCode) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsIP(networks []*net.IPNet, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
@@ -0,0 +1,171 @@
+package hmr_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/hmr"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+type recordingWriter struct {
+	gosip.ResponseWriter
+	written []sip.Response
+}
+
+func (w *recordingWriter) WriteResponse(res sip.Response) error {
+	w.written = append(w.written, res)
+	return nil
+}
+
+var _ = Describe("Engine", func() {
+	logger := testutils.NewLogrusLogger()
+
+	invite := func(source string) sip.Request {
+		req := testutils.Request([]string{
+			"INVITE sip:+15551234567@sbc.example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK.abc",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:+15551234567@sbc.example.com>",
+			"Call-ID: call-1",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"User-Agent: Cisco-SIPGateway/IOS-15",
+			"P-Preferred-Identity: <sip:+15550000000@example.com>",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		req.SetSource(source)
+		return req
+	}
+
+	It("should add, remove and replace headers", func() {
+		e, err := hmr.NewEngine(hmr.Config{Rules: []hmr.Rule{{
+			Name: "cisco",
+			Actions: []hmr.Action{
+				{Operation: hmr.Add, Header: "X-Trunk", Value: "cisco"},
+				{Operation: hmr.Remove, Header: "P-Preferred-Identity"},
+				{Operation: hmr.Replace, Header: "User-Agent", Pattern: `IOS-(\d+)`, Value: "IOS/$1"},
+			},
+		}}}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		req := invite("10.0.0.1:5060")
+		Expect(e.Apply(req, hmr.Inbound)).To(Equal(1))
+		Expect(req.GetHeaders("X-Trunk")).To(HaveLen(1))
+		Expect(req.GetHeaders("X-Trunk")[0].Value()).To(Equal("cisco"))
+		Expect(req.GetHeaders("P-Preferred-Identity")).To(BeEmpty())
+		Expect(req.GetHeaders("User-Agent")[0].Value()).To(Equal("Cisco-SIPGateway/IOS/15"))
+	})
+
+	It("should set and remove params of URIs", func() {
+		e, err := hmr.NewEngine(hmr.Config{Rules: []hmr.Rule{{
+			Name: "phone",
+			Actions: []hmr.Action{
+				{Operation: hmr.SetParam, Uri: hmr.RequestUri, Param: "user", Value: "phone"},
+				{Operation: hmr.SetParam, Uri: hmr.ToUri, Param: "user", Value: "phone"},
+				{Operation: hmr.SetParam, Uri: hmr.ContactUri, Param: "transport", Value: "tcp"},
+				{Operation: hmr.RemoveParam, Uri: hmr.ContactUri, Param: "transport"},
+			},
+		}}}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		req := invite("10.0.0.1:5060")
+		to, _ := req.To()
+		e.Apply(req, hmr.Outbound)
+		Expect(req.Recipient().String()).To(Equal("sip:+15551234567@sbc.example.com;user=phone"))
+		newTo, _ := req.To()
+		Expect(newTo.Address.String()).To(Equal("sip:+15551234567@sbc.example.com;user=phone"))
+		Expect(to.Address.String()).To(Equal("sip:+15551234567@sbc.example.com"))
+		contact, _ := req.Contact()
+		Expect(contact.Address.String()).To(Equal("sip:alice@10.0.0.1:5060"))
+	})
+
+	It("should match messages by method, direction, peer and header", func() {
+		e, err := hmr.NewEngine(hmr.Config{Rules: []hmr.Rule{{
+			Name: "legacy",
+			Match: hmr.Match{
+				Methods:   []string{"invite"},
+				Direction: hmr.Inbound,
+				Peers:     []string{"10.0.0.0/8"},
+				Header:    "User-Agent",
+				Pattern:   "^Cisco",
+			},
+			Actions: []hmr.Action{{Operation: hmr.Add, Header: "X-Legacy", Value: "yes"}},
+		}}}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(e.Apply(invite("10.0.0.1:5060"), hmr.Inbound)).To(Equal(1))
+		Expect(e.Apply(invite("10.0.0.1:5060"), hmr.Outbound)).To(Equal(0))
+		Expect(e.Apply(invite("192.168.0.1:5060"), hmr.Inbound)).To(Equal(0))
+
+		req := invite("10.0.0.1:5060")
+		req.RemoveHeader("User-Agent")
+		Expect(e.Apply(req, hmr.Inbound)).To(Equal(0))
+	})
+
+	It("should manipulate requests and written responses by the middleware", func() {
+		e, err := hmr.NewEngine(hmr.Config{Rules: []hmr.Rule{
+			{
+				Name:    "strip-ppi",
+				Match:   hmr.Match{Direction: hmr.Inbound},
+				Actions: []hmr.Action{{Operation: hmr.Remove, Header: "P-Preferred-Identity"}},
+			},
+			{
+				Name:    "hide-server",
+				Match:   hmr.Match{Direction: hmr.Outbound, StatusCodes: []sip.StatusCode{486}},
+				Actions: []hmr.Action{{Operation: hmr.Remove, Header: "Server"}},
+			},
+		}}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		w := &recordingWriter{}
+		handler := e.Middleware()(func(w gosip.ResponseWriter, req sip.Request) {
+			Expect(req.GetHeaders("P-Preferred-Identity")).To(BeEmpty())
+			Expect(w.Write(486, "Busy Here", "", &sip.GenericHeader{HeaderName: "Server", Contents: "pbx/1.0"})).To(Succeed())
+		})
+		handler(w, invite("10.0.0.1:5060"))
+
+		Expect(w.written).To(HaveLen(1))
+		Expect(w.written[0].StatusCode()).To(Equal(sip.StatusCode(486)))
+		Expect(w.written[0].GetHeaders("Server")).To(BeEmpty())
+	})
+
+	It("should load rules from JSON config", func() {
+		config, err := hmr.LoadConfig(strings.NewReader(`{"rules": [{
+			"name": "teams",
+			"match": {"methods": ["INVITE"], "direction": "outbound"},
+			"actions": [{"operation": "set-param", "uri": "request-uri", "param": "user", "value": "phone"}]
+		}]}`))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(config.Rules).To(HaveLen(1))
+		Expect(config.Rules[0].Actions[0].Operation).To(Equal(hmr.SetParam))
+
+		_, err = hmr.LoadConfig(strings.NewReader(`{"rules": [{"name": "typo", "acions": []}]}`))
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should reject invalid rules and keep current rules on reload", func() {
+		_, err := hmr.NewEngine(hmr.Config{Rules: []hmr.Rule{{
+			Actions: []hmr.Action{{Operation: "rewrite", Header: "To"}},
+		}}}, logger)
+		Expect(err).Should(HaveOccurred())
+
+		e, err := hmr.NewEngine(hmr.Config{Rules: []hmr.Rule{{
+			Actions: []hmr.Action{{Operation: hmr.Add, Header: "X-Trunk", Value: "a"}},
+		}}}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.Reload(hmr.Config{Rules: []hmr.Rule{{
+			Actions: []hmr.Action{{Operation: hmr.SetParam, Uri: "route", Param: "lr"}},
+		}}})).ShouldNot(Succeed())
+		Expect(e.Apply(invite("10.0.0.1:5060"), hmr.Inbound)).To(Equal(1))
+
+		Expect(e.Reload(hmr.Config{})).To(Succeed())
+		Expect(e.Apply(invite("10.0.0.1:5060"), hmr.Inbound)).To(Equal(0))
+	})
+})
@@ -0,0 +1,172 @@
+package im
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CPIMHeader is a message or content header of CPIM message.
+type CPIMHeader struct {
+	Name  string
+	Value string
+}
+
+// CPIM is a Common Presence and Instant Messaging message - RFC 3862.
+type CPIM struct {
+	// From and To are addresses in the 'Name <uri>' form.
+	From string
+	To   string
+	// DateTime is the message creation time, zero value is omitted.
+	DateTime time.Time
+	Subject  string
+	// Headers are other message headers in order, including NS and Require.
+	Headers []CPIMHeader
+	// ContentType of the encapsulated content, default is text/plain.
+	ContentType string
+	// ContentHeaders are other MIME headers of the encapsulated content.
+	ContentHeaders []CPIMHeader
+	Body           string
+}
+
+// NewCPIM creates CPIM message with text/plain content.
+func NewCPIM(from, to, body string) *CPIM {
+	return &CPIM{
+		From:        from,
+		To:          to,
+		DateTime:    time.Now(),
+		ContentType: ContentTypeText,
+		Body:        body,
+	}
+}
+
+// Header returns value of the first message header with the name.
+func (cpim *CPIM) Header(name string) (string, bool) {
+	for _, hdr := range cpim.Headers {
+		if strings.EqualFold(hdr.Name, name) {
+			return hdr.Value, true
+		}
+	}
+
+	return "", false
+}
+
+func (cpim *CPIM) String() string {
+	var buf strings.Builder
+
+	writeHeader := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+
+	if cpim.From != "" {
+		writeHeader("From", cpim.From)
+	}
+	if cpim.To != "" {
+		writeHeader("To", cpim.To)
+	}
+	if !cpim.DateTime.IsZero() {
+		writeHeader("DateTime", cpim.DateTime.Format(time.RFC3339))
+	}
+	if cpim.Subject != "" {
+		writeHeader("Subject", cpim.Subject)
+	}
+	for _, hdr := range cpim.Headers {
+		writeHeader(hdr.Name, hdr.Value)
+	}
+	buf.WriteString("\r\n")
+
+	contentType := cpim.ContentType
+	if contentType == "" {
+		contentType = ContentTypeText
+	}
+	writeHeader("Content-Type", contentType)
+	for _, hdr := range cpim.ContentHeaders {
+		writeHeader(hdr.Name, hdr.Value)
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(cpim.Body)
+
+	return buf.String()
+}
+
+// ParseCPIM parses message/cpim body.
+func ParseCPIM(body string) (*CPIM, error) {
+	cpim := &CPIM{}
+	reader := bufio.NewReader(strings.NewReader(body))
+
+	msgHeaders, err := readCPIMHeaders(reader)
+	if err != nil {
+		return nil, err
+	}
+	for _, hdr := range msgHeaders {
+		switch strings.ToLower(hdr.Name) {
+		case "from":
+			cpim.From = hdr.Value
+		case "to":
+			cpim.To = hdr.Value
+		case "datetime":
+			dt, err := time.Parse(time.RFC3339, hdr.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CPIM DateTime '%s': %w", hdr.Value, err)
+			}
+			cpim.DateTime = dt
+		case "subject":
+			cpim.Subject = hdr.Value
+		default:
+			cpim.Headers = append(cpim.Headers, hdr)
+		}
+	}
+
+	contentHeaders, err := readCPIMHeaders(reader)
+	if err != nil {
+		return nil, err
+	}
+	for _, hdr := range contentHeaders {
+		if strings.EqualFold(hdr.Name, "Content-Type") {
+			cpim.ContentType = hdr.Value
+			continue
+		}
+		cpim.ContentHeaders = append(cpim.ContentHeaders, hdr)
+	}
+	if cpim.ContentType == "" {
+		return nil, fmt.Errorf("CPIM content has no Content-Type")
+	}
+
+	rest := new(strings.Builder)
+	if _, err := reader.WriteTo(rest); err != nil {
+		return nil, err
+	}
+	cpim.Body = rest.String()
+
+	return cpim, nil
+}
+
+// readCPIMHeaders reads header block terminated by the empty line.
+func readCPIMHeaders(reader *bufio.Reader) ([]CPIMHeader, error) {
+	hdrs := make([]CPIMHeader, 0)
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if err != nil && len(hdrs) == 0 {
+				return nil, fmt.Errorf("unexpected end of CPIM message")
+			}
+
+			return hdrs, nil
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid CPIM header line '%s'", line)
+		}
+		hdrs = append(hdrs, CPIMHeader{
+			Name:  strings.TrimSpace(parts[0]),
+			Value: strings.TrimSpace(parts[1]),
+		})
+
+		if err != nil {
+			return hdrs, nil
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// im package implements paging-mode instant messaging with MESSAGE method - RFC 3428.
+package im
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	ContentTypeText = "text/plain"
+	ContentTypeCPIM = "message/cpim"
+)
+
+// Message is an instant message.
+type Message struct {
+	From        *sip.Address
+	To          *sip.Address
+	ContentType string
+	Body        string
+	// Request is the received MESSAGE request.
+	Request sip.Request
+}
+
+// CPIM parses the message/cpim body of the message.
+func (msg *Message) CPIM() (*CPIM, error) {
+	if !isContentType(msg.ContentType, ContentTypeCPIM) {
+		return nil, fmt.Errorf("message content type '%s' is not %s", msg.ContentType, ContentTypeCPIM)
+	}
+
+	return ParseCPIM(msg.Body)
+}
+
+// Config describes messaging agent options.
+type Config struct {
+	// From is the sender address of outgoing messages.
+	From *sip.Address
+	// Authorizer answers 401/407 challenges of outgoing messages.
+	Authorizer sip.Authorizer
+	// Headers are appended to each outgoing MESSAGE request.
+	Headers []sip.Header
+	// AcceptTypes are content types of received messages, default is text/plain and message/cpim.
+	// Other types are rejected with 415 - RFC 3428 7.
+	AcceptTypes []string
+	// Accepted responds 202 Accepted instead of 200 OK on delivered messages,
+	// for gateways that forward messages to the recipient later - RFC 3428 7.
+	Accepted bool
+	// OnMessage delivers received messages. Returned *sip.RequestError rejects the message with its code,
+	// other errors are responded with 500.
+	OnMessage func(msg *Message) error
+}
+
+// Agent sends and receives pager-mode instant messages.
+type Agent interface {
+	// Send sends MESSAGE outside of the dialog and waits for the final response - RFC 3428 4.
+	// Both 200 and 202 responses mean the message is delivered or accepted for the delivery.
+	Send(ctx context.Context, to *sip.Address, contentType, body string) (sip.Response, error)
+	// SendCPIM sends the message in message/cpim body.
+	SendCPIM(ctx context.Context, to *sip.Address, cpim *CPIM) (sip.Response, error)
+	// ServeMessage receives MESSAGE request, it can be passed directly to gosip.Server OnRequest - RFC 3428 7.
+	ServeMessage(req sip.Request, tx sip.ServerTransaction)
+}
+
+type agent struct {
+	requester gosip.Requester
+	config    Config
+
+	log log.Logger
+}
+
+// NewAgent creates messaging agent.
+func NewAgent(requester gosip.Requester, config Config, logger log.Logger) Agent {
+	if len(config.AcceptTypes) == 0 {
+		config.AcceptTypes = []string{ContentTypeText, ContentTypeCPIM}
+	}
+
+	a := &agent{
+		requester: requester,
+		config:    config,
+	}
+	a.log = logger.
+		WithPrefix("im.Agent").
+		WithFields(log.Fields{
+			"agent_ptr": fmt.Sprintf("%p", a),
+		})
+
+	return a
+}
+
+func (a *agent) Log() log.Logger {
+	return a.log
+}
+
+func (a *agent) Send(ctx context.Context, to *sip.Address, contentType, body string) (sip.Response, error) {
+	if a.config.From == nil {
+		return nil, fmt.Errorf("sender address is not configured")
+	}
+
+	req := a.newRequest(to, contentType, body)
+
+	options := make([]gosip.RequestWithContextOption, 0)
+	if a.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(a.config.Authorizer))
+	}
+
+	return a.requester.RequestWithContext(ctx, req, options...)
+}
+
+func (a *agent) SendCPIM(ctx context.Context, to *sip.Address, cpim *CPIM) (sip.Response, error) {
+	return a.Send(ctx, to, ContentTypeCPIM, cpim.String())
+}
+
+// RFC 3428 4. Each message is a standalone request with own Call-ID and without Contact.
+func (a *agent) newRequest(to *sip.Address, contentType, body string) sip.Request {
+	from := a.config.From.AsFromHeader()
+	from.Params = sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)})
+	toHdr := to.AsToHeader()
+	toHdr.Params = sip.NewParams()
+	callID := sip.CallID(util.RandString(32))
+	maxForwards := sip.MaxForwards(70)
+	ct := sip.ContentType(contentType)
+
+	hdrs := []sip.Header{
+		sip.ViaHeader{
+			&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       sip.DefaultProtocol,
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			},
+		},
+		&maxForwards,
+		from,
+		toHdr,
+		&callID,
+		&sip.CSeq{SeqNo: 1, MethodName: sip.MESSAGE},
+		&ct,
+	}
+	for _, hdr := range a.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	return sip.NewRequest(
+		"",
+		sip.MESSAGE,
+		to.Uri.Clone(),
+		"SIP/2.0",
+		hdrs,
+		body,
+		log.Fields{
+			"agent_ptr": fmt.Sprintf("%p", a),
+		},
+	)
+}
+
+func (a *agent) ServeMessage(req sip.Request, tx sip.ServerTransaction) {
+	logger := a.Log().WithFields(req.Fields())
+
+	if req.Method() != sip.MESSAGE {
+		a.respond(tx, sip.NewResponseFromRequest("", req, 405, "Method Not Allowed", ""))
+
+		return
+	}
+
+	msg := &Message{
+		ContentType: ContentTypeText,
+		Body:        req.Body(),
+		Request:     req,
+	}
+	if from, ok := req.From(); ok {
+		msg.From = sip.NewAddressFromFromHeader(from)
+	}
+	if to, ok := req.To(); ok {
+		msg.To = sip.NewAddressFromToHeader(to)
+	}
+	if ct, ok := req.ContentType(); ok {
+		msg.ContentType = ct.Value()
+	}
+
+	if !a.accepts(msg.ContentType) {
+		logger.Debugf("reject message with unsupported content type '%s'", msg.ContentType)
+
+		res := sip.NewResponseFromRequest("", req, 415, "Unsupported Media Type", "")
+		res.AppendHeader(&sip.GenericHeader{
+			HeaderName: "Accept",
+			Contents:   strings.Join(a.config.AcceptTypes, ", "),
+		})
+		a.respond(tx, res)
+
+		return
+	}
+
+	var err error
+	if a.config.OnMessage != nil {
+		err = a.config.OnMessage(msg)
+	}
+
+	var reqErr *sip.RequestError
+	switch {
+	case err == nil && a.config.Accepted:
+		a.respond(tx, sip.NewResponseFromRequest("", req, 202, "Accepted", ""))
+	case err == nil:
+		a.respond(tx, sip.NewResponseFromRequest("", req, 200, "OK", ""))
+	case errors.As(err, &reqErr):
+		logger.Debugf("message rejected: %s", err)
+		a.respond(tx, sip.NewResponseFromRequest("", req, sip.StatusCode(reqErr.Code), reqErr.Reason, ""))
+	default:
+		logger.Errorf("message delivery failed: %s", err)
+		a.respond(tx, sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""))
+	}
+}
+
+func (a *agent) accepts(contentType string) bool {
+	for _, accepted := range a.config.AcceptTypes {
+		if isContentType(contentType, accepted) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *agent) respond(tx sip.ServerTransaction, res sip.Response) {
+	if tx == nil {
+		return
+	}
+	if err := tx.Respond(res); err != nil {
+		a.Log().WithFields(res.Fields()).Errorf("respond '%s' failed: %s", res.Short(), err)
+	}
+}
+
+// isContentType compares media type of the Content-Type value ignoring params.
+func isContentType(value, mediaType string) bool {
+	if i := strings.Index(value, ";"); i >= 0 {
+		value = value[:i]
+	}
+
+	return strings.EqualFold(strings.TrimSpace(value), mediaType)
+}
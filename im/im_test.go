@@ -0,0 +1,156 @@
+package im_test
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/im"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+func messageRequest(contentType, body string) sip.Request {
+	return testutils.Request([]string{
+		"MESSAGE sip:bob@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+		"From: \"Alice\" <sip:alice@example.com>;tag=alice-tag",
+		"To: <sip:bob@example.com>",
+		"Call-ID: im-call-id",
+		"CSeq: 1 MESSAGE",
+		"Content-Type: " + contentType,
+		"Content-Length: " + sip.ContentLength(len(body)).Value(),
+		"",
+		body,
+	})
+}
+
+var _ = Describe("IM", func() {
+	var (
+		requester *testutils.MockRequester
+		config    im.Config
+		received  chan *im.Message
+	)
+
+	alice := &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"}}
+	bob := &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "bob"}, FHost: "example.com"}}
+
+	BeforeEach(func() {
+		requester = testutils.NewMockRequester(func(req sip.Request) (sip.Response, error) {
+			return sip.NewResponseFromRequest("", req, 202, "Accepted", ""), nil
+		})
+		received = make(chan *im.Message, 10)
+		config = im.Config{
+			From:       alice,
+			Authorizer: auth{},
+			OnMessage: func(msg *im.Message) error {
+				received <- msg
+				return nil
+			},
+		}
+	})
+
+	It("should send standalone MESSAGE", func() {
+		agent := im.NewAgent(requester, config, log.NewDefaultLogrusLogger())
+		res, err := agent.Send(context.Background(), bob, im.ContentTypeText, "hello")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(202)))
+		Expect(requester.Options()).To(Equal(1))
+
+		var req sip.Request
+		Eventually(requester.Received()).Should(Receive(&req))
+		Expect(req.Method()).To(Equal(sip.MESSAGE))
+		Expect(req.Recipient().String()).To(Equal("sip:bob@example.com"))
+		Expect(req.Body()).To(Equal("hello"))
+		ct, ok := req.ContentType()
+		Expect(ok).To(BeTrue())
+		Expect(ct.Value()).To(Equal(im.ContentTypeText))
+		from, _ := req.From()
+		Expect(from.Params.Has("tag")).To(BeTrue())
+		_, ok = req.Contact()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should deliver received messages", func() {
+		agent := im.NewAgent(requester, config, log.NewDefaultLogrusLogger())
+		tx := testutils.NewMockServerTx(nil)
+		agent.ServeMessage(messageRequest("text/plain; charset=utf-8", "hello"), tx)
+
+		var msg *im.Message
+		Eventually(received).Should(Receive(&msg))
+		Expect(msg.Body).To(Equal("hello"))
+		Expect(msg.From.Uri.String()).To(Equal("sip:alice@example.com"))
+		Expect(tx.Response().StatusCode()).To(Equal(sip.StatusCode(200)))
+
+		config.Accepted = true
+		agent = im.NewAgent(requester, config, log.NewDefaultLogrusLogger())
+		tx = testutils.NewMockServerTx(nil)
+		agent.ServeMessage(messageRequest("text/plain", "hello"), tx)
+		Expect(tx.Response().StatusCode()).To(Equal(sip.StatusCode(202)))
+	})
+
+	It("should reject unsupported content and messages refused by the application", func() {
+		agent := im.NewAgent(requester, config, log.NewDefaultLogrusLogger())
+		tx := testutils.NewMockServerTx(nil)
+		agent.ServeMessage(messageRequest("application/xml", "<x/>"), tx)
+		Expect(tx.Response().StatusCode()).To(Equal(sip.StatusCode(415)))
+		Expect(tx.Response().GetHeaders("Accept")[0].Value()).To(ContainSubstring(im.ContentTypeCPIM))
+
+		config.OnMessage = func(msg *im.Message) error {
+			return &sip.RequestError{Code: 486, Reason: "Busy Here"}
+		}
+		agent = im.NewAgent(requester, config, log.NewDefaultLogrusLogger())
+		tx = testutils.NewMockServerTx(nil)
+		agent.ServeMessage(messageRequest("text/plain", "hello"), tx)
+		Expect(tx.Response().StatusCode()).To(Equal(sip.StatusCode(486)))
+	})
+
+	It("should parse and build CPIM messages", func() {
+		body := strings.Join([]string{
+			"From: MR SANDERS <im:piglet@100akerwood.com>",
+			"To: Depressed Donkey <im:eeyore@100akerwood.com>",
+			"DateTime: 2000-12-13T13:40:00-08:00",
+			"Subject: the weather will be fine today",
+			"NS: MyFeatures <mid:MessageFeatures@id.foo.com>",
+			"Require: MyFeatures.VitalMessageOption",
+			"",
+			"Content-type: text/plain",
+			"Content-ID: <1234567890@foo.com>",
+			"",
+			"Here is the text of my message.",
+		}, "\r\n")
+
+		agent := im.NewAgent(requester, config, log.NewDefaultLogrusLogger())
+		agent.ServeMessage(messageRequest(im.ContentTypeCPIM, body), testutils.NewMockServerTx(nil))
+
+		var msg *im.Message
+		Eventually(received).Should(Receive(&msg))
+		cpim, err := msg.CPIM()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cpim.From).To(Equal("MR SANDERS <im:piglet@100akerwood.com>"))
+		Expect(cpim.To).To(Equal("Depressed Donkey <im:eeyore@100akerwood.com>"))
+		Expect(cpim.DateTime.Equal(time.Date(2000, 12, 13, 21, 40, 0, 0, time.UTC))).To(BeTrue())
+		Expect(cpim.Subject).To(Equal("the weather will be fine today"))
+		require, ok := cpim.Header("Require")
+		Expect(ok).To(BeTrue())
+		Expect(require).To(Equal("MyFeatures.VitalMessageOption"))
+		Expect(cpim.ContentType).To(Equal("text/plain"))
+		Expect(cpim.ContentHeaders).To(Equal([]im.CPIMHeader{{Name: "Content-ID", Value: "<1234567890@foo.com>"}}))
+		Expect(cpim.Body).To(Equal("Here is the text of my message."))
+
+		parsed, err := im.ParseCPIM(cpim.String())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed.Subject).To(Equal(cpim.Subject))
+		Expect(parsed.Body).To(Equal(cpim.Body))
+	})
+})
+
+type auth struct{}
+
+func (auth) AuthorizeRequest(request sip.Request, response sip.Response) error {
+	return nil
+}
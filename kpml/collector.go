@@ -0,0 +1,165 @@
+package kpml
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// Collector matches digits pressed by the user against the pattern of the request
+// and reports results, it is a notifier side of the subscription.
+// Digits are fed from the media, like RFC 4733 telephone-events, or from INFO requests.
+type Collector struct {
+	mu      sync.Mutex
+	pattern Pattern
+	regexes []*regexp.Regexp
+	report  func(res *Response)
+	timeout time.Duration
+	timer   timing.Timer
+	digits  strings.Builder
+	done    bool
+}
+
+// NewCollector creates collector of the request patterns, report is called with each result.
+// One-shot and single-notify collectors stop after the first report.
+func NewCollector(req *Request, report func(res *Response)) (*Collector, error) {
+	c := &Collector{
+		pattern: req.Pattern,
+		report:  report,
+		timeout: DefaultInterDigitTimer,
+	}
+	if req.Pattern.InterDigitTimer > 0 {
+		c.timeout = time.Duration(req.Pattern.InterDigitTimer) * time.Millisecond
+	}
+	for _, regex := range req.Pattern.Regexes {
+		re, err := compile(regex.Value)
+		if err != nil {
+			return nil, err
+		}
+		c.regexes = append(c.regexes, re)
+	}
+
+	return c, nil
+}
+
+// Digit adds the key pressed by the user: 0-9, A-D, * or #.
+func (c *Collector) Digit(key string) {
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return
+	}
+
+	var res *Response
+	if c.pattern.EnterKey != "" && key == c.pattern.EnterKey {
+		res = NewResponse(StatusSuccess, c.digits.String(), "")
+		res.ForcedFlush = true
+	} else {
+		c.digits.WriteString(strings.ToUpper(key))
+		for i, re := range c.regexes {
+			if re.MatchString(c.digits.String()) {
+				res = NewResponse(StatusSuccess, c.digits.String(), c.pattern.Regexes[i].Tag)
+				break
+			}
+		}
+	}
+
+	if res == nil {
+		c.resetTimer()
+		c.mu.Unlock()
+		return
+	}
+
+	c.finish()
+	c.mu.Unlock()
+
+	c.report(res)
+}
+
+// Stop stops the collector without report, e.g. when the subscription is terminated.
+func (c *Collector) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.done = true
+	c.stopTimer()
+}
+
+// Done reports whether the collector has stopped.
+func (c *Collector) Done() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.done
+}
+
+// finish clears collected digits, persistent collector continues with the next digits.
+func (c *Collector) finish() {
+	c.digits.Reset()
+	c.stopTimer()
+	if c.pattern.Persist != Persist {
+		c.done = true
+	}
+}
+
+func (c *Collector) resetTimer() {
+	c.stopTimer()
+	c.timer = timing.AfterFunc(c.timeout, func() {
+		c.mu.Lock()
+		if c.done || c.digits.Len() == 0 {
+			c.mu.Unlock()
+			return
+		}
+		res := NewResponse(StatusTimerExpired, c.digits.String(), "")
+		c.finish()
+		c.mu.Unlock()
+
+		c.report(res)
+	})
+}
+
+func (c *Collector) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// compile translates KPML regex to the anchored Go regular expression.
+func compile(value string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	inClass := false
+	for _, r := range strings.TrimSpace(value) {
+		switch {
+		case r == 'x' && !inClass:
+			expr.WriteString("[0-9]")
+		case r == 'x':
+			expr.WriteString("0-9")
+		case r == '.' && !inClass:
+			expr.WriteString(`[0-9A-D*#]`)
+		case r == '*' || r == '#':
+			expr.WriteString(`\` + string(r))
+		case r == '[':
+			inClass = true
+			expr.WriteRune(r)
+		case r == ']':
+			inClass = false
+			expr.WriteRune(r)
+		case strings.ContainsRune("0123456789ABCDabcd{},|-^", r):
+			expr.WriteString(strings.ToUpper(string(r)))
+		default:
+			return nil, fmt.Errorf("invalid KPML regex '%s': unexpected '%c'", value, r)
+		}
+	}
+
+	re, err := regexp.Compile("^(?:" + expr.String() + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid KPML regex '%s': %w", value, err)
+	}
+
+	return re, nil
+}
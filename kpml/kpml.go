@@ -0,0 +1,237 @@
+// kpml package implements "kpml" event package - RFC 4730.
+// The subscriber sends digit patterns in the SUBSCRIBE body, the notifier collects digits
+// pressed by the user and reports matched digits in NOTIFY bodies.
+package kpml
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	EventPackage        = "kpml"
+	RequestContentType  = "application/kpml-request+xml"
+	ResponseContentType = "application/kpml-response+xml"
+	Version             = "1.0"
+
+	// DefaultInterDigitTimer is a default time to wait for the next digit - RFC 4730 5.3.
+	DefaultInterDigitTimer = 4 * time.Second
+
+	requestNamespace  = "urn:ietf:params:xml:ns:kpml-request"
+	responseNamespace = "urn:ietf:params:xml:ns:kpml-response"
+)
+
+// Persistence of the subscription - RFC 4730 5.3.
+const (
+	// OneShot subscription terminates after the first report.
+	OneShot = "one-shot"
+	// Persist subscription reports each match until it is terminated.
+	Persist = "persist"
+	// SingleNotify subscription reports the first match and stays active without reports.
+	SingleNotify = "single-notify"
+)
+
+// Response codes - RFC 4730 5.4.
+const (
+	StatusSuccess                    = 200
+	StatusUserTerminatedWithoutMatch = 402
+	StatusTimerExpired               = 423
+	StatusDialogTerminated           = 481
+	StatusSubscriptionExpired        = 487
+	StatusBadDocument                = 501
+)
+
+// Request is a kpml-request document - RFC 4730 6.2.
+type Request struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:kpml-request kpml-request"`
+	Version string   `xml:"version,attr"`
+	Pattern Pattern  `xml:"pattern"`
+}
+
+// Pattern describes digits to collect.
+type Pattern struct {
+	// Persist is one of OneShot, Persist or SingleNotify, empty means OneShot.
+	Persist string `xml:"persist,attr,omitempty"`
+	// InterDigitTimer is a time in milliseconds to wait for the next digit, zero means DefaultInterDigitTimer.
+	InterDigitTimer uint `xml:"interdigittimer,attr,omitempty"`
+	// EnterKey is a key that forces the report of collected digits.
+	EnterKey string `xml:"enterkey,attr,omitempty"`
+	// Flush discards digits buffered before the subscription, "yes" or "no".
+	Flush   string  `xml:"flush,omitempty"`
+	Regexes []Regex `xml:"regex"`
+}
+
+// Regex is a digit pattern in KPML regular expression syntax - RFC 4730 5.2:
+// digits 0-9, A-D, * and # are keys, x matches 0-9, . matches any key,
+// [...] is a key class, {m,n} repeats the previous element and | separates alternatives.
+type Regex struct {
+	Tag   string `xml:"tag,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// Response is a kpml-response document - RFC 4730 6.3.
+type Response struct {
+	XMLName     xml.Name `xml:"urn:ietf:params:xml:ns:kpml-response kpml-response"`
+	Version     string   `xml:"version,attr"`
+	Code        int      `xml:"code,attr"`
+	Text        string   `xml:"text,attr"`
+	Suppressed  bool     `xml:"suppressed,attr,omitempty"`
+	ForcedFlush bool     `xml:"forced_flush,attr,omitempty"`
+	Digits      string   `xml:"digits,attr,omitempty"`
+	Tag         string   `xml:"tag,attr,omitempty"`
+}
+
+// NewRequest creates one-shot request of the regexes.
+func NewRequest(regexes ...Regex) *Request {
+	return &Request{
+		Version: Version,
+		Pattern: Pattern{
+			Persist: OneShot,
+			Regexes: regexes,
+		},
+	}
+}
+
+// Encode serializes document to XML.
+func (req *Request) Encode() (string, error) {
+	data, err := xml.MarshalIndent(req, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encode kpml-request: %w", err)
+	}
+
+	return xml.Header + string(data), nil
+}
+
+// DecodeRequest parses kpml-request document.
+func DecodeRequest(body string) (*Request, error) {
+	req := new(Request)
+	if err := xml.Unmarshal([]byte(body), req); err != nil {
+		return nil, fmt.Errorf("decode kpml-request: %w", err)
+	}
+	if req.XMLName.Space != requestNamespace {
+		return nil, fmt.Errorf("decode kpml-request: unexpected namespace '%s'", req.XMLName.Space)
+	}
+	if len(req.Pattern.Regexes) == 0 {
+		return nil, fmt.Errorf("decode kpml-request: pattern has no regex")
+	}
+	switch req.Pattern.Persist {
+	case "", OneShot, Persist, SingleNotify:
+	default:
+		return nil, fmt.Errorf("decode kpml-request: invalid persist '%s'", req.Pattern.Persist)
+	}
+
+	return req, nil
+}
+
+// NewResponse creates response with the code and its default text.
+func NewResponse(code int, digits, tag string) *Response {
+	return &Response{
+		Version: Version,
+		Code:    code,
+		Text:    StatusText(code),
+		Digits:  digits,
+		Tag:     tag,
+	}
+}
+
+// Encode serializes document to XML.
+func (res *Response) Encode() (string, error) {
+	data, err := xml.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encode kpml-response: %w", err)
+	}
+
+	return xml.Header + string(data), nil
+}
+
+// DecodeResponse parses kpml-response document.
+func DecodeResponse(body string) (*Response, error) {
+	res := new(Response)
+	if err := xml.Unmarshal([]byte(body), res); err != nil {
+		return nil, fmt.Errorf("decode kpml-response: %w", err)
+	}
+	if res.XMLName.Space != responseNamespace {
+		return nil, fmt.Errorf("decode kpml-response: unexpected namespace '%s'", res.XMLName.Space)
+	}
+
+	return res, nil
+}
+
+// StatusText returns default text of the response code.
+func StatusText(code int) string {
+	switch code {
+	case StatusSuccess:
+		return "Success"
+	case StatusUserTerminatedWithoutMatch:
+		return "User Terminated Without Match"
+	case StatusTimerExpired:
+		return "Timer Expired"
+	case StatusDialogTerminated:
+		return "Dialog Terminated"
+	case StatusSubscriptionExpired:
+		return "Subscription Expired"
+	case StatusBadDocument:
+		return "Bad Document"
+	default:
+		return ""
+	}
+}
+
+// SubscriptionConfig builds subscriber config to collect digits in the dialog - RFC 4730 5.2.
+// The subscription shares the dialog of the call.
+func SubscriptionConfig(dlg dialog.Dialog, contact *sip.ContactHeader, req *Request) (event.ClientConfig, error) {
+	body, err := req.Encode()
+	if err != nil {
+		return event.ClientConfig{}, err
+	}
+
+	return event.ClientConfig{
+		Contact: contact,
+		Event:   event.Event{Package: EventPackage},
+		Accept:  []string{ResponseContentType},
+		Headers: []sip.Header{contentType(RequestContentType)},
+		Body:    body,
+		Dialog:  dlg,
+	}, nil
+}
+
+// ParseSubscribe decodes kpml-request of the SUBSCRIBE request.
+// Returns nil request if SUBSCRIBE has no body, like refreshing SUBSCRIBE.
+func ParseSubscribe(req sip.Request) (*Request, error) {
+	if req.Body() == "" {
+		return nil, nil
+	}
+
+	return DecodeRequest(req.Body())
+}
+
+// ParseNotify decodes kpml-response of the NOTIFY request.
+// Returns nil response if NOTIFY has no body.
+func ParseNotify(req sip.Request) (*Response, error) {
+	if req.Body() == "" {
+		return nil, nil
+	}
+
+	return DecodeResponse(req.Body())
+}
+
+// Notify sends response to the subscriber.
+func Notify(ctx context.Context, sub event.ServerSubscription, res *Response) error {
+	body, err := res.Encode()
+	if err != nil {
+		return err
+	}
+
+	return sub.Notify(ctx, ResponseContentType, body)
+}
+
+func contentType(value string) sip.Header {
+	hdr := sip.ContentType(value)
+	return &hdr
+}
@@ -0,0 +1,136 @@
+package kpml_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/kpml"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+var _ = Describe("KPML", func() {
+	It("should decode RFC 4730 request", func() {
+		req, err := kpml.DecodeRequest(`<?xml version="1.0" encoding="UTF-8"?>
+<kpml-request xmlns="urn:ietf:params:xml:ns:kpml-request" version="1.0">
+  <pattern persist="persist" interdigittimer="7500">
+    <flush>yes</flush>
+    <regex tag="dtmf-star">*</regex>
+    <regex tag="pin">x{4}#</regex>
+  </pattern>
+</kpml-request>`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(req.Pattern.Persist).To(Equal(kpml.Persist))
+		Expect(req.Pattern.InterDigitTimer).To(Equal(uint(7500)))
+		Expect(req.Pattern.Flush).To(Equal("yes"))
+		Expect(req.Pattern.Regexes).To(Equal([]kpml.Regex{
+			{Tag: "dtmf-star", Value: "*"},
+			{Tag: "pin", Value: "x{4}#"},
+		}))
+
+		_, err = kpml.DecodeRequest(`<kpml-request xmlns="urn:ietf:params:xml:ns:kpml-request" version="1.0">
+  <pattern persist="forever"><regex>x</regex></pattern>
+</kpml-request>`)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should encode and decode response", func() {
+		body, err := kpml.NewResponse(kpml.StatusSuccess, "1234#", "pin").Encode()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(ContainSubstring(`code="200"`))
+		Expect(body).To(ContainSubstring(`text="Success"`))
+
+		res, err := kpml.DecodeResponse(body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.Digits).To(Equal("1234#"))
+		Expect(res.Tag).To(Equal("pin"))
+	})
+
+	Context("collector", func() {
+		var (
+			clock   timing.FakeClock
+			reports chan *kpml.Response
+		)
+
+		BeforeEach(func() {
+			clock = timing.NewFakeClock(time.Unix(0, 0))
+			timing.SetClock(clock)
+			reports = make(chan *kpml.Response, 10)
+		})
+
+		AfterEach(func() {
+			timing.SetClock(nil)
+		})
+
+		report := func(res *kpml.Response) {
+			reports <- res
+		}
+
+		It("should report matched digits and stop one-shot collector", func() {
+			c, err := kpml.NewCollector(kpml.NewRequest(
+				kpml.Regex{Tag: "star", Value: "*"},
+				kpml.Regex{Tag: "pin", Value: "x{4}#"},
+			), report)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, key := range []string{"1", "2", "3", "4"} {
+				c.Digit(key)
+			}
+			Expect(reports).To(BeEmpty())
+			c.Digit("#")
+			Expect(reports).To(Receive(Equal(kpml.NewResponse(kpml.StatusSuccess, "1234#", "pin"))))
+			Expect(c.Done()).To(BeTrue())
+
+			c.Digit("*")
+			Expect(reports).To(BeEmpty())
+		})
+
+		It("should continue persistent collector", func() {
+			req := kpml.NewRequest(kpml.Regex{Value: "[1-3]|[*#]"})
+			req.Pattern.Persist = kpml.Persist
+			c, err := kpml.NewCollector(req, report)
+			Expect(err).ToNot(HaveOccurred())
+
+			c.Digit("2")
+			c.Digit("#")
+			var res *kpml.Response
+			Expect(reports).To(Receive(&res))
+			Expect(res.Digits).To(Equal("2"))
+			Expect(reports).To(Receive(&res))
+			Expect(res.Digits).To(Equal("#"))
+			Expect(c.Done()).To(BeFalse())
+			c.Stop()
+			Expect(c.Done()).To(BeTrue())
+		})
+
+		It("should report collected digits on inter-digit timeout and enter key", func() {
+			req := kpml.NewRequest(kpml.Regex{Value: "x{4}"})
+			req.Pattern.InterDigitTimer = 1000
+			c, err := kpml.NewCollector(req, report)
+			Expect(err).ToNot(HaveOccurred())
+
+			c.Digit("1")
+			c.Digit("2")
+			clock.Advance(time.Second)
+			Eventually(reports).Should(Receive(Equal(kpml.NewResponse(kpml.StatusTimerExpired, "12", ""))))
+
+			req.Pattern.EnterKey = "#"
+			c, err = kpml.NewCollector(req, report)
+			Expect(err).ToNot(HaveOccurred())
+			c.Digit("7")
+			c.Digit("#")
+			var res *kpml.Response
+			Expect(reports).To(Receive(&res))
+			Expect(res.Digits).To(Equal("7"))
+			Expect(res.ForcedFlush).To(BeTrue())
+		})
+
+		It("should reject invalid regex", func() {
+			_, err := kpml.NewCollector(kpml.NewRequest(kpml.Regex{Value: "[1-"}), report)
+			Expect(err).To(HaveOccurred())
+			_, err = kpml.NewCollector(kpml.NewRequest(kpml.Regex{Value: "E"}), report)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
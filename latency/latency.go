@@ -0,0 +1,158 @@
+// latency package keeps percentiles of time spent by messages in the stages of the server pipeline
+// and logs slow messages with the stage breakdown.
+// Profiler implements gosip.Profiler, so it is passed to gosip.ServerConfig.
+package latency
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// DefaultWindow is a number of the latest samples of each stage used to calculate percentiles.
+const DefaultWindow = 1024
+
+// Config describes profiler options.
+type Config struct {
+	// SlowThreshold is a total processing time of the message logged as slow, zero disables the log.
+	SlowThreshold time.Duration
+	// Window is a number of the latest samples of each stage, default is DefaultWindow.
+	Window int
+}
+
+// Percentiles describes distribution of the stage durations over the latest samples.
+type Percentiles struct {
+	// Count is a total number of samples of the stage.
+	Count uint64
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// Profiler collects durations of the pipeline stages.
+type Profiler interface {
+	gosip.Profiler
+	// Stats returns percentiles of stages passed by messages.
+	Stats() map[gosip.Stage]Percentiles
+	// Reset drops collected samples.
+	Reset()
+}
+
+type window struct {
+	samples []time.Duration
+	next    int
+	count   uint64
+}
+
+func (w *window) add(d time.Duration) {
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next] = d
+	}
+	w.next = (w.next + 1) % cap(w.samples)
+	w.count++
+}
+
+func (w *window) percentiles() Percentiles {
+	sorted := append([]time.Duration(nil), w.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return Percentiles{
+		Count: w.count,
+		P50:   percentile(sorted, 50),
+		P90:   percentile(sorted, 90),
+		P99:   percentile(sorted, 99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+// percentile returns nearest-rank percentile of sorted samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+type profiler struct {
+	slowThreshold time.Duration
+	size          int
+
+	mu      sync.Mutex
+	windows map[gosip.Stage]*window
+
+	log log.Logger
+}
+
+// NewProfiler creates profiler of the pipeline stages.
+func NewProfiler(config Config, logger log.Logger) Profiler {
+	if config.Window <= 0 {
+		config.Window = DefaultWindow
+	}
+
+	p := &profiler{
+		slowThreshold: config.SlowThreshold,
+		size:          config.Window,
+		windows:       make(map[gosip.Stage]*window),
+	}
+	p.log = logger.WithPrefix("latency.Profiler")
+
+	return p
+}
+
+func (p *profiler) Log() log.Logger {
+	return p.log
+}
+
+func (p *profiler) MessageProcessed(msg sip.Message, timings gosip.Timings) {
+	p.mu.Lock()
+	for _, stage := range gosip.Stages {
+		if d := timings.Get(stage); d > 0 {
+			w, ok := p.windows[stage]
+			if !ok {
+				w = &window{samples: make([]time.Duration, 0, p.size)}
+				p.windows[stage] = w
+			}
+			w.add(d)
+		}
+	}
+	p.mu.Unlock()
+
+	if p.slowThreshold > 0 && timings.Total() >= p.slowThreshold {
+		p.Log().WithFields(msg.Fields()).Warnf(
+			"slow SIP message %s processed in %s: parse %s, transaction %s, handler %s, send %s",
+			msg.Short(),
+			timings.Total(),
+			timings.Parse,
+			timings.Transaction,
+			timings.Handler,
+			timings.Send,
+		)
+	}
+}
+
+func (p *profiler) Stats() map[gosip.Stage]Percentiles {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make(map[gosip.Stage]Percentiles, len(p.windows))
+	for stage, w := range p.windows {
+		stats[stage] = w.percentiles()
+	}
+
+	return stats
+}
+
+func (p *profiler) Reset() {
+	p.mu.Lock()
+	p.windows = make(map[gosip.Stage]*window)
+	p.mu.Unlock()
+}
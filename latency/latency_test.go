@@ -0,0 +1,98 @@
+package latency_test
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/latency"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Profiler", func() {
+	var (
+		out      *bytes.Buffer
+		profiler latency.Profiler
+	)
+
+	request := func() sip.Request {
+		return testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: latency-call",
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+	}
+
+	BeforeEach(func() {
+		out = new(bytes.Buffer)
+		logrusLogger := logrus.New()
+		logrusLogger.SetOutput(out)
+		profiler = latency.NewProfiler(latency.Config{
+			SlowThreshold: 100 * time.Millisecond,
+			Window:        100,
+		}, log.NewLogrusLogger(logrusLogger, "main", nil))
+	})
+
+	It("should calculate percentiles of passed stages", func() {
+		req := request()
+		for i := 1; i <= 100; i++ {
+			profiler.MessageProcessed(req, gosip.Timings{
+				Parse:   time.Duration(i) * time.Microsecond,
+				Handler: time.Duration(i) * time.Millisecond,
+			})
+		}
+
+		stats := profiler.Stats()
+		Expect(stats).To(HaveLen(2))
+		Expect(stats[gosip.StageParse]).To(Equal(latency.Percentiles{
+			Count: 100,
+			P50:   50 * time.Microsecond,
+			P90:   90 * time.Microsecond,
+			P99:   99 * time.Microsecond,
+			Max:   100 * time.Microsecond,
+		}))
+		Expect(stats[gosip.StageHandler].P90).To(Equal(90 * time.Millisecond))
+
+		profiler.Reset()
+		Expect(profiler.Stats()).To(BeEmpty())
+	})
+
+	It("should keep the latest samples in the window", func() {
+		req := request()
+		for i := 1; i <= 150; i++ {
+			profiler.MessageProcessed(req, gosip.Timings{Send: time.Duration(i) * time.Millisecond})
+		}
+
+		stats := profiler.Stats()[gosip.StageSend]
+		Expect(stats.Count).To(BeEquivalentTo(150))
+		Expect(stats.P50).To(Equal(100 * time.Millisecond))
+		Expect(stats.Max).To(Equal(150 * time.Millisecond))
+	})
+
+	It("should log slow messages with stage breakdown", func() {
+		req := request()
+		profiler.MessageProcessed(req, gosip.Timings{Parse: time.Millisecond, Handler: 10 * time.Millisecond})
+		Expect(out.String()).To(BeEmpty())
+
+		profiler.MessageProcessed(req, gosip.Timings{
+			Parse:       time.Millisecond,
+			Transaction: 2 * time.Millisecond,
+			Handler:     150 * time.Millisecond,
+		})
+		Expect(out.String()).To(ContainSubstring("slow SIP message sip.Request<"))
+		Expect(out.String()).To(ContainSubstring("processed in 153ms: parse 1ms, transaction 2ms, handler 150ms, send 0s"))
+		Expect(out.String()).To(ContainSubstring("call_id=latency-call"))
+	})
+})
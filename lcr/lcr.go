@@ -0,0 +1,363 @@
+// lcr package implements least-cost routing of calls to outbound trunks.
+// Trunks serving the dialed number are selected by the longest prefix of their rates,
+// ordered by priority, cost and weight, and filtered by time-of-day schedules
+// and live health, like of qualify.Pinger. The Router is a TargetSelector of proxy and B2BUA layers.
+package lcr
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/dialplan"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/proxy"
+	"github.com/ghettovoice/gosip/qualify"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// ErrNoTrunk is returned for numbers without available trunks.
+var ErrNoTrunk = errors.New("no available trunk")
+
+// Rate is the cost of calls to numbers with the prefix through the trunk, empty prefix matches all numbers.
+type Rate struct {
+	Prefix string
+	Cost   float64
+}
+
+// Window is the time of day the trunk is used in.
+type Window struct {
+	// Days of the week, empty means every day.
+	Days []time.Weekday
+	// From and To are times of day like "08:00" and "18:00", To before From spans midnight.
+	// To may be "24:00" for the end of the day, From equal to To covers the whole day.
+	From string
+	To   string
+}
+
+// Trunk is the outbound trunk, like the gateway of the carrier.
+type Trunk struct {
+	Name string
+	// Uri is the address of the trunk, like sip:gw1.carrier.net:5060;transport=tcp.
+	// The user part of the target is replaced by the dialed number.
+	Uri string
+	// Rates select numbers the trunk serves, the rate of the longest prefix gives the cost.
+	Rates []Rate
+	// Priority orders trunks before costs, lower priorities are tried first.
+	Priority int
+	// Weight shares calls between trunks of the same priority and cost, default is 1.
+	Weight int
+	// Schedule limits the trunk to windows, empty schedule uses the trunk all the time.
+	Schedule []Window
+}
+
+// Health reports live availability of trunks.
+type Health interface {
+	Available(uri sip.Uri) bool
+}
+
+// HealthFunc is an adapter to use ordinary function as Health.
+type HealthFunc func(uri sip.Uri) bool
+
+func (f HealthFunc) Available(uri sip.Uri) bool {
+	return f(uri)
+}
+
+// PingerHealth reports trunks marked down by the pinger as unavailable, trunks must be added to the pinger.
+func PingerHealth(pinger qualify.Pinger) Health {
+	return HealthFunc(func(uri sip.Uri) bool {
+		state, ok := pinger.State(uri)
+		return !ok || state.Status != qualify.Down
+	})
+}
+
+// Target is the selected trunk of the call.
+type Target struct {
+	Trunk string
+	Uri   sip.Uri
+	Cost  float64
+}
+
+// TargetSelector selects trunks of requests in order of attempts.
+type TargetSelector interface {
+	Select(req sip.Request) ([]Target, error)
+}
+
+// Config describes router options.
+type Config struct {
+	Trunks []Trunk
+	// Health filters out unavailable trunks, nil treats all trunks as available.
+	Health Health
+	// Location of time-of-day schedules, default is time.Local.
+	Location *time.Location
+	// Number returns the dialed number of the request, default is the user of the Request-URI.
+	// Numbers should be normalized by the dial plan, like dialplan.Plan.Normalize.
+	Number func(req sip.Request) string
+}
+
+// Router is a least-cost router of trunks.
+type Router interface {
+	TargetSelector
+	// SelectNumber returns available trunks of the number at the time in order of attempts.
+	SelectNumber(number string, at time.Time) []Target
+}
+
+type window struct {
+	days     map[time.Weekday]bool
+	from, to time.Duration
+}
+
+type trunk struct {
+	Trunk
+	uri      sip.Uri
+	rates    dialplan.Trie
+	schedule []window
+}
+
+type router struct {
+	trunks   []*trunk
+	health   Health
+	location *time.Location
+	number   func(req sip.Request) string
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	log log.Logger
+}
+
+// NewRouter creates least-cost router.
+func NewRouter(config Config, logger log.Logger) (Router, error) {
+	if config.Location == nil {
+		config.Location = time.Local
+	}
+	if config.Number == nil {
+		config.Number = requestNumber
+	}
+
+	r := &router{
+		health:   config.Health,
+		location: config.Location,
+		number:   config.Number,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, t := range config.Trunks {
+		compiled, err := compileTrunk(t)
+		if err != nil {
+			return nil, fmt.Errorf("trunk %q: %w", t.Name, err)
+		}
+		r.trunks = append(r.trunks, compiled)
+	}
+	r.log = logger.
+		WithPrefix("lcr.Router").
+		WithFields(log.Fields{
+			"router_ptr": fmt.Sprintf("%p", r),
+		})
+
+	return r, nil
+}
+
+func compileTrunk(t Trunk) (*trunk, error) {
+	if t.Weight <= 0 {
+		t.Weight = 1
+	}
+	uri, err := parser.ParseUri(t.Uri)
+	if err != nil {
+		return nil, fmt.Errorf("parse uri: %w", err)
+	}
+
+	compiled := &trunk{Trunk: t, uri: uri, rates: dialplan.NewTrie()}
+	for _, rate := range t.Rates {
+		compiled.rates.Insert(rate.Prefix, rate)
+	}
+	for i, w := range t.Schedule {
+		from, err := parseTimeOfDay(w.From)
+		if err != nil {
+			return nil, fmt.Errorf("schedule window %d: %w", i, err)
+		}
+		to := 24 * time.Hour
+		if w.To != "24:00" {
+			to, err = parseTimeOfDay(w.To)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("schedule window %d: %w", i, err)
+		}
+		compiledWindow := window{from: from, to: to}
+		if len(w.Days) > 0 {
+			compiledWindow.days = make(map[time.Weekday]bool, len(w.Days))
+			for _, day := range w.Days {
+				compiledWindow.days[day] = true
+			}
+		}
+		compiled.schedule = append(compiled.schedule, compiledWindow)
+	}
+
+	return compiled, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (r *router) Log() log.Logger {
+	return r.log
+}
+
+func requestNumber(req sip.Request) string {
+	if recipient := req.Recipient(); recipient != nil && recipient.User() != nil {
+		return recipient.User().String()
+	}
+
+	return ""
+}
+
+func (r *router) Select(req sip.Request) ([]Target, error) {
+	number := r.number(req)
+	if number == "" {
+		return nil, ErrNoTrunk
+	}
+
+	targets := r.SelectNumber(number, timing.Now())
+	if len(targets) == 0 {
+		return nil, ErrNoTrunk
+	}
+	r.Log().WithFields(req.Fields()).Debugf("selected %d trunks of %s for request '%s', the first is %s",
+		len(targets), number, req.Short(), targets[0].Trunk)
+
+	return targets, nil
+}
+
+type candidate struct {
+	*trunk
+	cost float64
+}
+
+func (r *router) SelectNumber(number string, at time.Time) []Target {
+	at = at.In(r.location)
+
+	var candidates []candidate
+	for _, t := range r.trunks {
+		_, value, ok := t.rates.Match(number)
+		if !ok || !t.scheduled(at) {
+			continue
+		}
+		if r.health != nil && !r.health.Available(t.uri) {
+			continue
+		}
+		candidates = append(candidates, candidate{t, value.(Rate).Cost})
+	}
+
+	r.shuffle(candidates)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority < candidates[j].Priority
+		}
+		return candidates[i].cost < candidates[j].cost
+	})
+
+	targets := make([]Target, 0, len(candidates))
+	for _, c := range candidates {
+		uri := c.uri.Clone()
+		uri.SetUser(sip.String{Str: number})
+		targets = append(targets, Target{Trunk: c.Name, Uri: uri, Cost: c.cost})
+	}
+
+	return targets
+}
+
+// shuffle orders candidates randomly by weights, the stable sort keeps the order within the same priority and cost.
+func (r *router) shuffle(candidates []candidate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range candidates {
+		total := 0
+		for _, c := range candidates[i:] {
+			total += c.Weight
+		}
+		n := r.rand.Intn(total)
+		for j := i; j < len(candidates); j++ {
+			if n < candidates[j].Weight {
+				candidates[i], candidates[j] = candidates[j], candidates[i]
+				break
+			}
+			n -= candidates[j].Weight
+		}
+	}
+}
+
+func (t *trunk) scheduled(at time.Time) bool {
+	if len(t.schedule) == 0 {
+		return true
+	}
+
+	day := at.Weekday()
+	offset := time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+	for _, w := range t.schedule {
+		switch {
+		case w.from == w.to:
+			if w.days == nil || w.days[day] {
+				return true
+			}
+		case w.from < w.to:
+			if (w.days == nil || w.days[day]) && offset >= w.from && offset < w.to {
+				return true
+			}
+		case offset >= w.from:
+			if w.days == nil || w.days[day] {
+				return true
+			}
+		case offset < w.to:
+			// the window started the day before
+			if w.days == nil || w.days[(day+6)%7] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// TargetSet returns the proxy target set that tries trunks sequentially by their order,
+// set proxy.Config.Forking to proxy.Sequential. Requests without trunks are rejected with 503 Service Unavailable.
+func TargetSet(selector TargetSelector) proxy.TargetSet {
+	return proxy.TargetSetFunc(func(req sip.Request) ([]proxy.Target, error) {
+		targets, err := selector.Select(req)
+		if err != nil {
+			if errors.Is(err, ErrNoTrunk) {
+				return nil, sip.NewRequestError(503, "Service Unavailable", req, nil)
+			}
+			return nil, err
+		}
+
+		proxyTargets := make([]proxy.Target, 0, len(targets))
+		for i, target := range targets {
+			// q values keep the order of attempts
+			proxyTargets = append(proxyTargets, proxy.Target{Uri: target.Uri, Q: 1 - float32(i)/float32(len(targets))})
+		}
+
+		return proxyTargets, nil
+	})
+}
+
+// Route returns the route of b2bua.Config.Route, the call is sent to the first selected trunk.
+func Route(selector TargetSelector) func(req sip.Request) (sip.Uri, error) {
+	return func(req sip.Request) (sip.Uri, error) {
+		targets, err := selector.Select(req)
+		if err != nil {
+			return nil, err
+		}
+
+		return targets[0].Uri, nil
+	}
+}
@@ -0,0 +1,181 @@
+package lcr_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/lcr"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Router", func() {
+	logger := testutils.NewLogrusLogger()
+	// Monday
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	trunks := []lcr.Trunk{
+		{
+			Name:  "cheap",
+			Uri:   "sip:gw.cheap.example.com",
+			Rates: []lcr.Rate{{Prefix: "+1", Cost: 0.01}, {Prefix: "+44", Cost: 0.02}},
+		},
+		{
+			Name:  "premium",
+			Uri:   "sip:gw.premium.example.com;transport=tcp",
+			Rates: []lcr.Rate{{Prefix: "+", Cost: 0.05}, {Prefix: "+1", Cost: 0.005}},
+			// premium is used only at night on weekdays
+			Schedule: []lcr.Window{{
+				Days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+				From: "22:00",
+				To:   "06:00",
+			}},
+		},
+		{
+			Name:     "backup",
+			Uri:      "sip:gw.backup.example.com",
+			Rates:    []lcr.Rate{{Cost: 0.001}},
+			Priority: 1,
+		},
+	}
+
+	names := func(targets []lcr.Target) []string {
+		result := make([]string, 0, len(targets))
+		for _, target := range targets {
+			result = append(result, target.Trunk)
+		}
+		return result
+	}
+
+	It("should order trunks by priority and cost of the longest prefix", func() {
+		r, err := lcr.NewRouter(lcr.Config{Trunks: trunks, Location: time.UTC}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		targets := r.SelectNumber("+12125550100", noon)
+		Expect(names(targets)).To(Equal([]string{"cheap", "backup"}))
+		Expect(targets[0].Uri.String()).To(Equal("sip:+12125550100@gw.cheap.example.com"))
+		Expect(targets[0].Cost).To(Equal(0.01))
+
+		// the night window of premium started on Monday
+		targets = r.SelectNumber("+12125550100", noon.Add(14*time.Hour))
+		Expect(names(targets)).To(Equal([]string{"premium", "cheap", "backup"}))
+		Expect(targets[0].Uri.String()).To(Equal("sip:+12125550100@gw.premium.example.com;transport=tcp"))
+
+		Expect(names(r.SelectNumber("+33123456789", noon.Add(14*time.Hour)))).To(Equal([]string{"premium", "backup"}))
+		// Saturday night
+		Expect(names(r.SelectNumber("+33123456789", noon.Add(5*24*time.Hour+14*time.Hour)))).To(Equal([]string{"backup"}))
+	})
+
+	It("should use trunks all day by windows of the whole day", func() {
+		r, err := lcr.NewRouter(lcr.Config{Trunks: []lcr.Trunk{
+			{
+				Name:     "weekend",
+				Uri:      "sip:weekend.example.com",
+				Rates:    []lcr.Rate{{Cost: 0.01}},
+				Schedule: []lcr.Window{{Days: []time.Weekday{time.Saturday, time.Sunday}, From: "00:00", To: "00:00"}},
+			},
+			{
+				Name:     "evening",
+				Uri:      "sip:evening.example.com",
+				Rates:    []lcr.Rate{{Cost: 0.02}},
+				Schedule: []lcr.Window{{From: "18:00", To: "24:00"}},
+			},
+		}, Location: time.UTC}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// Saturday
+		saturday := noon.Add(5 * 24 * time.Hour)
+		Expect(names(r.SelectNumber("+12125550100", saturday.Add(-12*time.Hour)))).To(Equal([]string{"weekend"}))
+		Expect(names(r.SelectNumber("+12125550100", saturday))).To(Equal([]string{"weekend"}))
+		Expect(names(r.SelectNumber("+12125550100", saturday.Add(11*time.Hour+59*time.Minute)))).To(Equal([]string{"weekend", "evening"}))
+		// Monday
+		Expect(names(r.SelectNumber("+12125550100", noon))).To(BeEmpty())
+		Expect(names(r.SelectNumber("+12125550100", noon.Add(11*time.Hour+59*time.Minute)))).To(Equal([]string{"evening"}))
+		Expect(names(r.SelectNumber("+12125550100", noon.Add(12*time.Hour)))).To(BeEmpty())
+	})
+
+	It("should skip unavailable trunks", func() {
+		r, err := lcr.NewRouter(lcr.Config{
+			Trunks:   trunks,
+			Location: time.UTC,
+			Health: lcr.HealthFunc(func(uri sip.Uri) bool {
+				return uri.Host() != "gw.cheap.example.com"
+			}),
+		}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(names(r.SelectNumber("+12125550100", noon))).To(Equal([]string{"backup"}))
+	})
+
+	It("should share calls between trunks by weights", func() {
+		r, err := lcr.NewRouter(lcr.Config{Trunks: []lcr.Trunk{
+			{Name: "a", Uri: "sip:a.example.com", Rates: []lcr.Rate{{Cost: 0.01}}, Weight: 3},
+			{Name: "b", Uri: "sip:b.example.com", Rates: []lcr.Rate{{Cost: 0.01}}, Weight: 1},
+		}}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		first := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			targets := r.SelectNumber("+12125550100", noon)
+			Expect(targets).To(HaveLen(2))
+			first[targets[0].Trunk]++
+		}
+		Expect(first["a"]).To(BeNumerically("~", 750, 80))
+	})
+
+	It("should select trunks of requests by the proxy target set and the B2BUA route", func() {
+		r, err := lcr.NewRouter(lcr.Config{Trunks: trunks, Location: time.UTC}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		request := func(uri string) sip.Request {
+			return testutils.Request([]string{
+				"INVITE " + uri + " SIP/2.0",
+				"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK.abc",
+				"From: <sip:alice@example.com>;tag=alice-tag",
+				"To: <" + uri + ">",
+				"Call-ID: call-1",
+				"CSeq: 1 INVITE",
+				"Content-Length: 0",
+				"",
+				"",
+			})
+		}
+
+		targets, err := lcr.TargetSet(r).Targets(request("sip:+442079460000@sbc.example.com"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(targets).To(HaveLen(len(r.SelectNumber("+442079460000", time.Now()))))
+		for i := 1; i < len(targets); i++ {
+			Expect(targets[i].Q).To(BeNumerically("<", targets[i-1].Q))
+		}
+
+		uri, err := lcr.Route(r)(request("sip:+442079460000@sbc.example.com"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(uri.User().String()).To(Equal("+442079460000"))
+
+		r, err = lcr.NewRouter(lcr.Config{Trunks: trunks[:1]}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = lcr.TargetSet(r).Targets(request("sip:+33123456789@sbc.example.com"))
+		Expect(err).To(BeAssignableToTypeOf(&sip.RequestError{}))
+	})
+
+	It("should reject invalid trunks", func() {
+		_, err := lcr.NewRouter(lcr.Config{Trunks: []lcr.Trunk{{Name: "a", Uri: "gw.example.com"}}}, logger)
+		Expect(err).Should(HaveOccurred())
+
+		_, err = lcr.NewRouter(lcr.Config{Trunks: []lcr.Trunk{{
+			Name:     "a",
+			Uri:      "sip:gw.example.com",
+			Schedule: []lcr.Window{{From: "8am", To: "18:00"}},
+		}}}, logger)
+		Expect(err).Should(HaveOccurred())
+
+		_, err = lcr.NewRouter(lcr.Config{Trunks: []lcr.Trunk{{
+			Name:     "a",
+			Uri:      "sip:gw.example.com",
+			Schedule: []lcr.Window{{From: "24:00", To: "06:00"}},
+		}}}, logger)
+		Expect(err).Should(HaveOccurred())
+	})
+})
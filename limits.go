@@ -0,0 +1,97 @@
+package gosip
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+const (
+	DefaultMaxHeaders      = 128
+	DefaultMaxHeaderLength = 4096
+	DefaultMaxUriLength    = 1024
+)
+
+// MessageLimit names the limit of MessageLimits.
+type MessageLimit = parser.Limit
+
+const (
+	LimitHeaders      = parser.LimitHeaders
+	LimitHeaderLength = parser.LimitHeaderLength
+	LimitUriLength    = parser.LimitUriLength
+)
+
+// MessageLimits bounds headers of incoming messages against header bombing,
+// like thousands of Via or Record-Route headers that inflate state of transactions and dialogs.
+// Limits are enforced by transports while messages are framed, so headers over limits are neither buffered nor parsed,
+// and messages over limits are not passed to the transaction layer.
+// Requests with too many headers or too long header are answered statelessly with '513 Message Too Large',
+// requests with too long Request-URI with '414 Request-URI Too Long'
+// and requests with too long URI of address headers, like From, To, Contact or Route, with '400 Bad Request'.
+// Responses over limits are dropped. Violations are reported to the Observer implementing LimitObserver.
+// The size of the whole message is bounded by transports.
+type MessageLimits struct {
+	// MaxHeaders is the max number of header fields, default is DefaultMaxHeaders.
+	MaxHeaders int
+	// MaxHeaderLength is the max length of the header field, default is DefaultMaxHeaderLength.
+	MaxHeaderLength int
+	// MaxUriLength is the max length of Request-URI and URIs of address headers, default is DefaultMaxUriLength.
+	MaxUriLength int
+}
+
+// MessageLimitError describes the message over MessageLimits.
+type MessageLimitError = parser.LimitError
+
+func (limits MessageLimits) parserLimits() parser.Limits {
+	if limits.MaxHeaders <= 0 {
+		limits.MaxHeaders = DefaultMaxHeaders
+	}
+	if limits.MaxHeaderLength <= 0 {
+		limits.MaxHeaderLength = DefaultMaxHeaderLength
+	}
+	if limits.MaxUriLength <= 0 {
+		limits.MaxUriLength = DefaultMaxUriLength
+	}
+
+	return parser.Limits{
+		MaxHeaders:      limits.MaxHeaders,
+		MaxHeaderLength: limits.MaxHeaderLength,
+		MaxUriLength:    limits.MaxUriLength,
+	}
+}
+
+// setMessageLimits configures limits of all protocols of the transport layer.
+func (srv *server) setMessageLimits(limits MessageLimits) {
+	for _, network := range []string{"udp", "tcp", "tls", "ws", "wss"} {
+		if limitable, ok := srv.protocol(network).(transport.Limitable); ok {
+			limitable.SetMessageLimits(limits.parserLimits())
+		} else {
+			srv.Log().Debugf("configure %s message limits failed: protocol does not limit incoming messages", network)
+		}
+	}
+}
+
+// rejectOverLimit answers the request over limits statelessly.
+func (srv *server) rejectOverLimit(err *MessageLimitError) {
+	if observer, ok := srv.observer.(LimitObserver); ok {
+		observer.LimitExceeded(err)
+	}
+
+	req, ok := err.Msg.(sip.Request)
+	if !ok || req.IsAck() {
+		return
+	}
+
+	var res sip.Response
+	switch {
+	case err.Limit == LimitUriLength && err.Header == "":
+		res = sip.NewReply(req, 414, "Request-URI Too Long", "")
+	case err.Limit == LimitUriLength:
+		res = sip.NewReply(req, 400, "Bad Request", "")
+	default:
+		res = sip.NewReply(req, 513, "Message Too Large", "")
+	}
+	if err := srv.tp.Send(res); err != nil {
+		srv.Log().Errorf("respond '%d %s' on request over limits failed: %s", res.StatusCode(), res.Reason(), err)
+	}
+}
@@ -0,0 +1,533 @@
+// load package generates SIP load with the stack, like SIPp uac and uas scenarios,
+// to measure performance of transport, parser and transaction layers and to size deployments.
+// Generator places calls or registrations at the configured rate, UAS answers them.
+// cmd/sipload is a command line tool of this package.
+package load
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// Scenario is a scenario of the generator.
+type Scenario string
+
+const (
+	// UAC places calls: INVITE with SDP offer, ACK, hold for Config.CallHold and BYE.
+	UAC Scenario = "uac"
+	// Register sends REGISTER of Config.Users distinct AORs, like registration storm after the outage.
+	Register Scenario = "register"
+)
+
+const (
+	DefaultRate         = 10
+	DefaultRampInterval = time.Second
+	DefaultConcurrency  = 100
+	DefaultTimeout      = 32 * time.Second
+	DefaultCallee       = "service"
+	DefaultExpires      = time.Hour
+)
+
+// Config describes generator options.
+type Config struct {
+	Scenario Scenario
+	// Target is host:port of the UAS, proxy or registrar.
+	Target string
+	// Transport is a transport of requests, default is UDP.
+	Transport string
+	// Domain is a host of AORs, default is the host of Target.
+	Domain string
+	// Contact is host:port of the local listener placed in Contact headers.
+	Contact string
+	// Users is a number of distinct callers or registered AORs 'sipload-N', default is 1.
+	Users int
+	// Callee is a user part of Request-URI of calls, default is DefaultCallee.
+	Callee string
+	// Authorizer answers challenges of the target, like sip.DigestAuthorizer.
+	Authorizer sip.Authorizer
+
+	// Rate is an initial number of calls or registrations per second, default is DefaultRate.
+	Rate float64
+	// RateStep increases rate every RampInterval until MaxRate, zero keeps the rate constant.
+	RateStep float64
+	// RampInterval is an interval of rate increase, default is DefaultRampInterval.
+	RampInterval time.Duration
+	// MaxRate limits rate ramp, zero is unlimited.
+	MaxRate float64
+	// Concurrency limits calls or registrations in progress, default is DefaultConcurrency.
+	Concurrency int
+	// Total is a number of calls or registrations, zero is unlimited until the run is canceled.
+	Total int
+
+	// CallHold is a duration of the answered call before BYE.
+	CallHold time.Duration
+	// Expires is an expiration interval of registrations, default is DefaultExpires.
+	Expires time.Duration
+	// Timeout limits the single call or registration, default is DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Report describes results of the load.
+type Report struct {
+	Scenario Scenario
+	Elapsed  time.Duration
+	// Rate is a number of started calls or registrations per second.
+	Rate      float64
+	Started   int
+	Succeeded int
+	Failed    int
+	// Codes counts final responses of INVITE or REGISTER, transport errors and timeouts are counted with zero code.
+	Codes map[sip.StatusCode]int
+	// Response time from the request to the final response.
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+func (r Report) String() string {
+	codes := make([]int, 0, len(r.Codes))
+	for code := range r.Codes {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	parts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		parts = append(parts, fmt.Sprintf("%d=%d", code, r.Codes[sip.StatusCode(code)]))
+	}
+
+	return fmt.Sprintf(
+		"%s: elapsed %s, rate %.1f/s, started %d, succeeded %d, failed %d, codes [%s], "+
+			"response time p50 %s, p90 %s, p99 %s, max %s",
+		r.Scenario,
+		r.Elapsed.Round(time.Millisecond),
+		r.Rate,
+		r.Started,
+		r.Succeeded,
+		r.Failed,
+		strings.Join(parts, " "),
+		r.P50,
+		r.P90,
+		r.P99,
+		r.Max,
+	)
+}
+
+// stats accumulates results of calls or registrations.
+type stats struct {
+	mu        sync.Mutex
+	scenario  Scenario
+	start     time.Time
+	finish    time.Time
+	started   int
+	succeeded int
+	failed    int
+	codes     map[sip.StatusCode]int
+	times     []time.Duration
+}
+
+func newStats(scenario Scenario) *stats {
+	return &stats{
+		scenario: scenario,
+		start:    time.Now(),
+		codes:    make(map[sip.StatusCode]int),
+	}
+}
+
+func (s *stats) begin() {
+	s.mu.Lock()
+	s.started++
+	s.mu.Unlock()
+}
+
+func (s *stats) end(code sip.StatusCode, responseTime time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.codes[code]++
+	if responseTime > 0 {
+		s.times = append(s.times, responseTime)
+	}
+	if ok {
+		s.succeeded++
+	} else {
+		s.failed++
+	}
+}
+
+// stop freezes elapsed time of the finished run.
+func (s *stats) stop() {
+	s.mu.Lock()
+	s.finish = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *stats) report() Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	finish := s.finish
+	if finish.IsZero() {
+		finish = time.Now()
+	}
+
+	r := Report{
+		Scenario:  s.scenario,
+		Elapsed:   finish.Sub(s.start),
+		Started:   s.started,
+		Succeeded: s.succeeded,
+		Failed:    s.failed,
+		Codes:     make(map[sip.StatusCode]int, len(s.codes)),
+	}
+	if r.Elapsed > 0 {
+		r.Rate = float64(r.Started) / r.Elapsed.Seconds()
+	}
+	for code, count := range s.codes {
+		r.Codes[code] = count
+	}
+
+	if len(s.times) > 0 {
+		sorted := append([]time.Duration(nil), s.times...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		r.P50 = percentile(sorted, 50)
+		r.P90 = percentile(sorted, 90)
+		r.P99 = percentile(sorted, 99)
+		r.Max = sorted[len(sorted)-1]
+	}
+
+	return r
+}
+
+// percentile returns nearest-rank percentile of sorted samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// Generator places calls or registrations with rate ramping.
+type Generator interface {
+	// Run generates load until Config.Total is reached or ctx is canceled,
+	// then waits for calls and registrations in progress.
+	Run(ctx context.Context) Report
+	// Report returns intermediate results of the run.
+	Report() Report
+}
+
+type generator struct {
+	requester gosip.RequestSender
+	config    Config
+
+	mu    sync.Mutex
+	stats *stats
+
+	log log.Logger
+}
+
+// NewGenerator creates load generator sending requests through the requester.
+func NewGenerator(requester gosip.RequestSender, config Config, logger log.Logger) (Generator, error) {
+	if config.Scenario != UAC && config.Scenario != Register {
+		return nil, fmt.Errorf("unsupported scenario '%s'", config.Scenario)
+	}
+	host, _, err := net.SplitHostPort(config.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target '%s': %w", config.Target, err)
+	}
+	if _, _, err := net.SplitHostPort(config.Contact); err != nil {
+		return nil, fmt.Errorf("invalid contact '%s': %w", config.Contact, err)
+	}
+	if config.Transport == "" {
+		config.Transport = "udp"
+	}
+	if config.Domain == "" {
+		config.Domain = host
+	}
+	if config.Users <= 0 {
+		config.Users = 1
+	}
+	if config.Callee == "" {
+		config.Callee = DefaultCallee
+	}
+	if config.Rate <= 0 {
+		config.Rate = DefaultRate
+	}
+	if config.RampInterval <= 0 {
+		config.RampInterval = DefaultRampInterval
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = DefaultConcurrency
+	}
+	if config.Expires <= 0 {
+		config.Expires = DefaultExpires
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	g := &generator{
+		requester: requester,
+		config:    config,
+		stats:     newStats(config.Scenario),
+	}
+	g.log = logger.
+		WithPrefix("load.Generator").
+		WithFields(log.Fields{
+			"scenario": config.Scenario,
+			"target":   config.Target,
+		})
+
+	return g, nil
+}
+
+func (g *generator) Log() log.Logger {
+	return g.log
+}
+
+func (g *generator) Report() Report {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.stats.report()
+}
+
+func (g *generator) Run(ctx context.Context) Report {
+	st := newStats(g.config.Scenario)
+	g.mu.Lock()
+	g.stats = st
+	g.mu.Unlock()
+
+	g.Log().Infof("start load at %.1f/s", g.config.Rate)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, g.config.Concurrency)
+	rate := g.config.Rate
+	next := time.Now()
+	nextRamp := next.Add(g.config.RampInterval)
+
+loop:
+	for n := 0; g.config.Total == 0 || n < g.config.Total; n++ {
+		select {
+		case <-ctx.Done():
+			break loop
+		case slots <- struct{}{}:
+		}
+
+		if delay := time.Until(next); delay > 0 {
+			select {
+			case <-ctx.Done():
+				<-slots
+				break loop
+			case <-timing.After(delay):
+			}
+		}
+
+		wg.Add(1)
+		go func(n int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			g.attempt(st, n)
+		}(n)
+
+		if g.config.RateStep != 0 && !time.Now().Before(nextRamp) {
+			rate += g.config.RateStep
+			if g.config.MaxRate > 0 && rate > g.config.MaxRate {
+				rate = g.config.MaxRate
+			}
+			nextRamp = nextRamp.Add(g.config.RampInterval)
+			g.Log().Debugf("ramp load to %.1f/s", rate)
+		}
+		next = next.Add(time.Duration(float64(time.Second) / rate))
+	}
+
+	wg.Wait()
+	st.stop()
+
+	report := st.report()
+	g.Log().Info(report.String())
+
+	return report
+}
+
+func (g *generator) attempt(st *stats, n int) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.config.Timeout)
+	defer cancel()
+
+	st.begin()
+
+	user := fmt.Sprintf("sipload-%d", n%g.config.Users)
+	var (
+		code         sip.StatusCode
+		responseTime time.Duration
+		err          error
+	)
+	switch g.config.Scenario {
+	case UAC:
+		code, responseTime, err = g.call(ctx, user)
+	case Register:
+		code, responseTime, err = g.register(ctx, user)
+	}
+	if err != nil {
+		g.Log().Debugf("%s of %s failed: %s", g.config.Scenario, user, err)
+	}
+
+	st.end(code, responseTime, err == nil)
+}
+
+func (g *generator) call(ctx context.Context, user string) (sip.StatusCode, time.Duration, error) {
+	req, err := g.newRequest(sip.INVITE, user, g.config.Callee)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "Content-Type", Contents: "application/sdp"})
+	req.SetBody(sdp(g.config.Contact), true)
+
+	start := time.Now()
+	dlg, res, err := dialog.NewInvite(req, g.requester, dialog.InviteConfig{
+		Authorizer: g.config.Authorizer,
+	}, g.Log()).Send(ctx)
+	responseTime := time.Since(start)
+	if err != nil {
+		return errorCode(err), responseTime, err
+	}
+	defer dlg.Terminate()
+
+	if g.config.CallHold > 0 {
+		select {
+		case <-ctx.Done():
+			return res.StatusCode(), responseTime, ctx.Err()
+		case <-timing.After(g.config.CallHold):
+		}
+	}
+
+	bye, err := dlg.NewRequest(sip.BYE, "")
+	if err != nil {
+		return res.StatusCode(), responseTime, err
+	}
+	if _, err := g.requester.RequestWithContext(ctx, bye); err != nil {
+		return res.StatusCode(), responseTime, fmt.Errorf("BYE failed: %w", err)
+	}
+
+	return res.StatusCode(), responseTime, nil
+}
+
+func (g *generator) register(ctx context.Context, user string) (sip.StatusCode, time.Duration, error) {
+	req, err := g.newRequest(sip.REGISTER, user, user)
+	if err != nil {
+		return 0, 0, err
+	}
+	expires := sip.Expires(uint32(g.config.Expires / time.Second))
+	req.AppendHeader(&expires)
+
+	var options []gosip.RequestWithContextOption
+	if g.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(g.config.Authorizer))
+	}
+
+	start := time.Now()
+	res, err := g.requester.RequestWithContext(ctx, req, options...)
+	responseTime := time.Since(start)
+	if err != nil {
+		return errorCode(err), responseTime, err
+	}
+
+	return res.StatusCode(), responseTime, nil
+}
+
+func (g *generator) newRequest(method sip.RequestMethod, from, to string) (sip.Request, error) {
+	var recipient string
+	if method == sip.REGISTER {
+		recipient = fmt.Sprintf("sip:%s;transport=%s", g.config.Target, g.config.Transport)
+	} else {
+		recipient = fmt.Sprintf("sip:%s@%s;transport=%s", to, g.config.Target, g.config.Transport)
+	}
+	recipientUri, err := parser.ParseUri(recipient)
+	if err != nil {
+		return nil, err
+	}
+	fromUri, err := parser.ParseUri(fmt.Sprintf("sip:%s@%s", from, g.config.Domain))
+	if err != nil {
+		return nil, err
+	}
+	toUri, err := parser.ParseUri(fmt.Sprintf("sip:%s@%s", to, g.config.Domain))
+	if err != nil {
+		return nil, err
+	}
+	contactUri, err := parser.ParseUri(fmt.Sprintf("sip:%s@%s;transport=%s", from, g.config.Contact, g.config.Transport))
+	if err != nil {
+		return nil, err
+	}
+
+	maxForwards := sip.MaxForwards(70)
+	callID := sip.CallID(util.RandString(32))
+	hdrs := []sip.Header{
+		sip.ViaHeader{
+			&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       strings.ToUpper(g.config.Transport),
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			},
+		},
+		&maxForwards,
+		&sip.FromHeader{
+			Address: fromUri,
+			Params:  sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)}),
+		},
+		&sip.ToHeader{
+			Address: toUri,
+			Params:  sip.NewParams(),
+		},
+		&callID,
+		&sip.CSeq{SeqNo: 1, MethodName: method},
+		&sip.ContactHeader{Address: contactUri},
+	}
+
+	return sip.NewRequest("", method, recipientUri, "SIP/2.0", hdrs, "", nil), nil
+}
+
+// errorCode returns status code of the failed request, zero for transport errors and timeouts.
+func errorCode(err error) sip.StatusCode {
+	var reqErr *sip.RequestError
+	if errors.As(err, &reqErr) {
+		return sip.StatusCode(reqErr.Code)
+	}
+
+	return 0
+}
+
+// sdp returns minimal audio session description of the load, media is not sent.
+func sdp(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+
+	return strings.Join([]string{
+		"v=0",
+		"o=sipload 1 1 IN IP4 " + host,
+		"s=sipload",
+		"c=IN IP4 " + host,
+		"t=0 0",
+		"m=audio 6000 RTP/AVP 0",
+		"a=rtpmap:0 PCMU/8000",
+		"",
+	}, "\r\n")
+}
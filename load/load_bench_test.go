@@ -0,0 +1,93 @@
+package load_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/load"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+const (
+	benchUACAddr = "127.0.0.1:5172"
+	benchUASAddr = "127.0.0.1:5173"
+)
+
+// benchmarkScenario runs b.N calls or registrations between two servers over the loopback,
+// so it measures transport, parser and transaction layers of both sides.
+func benchmarkScenario(b *testing.B, network string, scenario load.Scenario) {
+	logger := testutils.NewLogrusLogger()
+
+	uasSrv := gosip.NewServer(gosip.ServerConfig{Host: "127.0.0.1"}, nil, nil, logger)
+	defer uasSrv.Shutdown()
+	if err := uasSrv.Listen(network, benchUASAddr); err != nil {
+		b.Fatal(err)
+	}
+	if err := load.NewUAS(load.UASConfig{}, logger).Serve(uasSrv); err != nil {
+		b.Fatal(err)
+	}
+
+	uacSrv := gosip.NewServer(gosip.ServerConfig{Host: "127.0.0.1"}, nil, nil, logger)
+	defer uacSrv.Shutdown()
+	if err := uacSrv.Listen(network, benchUACAddr); err != nil {
+		b.Fatal(err)
+	}
+
+	config := load.Config{
+		Scenario:    scenario,
+		Target:      benchUASAddr,
+		Transport:   network,
+		Contact:     benchUACAddr,
+		Users:       1000,
+		Rate:        1e6,
+		Concurrency: 50,
+		Total:       b.N,
+		Timeout:     5 * time.Second,
+	}
+
+	// warm up opens the connection, so the benchmark measures the steady state
+	warmUp := config
+	warmUp.Total = 1
+	gen, err := load.NewGenerator(uacSrv, warmUp, logger)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if report := gen.Run(context.Background()); report.Failed > 0 {
+		b.Fatalf("warm up failed: %s", report)
+	}
+
+	gen, err = load.NewGenerator(uacSrv, config, logger)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	report := gen.Run(context.Background())
+
+	b.StopTimer()
+	if report.Failed > 0 {
+		b.Fatalf("%d of %d failed: %s", report.Failed, report.Started, report)
+	}
+	b.ReportMetric(report.Rate, "ops/s")
+	b.ReportMetric(float64(report.P99.Microseconds()), "p99-us")
+}
+
+func BenchmarkUAC_UDP(b *testing.B) {
+	benchmarkScenario(b, "udp", load.UAC)
+}
+
+func BenchmarkUAC_TCP(b *testing.B) {
+	benchmarkScenario(b, "tcp", load.UAC)
+}
+
+func BenchmarkRegister_UDP(b *testing.B) {
+	benchmarkScenario(b, "udp", load.Register)
+}
+
+func BenchmarkRegister_TCP(b *testing.B) {
+	benchmarkScenario(b, "tcp", load.Register)
+}
@@ -0,0 +1,112 @@
+package load_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/load"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+const (
+	uacAddr = "127.0.0.1:5170"
+	uasAddr = "127.0.0.1:5171"
+)
+
+var _ = Describe("Load", func() {
+	var (
+		uacSrv gosip.Server
+		uasSrv gosip.Server
+		uas    load.UAS
+	)
+
+	logger := testutils.NewLogrusLogger()
+
+	BeforeEach(func() {
+		uacSrv = gosip.NewServer(gosip.ServerConfig{Host: "127.0.0.1"}, nil, nil, logger)
+		Expect(uacSrv.Listen("udp", uacAddr)).To(Succeed())
+		uasSrv = gosip.NewServer(gosip.ServerConfig{Host: "127.0.0.1"}, nil, nil, logger)
+		Expect(uasSrv.Listen("udp", uasAddr)).To(Succeed())
+
+		uas = load.NewUAS(load.UASConfig{}, logger)
+		Expect(uas.Serve(uasSrv)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		uacSrv.Shutdown()
+		uasSrv.Shutdown()
+	})
+
+	It("should reject unknown scenario and invalid addresses", func() {
+		_, err := load.NewGenerator(uacSrv, load.Config{Scenario: "uas", Target: uasAddr, Contact: uacAddr}, logger)
+		Expect(err).To(HaveOccurred())
+		_, err = load.NewGenerator(uacSrv, load.Config{Scenario: load.UAC, Target: "127.0.0.1", Contact: uacAddr}, logger)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should place calls to the UAS", func() {
+		gen, err := load.NewGenerator(uacSrv, load.Config{
+			Scenario: load.UAC,
+			Target:   uasAddr,
+			Contact:  uacAddr,
+			Rate:     50,
+			Total:    10,
+			CallHold: 10 * time.Millisecond,
+			Timeout:  5 * time.Second,
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		report := gen.Run(context.Background())
+		Expect(report.Started).To(Equal(10))
+		Expect(report.Succeeded).To(Equal(10))
+		Expect(report.Failed).To(BeZero())
+		Expect(report.Codes).To(HaveKeyWithValue(BeEquivalentTo(200), 10))
+		Expect(report.Max).To(BeNumerically(">", 0))
+		Expect(gen.Report()).To(Equal(report))
+
+		uasReport := uas.Report()
+		Expect(uasReport.Succeeded).To(Equal(10))
+	}, 10)
+
+	It("should run registration storm with rate ramp", func() {
+		gen, err := load.NewGenerator(uacSrv, load.Config{
+			Scenario: load.Register,
+			Target:   uasAddr,
+			Contact:  uacAddr,
+			Users:    5,
+			Rate:     20,
+			RateStep: 20,
+			Total:    20,
+			Timeout:  5 * time.Second,
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		report := gen.Run(context.Background())
+		Expect(report.Succeeded).To(Equal(20))
+		Expect(report.Codes).To(HaveKeyWithValue(BeEquivalentTo(200), 20))
+		Expect(report.String()).To(HavePrefix("register: "))
+	}, 10)
+
+	It("should stop load when the context is canceled", func() {
+		gen, err := load.NewGenerator(uacSrv, load.Config{
+			Scenario: load.Register,
+			Target:   uasAddr,
+			Contact:  uacAddr,
+			Rate:     10,
+			Timeout:  5 * time.Second,
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+
+		report := gen.Run(ctx)
+		Expect(report.Started).To(BeNumerically(">=", 1))
+		Expect(report.Started).To(BeNumerically("<=", 4))
+		Expect(report.Failed).To(BeZero())
+	}, 10)
+})
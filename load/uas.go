@@ -0,0 +1,153 @@
+package load
+
+import (
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// UASConfig describes UAS options.
+type UASConfig struct {
+	// RingTime is a delay between 180 and the final response of INVITE, zero answers immediately without 180.
+	RingTime time.Duration
+	// Code is a final response of INVITE, default is 200. Non-2xx codes test failure paths.
+	Code sip.StatusCode
+}
+
+// UAS answers calls and registrations of the generator, like SIPp uas scenario.
+// INVITE is answered with Config.Code, BYE, REGISTER and OPTIONS are answered with 200.
+type UAS interface {
+	// Serve registers request handlers on the server.
+	Serve(srv gosip.Server) error
+	// Report returns results of handled INVITE and REGISTER requests, response time is a handling time of INVITE.
+	Report() Report
+}
+
+type uas struct {
+	config UASConfig
+	stats  *stats
+
+	log log.Logger
+}
+
+// NewUAS creates load UAS.
+func NewUAS(config UASConfig, logger log.Logger) UAS {
+	if config.Code == 0 {
+		config.Code = 200
+	}
+
+	u := &uas{
+		config: config,
+		stats:  newStats("uas"),
+	}
+	u.log = logger.WithPrefix("load.UAS")
+
+	return u
+}
+
+func (u *uas) Log() log.Logger {
+	return u.log
+}
+
+func (u *uas) Report() Report {
+	return u.stats.report()
+}
+
+func (u *uas) Serve(srv gosip.Server) error {
+	handlers := map[sip.RequestMethod]gosip.RequestHandler{
+		sip.INVITE:   u.handleInvite,
+		sip.ACK:      func(req sip.Request, tx sip.ServerTransaction) {},
+		sip.BYE:      u.handleOK,
+		sip.OPTIONS:  u.handleOK,
+		sip.REGISTER: u.handleRegister,
+	}
+	for method, handler := range handlers {
+		if err := srv.OnRequest(method, handler); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *uas) handleInvite(req sip.Request, tx sip.ServerTransaction) {
+	start := time.Now()
+	u.stats.begin()
+
+	toTag := util.RandString(8)
+	if u.config.RingTime > 0 {
+		if err := tx.Respond(u.newResponse(req, 180, "Ringing", toTag)); err != nil {
+			u.Log().Debugf("send 180 on %s failed: %s", req.Short(), err)
+		}
+
+		select {
+		case <-tx.Done():
+			u.stats.end(487, time.Since(start), false)
+			return
+		case <-timing.After(u.config.RingTime):
+		}
+	}
+
+	res := u.newResponse(req, u.config.Code, sip.ReasonPhrase(u.config.Code), toTag)
+	if res.IsSuccess() {
+		res.AppendHeader(&sip.GenericHeader{HeaderName: "Content-Type", Contents: "application/sdp"})
+		res.SetBody(sdp(req.Destination()), true)
+	}
+	if err := tx.Respond(res); err != nil {
+		u.Log().Debugf("send %d on %s failed: %s", u.config.Code, req.Short(), err)
+		u.stats.end(0, time.Since(start), false)
+
+		return
+	}
+
+	u.stats.end(u.config.Code, time.Since(start), res.IsSuccess())
+}
+
+func (u *uas) handleRegister(req sip.Request, tx sip.ServerTransaction) {
+	start := time.Now()
+	u.stats.begin()
+
+	res := u.newResponse(req, 200, "OK", util.RandString(8))
+	for _, hdr := range req.GetHeaders("Contact") {
+		res.AppendHeader(hdr.Clone())
+	}
+	for _, hdr := range req.GetHeaders("Expires") {
+		res.AppendHeader(hdr.Clone())
+	}
+	if err := tx.Respond(res); err != nil {
+		u.Log().Debugf("send 200 on %s failed: %s", req.Short(), err)
+		u.stats.end(0, time.Since(start), false)
+
+		return
+	}
+
+	u.stats.end(200, time.Since(start), true)
+}
+
+func (u *uas) handleOK(req sip.Request, tx sip.ServerTransaction) {
+	if err := tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", "")); err != nil {
+		u.Log().Debugf("send 200 on %s failed: %s", req.Short(), err)
+	}
+}
+
+// newResponse creates response with To tag and Contact of the Request-URI, so the UAC sends BYE to the UAS directly.
+func (u *uas) newResponse(req sip.Request, code sip.StatusCode, reason, toTag string) sip.Response {
+	res := sip.NewResponseFromRequest("", req, code, reason, "")
+	if to, ok := res.To(); ok {
+		if to.Params == nil {
+			to.Params = sip.NewParams()
+		}
+		if !to.Params.Has("tag") {
+			to.Params.Add("tag", sip.String{Str: toTag})
+		}
+	}
+	if req.IsInvite() {
+		res.AppendHeader(&sip.ContactHeader{Address: req.Recipient().Clone()})
+	}
+
+	return res
+}
@@ -3,6 +3,7 @@ package log
 import (
 	"fmt"
 	"strings"
+	"sync"
 )
 
 // Logger interface used as base logger throughout the library.
@@ -83,3 +84,44 @@ func AddFieldsFrom(logger Logger, values ...interface{}) Logger {
 	}
 	return logger
 }
+
+// CallIDField is a field of log entries emitted for messages of the call, see sip.Message Fields.
+const CallIDField = "call_id"
+
+var (
+	callLevelsMu sync.RWMutex
+	callLevels   = make(map[string]Level)
+)
+
+// SetCallLevel overrides the level of log entries of the call for targeted debugging,
+// entries are matched by CallIDField.
+func SetCallLevel(callID string, level Level) {
+	callLevelsMu.Lock()
+	callLevels[callID] = level
+	callLevelsMu.Unlock()
+}
+
+// ResetCallLevel removes the level override of the call.
+func ResetCallLevel(callID string) {
+	callLevelsMu.Lock()
+	delete(callLevels, callID)
+	callLevelsMu.Unlock()
+}
+
+// CallLevel returns the level override of the call of the entry fields.
+func CallLevel(fields Fields) (Level, bool) {
+	callLevelsMu.RLock()
+	defer callLevelsMu.RUnlock()
+
+	if len(callLevels) == 0 {
+		return 0, false
+	}
+
+	callID, ok := fields[CallIDField]
+	if !ok {
+		return 0, false
+	}
+	level, ok := callLevels[fmt.Sprint(callID)]
+
+	return level, ok
+}
@@ -1,6 +1,8 @@
 package log
 
 import (
+	"sync"
+
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
@@ -9,6 +11,8 @@ type LogrusLogger struct {
 	log    logrus.Ext1FieldLogger
 	prefix string
 	fields Fields
+	// calls is shared with derived loggers
+	calls *callLoggers
 }
 
 // Level type
@@ -42,6 +46,7 @@ func NewLogrusLogger(logrus logrus.Ext1FieldLogger, prefix string, fields Fields
 		log:    logrus,
 		prefix: prefix,
 		fields: fields,
+		calls:  new(callLoggers),
 	}
 }
 
@@ -120,7 +125,12 @@ func (l *LogrusLogger) Panicf(format string, args ...interface{}) {
 }
 
 func (l *LogrusLogger) WithPrefix(prefix string) Logger {
-	return NewLogrusLogger(l.log, prefix, l.Fields())
+	return &LogrusLogger{
+		log:    l.log,
+		prefix: prefix,
+		fields: l.Fields(),
+		calls:  l.calls,
+	}
 }
 
 func (l *LogrusLogger) Prefix() string {
@@ -128,7 +138,12 @@ func (l *LogrusLogger) Prefix() string {
 }
 
 func (l *LogrusLogger) WithFields(fields Fields) Logger {
-	return NewLogrusLogger(l.log, l.Prefix(), l.Fields().WithFields(fields))
+	return &LogrusLogger{
+		log:    l.log,
+		prefix: l.Prefix(),
+		fields: l.Fields().WithFields(fields),
+		calls:  l.calls,
+	}
 }
 
 func (l *LogrusLogger) Fields() Fields {
@@ -136,11 +151,63 @@ func (l *LogrusLogger) Fields() Fields {
 }
 
 func (l *LogrusLogger) prepareEntry() *logrus.Entry {
-	return l.log.
+	log := logrus.FieldLogger(l.log)
+	if level, ok := CallLevel(l.Fields()); ok {
+		if logger := l.calls.get(l.log, level); logger != nil {
+			log = logger
+		}
+	}
+
+	return log.
 		WithFields(logrus.Fields(l.Fields())).
 		WithField("prefix", l.Prefix())
 }
 
+// callLoggers caches copies of the logrus logger with levels of calls, so the call is logged
+// more or less verbose than the others. Copies are made on the first call of the level,
+// later changes of the output, hooks or formatter of the logrus logger are not applied to them.
+type callLoggers struct {
+	mu      sync.Mutex
+	loggers map[Level]*logrus.Logger
+}
+
+// get returns the copy of the logrus logger with the level, nil if the logger can not be copied.
+func (cl *callLoggers) get(log logrus.Ext1FieldLogger, level Level) logrus.FieldLogger {
+	var base *logrus.Logger
+	switch l := log.(type) {
+	case *logrus.Logger:
+		base = l
+	case *logrus.Entry:
+		base = l.Logger
+	default:
+		return nil
+	}
+
+	cl.mu.Lock()
+	logger, ok := cl.loggers[level]
+	if !ok {
+		logger = &logrus.Logger{
+			Out:          base.Out,
+			Hooks:        base.Hooks,
+			Formatter:    base.Formatter,
+			ReportCaller: base.ReportCaller,
+			Level:        logrus.Level(level),
+			ExitFunc:     base.ExitFunc,
+		}
+		if cl.loggers == nil {
+			cl.loggers = make(map[Level]*logrus.Logger)
+		}
+		cl.loggers[level] = logger
+	}
+	cl.mu.Unlock()
+
+	if entry, ok := log.(*logrus.Entry); ok {
+		return logger.WithFields(entry.Data)
+	}
+
+	return logger
+}
+
 func (l *LogrusLogger) SetLevel(level Level) {
 	if ll, ok := l.log.(*logrus.Logger); ok {
 		ll.SetLevel(logrus.Level(level))
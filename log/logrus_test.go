@@ -0,0 +1,40 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogrusLogger_CallLevel(t *testing.T) {
+	buf := new(bytes.Buffer)
+	base := logrus.New()
+	base.Out = buf
+	base.Level = logrus.InfoLevel
+	logger := NewLogrusLogger(base, "main", nil)
+
+	SetCallLevel("debugged-call", DebugLevel)
+	defer ResetCallLevel("debugged-call")
+	for i := 0; i < 3; i++ {
+		logger.WithPrefix("transport.Layer").
+			WithFields(Fields{CallIDField: "debugged-call"}).
+			Debugf("call debug %d", i)
+	}
+	logger.WithFields(Fields{CallIDField: "other-call"}).Debug("other debug")
+
+	if n := strings.Count(buf.String(), "call debug"); n != 3 {
+		t.Errorf("expected 3 debug entries of the call, got %d:\n%s", n, buf.String())
+	}
+	if strings.Contains(buf.String(), "other debug") {
+		t.Errorf("unexpected debug entry of the other call:\n%s", buf.String())
+	}
+	// derived loggers share the copy of the logrus logger with the level of the call
+	if n := len(logger.calls.loggers); n != 1 {
+		t.Errorf("expected single logger of the call level, got %d", n)
+	}
+	if base.Level != logrus.InfoLevel {
+		t.Errorf("level of the logrus logger is changed to %s", base.Level)
+	}
+}
@@ -0,0 +1,198 @@
+//go:build go1.21
+// +build go1.21
+
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// SlogLogger is Logger adapter of log/slog, fields and prefix are passed as record attributes.
+type SlogLogger struct {
+	log    *slog.Logger
+	prefix string
+	fields Fields
+	// level is shared with derived loggers, negative value means that the handler decides.
+	level *int32
+}
+
+func NewSlogLogger(logger *slog.Logger, prefix string, fields Fields) *SlogLogger {
+	level := int32(-1)
+
+	return &SlogLogger{
+		log:    logger,
+		prefix: prefix,
+		fields: fields,
+		level:  &level,
+	}
+}
+
+func NewDefaultSlogLogger() *SlogLogger {
+	return NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)), "main", nil)
+}
+
+// slogLevel maps the level to slog level, levels without slog equivalent are placed around the nearest one.
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case PanicLevel:
+		return slog.LevelError + 8
+	case FatalLevel:
+		return slog.LevelError + 4
+	case ErrorLevel:
+		return slog.LevelError
+	case WarnLevel:
+		return slog.LevelWarn
+	case InfoLevel:
+		return slog.LevelInfo
+	case DebugLevel:
+		return slog.LevelDebug
+	default:
+		return slog.LevelDebug - 4
+	}
+}
+
+func (l *SlogLogger) Print(args ...interface{}) {
+	l.logMsg(InfoLevel, fmt.Sprint(args...))
+}
+
+func (l *SlogLogger) Printf(format string, args ...interface{}) {
+	l.logMsg(InfoLevel, fmt.Sprintf(format, args...))
+}
+
+func (l *SlogLogger) Trace(args ...interface{}) {
+	l.logMsg(TraceLevel, fmt.Sprint(args...))
+}
+
+func (l *SlogLogger) Tracef(format string, args ...interface{}) {
+	l.logMsg(TraceLevel, fmt.Sprintf(format, args...))
+}
+
+func (l *SlogLogger) Debug(args ...interface{}) {
+	l.logMsg(DebugLevel, fmt.Sprint(args...))
+}
+
+func (l *SlogLogger) Debugf(format string, args ...interface{}) {
+	l.logMsg(DebugLevel, fmt.Sprintf(format, args...))
+}
+
+func (l *SlogLogger) Info(args ...interface{}) {
+	l.logMsg(InfoLevel, fmt.Sprint(args...))
+}
+
+func (l *SlogLogger) Infof(format string, args ...interface{}) {
+	l.logMsg(InfoLevel, fmt.Sprintf(format, args...))
+}
+
+func (l *SlogLogger) Warn(args ...interface{}) {
+	l.logMsg(WarnLevel, fmt.Sprint(args...))
+}
+
+func (l *SlogLogger) Warnf(format string, args ...interface{}) {
+	l.logMsg(WarnLevel, fmt.Sprintf(format, args...))
+}
+
+func (l *SlogLogger) Error(args ...interface{}) {
+	l.logMsg(ErrorLevel, fmt.Sprint(args...))
+}
+
+func (l *SlogLogger) Errorf(format string, args ...interface{}) {
+	l.logMsg(ErrorLevel, fmt.Sprintf(format, args...))
+}
+
+func (l *SlogLogger) Fatal(args ...interface{}) {
+	l.logMsg(FatalLevel, fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+func (l *SlogLogger) Fatalf(format string, args ...interface{}) {
+	l.logMsg(FatalLevel, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (l *SlogLogger) Panic(args ...interface{}) {
+	msg := fmt.Sprint(args...)
+	l.logMsg(PanicLevel, msg)
+	panic(msg)
+}
+
+func (l *SlogLogger) Panicf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	l.logMsg(PanicLevel, msg)
+	panic(msg)
+}
+
+func (l *SlogLogger) WithPrefix(prefix string) Logger {
+	return &SlogLogger{
+		log:    l.log,
+		prefix: prefix,
+		fields: l.Fields(),
+		level:  l.level,
+	}
+}
+
+func (l *SlogLogger) Prefix() string {
+	return l.prefix
+}
+
+func (l *SlogLogger) WithFields(fields Fields) Logger {
+	return &SlogLogger{
+		log:    l.log,
+		prefix: l.Prefix(),
+		fields: l.Fields().WithFields(fields),
+		level:  l.level,
+	}
+}
+
+func (l *SlogLogger) Fields() Fields {
+	return l.fields
+}
+
+// SetLevel sets the level of this logger and loggers derived from it, instead of the level of slog handler.
+func (l *SlogLogger) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+func (l *SlogLogger) enabled(ctx context.Context, level Level) bool {
+	if callLevel, ok := CallLevel(l.Fields()); ok {
+		return level <= callLevel
+	}
+	if loggerLevel := atomic.LoadInt32(l.level); loggerLevel >= 0 {
+		return level <= Level(loggerLevel)
+	}
+
+	return l.log.Handler().Enabled(ctx, slogLevel(level))
+}
+
+func (l *SlogLogger) logMsg(level Level, msg string) {
+	ctx := context.Background()
+	if !l.enabled(ctx, level) {
+		return
+	}
+
+	// skip runtime.Callers, logMsg and the level method
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+
+	record := slog.NewRecord(time.Now(), slogLevel(level), msg, pcs[0])
+	record.AddAttrs(slog.String("prefix", l.Prefix()))
+
+	fields := l.Fields()
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		record.AddAttrs(slog.Any(key, fields[key]))
+	}
+
+	// the handler is called directly, since the level is already checked
+	_ = l.log.Handler().Handle(ctx, record)
+}
@@ -0,0 +1,129 @@
+//go:build go1.21
+// +build go1.21
+
+package log_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/ghettovoice/gosip/log"
+)
+
+func newSlogLogger(level slog.Level) (*log.SlogLogger, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	handler := slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: level})
+
+	return log.NewSlogLogger(slog.New(handler), "main", nil), buf
+}
+
+func slogRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("unexpected record '%s': %s", line, err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestSlogLogger_Attributes(t *testing.T) {
+	logger, buf := newSlogLogger(slog.LevelInfo)
+	logger.WithPrefix("transport.Layer").
+		WithFields(log.Fields{"b": 2, "a": "1"}).
+		Infof("sent %d bytes", 10)
+
+	records := slogRecords(t, buf)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	record := records[0]
+	if record["msg"] != "sent 10 bytes" || record["level"] != "INFO" {
+		t.Errorf("unexpected record %v", record)
+	}
+	if record["prefix"] != "transport.Layer" || record["a"] != "1" || record["b"] != float64(2) {
+		t.Errorf("expected prefix and fields in attributes, got %v", record)
+	}
+	// fields are added in the order of keys after the prefix
+	if line := buf.String(); strings.Index(line, `"prefix"`) > strings.Index(line, `"a"`) ||
+		strings.Index(line, `"a"`) > strings.Index(line, `"b"`) {
+		t.Errorf("unexpected order of attributes %s", line)
+	}
+	if _, ok := logger.Fields()["a"]; ok {
+		t.Errorf("fields of the derived logger are added to the parent")
+	}
+}
+
+func TestSlogLogger_Levels(t *testing.T) {
+	logger, buf := newSlogLogger(slog.LevelInfo)
+	logger.Debug("skipped by handler")
+	logger.Warn("warning")
+	logger.Error("error")
+
+	records := slogRecords(t, buf)
+	if len(records) != 2 || records[0]["level"] != "WARN" || records[1]["level"] != "ERROR" {
+		t.Fatalf("expected WARN and ERROR records, got %v", records)
+	}
+
+	// the level of the adapter is shared with derived loggers and takes precedence over the handler
+	buf.Reset()
+	derived := logger.WithPrefix("derived")
+	logger.SetLevel(log.ErrorLevel)
+	derived.Warn("skipped by adapter")
+	derived.Error("error")
+	if records := slogRecords(t, buf); len(records) != 1 || records[0]["msg"] != "error" {
+		t.Errorf("expected only error record, got %v", records)
+	}
+	logger.SetLevel(log.TraceLevel)
+	derived.Trace("trace")
+	if records := slogRecords(t, buf); len(records) != 2 || records[1]["level"] != "DEBUG-4" {
+		t.Errorf("expected trace record below debug, got %v", records)
+	}
+}
+
+func TestSlogLogger_CallLevel(t *testing.T) {
+	logger, buf := newSlogLogger(slog.LevelInfo)
+	call := logger.WithFields(log.Fields{log.CallIDField: "debugged-call"})
+	other := logger.WithFields(log.Fields{log.CallIDField: "other-call"})
+
+	log.SetCallLevel("debugged-call", log.DebugLevel)
+	defer log.ResetCallLevel("debugged-call")
+	call.Debug("call debug")
+	other.Debug("other debug")
+
+	records := slogRecords(t, buf)
+	if len(records) != 1 || records[0]["msg"] != "call debug" || records[0][log.CallIDField] != "debugged-call" {
+		t.Errorf("expected debug record of the call only, got %v", records)
+	}
+
+	log.ResetCallLevel("debugged-call")
+	call.Debug("call debug")
+	if records := slogRecords(t, buf); len(records) != 1 {
+		t.Errorf("expected no debug records after reset, got %v", records)
+	}
+}
+
+func TestSlogLogger_Panic(t *testing.T) {
+	logger, buf := newSlogLogger(slog.LevelInfo)
+	defer func() {
+		if r := recover(); r != "failed 1" {
+			t.Errorf("expected panic with the message, got %v", r)
+		}
+		if records := slogRecords(t, buf); len(records) != 1 || records[0]["msg"] != "failed 1" {
+			t.Errorf("expected record before panic, got %v", records)
+		}
+	}()
+
+	logger.Panicf("failed %d", 1)
+}
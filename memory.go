@@ -0,0 +1,184 @@
+package gosip
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const (
+	DefaultMemoryInterval   = 100 * time.Millisecond
+	DefaultMemoryRetryAfter = 5 * time.Second
+)
+
+// MemoryConfig describes the memory budget of the server, like the memory available on the small edge device.
+// The heap of the process is sampled periodically and while it exceeds the budget, new out-of-dialog requests
+// are rejected with the error response and Retry-After before transactions are created,
+// so the server sheds load instead of growing until it is killed. Requests within dialogs are always admitted.
+// The usage of the budget is a part of the load of the overload control too.
+type MemoryConfig struct {
+	// Limit is the budget of the Go heap in bytes, it is shared by all servers of the process.
+	Limit uint64
+	// Interval of sampling of the heap, default is DefaultMemoryInterval.
+	// The heap is sampled once for all servers of the process with the shortest interval of their budgets.
+	Interval time.Duration
+	// RejectCode and RejectReason of the response to shed requests, default is '503 Service Unavailable'.
+	RejectCode   sip.StatusCode
+	RejectReason string
+	// RetryAfter is a value of Retry-After header of responses to shed requests, default is DefaultMemoryRetryAfter.
+	RetryAfter time.Duration
+}
+
+// memoryBudget tracks the sampled heap of the process against the budget.
+type memoryBudget struct {
+	config  MemoryConfig
+	sampler *heapSampler
+}
+
+func newMemoryBudget(config MemoryConfig) *memoryBudget {
+	if config.Interval <= 0 {
+		config.Interval = DefaultMemoryInterval
+	}
+	if config.RejectCode == 0 {
+		config.RejectCode = 503
+		config.RejectReason = "Service Unavailable"
+	}
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = DefaultMemoryRetryAfter
+	}
+
+	return &memoryBudget{
+		config:  config,
+		sampler: processHeap,
+	}
+}
+
+// start adds the budget to the sampler of the heap, returned function removes it.
+func (mb *memoryBudget) start() func() {
+	mb.sampler.add(mb)
+
+	return func() {
+		mb.sampler.remove(mb)
+	}
+}
+
+// load returns usage of the budget from 0, it exceeds 1 when the heap is over the budget.
+func (mb *memoryBudget) load() float64 {
+	if mb.config.Limit == 0 {
+		return 0
+	}
+
+	return float64(mb.sampler.load()) / float64(mb.config.Limit)
+}
+
+func (mb *memoryBudget) exceeded() bool {
+	return mb.config.Limit > 0 && mb.sampler.load() > mb.config.Limit
+}
+
+// Admit sheds new out-of-dialog requests while the heap exceeds the budget.
+func (mb *memoryBudget) Admit(req AdmissionRequest) AdmissionDecision {
+	if !mb.exceeded() {
+		return Accept()
+	}
+	if to, ok := req.Request.To(); ok && to.Params != nil && to.Params.Has("tag") {
+		return Accept()
+	}
+
+	return Reject(mb.config.RejectCode, mb.config.RejectReason, &sip.GenericHeader{
+		HeaderName: "Retry-After",
+		Contents:   fmt.Sprintf("%d", int(math.Ceil(mb.config.RetryAfter.Seconds()))),
+	})
+}
+
+// processHeap samples the heap for all memory budgets of the process.
+var processHeap = newHeapSampler(readHeap)
+
+// heapSampler samples the heap on the timer of the timing clock while there are started budgets,
+// with the shortest interval of them.
+type heapSampler struct {
+	read func() uint64
+	heap uint64
+
+	mu       sync.Mutex
+	budgets  map[*memoryBudget]bool
+	interval time.Duration
+	timer    timing.Timer
+	// gen invalidates ticks of stopped timers
+	gen uint64
+}
+
+func newHeapSampler(read func() uint64) *heapSampler {
+	return &heapSampler{
+		read:    read,
+		budgets: make(map[*memoryBudget]bool),
+	}
+}
+
+func (hs *heapSampler) add(mb *memoryBudget) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if len(hs.budgets) == 0 {
+		hs.sample()
+	}
+	hs.budgets[mb] = true
+	if hs.timer == nil || mb.config.Interval < hs.interval {
+		hs.schedule()
+	}
+}
+
+func (hs *heapSampler) remove(mb *memoryBudget) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	delete(hs.budgets, mb)
+	if len(hs.budgets) == 0 && hs.timer != nil {
+		hs.timer.Stop()
+		hs.timer = nil
+		hs.gen++
+	}
+}
+
+// schedule restarts the timer with the shortest interval of the budgets, hs.mu must be held.
+func (hs *heapSampler) schedule() {
+	if hs.timer != nil {
+		hs.timer.Stop()
+	}
+
+	hs.interval = 0
+	for mb := range hs.budgets {
+		if hs.interval == 0 || mb.config.Interval < hs.interval {
+			hs.interval = mb.config.Interval
+		}
+	}
+	hs.gen++
+	gen := hs.gen
+	hs.timer = timing.AfterFunc(hs.interval, func() {
+		hs.tick(gen)
+	})
+}
+
+func (hs *heapSampler) tick(gen uint64) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if gen != hs.gen {
+		return
+	}
+	hs.sample()
+	hs.schedule()
+}
+
+// sample must be called with locked sampler.
+func (hs *heapSampler) sample() {
+	atomic.StoreUint64(&hs.heap, hs.read())
+}
+
+func (hs *heapSampler) load() uint64 {
+	return atomic.LoadUint64(&hs.heap)
+}
@@ -0,0 +1,28 @@
+//go:build go1.16
+// +build go1.16
+
+package gosip
+
+import (
+	"runtime"
+	"runtime/metrics"
+)
+
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// heapSample is reused by readHeap, reads are serialized by the heap sampler.
+var heapSample = []metrics.Sample{{Name: heapObjectsMetric}}
+
+// readHeap returns bytes of heap objects like runtime.MemStats.HeapAlloc,
+// the runtime metric is read without stopping the world.
+func readHeap() uint64 {
+	metrics.Read(heapSample)
+	if heapSample[0].Value.Kind() != metrics.KindUint64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+
+		return stats.HeapAlloc
+	}
+
+	return heapSample[0].Value.Uint64()
+}
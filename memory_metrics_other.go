@@ -0,0 +1,16 @@
+//go:build !go1.16
+// +build !go1.16
+
+package gosip
+
+import (
+	"runtime"
+)
+
+// readHeap returns runtime.MemStats.HeapAlloc.
+func readHeap() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	return stats.HeapAlloc
+}
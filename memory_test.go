@@ -0,0 +1,74 @@
+package gosip
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ghettovoice/gosip/timing"
+)
+
+func TestHeapSampler(t *testing.T) {
+	clock := timing.NewFakeClock(time.Now())
+	timing.SetClock(clock)
+	defer timing.SetClock(nil)
+
+	var reads, heap uint64
+	sampler := newHeapSampler(func() uint64 {
+		atomic.AddUint64(&reads, 1)
+		return atomic.LoadUint64(&heap)
+	})
+	newBudget := func(interval time.Duration) *memoryBudget {
+		mb := newMemoryBudget(MemoryConfig{Limit: 100, Interval: interval})
+		mb.sampler = sampler
+		return mb
+	}
+	waitReads := func(expected uint64) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadUint64(&reads) < expected && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if n := atomic.LoadUint64(&reads); n != expected {
+			t.Fatalf("expected %d reads of the heap, got %d", expected, n)
+		}
+		// the tick stores the sample and reschedules the timer under the lock
+		sampler.mu.Lock()
+		defer sampler.mu.Unlock()
+	}
+
+	atomic.StoreUint64(&heap, 200)
+	slow, fast := newBudget(time.Second), newBudget(100*time.Millisecond)
+	stopSlow := slow.start()
+	stopFast := fast.start()
+	if !slow.exceeded() || !fast.exceeded() {
+		t.Fatalf("expected budgets to be exceeded by the heap sampled on start")
+	}
+	// budgets of all servers share the single timer with the shortest interval
+	if n := clock.Timers(); n != 1 {
+		t.Fatalf("expected single timer of the sampler, got %d", n)
+	}
+
+	atomic.StoreUint64(&heap, 50)
+	clock.Advance(100 * time.Millisecond)
+	waitReads(2)
+	if slow.exceeded() || slow.load() != 0.5 {
+		t.Errorf("expected load 0.5 of the slow budget, got %f", slow.load())
+	}
+
+	stopFast()
+	clock.BlockUntil(1)
+	clock.Advance(100 * time.Millisecond)
+	waitReads(3)
+
+	// the sampler stops with the last budget
+	stopSlow()
+	if n := clock.Timers(); n != 0 {
+		t.Fatalf("expected no timers of the stopped sampler, got %d", n)
+	}
+	clock.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadUint64(&reads); n != 3 {
+		t.Errorf("expected no reads of the stopped sampler, got %d", n)
+	}
+}
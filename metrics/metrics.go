@@ -0,0 +1,256 @@
+// metrics package exposes Prometheus metrics of the SIP stack.
+// Metrics implements gosip.Observer and gosip.Profiler, so it is passed to gosip.ServerConfig
+// and registered into prometheus.Registerer.
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const DefaultNamespace = "gosip"
+
+// DefaultDurationBuckets covers SIP transactions from sub-second non-INVITE ones up to the 64*T1 timeout.
+var DefaultDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 32, 64}
+
+// DefaultStageBuckets covers pipeline stages from microseconds of parsing up to seconds of slow handlers and DNS.
+var DefaultStageBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Config describes metrics options.
+type Config struct {
+	// Namespace is a prefix of metric names, default is DefaultNamespace.
+	Namespace string
+	// ConstLabels are added to all metrics, like the instance name.
+	ConstLabels prometheus.Labels
+	// DurationBuckets are buckets of transaction duration histogram in seconds, default is DefaultDurationBuckets.
+	DurationBuckets []float64
+	// StageBuckets are buckets of pipeline stage duration histogram in seconds, default is DefaultStageBuckets.
+	StageBuckets []float64
+}
+
+// Metrics collects metrics of the server:
+// messages in and out by method and status code, retransmissions, transaction durations,
+// pipeline stage durations, active connections by network, parse errors, limit violations and DNS failures.
+type Metrics interface {
+	gosip.Observer
+	gosip.Profiler
+	gosip.ConnectionObserver
+	prometheus.Collector
+}
+
+type metrics struct {
+	received        *prometheus.CounterVec
+	sent            *prometheus.CounterVec
+	retransmissions *prometheus.CounterVec
+	durations       *prometheus.HistogramVec
+	stages          *prometheus.HistogramVec
+	parseErrors     prometheus.Counter
+	limitErrors     *prometheus.CounterVec
+	dnsFailures     prometheus.Counter
+	connections     *prometheus.Desc
+	countersMu      sync.Mutex
+	counters        map[*connectionCounter]bool
+}
+
+// connectionCounter wraps the counter of the server to remove it by pointer.
+type connectionCounter struct {
+	count func() map[string]int
+}
+
+// NewMetrics creates metrics of the server.
+func NewMetrics(config Config) Metrics {
+	if config.Namespace == "" {
+		config.Namespace = DefaultNamespace
+	}
+	if len(config.DurationBuckets) == 0 {
+		config.DurationBuckets = DefaultDurationBuckets
+	}
+	if len(config.StageBuckets) == 0 {
+		config.StageBuckets = DefaultStageBuckets
+	}
+
+	messageLabels := []string{"method", "code"}
+
+	return &metrics{
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Name:        "messages_received_total",
+			Help:        "Number of received SIP messages, code is empty for requests.",
+			ConstLabels: config.ConstLabels,
+		}, messageLabels),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Name:        "messages_sent_total",
+			Help:        "Number of sent SIP messages including retransmissions, code is empty for requests.",
+			ConstLabels: config.ConstLabels,
+		}, messageLabels),
+		retransmissions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Name:        "retransmissions_total",
+			Help:        "Number of retransmitted SIP messages, code is empty for requests.",
+			ConstLabels: config.ConstLabels,
+		}, messageLabels),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Name:        "transaction_duration_seconds",
+			Help:        "Duration of SIP transactions from creation to termination.",
+			ConstLabels: config.ConstLabels,
+			Buckets:     config.DurationBuckets,
+		}, []string{"method", "side"}),
+		stages: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   config.Namespace,
+			Name:        "stage_duration_seconds",
+			Help:        "Time spent by SIP messages in the stages of the processing pipeline.",
+			ConstLabels: config.ConstLabels,
+			Buckets:     config.StageBuckets,
+		}, []string{"stage", "method"}),
+		parseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Name:        "parse_errors_total",
+			Help:        "Number of malformed incoming SIP messages.",
+			ConstLabels: config.ConstLabels,
+		}),
+		limitErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Name:        "limit_violations_total",
+			Help:        "Number of incoming SIP messages rejected by message limits.",
+			ConstLabels: config.ConstLabels,
+		}, []string{"limit"}),
+		dnsFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   config.Namespace,
+			Name:        "dns_failures_total",
+			Help:        "Number of failed DNS resolutions of outgoing messages.",
+			ConstLabels: config.ConstLabels,
+		}),
+		connections: prometheus.NewDesc(
+			prometheus.BuildFQName(config.Namespace, "", "connections_active"),
+			"Number of open transport connections.",
+			[]string{"network"},
+			config.ConstLabels,
+		),
+		counters: make(map[*connectionCounter]bool),
+	}
+}
+
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.received.Describe(ch)
+	m.sent.Describe(ch)
+	m.retransmissions.Describe(ch)
+	m.durations.Describe(ch)
+	m.stages.Describe(ch)
+	m.parseErrors.Describe(ch)
+	m.limitErrors.Describe(ch)
+	m.dnsFailures.Describe(ch)
+	ch <- m.connections
+}
+
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	m.received.Collect(ch)
+	m.sent.Collect(ch)
+	m.retransmissions.Collect(ch)
+	m.durations.Collect(ch)
+	m.stages.Collect(ch)
+	m.parseErrors.Collect(ch)
+	m.limitErrors.Collect(ch)
+	m.dnsFailures.Collect(ch)
+	for network, count := range m.openConnections() {
+		ch <- prometheus.MustNewConstMetric(m.connections, prometheus.GaugeValue, float64(count), network)
+	}
+}
+
+func (m *metrics) ObserveConnections(count func() map[string]int) func() {
+	counter := &connectionCounter{count}
+	m.countersMu.Lock()
+	m.counters[counter] = true
+	m.countersMu.Unlock()
+
+	return func() {
+		m.countersMu.Lock()
+		delete(m.counters, counter)
+		m.countersMu.Unlock()
+	}
+}
+
+// openConnections sums open connections of observed servers by network.
+func (m *metrics) openConnections() map[string]int {
+	m.countersMu.Lock()
+	counters := make([]*connectionCounter, 0, len(m.counters))
+	for counter := range m.counters {
+		counters = append(counters, counter)
+	}
+	m.countersMu.Unlock()
+
+	counts := make(map[string]int)
+	for _, counter := range counters {
+		for network, count := range counter.count() {
+			counts[network] += count
+		}
+	}
+
+	return counts
+}
+
+func (m *metrics) MessageReceived(msg sip.Message) {
+	m.received.WithLabelValues(messageLabels(msg)...).Inc()
+}
+
+func (m *metrics) MessageSent(msg sip.Message) {
+	m.sent.WithLabelValues(messageLabels(msg)...).Inc()
+}
+
+func (m *metrics) Retransmission(msg sip.Message) {
+	m.retransmissions.WithLabelValues(messageLabels(msg)...).Inc()
+}
+
+func (m *metrics) TransactionCompleted(method sip.RequestMethod, client bool, duration time.Duration) {
+	side := "server"
+	if client {
+		side = "client"
+	}
+
+	m.durations.WithLabelValues(string(method), side).Observe(duration.Seconds())
+}
+
+func (m *metrics) MessageProcessed(msg sip.Message, timings gosip.Timings) {
+	method := messageLabels(msg)[0]
+	for _, stage := range gosip.Stages {
+		if d := timings.Get(stage); d > 0 {
+			m.stages.WithLabelValues(string(stage), method).Observe(d.Seconds())
+		}
+	}
+}
+
+func (m *metrics) ParseError(err error) {
+	m.parseErrors.Inc()
+}
+
+func (m *metrics) LimitExceeded(err *gosip.MessageLimitError) {
+	m.limitErrors.WithLabelValues(string(err.Limit)).Inc()
+}
+
+func (m *metrics) DNSFailure(err error) {
+	m.dnsFailures.Inc()
+}
+
+// messageLabels returns method and code labels, method of the response is taken from CSeq.
+func messageLabels(msg sip.Message) []string {
+	switch msg := msg.(type) {
+	case sip.Request:
+		return []string{string(msg.Method()), ""}
+	case sip.Response:
+		var method string
+		if cseq, ok := msg.CSeq(); ok {
+			method = string(cseq.MethodName)
+		}
+
+		return []string{method, strconv.Itoa(int(msg.StatusCode()))}
+	default:
+		return []string{"", ""}
+	}
+}
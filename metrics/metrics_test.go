@@ -0,0 +1,133 @@
+package metrics_test
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/metrics"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		m        metrics.Metrics
+		registry *prometheus.Registry
+	)
+
+	request := func() sip.Request {
+		return testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: metrics-call",
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+	}
+
+	BeforeEach(func() {
+		m = metrics.NewMetrics(metrics.Config{})
+		registry = prometheus.NewRegistry()
+		Expect(registry.Register(m)).To(Succeed())
+	})
+
+	It("should count messages by method and code", func() {
+		req := request()
+		res := sip.NewResponseFromRequest("", req, 486, "Busy Here", "")
+
+		m.MessageReceived(req)
+		m.MessageSent(res)
+		m.MessageSent(res)
+		m.Retransmission(res)
+		m.ParseError(errors.New("malformed"))
+		m.DNSFailure(errors.New("no such host"))
+
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP gosip_messages_received_total Number of received SIP messages, code is empty for requests.
+# TYPE gosip_messages_received_total counter
+gosip_messages_received_total{code="",method="INVITE"} 1
+# HELP gosip_messages_sent_total Number of sent SIP messages including retransmissions, code is empty for requests.
+# TYPE gosip_messages_sent_total counter
+gosip_messages_sent_total{code="486",method="INVITE"} 2
+# HELP gosip_retransmissions_total Number of retransmitted SIP messages, code is empty for requests.
+# TYPE gosip_retransmissions_total counter
+gosip_retransmissions_total{code="486",method="INVITE"} 1
+# HELP gosip_parse_errors_total Number of malformed incoming SIP messages.
+# TYPE gosip_parse_errors_total counter
+gosip_parse_errors_total 1
+# HELP gosip_dns_failures_total Number of failed DNS resolutions of outgoing messages.
+# TYPE gosip_dns_failures_total counter
+gosip_dns_failures_total 1
+`),
+			"gosip_messages_received_total",
+			"gosip_messages_sent_total",
+			"gosip_retransmissions_total",
+			"gosip_parse_errors_total",
+			"gosip_dns_failures_total",
+		)).To(Succeed())
+	})
+
+	It("should count limit violations apart from parse errors", func() {
+		observer, ok := m.(gosip.LimitObserver)
+		Expect(ok).To(BeTrue())
+		observer.LimitExceeded(&gosip.MessageLimitError{Limit: gosip.LimitHeaders, Value: 200, Max: 128})
+
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP gosip_limit_violations_total Number of incoming SIP messages rejected by message limits.
+# TYPE gosip_limit_violations_total counter
+gosip_limit_violations_total{limit="headers"} 1
+# HELP gosip_parse_errors_total Number of malformed incoming SIP messages.
+# TYPE gosip_parse_errors_total counter
+gosip_parse_errors_total 0
+`),
+			"gosip_limit_violations_total",
+			"gosip_parse_errors_total",
+		)).To(Succeed())
+	})
+
+	It("should observe transaction durations", func() {
+		m.TransactionCompleted(sip.INVITE, true, 300*time.Millisecond)
+		m.TransactionCompleted(sip.BYE, false, 20*time.Millisecond)
+
+		Expect(testutil.CollectAndCount(m, "gosip_transaction_duration_seconds")).To(Equal(2))
+	})
+
+	It("should sum open connections of observed servers only", func() {
+		removeFirst := m.ObserveConnections(func() map[string]int {
+			return map[string]int{"UDP": 1, "TCP": 2}
+		})
+		removeSecond := m.ObserveConnections(func() map[string]int {
+			return map[string]int{"TCP": 3}
+		})
+		defer removeSecond()
+
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP gosip_connections_active Number of open transport connections.
+# TYPE gosip_connections_active gauge
+gosip_connections_active{network="TCP"} 5
+gosip_connections_active{network="UDP"} 1
+`),
+			"gosip_connections_active",
+		)).To(Succeed())
+
+		removeFirst()
+
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP gosip_connections_active Number of open transport connections.
+# TYPE gosip_connections_active gauge
+gosip_connections_active{network="TCP"} 3
+`),
+			"gosip_connections_active",
+		)).To(Succeed())
+	})
+})
@@ -0,0 +1,222 @@
+package gosip
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// HandlerFunc handles the request and responds through the writer, like http.HandlerFunc.
+type HandlerFunc func(w ResponseWriter, req sip.Request)
+
+// Middleware wraps the handler, like authentication, rate limiting or logging of requests.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// ResponseWriter sends responses on the request through its server transaction.
+type ResponseWriter interface {
+	// Tx returns the server transaction of the request, it is nil for 2xx ACK.
+	Tx() sip.ServerTransaction
+	// AddHeader adds the header to each response written later, unless the response already has such header.
+	AddHeader(hdr sip.Header)
+	// Write builds the response on the request and sends it.
+	Write(status sip.StatusCode, reason, body string, headers ...sip.Header) error
+	// WriteResponse sends the prepared response.
+	WriteResponse(res sip.Response) error
+	// Status returns status code of the last written response, zero if nothing is written yet.
+	Status() sip.StatusCode
+}
+
+type responseWriter struct {
+	req sip.Request
+	tx  sip.ServerTransaction
+
+	mu      sync.Mutex
+	headers []sip.Header
+	status  sip.StatusCode
+}
+
+func newResponseWriter(req sip.Request, tx sip.ServerTransaction) *responseWriter {
+	return &responseWriter{
+		req: req,
+		tx:  tx,
+	}
+}
+
+func (w *responseWriter) Tx() sip.ServerTransaction {
+	return w.tx
+}
+
+func (w *responseWriter) AddHeader(hdr sip.Header) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.headers = append(w.headers, hdr)
+}
+
+func (w *responseWriter) Write(status sip.StatusCode, reason, body string, headers ...sip.Header) error {
+	res := sip.NewResponseFromRequest("", w.req, status, reason, body)
+	for _, hdr := range headers {
+		res.AppendHeader(hdr)
+	}
+
+	return w.WriteResponse(res)
+}
+
+func (w *responseWriter) WriteResponse(res sip.Response) error {
+	if w.tx == nil {
+		return fmt.Errorf("request '%s' has no transaction", w.req.Short())
+	}
+
+	w.mu.Lock()
+	headers := append([]sip.Header{}, w.headers...)
+	w.mu.Unlock()
+
+	for _, hdr := range headers {
+		if len(res.GetHeaders(hdr.Name())) == 0 {
+			res.AppendHeader(hdr.Clone())
+		}
+	}
+
+	if err := w.tx.Respond(res); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.status = res.StatusCode()
+	w.mu.Unlock()
+
+	return nil
+}
+
+func (w *responseWriter) Status() sip.StatusCode {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.status
+}
+
+// Mux is a high-level API of the Server that routes requests to handlers by method.
+// Requests of methods without handler are rejected by the Server with 405 and Allow header.
+type Mux interface {
+	// Use adds middleware applied to the requests of all methods, it wraps per-method middleware.
+	Use(middleware ...Middleware)
+	// OnRequest registers the handler of the method wrapped with the middleware.
+	OnRequest(method sip.RequestMethod, handler HandlerFunc, middleware ...Middleware) error
+	OnInvite(handler HandlerFunc, middleware ...Middleware) error
+	OnAck(handler HandlerFunc, middleware ...Middleware) error
+	OnCancel(handler HandlerFunc, middleware ...Middleware) error
+	OnBye(handler HandlerFunc, middleware ...Middleware) error
+	OnRegister(handler HandlerFunc, middleware ...Middleware) error
+	OnOptions(handler HandlerFunc, middleware ...Middleware) error
+	OnMessage(handler HandlerFunc, middleware ...Middleware) error
+	OnSubscribe(handler HandlerFunc, middleware ...Middleware) error
+	OnNotify(handler HandlerFunc, middleware ...Middleware) error
+	OnRefer(handler HandlerFunc, middleware ...Middleware) error
+	OnInfo(handler HandlerFunc, middleware ...Middleware) error
+	OnUpdate(handler HandlerFunc, middleware ...Middleware) error
+}
+
+type mux struct {
+	srv Server
+
+	mu         sync.RWMutex
+	middleware []Middleware
+
+	log log.Logger
+}
+
+// NewMux creates request router of the server.
+func NewMux(srv Server, logger log.Logger) Mux {
+	m := &mux{
+		srv: srv,
+	}
+	m.log = logger.
+		WithPrefix("gosip.Mux").
+		WithFields(log.Fields{
+			"mux_ptr": fmt.Sprintf("%p", m),
+		})
+
+	return m
+}
+
+func (m *mux) Log() log.Logger {
+	return m.log
+}
+
+func (m *mux) Use(middleware ...Middleware) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.middleware = append(m.middleware, middleware...)
+}
+
+func (m *mux) OnRequest(method sip.RequestMethod, handler HandlerFunc, middleware ...Middleware) error {
+	handler = chain(handler, middleware)
+
+	return m.srv.OnRequest(method, func(req sip.Request, tx sip.ServerTransaction) {
+		m.mu.RLock()
+		global := append([]Middleware{}, m.middleware...)
+		m.mu.RUnlock()
+
+		chain(handler, global)(newResponseWriter(req, tx), req)
+	})
+}
+
+// chain wraps the handler with middleware, the first one is the outermost.
+func chain(handler HandlerFunc, middleware []Middleware) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
+
+func (m *mux) OnInvite(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.INVITE, handler, middleware...)
+}
+
+func (m *mux) OnAck(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.ACK, handler, middleware...)
+}
+
+func (m *mux) OnCancel(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.CANCEL, handler, middleware...)
+}
+
+func (m *mux) OnBye(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.BYE, handler, middleware...)
+}
+
+func (m *mux) OnRegister(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.REGISTER, handler, middleware...)
+}
+
+func (m *mux) OnOptions(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.OPTIONS, handler, middleware...)
+}
+
+func (m *mux) OnMessage(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.MESSAGE, handler, middleware...)
+}
+
+func (m *mux) OnSubscribe(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.SUBSCRIBE, handler, middleware...)
+}
+
+func (m *mux) OnNotify(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.NOTIFY, handler, middleware...)
+}
+
+func (m *mux) OnRefer(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.REFER, handler, middleware...)
+}
+
+func (m *mux) OnInfo(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.INFO, handler, middleware...)
+}
+
+func (m *mux) OnUpdate(handler HandlerFunc, middleware ...Middleware) error {
+	return m.OnRequest(sip.UPDATE, handler, middleware...)
+}
@@ -0,0 +1,237 @@
+// mwi package implements "message-summary" event package - RFC 3842.
+package mwi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	EventPackage = "message-summary"
+	ContentType  = "application/simple-message-summary"
+)
+
+// Message context classes - RFC 3458.
+const (
+	Voice      = "voice-message"
+	Fax        = "fax-message"
+	Pager      = "pager-message"
+	Multimedia = "multimedia-message"
+	Text       = "text-message"
+	None       = "none"
+)
+
+// Counts is a number of messages of the single message context class.
+type Counts struct {
+	New       int
+	Old       int
+	NewUrgent int
+	OldUrgent int
+}
+
+func (counts Counts) String() string {
+	str := fmt.Sprintf("%d/%d", counts.New, counts.Old)
+	if counts.NewUrgent > 0 || counts.OldUrgent > 0 {
+		str += fmt.Sprintf(" (%d/%d)", counts.NewUrgent, counts.OldUrgent)
+	}
+
+	return str
+}
+
+// Summary is a simple-message-summary body - RFC 3842 5.2.
+type Summary struct {
+	MessagesWaiting bool
+	// Account is an optional Message-Account URI.
+	Account string
+	// Messages are message counts by context class.
+	Messages map[string]Counts
+	// Headers are optional message headers after the summary, kept as raw text.
+	Headers string
+}
+
+// NewSummary creates summary with voice messages counts.
+func NewSummary(account string, voice Counts) *Summary {
+	return &Summary{
+		MessagesWaiting: voice.New > 0,
+		Account:         account,
+		Messages:        map[string]Counts{Voice: voice},
+	}
+}
+
+// Voice returns voice messages counts.
+func (summary *Summary) Voice() Counts {
+	return summary.Messages[Voice]
+}
+
+func (summary *Summary) String() string {
+	var buf strings.Builder
+
+	waiting := "no"
+	if summary.MessagesWaiting {
+		waiting = "yes"
+	}
+	buf.WriteString("Messages-Waiting: " + waiting + "\r\n")
+	if summary.Account != "" {
+		buf.WriteString("Message-Account: " + summary.Account + "\r\n")
+	}
+
+	classes := make([]string, 0, len(summary.Messages))
+	for class := range summary.Messages {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		buf.WriteString(headerCase(class) + ": " + summary.Messages[class].String() + "\r\n")
+	}
+
+	if summary.Headers != "" {
+		buf.WriteString("\r\n" + summary.Headers)
+	}
+
+	return buf.String()
+}
+
+// ParseSummary parses simple-message-summary body.
+func ParseSummary(body string) (*Summary, error) {
+	summary := &Summary{
+		Messages: make(map[string]Counts),
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	seenStatus := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			if seenStatus {
+				// message headers follow the empty line
+				rest := make([]string, 0)
+				for scanner.Scan() {
+					rest = append(rest, scanner.Text())
+				}
+				summary.Headers = strings.Join(rest, "\r\n")
+				break
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid message summary line '%s'", line)
+		}
+		name, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+
+		switch name {
+		case "messages-waiting":
+			switch strings.ToLower(value) {
+			case "yes":
+				summary.MessagesWaiting = true
+			case "no":
+				summary.MessagesWaiting = false
+			default:
+				return nil, fmt.Errorf("invalid Messages-Waiting value '%s'", value)
+			}
+			seenStatus = true
+		case "message-account":
+			summary.Account = value
+		default:
+			counts, err := parseCounts(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid '%s' counts: %w", name, err)
+			}
+			summary.Messages[name] = counts
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !seenStatus {
+		return nil, fmt.Errorf("Messages-Waiting line not found")
+	}
+
+	return summary, nil
+}
+
+// parses 'new/old (new-urgent/old-urgent)'
+func parseCounts(value string) (Counts, error) {
+	var counts Counts
+
+	main := value
+	urgent := ""
+	if i := strings.Index(value, "("); i >= 0 {
+		main = value[:i]
+		urgent = strings.TrimSuffix(strings.TrimSpace(value[i+1:]), ")")
+	}
+
+	var err error
+	if counts.New, counts.Old, err = parsePair(main); err != nil {
+		return counts, err
+	}
+	if urgent != "" {
+		if counts.NewUrgent, counts.OldUrgent, err = parsePair(urgent); err != nil {
+			return counts, err
+		}
+	}
+
+	return counts, nil
+}
+
+func parsePair(value string) (int, int, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid counts '%s'", value)
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	second, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return first, second, nil
+}
+
+func headerCase(name string) string {
+	parts := strings.Split(name, "-")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+
+	return strings.Join(parts, "-")
+}
+
+// SubscriptionConfig builds subscriber config for the message summary of the account - RFC 3842 4.
+func SubscriptionConfig(subscriber, account *sip.Address, contact *sip.ContactHeader) event.ClientConfig {
+	return event.ClientConfig{
+		From:    subscriber,
+		To:      account,
+		Contact: contact,
+		Event:   event.Event{Package: EventPackage},
+		Accept:  []string{ContentType},
+	}
+}
+
+// ParseNotify decodes message summary of the NOTIFY request.
+// Returns nil summary if NOTIFY has no body.
+func ParseNotify(req sip.Request) (*Summary, error) {
+	if req.Body() == "" {
+		return nil, nil
+	}
+
+	return ParseSummary(req.Body())
+}
+
+// Notify sends message summary to the subscriber.
+func Notify(ctx context.Context, sub event.ServerSubscription, summary *Summary) error {
+	return sub.Notify(ctx, ContentType, summary.String())
+}
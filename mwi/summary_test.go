@@ -0,0 +1,46 @@
+package mwi_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/mwi"
+)
+
+var _ = Describe("Summary", func() {
+	It("should parse RFC 3842 example", func() {
+		summary, err := mwi.ParseSummary("Messages-Waiting: yes\r\n" +
+			"Message-Account: sip:alice@vmail.example.com\r\n" +
+			"Voice-Message: 4/8 (1/2)\r\n" +
+			"\r\n" +
+			"To: <alice@atlanta.example.com>\r\n" +
+			"Subject: carpool tomorrow?\r\n")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(summary.MessagesWaiting).To(BeTrue())
+		Expect(summary.Account).To(Equal("sip:alice@vmail.example.com"))
+		Expect(summary.Voice()).To(Equal(mwi.Counts{New: 4, Old: 8, NewUrgent: 1, OldUrgent: 2}))
+		Expect(summary.Headers).To(ContainSubstring("Subject: carpool tomorrow?"))
+	})
+
+	It("should build summary", func() {
+		summary := mwi.NewSummary("sip:alice@vmail.example.com", mwi.Counts{New: 2, Old: 1})
+		summary.Messages[mwi.Fax] = mwi.Counts{New: 0, Old: 1, OldUrgent: 1}
+		Expect(summary.String()).To(Equal("Messages-Waiting: yes\r\n" +
+			"Message-Account: sip:alice@vmail.example.com\r\n" +
+			"Fax-Message: 0/1 (0/1)\r\n" +
+			"Voice-Message: 2/1\r\n"))
+
+		parsed, err := mwi.ParseSummary(summary.String())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed.Messages).To(Equal(summary.Messages))
+	})
+
+	It("should reject invalid bodies", func() {
+		_, err := mwi.ParseSummary("Voice-Message: 1/2\r\n")
+		Expect(err).To(HaveOccurred())
+		_, err = mwi.ParseSummary("Messages-Waiting: maybe\r\n")
+		Expect(err).To(HaveOccurred())
+		_, err = mwi.ParseSummary("Messages-Waiting: yes\r\nVoice-Message: x/2\r\n")
+		Expect(err).To(HaveOccurred())
+	})
+})
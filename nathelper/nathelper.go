@@ -0,0 +1,295 @@
+// nathelper package fixes messages of clients behind NAT on the inbound side, like nathelper module of Kamailio.
+// Private addresses of Contact URIs and SDP connection lines are replaced by the address the message
+// actually arrived from, and Via of requests gets 'received' and 'rport' params - RFC 3581,
+// so responses and later requests reach the client through its NAT binding.
+package nathelper
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// Mode selects parts of the message to fix.
+type Mode int
+
+const (
+	// FixContact rewrites private host and port of Contact URIs, like fix_nated_contact.
+	FixContact Mode = 1 << iota
+	// FixVia adds 'received' and 'rport' params to the top Via of requests, like force_rport.
+	FixVia
+	// FixSDP rewrites private addresses of 'c=' lines of SDP bodies, like fix_nated_sdp.
+	FixSDP
+
+	FixAll = FixContact | FixVia | FixSDP
+)
+
+// DefaultPrivate lists private networks of RFC 1918 and the shared address space of carrier-grade NAT - RFC 6598.
+var DefaultPrivate = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10"}
+
+// Config describes NAT fixer options.
+type Config struct {
+	// Sources lists networks of NATted clients in CIDR notation or single IP addresses,
+	// messages received from other sources are not modified. Empty fixes messages from all sources.
+	Sources []string
+	// Private lists networks of the addresses that are replaced, default is DefaultPrivate.
+	Private []string
+	// Mode selects parts of the message to fix, default is FixAll.
+	Mode Mode
+}
+
+// Fixer rewrites addresses of messages received from NATted clients.
+type Fixer interface {
+	// Fix rewrites the message received from the source address, returns true if the message is modified.
+	Fix(msg sip.Message) bool
+	// MessageMapper returns mapper of incoming messages for ServerConfig.MsgMapper,
+	// it fixes messages before they are passed to the next mapper, nil next is allowed.
+	MessageMapper(next sip.MessageMapper) sip.MessageMapper
+}
+
+type fixer struct {
+	sources []*net.IPNet
+	private []*net.IPNet
+	mode    Mode
+
+	log log.Logger
+}
+
+// NewFixer creates NAT fixer.
+func NewFixer(config Config, logger log.Logger) (Fixer, error) {
+	sources, err := parseNetworks(config.Sources)
+	if err != nil {
+		return nil, fmt.Errorf("parse sources: %w", err)
+	}
+	if len(config.Private) == 0 {
+		config.Private = DefaultPrivate
+	}
+	private, err := parseNetworks(config.Private)
+	if err != nil {
+		return nil, fmt.Errorf("parse private networks: %w", err)
+	}
+	if config.Mode == 0 {
+		config.Mode = FixAll
+	}
+
+	f := &fixer{
+		sources: sources,
+		private: private,
+		mode:    config.Mode,
+	}
+	f.log = logger.
+		WithPrefix("nathelper.Fixer").
+		WithFields(log.Fields{
+			"nathelper_ptr": fmt.Sprintf("%p", f),
+		})
+
+	return f, nil
+}
+
+func (f *fixer) Log() log.Logger {
+	return f.log
+}
+
+func (f *fixer) MessageMapper(next sip.MessageMapper) sip.MessageMapper {
+	return func(msg sip.Message) sip.Message {
+		f.Fix(msg)
+		if next != nil {
+			return next(msg)
+		}
+
+		return msg
+	}
+}
+
+func (f *fixer) Fix(msg sip.Message) bool {
+	addr, _ := msg.Fields()[transport.ReceivedFromField].(string)
+	if addr == "" {
+		addr = msg.Source()
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || (len(f.sources) > 0 && !contains(f.sources, ip)) {
+		return false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return false
+	}
+
+	fixed := false
+	if f.mode&FixVia != 0 {
+		if req, ok := msg.(sip.Request); ok && f.fixVia(req, ip, sip.Port(port)) {
+			// responses are sent to the source of the request
+			req.SetSource(addr)
+			fixed = true
+		}
+	}
+	if f.mode&FixContact != 0 && f.fixContact(msg, ip, sip.Port(port)) {
+		fixed = true
+	}
+	if f.mode&FixSDP != 0 && f.fixBody(msg, ip) {
+		fixed = true
+	}
+	if fixed {
+		f.Log().WithFields(msg.Fields()).Debugf("fixed NATted message from %s", addr)
+	}
+
+	return fixed
+}
+
+func (f *fixer) fixVia(req sip.Request, ip net.IP, port sip.Port) bool {
+	viaHop, ok := req.ViaHop()
+	if !ok {
+		return false
+	}
+	if viaHop.Params == nil {
+		viaHop.Params = sip.NewParams()
+	}
+
+	sentPort := sip.DefaultPort(viaHop.Transport)
+	if viaHop.Port != nil {
+		sentPort = *viaHop.Port
+	}
+	if net.ParseIP(viaHop.Host).Equal(ip) && sentPort == port {
+		return false
+	}
+
+	viaHop.Params.Add("received", sip.String{Str: ip.String()})
+	viaHop.Params.Add("rport", sip.String{Str: strconv.Itoa(int(port))})
+
+	return true
+}
+
+func (f *fixer) fixContact(msg sip.Message, ip net.IP, port sip.Port) bool {
+	fixed := false
+	for _, hdr := range msg.GetHeaders("Contact") {
+		contact, ok := hdr.(*sip.ContactHeader)
+		if !ok || contact.Address == nil {
+			continue
+		}
+		uri, ok := contact.Address.(*sip.SipUri)
+		if !ok || !f.isPrivate(uri.FHost) {
+			continue
+		}
+
+		uri.FHost = ip.String()
+		uri.FPort = &port
+		fixed = true
+	}
+
+	return fixed
+}
+
+// fixBody rewrites SDP of application/sdp body or the SDP part of multipart body.
+func (f *fixer) fixBody(msg sip.Message, ip net.IP) bool {
+	contentType, ok := msg.ContentType()
+	if !ok || msg.Body() == "" {
+		return false
+	}
+
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType.Value(), ";", 2)[0]))
+	switch {
+	case mediaType == "application/sdp":
+		sdp, ok := f.fixSDP(msg.Body(), ip)
+		if ok {
+			msg.SetBody(sdp, true)
+		}
+
+		return ok
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mp, err := sip.MessageMultipart(msg)
+		if err != nil {
+			return false
+		}
+		part, ok := mp.Part("application/sdp")
+		if !ok {
+			return false
+		}
+		sdp, ok := f.fixSDP(part.Body, ip)
+		if ok {
+			part.Body = sdp
+			sip.SetMessageMultipart(msg, mp)
+		}
+
+		return ok
+	default:
+		return false
+	}
+}
+
+// fixSDP replaces private addresses of session and media connection lines - RFC 4566 5.7.
+func (f *fixer) fixSDP(sdp string, ip net.IP) (string, bool) {
+	addrType := "IP6"
+	if ip.To4() != nil {
+		addrType = "IP4"
+	}
+
+	lines := strings.Split(sdp, "\n")
+	fixed := false
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, "\r")
+		if !strings.HasPrefix(trimmed, "c=") {
+			continue
+		}
+		// c=<nettype> <addrtype> <connection-address>[/<ttl>]
+		fields := strings.Fields(trimmed[2:])
+		if len(fields) != 3 || !f.isPrivate(strings.SplitN(fields[2], "/", 2)[0]) {
+			continue
+		}
+
+		lines[i] = fmt.Sprintf("c=%s %s %s", fields[0], addrType, ip) + line[len(trimmed):]
+		fixed = true
+	}
+
+	return strings.Join(lines, "\n"), fixed
+}
+
+func (f *fixer) isPrivate(host string) bool {
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && contains(f.private, ip)
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
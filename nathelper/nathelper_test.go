@@ -0,0 +1,102 @@
+package nathelper_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/nathelper"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+var _ = Describe("Fixer", func() {
+	var invite sip.Request
+
+	newFixer := func(config nathelper.Config) nathelper.Fixer {
+		fixer, err := nathelper.NewFixer(config, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		return fixer
+	}
+
+	BeforeEach(func() {
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 192.168.1.10:5060;branch=z9hG4bK-alice",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: nathelper-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@192.168.1.10:5060;transport=udp>",
+			"Content-Type: application/sdp",
+			"Content-Length: 0",
+			"",
+			"v=0\r\no=alice 1 1 IN IP4 192.168.1.10\r\ns=-\r\nc=IN IP4 192.168.1.10\r\nt=0 0\r\n" +
+				"m=audio 4000 RTP/AVP 0\r\nc=IN IP4 203.0.113.7\r\n",
+		})
+		invite.SetSource("192.168.1.10:5060")
+		invite.WithFields(log.Fields{transport.ReceivedFromField: "198.51.100.1:61000"})
+	})
+
+	It("should fix Contact, Via and SDP of NATted client", func() {
+		Expect(newFixer(nathelper.Config{}).Fix(invite)).To(BeTrue())
+
+		contact := invite.GetHeaders("Contact")[0].(*sip.ContactHeader)
+		Expect(contact.Address.String()).To(Equal("sip:alice@198.51.100.1:61000;transport=udp"))
+
+		viaHop, _ := invite.ViaHop()
+		received, _ := viaHop.Params.Get("received")
+		Expect(received.String()).To(Equal("198.51.100.1"))
+		rport, _ := viaHop.Params.Get("rport")
+		Expect(rport.String()).To(Equal("61000"))
+		Expect(invite.Source()).To(Equal("198.51.100.1:61000"))
+
+		Expect(invite.Body()).To(ContainSubstring("s=-\r\nc=IN IP4 198.51.100.1\r\n"))
+		Expect(invite.Body()).To(ContainSubstring("o=alice 1 1 IN IP4 192.168.1.10\r\n"))
+		Expect(invite.Body()).To(ContainSubstring("c=IN IP4 203.0.113.7\r\n"))
+		length, _ := invite.ContentLength()
+		Expect(int(*length)).To(Equal(len(invite.Body())))
+	})
+
+	It("should fix only selected parts", func() {
+		Expect(newFixer(nathelper.Config{Mode: nathelper.FixSDP}).Fix(invite)).To(BeTrue())
+
+		contact := invite.GetHeaders("Contact")[0].(*sip.ContactHeader)
+		Expect(contact.Address.String()).To(Equal("sip:alice@192.168.1.10:5060;transport=udp"))
+		Expect(invite.Body()).To(ContainSubstring("c=IN IP4 198.51.100.1"))
+	})
+
+	It("should skip messages from other sources and public addresses", func() {
+		Expect(newFixer(nathelper.Config{Sources: []string{"203.0.113.0/24"}}).Fix(invite)).To(BeFalse())
+
+		res := testutils.Response([]string{
+			"SIP/2.0 200 OK",
+			"Via: SIP/2.0/UDP 198.51.100.1:61000;branch=z9hG4bK-alice",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: nathelper-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:bob@203.0.113.5:5060>",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		res.SetSource("203.0.113.5:5060")
+		Expect(newFixer(nathelper.Config{}).Fix(res)).To(BeFalse())
+	})
+
+	It("should fix messages passed through the message mapper", func() {
+		mapper := newFixer(nathelper.Config{Mode: nathelper.FixContact}).MessageMapper(func(msg sip.Message) sip.Message {
+			contact := msg.GetHeaders("Contact")[0].(*sip.ContactHeader)
+			Expect(contact.Address.Host()).To(Equal("198.51.100.1"))
+			return msg
+		})
+		Expect(mapper(invite)).To(Equal(invite))
+	})
+
+	It("should reject invalid networks", func() {
+		_, err := nathelper.NewFixer(nathelper.Config{Private: []string{"10.0.0.0/33"}}, testutils.NewLogrusLogger())
+		Expect(err).To(HaveOccurred())
+	})
+})
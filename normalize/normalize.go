@@ -0,0 +1,323 @@
+// normalize package repairs raw incoming messages of broken peers before they are parsed strictly,
+// like normalization of Kamailio or the message manipulation of SBCs.
+// Normalizer implements transport.Normalizer, so it is passed to gosip.ServerConfig.Normalizer.
+// Repairs are selected by profiles, known-broken devices get own profiles by their source addresses.
+package normalize
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// Repair selects repairs of the message.
+type Repair int
+
+const (
+	// RepairNulls strips null bytes of the message head and null padding after the message.
+	RepairNulls Repair = 1 << iota
+	// RepairLineEndings replaces bare LF and CR line endings of the message head by CRLF
+	// and terminates the head by the empty line if it is missing.
+	RepairLineEndings
+	// RepairUri escapes characters that are not allowed in the Request-URI - RFC 3261 25.1,
+	// like spaces or '#' of dialed numbers.
+	RepairUri
+	// RepairMaxForwards adds 'Max-Forwards' header to requests without it - RFC 3261 8.1.1.6.
+	RepairMaxForwards
+	// RepairContentLength sets 'Content-Length' header to the actual length of the body of the datagram.
+	RepairContentLength
+
+	RepairAll = RepairNulls | RepairLineEndings | RepairUri | RepairMaxForwards | RepairContentLength
+)
+
+const DefaultMaxForwards = 70
+
+// Profile describes repairs of messages of the kind of peers.
+type Profile struct {
+	// Name of the profile is logged with repaired messages, like the vendor of the device.
+	Name    string
+	Repairs Repair
+	// MaxForwards is the value of added 'Max-Forwards' headers, default is DefaultMaxForwards.
+	MaxForwards int
+}
+
+// Rule applies the profile to messages of sources.
+type Rule struct {
+	// Sources lists networks of peers in CIDR notation or single IP addresses.
+	Sources []string
+	Profile Profile
+}
+
+// Config describes normalizer options.
+type Config struct {
+	// Default profile is applied to messages of sources that are not matched by rules.
+	Default Profile
+	// Rules apply profiles to known-broken devices, the first rule with the network of the source wins.
+	Rules []Rule
+}
+
+// Normalizer repairs raw incoming messages by profiles of their sources.
+type Normalizer interface {
+	transport.Normalizer
+	// Repaired returns the number of repaired messages.
+	Repaired() uint64
+}
+
+type rule struct {
+	sources []*net.IPNet
+	profile Profile
+}
+
+type normalizer struct {
+	def      Profile
+	rules    []rule
+	repaired uint64
+
+	log log.Logger
+}
+
+// NewNormalizer creates normalizer of messages.
+func NewNormalizer(config Config, logger log.Logger) (Normalizer, error) {
+	n := &normalizer{def: withDefaults(config.Default)}
+	for i, r := range config.Rules {
+		sources, err := parseNetworks(r.Sources)
+		if err != nil {
+			return nil, fmt.Errorf("parse sources of rule %d: %w", i, err)
+		}
+		n.rules = append(n.rules, rule{sources, withDefaults(r.Profile)})
+	}
+	n.log = logger.
+		WithPrefix("normalize.Normalizer").
+		WithFields(log.Fields{
+			"normalizer_ptr": fmt.Sprintf("%p", n),
+		})
+
+	return n, nil
+}
+
+func withDefaults(profile Profile) Profile {
+	if profile.MaxForwards <= 0 {
+		profile.MaxForwards = DefaultMaxForwards
+	}
+
+	return profile
+}
+
+func (n *normalizer) Log() log.Logger {
+	return n.log
+}
+
+func (n *normalizer) Repaired() uint64 {
+	return atomic.LoadUint64(&n.repaired)
+}
+
+func (n *normalizer) Normalize(data []byte, source string) []byte {
+	profile := n.profileOf(source)
+	if profile.Repairs == 0 {
+		return data
+	}
+
+	repaired := Apply(data, profile)
+	if !bytes.Equal(repaired, data) {
+		atomic.AddUint64(&n.repaired, 1)
+		n.Log().WithFields(log.Fields{
+			"source_addr": source,
+			"profile":     profile.Name,
+		}).Debug("repaired message")
+	}
+
+	return repaired
+}
+
+// profileOf returns the profile of the source address.
+func (n *normalizer) profileOf(source string) Profile {
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		host = source
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return n.def
+	}
+
+	for _, r := range n.rules {
+		for _, network := range r.sources {
+			if network.Contains(ip) {
+				return r.profile
+			}
+		}
+	}
+
+	return n.def
+}
+
+// Apply repairs the message by the profile, data is not modified.
+func Apply(data []byte, profile Profile) []byte {
+	if profile.Repairs&RepairNulls != 0 {
+		data = bytes.TrimRight(data, "\x00")
+	}
+
+	head, body, ok := splitMessage(data, profile.Repairs&RepairLineEndings != 0)
+	if profile.Repairs&RepairNulls != 0 {
+		head = bytes.Replace(head, []byte{0}, nil, -1)
+	}
+	if profile.Repairs&RepairLineEndings != 0 {
+		head = fixLineEndings(head)
+		ok = true
+	}
+	if !ok {
+		// the head is not terminated and can't be edited safely
+		return data
+	}
+
+	lines := bytes.Split(head, []byte("\r\n"))
+	if len(lines) == 0 || len(lines[0]) == 0 {
+		return data
+	}
+	request := !bytes.HasPrefix(lines[0], []byte("SIP/"))
+
+	if request && profile.Repairs&RepairUri != 0 {
+		lines[0] = escapeRequestUri(lines[0])
+	}
+	if request && profile.Repairs&RepairMaxForwards != 0 && headerIndex(lines, "max-forwards", "") == -1 {
+		hdr := []byte("Max-Forwards: " + strconv.Itoa(profile.MaxForwards))
+		lines = append(lines[:1], append([][]byte{hdr}, lines[1:]...)...)
+	}
+	if profile.Repairs&RepairContentLength != 0 {
+		hdr := []byte("Content-Length: " + strconv.Itoa(len(body)))
+		if i := headerIndex(lines, "content-length", "l"); i != -1 {
+			lines[i] = hdr
+		} else {
+			lines = append(lines, hdr)
+		}
+	}
+
+	msg := make([]byte, 0, len(head)+len(body)+64)
+	msg = append(msg, bytes.Join(lines, []byte("\r\n"))...)
+	msg = append(msg, "\r\n\r\n"...)
+	msg = append(msg, body...)
+
+	return msg
+}
+
+// splitMessage splits the message to the head without the empty line and the body,
+// lenient split accepts LF line endings and the message without the empty line.
+func splitMessage(data []byte, lenient bool) ([]byte, []byte, bool) {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i != -1 {
+		return data[:i], data[i+4:], true
+	}
+	if !lenient {
+		return data, nil, false
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i != -1 {
+		return data[:i], data[i+2:], true
+	}
+
+	return bytes.TrimRight(data, "\r\n"), nil, true
+}
+
+// fixLineEndings replaces bare LF and CR by CRLF.
+func fixLineEndings(head []byte) []byte {
+	fixed := make([]byte, 0, len(head)+16)
+	for i := 0; i < len(head); i++ {
+		switch {
+		case head[i] == '\r' && i+1 < len(head) && head[i+1] == '\n':
+			fixed = append(fixed, '\r', '\n')
+			i++
+		case head[i] == '\r' || head[i] == '\n':
+			fixed = append(fixed, '\r', '\n')
+		default:
+			fixed = append(fixed, head[i])
+		}
+	}
+
+	return fixed
+}
+
+// headerIndex returns index of the first header line of the name or the compact name.
+func headerIndex(lines [][]byte, name, compact string) int {
+	for i, line := range lines[1:] {
+		idx := bytes.IndexByte(line, ':')
+		if idx == -1 {
+			continue
+		}
+		hdrName := string(bytes.ToLower(bytes.TrimSpace(line[:idx])))
+		if hdrName == name || (compact != "" && hdrName == compact) {
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// escapeRequestUri escapes characters of the Request-URI, it is between the method and the SIP version.
+func escapeRequestUri(line []byte) []byte {
+	first := bytes.IndexByte(line, ' ')
+	last := bytes.LastIndexByte(line, ' ')
+	if first == -1 || last <= first {
+		return line
+	}
+
+	uri := bytes.TrimSpace(line[first+1 : last])
+	escaped := make([]byte, 0, len(uri)+16)
+	for _, c := range uri {
+		if uriChar(c) {
+			escaped = append(escaped, c)
+		} else {
+			escaped = append(escaped, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+
+	fixed := make([]byte, 0, len(line)+len(escaped))
+	fixed = append(fixed, line[:first+1]...)
+	fixed = append(fixed, escaped...)
+	fixed = append(fixed, line[last:]...)
+
+	return fixed
+}
+
+// uriChar checks that the character is unreserved, reserved or escape of the SIP URI - RFC 3261 25.1,
+// brackets are allowed for IPv6 references.
+func uriChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+
+	switch c {
+	case '-', '_', '.', '!', '~', '*', '\'', '(', ')',
+		';', '/', '?', ':', '@', '&', '=', '+', '$', ',',
+		'%', '[', ']':
+		return true
+	}
+
+	return false
+}
+
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
@@ -0,0 +1,101 @@
+package normalize_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/normalize"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Normalizer", func() {
+	// broken is a request of the legacy device: LF line endings, the number with '#' in the Request-URI,
+	// no Max-Forwards, wrong Content-Length and null padding
+	broken := strings.Join([]string{
+		"INVITE sip:*21#@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK-broken",
+		"From: <sip:alice@example.com>;tag=alice-tag",
+		"To: <sip:bob@example.com>",
+		"Call-ID: broken-call-id",
+		"CSeq: 1 INVITE",
+		"Content-Type: text/plain",
+		"Content-Length: 100",
+		"",
+		"hello\r\n",
+	}, "\n") + "\x00\x00\x00"
+
+	newNormalizer := func(config normalize.Config) normalize.Normalizer {
+		n, err := normalize.NewNormalizer(config, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		return n
+	}
+	parse := func(data []byte) (sip.Message, error) {
+		return parser.ParseMessage(data, testutils.NewLogrusLogger())
+	}
+
+	It("should repair broken message to be parsed strictly", func() {
+		_, err := parse([]byte(broken))
+		Expect(err).To(HaveOccurred())
+
+		n := newNormalizer(normalize.Config{Default: normalize.Profile{Repairs: normalize.RepairAll}})
+		msg, err := parse(n.Normalize([]byte(broken), "10.0.0.1:5060"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n.Repaired()).To(Equal(uint64(1)))
+
+		req := msg.(sip.Request)
+		Expect(req.Recipient().String()).To(Equal("sip:*21%23@example.com"))
+		hdrs := req.GetHeaders("Max-Forwards")
+		Expect(hdrs).To(HaveLen(1))
+		Expect(hdrs[0].Value()).To(Equal("70"))
+		Expect(req.Body()).To(Equal("hello\r\n"))
+	})
+
+	It("should keep valid message", func() {
+		valid := testutils.Request([]string{
+			"OPTIONS sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK-valid",
+			"Max-Forwards: 70",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: valid-call-id",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}).String()
+
+		n := newNormalizer(normalize.Config{Default: normalize.Profile{Repairs: normalize.RepairAll}})
+		Expect(string(n.Normalize([]byte(valid), "10.0.0.1:5060"))).To(Equal(valid))
+		Expect(n.Repaired()).To(BeZero())
+	})
+
+	It("should keep the body with null bytes", func() {
+		data := "MESSAGE sip:bob@example.com SIP/2.0\r\nMax-Forwards: 70\r\nContent-Length: 3\r\n\r\n\x01\x00\x02"
+
+		Expect(string(normalize.Apply([]byte(data), normalize.Profile{Repairs: normalize.RepairNulls}))).
+			To(Equal(data))
+	})
+
+	It("should repair messages of sources by profiles of rules", func() {
+		n := newNormalizer(normalize.Config{
+			Rules: []normalize.Rule{
+				{Sources: []string{"10.0.0.0/8"}, Profile: normalize.Profile{Name: "legacy-pbx", Repairs: normalize.RepairAll}},
+			},
+		})
+
+		Expect(string(n.Normalize([]byte(broken), "192.168.0.1:5060"))).To(Equal(broken))
+		_, err := parse(n.Normalize([]byte(broken), "10.0.0.1:5060"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject invalid sources", func() {
+		_, err := normalize.NewNormalizer(normalize.Config{
+			Rules: []normalize.Rule{{Sources: []string{"pbx.example.com"}}},
+		}, testutils.NewLogrusLogger())
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,152 @@
+package gosip
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Observer receives events of the server for monitoring, metrics package implements it with Prometheus.
+// Methods are called synchronously from the SIP stack, so they must not block.
+type Observer interface {
+	// MessageReceived is called for each incoming message including retransmissions.
+	MessageReceived(msg sip.Message)
+	// MessageSent is called for each message sent by the transport layer including retransmissions.
+	MessageSent(msg sip.Message)
+	// Retransmission is called for each outgoing message that has been already sent.
+	Retransmission(msg sip.Message)
+	// TransactionCompleted is called when the client or server transaction of the method is terminated.
+	TransactionCompleted(method sip.RequestMethod, client bool, duration time.Duration)
+	// ParseError is called for each malformed incoming message.
+	ParseError(err error)
+	// DNSFailure is called when the destination of the outgoing message can not be resolved.
+	DNSFailure(err error)
+}
+
+// LimitObserver is implemented by observers that count messages over ServerConfig.Limits,
+// they are not reported as parse errors.
+type LimitObserver interface {
+	// LimitExceeded is called for each incoming message over limits.
+	LimitExceeded(err *MessageLimitError)
+}
+
+// ConnectionObserver is implemented by observers that report open connections, like metrics.Metrics.
+// The server adds the counter of its transport layer when it is created and removes it on shutdown,
+// so the observer shared by servers, like tenants, reports connections of running servers only.
+type ConnectionObserver interface {
+	// ObserveConnections adds the counter of open connections by network, remove stops observing it.
+	ObserveConnections(counter func() map[string]int) (remove func())
+}
+
+// Observers combines observers, like metrics and message trace, events are passed to all of them in order.
+func Observers(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+type multiObserver []Observer
+
+func (observers multiObserver) MessageReceived(msg sip.Message) {
+	for _, observer := range observers {
+		observer.MessageReceived(msg)
+	}
+}
+
+func (observers multiObserver) MessageSent(msg sip.Message) {
+	for _, observer := range observers {
+		observer.MessageSent(msg)
+	}
+}
+
+func (observers multiObserver) Retransmission(msg sip.Message) {
+	for _, observer := range observers {
+		observer.Retransmission(msg)
+	}
+}
+
+func (observers multiObserver) TransactionCompleted(method sip.RequestMethod, client bool, duration time.Duration) {
+	for _, observer := range observers {
+		observer.TransactionCompleted(method, client, duration)
+	}
+}
+
+func (observers multiObserver) ParseError(err error) {
+	for _, observer := range observers {
+		observer.ParseError(err)
+	}
+}
+
+func (observers multiObserver) DNSFailure(err error) {
+	for _, observer := range observers {
+		observer.DNSFailure(err)
+	}
+}
+
+func (observers multiObserver) LimitExceeded(err *MessageLimitError) {
+	for _, observer := range observers {
+		if observer, ok := observer.(LimitObserver); ok {
+			observer.LimitExceeded(err)
+		}
+	}
+}
+
+func (observers multiObserver) ObserveConnections(counter func() map[string]int) func() {
+	removes := make([]func(), 0)
+	for _, observer := range observers {
+		if observer, ok := observer.(ConnectionObserver); ok {
+			removes = append(removes, observer.ObserveConnections(counter))
+		}
+	}
+
+	return func() {
+		for _, remove := range removes {
+			remove()
+		}
+	}
+}
+
+// sentMessagesLimit bounds memory of sent message IDs used to detect retransmissions,
+// it covers all transactions alive at typical load.
+const sentMessagesLimit = 4096
+
+// sentMessages remembers recently sent messages, transaction layer retransmits the same message.
+// Messages are identified by ID and Via branch, since copies of the request sent to other targets keep the ID.
+type sentMessages struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	order []string
+	next  int
+}
+
+func newSentMessages() *sentMessages {
+	return &sentMessages{
+		ids:   make(map[string]bool),
+		order: make([]string, sentMessagesLimit),
+	}
+}
+
+// add remembers the message and returns true if it was already sent.
+func (sent *sentMessages) add(msg sip.Message) bool {
+	id := string(msg.MessageID())
+	if viaHop, ok := msg.ViaHop(); ok && viaHop.Params != nil {
+		if branch, ok := viaHop.Params.Get("branch"); ok && branch != nil {
+			id += "/" + branch.String()
+		}
+	}
+
+	sent.mu.Lock()
+	defer sent.mu.Unlock()
+
+	if sent.ids[id] {
+		return true
+	}
+
+	if old := sent.order[sent.next]; old != "" {
+		delete(sent.ids, old)
+	}
+	sent.order[sent.next] = id
+	sent.next = (sent.next + 1) % len(sent.order)
+	sent.ids[id] = true
+
+	return false
+}
@@ -1,6 +1,15 @@
 package gosip
 
-import "github.com/ghettovoice/gosip/sip"
+import (
+	"net"
+
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
+	"github.com/ghettovoice/gosip/transport"
+)
 
 type RequestWithContextOption interface {
 	ApplyRequestWithContext(options *RequestWithContextOptions)
@@ -9,6 +18,15 @@ type RequestWithContextOption interface {
 type RequestWithContextOptions struct {
 	ResponseHandler func(res sip.Response, request sip.Request)
 	Authorizer      sip.Authorizer
+	// Failover enables retry of the request against the next RFC 3263 target
+	// on 503 response, transport error or timeout.
+	Failover bool
+	// FailoverPolicy controls how targets are attempted on failover, nil tries them one by one.
+	FailoverPolicy *FailoverPolicy
+	// Redirect enables recursion on 3xx responses, nil surfaces 3xx response as the request failure.
+	Redirect *RedirectPolicy
+	// UserAgent overrides User-Agent header of the request stamped by the server.
+	UserAgent *string
 }
 
 type withResponseHandler struct {
@@ -34,3 +52,608 @@ func (o withAuthorizer) ApplyRequestWithContext(options *RequestWithContextOptio
 func WithAuthorizer(authorizer sip.Authorizer) RequestWithContextOption {
 	return withAuthorizer{authorizer}
 }
+
+type withFailover struct{}
+
+func (o withFailover) ApplyRequestWithContext(options *RequestWithContextOptions) {
+	options.Failover = true
+}
+
+// WithFailover enables request failover between resolved targets - RFC 3263 4.3.
+func WithFailover() RequestWithContextOption {
+	return withFailover{}
+}
+
+type withFailoverPolicy struct {
+	policy FailoverPolicy
+}
+
+func (o withFailoverPolicy) ApplyRequestWithContext(options *RequestWithContextOptions) {
+	policy := o.policy
+	options.Failover = true
+	options.FailoverPolicy = &policy
+}
+
+// WithFailoverPolicy enables request failover between resolved targets attempted by the policy.
+func WithFailoverPolicy(policy FailoverPolicy) RequestWithContextOption {
+	return withFailoverPolicy{policy}
+}
+
+type withRedirect struct {
+	policy RedirectPolicy
+}
+
+func (o withRedirect) ApplyRequestWithContext(options *RequestWithContextOptions) {
+	options.Redirect = &o.policy
+}
+
+// WithRedirect enables recursion on 3xx responses with the policy - RFC 3261 8.1.3.4.
+func WithRedirect(policy RedirectPolicy) RequestWithContextOption {
+	return withRedirect{policy}
+}
+
+type withRequestUserAgent struct {
+	userAgent string
+}
+
+func (o withRequestUserAgent) ApplyRequestWithContext(options *RequestWithContextOptions) {
+	options.UserAgent = &o.userAgent
+}
+
+// WithRequestUserAgent overrides User-Agent header of the single request, empty value restores the server default.
+func WithRequestUserAgent(userAgent string) RequestWithContextOption {
+	return withRequestUserAgent{userAgent}
+}
+
+// ServerOption configures the server created by New.
+type ServerOption interface {
+	ApplyServer(opts *ServerOptions)
+}
+
+// ServerOptions collect all knobs of the stack, new knobs are added as new options
+// without changes of the New signature.
+type ServerOptions struct {
+	ServerConfig
+	// Listen are addresses the server starts to listen on.
+	Listen []ListenAddr
+	// TLSConfig is applied to TLS and WSS listeners.
+	TLSConfig *transport.TLSConfig
+	// Timers are base values of transaction timers, zero values are replaced by RFC 3261 defaults.
+	Timers transaction.Timers
+	// TimerWheel runs transaction timers on the hierarchical timing wheel instead of runtime timers,
+	// nil uses the current clock of the timing package.
+	TimerWheel *timing.WheelConfig
+	// Logger is a server logger, default is logrus logger.
+	Logger                  log.Logger
+	TransportLayerFactory   TransportLayerFactory
+	TransactionLayerFactory TransactionLayerFactory
+}
+
+// ListenAddr is a listen address of the server.
+type ListenAddr struct {
+	Network string
+	Addr    string
+}
+
+type withConfig struct {
+	config ServerConfig
+}
+
+func (o withConfig) ApplyServer(opts *ServerOptions) {
+	opts.ServerConfig = o.config
+}
+
+// WithConfig replaces the whole server config, so it should go before other options.
+func WithConfig(config ServerConfig) ServerOption {
+	return withConfig{config}
+}
+
+type withHost struct {
+	host string
+}
+
+func (o withHost) ApplyServer(opts *ServerOptions) {
+	opts.Host = o.host
+}
+
+// WithHost sets public IP address or domain name of the server.
+func WithHost(host string) ServerOption {
+	return withHost{host}
+}
+
+type withAdmission struct {
+	admission Admission
+}
+
+func (o withAdmission) ApplyServer(opts *ServerOptions) {
+	opts.Admission = o.admission
+}
+
+// WithAdmission sets the policy of the incoming requests, see Admission.
+func WithAdmission(admission Admission) ServerOption {
+	return withAdmission{admission}
+}
+
+type withTenant struct {
+	tenant string
+}
+
+func (o withTenant) ApplyServer(opts *ServerOptions) {
+	opts.Tenant = o.tenant
+}
+
+// WithTenant sets the tenant of the server, see ServerConfig.Tenant.
+func WithTenant(tenant string) ServerOption {
+	return withTenant{tenant}
+}
+
+type withUserAgent struct {
+	userAgent string
+}
+
+func (o withUserAgent) ApplyServer(opts *ServerOptions) {
+	opts.UserAgent = o.userAgent
+}
+
+// WithUserAgent sets User-Agent and Server header values of the outgoing messages.
+func WithUserAgent(userAgent string) ServerOption {
+	return withUserAgent{userAgent}
+}
+
+type withServerName struct {
+	serverName string
+}
+
+func (o withServerName) ApplyServer(opts *ServerOptions) {
+	opts.ServerName = o.serverName
+}
+
+// WithServerName sets Server header value of the outgoing responses, see ServerConfig.ServerName.
+func WithServerName(serverName string) ServerOption {
+	return withServerName{serverName}
+}
+
+type withHiddenUserAgent struct{}
+
+func (o withHiddenUserAgent) ApplyServer(opts *ServerOptions) {
+	opts.HideUserAgent = true
+}
+
+// WithHiddenUserAgent disables stamping of User-Agent and Server headers, see ServerConfig.HideUserAgent.
+func WithHiddenUserAgent() ServerOption {
+	return withHiddenUserAgent{}
+}
+
+type withExtensions struct {
+	extensions []string
+}
+
+func (o withExtensions) ApplyServer(opts *ServerOptions) {
+	opts.Extensions = append(opts.Extensions, o.extensions...)
+}
+
+// WithExtensions adds option tags of the enabled extensions, see ServerConfig.Extensions.
+func WithExtensions(extensions ...string) ServerOption {
+	return withExtensions{extensions}
+}
+
+type withAccept struct {
+	accept []string
+}
+
+func (o withAccept) ApplyServer(opts *ServerOptions) {
+	opts.Accept = append(opts.Accept, o.accept...)
+}
+
+// WithAccept adds media types of the accepted bodies, see ServerConfig.Accept.
+func WithAccept(mediaTypes ...string) ServerOption {
+	return withAccept{mediaTypes}
+}
+
+type withOptionsResponder struct {
+	responder *OptionsResponder
+}
+
+func (o withOptionsResponder) ApplyServer(opts *ServerOptions) {
+	opts.OptionsResponder = o.responder
+}
+
+// WithOptionsResponder enables built-in answers on OPTIONS requests, see OptionsResponder.
+func WithOptionsResponder(responder OptionsResponder) ServerOption {
+	return withOptionsResponder{&responder}
+}
+
+type withSymmetric struct{}
+
+func (o withSymmetric) ApplyServer(opts *ServerOptions) {
+	opts.Symmetric = true
+}
+
+// WithSymmetric enables symmetric signaling, see ServerConfig.Symmetric.
+func WithSymmetric() ServerOption {
+	return withSymmetric{}
+}
+
+type withCircuitBreaker struct {
+	config BreakerConfig
+}
+
+func (o withCircuitBreaker) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.CircuitBreaker = &config
+}
+
+// WithCircuitBreaker enables circuit breakers of destinations, see ServerConfig.CircuitBreaker.
+func WithCircuitBreaker(config BreakerConfig) ServerOption {
+	return withCircuitBreaker{config}
+}
+
+type withQueue struct {
+	config QueueConfig
+}
+
+func (o withQueue) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.Queue = &config
+}
+
+// WithQueue enables prioritized work queue of request handlers, see ServerConfig.Queue.
+func WithQueue(config QueueConfig) ServerOption {
+	return withQueue{config}
+}
+
+type withOverload struct {
+	config OverloadConfig
+}
+
+func (o withOverload) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.Overload = &config
+}
+
+// WithOverload enables SIP overload control, see ServerConfig.Overload.
+func WithOverload(config OverloadConfig) ServerOption {
+	return withOverload{config}
+}
+
+type withMemory struct {
+	config MemoryConfig
+}
+
+func (o withMemory) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.Memory = &config
+}
+
+// WithMemory enables the memory budget of the server, see ServerConfig.Memory.
+func WithMemory(config MemoryConfig) ServerOption {
+	return withMemory{config}
+}
+
+type withNormalizer struct {
+	normalizer transport.Normalizer
+}
+
+func (o withNormalizer) ApplyServer(opts *ServerOptions) {
+	opts.Normalizer = o.normalizer
+}
+
+// WithNormalizer enables repair of datagrams of broken peers, see ServerConfig.Normalizer.
+func WithNormalizer(normalizer transport.Normalizer) ServerOption {
+	return withNormalizer{normalizer}
+}
+
+type withResponseTranslation struct {
+	config ResponseTranslationConfig
+}
+
+func (o withResponseTranslation) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.ResponseTranslation = &config
+}
+
+// WithResponseTranslation enables translation of responses sent to peers, see ServerConfig.ResponseTranslation.
+func WithResponseTranslation(config ResponseTranslationConfig) ServerOption {
+	return withResponseTranslation{config}
+}
+
+type withResponseRouting struct {
+	config ResponseRoutingConfig
+}
+
+func (o withResponseRouting) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.ResponseRouting = &config
+}
+
+// WithResponseRouting selects addresses of responses to UDP requests, see ServerConfig.ResponseRouting.
+func WithResponseRouting(config ResponseRoutingConfig) ServerOption {
+	return withResponseRouting{config}
+}
+
+type withMessageLimits struct {
+	limits MessageLimits
+}
+
+func (o withMessageLimits) ApplyServer(opts *ServerOptions) {
+	limits := o.limits
+	opts.Limits = &limits
+}
+
+// WithMessageLimits enables limits of headers and URIs of incoming messages, see ServerConfig.Limits.
+func WithMessageLimits(limits MessageLimits) ServerOption {
+	return withMessageLimits{limits}
+}
+
+type withSips struct {
+	policy SipsPolicy
+}
+
+func (o withSips) ApplyServer(opts *ServerOptions) {
+	policy := o.policy
+	opts.Sips = &policy
+}
+
+// WithSips enables enforcement of secure signaling, see ServerConfig.Sips.
+func WithSips(policy SipsPolicy) ServerOption {
+	return withSips{policy}
+}
+
+type withSourceValidation struct {
+	config SourceValidationConfig
+}
+
+func (o withSourceValidation) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.SourceValidation = &config
+}
+
+// WithSourceValidation enables validation of UDP sources, see ServerConfig.SourceValidation.
+func WithSourceValidation(config SourceValidationConfig) ServerOption {
+	return withSourceValidation{config}
+}
+
+type withWsClient struct {
+	config transport.WsClientConfig
+}
+
+func (o withWsClient) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.WsClient = &config
+}
+
+// WithWsClient configures outgoing WebSocket connections, see ServerConfig.WsClient.
+func WithWsClient(config transport.WsClientConfig) ServerOption {
+	return withWsClient{config}
+}
+
+type withTLSClient struct {
+	config transport.TLSClientConfig
+}
+
+func (o withTLSClient) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.TLSClient = &config
+}
+
+// WithTLSClient configures verification of TLS servers, see ServerConfig.TLSClient.
+func WithTLSClient(config transport.TLSClientConfig) ServerOption {
+	return withTLSClient{config}
+}
+
+type withStrayResponseHandler struct {
+	handler transaction.StrayResponseHandler
+}
+
+func (o withStrayResponseHandler) ApplyServer(opts *ServerOptions) {
+	opts.StrayResponseHandler = o.handler
+}
+
+// WithStrayResponseHandler sets handler of stray responses, see ServerConfig.StrayResponseHandler.
+func WithStrayResponseHandler(handler transaction.StrayResponseHandler) ServerOption {
+	return withStrayResponseHandler{handler}
+}
+
+type withListenAddrs struct {
+	addrs []ListenAddr
+}
+
+func (o withListenAddrs) ApplyServer(opts *ServerOptions) {
+	opts.Listen = append(opts.Listen, o.addrs...)
+}
+
+// WithListenAddrs adds addresses the server starts to listen on.
+func WithListenAddrs(addrs ...ListenAddr) ServerOption {
+	return withListenAddrs{addrs}
+}
+
+type withTLSConfig struct {
+	config transport.TLSConfig
+}
+
+func (o withTLSConfig) ApplyServer(opts *ServerOptions) {
+	opts.TLSConfig = &o.config
+}
+
+// WithTLSConfig sets certificate of TLS and WSS listeners.
+func WithTLSConfig(config transport.TLSConfig) ServerOption {
+	return withTLSConfig{config}
+}
+
+type withTimers struct {
+	timers transaction.Timers
+}
+
+func (o withTimers) ApplyServer(opts *ServerOptions) {
+	opts.Timers = o.timers
+}
+
+// WithTimers overrides base values of transaction timers T1, T2, T4.
+func WithTimers(timers transaction.Timers) ServerOption {
+	return withTimers{timers}
+}
+
+type withTimerWheel struct {
+	config timing.WheelConfig
+}
+
+func (o withTimerWheel) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.TimerWheel = &config
+}
+
+// WithTimerWheel runs transaction timers on the hierarchical timing wheel with the tick resolution of the config,
+// it reduces timer pressure of the runtime when hundreds of thousands of transactions are in flight.
+// The wheel is stopped with the transaction layer. It is ignored with WithTransactionLayerFactory.
+func WithTimerWheel(config timing.WheelConfig) ServerOption {
+	return withTimerWheel{config}
+}
+
+type withResolver struct {
+	resolver *net.Resolver
+}
+
+func (o withResolver) ApplyServer(opts *ServerOptions) {
+	opts.Resolver = o.resolver
+}
+
+// WithResolver sets DNS resolver used in RFC 3263 lookups, it takes precedence over ServerConfig.Dns.
+func WithResolver(resolver *net.Resolver) ServerOption {
+	return withResolver{resolver}
+}
+
+type withSecureDNS struct {
+	config transport.SecureDNSConfig
+}
+
+func (o withSecureDNS) ApplyServer(opts *ServerOptions) {
+	config := o.config
+	opts.SecureDNS = &config
+}
+
+// WithSecureDNS sends DNS queries of RFC 3263 lookups to the secure upstream, see ServerConfig.SecureDNS.
+func WithSecureDNS(config transport.SecureDNSConfig) ServerOption {
+	return withSecureDNS{config}
+}
+
+type withLogger struct {
+	logger log.Logger
+}
+
+func (o withLogger) ApplyServer(opts *ServerOptions) {
+	opts.Logger = o.logger
+}
+
+// WithLogger sets logger of the server.
+func WithLogger(logger log.Logger) ServerOption {
+	return withLogger{logger}
+}
+
+type withMetrics struct {
+	observer Observer
+}
+
+func (o withMetrics) ApplyServer(opts *ServerOptions) {
+	opts.Observer = o.observer
+	if profiler, ok := o.observer.(Profiler); ok {
+		opts.Profiler = profiler
+	}
+}
+
+// WithMetrics sets observer of the server events, like metrics.Metrics.
+// The observer is used as Profiler too if it implements the interface.
+func WithMetrics(observer Observer) ServerOption {
+	return withMetrics{observer}
+}
+
+type withACL struct {
+	acl ACL
+}
+
+func (o withACL) ApplyServer(opts *ServerOptions) {
+	opts.ACL = &o.acl
+}
+
+// WithACL restricts sources of the incoming messages.
+func WithACL(acl ACL) ServerOption {
+	return withACL{acl}
+}
+
+type withTracer struct {
+	tracer Tracer
+}
+
+func (o withTracer) ApplyServer(opts *ServerOptions) {
+	opts.Tracer = o.tracer
+}
+
+// WithTracer sets tracer of the messages processed by the server.
+func WithTracer(tracer Tracer) ServerOption {
+	return withTracer{tracer}
+}
+
+type withEventBus struct {
+	bus eventbus.Bus
+}
+
+func (o withEventBus) ApplyServer(opts *ServerOptions) {
+	opts.EventBus = o.bus
+}
+
+// WithEventBus sets the event bus of the server, so events of its transports and transactions
+// are not mixed with events of other servers of the process.
+func WithEventBus(bus eventbus.Bus) ServerOption {
+	return withEventBus{bus}
+}
+
+type withFaultInjector struct {
+	fi transport.FaultInjector
+}
+
+func (o withFaultInjector) ApplyServer(opts *ServerOptions) {
+	opts.FaultInjector = o.fi
+}
+
+// WithFaultInjector breaks connections of the server for resilience testing, see transport.NewFaultInjector.
+func WithFaultInjector(fi transport.FaultInjector) ServerOption {
+	return withFaultInjector{fi}
+}
+
+type withParserWorkers struct {
+	n int
+}
+
+func (o withParserWorkers) ApplyServer(opts *ServerOptions) {
+	opts.ParserWorkers = o.n
+}
+
+// WithParserWorkers sets the number of goroutines parsing datagrams of each packet transport of the server.
+func WithParserWorkers(n int) ServerOption {
+	return withParserWorkers{n}
+}
+
+type withTransportLayerFactory struct {
+	factory TransportLayerFactory
+}
+
+func (o withTransportLayerFactory) ApplyServer(opts *ServerOptions) {
+	opts.TransportLayerFactory = o.factory
+}
+
+// WithTransportLayerFactory replaces the default transport layer.
+func WithTransportLayerFactory(factory TransportLayerFactory) ServerOption {
+	return withTransportLayerFactory{factory}
+}
+
+type withTransactionLayerFactory struct {
+	factory TransactionLayerFactory
+}
+
+func (o withTransactionLayerFactory) ApplyServer(opts *ServerOptions) {
+	opts.TransactionLayerFactory = o.factory
+}
+
+// WithTransactionLayerFactory replaces the default transaction layer, timers are not applied to it.
+func WithTransactionLayerFactory(factory TransactionLayerFactory) ServerOption {
+	return withTransactionLayerFactory{factory}
+}
@@ -0,0 +1,459 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/registration"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	// DefaultKeepAliveInterval is used when the registrar does not return Flow-Timer - RFC 5626 4.4.1.
+	DefaultKeepAliveInterval = 120 * time.Second
+	// DefaultBaseTimeAllFailed is the recovery base time when all flows failed - RFC 5626 4.5.
+	DefaultBaseTimeAllFailed = 30 * time.Second
+	// DefaultBaseTimeNotFailed is the recovery base time when some flows are registered - RFC 5626 4.5.
+	DefaultBaseTimeNotFailed = 90 * time.Second
+	// DefaultMaxRecoveryTime is the upper bound of the recovery wait time - RFC 5626 4.5.
+	DefaultMaxRecoveryTime = 1800 * time.Second
+)
+
+// Pinger sends keep-alive over the flow to the edge proxy.
+type Pinger interface {
+	// Ping returns error if the flow is broken.
+	Ping(ctx context.Context, edge sip.Uri) error
+}
+
+// PingerFunc is an adapter to use ordinary function as Pinger.
+type PingerFunc func(ctx context.Context, edge sip.Uri) error
+
+func (f PingerFunc) Ping(ctx context.Context, edge sip.Uri) error {
+	return f(ctx, edge)
+}
+
+// OptionsPinger sends OPTIONS to the edge proxy, any response means the flow is alive.
+// The transport layer does not expose CRLF and STUN keep-alives of RFC 5626 4.4,
+// OPTIONS sent through the same connection refreshes NAT bindings and detects broken flows as well.
+func OptionsPinger(requester gosip.Requester, from *sip.Address) Pinger {
+	return PingerFunc(func(ctx context.Context, edge sip.Uri) error {
+		fromHdr := from.AsFromHeader()
+		fromHdr.Params = sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)})
+		callID := sip.CallID(util.RandString(32))
+		maxForwards := sip.MaxForwards(70)
+
+		req := sip.NewRequest(
+			"",
+			sip.OPTIONS,
+			edge.Clone(),
+			"SIP/2.0",
+			[]sip.Header{
+				sip.ViaHeader{
+					&sip.ViaHop{
+						ProtocolName:    "SIP",
+						ProtocolVersion: "2.0",
+						Transport:       sip.DefaultProtocol,
+						Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+					},
+				},
+				&maxForwards,
+				fromHdr,
+				&sip.ToHeader{Address: edge.Clone()},
+				&callID,
+				&sip.CSeq{SeqNo: 1, MethodName: sip.OPTIONS},
+			},
+			"",
+			nil,
+		)
+
+		_, err := requester.RequestWithContext(ctx, req)
+		var reqErr *sip.RequestError
+		if errors.As(err, &reqErr) && reqErr.Response != nil {
+			return nil
+		}
+
+		return err
+	})
+}
+
+// FlowChange describes registration state transition of the flow.
+type FlowChange struct {
+	registration.StateChange
+	RegID int
+	Edge  sip.Uri
+}
+
+// FlowState describes current state of the flow.
+type FlowState struct {
+	RegID int
+	Edge  sip.Uri
+	State registration.State
+	// Failures is the number of consecutive registration failures.
+	Failures int
+}
+
+// Config describes outbound client options.
+type Config struct {
+	// Registration is a template of the flow registrations. Contact gets +sip.instance and reg-id params,
+	// Supported header and preloaded Route to the edge proxy are appended to Headers.
+	// OnStateChange and RetryInterval are replaced by the flow recovery.
+	Registration registration.Config
+	// InstanceID is the URN of the UA instance, default is a random 'urn:uuid'.
+	InstanceID string
+	// EdgeProxies is the outbound-proxy-set, one flow is registered through each proxy with reg-id of index + 1.
+	EdgeProxies []sip.Uri
+	// KeepAliveInterval is used when the registrar response has no Flow-Timer, default is DefaultKeepAliveInterval.
+	KeepAliveInterval time.Duration
+	// Pinger sends keep-alives, default is OptionsPinger from the Registration AOR.
+	Pinger Pinger
+	// BaseTimeAllFailed is the recovery base time when all flows failed, default is DefaultBaseTimeAllFailed.
+	BaseTimeAllFailed time.Duration
+	// BaseTimeNotFailed is the recovery base time when some flows are registered, default is DefaultBaseTimeNotFailed.
+	BaseTimeNotFailed time.Duration
+	// MaxRecoveryTime is the upper bound of the recovery wait time, default is DefaultMaxRecoveryTime.
+	MaxRecoveryTime time.Duration
+	// OnFlowChange is called on each registration state transition of the flows.
+	OnFlowChange func(change FlowChange)
+}
+
+// Client maintains registrations of the UA instance through all edge proxies.
+type Client interface {
+	// Register registers all flows, it succeeds if at least one flow is registered.
+	// Failed flows are recovered in background.
+	Register(ctx context.Context) error
+	// Unregister removes all flows and stops keep-alives.
+	Unregister(ctx context.Context) error
+	// Stop cancels keep-alives, recoveries and refreshes without unregistering.
+	Stop()
+	InstanceID() string
+	Flows() []FlowState
+}
+
+type client struct {
+	config Config
+	flows  []*flow
+
+	mu     sync.Mutex
+	active bool
+
+	log log.Logger
+}
+
+// NewClient creates outbound client.
+func NewClient(requester gosip.Requester, config Config, logger log.Logger) Client {
+	if config.InstanceID == "" {
+		config.InstanceID = NewInstanceID()
+	}
+	if config.KeepAliveInterval <= 0 {
+		config.KeepAliveInterval = DefaultKeepAliveInterval
+	}
+	if config.Pinger == nil {
+		config.Pinger = OptionsPinger(requester, config.Registration.AOR)
+	}
+	if config.BaseTimeAllFailed <= 0 {
+		config.BaseTimeAllFailed = DefaultBaseTimeAllFailed
+	}
+	if config.BaseTimeNotFailed <= 0 {
+		config.BaseTimeNotFailed = DefaultBaseTimeNotFailed
+	}
+	if config.MaxRecoveryTime <= 0 {
+		config.MaxRecoveryTime = DefaultMaxRecoveryTime
+	}
+
+	c := &client{
+		config: config,
+	}
+	c.log = logger.
+		WithPrefix("outbound.Client").
+		WithFields(log.Fields{
+			"outbound_ptr": fmt.Sprintf("%p", c),
+			"instance_id":  config.InstanceID,
+		})
+
+	for i, edge := range config.EdgeProxies {
+		f := &flow{
+			c:     c,
+			regID: i + 1,
+			edge:  edge,
+		}
+		f.log = c.Log().WithFields(log.Fields{
+			"reg_id": f.regID,
+			"edge":   edge.String(),
+		})
+		f.reg = registration.NewClient(requester, c.flowConfig(f), logger)
+		c.flows = append(c.flows, f)
+	}
+
+	return c
+}
+
+func (c *client) Log() log.Logger {
+	return c.log
+}
+
+func (c *client) InstanceID() string {
+	return c.config.InstanceID
+}
+
+func (c *client) Flows() []FlowState {
+	states := make([]FlowState, 0, len(c.flows))
+	for _, f := range c.flows {
+		f.mu.Lock()
+		failures := f.failures
+		f.mu.Unlock()
+
+		states = append(states, FlowState{
+			RegID:    f.regID,
+			Edge:     f.edge,
+			State:    f.reg.State(),
+			Failures: failures,
+		})
+	}
+
+	return states
+}
+
+func (c *client) Register(ctx context.Context) error {
+	c.mu.Lock()
+	c.active = true
+	c.mu.Unlock()
+
+	errs := make([]error, len(c.flows))
+	var wg sync.WaitGroup
+	for i, f := range c.flows {
+		wg.Add(1)
+		go func(i int, f *flow) {
+			defer wg.Done()
+			errs[i] = f.reg.Register(ctx)
+		}(i, f)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no edge proxies")
+	}
+
+	return errs[0]
+}
+
+func (c *client) Unregister(ctx context.Context) error {
+	c.mu.Lock()
+	c.active = false
+	c.mu.Unlock()
+
+	var firstErr error
+	for _, f := range c.flows {
+		f.stopTimer()
+		if err := f.reg.Unregister(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (c *client) Stop() {
+	c.mu.Lock()
+	c.active = false
+	c.mu.Unlock()
+
+	for _, f := range c.flows {
+		f.stopTimer()
+		f.reg.Stop()
+	}
+}
+
+func (c *client) isActive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.active
+}
+
+func (c *client) flowConfig(f *flow) registration.Config {
+	config := c.config.Registration
+
+	contact := config.Contact.Clone().(*sip.ContactHeader)
+	SetContactFlow(contact, c.config.InstanceID, f.regID)
+	config.Contact = contact
+
+	route := f.edge.Clone()
+	if route.UriParams() == nil {
+		route.SetUriParams(sip.NewParams())
+	}
+	if !sip.IsLooseRouter(route) {
+		route.UriParams().Add("lr", nil)
+	}
+
+	config.Headers = append(append([]sip.Header{}, config.Headers...),
+		&sip.SupportedHeader{Options: []string{OptionTag, "path"}},
+		&sip.RouteHeader{Addresses: []sip.Uri{route}},
+	)
+	// the flow recovery re-registers earlier, so retry of the registration client is only a fallback
+	config.RetryInterval = c.config.MaxRecoveryTime
+	config.OnStateChange = f.onStateChange
+
+	return config
+}
+
+// allFailed checks that no flow is registered.
+func (c *client) allFailed() bool {
+	for _, f := range c.flows {
+		if f.reg.State() == registration.Registered {
+			return false
+		}
+	}
+
+	return true
+}
+
+// flow is a registration through the single edge proxy.
+type flow struct {
+	c     *client
+	regID int
+	edge  sip.Uri
+	reg   registration.Client
+
+	mu       sync.Mutex
+	failures int
+	// interval is the keep-alive interval of the last Flow-Timer
+	interval time.Duration
+	timer    timing.Timer
+
+	log log.Logger
+}
+
+func (f *flow) Log() log.Logger {
+	return f.log
+}
+
+func (f *flow) onStateChange(change registration.StateChange) {
+	switch change.State {
+	case registration.Registered:
+		f.mu.Lock()
+		f.failures = 0
+		f.mu.Unlock()
+
+		if change.Response != nil && !HasOptionTag(change.Response, "Require", OptionTag) {
+			f.Log().Debug("registrar does not support outbound")
+		}
+		f.schedule(keepAliveDelay(f.keepAliveInterval(change.Response)), f.keepAlive)
+	case registration.Failed:
+		if !f.c.isActive() {
+			break
+		}
+
+		f.mu.Lock()
+		f.failures++
+		failures := f.failures
+		f.mu.Unlock()
+
+		delay := f.recoveryDelay(failures)
+		f.Log().Debugf("flow registration failed %d times, recover in %s: %s", failures, delay, change.Err)
+		f.schedule(delay, f.reg.FlowFailed)
+	case registration.Unregistered:
+		f.stopTimer()
+	}
+
+	if f.c.config.OnFlowChange != nil {
+		f.c.config.OnFlowChange(FlowChange{
+			StateChange: change,
+			RegID:       f.regID,
+			Edge:        f.edge,
+		})
+	}
+}
+
+// keepAlive pings the edge proxy, broken flow is re-registered immediately - RFC 5626 4.4.
+func (f *flow) keepAlive() {
+	if err := f.c.config.Pinger.Ping(context.Background(), f.edge); err != nil {
+		f.Log().Debugf("keep-alive failed, re-registering: %s", err)
+		f.reg.FlowFailed()
+
+		return
+	}
+
+	f.schedule(keepAliveDelay(f.keepAliveInterval(nil)), f.keepAlive)
+}
+
+// keepAliveInterval returns Flow-Timer of the registrar response or the last known interval - RFC 5626 4.4.1.
+func (f *flow) keepAliveInterval(res sip.Response) time.Duration {
+	if res != nil {
+		if hdrs := res.GetHeaders("Flow-Timer"); len(hdrs) > 0 {
+			if sec, err := strconv.ParseUint(strings.TrimSpace(hdrs[0].Value()), 10, 32); err == nil && sec > 0 {
+				f.mu.Lock()
+				f.interval = time.Duration(sec) * time.Second
+				f.mu.Unlock()
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.interval > 0 {
+		return f.interval
+	}
+
+	return f.c.config.KeepAliveInterval
+}
+
+// recoveryDelay computes the wait time before the next registration attempt - RFC 5626 4.5.
+func (f *flow) recoveryDelay(failures int) time.Duration {
+	base := f.c.config.BaseTimeNotFailed
+	if f.c.allFailed() {
+		base = f.c.config.BaseTimeAllFailed
+	}
+
+	wait := f.c.config.MaxRecoveryTime
+	if failures < 32 && base<<uint(failures) < wait {
+		wait = base << uint(failures)
+	}
+
+	// random value between 50 and 100 percent of the wait time
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func (f *flow) schedule(delay time.Duration, fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	f.timer = timing.AfterFunc(delay, func() {
+		if f.c.isActive() {
+			fn()
+		}
+	})
+}
+
+func (f *flow) stopTimer() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
+
+// keepAliveDelay returns random value between 80 and 100 percent of the interval - RFC 5626 4.4.1.
+func keepAliveDelay(interval time.Duration) time.Duration {
+	return interval*4/5 + time.Duration(rand.Int63n(int64(interval/5)+1))
+}
@@ -0,0 +1,156 @@
+package outbound_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/outbound"
+	"github.com/ghettovoice/gosip/registration"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+func okResponse(req sip.Request) sip.Response {
+	res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+	res.AppendHeader(&sip.RequireHeader{Options: []string{outbound.OptionTag}})
+	res.AppendHeader(&sip.GenericHeader{HeaderName: "Flow-Timer", Contents: "30"})
+
+	return res
+}
+
+var _ = Describe("Outbound Client", func() {
+	var (
+		requester *testutils.MockRequester
+		pings     chan string
+		pingErr   map[string]error
+		pingMu    sync.Mutex
+		config    outbound.Config
+	)
+
+	edge1 := &sip.SipUri{FHost: "edge1.example.com"}
+	edge2 := &sip.SipUri{FHost: "edge2.example.com"}
+
+	BeforeEach(func() {
+		timing.MockMode = true
+		requester = testutils.NewMockRequester(func(req sip.Request) (sip.Response, error) {
+			return okResponse(req), nil
+		})
+		pings = make(chan string, 10)
+		pingErr = make(map[string]error)
+		config = outbound.Config{
+			Registration: registration.Config{
+				Registrar: &sip.SipUri{FHost: "example.com"},
+				AOR: &sip.Address{
+					Uri: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"},
+				},
+				Contact: &sip.ContactHeader{
+					Address: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "10.0.0.1"},
+				},
+			},
+			EdgeProxies: []sip.Uri{edge1, edge2},
+			Pinger: outbound.PingerFunc(func(ctx context.Context, edge sip.Uri) error {
+				pings <- edge.Host()
+
+				pingMu.Lock()
+				defer pingMu.Unlock()
+
+				return pingErr[edge.Host()]
+			}),
+		}
+	})
+
+	AfterEach(func() {
+		timing.MockMode = false
+	})
+
+	It("should register the instance through each edge proxy", func() {
+		client := outbound.NewClient(requester, config, log.NewDefaultLogrusLogger())
+		Expect(client.Register(context.Background())).To(Succeed())
+		defer client.Stop()
+
+		for i, host := range []string{"edge1.example.com", "edge2.example.com"} {
+			reqs := requester.RequestsTo(host)
+			Expect(reqs).To(HaveLen(1))
+
+			Expect(outbound.HasOptionTag(reqs[0], "Supported", outbound.OptionTag)).To(BeTrue())
+			Expect(sip.IsLooseRouter(sip.RouteUris(reqs[0])[0])).To(BeTrue())
+
+			contact, ok := reqs[0].Contact()
+			Expect(ok).To(BeTrue())
+			instanceID, regID, ok := outbound.ContactFlow(contact)
+			Expect(ok).To(BeTrue())
+			Expect(instanceID).To(Equal(client.InstanceID()))
+			Expect(regID).To(Equal(i + 1))
+		}
+
+		for _, flow := range client.Flows() {
+			Expect(flow.State).To(Equal(registration.Registered))
+		}
+	})
+
+	It("should send keep-alives within Flow-Timer", func() {
+		client := outbound.NewClient(requester, config, log.NewDefaultLogrusLogger())
+		Expect(client.Register(context.Background())).To(Succeed())
+		defer client.Stop()
+
+		timing.Elapse(23 * time.Second)
+		Consistently(pings, 50*time.Millisecond).ShouldNot(Receive())
+
+		timing.Elapse(7 * time.Second)
+		Eventually(pings).Should(Receive())
+		Eventually(pings).Should(Receive())
+	})
+
+	It("should re-register the flow on keep-alive failure", func() {
+		pingErr["edge1.example.com"] = fmt.Errorf("connection reset")
+
+		client := outbound.NewClient(requester, config, log.NewDefaultLogrusLogger())
+		Expect(client.Register(context.Background())).To(Succeed())
+		defer client.Stop()
+
+		timing.Elapse(30 * time.Second)
+		Eventually(func() int { return len(requester.RequestsTo("edge1.example.com")) }).Should(Equal(2))
+		Expect(requester.RequestsTo("edge2.example.com")).To(HaveLen(1))
+	})
+
+	It("should recover the failed flow with backoff", func() {
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			if sip.RouteUris(req)[0].Host() == "edge2.example.com" {
+				return nil, &sip.RequestError{Request: req, Code: 503, Reason: "Service Unavailable"}
+			}
+			return okResponse(req), nil
+		})
+
+		// flows are registered concurrently, so the same base time does not depend on the order
+		config.BaseTimeAllFailed = 90 * time.Second
+		config.BaseTimeNotFailed = 90 * time.Second
+		client := outbound.NewClient(requester, config, log.NewDefaultLogrusLogger())
+		Expect(client.Register(context.Background())).To(Succeed())
+		defer client.Stop()
+
+		flows := client.Flows()
+		Expect(flows[0].State).To(Equal(registration.Registered))
+		Expect(flows[1].State).To(Equal(registration.Failed))
+		Expect(flows[1].Failures).To(Equal(1))
+
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			return okResponse(req), nil
+		})
+
+		// 1 failure doubles the base time, the wait time is 90-180s
+		timing.Elapse(80 * time.Second)
+		Consistently(func() int { return len(requester.RequestsTo("edge2.example.com")) }, 50*time.Millisecond).
+			Should(Equal(1))
+
+		timing.Elapse(100 * time.Second)
+		Eventually(func() registration.State { return client.Flows()[1].State }).Should(Equal(registration.Registered))
+		Expect(client.Flows()[1].Failures).To(BeZero())
+	})
+})
@@ -0,0 +1,321 @@
+package outbound
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// flowTokenMacSize is the size of truncated HMAC-SHA1-80 of the flow token - RFC 5626 5.2.
+const flowTokenMacSize = 10
+
+// ErrInvalidFlowToken is returned for tokens that were not issued by the edge proxy or were tampered.
+var ErrInvalidFlowToken = errors.New("invalid flow token")
+
+// Flow is a transport connection between the edge proxy and the UA - RFC 5626 3.
+type Flow struct {
+	Transport  string
+	LocalAddr  string
+	RemoteAddr string
+	// Node is the ID of the cluster node that holds the connection, empty for single node edge proxy.
+	Node string
+}
+
+// FlowOf returns the flow the message was received on.
+func FlowOf(msg sip.Message) Flow {
+	return Flow{
+		Transport:  msg.Transport(),
+		LocalAddr:  msg.Destination(),
+		RemoteAddr: msg.Source(),
+	}
+}
+
+func (flow Flow) String() string {
+	if flow.Node != "" {
+		return fmt.Sprintf("%s %s <-> %s on %s", flow.Transport, flow.LocalAddr, flow.RemoteAddr, flow.Node)
+	}
+
+	return fmt.Sprintf("%s %s <-> %s", flow.Transport, flow.LocalAddr, flow.RemoteAddr)
+}
+
+// connection returns the flow without the node.
+func (flow Flow) connection() Flow {
+	flow.Node = ""
+	return flow
+}
+
+// StaticRelay returns EdgeConfig.Relay that sends requests to the nodes by the addresses
+// over the transport, nodes maps node IDs to "host:port" addresses of the internal network.
+func StaticRelay(transport string, nodes map[string]string) func(node string, req sip.Request) error {
+	return func(node string, req sip.Request) error {
+		addr, ok := nodes[node]
+		if !ok {
+			return fmt.Errorf("unknown node %s", node)
+		}
+
+		req.SetTransport(transport)
+		req.SetDestination(addr)
+
+		return nil
+	}
+}
+
+// EdgeConfig describes edge proxy options.
+type EdgeConfig struct {
+	// Uri is the edge proxy URI inserted into Path and Record-Route with the flow token in the user part.
+	// Route entries with this host and port are recognized as own.
+	Uri sip.Uri
+	// Key signs flow tokens, default is a random key, so tokens issued before restart are invalid.
+	// All nodes of the cluster must share the same key.
+	Key []byte
+	// IsAlive checks that the flow is still connected, nil treats all flows as alive.
+	IsAlive func(flow Flow) bool
+	// Node is the ID of the node in the cluster of edge proxies behind the load balancer,
+	// it is encoded into flow tokens, so any node knows which one holds the flow. It must not contain spaces.
+	Node string
+	// Relay prepares the request to the flow held by another node for forwarding to that node,
+	// e.g. sets the transport and the node address on the internal network, the request is then sent as usual.
+	// The Route with the flow token is kept, so the node routes the request over the flow.
+	// Nil relay or its error fails the flow.
+	Relay func(node string, req sip.Request) error
+}
+
+// Edge implements flow token handling of the edge proxy - RFC 5626 5.
+type Edge interface {
+	// FlowToken encodes the flow into the signed token, the flow without node is held by this node.
+	FlowToken(flow Flow) string
+	// ParseFlowToken validates the token and decodes the flow.
+	ParseFlowToken(token string) (Flow, error)
+	// AddPath inserts Path with the flow token and 'ob' param into REGISTER received directly from the UA
+	// with reg-id Contact param - RFC 5626 5.1. It returns true if Path was inserted.
+	AddPath(req sip.Request) bool
+	// AddRecordRoute inserts Record-Route with the flow token into dialog forming request received directly
+	// from the UA with 'ob' Contact URI param, so the peer routes in-dialog requests over the flow - RFC 5626 5.4.
+	// It returns true if Record-Route was inserted.
+	AddRecordRoute(req sip.Request) bool
+	// RouteToFlow processes the topmost Route with the own URI and the flow token - RFC 5626 5.3.
+	// The Route entry is removed and the request destination is set to the flow, so the request
+	// is sent over the connection to the UA. Requests to flows of other nodes keep the Route and are relayed
+	// to the node with EdgeConfig.Relay. It returns false if the request is not routed to a flow,
+	// including requests received from the flow itself, and the error response to send upstream:
+	// 403 for the invalid token and 430 for the broken flow.
+	RouteToFlow(req sip.Request) (bool, sip.Response)
+}
+
+type edge struct {
+	config EdgeConfig
+
+	log log.Logger
+}
+
+// NewEdge creates edge proxy flow token handler.
+func NewEdge(config EdgeConfig, logger log.Logger) Edge {
+	if len(config.Key) == 0 {
+		config.Key = make([]byte, 20)
+		if _, err := rand.Read(config.Key); err != nil {
+			panic(err)
+		}
+	}
+
+	e := &edge{
+		config: config,
+	}
+	e.log = logger.
+		WithPrefix("outbound.Edge").
+		WithFields(log.Fields{
+			"edge_ptr": fmt.Sprintf("%p", e),
+		})
+
+	return e
+}
+
+func (e *edge) Log() log.Logger {
+	return e.log
+}
+
+// FlowToken returns base64 of HMAC-SHA1-80 followed by the flow tuple and the node - RFC 5626 5.2.
+func (e *edge) FlowToken(flow Flow) string {
+	if flow.Node == "" {
+		flow.Node = e.config.Node
+	}
+	fields := []string{flow.Transport, flow.LocalAddr, flow.RemoteAddr}
+	if flow.Node != "" {
+		fields = append(fields, flow.Node)
+	}
+	data := []byte(strings.Join(fields, " "))
+
+	return base64.RawURLEncoding.EncodeToString(append(e.mac(data), data...))
+}
+
+func (e *edge) ParseFlowToken(token string) (Flow, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) <= flowTokenMacSize {
+		return Flow{}, ErrInvalidFlowToken
+	}
+
+	data := raw[flowTokenMacSize:]
+	if !hmac.Equal(raw[:flowTokenMacSize], e.mac(data)) {
+		return Flow{}, ErrInvalidFlowToken
+	}
+
+	parts := bytes.Split(data, []byte(" "))
+	if len(parts) != 3 && len(parts) != 4 {
+		return Flow{}, ErrInvalidFlowToken
+	}
+
+	flow := Flow{
+		Transport:  string(parts[0]),
+		LocalAddr:  string(parts[1]),
+		RemoteAddr: string(parts[2]),
+	}
+	if len(parts) == 4 {
+		flow.Node = string(parts[3])
+	}
+
+	return flow, nil
+}
+
+func (e *edge) mac(data []byte) []byte {
+	h := hmac.New(sha1.New, e.config.Key)
+	h.Write(data)
+
+	return h.Sum(nil)[:flowTokenMacSize]
+}
+
+func (e *edge) AddPath(req sip.Request) bool {
+	if req.Method() != sip.REGISTER || !isFirstHop(req) {
+		return false
+	}
+
+	var outbound bool
+	for _, hdr := range req.GetHeaders("Contact") {
+		if contact, ok := hdr.(*sip.ContactHeader); ok {
+			if _, _, ok := ContactFlow(contact); ok {
+				outbound = true
+				break
+			}
+		}
+	}
+	if !outbound {
+		return false
+	}
+
+	uri := e.flowUri(req)
+	uri.UriParams().Add(ObParam, nil)
+	req.PrependHeader(&sip.GenericHeader{
+		HeaderName: "Path",
+		Contents:   "<" + uri.String() + ">",
+	})
+
+	return true
+}
+
+func (e *edge) AddRecordRoute(req sip.Request) bool {
+	if req.Method() == sip.REGISTER || req.IsAck() || !isFirstHop(req) {
+		return false
+	}
+	if to, ok := req.To(); ok && to.Params != nil && to.Params.Has("tag") {
+		return false
+	}
+
+	contact, ok := req.Contact()
+	if !ok || !hasObParam(contact.Address) {
+		return false
+	}
+
+	req.PrependHeader(&sip.RecordRouteHeader{Addresses: []sip.Uri{e.flowUri(req)}})
+
+	return true
+}
+
+func (e *edge) RouteToFlow(req sip.Request) (bool, sip.Response) {
+	routes := sip.RouteUris(req)
+	if len(routes) == 0 || !sip.IsLocalUri(routes[0], e.config.Uri) || routes[0].User() == nil {
+		return false, nil
+	}
+
+	token := routes[0].User().String()
+	if token == "" {
+		return false, nil
+	}
+
+	flow, err := e.ParseFlowToken(token)
+	if err != nil {
+		e.Log().WithFields(req.Fields()).Debugf("reject request with flow token '%s': %s", token, err)
+
+		return false, sip.NewResponseFromRequest("", req, 403, "Forbidden", "")
+	}
+
+	if flow.Node != "" && flow.Node != e.config.Node {
+		return e.relay(req, flow)
+	}
+
+	sip.SetRouteUris(req, routes[1:])
+
+	// the request is sent by the UA on the flow, so it is routed further as usual
+	if flow.connection() == FlowOf(req) {
+		return false, nil
+	}
+
+	if e.config.IsAlive != nil && !e.config.IsAlive(flow) {
+		e.Log().WithFields(req.Fields()).Debugf("flow %s failed", flow)
+
+		return false, sip.NewResponseFromRequest("", req, 430, "Flow Failed", "")
+	}
+
+	req.SetTransport(flow.Transport)
+	req.SetSource(flow.LocalAddr)
+	req.SetDestination(flow.RemoteAddr)
+
+	return true, nil
+}
+
+// relay forwards the request to the node that holds the flow.
+func (e *edge) relay(req sip.Request, flow Flow) (bool, sip.Response) {
+	if e.config.Relay == nil {
+		e.Log().WithFields(req.Fields()).Debugf("flow %s is held by another node", flow)
+
+		return false, sip.NewResponseFromRequest("", req, 430, "Flow Failed", "")
+	}
+	if err := e.config.Relay(flow.Node, req); err != nil {
+		e.Log().WithFields(req.Fields()).Warnf("relay request to node %s failed: %s", flow.Node, err)
+
+		return false, sip.NewResponseFromRequest("", req, 430, "Flow Failed", "")
+	}
+
+	return true, nil
+}
+
+// flowUri returns the edge proxy URI with the token of the request flow.
+func (e *edge) flowUri(req sip.Request) sip.Uri {
+	uri := e.config.Uri.Clone()
+	uri.SetUser(sip.String{Str: e.FlowToken(FlowOf(req))})
+	if uri.UriParams() == nil {
+		uri.SetUriParams(sip.NewParams())
+	}
+	if !sip.IsLooseRouter(uri) {
+		uri.UriParams().Add("lr", nil)
+	}
+
+	return uri
+}
+
+// isFirstHop checks that the request was sent directly by the UA, so it has the single Via - RFC 5626 5.1.
+func isFirstHop(req sip.Request) bool {
+	var hops int
+	for _, hdr := range req.GetHeaders("Via") {
+		if via, ok := hdr.(sip.ViaHeader); ok {
+			hops += len(via)
+		}
+	}
+
+	return hops == 1
+}
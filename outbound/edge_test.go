@@ -0,0 +1,184 @@
+package outbound_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/outbound"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Outbound Edge", func() {
+	var (
+		edge   outbound.Edge
+		alive  bool
+		flow   outbound.Flow
+		config outbound.EdgeConfig
+	)
+
+	fromFlow := func(req sip.Request, flow outbound.Flow) sip.Request {
+		req.SetTransport(flow.Transport)
+		req.SetSource(flow.RemoteAddr)
+		req.SetDestination(flow.LocalAddr)
+		return req
+	}
+
+	register := func(vias ...string) sip.Request {
+		lines := []string{"REGISTER sip:example.com SIP/2.0"}
+		for _, via := range vias {
+			lines = append(lines, "Via: "+via)
+		}
+		lines = append(lines,
+			"From: <sip:alice@example.com>;tag=reg-tag",
+			"To: <sip:alice@example.com>",
+			"Call-ID: outbound-register",
+			"CSeq: 1 REGISTER",
+			"Supported: outbound, path",
+			"Contact: <sip:alice@192.168.0.10:5060;transport=tcp>;+sip.instance=\"<urn:uuid:00000000-0000-1000-8000-000a95a0e128>\";reg-id=1",
+			"",
+			"",
+		)
+		return fromFlow(testutils.Request(lines), flow)
+	}
+
+	inviteToUA := func(route string) sip.Request {
+		return testutils.Request([]string{
+			"INVITE sip:alice@192.168.0.10:5060;transport=tcp SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.5:5060;branch=" + sip.GenerateBranch(),
+			"Route: " + route,
+			"From: <sip:bob@example.com>;tag=bob-tag",
+			"To: <sip:alice@example.com>",
+			"Call-ID: outbound-invite",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:bob@10.0.0.5:5060>",
+			"",
+			"",
+		})
+	}
+
+	BeforeEach(func() {
+		alive = true
+		flow = outbound.Flow{Transport: "TCP", LocalAddr: "203.0.113.1:5060", RemoteAddr: "198.51.100.7:41234"}
+		config = outbound.EdgeConfig{
+			Uri: &sip.SipUri{FHost: "edge.example.com"},
+			IsAlive: func(flow outbound.Flow) bool {
+				return alive
+			},
+		}
+		edge = outbound.NewEdge(config, log.NewDefaultLogrusLogger())
+	})
+
+	It("should validate flow tokens", func() {
+		token := edge.FlowToken(flow)
+		decoded, err := edge.ParseFlowToken(token)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded).To(Equal(flow))
+
+		tampered := []byte(token)
+		tampered[len(tampered)-1] ^= 1
+		_, err = edge.ParseFlowToken(string(tampered))
+		Expect(err).To(Equal(outbound.ErrInvalidFlowToken))
+
+		other := outbound.NewEdge(config, log.NewDefaultLogrusLogger())
+		_, err = other.ParseFlowToken(token)
+		Expect(err).To(Equal(outbound.ErrInvalidFlowToken))
+	})
+
+	It("should insert Path into REGISTER received from the UA", func() {
+		req := register("SIP/2.0/TCP 192.168.0.10:5060;branch=" + sip.GenerateBranch())
+		Expect(edge.AddPath(req)).To(BeTrue())
+
+		path := req.GetHeaders("Path")
+		Expect(path).To(HaveLen(1))
+		Expect(path[0].Value()).To(Equal("<sip:" + edge.FlowToken(flow) + "@edge.example.com;lr;ob>"))
+
+		proxied := register(
+			"SIP/2.0/TCP 10.0.0.2:5060;branch="+sip.GenerateBranch(),
+			"SIP/2.0/TCP 192.168.0.10:5060;branch="+sip.GenerateBranch(),
+		)
+		Expect(edge.AddPath(proxied)).To(BeFalse())
+	})
+
+	It("should route requests to the UA over the flow", func() {
+		req := inviteToUA("<sip:" + edge.FlowToken(flow) + "@edge.example.com;lr;ob>, <sip:pbx.example.com;lr>")
+		ok, res := edge.RouteToFlow(req)
+		Expect(res).To(BeNil())
+		Expect(ok).To(BeTrue())
+		Expect(req.Destination()).To(Equal(flow.RemoteAddr))
+		Expect(req.Transport()).To(Equal(flow.Transport))
+		Expect(sip.RouteUris(req)).To(HaveLen(1))
+	})
+
+	It("should reject invalid flow tokens and failed flows", func() {
+		_, res := edge.RouteToFlow(inviteToUA("<sip:forged@edge.example.com;lr;ob>"))
+		Expect(res).ToNot(BeNil())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(403)))
+
+		alive = false
+		_, res = edge.RouteToFlow(inviteToUA("<sip:" + edge.FlowToken(flow) + "@edge.example.com;lr;ob>"))
+		Expect(res).ToNot(BeNil())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(430)))
+	})
+
+	It("should relay requests to the node that holds the flow", func() {
+		config.Key = []byte("cluster-key")
+		config.Node = "node-1"
+		node1 := outbound.NewEdge(config, log.NewDefaultLogrusLogger())
+		config.Node = "node-2"
+		config.Relay = outbound.StaticRelay("UDP", map[string]string{"node-1": "10.1.0.1:5060"})
+		node2 := outbound.NewEdge(config, log.NewDefaultLogrusLogger())
+
+		token := node1.FlowToken(flow)
+		decoded, err := node2.ParseFlowToken(token)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded.Node).To(Equal("node-1"))
+
+		req := inviteToUA("<sip:" + token + "@edge.example.com;lr;ob>")
+		ok, res := node2.RouteToFlow(req)
+		Expect(res).To(BeNil())
+		Expect(ok).To(BeTrue())
+		Expect(req.Destination()).To(Equal("10.1.0.1:5060"))
+		Expect(req.Transport()).To(Equal("UDP"))
+		Expect(sip.RouteUris(req)).To(HaveLen(1))
+
+		ok, res = node1.RouteToFlow(req)
+		Expect(res).To(BeNil())
+		Expect(ok).To(BeTrue())
+		Expect(req.Destination()).To(Equal(flow.RemoteAddr))
+		Expect(sip.RouteUris(req)).To(BeEmpty())
+
+		_, res = node2.RouteToFlow(inviteToUA("<sip:" + node2.FlowToken(outbound.Flow{
+			Transport:  "TCP",
+			LocalAddr:  "203.0.113.3:5060",
+			RemoteAddr: "198.51.100.7:41234",
+			Node:       "node-3",
+		}) + "@edge.example.com;lr;ob>"))
+		Expect(res).ToNot(BeNil())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(430)))
+	})
+
+	It("should record-route dialogs of the UA and route requests from the flow further", func() {
+		invite := fromFlow(testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/TCP 192.168.0.10:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: outbound-invite",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@192.168.0.10:5060;transport=tcp;ob>",
+			"",
+			"",
+		}), flow)
+		Expect(edge.AddRecordRoute(invite)).To(BeTrue())
+		rr := sip.RecordRouteUris(invite)
+		Expect(rr).To(HaveLen(1))
+
+		bye := fromFlow(inviteToUA("<"+rr[0].String()+">, <sip:pbx.example.com;lr>"), flow)
+		ok, res := edge.RouteToFlow(bye)
+		Expect(ok).To(BeFalse())
+		Expect(res).To(BeNil())
+		Expect(sip.RouteUris(bye)[0].Host()).To(Equal("pbx.example.com"))
+	})
+})
@@ -0,0 +1,89 @@
+// outbound package implements SIP Outbound - RFC 5626.
+// The client registers the same Contact through several edge proxies, each registration is a separate flow
+// identified by reg-id, keeps the flows alive and recovers the failed ones.
+// The edge side inserts signed flow tokens into Path and Record-Route and routes requests back over the flows.
+// In the cluster of edge proxies the token also names the node that holds the flow,
+// requests landing on another node are relayed to it.
+package outbound
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	// OptionTag is the option tag of Supported and Require headers.
+	OptionTag = "outbound"
+	// InstanceParam is the Contact param with the UA instance URN - RFC 5626 4.1.
+	InstanceParam = "+sip.instance"
+	// RegIDParam is the Contact param with the flow number - RFC 5626 4.2.
+	RegIDParam = "reg-id"
+	// ObParam is the URI param of Path, Record-Route and Contact URIs that are routed over the flow.
+	ObParam = "ob"
+)
+
+// NewInstanceID generates random 'urn:uuid' instance ID - RFC 4122.
+func NewInstanceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// SetContactFlow adds +sip.instance and reg-id params to the Contact.
+func SetContactFlow(contact *sip.ContactHeader, instanceID string, regID int) {
+	if contact.Params == nil {
+		contact.Params = sip.NewParams()
+	}
+	contact.Params.Add(InstanceParam, sip.String{Str: "\"<" + instanceID + ">\""})
+	contact.Params.Add(RegIDParam, sip.String{Str: strconv.Itoa(regID)})
+}
+
+// ContactFlow returns instance ID and reg-id of the Contact, ok is false if the Contact has no both params.
+func ContactFlow(contact *sip.ContactHeader) (instanceID string, regID int, ok bool) {
+	if contact == nil || contact.Params == nil {
+		return "", 0, false
+	}
+
+	instance, ok := contact.Params.Get(InstanceParam)
+	if !ok || instance == nil {
+		return "", 0, false
+	}
+	instanceID = strings.Trim(instance.String(), "\"<>")
+
+	val, ok := contact.Params.Get(RegIDParam)
+	if !ok || val == nil {
+		return "", 0, false
+	}
+	regID, err := strconv.Atoi(val.String())
+	if err != nil || regID <= 0 {
+		return "", 0, false
+	}
+
+	return instanceID, regID, instanceID != ""
+}
+
+// HasOptionTag checks that one of the headers with the name lists the option tag.
+func HasOptionTag(msg sip.Message, name, tag string) bool {
+	for _, hdr := range msg.GetHeaders(name) {
+		for _, val := range strings.Split(hdr.Value(), ",") {
+			if strings.EqualFold(strings.TrimSpace(val), tag) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func hasObParam(uri sip.Uri) bool {
+	return uri != nil && uri.UriParams() != nil && uri.UriParams().Has(ObParam)
+}
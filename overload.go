@@ -0,0 +1,273 @@
+package gosip
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const (
+	// LossAlgorithmName is oc-algo value of the loss-based overload control - RFC 7339 5.10.
+	LossAlgorithmName = "loss"
+	// DefaultOverloadValidity is oc-validity of the advertised reduction - RFC 7339 5.2.
+	DefaultOverloadValidity = 500 * time.Millisecond
+	// DefaultOverloadThreshold is the load the loss algorithm starts reduction at.
+	DefaultOverloadThreshold = 0.8
+)
+
+// OverloadAlgorithm is an overload control algorithm - RFC 7339 3.
+// The server advertises the reduction of the algorithm in Via of responses to clients supporting the algorithm,
+// the client throttles requests to the overloaded server by the reduction it advertised.
+type OverloadAlgorithm interface {
+	// Name is oc-algo value of the algorithm, like "loss".
+	Name() string
+	// Reduction returns the current reduction of traffic to the server, for the loss algorithm it is
+	// the percentage of requests the clients should drop, zero when the server is not overloaded.
+	Reduction() int
+	// Throttle decides whether the request to the server that advertised the reduction is dropped.
+	Throttle(reduction int) bool
+}
+
+// LossConfig describes the loss-based overload control algorithm.
+type LossConfig struct {
+	// Load returns the current load of the server from 0 to 1, nil is the load of ServerConfig.Queue,
+	// ServerConfig.Health.MaxTransactions and ServerConfig.Memory.
+	Load func() float64
+	// Threshold is the load the reduction starts at, it grows linearly to 100% at the full load,
+	// default is DefaultOverloadThreshold.
+	Threshold float64
+}
+
+type lossAlgorithm struct {
+	config LossConfig
+}
+
+// NewLossAlgorithm creates the loss-based overload control algorithm - RFC 7339 5.10.
+func NewLossAlgorithm(config LossConfig) OverloadAlgorithm {
+	if config.Threshold <= 0 || config.Threshold >= 1 {
+		config.Threshold = DefaultOverloadThreshold
+	}
+
+	return &lossAlgorithm{config: config}
+}
+
+func (alg *lossAlgorithm) Name() string {
+	return LossAlgorithmName
+}
+
+func (alg *lossAlgorithm) Reduction() int {
+	if alg.config.Load == nil {
+		return 0
+	}
+
+	load := alg.config.Load()
+	if load <= alg.config.Threshold {
+		return 0
+	}
+	reduction := int(100 * (load - alg.config.Threshold) / (1 - alg.config.Threshold))
+	if reduction > 100 {
+		reduction = 100
+	}
+
+	return reduction
+}
+
+func (alg *lossAlgorithm) Throttle(reduction int) bool {
+	return reduction > 0 && rand.Intn(100) < reduction
+}
+
+// OverloadConfig describes SIP overload control - RFC 7339.
+type OverloadConfig struct {
+	// Algorithm is the overload control algorithm, default is the loss algorithm driven by the load of the server.
+	Algorithm OverloadAlgorithm
+	// Validity is oc-validity of the advertised reduction, default is DefaultOverloadValidity.
+	Validity time.Duration
+}
+
+// overloadControl advertises the reduction of the server and tracks the reductions of downstream servers.
+type overloadControl struct {
+	algorithm OverloadAlgorithm
+	validity  time.Duration
+
+	mu sync.Mutex
+	// overloadedUntil is the time the last non-zero reduction advertised by the server is valid until,
+	// so clients get oc=0 when the overload ends
+	overloadedUntil time.Time
+	// servers are active reductions of downstream servers by destinations of requests
+	servers map[string]serverReduction
+}
+
+type serverReduction struct {
+	reduction int
+	seq       float64
+	expires   time.Time
+}
+
+func newOverloadControl(config OverloadConfig, load func() float64) *overloadControl {
+	if config.Algorithm == nil {
+		config.Algorithm = NewLossAlgorithm(LossConfig{Load: load})
+	}
+	if config.Validity <= 0 {
+		config.Validity = DefaultOverloadValidity
+	}
+
+	return &overloadControl{
+		algorithm: config.Algorithm,
+		validity:  config.Validity,
+		servers:   make(map[string]serverReduction),
+	}
+}
+
+// supportOverload adds 'oc' and 'oc-algo' params to the own Via of the outgoing request - RFC 7339 5.1.
+func (oc *overloadControl) supportOverload(req sip.Request) {
+	viaHop, ok := req.ViaHop()
+	if !ok || viaHop.Params == nil || viaHop.Params.Has("oc") {
+		return
+	}
+
+	viaHop.Params.Add("oc", nil)
+	viaHop.Params.Add("oc-algo", sip.String{Str: `"` + oc.algorithm.Name() + `"`})
+}
+
+// advertise sets the reduction of the server to the Via of the client supporting the algorithm - RFC 7339 5.2.
+func (oc *overloadControl) advertise(res sip.Response) {
+	viaHop, ok := res.ViaHop()
+	if !ok || viaHop.Params == nil || !viaHop.Params.Has("oc") || !oc.supportedBy(viaHop.Params) {
+		return
+	}
+
+	now := timing.Now()
+	reduction := oc.algorithm.Reduction()
+
+	oc.mu.Lock()
+	if reduction > 0 {
+		oc.overloadedUntil = now.Add(oc.validity)
+	} else if now.After(oc.overloadedUntil) {
+		oc.mu.Unlock()
+		return
+	}
+	oc.mu.Unlock()
+
+	viaHop.Params.Add("oc", sip.String{Str: strconv.Itoa(reduction)})
+	viaHop.Params.Add("oc-algo", sip.String{Str: `"` + oc.algorithm.Name() + `"`})
+	viaHop.Params.Add("oc-validity", sip.String{Str: strconv.Itoa(int(oc.validity / time.Millisecond))})
+	viaHop.Params.Add("oc-seq", sip.String{Str: strconv.FormatFloat(float64(now.UnixNano())/1e9, 'f', 3, 64)})
+}
+
+// supportedBy checks that oc-algo of the client lists the algorithm of the server.
+func (oc *overloadControl) supportedBy(params sip.Params) bool {
+	algo, ok := params.Get("oc-algo")
+	if !ok || algo == nil {
+		// the default algorithm is loss - RFC 7339 5.1
+		return oc.algorithm.Name() == LossAlgorithmName
+	}
+	for _, name := range strings.Split(strings.Trim(algo.String(), `"`), ",") {
+		if strings.EqualFold(strings.TrimSpace(name), oc.algorithm.Name()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// learn remembers the reduction advertised in the own Via of the response to the request sent to the destination
+// - RFC 7339 5.3. Reductions are kept by destinations of requests, so they are matched by throttle
+// whether the destination is the host name or the address the response is received from.
+func (oc *overloadControl) learn(res sip.Response, dest string) {
+	viaHop, ok := res.ViaHop()
+	if !ok || viaHop.Params == nil {
+		return
+	}
+	value, ok := viaHop.Params.Get("oc")
+	if !ok || value == nil || value.String() == "" {
+		return
+	}
+	if algo, ok := viaHop.Params.Get("oc-algo"); ok && algo != nil &&
+		!strings.EqualFold(strings.Trim(algo.String(), `"`), oc.algorithm.Name()) {
+		return
+	}
+	reduction, err := strconv.Atoi(value.String())
+	if err != nil || reduction < 0 || reduction > 100 {
+		return
+	}
+
+	validity := DefaultOverloadValidity
+	if v, ok := viaHop.Params.Get("oc-validity"); ok && v != nil {
+		if ms, err := strconv.Atoi(v.String()); err == nil && ms >= 0 {
+			validity = time.Duration(ms) * time.Millisecond
+		}
+	}
+	var seq float64
+	if v, ok := viaHop.Params.Get("oc-seq"); ok && v != nil {
+		seq, _ = strconv.ParseFloat(v.String(), 64)
+	}
+
+	now := timing.Now()
+
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	if current, ok := oc.servers[dest]; ok && seq < current.seq {
+		// reordered response with outdated value
+		return
+	}
+	if reduction == 0 || validity == 0 {
+		delete(oc.servers, dest)
+		return
+	}
+	oc.servers[dest] = serverReduction{
+		reduction: reduction,
+		seq:       seq,
+		expires:   now.Add(validity),
+	}
+	for key, server := range oc.servers {
+		if now.After(server.expires) {
+			delete(oc.servers, key)
+		}
+	}
+}
+
+// throttle decides whether the request to the overloaded destination is dropped,
+// requests within dialogs and ACK and CANCEL requests are never dropped - RFC 7339 5.10.2.
+func (oc *overloadControl) throttle(req sip.Request, dest string) bool {
+	if req.IsAck() || req.IsCancel() {
+		return false
+	}
+	if to, ok := req.To(); ok && to.Params != nil && to.Params.Has("tag") {
+		return false
+	}
+
+	oc.mu.Lock()
+	server, ok := oc.servers[dest]
+	oc.mu.Unlock()
+	if !ok || timing.Now().After(server.expires) {
+		return false
+	}
+
+	return oc.algorithm.Throttle(server.reduction)
+}
+
+// load returns the load of the server for the default overload control algorithm.
+func (srv *server) load() float64 {
+	var load float64
+	if srv.queue != nil {
+		load = srv.queue.load()
+	}
+	if srv.health.MaxTransactions > 0 {
+		if txLoad := float64(srv.tx.Count()) / float64(srv.health.MaxTransactions); txLoad > load {
+			load = txLoad
+		}
+	}
+	if srv.memory != nil {
+		if memLoad := srv.memory.load(); memLoad > load {
+			load = memLoad
+		}
+	}
+
+	return load
+}
@@ -0,0 +1,98 @@
+// presence package implements "presence" event package - RFC 3856,
+// PIDF bodies - RFC 3863 and event state publication - RFC 3903.
+package presence
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+const (
+	EventPackage = "presence"
+	ContentType  = "application/pidf+xml"
+
+	pidfNamespace = "urn:ietf:params:xml:ns:pidf"
+)
+
+// Basic status values.
+const (
+	Open   = "open"
+	Closed = "closed"
+)
+
+// PIDF is a presence document - RFC 3863 4.
+type PIDF struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:pidf presence"`
+	Entity  string   `xml:"entity,attr"`
+	Tuples  []Tuple  `xml:"tuple"`
+	Notes   []Note   `xml:"note,omitempty"`
+}
+
+type Tuple struct {
+	ID        string   `xml:"id,attr"`
+	Status    Status   `xml:"status"`
+	Contact   *Contact `xml:"contact,omitempty"`
+	Notes     []Note   `xml:"note,omitempty"`
+	Timestamp string   `xml:"timestamp,omitempty"`
+}
+
+type Status struct {
+	Basic string `xml:"basic,omitempty"`
+}
+
+type Contact struct {
+	Priority string `xml:"priority,attr,omitempty"`
+	URI      string `xml:",chardata"`
+}
+
+type Note struct {
+	Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+// NewPIDF creates presence document of the entity with single tuple.
+func NewPIDF(entity, tupleID, basic string) *PIDF {
+	return &PIDF{
+		Entity: entity,
+		Tuples: []Tuple{
+			{
+				ID:     tupleID,
+				Status: Status{Basic: basic},
+			},
+		},
+	}
+}
+
+// Basic returns 'open' if any tuple is open, 'closed' otherwise.
+func (doc *PIDF) Basic() string {
+	for _, tuple := range doc.Tuples {
+		if tuple.Status.Basic == Open {
+			return Open
+		}
+	}
+
+	return Closed
+}
+
+// Encode serializes presence document to XML.
+func (doc *PIDF) Encode() (string, error) {
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encode PIDF: %w", err)
+	}
+
+	return xml.Header + string(data), nil
+}
+
+// DecodePIDF parses presence document.
+func DecodePIDF(body string) (*PIDF, error) {
+	doc := new(PIDF)
+	if err := xml.Unmarshal([]byte(body), doc); err != nil {
+		return nil, fmt.Errorf("decode PIDF: %w", err)
+	}
+	if doc.XMLName.Space != pidfNamespace {
+		return nil, fmt.Errorf("decode PIDF: unexpected namespace '%s'", doc.XMLName.Space)
+	}
+
+	return doc, nil
+}
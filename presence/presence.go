@@ -0,0 +1,39 @@
+package presence
+
+import (
+	"context"
+
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// SubscriptionConfig builds subscriber config for the presence of the presentity - RFC 3856 6.
+func SubscriptionConfig(watcher, presentity *sip.Address, contact *sip.ContactHeader) event.ClientConfig {
+	return event.ClientConfig{
+		From:    watcher,
+		To:      presentity,
+		Contact: contact,
+		Event:   event.Event{Package: EventPackage},
+		Accept:  []string{ContentType},
+	}
+}
+
+// ParseNotify decodes PIDF body of the presence NOTIFY request.
+// Returns nil document if NOTIFY has no body, e.g. in pending state.
+func ParseNotify(req sip.Request) (*PIDF, error) {
+	if req.Body() == "" {
+		return nil, nil
+	}
+
+	return DecodePIDF(req.Body())
+}
+
+// Notify sends presence document to the watcher.
+func Notify(ctx context.Context, sub event.ServerSubscription, doc *PIDF) error {
+	body, err := doc.Encode()
+	if err != nil {
+		return err
+	}
+
+	return sub.Notify(ctx, ContentType, body)
+}
@@ -0,0 +1,117 @@
+package presence_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/presence"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+type compositorRequester struct {
+	compositor presence.Compositor
+	requests   []sip.Request
+}
+
+func (r *compositorRequester) RequestWithContext(
+	ctx context.Context,
+	request sip.Request,
+	options ...gosip.RequestWithContextOption,
+) (sip.Response, error) {
+	r.requests = append(r.requests, request)
+	res := r.compositor.HandlePublish(request)
+	if !res.IsSuccess() {
+		return nil, sip.NewRequestError(uint(res.StatusCode()), res.Reason(), request, res)
+	}
+	return res, nil
+}
+
+var _ = Describe("Presence", func() {
+	It("should encode and decode PIDF", func() {
+		doc := presence.NewPIDF("pres:alice@example.com", "t1", presence.Open)
+		doc.Tuples[0].Contact = &presence.Contact{Priority: "0.8", URI: "sip:alice@10.0.0.1"}
+		doc.Tuples[0].Notes = []presence.Note{{Lang: "en", Text: "Available"}}
+
+		body, err := doc.Encode()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(ContainSubstring(`xmlns="urn:ietf:params:xml:ns:pidf"`))
+		Expect(body).To(ContainSubstring(`<basic>open</basic>`))
+
+		decoded, err := presence.DecodePIDF(body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded.Entity).To(Equal("pres:alice@example.com"))
+		Expect(decoded.Basic()).To(Equal(presence.Open))
+		Expect(decoded.Tuples[0].Contact.URI).To(Equal("sip:alice@10.0.0.1"))
+		Expect(decoded.Tuples[0].Notes[0].Lang).To(Equal("en"))
+
+		_, err = presence.DecodePIDF(`<presence xmlns="urn:other" entity="x"/>`)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should publish, refresh, modify and remove state", func() {
+		changes := make([]int, 0)
+		compositor := presence.NewCompositor(presence.CompositorConfig{
+			OnChange: func(resource string, pubs []*presence.Publication) {
+				Expect(resource).To(Equal("sip:alice@example.com"))
+				changes = append(changes, len(pubs))
+			},
+		}, testutils.NewLogrusLogger())
+		requester := &compositorRequester{compositor: compositor}
+		publisher := presence.NewPublisher(requester, presence.PublisherConfig{
+			Entity: &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"}},
+		}, testutils.NewLogrusLogger())
+
+		body, _ := presence.NewPIDF("pres:alice@example.com", "t1", presence.Open).Encode()
+		Expect(publisher.Publish(context.Background(), body)).To(Succeed())
+		etag := publisher.ETag()
+		Expect(etag).ToNot(BeEmpty())
+		Expect(requester.requests[0].GetHeaders("SIP-If-Match")).To(BeEmpty())
+
+		Expect(publisher.Refresh(context.Background())).To(Succeed())
+		Expect(requester.requests[1].GetHeaders("SIP-If-Match")[0].Value()).To(Equal(etag))
+		Expect(requester.requests[1].Body()).To(BeEmpty())
+		Expect(publisher.ETag()).ToNot(Equal(etag))
+
+		pubs := compositor.Publications("sip:alice@example.com")
+		Expect(pubs).To(HaveLen(1))
+		Expect(pubs[0].Body).To(Equal(body))
+
+		Expect(publisher.Remove(context.Background())).To(Succeed())
+		Expect(compositor.Publications("sip:alice@example.com")).To(BeEmpty())
+		Expect(changes).To(Equal([]int{1, 0}))
+	})
+
+	It("should republish on unknown entity-tag", func() {
+		compositor := presence.NewCompositor(presence.CompositorConfig{}, testutils.NewLogrusLogger())
+		requester := &compositorRequester{compositor: compositor}
+		publisher := presence.NewPublisher(requester, presence.PublisherConfig{
+			Entity: &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"}},
+		}, testutils.NewLogrusLogger())
+		Expect(publisher.Publish(context.Background(), "state")).To(Succeed())
+
+		// compositor lost the state
+		requester.compositor = presence.NewCompositor(presence.CompositorConfig{}, testutils.NewLogrusLogger())
+		Expect(publisher.Refresh(context.Background())).To(Succeed())
+		Expect(requester.requests).To(HaveLen(3))
+		Expect(requester.requests[2].Body()).To(Equal("state"))
+		Expect(requester.compositor.Publications("sip:alice@example.com")).To(HaveLen(1))
+	})
+
+	It("should treat removal of the lost publication as done", func() {
+		compositor := presence.NewCompositor(presence.CompositorConfig{}, testutils.NewLogrusLogger())
+		requester := &compositorRequester{compositor: compositor}
+		publisher := presence.NewPublisher(requester, presence.PublisherConfig{
+			Entity: &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"}},
+		}, testutils.NewLogrusLogger())
+		Expect(publisher.Publish(context.Background(), "state")).To(Succeed())
+
+		requester.compositor = presence.NewCompositor(presence.CompositorConfig{}, testutils.NewLogrusLogger())
+		Expect(publisher.Remove(context.Background())).To(Succeed())
+		Expect(publisher.ETag()).To(BeEmpty())
+		Expect(requester.requests).To(HaveLen(2))
+	})
+})
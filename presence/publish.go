@@ -0,0 +1,554 @@
+package presence
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	DefaultPublishExpires = time.Hour
+	DefaultRefreshBefore  = 30 * time.Second
+	DefaultMinExpires     = time.Minute
+	DefaultMaxExpires     = 24 * time.Hour
+)
+
+// PublisherConfig describes event publication client options.
+type PublisherConfig struct {
+	// Target is a Request-URI of PUBLISH requests, default is Entity URI.
+	Target sip.Uri
+	// Entity is an address of the presentity.
+	Entity *sip.Address
+	// Event is an event package, default is "presence".
+	Event event.Event
+	// ContentType of the published state, default is PIDF.
+	ContentType string
+	// Expires is a requested publication duration, default is DefaultPublishExpires.
+	Expires time.Duration
+	// RefreshBefore defines how long before expiry the publication is refreshed, default is DefaultRefreshBefore.
+	RefreshBefore time.Duration
+	Authorizer    sip.Authorizer
+	Headers       []sip.Header
+}
+
+// Publisher publishes event state to the event state compositor - RFC 3903 4.
+type Publisher interface {
+	// Publish sends initial or modifying PUBLISH with the new state.
+	Publish(ctx context.Context, body string) error
+	// Refresh sends refreshing PUBLISH without body - RFC 3903 4.3.
+	Refresh(ctx context.Context) error
+	// Remove sends PUBLISH with Expires: 0 - RFC 3903 4.5.
+	Remove(ctx context.Context) error
+	// ETag returns current entity-tag of the publication.
+	ETag() string
+}
+
+type publisher struct {
+	requester gosip.Requester
+	config    PublisherConfig
+	callID    sip.CallID
+	// opMu serializes publish operations, so each of them uses the entity-tag of the previous one
+	opMu sync.Mutex
+
+	mu      sync.Mutex
+	seqNo   uint32
+	etag    string
+	body    string
+	expires time.Duration
+	timer   timing.Timer
+
+	log log.Logger
+}
+
+// NewPublisher creates publication client.
+func NewPublisher(requester gosip.Requester, config PublisherConfig, logger log.Logger) Publisher {
+	if config.Target == nil && config.Entity != nil {
+		config.Target = config.Entity.Uri.Clone()
+	}
+	if config.Event.Package == "" {
+		config.Event = event.Event{Package: EventPackage}
+	}
+	if config.ContentType == "" {
+		config.ContentType = ContentType
+	}
+	if config.Expires <= 0 {
+		config.Expires = DefaultPublishExpires
+	}
+	if config.RefreshBefore <= 0 {
+		config.RefreshBefore = DefaultRefreshBefore
+	}
+
+	p := &publisher{
+		requester: requester,
+		config:    config,
+		callID:    sip.CallID(util.RandString(32)),
+		seqNo:     uint32(rand.Int31n(1 << 16)),
+	}
+	p.log = logger.
+		WithPrefix("presence.Publisher").
+		WithFields(log.Fields{
+			"publisher_ptr": fmt.Sprintf("%p", p),
+		})
+
+	return p
+}
+
+func (p *publisher) Log() log.Logger {
+	return p.log
+}
+
+func (p *publisher) ETag() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.etag
+}
+
+func (p *publisher) Publish(ctx context.Context, body string) error {
+	p.opMu.Lock()
+	defer p.opMu.Unlock()
+
+	p.mu.Lock()
+	p.body = body
+	p.mu.Unlock()
+
+	return p.publish(ctx, body, true, p.config.Expires)
+}
+
+func (p *publisher) Refresh(ctx context.Context) error {
+	p.opMu.Lock()
+	defer p.opMu.Unlock()
+
+	if p.ETag() == "" {
+		return fmt.Errorf("refresh of not published state")
+	}
+
+	return p.publish(ctx, "", false, p.config.Expires)
+}
+
+func (p *publisher) Remove(ctx context.Context) error {
+	// pending refresh could schedule the next one, so the timer is stopped after it
+	p.opMu.Lock()
+	defer p.opMu.Unlock()
+
+	p.mu.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.mu.Unlock()
+
+	if p.ETag() == "" {
+		return nil
+	}
+
+	err := p.publish(ctx, "", false, 0)
+
+	p.mu.Lock()
+	p.etag = ""
+	p.body = ""
+	p.mu.Unlock()
+
+	// RFC 3903 4.4. the compositor does not have the publication anymore, so there is nothing to remove
+	if reqErr, ok := err.(*sip.RequestError); ok && reqErr.Code == 412 {
+		p.Log().Debug("publication is already expired")
+
+		return nil
+	}
+
+	return err
+}
+
+func (p *publisher) publish(ctx context.Context, body string, withBody bool, expires time.Duration) error {
+	req := p.newRequest(body, withBody, expires)
+
+	options := make([]gosip.RequestWithContextOption, 0)
+	if p.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(p.config.Authorizer))
+	}
+
+	res, err := p.requester.RequestWithContext(ctx, req, options...)
+	if err != nil {
+		reqErr, ok := err.(*sip.RequestError)
+		conditional := len(req.GetHeaders("SIP-If-Match")) > 0
+		// RFC 3903 4.4. entity-tag is unknown to the compositor, initial publication is required
+		if ok && reqErr.Code == 412 && conditional && expires > 0 {
+			p.mu.Lock()
+			p.etag = ""
+			body = p.body
+			p.mu.Unlock()
+
+			p.Log().Debug("publication is lost, publishing initial state")
+
+			return p.publish(ctx, body, true, expires)
+		}
+		// RFC 3903 4.6. 423 Interval Too Brief
+		if ok && reqErr.Code == 423 && reqErr.Response != nil {
+			if hdrs := reqErr.Response.GetHeaders("Min-Expires"); len(hdrs) > 0 {
+				if sec, e := strconv.ParseUint(strings.TrimSpace(hdrs[0].Value()), 10, 32); e == nil && time.Duration(sec)*time.Second > expires {
+					return p.publish(ctx, body, withBody, time.Duration(sec)*time.Second)
+				}
+			}
+		}
+
+		return err
+	}
+
+	if expires == 0 {
+		return nil
+	}
+
+	granted := expires
+	if hdrs := res.GetHeaders("Expires"); len(hdrs) > 0 {
+		if sec, err := strconv.ParseUint(strings.TrimSpace(hdrs[0].Value()), 10, 32); err == nil && sec > 0 {
+			granted = time.Duration(sec) * time.Second
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if hdrs := res.GetHeaders("SIP-ETag"); len(hdrs) > 0 {
+		p.etag = strings.TrimSpace(hdrs[0].Value())
+	}
+	p.expires = granted
+
+	delay := granted - p.config.RefreshBefore
+	if granted <= 2*p.config.RefreshBefore {
+		delay = granted / 2
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = timing.AfterFunc(delay, func() {
+		if err := p.Refresh(context.Background()); err != nil {
+			p.Log().Warnf("refresh publication failed: %s", err)
+		}
+	})
+
+	return nil
+}
+
+func (p *publisher) newRequest(body string, withBody bool, expires time.Duration) sip.Request {
+	p.mu.Lock()
+	p.seqNo++
+	seqNo := p.seqNo
+	etag := p.etag
+	p.mu.Unlock()
+
+	to := p.config.Entity.AsToHeader()
+	to.Params = sip.NewParams()
+	from := p.config.Entity.AsFromHeader()
+	from.Params = sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)})
+	maxForwards := sip.MaxForwards(70)
+	callID := p.callID
+	expiresHdr := sip.Expires(uint32(expires / time.Second))
+
+	hdrs := []sip.Header{
+		sip.ViaHeader{
+			&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       sip.DefaultProtocol,
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			},
+		},
+		&maxForwards,
+		from,
+		to,
+		&callID,
+		&sip.CSeq{SeqNo: seqNo, MethodName: sip.PUBLISH},
+		p.config.Event.Header(),
+		&expiresHdr,
+	}
+	if etag != "" {
+		hdrs = append(hdrs, &sip.GenericHeader{HeaderName: "SIP-If-Match", Contents: etag})
+	}
+	if withBody {
+		contentType := sip.ContentType(p.config.ContentType)
+		hdrs = append(hdrs, &contentType)
+	}
+	for _, hdr := range p.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	req := sip.NewRequest(
+		"",
+		sip.PUBLISH,
+		p.config.Target.Clone(),
+		"SIP/2.0",
+		hdrs,
+		"",
+		log.Fields{
+			"publisher_ptr": fmt.Sprintf("%p", p),
+		},
+	)
+	req.SetBody(body, true)
+
+	return req
+}
+
+// Publication is an event state published by the single publisher.
+type Publication struct {
+	Resource    string
+	ETag        string
+	ContentType string
+	Body        string
+	Expires     time.Time
+}
+
+// CompositorConfig describes event state compositor options.
+type CompositorConfig struct {
+	// Event is an event package, default is "presence".
+	Event      event.Event
+	MinExpires time.Duration
+	MaxExpires time.Duration
+	// OnChange is called when the resource state is published, modified or removed.
+	OnChange func(resource string, publications []*Publication)
+}
+
+// Compositor is an event state compositor that processes PUBLISH requests - RFC 3903 6.
+type Compositor interface {
+	// ServePublish handles PUBLISH request, can be passed directly to gosip.Server OnRequest.
+	ServePublish(req sip.Request, tx sip.ServerTransaction)
+	// HandlePublish processes PUBLISH request and builds the response.
+	HandlePublish(req sip.Request) sip.Response
+	// Publications returns active publications of the resource.
+	Publications(resource string) []*Publication
+}
+
+type compositor struct {
+	config CompositorConfig
+
+	mu           sync.Mutex
+	publications map[string]map[string]*Publication
+	timers       map[string]timing.Timer
+
+	log log.Logger
+}
+
+// NewCompositor creates event state compositor.
+func NewCompositor(config CompositorConfig, logger log.Logger) Compositor {
+	if config.Event.Package == "" {
+		config.Event = event.Event{Package: EventPackage}
+	}
+	if config.MinExpires <= 0 {
+		config.MinExpires = DefaultMinExpires
+	}
+	if config.MaxExpires <= 0 {
+		config.MaxExpires = DefaultMaxExpires
+	}
+
+	c := &compositor{
+		config:       config,
+		publications: make(map[string]map[string]*Publication),
+		timers:       make(map[string]timing.Timer),
+	}
+	c.log = logger.WithPrefix("presence.Compositor")
+
+	return c
+}
+
+func (c *compositor) Log() log.Logger {
+	return c.log
+}
+
+func (c *compositor) ServePublish(req sip.Request, tx sip.ServerTransaction) {
+	if err := tx.Respond(c.HandlePublish(req)); err != nil {
+		c.Log().WithFields(req.Fields()).Errorf("respond on PUBLISH failed: %s", err)
+	}
+}
+
+func (c *compositor) HandlePublish(req sip.Request) sip.Response {
+	// RFC 3903 6. step 2, event package
+	if ev, ok := event.GetEvent(req); !ok || !strings.EqualFold(ev.Package, c.config.Event.Package) {
+		res := sip.NewResponseFromRequest("", req, 489, "Bad Event", "")
+		res.AppendHeader(&sip.GenericHeader{HeaderName: "Allow-Events", Contents: c.config.Event.Package})
+
+		return res
+	}
+
+	resource := ResourceKey(req.Recipient())
+
+	expires := DefaultPublishExpires
+	if hdrs := req.GetHeaders("Expires"); len(hdrs) > 0 {
+		sec, err := strconv.ParseUint(strings.TrimSpace(hdrs[0].Value()), 10, 32)
+		if err != nil {
+			return sip.NewResponseFromRequest("", req, 400, "Bad Request", "")
+		}
+		expires = time.Duration(sec) * time.Second
+	}
+	// RFC 3903 6. step 5
+	if expires > 0 && expires < c.config.MinExpires {
+		res := sip.NewResponseFromRequest("", req, 423, "Interval Too Brief", "")
+		res.AppendHeader(&sip.GenericHeader{
+			HeaderName: "Min-Expires",
+			Contents:   fmt.Sprintf("%d", int(c.config.MinExpires/time.Second)),
+		})
+
+		return res
+	}
+	if expires > c.config.MaxExpires {
+		expires = c.config.MaxExpires
+	}
+
+	var ifMatch string
+	if hdrs := req.GetHeaders("SIP-If-Match"); len(hdrs) > 0 {
+		ifMatch = strings.TrimSpace(hdrs[0].Value())
+	}
+
+	var contentType string
+	if hdrs := req.GetHeaders("Content-Type"); len(hdrs) > 0 {
+		contentType = hdrs[0].Value()
+	}
+
+	c.mu.Lock()
+
+	pubs := c.publications[resource]
+	var pub *Publication
+	if ifMatch != "" {
+		// RFC 3903 6. step 4, unknown entity-tag
+		if pubs == nil || pubs[ifMatch] == nil {
+			c.mu.Unlock()
+
+			return sip.NewResponseFromRequest("", req, 412, "Conditional Request Failed", "")
+		}
+		pub = pubs[ifMatch]
+		delete(pubs, ifMatch)
+		c.stopTimer(ifMatch)
+	} else if req.Body() == "" {
+		// initial publication must contain the state
+		c.mu.Unlock()
+
+		return sip.NewResponseFromRequest("", req, 400, "Bad Request", "")
+	}
+
+	if expires == 0 {
+		if len(pubs) == 0 {
+			delete(c.publications, resource)
+		}
+		snapshot := c.snapshot(resource)
+		c.mu.Unlock()
+
+		c.notify(resource, snapshot)
+
+		res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+		expiresHdr := sip.Expires(0)
+		res.AppendHeader(&expiresHdr)
+
+		return res
+	}
+
+	if pub == nil {
+		pub = &Publication{Resource: resource}
+	}
+	// RFC 3903 6. step 6, new entity-tag on each successful publication
+	pub.ETag = util.RandString(16)
+	pub.Expires = timing.Now().Add(expires)
+	changed := req.Body() != ""
+	if changed {
+		pub.Body = req.Body()
+		pub.ContentType = contentType
+	}
+
+	if pubs == nil {
+		pubs = make(map[string]*Publication)
+		c.publications[resource] = pubs
+	}
+	pubs[pub.ETag] = pub
+	etag := pub.ETag
+	c.timers[etag] = timing.AfterFunc(expires, func() {
+		c.expire(resource, etag)
+	})
+	snapshot := c.snapshot(resource)
+	c.mu.Unlock()
+
+	if changed {
+		c.notify(resource, snapshot)
+	}
+
+	res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+	res.AppendHeader(&sip.GenericHeader{HeaderName: "SIP-ETag", Contents: etag})
+	expiresHdr := sip.Expires(uint32(expires / time.Second))
+	res.AppendHeader(&expiresHdr)
+
+	return res
+}
+
+// ResourceKey converts presentity URI to the 'sip:user@host' form used as publications key.
+func ResourceKey(uri sip.Uri) string {
+	sipUri, ok := uri.(*sip.SipUri)
+	if !ok {
+		return uri.String()
+	}
+
+	key := "sip:"
+	if sipUri.FUser != nil && sipUri.FUser.String() != "" {
+		key += sipUri.FUser.String() + "@"
+	}
+
+	return key + strings.ToLower(sipUri.FHost)
+}
+
+func (c *compositor) Publications(resource string) []*Publication {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.snapshot(resource)
+}
+
+func (c *compositor) expire(resource, etag string) {
+	c.mu.Lock()
+	pubs := c.publications[resource]
+	if pubs == nil || pubs[etag] == nil {
+		c.mu.Unlock()
+		return
+	}
+	delete(pubs, etag)
+	delete(c.timers, etag)
+	if len(pubs) == 0 {
+		delete(c.publications, resource)
+	}
+	snapshot := c.snapshot(resource)
+	c.mu.Unlock()
+
+	c.Log().Debugf("publication %s of %s expired", etag, resource)
+
+	c.notify(resource, snapshot)
+}
+
+// should be called under lock
+func (c *compositor) stopTimer(etag string) {
+	if timer, ok := c.timers[etag]; ok {
+		timer.Stop()
+		delete(c.timers, etag)
+	}
+}
+
+// should be called under lock
+func (c *compositor) snapshot(resource string) []*Publication {
+	pubs := make([]*Publication, 0, len(c.publications[resource]))
+	for _, pub := range c.publications[resource] {
+		clone := *pub
+		pubs = append(pubs, &clone)
+	}
+
+	return pubs
+}
+
+func (c *compositor) notify(resource string, pubs []*Publication) {
+	if c.config.OnChange != nil {
+		c.config.OnChange(resource, pubs)
+	}
+}
@@ -0,0 +1,84 @@
+package gosip
+
+import (
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Stage is a stage of the message processing pipeline.
+type Stage string
+
+const (
+	// StageParse is parsing of the incoming message by the transport layer.
+	StageParse Stage = "parse"
+	// StageTransaction is matching of the incoming request to the transaction by the transaction layer,
+	// including queueing between the layers.
+	StageTransaction Stage = "transaction"
+	// StageHandler is processing of the incoming request by the TU handler.
+	StageHandler Stage = "handler"
+	// StageSend is sending of the outgoing message by the transport layer, including DNS lookup.
+	StageSend Stage = "send"
+)
+
+// Stages lists stages of the pipeline in processing order.
+var Stages = []Stage{StageParse, StageTransaction, StageHandler, StageSend}
+
+// Timings is a time spent by the message in the pipeline stages, zero durations are stages not passed by the message.
+type Timings struct {
+	Parse       time.Duration
+	Transaction time.Duration
+	Handler     time.Duration
+	Send        time.Duration
+}
+
+// Get returns duration of the stage.
+func (t Timings) Get(stage Stage) time.Duration {
+	switch stage {
+	case StageParse:
+		return t.Parse
+	case StageTransaction:
+		return t.Transaction
+	case StageHandler:
+		return t.Handler
+	case StageSend:
+		return t.Send
+	default:
+		return 0
+	}
+}
+
+// Total returns time spent in all stages.
+func (t Timings) Total() time.Duration {
+	return t.Parse + t.Transaction + t.Handler + t.Send
+}
+
+// Profiler receives timings of processed messages to find processing bottlenecks, latency package implements it.
+// Methods are called synchronously from the SIP stack, so they must not block.
+type Profiler interface {
+	// MessageProcessed is called when the incoming request is handled by the TU handler,
+	// the incoming response is parsed or the outgoing message is sent.
+	MessageProcessed(msg sip.Message, timings Timings)
+}
+
+// Profilers combines profilers, like metrics and latency percentiles, timings are passed to all of them in order.
+func Profilers(profilers ...Profiler) Profiler {
+	return multiProfiler(profilers)
+}
+
+type multiProfiler []Profiler
+
+func (profilers multiProfiler) MessageProcessed(msg sip.Message, timings Timings) {
+	for _, profiler := range profilers {
+		profiler.MessageProcessed(msg, timings)
+	}
+}
+
+// messageTimings returns timings of the incoming message recorded by the transport layer.
+func messageTimings(msg sip.Message) (timings Timings, receivedAt time.Time) {
+	fields := msg.Fields()
+	timings.Parse, _ = fields["parse_duration"].(time.Duration)
+	receivedAt, _ = fields["received_at"].(time.Time)
+
+	return timings, receivedAt
+}
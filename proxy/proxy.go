@@ -0,0 +1,466 @@
+// proxy package implements stateful SIP proxy core - RFC 3261 16.
+// The proxy validates and forwards requests to the target set determined by the TargetSet plugin,
+// forks them in parallel or sequentially and selects the best response of all branches.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// DefaultMaxForwards is a value of Max-Forwards inserted into forwarded requests without it.
+const DefaultMaxForwards = 70
+
+// Forking is a mode of forwarding the request to the target set.
+type Forking int
+
+const (
+	// Parallel forwards the request to all targets at once.
+	Parallel Forking = iota
+	// Sequential forwards the request to groups of targets with equal q-value in descending q order,
+	// the next group is tried when all branches of the previous one failed.
+	Sequential
+)
+
+func (forking Forking) String() string {
+	switch forking {
+	case Parallel:
+		return "Parallel"
+	case Sequential:
+		return "Sequential"
+	default:
+		return "Unknown"
+	}
+}
+
+// Config describes proxy options.
+type Config struct {
+	// TargetSet determines targets of out-of-dialog requests, default is RequestURITargetSet.
+	// In-dialog requests and requests with pre-loaded Route are always forwarded to the Request-URI.
+	TargetSet TargetSet
+	// RecordRoute is the proxy URI inserted into Record-Route of out-of-dialog requests, nil disables record-routing.
+	// Route entries and strict routing Request-URI with this host and port are recognized as own.
+	RecordRoute sip.Uri
+	// Interfaces are additional proxy URIs of other transports or network interfaces.
+	// The interface is selected by 'transport' URI param, Record-Route is doubled when the request
+	// is forwarded through another interface than it was received on - RFC 5658.
+	Interfaces []sip.Uri
+	// Forking is a mode of forwarding the request to multiple targets, default is Parallel.
+	Forking Forking
+	// BranchTimeout limits waiting of the final response on each branch, zero means the transaction timeout.
+	BranchTimeout time.Duration
+	// MaxForwards is inserted into forwarded requests without Max-Forwards header, default is DefaultMaxForwards.
+	MaxForwards uint32
+	// LoopDetection enables detection of requests looped back to the proxy - RFC 3261 16.3 step 4.
+	// Hash of the request fields is embedded into the branch of the proxy Via, the request received
+	// with such Via and the same hash is rejected with 482, requests with changed fields are spirals and forwarded.
+	LoopDetection bool
+	// Supported lists option tags of Proxy-Require header the proxy understands.
+	Supported []string
+	// OnRequest is called with each request before it is forwarded to the target.
+	OnRequest func(req sip.Request)
+	// OnResponse is called with each response before it is forwarded upstream.
+	OnResponse func(res sip.Response)
+}
+
+// Proxy is a stateful proxy core.
+type Proxy interface {
+	// ServeRequest proxies the incoming request, it can be passed directly to gosip.Server OnRequest for any method.
+	// ACK on 2xx is forwarded statelessly, CANCEL of the proxied INVITE is received through the server transaction.
+	ServeRequest(req sip.Request, tx sip.ServerTransaction)
+}
+
+type proxy struct {
+	requester gosip.RequestSender
+	config    Config
+	// id marks branches of the proxy Via entries
+	id string
+
+	log log.Logger
+}
+
+// NewProxy creates proxy.
+func NewProxy(requester gosip.RequestSender, config Config, logger log.Logger) Proxy {
+	if config.TargetSet == nil {
+		config.TargetSet = RequestURITargetSet
+	}
+	if config.MaxForwards == 0 {
+		config.MaxForwards = DefaultMaxForwards
+	}
+
+	p := &proxy{
+		requester: requester,
+		config:    config,
+		id:        util.RandString(8),
+	}
+	p.log = logger.
+		WithPrefix("proxy.Proxy").
+		WithFields(log.Fields{
+			"proxy_ptr": fmt.Sprintf("%p", p),
+		})
+
+	return p
+}
+
+func (p *proxy) Log() log.Logger {
+	return p.log
+}
+
+func (p *proxy) ServeRequest(req sip.Request, tx sip.ServerTransaction) {
+	logger := p.Log().WithFields(req.Fields())
+
+	if res := p.validate(req); res != nil {
+		logger.Debugf("request rejected with '%s'", res.Short())
+		if !req.IsAck() {
+			p.respond(tx, res)
+		}
+
+		return
+	}
+
+	req = p.preprocessRoute(req)
+
+	if p.config.LoopDetection && p.isLooped(req) {
+		logger.Debug("loop detected")
+		if !req.IsAck() {
+			p.respond(tx, sip.NewResponseFromRequest("", req, 482, "Loop Detected", ""))
+		}
+
+		return
+	}
+
+	if req.IsAck() || tx == nil {
+		fwd := p.newRequest(req, Target{Uri: req.Recipient().Clone()})
+		if err := p.requester.Send(fwd); err != nil {
+			logger.Errorf("forward '%s' failed: %s", fwd.Short(), err)
+		}
+
+		return
+	}
+
+	targets, err := p.targets(req)
+	if err != nil {
+		logger.Debugf("determine targets failed: %s", err)
+
+		var reqErr *sip.RequestError
+		if errors.As(err, &reqErr) {
+			p.respond(tx, sip.NewResponseFromRequest("", req, sip.StatusCode(reqErr.Code), reqErr.Reason, ""))
+		} else {
+			p.respond(tx, sip.NewResponseFromRequest("", req, 500, "Server Internal Error", ""))
+		}
+
+		return
+	}
+	if len(targets) == 0 {
+		p.respond(tx, sip.NewResponseFromRequest("", req, 480, "Temporarily Unavailable", ""))
+
+		return
+	}
+
+	newResponseContext(p, req, tx).run(targets)
+}
+
+// validate checks the request before forwarding - RFC 3261 16.3.
+func (p *proxy) validate(req sip.Request) sip.Response {
+	if hdrs := req.GetHeaders("Max-Forwards"); len(hdrs) > 0 {
+		if maxForwards, ok := hdrs[0].(*sip.MaxForwards); ok && *maxForwards == 0 {
+			return sip.NewResponseFromRequest("", req, 483, "Too Many Hops", "")
+		}
+	}
+
+	var unsupported []string
+	for _, hdr := range req.GetHeaders("Proxy-Require") {
+		for _, tag := range strings.Split(hdr.Value(), ",") {
+			tag = strings.TrimSpace(tag)
+			if tag != "" && !p.supports(tag) {
+				unsupported = append(unsupported, tag)
+			}
+		}
+	}
+	if len(unsupported) > 0 {
+		res := sip.NewResponseFromRequest("", req, 420, "Bad Extension", "")
+		res.AppendHeader(&sip.GenericHeader{
+			HeaderName: "Unsupported",
+			Contents:   strings.Join(unsupported, ", "),
+		})
+
+		return res
+	}
+
+	return nil
+}
+
+func (p *proxy) supports(tag string) bool {
+	for _, supported := range p.config.Supported {
+		if strings.EqualFold(supported, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// preprocessRoute processes route information of the request copy - RFC 3261 16.4.
+func (p *proxy) preprocessRoute(req sip.Request) sip.Request {
+	req = sip.CopyRequest(req)
+	local := p.localUris()
+	if sip.RestoreStrictRoute(req, local...) {
+		p.Log().WithFields(req.Fields()).Debug("request received from strict router")
+	}
+	sip.StripLocalRoutes(req, local...)
+
+	return req
+}
+
+func (p *proxy) targets(req sip.Request) ([]Target, error) {
+	if isInDialog(req) || len(sip.RouteUris(req)) > 0 {
+		return RequestURITargetSet(req)
+	}
+
+	return p.config.TargetSet.Targets(req)
+}
+
+// newRequest builds the request forwarded to the target - RFC 3261 16.6.
+func (p *proxy) newRequest(req sip.Request, target Target) sip.Request {
+	hdrs := make([]sip.Header, 0)
+	for _, hdr := range req.Headers() {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	fwd := sip.NewRequest(
+		"",
+		req.Method(),
+		target.Uri.Clone(),
+		req.SipVersion(),
+		hdrs,
+		req.Body(),
+		log.Fields{
+			"proxy_ptr": fmt.Sprintf("%p", p),
+		},
+	)
+
+	if hdrs := fwd.GetHeaders("Max-Forwards"); len(hdrs) > 0 {
+		if hdr, ok := hdrs[0].(*sip.MaxForwards); ok && *hdr > 0 {
+			*hdr--
+		}
+	} else {
+		maxForwards := sip.MaxForwards(p.config.MaxForwards)
+		fwd.AppendHeader(&maxForwards)
+	}
+
+	transport := targetTransport(sip.NextHop(fwd))
+	if p.config.RecordRoute != nil && !isInDialog(fwd) && !fwd.IsAck() && fwd.Method() != sip.REGISTER {
+		sip.AddRecordRoute(fwd, p.iface(req.Transport()), p.iface(transport))
+	}
+
+	// next hop is a strict router, so it gets the Request-URI in the last Route entry
+	sip.CompensateStrictRoute(fwd)
+
+	fwd.PrependHeader(sip.ViaHeader{
+		&sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       transport,
+			Params:          sip.NewParams().Add("branch", sip.String{Str: p.branch(req)}),
+		},
+	})
+
+	if p.config.OnRequest != nil {
+		p.config.OnRequest(fwd)
+	}
+
+	return fwd
+}
+
+// newResponse builds the response forwarded upstream, the topmost Via is removed - RFC 3261 16.7.
+func (p *proxy) newResponse(req sip.Request, res sip.Response) sip.Response {
+	hdrs := make([]sip.Header, 0)
+	for _, hdr := range res.Headers() {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	out := sip.NewResponse(
+		"",
+		res.SipVersion(),
+		res.StatusCode(),
+		res.Reason(),
+		hdrs,
+		res.Body(),
+		log.Fields{
+			"proxy_ptr": fmt.Sprintf("%p", p),
+		},
+	)
+	popVia(out)
+	out.SetTransport(req.Transport())
+	out.SetSource(req.Destination())
+	out.SetDestination(req.Source())
+
+	if p.config.OnResponse != nil {
+		p.config.OnResponse(out)
+	}
+
+	return out
+}
+
+func (p *proxy) respond(tx sip.ServerTransaction, res sip.Response) {
+	if err := tx.Respond(res); err != nil {
+		p.Log().WithFields(res.Fields()).Errorf("respond '%s' failed: %s", res.Short(), err)
+	}
+}
+
+// branch generates branch of the proxy Via, with enabled loop detection it includes
+// the proxy id and the hash of the request - RFC 3261 16.6 step 8.
+func (p *proxy) branch(req sip.Request) string {
+	if !p.config.LoopDetection {
+		return sip.GenerateBranch()
+	}
+
+	return strings.Join([]string{
+		sip.RFC3261BranchMagicCookie,
+		p.id,
+		loopHash(req),
+		util.RandString(16),
+	}, ".")
+}
+
+// isLooped checks Via entries of the proxy for the hash of the request - RFC 3261 16.3 step 4.
+// The same hash means that the request is looped back unchanged, other one means that the request spirals.
+func (p *proxy) isLooped(req sip.Request) bool {
+	var hash string
+	for _, hdr := range req.GetHeaders("Via") {
+		via, ok := hdr.(sip.ViaHeader)
+		if !ok {
+			continue
+		}
+		for _, hop := range via {
+			if hop.Params == nil {
+				continue
+			}
+			branch, ok := hop.Params.Get("branch")
+			if !ok || branch == nil {
+				continue
+			}
+			parts := strings.Split(branch.String(), ".")
+			if len(parts) != 4 || parts[0] != sip.RFC3261BranchMagicCookie || parts[1] != p.id {
+				continue
+			}
+
+			if hash == "" {
+				hash = loopHash(req)
+			}
+			if parts[2] == hash {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// loopHash hashes the request fields that are changed when the request spirals - RFC 3261 16.6 step 8.
+// Topmost Via is not hashed, since it always differs when the request is looped back through other elements.
+func loopHash(req sip.Request) string {
+	h := fnv.New64a()
+	write := func(str string) {
+		_, _ = h.Write([]byte(str))
+		_, _ = h.Write([]byte{0})
+	}
+
+	write(req.Recipient().String())
+	if to, ok := req.To(); ok {
+		write(getTag(to.Params))
+	}
+	if from, ok := req.From(); ok {
+		write(getTag(from.Params))
+	}
+	if callID, ok := req.CallID(); ok {
+		write(callID.Value())
+	}
+	if cseq, ok := req.CSeq(); ok {
+		write(fmt.Sprintf("%d", cseq.SeqNo))
+	}
+	for _, name := range []string{"Proxy-Require", "Proxy-Authorization"} {
+		for _, hdr := range req.GetHeaders(name) {
+			write(hdr.Value())
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+func (p *proxy) localUris() []sip.Uri {
+	if p.config.RecordRoute == nil {
+		return p.config.Interfaces
+	}
+
+	return append([]sip.Uri{p.config.RecordRoute}, p.config.Interfaces...)
+}
+
+// iface returns the proxy URI of the transport, default is RecordRoute.
+func (p *proxy) iface(transport string) sip.Uri {
+	for _, uri := range p.config.Interfaces {
+		if strings.EqualFold(targetTransport(uri), transport) {
+			return uri
+		}
+	}
+
+	return p.config.RecordRoute
+}
+
+func targetTransport(uri sip.Uri) string {
+	if uri.UriParams() != nil {
+		if tp, ok := uri.UriParams().Get("transport"); ok && tp != nil && tp.String() != "" {
+			return strings.ToUpper(tp.String())
+		}
+	}
+
+	return sip.DefaultProtocol
+}
+
+func getTag(params sip.Params) string {
+	if params == nil {
+		return ""
+	}
+	if tag, ok := params.Get("tag"); ok && tag != nil {
+		return tag.String()
+	}
+
+	return ""
+}
+
+func isInDialog(req sip.Request) bool {
+	to, ok := req.To()
+	if !ok || to.Params == nil {
+		return false
+	}
+
+	return to.Params.Has("tag")
+}
+
+func popVia(msg sip.Message) {
+	hdrs := msg.GetHeaders("Via")
+	if len(hdrs) == 0 {
+		return
+	}
+
+	rest := make([]sip.Header, 0, len(hdrs))
+	if via, ok := hdrs[0].(sip.ViaHeader); ok && len(via) > 1 {
+		rest = append(rest, via[1:])
+	}
+	rest = append(rest, hdrs[1:]...)
+
+	if len(rest) == 0 {
+		msg.RemoveHeader("Via")
+
+		return
+	}
+	msg.ReplaceHeaders("Via", rest)
+}
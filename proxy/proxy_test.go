@@ -0,0 +1,387 @@
+package proxy_test
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/proxy"
+	"github.com/ghettovoice/gosip/registrar"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+// network delivers requests to the handler selected by Request-URI host,
+// the handler returns responses of the branch, no final response means that the branch was cancelled.
+type network struct {
+	mu       sync.Mutex
+	handlers map[string]func(ctx context.Context, req sip.Request) []sip.Response
+	requests []sip.Request
+	sent     chan sip.Message
+}
+
+func (n *network) RequestWithContext(
+	ctx context.Context,
+	request sip.Request,
+	options ...gosip.RequestWithContextOption,
+) (sip.Response, error) {
+	opts := &gosip.RequestWithContextOptions{}
+	for _, opt := range options {
+		opt.ApplyRequestWithContext(opts)
+	}
+
+	n.mu.Lock()
+	n.requests = append(n.requests, request)
+	handler := n.handlers[request.Recipient().Host()]
+	n.mu.Unlock()
+
+	var res sip.Response
+	for _, res = range handler(ctx, request) {
+		if opts.ResponseHandler != nil {
+			opts.ResponseHandler(res, request)
+		}
+	}
+	switch {
+	case res == nil || res.IsProvisional():
+		return nil, sip.NewRequestError(487, "Request Terminated", request, res)
+	case res.IsSuccess():
+		return res, nil
+	default:
+		return nil, sip.NewRequestError(uint(res.StatusCode()), res.Reason(), request, res)
+	}
+}
+
+func (n *network) Send(msg sip.Message) error {
+	n.sent <- msg
+	return nil
+}
+
+func (n *network) Requests() []sip.Request {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]sip.Request{}, n.requests...)
+}
+
+func (n *network) respondWith(codes ...sip.StatusCode) func(ctx context.Context, req sip.Request) []sip.Response {
+	return func(ctx context.Context, req sip.Request) []sip.Response {
+		responses := make([]sip.Response, 0, len(codes))
+		for _, code := range codes {
+			responses = append(responses, sip.NewResponseFromRequest("", req, code, "", ""))
+		}
+		return responses
+	}
+}
+
+func uri(str string) sip.Uri {
+	return testutils.Request([]string{"OPTIONS " + str + " SIP/2.0", "", ""}).Recipient()
+}
+
+var _ = Describe("Proxy", func() {
+	var (
+		net    *network
+		config proxy.Config
+		invite sip.Request
+		tx     *testutils.MockServerTx
+	)
+
+	targets := func(targets ...proxy.Target) proxy.TargetSet {
+		return proxy.TargetSetFunc(func(req sip.Request) ([]proxy.Target, error) {
+			return targets, nil
+		})
+	}
+
+	BeforeEach(func() {
+		net = &network{
+			handlers: make(map[string]func(ctx context.Context, req sip.Request) []sip.Response),
+			sent:     make(chan sip.Message, 10),
+		}
+		config = proxy.Config{
+			RecordRoute: uri("sip:10.0.0.100:5060"),
+		}
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"Max-Forwards: 70",
+			"Route: <sip:10.0.0.100:5060;lr>",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: proxy-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"",
+			"",
+		})
+		tx = testutils.NewMockServerTx(invite)
+	})
+
+	It("should forward request and responses", func() {
+		net.handlers["10.0.0.2"] = net.respondWith(100, 180, 200)
+		config.TargetSet = targets(proxy.Target{Uri: uri("sip:bob@10.0.0.2:5060")})
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+
+		requests := net.Requests()
+		Expect(requests).To(HaveLen(1))
+		req := requests[0]
+		Expect(req.Recipient().String()).To(Equal("sip:bob@10.0.0.2:5060"))
+		Expect(req.GetHeaders("Via")).To(HaveLen(2))
+		Expect(req.GetHeaders("Max-Forwards")[0].Value()).To(Equal("69"))
+		Expect(req.GetHeaders("Route")).To(BeEmpty())
+		Expect(req.GetHeaders("Record-Route")[0].Value()).To(Equal("<sip:10.0.0.100:5060;lr>"))
+
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{180, 200}))
+		res := tx.Response()
+		Expect(res.GetHeaders("Via")).To(HaveLen(1))
+		via, _ := res.ViaHop()
+		Expect(via.Host).To(Equal("10.0.0.1"))
+		Expect(res.GetHeaders("Record-Route")).To(HaveLen(1))
+	})
+
+	It("should double Record-Route between transports", func() {
+		net.handlers["10.0.0.2"] = net.respondWith(200)
+		config.Interfaces = []sip.Uri{uri("sip:10.0.0.100:5060;transport=tcp")}
+		config.TargetSet = targets(proxy.Target{Uri: uri("sip:bob@10.0.0.2:5060;transport=tcp")})
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+
+		req := net.Requests()[0]
+		rr := req.GetHeaders("Record-Route")
+		Expect(rr).To(HaveLen(2))
+		Expect(rr[0].Value()).To(Equal("<sip:10.0.0.100:5060;transport=tcp;lr>"))
+		Expect(rr[1].Value()).To(Equal("<sip:10.0.0.100:5060;lr>"))
+		via, _ := req.ViaHop()
+		Expect(via.Transport).To(Equal("TCP"))
+
+		// both own entries are stripped from the in-dialog request
+		bye := testutils.Request([]string{
+			"BYE sip:bob@10.0.0.2:5060;transport=tcp SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"Max-Forwards: 70",
+			"Route: <sip:10.0.0.100:5060;lr>, <sip:10.0.0.100:5060;transport=tcp;lr>",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: proxy-call-id",
+			"CSeq: 2 BYE",
+			"",
+			"",
+		})
+		tx = testutils.NewMockServerTx(bye)
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(bye, tx)
+		req = net.Requests()[1]
+		Expect(req.GetHeaders("Route")).To(BeEmpty())
+		Expect(req.GetHeaders("Record-Route")).To(BeEmpty())
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{200}))
+	})
+
+	It("should reject invalid request", func() {
+		maxForwards := sip.MaxForwards(0)
+		invite.ReplaceHeaders("Max-Forwards", []sip.Header{&maxForwards})
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{483}))
+
+		maxForwards = 10
+		invite.AppendHeader(&sip.GenericHeader{HeaderName: "Proxy-Require", Contents: "foo"})
+		tx = testutils.NewMockServerTx(invite)
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{420}))
+		Expect(tx.Response().GetHeaders("Unsupported")[0].Value()).To(Equal("foo"))
+		Expect(net.Requests()).To(BeEmpty())
+	})
+
+	It("should insert Max-Forwards and detect loops", func() {
+		net.handlers["10.0.0.2"] = net.respondWith(200)
+		config.MaxForwards = 20
+		config.LoopDetection = true
+		config.TargetSet = targets(proxy.Target{Uri: uri("sip:bob@10.0.0.2:5060")})
+		p := proxy.NewProxy(net, config, testutils.NewLogrusLogger())
+
+		invite.RemoveHeader("Max-Forwards")
+		p.ServeRequest(invite, tx)
+		fwd := net.Requests()[0]
+		Expect(fwd.GetHeaders("Max-Forwards")[0].Value()).To(Equal("20"))
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{200}))
+
+		// downstream element sends the request back unchanged
+		looped := sip.CopyRequest(fwd)
+		looped.PrependHeader(sip.ViaHeader{&sip.ViaHop{
+			ProtocolName:    "SIP",
+			ProtocolVersion: "2.0",
+			Transport:       "UDP",
+			Host:            "10.0.0.2",
+			Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+		}})
+		looped.SetRecipient(invite.Recipient().Clone())
+		tx = testutils.NewMockServerTx(looped)
+		p.ServeRequest(looped, tx)
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{482}))
+		Expect(net.Requests()).To(HaveLen(1))
+
+		// the request with retargeted Request-URI spirals
+		spiral := sip.CopyRequest(looped)
+		spiral.SetRecipient(uri("sip:bob-mobile@example.com"))
+		tx = testutils.NewMockServerTx(spiral)
+		p.ServeRequest(spiral, tx)
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{200}))
+		Expect(net.Requests()).To(HaveLen(2))
+		Expect(net.Requests()[1].GetHeaders("Via")).To(HaveLen(4))
+	})
+
+	It("should fork in parallel and cancel losing branches on 2xx", func() {
+		cancelled := make(chan bool, 1)
+		net.handlers["10.0.0.2"] = func(ctx context.Context, req sip.Request) []sip.Response {
+			ringing := sip.NewResponseFromRequest("", req, 180, "Ringing", "")
+			<-ctx.Done()
+			cancelled <- true
+			return []sip.Response{ringing, sip.NewResponseFromRequest("", req, 487, "Request Terminated", "")}
+		}
+		net.handlers["10.0.0.3"] = net.respondWith(200)
+		config.TargetSet = targets(
+			proxy.Target{Uri: uri("sip:bob@10.0.0.2:5060")},
+			proxy.Target{Uri: uri("sip:bob@10.0.0.3:5060")},
+		)
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+
+		Expect(cancelled).To(Receive())
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{200}))
+	})
+
+	It("should select the best response", func() {
+		challenge := func(code sip.StatusCode, realm string) func(ctx context.Context, req sip.Request) []sip.Response {
+			return func(ctx context.Context, req sip.Request) []sip.Response {
+				res := sip.NewResponseFromRequest("", req, code, "", "")
+				res.AppendHeader(&sip.GenericHeader{HeaderName: "WWW-Authenticate", Contents: "Digest realm=\"" + realm + "\""})
+				return []sip.Response{res}
+			}
+		}
+		net.handlers["10.0.0.2"] = challenge(401, "a")
+		net.handlers["10.0.0.3"] = challenge(401, "b")
+		net.handlers["10.0.0.4"] = net.respondWith(503)
+		config.TargetSet = targets(
+			proxy.Target{Uri: uri("sip:bob@10.0.0.2")},
+			proxy.Target{Uri: uri("sip:bob@10.0.0.3")},
+			proxy.Target{Uri: uri("sip:bob@10.0.0.4")},
+		)
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{401}))
+		Expect(tx.Response().GetHeaders("WWW-Authenticate")).To(HaveLen(2))
+
+		// 503 is converted to 500
+		config.TargetSet = targets(proxy.Target{Uri: uri("sip:bob@10.0.0.4")})
+		tx = testutils.NewMockServerTx(invite)
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{500}))
+
+		// 6xx wins over other classes
+		net.handlers["10.0.0.3"] = net.respondWith(603)
+		config.TargetSet = targets(
+			proxy.Target{Uri: uri("sip:bob@10.0.0.3")},
+			proxy.Target{Uri: uri("sip:bob@10.0.0.4")},
+		)
+		tx = testutils.NewMockServerTx(invite)
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{603}))
+	})
+
+	It("should fork sequentially in q-value order", func() {
+		net.handlers["10.0.0.2"] = net.respondWith(200)
+		net.handlers["10.0.0.3"] = net.respondWith(486)
+		net.handlers["10.0.0.4"] = net.respondWith(200)
+		config.Forking = proxy.Sequential
+		config.TargetSet = targets(
+			proxy.Target{Uri: uri("sip:bob@10.0.0.2"), Q: 0.5},
+			proxy.Target{Uri: uri("sip:bob@10.0.0.3"), Q: 1},
+			proxy.Target{Uri: uri("sip:bob@10.0.0.4"), Q: 0.1},
+		)
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+
+		Expect(tx.Codes()).To(Equal([]sip.StatusCode{200}))
+		requests := net.Requests()
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0].Recipient().Host()).To(Equal("10.0.0.3"))
+		Expect(requests[1].Recipient().Host()).To(Equal("10.0.0.2"))
+	})
+
+	It("should cancel branches on CANCEL", func() {
+		net.handlers["10.0.0.2"] = func(ctx context.Context, req sip.Request) []sip.Response {
+			<-ctx.Done()
+			return nil
+		}
+		config.TargetSet = targets(proxy.Target{Uri: uri("sip:bob@10.0.0.2")})
+		tx.Cancel(sip.NewCancelRequest("", invite, nil))
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(invite, tx)
+
+		Expect(tx.Codes()).To(ConsistOf(sip.StatusCode(200), sip.StatusCode(487)))
+	})
+
+	It("should forward ACK statelessly", func() {
+		ack := testutils.Request([]string{
+			"ACK sip:bob@10.0.0.2:5060 SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"Max-Forwards: 70",
+			"Route: <sip:10.0.0.100:5060;lr>",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: proxy-call-id",
+			"CSeq: 1 ACK",
+			"",
+			"",
+		})
+		proxy.NewProxy(net, config, testutils.NewLogrusLogger()).ServeRequest(ack, nil)
+
+		var msg sip.Message
+		Expect(net.sent).To(Receive(&msg))
+		req := msg.(sip.Request)
+		Expect(req.IsAck()).To(BeTrue())
+		Expect(req.Recipient().Host()).To(Equal("10.0.0.2"))
+		Expect(req.GetHeaders("Via")).To(HaveLen(2))
+		Expect(req.GetHeaders("Route")).To(BeEmpty())
+		Expect(req.GetHeaders("Record-Route")).To(BeEmpty())
+	})
+})
+
+var _ = Describe("PreferencesTargetSet", func() {
+	It("should select targets by caller preferences", func() {
+		r := registrar.NewRegistrar(registrar.Config{}, testutils.NewLogrusLogger())
+		res := r.HandleRegister(testutils.Request([]string{
+			"REGISTER sip:example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:bob@example.com>;tag=reg-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: prefs-register",
+			"CSeq: 1 REGISTER",
+			"Contact: <sip:bob@10.0.0.2>;audio;q=0.5",
+			"Contact: <sip:bob@10.0.0.3>;audio;video;q=0.5",
+			"Contact: <sip:bob@10.0.0.4>;methods=\"MESSAGE\"",
+			"",
+			"",
+		}))
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+
+		invite := func(headers ...string) sip.Request {
+			lines := []string{
+				"INVITE sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@example.com>;tag=alice-tag",
+				"To: <sip:bob@example.com>",
+				"Call-ID: prefs-call-id",
+				"CSeq: 1 INVITE",
+			}
+			return testutils.Request(append(append(lines, headers...), "", ""))
+		}
+
+		targets, err := proxy.PreferencesTargetSet(r).Targets(invite("Accept-Contact: *;video"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(HaveLen(2))
+		Expect(targets[0].Uri.Host()).To(Equal("10.0.0.3"))
+		Expect(targets[1].Uri.Host()).To(Equal("10.0.0.2"))
+
+		targets, err = proxy.PreferencesTargetSet(r).Targets(invite(
+			"Accept-Contact: *;video",
+			"Request-Disposition: no-fork",
+		))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(HaveLen(1))
+		Expect(targets[0].Uri.Host()).To(Equal("10.0.0.3"))
+	})
+})
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// responseContext groups client transactions of the forked request - RFC 3261 16.7.
+type responseContext struct {
+	p   *proxy
+	req sip.Request
+	tx  sip.ServerTransaction
+	// ctx is cancelled on CANCEL of the request, 2xx or 6xx responses
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// final response has been forwarded upstream
+	final bool
+	// 2xx or 6xx response received, so no more branches are started
+	stopped bool
+	best    sip.Response
+	// challenges of all 401 and 407 responses
+	challenges []sip.Header
+
+	log log.Logger
+}
+
+func newResponseContext(p *proxy, req sip.Request, tx sip.ServerTransaction) *responseContext {
+	rc := &responseContext{
+		p:   p,
+		req: req,
+		tx:  tx,
+	}
+	rc.ctx, rc.cancel = context.WithCancel(context.Background())
+	rc.log = p.Log().
+		WithPrefix("proxy.responseContext").
+		WithFields(req.Fields())
+
+	return rc
+}
+
+func (rc *responseContext) Log() log.Logger {
+	return rc.log
+}
+
+// run forwards the request to the groups of targets one by one and responds upstream with the best response.
+func (rc *responseContext) run(targets []Target) {
+	defer rc.cancel()
+
+	if rc.req.IsInvite() {
+		go rc.watchCancels()
+	}
+
+	for _, group := range groupTargets(targets, rc.p.config.Forking) {
+		var wg sync.WaitGroup
+		for _, target := range group {
+			wg.Add(1)
+			go func(target Target) {
+				defer wg.Done()
+				rc.forward(target)
+			}(target)
+		}
+		wg.Wait()
+
+		rc.mu.Lock()
+		stopped := rc.stopped
+		rc.mu.Unlock()
+		if stopped || rc.ctx.Err() != nil {
+			break
+		}
+	}
+
+	rc.respondBest()
+}
+
+// watchCancels cancels all pending branches on CANCEL of the request - RFC 3261 16.10.
+func (rc *responseContext) watchCancels() {
+	select {
+	case <-rc.ctx.Done():
+	case cancel, ok := <-rc.tx.Cancels():
+		if !ok {
+			return
+		}
+		rc.p.respond(rc.tx, sip.NewResponseFromRequest("", cancel, 200, "OK", ""))
+		rc.cancel()
+	}
+}
+
+// forward sends the request to the target and waits for the final response.
+func (rc *responseContext) forward(target Target) {
+	req := rc.p.newRequest(rc.req, target)
+
+	ctx := rc.ctx
+	if rc.p.config.BranchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.p.config.BranchTimeout)
+		defer cancel()
+	}
+
+	_, err := rc.p.requester.RequestWithContext(ctx, req,
+		gosip.WithResponseHandler(func(res sip.Response, _ sip.Request) {
+			switch {
+			case res.IsProvisional():
+				rc.forwardProvisional(res)
+			case res.IsSuccess():
+				rc.forwardSuccess(res)
+			}
+		}),
+	)
+	if err == nil {
+		return
+	}
+
+	var reqErr *sip.RequestError
+	switch {
+	case errors.As(err, &reqErr) && reqErr.Response != nil && reqErr.Response.StatusCode() >= 300:
+		rc.collect(reqErr.Response)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		// branch timeout is treated as 408 received - RFC 3261 16.8
+		rc.collect(sip.NewResponseFromRequest("", req, 408, "Request Timeout", ""))
+	case errors.As(err, &reqErr):
+		rc.collect(sip.NewResponseFromRequest("", req, sip.StatusCode(reqErr.Code), reqErr.Reason, ""))
+	default:
+		// transport error is treated as 503 received - RFC 3261 16.9
+		rc.Log().Debugf("forward to %s failed: %s", target.Uri, err)
+		rc.collect(sip.NewResponseFromRequest("", req, 503, "Service Unavailable", ""))
+	}
+}
+
+func (rc *responseContext) forwardProvisional(res sip.Response) {
+	if res.StatusCode() == 100 {
+		return
+	}
+
+	rc.mu.Lock()
+	final := rc.final
+	rc.mu.Unlock()
+
+	if !final {
+		rc.p.respond(rc.tx, rc.p.newResponse(rc.req, res))
+	}
+}
+
+// forwardSuccess forwards each 2xx upstream, the first one through the server transaction,
+// next 2xx of the INVITE statelessly. Other pending branches are cancelled.
+func (rc *responseContext) forwardSuccess(res sip.Response) {
+	rc.mu.Lock()
+	first := !rc.final
+	rc.final = true
+	rc.stopped = true
+	rc.mu.Unlock()
+
+	out := rc.p.newResponse(rc.req, res)
+	switch {
+	case first:
+		rc.p.respond(rc.tx, out)
+	case rc.req.IsInvite():
+		if err := rc.p.requester.Send(out); err != nil {
+			rc.Log().Errorf("forward '%s' failed: %s", out.Short(), err)
+		}
+	default:
+		return
+	}
+
+	if rc.req.IsInvite() {
+		rc.cancel()
+	}
+}
+
+// collect stores the final failure response of the branch.
+func (rc *responseContext) collect(res sip.Response) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	switch res.StatusCode() {
+	case 401:
+		rc.challenges = append(rc.challenges, res.GetHeaders("WWW-Authenticate")...)
+	case 407:
+		rc.challenges = append(rc.challenges, res.GetHeaders("Proxy-Authenticate")...)
+	}
+
+	if res.StatusCode() >= 600 && !rc.stopped {
+		rc.stopped = true
+		if rc.req.IsInvite() {
+			rc.cancel()
+		}
+	}
+
+	if rc.best == nil || isBetter(res, rc.best) {
+		rc.best = res
+	}
+}
+
+// respondBest forwards the best final response if no 2xx was forwarded - RFC 3261 16.7 step 6.
+func (rc *responseContext) respondBest() {
+	rc.mu.Lock()
+	if rc.final {
+		rc.mu.Unlock()
+
+		return
+	}
+	rc.final = true
+	best := rc.best
+	challenges := rc.challenges
+	rc.mu.Unlock()
+
+	if best == nil {
+		rc.p.respond(rc.tx, sip.NewResponseFromRequest("", rc.req, 408, "Request Timeout", ""))
+
+		return
+	}
+
+	res := rc.p.newResponse(rc.req, best)
+	switch res.StatusCode() {
+	case 503:
+		res = sip.NewResponseFromRequest("", rc.req, 500, "Server Internal Error", "")
+	case 401, 407:
+		res.RemoveHeader("WWW-Authenticate")
+		res.RemoveHeader("Proxy-Authenticate")
+		for _, hdr := range challenges {
+			res.AppendHeader(hdr.Clone())
+		}
+	}
+
+	rc.p.respond(rc.tx, res)
+}
+
+func (rc *responseContext) String() string {
+	return fmt.Sprintf("proxy.responseContext<%s>", rc.req.Short())
+}
+
+// isBetter compares final failure responses: 6xx wins, otherwise the lowest class wins.
+func isBetter(res, best sip.Response) bool {
+	class, bestClass := res.StatusCode()/100, best.StatusCode()/100
+	switch {
+	case bestClass == 6:
+		return false
+	case class == 6:
+		return true
+	default:
+		return class < bestClass
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"sort"
+
+	"github.com/ghettovoice/gosip/callerprefs"
+	"github.com/ghettovoice/gosip/registrar"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Target is a destination of the proxied request.
+type Target struct {
+	Uri sip.Uri
+	// Q is a target preference from 0 to 1, used to order targets in sequential forking.
+	Q float32
+}
+
+// TargetSet is a routing plugin that determines targets of the request - RFC 3261 16.5.
+type TargetSet interface {
+	// Targets returns targets of the request.
+	// Empty target set rejects the request with 480 Temporarily Unavailable,
+	// *sip.RequestError rejects the request with the error code.
+	Targets(req sip.Request) ([]Target, error)
+}
+
+// TargetSetFunc is an adapter to use ordinary function as TargetSet.
+type TargetSetFunc func(req sip.Request) ([]Target, error)
+
+func (f TargetSetFunc) Targets(req sip.Request) ([]Target, error) {
+	return f(req)
+}
+
+// RequestURITargetSet forwards the request to its Request-URI.
+var RequestURITargetSet = TargetSetFunc(func(req sip.Request) ([]Target, error) {
+	return []Target{{Uri: req.Recipient().Clone(), Q: 1}}, nil
+})
+
+// LocationTargetSet returns targets from the location service,
+// each active binding of the Request-URI is a target.
+func LocationTargetSet(r registrar.Registrar) TargetSet {
+	return TargetSetFunc(func(req sip.Request) ([]Target, error) {
+		bindings, err := r.Lookup(req.Recipient())
+		if err != nil {
+			return nil, err
+		}
+
+		targets := make([]Target, 0, len(bindings))
+		for _, binding := range bindings {
+			if binding.Contact == nil || binding.Contact.Address == nil {
+				continue
+			}
+			targets = append(targets, Target{Uri: binding.Contact.Address.Clone(), Q: binding.Q})
+		}
+
+		return targets, nil
+	})
+}
+
+// PreferencesTargetSet returns targets from the location service filtered and ordered
+// by caller preferences of the request - RFC 3841 7.2.
+// Request-Disposition no-fork limits targets to the most preferred one.
+func PreferencesTargetSet(r registrar.Registrar) TargetSet {
+	return TargetSetFunc(func(req sip.Request) ([]Target, error) {
+		bindings, err := r.Lookup(req.Recipient())
+		if err != nil {
+			return nil, err
+		}
+
+		contacts := make([]*sip.ContactHeader, 0, len(bindings))
+		for _, binding := range bindings {
+			if binding.Contact == nil || binding.Contact.Address == nil {
+				continue
+			}
+			contacts = append(contacts, binding.Contact)
+		}
+		candidates, err := callerprefs.Select(req, contacts)
+		if err != nil {
+			return nil, sip.NewRequestError(400, "Bad Request", req, nil)
+		}
+		if rd, ok := callerprefs.GetRequestDisposition(req); ok && rd.NoFork && len(candidates) > 1 {
+			candidates = candidates[:1]
+		}
+
+		targets := make([]Target, 0, len(candidates))
+		for _, candidate := range candidates {
+			targets = append(targets, Target{Uri: candidate.Contact.Address.Clone(), Q: float32(candidate.Q)})
+		}
+
+		return targets, nil
+	})
+}
+
+// groupTargets splits targets into groups that are forked in parallel.
+// Sequential forking groups targets with equal q-value in descending q order.
+func groupTargets(targets []Target, forking Forking) [][]Target {
+	if forking == Parallel || len(targets) < 2 {
+		return [][]Target{targets}
+	}
+
+	sorted := make([]Target, len(targets))
+	copy(sorted, targets)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Q > sorted[j].Q
+	})
+
+	var groups [][]Target
+	for i, target := range sorted {
+		if i == 0 || target.Q != sorted[i-1].Q {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], target)
+	}
+
+	return groups
+}
@@ -0,0 +1,87 @@
+package qualify
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip/proxy"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Blacklist holds unavailable destinations, they are matched by host and port.
+type Blacklist interface {
+	Block(uri sip.Uri)
+	Unblock(uri sip.Uri)
+	Blocked(uri sip.Uri) bool
+}
+
+type blacklist struct {
+	mu      sync.RWMutex
+	entries map[string]struct{}
+}
+
+// NewBlacklist creates in-memory blacklist.
+func NewBlacklist() Blacklist {
+	return &blacklist{
+		entries: make(map[string]struct{}),
+	}
+}
+
+func (bl *blacklist) Block(uri sip.Uri) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.entries[blacklistKey(uri)] = struct{}{}
+}
+
+func (bl *blacklist) Unblock(uri sip.Uri) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	delete(bl.entries, blacklistKey(uri))
+}
+
+func (bl *blacklist) Blocked(uri sip.Uri) bool {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	_, ok := bl.entries[blacklistKey(uri)]
+
+	return ok
+}
+
+// FilterTargetSet excludes blacklisted targets from the target set of the proxy.
+// The request is rejected with 480 Temporarily Unavailable if all targets are blacklisted.
+func FilterTargetSet(targetSet proxy.TargetSet, bl Blacklist) proxy.TargetSet {
+	return proxy.TargetSetFunc(func(req sip.Request) ([]proxy.Target, error) {
+		targets, err := targetSet.Targets(req)
+		if err != nil {
+			return nil, err
+		}
+
+		available := make([]proxy.Target, 0, len(targets))
+		for _, target := range targets {
+			if !bl.Blocked(target.Uri) {
+				available = append(available, target)
+			}
+		}
+
+		return available, nil
+	})
+}
+
+// blacklistKey returns host and port of the URI, absent port is the default port of the scheme.
+func blacklistKey(uri sip.Uri) string {
+	var port sip.Port
+	switch {
+	case uri.Port() != nil:
+		port = *uri.Port()
+	case uri.IsEncrypted():
+		port = sip.DefaultPort("TLS")
+	default:
+		port = sip.DefaultPort(sip.DefaultProtocol)
+	}
+
+	return fmt.Sprintf("%s:%d", strings.ToLower(uri.Host()), port)
+}
@@ -0,0 +1,326 @@
+// qualify package implements availability monitoring of SIP peers with periodic OPTIONS requests - RFC 3261 11.
+// Peers that stop responding are marked down and put into the blacklist until they respond again.
+package qualify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	DefaultInterval         = time.Minute
+	DefaultTimeout          = 5 * time.Second
+	DefaultFailureThreshold = 3
+)
+
+// Status is an availability of the target.
+type Status int
+
+const (
+	// Unknown is the status of the target before the first response or failure threshold.
+	Unknown Status = iota
+	Up
+	Down
+)
+
+func (status Status) String() string {
+	switch status {
+	case Unknown:
+		return "Unknown"
+	case Up:
+		return "Up"
+	case Down:
+		return "Down"
+	default:
+		return "Invalid"
+	}
+}
+
+// TargetState describes current availability of the target.
+type TargetState struct {
+	Uri    sip.Uri
+	Status Status
+	// Failures is the number of consecutive unanswered requests.
+	Failures int
+	// RTT is the round trip time of the last answered request.
+	RTT time.Duration
+}
+
+// StatusChange describes availability transition of the target.
+type StatusChange struct {
+	TargetState
+	Previous Status
+	// Err is the last failure of the Down target.
+	Err error
+}
+
+// Config describes pinger options.
+type Config struct {
+	// From is an address used in From header of OPTIONS requests.
+	From *sip.Address
+	// Interval between requests to the target, default is DefaultInterval.
+	Interval time.Duration
+	// Timeout of the single request, default is DefaultTimeout.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failures after that the target is down,
+	// default is DefaultFailureThreshold.
+	FailureThreshold int
+	// Blacklist receives down targets and releases them when they are up again.
+	Blacklist Blacklist
+	// Headers are appended to each OPTIONS request.
+	Headers []sip.Header
+	// OnStatusChange is called on each availability transition of the targets.
+	OnStatusChange func(change StatusChange)
+}
+
+// Pinger periodically sends OPTIONS to the targets, any response including failures means the target is up.
+type Pinger interface {
+	// Add starts qualifying of the target, the first request is sent immediately.
+	Add(target sip.Uri)
+	// Remove stops qualifying of the target and releases it from the blacklist.
+	Remove(target sip.Uri)
+	// State returns current state of the target, ok is false for unknown targets.
+	State(target sip.Uri) (TargetState, bool)
+	Targets() []TargetState
+	// Stop stops qualifying of all targets.
+	Stop()
+}
+
+type pinger struct {
+	requester gosip.Requester
+	config    Config
+
+	mu      sync.Mutex
+	targets map[string]*target
+	stopped bool
+
+	log log.Logger
+}
+
+type target struct {
+	state TargetState
+	timer timing.Timer
+}
+
+// NewPinger creates OPTIONS pinger.
+func NewPinger(requester gosip.Requester, config Config, logger log.Logger) Pinger {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultFailureThreshold
+	}
+
+	p := &pinger{
+		requester: requester,
+		config:    config,
+		targets:   make(map[string]*target),
+	}
+	p.log = logger.
+		WithPrefix("qualify.Pinger").
+		WithFields(log.Fields{
+			"pinger_ptr": fmt.Sprintf("%p", p),
+		})
+
+	return p
+}
+
+func (p *pinger) Log() log.Logger {
+	return p.log
+}
+
+func (p *pinger) Add(uri sip.Uri) {
+	key := uri.String()
+
+	p.mu.Lock()
+	if _, ok := p.targets[key]; ok || p.stopped {
+		p.mu.Unlock()
+
+		return
+	}
+	p.targets[key] = &target{
+		state: TargetState{Uri: uri.Clone()},
+	}
+	p.mu.Unlock()
+
+	go p.ping(key)
+}
+
+func (p *pinger) Remove(uri sip.Uri) {
+	key := uri.String()
+
+	p.mu.Lock()
+	t, ok := p.targets[key]
+	var down bool
+	if ok {
+		delete(p.targets, key)
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		down = t.state.Status == Down
+	}
+	p.mu.Unlock()
+
+	if down && p.config.Blacklist != nil {
+		p.config.Blacklist.Unblock(uri)
+	}
+}
+
+func (p *pinger) State(uri sip.Uri) (TargetState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.targets[uri.String()]
+	if !ok {
+		return TargetState{}, false
+	}
+
+	return t.state, true
+}
+
+func (p *pinger) Targets() []TargetState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	states := make([]TargetState, 0, len(p.targets))
+	for _, t := range p.targets {
+		states = append(states, t.state)
+	}
+
+	return states
+}
+
+func (p *pinger) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stopped = true
+	for _, t := range p.targets {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+	}
+}
+
+func (p *pinger) ping(key string) {
+	p.mu.Lock()
+	t, ok := p.targets[key]
+	if !ok || p.stopped {
+		p.mu.Unlock()
+
+		return
+	}
+	uri := t.state.Uri
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	start := timing.Now()
+	_, err := p.requester.RequestWithContext(ctx, p.newRequest(uri))
+	rtt := timing.Now().Sub(start)
+	cancel()
+
+	var reqErr *sip.RequestError
+	if errors.As(err, &reqErr) && reqErr.Response != nil {
+		err = nil
+	}
+
+	p.mu.Lock()
+	// target could be removed or re-added while the request was pending
+	if p.targets[key] != t || p.stopped {
+		p.mu.Unlock()
+
+		return
+	}
+
+	prev := t.state.Status
+	if err == nil {
+		t.state.Status = Up
+		t.state.Failures = 0
+		t.state.RTT = rtt
+	} else {
+		t.state.Failures++
+		if t.state.Failures >= p.config.FailureThreshold {
+			t.state.Status = Down
+		}
+	}
+	state := t.state
+	t.timer = timing.AfterFunc(p.config.Interval, func() {
+		p.ping(key)
+	})
+	p.mu.Unlock()
+
+	if err != nil {
+		p.Log().Debugf("target %s did not respond (%d/%d): %s", uri, state.Failures, p.config.FailureThreshold, err)
+	}
+	if state.Status == prev {
+		return
+	}
+
+	p.Log().Debugf("target %s status changed %s -> %s", uri, prev, state.Status)
+
+	if p.config.Blacklist != nil {
+		switch {
+		case state.Status == Down:
+			p.config.Blacklist.Block(uri)
+		case prev == Down:
+			p.config.Blacklist.Unblock(uri)
+		}
+	}
+	if p.config.OnStatusChange != nil {
+		p.config.OnStatusChange(StatusChange{
+			TargetState: state,
+			Previous:    prev,
+			Err:         err,
+		})
+	}
+}
+
+func (p *pinger) newRequest(uri sip.Uri) sip.Request {
+	from := p.config.From.AsFromHeader()
+	from.Params = sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)})
+	callID := sip.CallID(util.RandString(32))
+	maxForwards := sip.MaxForwards(70)
+
+	hdrs := []sip.Header{
+		sip.ViaHeader{
+			&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       sip.DefaultProtocol,
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			},
+		},
+		&maxForwards,
+		from,
+		&sip.ToHeader{Address: uri.Clone()},
+		&callID,
+		&sip.CSeq{SeqNo: 1, MethodName: sip.OPTIONS},
+	}
+	for _, hdr := range p.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	return sip.NewRequest(
+		"",
+		sip.OPTIONS,
+		uri.Clone(),
+		"SIP/2.0",
+		hdrs,
+		"",
+		log.Fields{
+			"pinger_ptr": fmt.Sprintf("%p", p),
+		},
+	)
+}
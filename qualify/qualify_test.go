@@ -0,0 +1,130 @@
+package qualify_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/proxy"
+	"github.com/ghettovoice/gosip/qualify"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+var _ = Describe("Qualify", func() {
+	var (
+		requester *testutils.MockRequester
+		down      *sync.Map
+		blacklist qualify.Blacklist
+		changes   chan qualify.StatusChange
+		pinger    qualify.Pinger
+	)
+
+	trunk := &sip.SipUri{FHost: "trunk.example.com"}
+
+	BeforeEach(func() {
+		timing.MockMode = true
+		down = new(sync.Map)
+		hosts := down
+		requester = testutils.NewMockRequester(func(req sip.Request) (sip.Response, error) {
+			if isDown, _ := hosts.Load(req.Recipient().Host()); isDown == true {
+				return nil, fmt.Errorf("transaction timed out")
+			}
+
+			// failure response means the target is reachable
+			res := sip.NewResponseFromRequest("", req, 405, "Method Not Allowed", "")
+			return nil, &sip.RequestError{Request: req, Response: res, Code: 405, Reason: "Method Not Allowed"}
+		})
+		blacklist = qualify.NewBlacklist()
+		changes = make(chan qualify.StatusChange, 10)
+		pinger = qualify.NewPinger(requester, qualify.Config{
+			From:             &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "qualify"}, FHost: "proxy.example.com"}},
+			Interval:         30 * time.Second,
+			FailureThreshold: 2,
+			Blacklist:        blacklist,
+			OnStatusChange: func(change qualify.StatusChange) {
+				changes <- change
+			},
+		}, log.NewDefaultLogrusLogger())
+	})
+
+	AfterEach(func() {
+		pinger.Stop()
+		timing.MockMode = false
+	})
+
+	It("should mark the target up on any response", func() {
+		pinger.Add(trunk)
+
+		var req sip.Request
+		Eventually(requester.Received()).Should(Receive(&req))
+		Expect(req.Method()).To(Equal(sip.OPTIONS))
+		Expect(req.Recipient().String()).To(Equal("sip:trunk.example.com"))
+
+		var change qualify.StatusChange
+		Eventually(changes).Should(Receive(&change))
+		Expect(change.Previous).To(Equal(qualify.Unknown))
+		Expect(change.Status).To(Equal(qualify.Up))
+
+		state, ok := pinger.State(trunk)
+		Expect(ok).To(BeTrue())
+		Expect(state.Status).To(Equal(qualify.Up))
+	})
+
+	It("should blacklist the target after consecutive failures and release it on recovery", func() {
+		down.Store("trunk.example.com", true)
+		pinger.Add(trunk)
+		Eventually(requester.Received()).Should(Receive())
+		Consistently(changes, 50*time.Millisecond).ShouldNot(Receive())
+		Expect(blacklist.Blocked(trunk)).To(BeFalse())
+
+		timing.Elapse(30 * time.Second)
+		Eventually(requester.Received()).Should(Receive())
+
+		var change qualify.StatusChange
+		Eventually(changes).Should(Receive(&change))
+		Expect(change.Status).To(Equal(qualify.Down))
+		Expect(change.Failures).To(Equal(2))
+		Expect(change.Err).To(HaveOccurred())
+		Expect(blacklist.Blocked(&sip.SipUri{FHost: "TRUNK.example.com", FPort: portPtr(5060)})).To(BeTrue())
+
+		down.Store("trunk.example.com", false)
+		timing.Elapse(30 * time.Second)
+		Eventually(changes).Should(Receive(&change))
+		Expect(change.Previous).To(Equal(qualify.Down))
+		Expect(change.Status).To(Equal(qualify.Up))
+		Expect(blacklist.Blocked(trunk)).To(BeFalse())
+	})
+
+	It("should exclude blacklisted targets from the proxy target set", func() {
+		backup := &sip.SipUri{FHost: "backup.example.com"}
+		blacklist.Block(trunk)
+
+		targetSet := qualify.FilterTargetSet(proxy.TargetSetFunc(func(req sip.Request) ([]proxy.Target, error) {
+			return []proxy.Target{{Uri: trunk, Q: 1}, {Uri: backup, Q: 0.5}}, nil
+		}), blacklist)
+
+		targets, err := targetSet.Targets(testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: qualify-call-id",
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(HaveLen(1))
+		Expect(targets[0].Uri).To(Equal(backup))
+	})
+})
+
+func portPtr(port sip.Port) *sip.Port {
+	return &port
+}
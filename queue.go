@@ -0,0 +1,231 @@
+package gosip
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	DefaultQueueWorkers    = 100
+	DefaultQueueSize       = 1000
+	DefaultQueueRetryAfter = 5 * time.Second
+)
+
+// Priority is a class of the incoming request in the work queue of handlers, lower value is processed first.
+type Priority int
+
+const (
+	// PriorityEmergency is for emergency calls - RFC 5031.
+	PriorityEmergency Priority = iota
+	// PriorityDialog is for ACK, CANCEL, BYE and other requests within existing dialogs,
+	// they complete work already accepted by the server.
+	PriorityDialog
+	// PriorityNormal is for out-of-dialog requests other than INVITE, like REGISTER or OPTIONS.
+	PriorityNormal
+	// PriorityNew is for INVITE requests creating new sessions, they are shed first under overload.
+	PriorityNew
+
+	priorityLevels = int(PriorityNew) + 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityEmergency:
+		return "Emergency"
+	case PriorityDialog:
+		return "Dialog"
+	case PriorityNormal:
+		return "Normal"
+	case PriorityNew:
+		return "New"
+	default:
+		return "Unknown"
+	}
+}
+
+// QueueConfig describes the prioritized work queue of request handlers.
+// Handlers are run by the fixed number of workers, queued requests of higher priority are taken first.
+// When the queue of the priority is full, the request is rejected with the error response and Retry-After,
+// so the server sheds load instead of piling up goroutines. ACK requests can not be answered and are dropped.
+// Responses are matched to client transactions by the transaction layer and never wait in the queue.
+type QueueConfig struct {
+	// Workers is a number of concurrently running handlers, default is DefaultQueueWorkers.
+	Workers int
+	// Size is a capacity of the queue of each priority, default is DefaultQueueSize.
+	Size int
+	// Classify returns priority of the request, default is ClassifyRequest.
+	// Use emergency.Classifier to recognize emergency numbers.
+	Classify func(req sip.Request) Priority
+	// RejectCode and RejectReason of the response to shed requests, default is '503 Service Unavailable'.
+	RejectCode   sip.StatusCode
+	RejectReason string
+	// RetryAfter is a value of Retry-After header of responses to shed requests, default is DefaultQueueRetryAfter.
+	RetryAfter time.Duration
+}
+
+// ClassifyRequest is a default classifier of requests.
+// Requests with 'Priority: emergency' or to urn:service:sos are emergency - RFC 3261 20.26, RFC 5031.
+func ClassifyRequest(req sip.Request) Priority {
+	for _, hdr := range req.GetHeaders("Priority") {
+		if strings.EqualFold(strings.TrimSpace(hdr.Value()), "emergency") {
+			return PriorityEmergency
+		}
+	}
+	if urn, ok := req.Recipient().(*sip.UrnUri); ok && strings.EqualFold(urn.FNid, "service") {
+		if service := strings.ToLower(urn.FNss); service == "sos" || strings.HasPrefix(service, "sos.") {
+			return PriorityEmergency
+		}
+	}
+
+	switch req.Method() {
+	case sip.ACK, sip.CANCEL, sip.BYE, sip.PRACK:
+		return PriorityDialog
+	}
+	if to, ok := req.To(); ok && to.Params != nil && to.Params.Has("tag") {
+		return PriorityDialog
+	}
+	if req.Method() == sip.INVITE {
+		return PriorityNew
+	}
+
+	return PriorityNormal
+}
+
+// workQueue is a bounded queue of handler jobs per priority served by the fixed pool of workers.
+type workQueue struct {
+	config QueueConfig
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	jobs   [priorityLevels][]func()
+	closed bool
+}
+
+func newWorkQueue(config QueueConfig) *workQueue {
+	if config.Workers <= 0 {
+		config.Workers = DefaultQueueWorkers
+	}
+	if config.Size <= 0 {
+		config.Size = DefaultQueueSize
+	}
+	if config.Classify == nil {
+		config.Classify = ClassifyRequest
+	}
+	if config.RejectCode == 0 {
+		config.RejectCode = 503
+		config.RejectReason = "Service Unavailable"
+	}
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = DefaultQueueRetryAfter
+	}
+
+	q := &workQueue{config: config}
+	q.cond = sync.NewCond(&q.mu)
+
+	return q
+}
+
+// push queues the job of the priority, it returns false if the queue is full or closed.
+func (q *workQueue) push(priority Priority, job func()) bool {
+	if priority < 0 || int(priority) >= priorityLevels {
+		priority = PriorityNormal
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || len(q.jobs[priority]) >= q.config.Size {
+		return false
+	}
+	q.jobs[priority] = append(q.jobs[priority], job)
+	q.cond.Signal()
+
+	return true
+}
+
+// pop waits for the job of the highest priority, it returns false when the queue is closed.
+func (q *workQueue) pop() (func(), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return nil, false
+		}
+		for priority := range q.jobs {
+			if jobs := q.jobs[priority]; len(jobs) > 0 {
+				job := jobs[0]
+				jobs[0] = nil
+				q.jobs[priority] = jobs[1:]
+
+				return job, true
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+// close stops workers, queued jobs are dropped.
+func (q *workQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.jobs = [priorityLevels][]func(){}
+	q.cond.Broadcast()
+}
+
+// load returns the fill ratio of the fullest queue.
+func (q *workQueue) load() float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var load float64
+	for _, jobs := range q.jobs {
+		if ratio := float64(len(jobs)) / float64(q.config.Size); ratio > load {
+			load = ratio
+		}
+	}
+
+	return load
+}
+
+func (q *workQueue) work() {
+	for {
+		job, ok := q.pop()
+		if !ok {
+			return
+		}
+		job()
+	}
+}
+
+// enqueue passes the request to the work queue or sheds it when the queue is full.
+func (srv *server) enqueue(req sip.Request, job func()) {
+	priority := srv.queue.config.Classify(req)
+	if srv.queue.push(priority, job) {
+		return
+	}
+
+	logger := srv.Log().WithFields(req.Fields())
+	if req.IsAck() {
+		logger.Warnf("drop ACK request, %s queue is full", priority)
+		return
+	}
+
+	logger.Warnf("reject request, %s queue is full", priority)
+
+	res := sip.NewResponseFromRequest("", req, srv.queue.config.RejectCode, srv.queue.config.RejectReason, "")
+	res.AppendHeader(&sip.GenericHeader{
+		HeaderName: "Retry-After",
+		Contents:   fmt.Sprintf("%d", int(math.Ceil(srv.queue.config.RetryAfter.Seconds()))),
+	})
+	if _, err := srv.Respond(res); err != nil {
+		logger.Errorf("respond '%d %s' failed: %s", res.StatusCode(), res.Reason(), err)
+	}
+}
@@ -0,0 +1,111 @@
+package quirks
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	CiscoCube            = "cisco-cube"
+	AvayaSM              = "avaya-sm"
+	MSTeamsDirectRouting = "ms-teams-direct-routing"
+)
+
+// Builtin returns built-in profiles of known vendors.
+// They bundle behaviors interop guides of vendors require, deployments tune them by custom profiles.
+func Builtin() []Profile {
+	return []Profile{
+		{
+			Name: CiscoCube,
+			Headers: []sip.Header{
+				&sip.GenericHeader{HeaderName: "Allow", Contents: "INVITE, OPTIONS, BYE, CANCEL, ACK, PRACK, UPDATE, REFER, NOTIFY, INFO"},
+			},
+			SessionExpires: 1800 * time.Second,
+			MinSE:          90 * time.Second,
+		},
+		{
+			Name: AvayaSM,
+			// Session Manager marks the SIP entity down on 503 and stops routing calls to it
+			ResponseCodes: map[sip.StatusCode]sip.StatusCode{
+				503: 480,
+			},
+			StripHeaders:   []string{"History-Info"},
+			SessionExpires: 1200 * time.Second,
+			MinSE:          90 * time.Second,
+		},
+		{
+			Name: MSTeamsDirectRouting,
+			Headers: []sip.Header{
+				&sip.GenericHeader{HeaderName: "Allow", Contents: "INVITE, ACK, OPTIONS, CANCEL, BYE, NOTIFY, UPDATE, REFER, PRACK"},
+			},
+			// Teams does not accept the private identity of the SBC side
+			StripHeaders:   []string{"P-Preferred-Identity"},
+			SessionExpires: 3600 * time.Second,
+			MinSE:          90 * time.Second,
+			TLS: TLSQuirks{
+				Required:    true,
+				FQDNContact: true,
+			},
+		},
+	}
+}
+
+// Registry keeps profiles by names, it is the extension point of custom profiles.
+type Registry interface {
+	// Register adds the profile, the profile with the same name is replaced, like to tune built-in profile.
+	Register(profile Profile)
+	Profile(name string) (Profile, bool)
+	// Names returns sorted names of profiles.
+	Names() []string
+}
+
+type registry struct {
+	mu       sync.RWMutex
+	profiles map[string]Profile
+}
+
+// NewRegistry creates registry of built-in profiles and the custom ones.
+func NewRegistry(custom ...Profile) Registry {
+	r := &registry{profiles: make(map[string]Profile)}
+	for _, profile := range Builtin() {
+		r.Register(profile)
+	}
+	for _, profile := range custom {
+		r.Register(profile)
+	}
+
+	return r
+}
+
+func (r *registry) Register(profile Profile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.profiles[strings.ToLower(profile.Name)] = profile
+}
+
+func (r *registry) Profile(name string) (Profile, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	profile, ok := r.profiles[strings.ToLower(name)]
+
+	return profile, ok
+}
+
+func (r *registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.profiles))
+	for name := range r.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
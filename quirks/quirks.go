@@ -0,0 +1,299 @@
+// quirks package implements vendor interop profiles of trunks and peers, like cisco-cube or ms-teams-direct-routing.
+// The profile bundles behaviors the vendor requires: mandatory headers, response code translations,
+// session timer defaults and TLS quirks. Profiles are selected per peer by source addresses of incoming messages
+// and by hosts of targets of outgoing requests, and applied to messages sent to the peer,
+// like by OnRequest and OnResponse of b2bua.Config.
+package quirks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// TLSQuirks are TLS requirements of the peer.
+type TLSQuirks struct {
+	// Required sends requests to the peer over TLS only.
+	Required bool
+	// FQDNContact replaces the host of Contact of messages sent to the peer by Peer.LocalFQDN,
+	// since the peer matches it with the certificate of the local side.
+	FQDNContact bool
+}
+
+// Profile bundles interop behaviors of the vendor.
+type Profile struct {
+	Name string
+	// Headers are added to messages sent to the peer that have no header of the name.
+	Headers []sip.Header
+	// StripHeaders are removed from messages sent to the peer.
+	StripHeaders []string
+	// ResponseCodes translates codes of responses sent to the peer, reasons are replaced by default phrases.
+	ResponseCodes map[sip.StatusCode]sip.StatusCode
+	// SessionExpires and MinSE are added to initial INVITEs sent to the peer without them - RFC 4028,
+	// zero adds nothing.
+	SessionExpires time.Duration
+	MinSE          time.Duration
+	TLS            TLSQuirks
+}
+
+// Peer binds the profile to the trunk or peer.
+type Peer struct {
+	Name string
+	// Profile is the name of the profile in the registry.
+	Profile string
+	// Sources lists networks of the peer in CIDR notation or single IP addresses.
+	Sources []string
+	// Hosts lists hosts of targets of requests to the peer, like the FQDN of the trunk.
+	Hosts []string
+	// LocalFQDN is the FQDN of the local side advertised to the peer, see TLSQuirks.FQDNContact.
+	LocalFQDN string
+}
+
+// Config describes quirks options.
+type Config struct {
+	// Registry provides profiles of peers, default is NewRegistry() of built-in profiles.
+	Registry Registry
+	Peers    []Peer
+}
+
+// Quirks applies profiles of peers to messages sent to them.
+type Quirks interface {
+	// PeerOf returns the peer the incoming message is received from.
+	PeerOf(msg sip.Message) (Peer, Profile, bool)
+	// TargetOf returns the peer the outgoing request is sent to.
+	TargetOf(req sip.Request) (Peer, Profile, bool)
+	// ApplyRequest applies the profile of the peer the request is sent to, returns false if the peer is unknown.
+	ApplyRequest(req sip.Request) bool
+	// ApplyResponse applies the profile of the peer the response is sent to, returns false if the peer is unknown.
+	ApplyResponse(res sip.Response) bool
+}
+
+type peer struct {
+	Peer
+	sources []*net.IPNet
+	profile Profile
+}
+
+type quirks struct {
+	peers []*peer
+
+	log log.Logger
+}
+
+// NewQuirks creates quirks of peers, profiles of peers must be in the registry.
+func NewQuirks(config Config, logger log.Logger) (Quirks, error) {
+	if config.Registry == nil {
+		config.Registry = NewRegistry()
+	}
+
+	q := &quirks{}
+	for _, p := range config.Peers {
+		profile, ok := config.Registry.Profile(p.Profile)
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q of peer %q", p.Profile, p.Name)
+		}
+		sources, err := parseNetworks(p.Sources)
+		if err != nil {
+			return nil, fmt.Errorf("parse sources of peer %q: %w", p.Name, err)
+		}
+		q.peers = append(q.peers, &peer{Peer: p, sources: sources, profile: profile})
+	}
+	q.log = logger.
+		WithPrefix("quirks.Quirks").
+		WithFields(log.Fields{
+			"quirks_ptr": fmt.Sprintf("%p", q),
+		})
+
+	return q, nil
+}
+
+func (q *quirks) Log() log.Logger {
+	return q.log
+}
+
+func (q *quirks) PeerOf(msg sip.Message) (Peer, Profile, bool) {
+	addr, _ := msg.Fields()[transport.ReceivedFromField].(string)
+	if addr == "" {
+		addr = msg.Source()
+	}
+	if p := q.bySource(addr); p != nil {
+		return p.Peer, p.profile, true
+	}
+
+	return Peer{}, Profile{}, false
+}
+
+func (q *quirks) TargetOf(req sip.Request) (Peer, Profile, bool) {
+	if p := q.byTarget(req); p != nil {
+		return p.Peer, p.profile, true
+	}
+
+	return Peer{}, Profile{}, false
+}
+
+func (q *quirks) bySource(addr string) *peer {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return nil
+	}
+
+	for _, p := range q.peers {
+		for _, network := range p.sources {
+			if network.Contains(ip) {
+				return p
+			}
+		}
+	}
+
+	return nil
+}
+
+// byTarget matches the host of the first Route or Request-URI with hosts and sources of peers.
+func (q *quirks) byTarget(req sip.Request) *peer {
+	uri := req.Recipient()
+	if hdrs := req.GetHeaders("Route"); len(hdrs) > 0 {
+		if route, ok := hdrs[0].(*sip.RouteHeader); ok && len(route.Addresses) > 0 {
+			uri = route.Addresses[0]
+		}
+	}
+	if uri == nil {
+		return nil
+	}
+
+	host := uri.Host()
+	for _, p := range q.peers {
+		for _, h := range p.Hosts {
+			if strings.EqualFold(h, host) {
+				return p
+			}
+		}
+	}
+
+	return q.bySource(host)
+}
+
+func (q *quirks) ApplyRequest(req sip.Request) bool {
+	p := q.byTarget(req)
+	if p == nil {
+		return false
+	}
+
+	q.applyHeaders(req, p)
+	if p.profile.TLS.Required {
+		req.SetTransport("TLS")
+	}
+	if req.IsInvite() && !inDialog(req) {
+		applySessionTimer(req, p.profile)
+	}
+
+	return true
+}
+
+func (q *quirks) ApplyResponse(res sip.Response) bool {
+	p := q.bySource(res.Destination())
+	if p == nil {
+		addr, _ := res.Fields()[transport.ReceivedFromField].(string)
+		if p = q.bySource(addr); p == nil {
+			return false
+		}
+	}
+
+	q.applyHeaders(res, p)
+	if code, ok := p.profile.ResponseCodes[res.StatusCode()]; ok {
+		q.Log().WithFields(res.Fields()).Debugf("translate response code %d to %d for peer %s",
+			res.StatusCode(), code, p.Name)
+		res.SetStatusCode(code)
+		res.SetReason(sip.ReasonPhrase(code))
+	}
+
+	return true
+}
+
+func (q *quirks) applyHeaders(msg sip.Message, p *peer) {
+	for _, name := range p.profile.StripHeaders {
+		msg.RemoveHeader(name)
+	}
+	for _, hdr := range p.profile.Headers {
+		if len(msg.GetHeaders(hdr.Name())) == 0 {
+			msg.AppendHeader(hdr.Clone())
+		}
+	}
+	if p.profile.TLS.FQDNContact && p.LocalFQDN != "" {
+		// headers are cloned, since the Contact may be shared by messages, like b2bua.Config.Contact
+		hdrs := msg.GetHeaders("Contact")
+		contacts := make([]sip.Header, 0, len(hdrs))
+		for _, hdr := range hdrs {
+			if contact, ok := hdr.(*sip.ContactHeader); ok && contact.Address != nil {
+				contact = contact.Clone().(*sip.ContactHeader)
+				contact.Address.SetHost(p.LocalFQDN)
+				hdr = contact
+			}
+			contacts = append(contacts, hdr)
+		}
+		if len(contacts) > 0 {
+			msg.ReplaceHeaders("Contact", contacts)
+		}
+	}
+}
+
+func applySessionTimer(req sip.Request, profile Profile) {
+	if profile.SessionExpires <= 0 || len(req.GetHeaders("Session-Expires")) > 0 {
+		return
+	}
+
+	req.AppendHeader(dialog.SessionExpires{Delta: profile.SessionExpires}.Header())
+	if profile.MinSE > 0 && len(req.GetHeaders("Min-SE")) == 0 {
+		req.AppendHeader(&sip.GenericHeader{
+			HeaderName: "Min-SE",
+			Contents:   strconv.Itoa(int(profile.MinSE / time.Second)),
+		})
+	}
+
+	for _, hdr := range req.GetHeaders("Supported") {
+		for _, option := range strings.Split(hdr.Value(), ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "timer") {
+				return
+			}
+		}
+	}
+	req.AppendHeader(&sip.SupportedHeader{Options: []string{"timer"}})
+}
+
+func inDialog(req sip.Request) bool {
+	to, ok := req.To()
+	return ok && to.Params != nil && to.Params.Has("tag")
+}
+
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
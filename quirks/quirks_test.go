@@ -0,0 +1,122 @@
+package quirks_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/quirks"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+var _ = Describe("Quirks", func() {
+	var invite sip.Request
+
+	newQuirks := func(config quirks.Config) quirks.Quirks {
+		q, err := quirks.NewQuirks(config, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		return q
+	}
+	peers := []quirks.Peer{
+		{
+			Name:      "teams",
+			Profile:   quirks.MSTeamsDirectRouting,
+			Hosts:     []string{"sip.pstnhub.microsoft.com"},
+			Sources:   []string{"52.112.0.0/14"},
+			LocalFQDN: "sbc.example.com",
+		},
+		{
+			Name:    "avaya",
+			Profile: quirks.AvayaSM,
+			Sources: []string{"10.1.0.0/16"},
+		},
+	}
+
+	BeforeEach(func() {
+		invite = testutils.Request([]string{
+			"INVITE sip:+15551234567@sip.pstnhub.microsoft.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=from-tag",
+			"To: <sip:+15551234567@sip.pstnhub.microsoft.com>",
+			"Call-ID: quirks-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:b2bua@10.0.0.1:5060>",
+			"P-Preferred-Identity: <sip:alice@example.com>",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+	})
+
+	It("should have built-in profiles", func() {
+		Expect(quirks.NewRegistry().Names()).To(ConsistOf(quirks.CiscoCube, quirks.AvayaSM, quirks.MSTeamsDirectRouting))
+	})
+
+	It("should apply the profile of the target peer to requests", func() {
+		q := newQuirks(quirks.Config{Peers: peers})
+
+		Expect(q.ApplyRequest(invite)).To(BeTrue())
+		Expect(invite.Transport()).To(Equal("TLS"))
+		Expect(invite.GetHeaders("P-Preferred-Identity")).To(BeEmpty())
+		Expect(invite.GetHeaders("Allow")).To(HaveLen(1))
+		Expect(invite.GetHeaders("Session-Expires")[0].Value()).To(Equal("3600"))
+		Expect(invite.GetHeaders("Min-SE")[0].Value()).To(Equal("90"))
+		Expect(invite.GetHeaders("Supported")[0].Value()).To(Equal("timer"))
+		contact, ok := invite.Contact()
+		Expect(ok).To(BeTrue())
+		Expect(contact.Address.Host()).To(Equal("sbc.example.com"))
+	})
+
+	It("should translate codes of responses to the peer", func() {
+		q := newQuirks(quirks.Config{Peers: peers})
+		invite.WithFields(log.Fields{transport.ReceivedFromField: "10.1.2.3:5060"})
+		res := sip.NewResponseFromRequest("", invite, 503, "Service Unavailable", "")
+
+		Expect(q.ApplyResponse(res)).To(BeTrue())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(480)))
+		Expect(res.Reason()).To(Equal("Temporarily Unavailable"))
+	})
+
+	It("should not modify messages of unknown peers", func() {
+		q := newQuirks(quirks.Config{Peers: peers[1:]})
+		before := invite.String()
+
+		Expect(q.ApplyRequest(invite)).To(BeFalse())
+		Expect(invite.String()).To(Equal(before))
+	})
+
+	It("should select peers of incoming messages by source", func() {
+		q := newQuirks(quirks.Config{Peers: peers})
+		invite.SetSource("52.113.1.1:5061")
+
+		peer, profile, ok := q.PeerOf(invite)
+		Expect(ok).To(BeTrue())
+		Expect(peer.Name).To(Equal("teams"))
+		Expect(profile.TLS.Required).To(BeTrue())
+	})
+
+	It("should apply custom profiles", func() {
+		registry := quirks.NewRegistry(quirks.Profile{
+			Name:          "legacy-pbx",
+			Headers:       []sip.Header{&sip.GenericHeader{HeaderName: "X-Trunk", Contents: "legacy"}},
+			ResponseCodes: map[sip.StatusCode]sip.StatusCode{404: 604},
+		})
+		q := newQuirks(quirks.Config{
+			Registry: registry,
+			Peers:    []quirks.Peer{{Name: "pbx", Profile: "legacy-pbx", Hosts: []string{"sip.pstnhub.microsoft.com"}}},
+		})
+
+		Expect(q.ApplyRequest(invite)).To(BeTrue())
+		Expect(invite.GetHeaders("X-Trunk")[0].Value()).To(Equal("legacy"))
+		Expect(invite.GetHeaders("Session-Expires")).To(BeEmpty())
+	})
+
+	It("should reject peers of unknown profiles", func() {
+		_, err := quirks.NewQuirks(quirks.Config{
+			Peers: []quirks.Peer{{Name: "pbx", Profile: "unknown"}},
+		}, testutils.NewLogrusLogger())
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,233 @@
+// redact package masks sensitive data of SIP messages in logs and traces:
+// Authorization credentials, user parts of URIs and message bodies.
+// The stack applies the policy set with SetPolicy, default policy doesn't mask anything.
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const DefaultMask = "***"
+
+// Policy describes what data is masked.
+type Policy struct {
+	// Credentials masks response, nonce, cnonce and opaque of Authorization and Proxy-Authorization headers,
+	// credentials of other schemes are masked entirely.
+	Credentials bool
+	// UserParts masks user parts of sip, sips and tel URIs and the username of credentials.
+	UserParts bool
+	// Bodies masks message bodies.
+	Bodies bool
+	// Headers are names of additional headers with masked values, like P-Asserted-Identity.
+	Headers []string
+	// Mask replaces masked data, default is DefaultMask.
+	Mask string
+}
+
+// Enabled reports whether the policy masks anything.
+func (p Policy) Enabled() bool {
+	return p.Credentials || p.UserParts || p.Bodies || len(p.Headers) > 0
+}
+
+func (p Policy) mask() string {
+	if p.Mask == "" {
+		return DefaultMask
+	}
+
+	return p.Mask
+}
+
+var (
+	sipUserRe = regexp.MustCompile(`(?i)\b(sips?:)[^@\s;>,"]+@`)
+	telUserRe = regexp.MustCompile(`(?i)\b(tel:)[^\s;>,"]+`)
+)
+
+// Redact masks the text of SIP message, the text may be a part of the stream with several messages.
+func (p Policy) Redact(text string) string {
+	if !p.Enabled() {
+		return text
+	}
+
+	head, body, hasBody := text, "", false
+	if i := strings.Index(text, "\r\n\r\n"); i >= 0 {
+		head, body, hasBody = text[:i], text[i+4:], true
+	}
+
+	lines := strings.Split(head, "\r\n")
+	for i, line := range lines {
+		colon := strings.Index(line, ":")
+		// start line and folded lines
+		if i == 0 || colon < 0 || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			lines[i] = p.redactURIs(line)
+			continue
+		}
+
+		name, value := line[:colon], line[colon+1:]
+		switch {
+		case p.maskedHeader(name):
+			value = " " + p.mask()
+		case p.Credentials && isCredentialsHeader(name):
+			value = " " + p.redactCredentials(strings.TrimSpace(value))
+		default:
+			value = p.redactURIs(value)
+		}
+		lines[i] = name + ":" + value
+	}
+
+	text = strings.Join(lines, "\r\n")
+	if hasBody {
+		text += "\r\n\r\n" + p.RedactBody(body)
+	}
+
+	return text
+}
+
+// RedactBody masks the message body.
+func (p Policy) RedactBody(body string) string {
+	if !p.Bodies || body == "" {
+		return body
+	}
+
+	return fmt.Sprintf("%s (%d bytes)", p.mask(), len(body))
+}
+
+func (p Policy) redactURIs(text string) string {
+	if !p.UserParts {
+		return text
+	}
+
+	text = sipUserRe.ReplaceAllString(text, "${1}"+p.mask()+"@")
+
+	return telUserRe.ReplaceAllString(text, "${1}"+p.mask())
+}
+
+func (p Policy) maskedHeader(name string) bool {
+	name = strings.TrimSpace(name)
+	for _, hdr := range p.Headers {
+		if strings.EqualFold(hdr, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isCredentialsHeader(name string) bool {
+	name = strings.TrimSpace(name)
+
+	return strings.EqualFold(name, "Authorization") || strings.EqualFold(name, "Proxy-Authorization")
+}
+
+// secretParams are masked parameters of Digest credentials - RFC 3261 25.1.
+var secretParams = map[string]bool{
+	"response": true,
+	"nonce":    true,
+	"cnonce":   true,
+	"opaque":   true,
+}
+
+func (p Policy) redactCredentials(value string) string {
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) < 2 {
+		return p.mask()
+	}
+
+	scheme := parts[0]
+	if !strings.EqualFold(scheme, "Digest") {
+		return scheme + " " + p.mask()
+	}
+
+	params := splitParams(parts[1])
+	for i, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		switch {
+		case secretParams[key], key == "username" && p.UserParts:
+			val := p.mask()
+			if strings.HasPrefix(strings.TrimSpace(kv[1]), `"`) {
+				val = `"` + val + `"`
+			}
+			params[i] = kv[0] + "=" + val
+		case key == "uri":
+			params[i] = kv[0] + "=" + p.redactURIs(kv[1])
+		}
+	}
+
+	return scheme + " " + strings.Join(params, ",")
+}
+
+// splitParams splits credentials parameters by commas outside of quoted strings.
+func splitParams(s string) []string {
+	var (
+		params []string
+		quoted bool
+		start  int
+	)
+	for i, c := range s {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				params = append(params, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(params, s[start:])
+}
+
+var policy atomic.Value
+
+func init() {
+	policy.Store(Policy{})
+}
+
+// SetPolicy sets the policy applied to logs and traces of the stack.
+func SetPolicy(p Policy) {
+	p.Headers = append([]string(nil), p.Headers...)
+	policy.Store(p)
+}
+
+// CurrentPolicy returns the policy set with SetPolicy.
+func CurrentPolicy() Policy {
+	return policy.Load().(Policy)
+}
+
+// Message returns lazy masked text of the message for formatted log calls,
+// the message is masked only when the log record is actually written.
+func Message(msg sip.Message) fmt.Stringer {
+	return stringer(func() string {
+		return CurrentPolicy().Redact(msg.String())
+	})
+}
+
+// Bytes returns lazy masked text of raw data, like data read from or written to connections.
+func Bytes(data []byte) fmt.Stringer {
+	return stringer(func() string {
+		return CurrentPolicy().Redact(string(data))
+	})
+}
+
+// Body returns lazy masked text of the message body.
+func Body(body string) fmt.Stringer {
+	return stringer(func() string {
+		return CurrentPolicy().RedactBody(body)
+	})
+}
+
+type stringer func() string
+
+func (s stringer) String() string {
+	return s()
+}
@@ -0,0 +1,85 @@
+package redact_test
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/redact"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Policy", func() {
+	msg := strings.Join([]string{
+		"INVITE sip:bob@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK.abc",
+		`From: "Alice" <sip:alice@example.com>;tag=alice-tag`,
+		"To: <tel:+15551234567>",
+		"Call-ID: call-1",
+		"CSeq: 1 INVITE",
+		`Authorization: Digest username="alice", realm="example.com", nonce="n0nce", ` +
+			`uri="sip:bob@example.com", response="6629fae49393a05397450978507c4ef1", cnonce="0a4f113b", qop=auth, nc=00000001`,
+		"P-Asserted-Identity: <sip:+15550000000@example.com>",
+		"Content-Type: application/sdp",
+		"Content-Length: 14",
+		"",
+		"v=0\r\no=alice\r\n",
+	}, "\r\n")
+
+	It("should not change text with empty policy", func() {
+		Expect(redact.Policy{}.Redact(msg)).To(Equal(msg))
+	})
+
+	It("should mask digest secrets", func() {
+		text := redact.Policy{Credentials: true}.Redact(msg)
+
+		Expect(text).To(ContainSubstring(`Authorization: Digest username="alice", realm="example.com", nonce="***", ` +
+			`uri="sip:bob@example.com", response="***", cnonce="***", qop=auth, nc=00000001`))
+		Expect(text).NotTo(ContainSubstring("6629fae49393a05397450978507c4ef1"))
+		Expect(text).To(ContainSubstring("sip:alice@example.com"))
+	})
+
+	It("should mask credentials of other schemes entirely", func() {
+		text := redact.Policy{Credentials: true}.Redact("MESSAGE sip:bob@example.com SIP/2.0\r\n" +
+			"Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n\r\n")
+
+		Expect(text).To(ContainSubstring("Proxy-Authorization: Basic ***\r\n"))
+	})
+
+	It("should mask user parts of URIs", func() {
+		text := redact.Policy{UserParts: true, Credentials: true}.Redact(msg)
+
+		Expect(text).To(HavePrefix("INVITE sip:***@example.com SIP/2.0\r\n"))
+		Expect(text).To(ContainSubstring(`From: "Alice" <sip:***@example.com>;tag=alice-tag`))
+		Expect(text).To(ContainSubstring("To: <tel:***>"))
+		Expect(text).To(ContainSubstring(`username="***"`))
+		Expect(text).To(ContainSubstring(`uri="sip:***@example.com"`))
+		Expect(text).To(ContainSubstring("Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK.abc"))
+		Expect(text).NotTo(ContainSubstring("alice@"))
+		Expect(text).NotTo(ContainSubstring("5551234567"))
+	})
+
+	It("should mask bodies and configured headers", func() {
+		text := redact.Policy{Bodies: true, Headers: []string{"p-asserted-identity"}, Mask: "#"}.Redact(msg)
+
+		Expect(text).To(ContainSubstring("P-Asserted-Identity: #\r\n"))
+		Expect(text).To(HaveSuffix("Content-Length: 14\r\n\r\n# (14 bytes)"))
+		Expect(text).NotTo(ContainSubstring("o=alice"))
+	})
+
+	It("should mask messages logged by the stack with the current policy", func() {
+		// the parser doesn't support tel URIs in To header
+		req := testutils.Request(strings.Split(strings.Replace(msg, "tel:+15551234567", "sip:bob@example.com", 1), "\r\n"))
+
+		redact.SetPolicy(redact.Policy{UserParts: true, Bodies: true})
+		defer redact.SetPolicy(redact.Policy{})
+
+		text := fmt.Sprintf("%s", redact.Message(req))
+		Expect(text).To(HavePrefix("INVITE sip:***@example.com SIP/2.0\r\n"))
+		Expect(text).To(HaveSuffix("*** (14 bytes)"))
+		Expect(fmt.Sprint(redact.Bytes([]byte(msg)))).NotTo(ContainSubstring("alice@"))
+		Expect(fmt.Sprint(redact.Body("v=0\r\n"))).To(Equal("*** (5 bytes)"))
+	})
+})
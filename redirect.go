@@ -0,0 +1,155 @@
+package gosip
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const DefaultRedirectMaxDepth = 5
+
+// RedirectTarget is a Contact of the 3xx response.
+type RedirectTarget struct {
+	Uri sip.Uri
+	// Q is a q-value of the Contact, default is 1.
+	Q float32
+}
+
+// RedirectPolicy controls recursion on 3xx responses - RFC 3261 8.1.3.4.
+type RedirectPolicy struct {
+	// MaxDepth limits the number of nested redirects, default is DefaultRedirectMaxDepth.
+	MaxDepth int
+	// OnRedirect is called on each 300, 301 or 302 response with its targets in descending q-value order,
+	// targets that were already tried are excluded. Returned targets are tried in order,
+	// empty list surfaces the 3xx response as the request failure. Default follows all targets.
+	OnRedirect func(res sip.Response, targets []RedirectTarget) []RedirectTarget
+}
+
+// redirection is the state of the request recursion on 3xx responses.
+type redirection struct {
+	policy      RedirectPolicy
+	visited     map[string]bool
+	seqNo       uint32
+	optionsHash *RequestWithContextOptions
+	options     []RequestWithContextOption
+}
+
+// requestWithRedirect sends the request and retries it towards the Contacts of 3xx responses.
+// Each URI is tried once to protect from redirect loops.
+func (srv *server) requestWithRedirect(
+	ctx context.Context,
+	request sip.Request,
+	policy RedirectPolicy,
+	options ...RequestWithContextOption,
+) (sip.Response, error) {
+	if policy.MaxDepth <= 0 {
+		policy.MaxDepth = DefaultRedirectMaxDepth
+	}
+
+	r := &redirection{
+		policy: policy,
+		visited: map[string]bool{
+			request.Recipient().String(): true,
+		},
+		optionsHash: &RequestWithContextOptions{},
+		options:     options,
+	}
+	for _, opt := range options {
+		opt.ApplyRequestWithContext(r.optionsHash)
+	}
+
+	return srv.redirect(ctx, request, r, 0)
+}
+
+func (srv *server) redirect(ctx context.Context, request sip.Request, r *redirection, depth int) (sip.Response, error) {
+	if cseq, ok := request.CSeq(); ok {
+		r.seqNo = cseq.SeqNo
+	}
+
+	res, err := srv.request(ctx, request, r.optionsHash, r.options...)
+
+	var reqErr *sip.RequestError
+	if !errors.As(err, &reqErr) || reqErr.Response == nil || !isRedirect(reqErr.Response.StatusCode()) {
+		return res, err
+	}
+	if depth >= r.policy.MaxDepth {
+		srv.Log().WithFields(request.Fields()).Debugf("redirect depth limit %d is reached", r.policy.MaxDepth)
+
+		return res, err
+	}
+
+	targets := make([]RedirectTarget, 0)
+	for _, target := range redirectTargets(reqErr.Response) {
+		if !r.visited[target.Uri.String()] {
+			targets = append(targets, target)
+		}
+	}
+	if r.policy.OnRedirect != nil {
+		targets = r.policy.OnRedirect(reqErr.Response, targets)
+	}
+
+	for _, target := range targets {
+		if r.visited[target.Uri.String()] {
+			continue
+		}
+		r.visited[target.Uri.String()] = true
+
+		srv.Log().WithFields(request.Fields()).Debugf("request is redirected to %s", target.Uri)
+
+		res, err = srv.redirect(ctx, redirectRequest(request, target.Uri, r.seqNo+1), r, depth+1)
+		if err == nil || ctx.Err() != nil {
+			return res, err
+		}
+	}
+
+	return res, err
+}
+
+func isRedirect(code sip.StatusCode) bool {
+	return code == 300 || code == 301 || code == 302
+}
+
+// redirectTargets returns Contacts of the 3xx response sorted by q-value.
+func redirectTargets(res sip.Response) []RedirectTarget {
+	targets := make([]RedirectTarget, 0)
+	for _, hdr := range res.GetHeaders("Contact") {
+		contact, ok := hdr.(*sip.ContactHeader)
+		if !ok || contact.Address == nil {
+			continue
+		}
+
+		target := RedirectTarget{Uri: contact.Address.Clone(), Q: 1}
+		if contact.Params != nil {
+			if val, ok := contact.Params.Get("q"); ok && val != nil {
+				if q, err := strconv.ParseFloat(val.String(), 32); err == nil && q >= 0 && q <= 1 {
+					target.Q = float32(q)
+				}
+			}
+		}
+		targets = append(targets, target)
+	}
+
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].Q > targets[j].Q
+	})
+
+	return targets
+}
+
+// redirectRequest builds new request to the target with the same Call-ID, From and To - RFC 3261 8.1.3.4.
+func redirectRequest(request sip.Request, target sip.Uri, seqNo uint32) sip.Request {
+	req := sip.CopyRequest(request)
+	req.SetRecipient(target.Clone())
+	req.SetDestination("")
+	if viaHop, ok := req.ViaHop(); ok && viaHop.Params != nil && viaHop.Params.Has("branch") {
+		viaHop.Params.Add("branch", sip.String{Str: sip.GenerateBranch()})
+	}
+	if cseq, ok := req.CSeq(); ok {
+		cseq.SeqNo = seqNo
+	}
+
+	return req
+}
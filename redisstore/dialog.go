@@ -0,0 +1,230 @@
+package redisstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// DefaultDialogTTL is the lifetime of the dialog key without updates.
+const DefaultDialogTTL = 12 * time.Hour
+
+// ErrDialogConflict is returned by Put if the dialog was changed by another node since this node stored it.
+var ErrDialogConflict = errors.New("dialog was changed concurrently")
+
+// DialogConfig describes options of the dialog store.
+type DialogConfig struct {
+	Config
+	// TTL is the lifetime of the dialog key, each Put extends it, default is DefaultDialogTTL.
+	// It should exceed session refresh intervals of dialogs - RFC 4028.
+	TTL time.Duration
+}
+
+type dialogStore struct {
+	redis
+	ttl time.Duration
+
+	mu sync.Mutex
+	// dialogs are dialogs put by the node and dialogs of other nodes restored by the node,
+	// so all callers get the same object of the dialog
+	dialogs  map[string]dialog.Dialog
+	owned    map[string]bool
+	versions map[string]int64
+
+	log log.Logger
+}
+
+// NewDialogStore creates dialog store that shares dialog snapshots between nodes.
+// Dialogs stored by the node are returned as is, dialogs of other nodes are restored from snapshots,
+// see dialog.RestoreDialog. Put the dialog again to share its updated state.
+func NewDialogStore(client Client, config DialogConfig, logger log.Logger) dialog.DialogStore {
+	if config.TTL <= 0 {
+		config.TTL = DefaultDialogTTL
+	}
+
+	store := &dialogStore{
+		redis: redis{
+			client: client,
+			config: config.Config.withDefaults(),
+		},
+		ttl:      config.TTL,
+		dialogs:  make(map[string]dialog.Dialog),
+		owned:    make(map[string]bool),
+		versions: make(map[string]int64),
+	}
+	store.log = logger.
+		WithPrefix("redisstore.DialogStore").
+		WithFields(log.Fields{
+			"dialog_store_ptr": fmt.Sprintf("%p", store),
+		})
+
+	return store
+}
+
+func (store *dialogStore) Log() log.Logger {
+	return store.log
+}
+
+func (store *dialogStore) key(id string) string {
+	return store.config.Prefix + "dialog:" + id
+}
+
+func (store *dialogStore) callIDKey(callID sip.CallID) string {
+	return store.config.Prefix + "dialog-call:" + string(callID)
+}
+
+func (store *dialogStore) Put(dlg dialog.Dialog) error {
+	data, err := json.Marshal(dialog.SnapshotOf(dlg))
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", dlg, err)
+	}
+	expires := timing.Now().Add(store.ttl)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	version, err := store.compareAndSet(store.key(dlg.ID()), store.versions[dlg.ID()], string(data), expires)
+	if errors.Is(err, errConflict) {
+		return ErrDialogConflict
+	}
+	if err != nil {
+		return err
+	}
+	store.versions[dlg.ID()] = version
+	store.dialogs[dlg.ID()] = dlg
+	store.owned[dlg.ID()] = true
+
+	callIDKey := store.callIDKey(dlg.CallID())
+	if _, err := store.do("SADD", callIDKey, dlg.ID()); err != nil {
+		return err
+	}
+	if _, err := store.do("PEXPIREAT", callIDKey, expires.UnixNano()/int64(time.Millisecond)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (store *dialogStore) Delete(id string) error {
+	dlg, err := store.Get(id)
+	if err != nil || dlg == nil {
+		return err
+	}
+
+	store.forget(id)
+
+	if _, err := store.do("DEL", store.key(id)); err != nil {
+		return err
+	}
+	if _, err := store.do("SREM", store.callIDKey(dlg.CallID()), id); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (store *dialogStore) Get(id string) (dialog.Dialog, error) {
+	store.mu.Lock()
+	dlg, ok := store.dialogs[id]
+	owned := store.owned[id]
+	store.mu.Unlock()
+	if owned {
+		return dlg, nil
+	}
+
+	kv, err := store.get(store.key(id))
+	if err != nil {
+		return nil, err
+	}
+	if kv.data == "" {
+		// the dialog of another node is deleted or expired
+		if ok {
+			store.forget(id)
+			dlg.Terminate()
+		}
+
+		return nil, nil
+	}
+	if ok {
+		return dlg, nil
+	}
+
+	var snapshot dialog.Snapshot
+	if err := json.Unmarshal([]byte(kv.data), &snapshot); err != nil {
+		return nil, fmt.Errorf("decode dialog %s: %w", id, err)
+	}
+	dlg, err = dialog.RestoreDialog(snapshot, store.Log())
+	if err != nil {
+		return nil, fmt.Errorf("restore dialog %s: %w", id, err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// the dialog could be restored concurrently, all callers must get the same object
+	if stored, ok := store.dialogs[id]; ok {
+		return stored, nil
+	}
+	store.dialogs[id] = dlg
+	store.versions[id] = kv.version
+
+	return dlg, nil
+}
+
+func (store *dialogStore) forget(id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.dialogs, id)
+	delete(store.owned, id)
+	delete(store.versions, id)
+}
+
+func (store *dialogStore) ByCallID(callID sip.CallID) ([]dialog.Dialog, error) {
+	reply, err := store.do("SMEMBERS", store.callIDKey(callID))
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		if id, ok := toString(member); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return store.getAll(ids)
+}
+
+func (store *dialogStore) All() ([]dialog.Dialog, error) {
+	ids, err := store.scan(store.config.Prefix + "dialog:")
+	if err != nil {
+		return nil, err
+	}
+
+	return store.getAll(ids)
+}
+
+// getAll returns existing dialogs of IDs, expired dialogs are skipped.
+func (store *dialogStore) getAll(ids []string) ([]dialog.Dialog, error) {
+	dialogs := make([]dialog.Dialog, 0, len(ids))
+	for _, id := range ids {
+		dlg, err := store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if dlg != nil {
+			dialogs = append(dialogs, dlg)
+		}
+	}
+
+	return dialogs, nil
+}
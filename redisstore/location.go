@@ -0,0 +1,151 @@
+package redisstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/registrar"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+type bindingJSON struct {
+	Contact string  `json:"contact"`
+	CallID  string  `json:"call_id"`
+	CSeq    uint32  `json:"cseq"`
+	Expires int64   `json:"expires"`
+	Q       float32 `json:"q"`
+}
+
+type locationStore struct {
+	redis
+
+	mu sync.Mutex
+	// versions are versions of AORs read by Get
+	versions map[string]int64
+}
+
+// NewLocationStore creates registrar location store, the AOR key expires with its last binding.
+// Set returns registrar.ErrConflict if the AOR was changed by another node since Get.
+func NewLocationStore(client Client, config Config) registrar.LocationStore {
+	return &locationStore{
+		redis: redis{
+			client: client,
+			config: config.withDefaults(),
+		},
+		versions: make(map[string]int64),
+	}
+}
+
+func (store *locationStore) key(aor string) string {
+	return store.config.Prefix + "location:" + aor
+}
+
+func (store *locationStore) Get(aor string) ([]*registrar.Binding, error) {
+	kv, err := store.get(store.key(aor))
+	if err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	if kv.version > 0 {
+		store.versions[aor] = kv.version
+	} else {
+		delete(store.versions, aor)
+	}
+	store.mu.Unlock()
+
+	if kv.data == "" {
+		return []*registrar.Binding{}, nil
+	}
+
+	var values []bindingJSON
+	if err := json.Unmarshal([]byte(kv.data), &values); err != nil {
+		return nil, fmt.Errorf("decode bindings of %s: %w", aor, err)
+	}
+	bindings := make([]*registrar.Binding, 0, len(values))
+	for _, value := range values {
+		contact, err := parseContact(value.Contact)
+		if err != nil {
+			return nil, fmt.Errorf("decode bindings of %s: %w", aor, err)
+		}
+		bindings = append(bindings, &registrar.Binding{
+			Contact: contact,
+			CallID:  value.CallID,
+			CSeq:    value.CSeq,
+			Expires: time.Unix(0, value.Expires*int64(time.Millisecond)),
+			Q:       value.Q,
+		})
+	}
+
+	return bindings, nil
+}
+
+func (store *locationStore) Set(aor string, bindings []*registrar.Binding) error {
+	var (
+		data    string
+		expires time.Time
+	)
+	if len(bindings) > 0 {
+		values := make([]bindingJSON, 0, len(bindings))
+		for _, binding := range bindings {
+			values = append(values, bindingJSON{
+				Contact: binding.Contact.Value(),
+				CallID:  binding.CallID,
+				CSeq:    binding.CSeq,
+				Expires: binding.Expires.UnixNano() / int64(time.Millisecond),
+				Q:       binding.Q,
+			})
+			if binding.Expires.After(expires) {
+				expires = binding.Expires
+			}
+		}
+		encoded, err := json.Marshal(values)
+		if err != nil {
+			return fmt.Errorf("encode bindings of %s: %w", aor, err)
+		}
+		data = string(encoded)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	version, err := store.compareAndSet(store.key(aor), store.versions[aor], data, expires)
+	if errors.Is(err, errConflict) {
+		delete(store.versions, aor)
+		return registrar.ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	if version > 0 {
+		store.versions[aor] = version
+	} else {
+		delete(store.versions, aor)
+	}
+
+	return nil
+}
+
+func (store *locationStore) AORs() ([]string, error) {
+	return store.scan(store.config.Prefix + "location:")
+}
+
+func parseContact(value string) (*sip.ContactHeader, error) {
+	hdrs, err := parser.ParseHeader("Contact: " + value)
+	if err != nil {
+		return nil, err
+	}
+	if len(hdrs) != 1 {
+		return nil, fmt.Errorf("invalid contact '%s'", value)
+	}
+	contact, ok := hdrs[0].(*sip.ContactHeader)
+	if !ok {
+		return nil, fmt.Errorf("invalid contact '%s'", value)
+	}
+
+	return contact, nil
+}
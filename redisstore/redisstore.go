@@ -0,0 +1,184 @@
+// redisstore package implements registrar location store and dialog store backed by Redis,
+// so a cluster of nodes shares registrations and dialogs.
+// Keys expire with the bindings and dialogs they hold, updates are optimistic:
+// every key has a version and a write fails if the key was changed since it was read by the node.
+//
+// The package does not depend on the particular Redis client, any client is adapted with ClientFunc, e.g. go-redis:
+//
+//	client := redisstore.ClientFunc(func(ctx context.Context, args ...interface{}) (interface{}, error) {
+//		return rdb.Do(ctx, args...).Result()
+//	})
+//	reg := registrar.NewRegistrar(registrar.Config{Store: redisstore.NewLocationStore(client, redisstore.Config{})}, logger)
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPrefix is a prefix of all keys of the stores.
+	DefaultPrefix = "gosip:"
+	// DefaultTimeout limits each Redis command.
+	DefaultTimeout = time.Second
+)
+
+// errConflict is returned by compareAndSet when the key was changed since it was read.
+var errConflict = errors.New("key was changed concurrently")
+
+// Client executes Redis command and returns its reply: string or []byte for bulk strings,
+// int64 for integers, []interface{} for arrays and nil for nil elements of arrays.
+type Client interface {
+	Do(ctx context.Context, args ...interface{}) (interface{}, error)
+}
+
+// ClientFunc is an adapter to use ordinary function as Client.
+type ClientFunc func(ctx context.Context, args ...interface{}) (interface{}, error)
+
+func (f ClientFunc) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	return f(ctx, args...)
+}
+
+// Config describes options of the stores.
+type Config struct {
+	// Prefix is a prefix of all keys, nodes of the cluster must use the same prefix, default is DefaultPrefix.
+	Prefix string
+	// Timeout limits each Redis command, default is DefaultTimeout.
+	Timeout time.Duration
+}
+
+func (config Config) withDefaults() Config {
+	if config.Prefix == "" {
+		config.Prefix = DefaultPrefix
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	return config
+}
+
+// casScript replaces data of the hash if its version is equal to the expected one
+// and increments the version, empty data deletes the hash.
+// KEYS[1] is the hash, ARGV[1] is the expected version, ARGV[2] is the data, ARGV[3] is the expiration unix time in ms.
+const casScript = `
+local v = redis.call('HGET', KEYS[1], 'v')
+if (v or '0') ~= ARGV[1] then
+	return 0
+end
+if ARGV[2] == '' then
+	redis.call('DEL', KEYS[1])
+	return 1
+end
+redis.call('HSET', KEYS[1], 'v', tostring(tonumber(ARGV[1]) + 1), 'd', ARGV[2])
+redis.call('PEXPIREAT', KEYS[1], ARGV[3])
+return 1
+`
+
+// keyValue is a versioned value of the key.
+type keyValue struct {
+	version int64
+	data    string
+}
+
+type redis struct {
+	client Client
+	config Config
+}
+
+func (r *redis) do(args ...interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+
+	reply, err := r.client.Do(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("redis %s: %w", args[0], err)
+	}
+
+	return reply, nil
+}
+
+// get reads version and data of the key, zero version means the key does not exist.
+func (r *redis) get(key string) (keyValue, error) {
+	reply, err := r.do("HMGET", key, "v", "d")
+	if err != nil {
+		return keyValue{}, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return keyValue{}, fmt.Errorf("redis HMGET: unexpected reply %v", reply)
+	}
+
+	version, ok := toString(values[0])
+	if !ok {
+		return keyValue{}, nil
+	}
+	kv := keyValue{}
+	if kv.version, err = strconv.ParseInt(version, 10, 64); err != nil {
+		return keyValue{}, fmt.Errorf("redis HMGET: invalid version '%s'", version)
+	}
+	kv.data, _ = toString(values[1])
+
+	return kv, nil
+}
+
+// compareAndSet writes data of the key read with the version, empty data deletes the key.
+// Returns the new version or errConflict.
+func (r *redis) compareAndSet(key string, version int64, data string, expires time.Time) (int64, error) {
+	reply, err := r.do("EVAL", casScript, 1, key,
+		strconv.FormatInt(version, 10), data, strconv.FormatInt(expires.UnixNano()/int64(time.Millisecond), 10))
+	if err != nil {
+		return 0, err
+	}
+	if n, ok := reply.(int64); !ok || n != 1 {
+		return 0, errConflict
+	}
+	if data == "" {
+		return 0, nil
+	}
+
+	return version + 1, nil
+}
+
+// scan returns all keys with the prefix.
+func (r *redis) scan(prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 100)
+		if err != nil {
+			return nil, err
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 2 {
+			return nil, fmt.Errorf("redis SCAN: unexpected reply %v", reply)
+		}
+		if cursor, ok = toString(values[0]); !ok {
+			return nil, fmt.Errorf("redis SCAN: unexpected cursor %v", values[0])
+		}
+		items, _ := values[1].([]interface{})
+		for _, item := range items {
+			if key, ok := toString(item); ok {
+				keys = append(keys, strings.TrimPrefix(key, prefix))
+			}
+		}
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+func toString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,279 @@
+package redisstore_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/redisstore"
+	"github.com/ghettovoice/gosip/registrar"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+// fakeRedis implements commands used by the stores, EVAL executes compare-and-set.
+type fakeRedis struct {
+	mu     sync.Mutex
+	hashes map[string]map[string]string
+	sets   map[string]map[string]bool
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		hashes: make(map[string]map[string]string),
+		sets:   make(map[string]map[string]bool),
+	}
+}
+
+func (r *fakeRedis) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	str := func(i int) string { return fmt.Sprint(args[i]) }
+	switch str(0) {
+	case "HMGET":
+		hash, ok := r.hashes[str(1)]
+		reply := make([]interface{}, 0, len(args)-2)
+		for i := 2; i < len(args); i++ {
+			if value, has := hash[str(i)]; ok && has {
+				reply = append(reply, []byte(value))
+			} else {
+				reply = append(reply, nil)
+			}
+		}
+		return reply, nil
+	case "EVAL":
+		key, version, data := str(3), str(4), str(5)
+		current := "0"
+		if hash, ok := r.hashes[key]; ok {
+			current = hash["v"]
+		}
+		if current != version {
+			return int64(0), nil
+		}
+		if data == "" {
+			delete(r.hashes, key)
+			return int64(1), nil
+		}
+		n, _ := strconv.ParseInt(version, 10, 64)
+		r.hashes[key] = map[string]string{"v": strconv.FormatInt(n+1, 10), "d": data}
+		return int64(1), nil
+	case "SCAN":
+		prefix := strings.TrimSuffix(str(3), "*")
+		keys := make([]interface{}, 0)
+		for key := range r.hashes {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		return []interface{}{"0", keys}, nil
+	case "SADD":
+		if r.sets[str(1)] == nil {
+			r.sets[str(1)] = make(map[string]bool)
+		}
+		r.sets[str(1)][str(2)] = true
+		return int64(1), nil
+	case "SREM":
+		delete(r.sets[str(1)], str(2))
+		return int64(1), nil
+	case "SMEMBERS":
+		members := make([]interface{}, 0)
+		for member := range r.sets[str(1)] {
+			members = append(members, member)
+		}
+		return members, nil
+	case "DEL":
+		delete(r.hashes, str(1))
+		delete(r.sets, str(1))
+		return int64(1), nil
+	case "PEXPIREAT":
+		return int64(1), nil
+	default:
+		return nil, fmt.Errorf("unknown command %s", args[0])
+	}
+}
+
+var _ = Describe("LocationStore", func() {
+	var redis *fakeRedis
+
+	binding := func(host string) *registrar.Binding {
+		return &registrar.Binding{
+			Contact: &sip.ContactHeader{
+				Address: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: host},
+				Params:  sip.NewParams(),
+			},
+			CallID:  "call-1",
+			CSeq:    1,
+			Expires: time.Now().Add(time.Hour).Truncate(time.Millisecond),
+			Q:       0.5,
+		}
+	}
+
+	BeforeEach(func() {
+		redis = newFakeRedis()
+	})
+
+	It("should store bindings", func() {
+		store := redisstore.NewLocationStore(redis, redisstore.Config{})
+		_, err := store.Get("sip:alice@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		expected := binding("10.0.0.1")
+		Expect(store.Set("sip:alice@example.com", []*registrar.Binding{expected})).To(Succeed())
+
+		bindings, err := redisstore.NewLocationStore(redis, redisstore.Config{}).Get("sip:alice@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings).To(HaveLen(1))
+		Expect(bindings[0].Contact.Address.String()).To(Equal("sip:alice@10.0.0.1"))
+		Expect(bindings[0].CallID).To(Equal("call-1"))
+		Expect(bindings[0].Expires.Equal(expected.Expires)).To(BeTrue())
+		Expect(bindings[0].Q).To(BeNumerically("~", 0.5, 0.001))
+
+		Expect(store.AORs()).To(Equal([]string{"sip:alice@example.com"}))
+
+		Expect(store.Set("sip:alice@example.com", nil)).To(Succeed())
+		Expect(store.AORs()).To(BeEmpty())
+	})
+
+	It("should detect concurrent updates", func() {
+		node1 := redisstore.NewLocationStore(redis, redisstore.Config{})
+		node2 := redisstore.NewLocationStore(redis, redisstore.Config{})
+		_, err := node1.Get("sip:alice@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = node2.Get("sip:alice@example.com")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(node1.Set("sip:alice@example.com", []*registrar.Binding{binding("10.0.0.1")})).To(Succeed())
+		Expect(node2.Set("sip:alice@example.com", []*registrar.Binding{binding("10.0.0.2")})).
+			To(MatchError(registrar.ErrConflict))
+	})
+
+	It("should serve registrar of several nodes", func() {
+		newRegistrar := func() registrar.Registrar {
+			return registrar.NewRegistrar(registrar.Config{
+				Domains: []string{"example.com"},
+				Store:   redisstore.NewLocationStore(redis, redisstore.Config{}),
+			}, testutils.NewLogrusLogger())
+		}
+		register := func(r registrar.Registrar, cseq int, contact string) sip.Response {
+			return r.HandleRegister(testutils.Request([]string{
+				"REGISTER sip:example.com SIP/2.0",
+				"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@example.com>;tag=reg-tag",
+				"To: <sip:alice@example.com>",
+				"Call-ID: call-" + contact,
+				fmt.Sprintf("CSeq: %d REGISTER", cseq),
+				"Contact: <sip:alice@" + contact + ">",
+				"",
+				"",
+			}))
+		}
+
+		node1, node2 := newRegistrar(), newRegistrar()
+		Expect(register(node1, 1, "10.0.0.1").StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(register(node2, 1, "10.0.0.2").StatusCode()).To(Equal(sip.StatusCode(200)))
+
+		bindings, err := node1.Lookup(&sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings).To(HaveLen(2))
+	})
+})
+
+var _ = Describe("DialogStore", func() {
+	var (
+		redis *fakeRedis
+		dlg   dialog.Dialog
+	)
+
+	newStore := func() dialog.DialogStore {
+		return redisstore.NewDialogStore(redis, redisstore.DialogConfig{}, testutils.NewLogrusLogger())
+	}
+
+	BeforeEach(func() {
+		redis = newFakeRedis()
+
+		invite := testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: redis-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060>",
+			"",
+			"",
+		})
+		res := testutils.Response([]string{
+			"SIP/2.0 200 OK",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: redis-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:bob@10.0.0.2:5060>",
+			"Record-Route: <sip:proxy.example.com;lr>",
+			"",
+			"",
+		})
+		var err error
+		dlg, err = dialog.NewUACDialog(invite, res, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should return the stored dialog on the same node", func() {
+		store := newStore()
+		Expect(store.Put(dlg)).To(Succeed())
+
+		Expect(store.Get(dlg.ID())).To(BeIdenticalTo(dlg))
+		Expect(store.ByCallID("redis-call-id")).To(ConsistOf(dlg))
+		Expect(store.All()).To(ConsistOf(dlg))
+
+		Expect(store.Delete(dlg.ID())).To(Succeed())
+		Expect(store.Get(dlg.ID())).To(BeNil())
+		Expect(store.ByCallID("redis-call-id")).To(BeEmpty())
+	})
+
+	It("should restore the dialog on another node", func() {
+		Expect(newStore().Put(dlg)).To(Succeed())
+
+		store := newStore()
+		restored, err := store.Get(dlg.ID())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(restored).ToNot(BeNil())
+		Expect(restored.ID()).To(Equal(dlg.ID()))
+		Expect(restored.IsUAC()).To(BeTrue())
+		Expect(restored.LocalSeq()).To(Equal(dlg.LocalSeq()))
+		Expect(restored.RemoteTarget().String()).To(Equal("sip:bob@10.0.0.2:5060"))
+		Expect(restored.RouteSet()).To(HaveLen(1))
+		Expect(store.Get(dlg.ID())).To(BeIdenticalTo(restored))
+	})
+
+	It("should drop the restored dialog deleted by another node", func() {
+		owner := newStore()
+		Expect(owner.Put(dlg)).To(Succeed())
+		store := newStore()
+		restored, err := store.Get(dlg.ID())
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(owner.Delete(dlg.ID())).To(Succeed())
+		Expect(store.Get(dlg.ID())).To(BeNil())
+		Expect(restored.State()).To(Equal(dialog.Terminated))
+	})
+
+	It("should detect concurrent updates", func() {
+		owner := newStore()
+		Expect(owner.Put(dlg)).To(Succeed())
+		store := newStore()
+		restored, err := store.Get(dlg.ID())
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(owner.Put(dlg)).To(Succeed())
+		Expect(store.Put(restored)).To(MatchError(redisstore.ErrDialogConflict))
+	})
+})
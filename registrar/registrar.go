@@ -0,0 +1,486 @@
+// registrar package implements SIP registrar and location service - RFC 3261 10.3.
+package registrar
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	DefaultExpires    = time.Hour
+	DefaultMinExpires = time.Minute
+	DefaultMaxExpires = 24 * time.Hour
+
+	// maxConflictRetries limits updates of bindings changed concurrently by other nodes.
+	maxConflictRetries = 3
+)
+
+// Config describes registrar options.
+type Config struct {
+	// Store is a location service backend, default is in-memory store.
+	Store LocationStore
+	// Domains is a list of domains the registrar is responsible for, empty list allows any domain.
+	Domains []string
+	// DefaultExpires is used when the request has no expiration interval, default is DefaultExpires.
+	DefaultExpires time.Duration
+	// MinExpires is the shortest allowed expiration interval, default is DefaultMinExpires.
+	MinExpires time.Duration
+	// MaxExpires is the longest allowed expiration interval, default is DefaultMaxExpires.
+	MaxExpires time.Duration
+	// EventBus receives expired bindings, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+type Registrar interface {
+	// ServeRegister handles REGISTER request and responds through the transaction,
+	// it can be passed directly to gosip.Server OnRequest.
+	ServeRegister(req sip.Request, tx sip.ServerTransaction)
+	// HandleRegister processes REGISTER request and builds the response - RFC 3261 10.3.
+	HandleRegister(req sip.Request) sip.Response
+	// Lookup returns active bindings of the AOR ordered by q-value.
+	Lookup(aor sip.Uri) ([]*Binding, error)
+}
+
+// Bindings are removed from the store when they expire by the timer of the earliest binding of the AOR,
+// the timer is started by the registrar that updates the bindings of the AOR.
+type registrar struct {
+	store          LocationStore
+	domains        []string
+	defaultExpires time.Duration
+	minExpires     time.Duration
+	maxExpires     time.Duration
+	bus            eventbus.Bus
+	mu             sync.Mutex
+	// timers expire bindings of AORs
+	timers map[string]timing.Timer
+
+	log log.Logger
+}
+
+// NewRegistrar creates registrar.
+func NewRegistrar(config Config, logger log.Logger) Registrar {
+	if config.Store == nil {
+		config.Store = NewMemoryStore()
+	}
+	if config.DefaultExpires <= 0 {
+		config.DefaultExpires = DefaultExpires
+	}
+	if config.MinExpires <= 0 {
+		config.MinExpires = DefaultMinExpires
+	}
+	if config.MaxExpires <= 0 {
+		config.MaxExpires = DefaultMaxExpires
+	}
+	if config.EventBus == nil {
+		config.EventBus = eventbus.Default
+	}
+
+	r := &registrar{
+		store:          config.Store,
+		defaultExpires: config.DefaultExpires,
+		minExpires:     config.MinExpires,
+		maxExpires:     config.MaxExpires,
+		bus:            config.EventBus,
+		timers:         make(map[string]timing.Timer),
+	}
+	for _, domain := range config.Domains {
+		r.domains = append(r.domains, strings.ToLower(domain))
+	}
+	r.log = logger.WithPrefix("registrar.Registrar")
+
+	return r
+}
+
+func (r *registrar) Log() log.Logger {
+	return r.log
+}
+
+func (r *registrar) ServeRegister(req sip.Request, tx sip.ServerTransaction) {
+	res := r.HandleRegister(req)
+	if err := tx.Respond(res); err != nil {
+		r.Log().WithFields(req.Fields()).Errorf("respond on REGISTER failed: %s", err)
+	}
+}
+
+func (r *registrar) HandleRegister(req sip.Request) sip.Response {
+	logger := r.Log().WithFields(req.Fields())
+
+	if req.Method() != sip.REGISTER {
+		return newResponse(req, 405, "Method Not Allowed")
+	}
+
+	// RFC 3261 10.3.1. Request-URI domain
+	if !r.isResponsible(req.Recipient()) {
+		return newResponse(req, 404, "Not Found")
+	}
+
+	// RFC 3261 10.3.2. registrar does not support any extensions
+	if hdrs := req.GetHeaders("Require"); len(hdrs) > 0 {
+		res := newResponse(req, 420, "Bad Extension")
+		for _, hdr := range hdrs {
+			if require, ok := hdr.(*sip.RequireHeader); ok {
+				res.AppendHeader(&sip.UnsupportedHeader{Options: require.Options})
+			}
+		}
+		return res
+	}
+
+	// RFC 3261 10.3.5. address-of-record from To header
+	to, ok := req.To()
+	if !ok || to.Address == nil {
+		return newResponse(req, 400, "Bad Request")
+	}
+	aor, err := CanonicalAOR(to.Address)
+	if err != nil || !r.isResponsible(to.Address) {
+		return newResponse(req, 404, "Not Found")
+	}
+
+	callID, ok := req.CallID()
+	if !ok {
+		return newResponse(req, 400, "Bad Request")
+	}
+	cseq, ok := req.CSeq()
+	if !ok {
+		return newResponse(req, 400, "Bad Request")
+	}
+
+	contacts := make([]*sip.ContactHeader, 0)
+	wildcard := false
+	for _, hdr := range req.GetHeaders("Contact") {
+		contact, ok := hdr.(*sip.ContactHeader)
+		if !ok || contact.Address == nil {
+			return newResponse(req, 400, "Bad Request")
+		}
+		if contact.Address.IsWildcard() {
+			wildcard = true
+		}
+		contacts = append(contacts, contact)
+	}
+
+	reqExpires, hasExpires := requestExpires(req)
+	// RFC 3261 10.3.6. '*' Contact must be the only one and must have Expires: 0
+	if wildcard && (len(contacts) > 1 || !hasExpires || reqExpires != 0) {
+		return newResponse(req, 400, "Bad Request")
+	}
+	if !hasExpires {
+		reqExpires = r.defaultExpires
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		current, err := r.store.Get(aor)
+		if err != nil {
+			logger.Errorf("get bindings of %s failed: %s", aor, err)
+
+			return newResponse(req, 500, "Server Internal Error")
+		}
+
+		now := timing.Now()
+		bindings := activeBindings(current, now)
+
+		if wildcard {
+			// RFC 3261 10.3.7. wildcard removes all bindings unless the request is out of order
+			for _, binding := range bindings {
+				if binding.CallID == string(*callID) && binding.CSeq >= cseq.SeqNo {
+					return newResponse(req, 500, "Server Internal Error")
+				}
+			}
+			bindings = bindings[:0]
+		}
+
+		for _, contact := range contacts {
+			if wildcard {
+				break
+			}
+
+			expires := reqExpires
+			if val, ok := paramExpires(contact.Params); ok {
+				expires = val
+			}
+			if expires > 0 && expires < r.minExpires {
+				res := newResponse(req, 423, "Interval Too Brief")
+				res.AppendHeader(&sip.GenericHeader{
+					HeaderName: "Min-Expires",
+					Contents:   fmt.Sprintf("%d", int(r.minExpires/time.Second)),
+				})
+				return res
+			}
+			if expires > r.maxExpires {
+				expires = r.maxExpires
+			}
+
+			index := -1
+			for i, binding := range bindings {
+				if binding.Contact.Address.Equals(contact.Address) {
+					index = i
+					break
+				}
+			}
+
+			if index >= 0 {
+				binding := bindings[index]
+				// RFC 3261 10.3.7. out of order request for the same Call-ID
+				if binding.CallID == string(*callID) && binding.CSeq >= cseq.SeqNo {
+					return newResponse(req, 500, "Server Internal Error")
+				}
+				if expires == 0 {
+					bindings = append(bindings[:index], bindings[index+1:]...)
+					continue
+				}
+			} else if expires == 0 {
+				continue
+			}
+
+			stored := contact.Clone().(*sip.ContactHeader)
+			if stored.Params != nil {
+				stored.Params.Remove("expires")
+			}
+			binding := &Binding{
+				Contact: stored,
+				CallID:  string(*callID),
+				CSeq:    cseq.SeqNo,
+				Expires: now.Add(expires),
+				Q:       paramQ(contact.Params),
+			}
+			if index >= 0 {
+				bindings[index] = binding
+			} else {
+				bindings = append(bindings, binding)
+			}
+		}
+
+		if len(contacts) > 0 {
+			if err := r.store.Set(aor, bindings); err != nil {
+				if errors.Is(err, ErrConflict) && attempt < maxConflictRetries {
+					logger.Debugf("bindings of %s changed concurrently, retry", aor)
+					continue
+				}
+				logger.Errorf("set bindings of %s failed: %s", aor, err)
+
+				return newResponse(req, 500, "Server Internal Error")
+			}
+
+			logger.Debugf("%s has %d bindings", aor, len(bindings))
+
+			// bindings expired before the timer fired are removed from the store with the update
+			r.publishExpired(aor, current, now)
+			r.schedule(aor, bindings)
+		}
+
+		// RFC 3261 10.3.8. 200 OK lists all current bindings
+		res := newResponse(req, 200, "OK")
+		for _, binding := range bindings {
+			res.AppendHeader(bindingContact(binding, now))
+		}
+
+		return res
+	}
+}
+
+// expire removes expired bindings of the AOR, it is called by the timer of the earliest binding.
+func (r *registrar) expire(aor string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		current, err := r.store.Get(aor)
+		if err != nil {
+			r.Log().Errorf("get bindings of %s failed: %s", aor, err)
+
+			return
+		}
+
+		now := timing.Now()
+		bindings := activeBindings(current, now)
+		if len(bindings) < len(current) {
+			if err := r.store.Set(aor, bindings); err != nil {
+				if errors.Is(err, ErrConflict) && attempt < maxConflictRetries {
+					continue
+				}
+				r.Log().Errorf("remove expired bindings of %s failed: %s", aor, err)
+
+				return
+			}
+
+			r.Log().Debugf("%s has %d bindings after expiry", aor, len(bindings))
+			r.publishExpired(aor, current, now)
+		}
+		r.schedule(aor, bindings)
+
+		return
+	}
+}
+
+// schedule starts the timer of the earliest binding of the AOR, r.mu must be held.
+func (r *registrar) schedule(aor string, bindings []*Binding) {
+	if timer, ok := r.timers[aor]; ok {
+		timer.Stop()
+		delete(r.timers, aor)
+	}
+	if len(bindings) == 0 {
+		return
+	}
+
+	earliest := bindings[0].Expires
+	for _, binding := range bindings[1:] {
+		if binding.Expires.Before(earliest) {
+			earliest = binding.Expires
+		}
+	}
+	r.timers[aor] = timing.AfterFunc(earliest.Sub(timing.Now()), func() {
+		r.expire(aor)
+	})
+}
+
+func (r *registrar) publishExpired(aor string, bindings []*Binding, now time.Time) {
+	for _, binding := range bindings {
+		if binding.IsExpired(now) {
+			r.bus.Publish(&eventbus.RegistrationExpiredEvent{
+				AOR:     aor,
+				Contact: binding.Contact,
+				CallID:  binding.CallID,
+			})
+		}
+	}
+}
+
+func (r *registrar) Lookup(aor sip.Uri) ([]*Binding, error) {
+	key, err := CanonicalAOR(aor)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings, err := r.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings = activeBindings(bindings, timing.Now())
+	sort.SliceStable(bindings, func(i, j int) bool {
+		return bindings[i].Q > bindings[j].Q
+	})
+
+	return bindings, nil
+}
+
+func (r *registrar) isResponsible(uri sip.Uri) bool {
+	if len(r.domains) == 0 {
+		return true
+	}
+
+	host := strings.ToLower(uri.Host())
+	for _, domain := range r.domains {
+		if host == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanonicalAOR converts URI to the canonical address-of-record form 'sip:user@host' - RFC 3261 10.3.5.
+func CanonicalAOR(uri sip.Uri) (string, error) {
+	sipUri, ok := uri.(*sip.SipUri)
+	if !ok || sipUri.FHost == "" {
+		return "", fmt.Errorf("invalid address-of-record '%s'", uri)
+	}
+
+	aor := "sip:"
+	if sipUri.FUser != nil && sipUri.FUser.String() != "" {
+		aor += sipUri.FUser.String() + "@"
+	}
+	aor += strings.ToLower(sipUri.FHost)
+
+	return aor, nil
+}
+
+func activeBindings(bindings []*Binding, now time.Time) []*Binding {
+	active := make([]*Binding, 0, len(bindings))
+	for _, binding := range bindings {
+		if !binding.IsExpired(now) {
+			active = append(active, binding)
+		}
+	}
+
+	return active
+}
+
+func bindingContact(binding *Binding, now time.Time) *sip.ContactHeader {
+	contact := binding.Contact.Clone().(*sip.ContactHeader)
+	if contact.Params == nil {
+		contact.Params = sip.NewParams()
+	}
+	expires := binding.Expires.Sub(now).Round(time.Second) / time.Second
+	contact.Params.Add("expires", sip.String{Str: strconv.Itoa(int(expires))})
+
+	return contact
+}
+
+func requestExpires(req sip.Request) (time.Duration, bool) {
+	hdrs := req.GetHeaders("Expires")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+	if expires, ok := hdrs[0].(*sip.Expires); ok {
+		return time.Duration(*expires) * time.Second, true
+	}
+
+	return 0, false
+}
+
+func paramExpires(params sip.Params) (time.Duration, bool) {
+	if params == nil {
+		return 0, false
+	}
+	val, ok := params.Get("expires")
+	if !ok || val == nil {
+		return 0, false
+	}
+	sec, err := strconv.ParseUint(val.String(), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(sec) * time.Second, true
+}
+
+func paramQ(params sip.Params) float32 {
+	if params != nil {
+		if val, ok := params.Get("q"); ok && val != nil {
+			if q, err := strconv.ParseFloat(val.String(), 32); err == nil && q >= 0 && q <= 1 {
+				return float32(q)
+			}
+		}
+	}
+
+	return 1
+}
+
+func newResponse(req sip.Request, code sip.StatusCode, reason string) sip.Response {
+	res := sip.NewResponseFromRequest("", req, code, reason, "")
+	if to, ok := res.To(); ok {
+		if to.Params == nil || !to.Params.Has("tag") {
+			to := to.Clone().(*sip.ToHeader)
+			if to.Params == nil {
+				to.Params = sip.NewParams()
+			}
+			to.Params.Add("tag", sip.String{Str: util.RandString(8)})
+			res.ReplaceHeaders("To", []sip.Header{to})
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,170 @@
+package registrar_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/registrar"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+func register(cseq int, callID string, headers ...string) sip.Request {
+	lines := []string{
+		"REGISTER sip:example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+		"From: <sip:alice@example.com>;tag=reg-tag",
+		"To: <sip:alice@example.com>",
+		"Call-ID: " + callID,
+		fmt.Sprintf("CSeq: %d REGISTER", cseq),
+	}
+	lines = append(lines, headers...)
+	lines = append(lines, "", "")
+
+	return testutils.Request(lines)
+}
+
+var _ = Describe("Registrar", func() {
+	var r registrar.Registrar
+	aor := &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"}
+
+	BeforeEach(func() {
+		r = registrar.NewRegistrar(registrar.Config{
+			Domains: []string{"example.com"},
+		}, testutils.NewLogrusLogger())
+	})
+
+	It("should add bindings and list them in 200 OK", func() {
+		res := r.HandleRegister(register(1, "call-1",
+			"Contact: <sip:alice@10.0.0.1>;q=0.5",
+			"Contact: <sip:alice@10.0.0.2>;expires=120;q=0.9",
+			"Expires: 600",
+		))
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		contacts := res.GetHeaders("Contact")
+		Expect(contacts).To(HaveLen(2))
+		Expect(contacts[0].Value()).To(ContainSubstring("expires=600"))
+		Expect(contacts[1].Value()).To(ContainSubstring("expires=120"))
+		to, _ := res.To()
+		Expect(to.Params.Has("tag")).To(BeTrue())
+
+		bindings, err := r.Lookup(aor)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings).To(HaveLen(2))
+		Expect(bindings[0].Contact.Address.String()).To(Equal("sip:alice@10.0.0.2"))
+		Expect(bindings[0].Q).To(BeNumerically("~", 0.9, 0.001))
+	})
+
+	It("should return current bindings on query", func() {
+		r.HandleRegister(register(1, "call-1", "Contact: <sip:alice@10.0.0.1>"))
+		res := r.HandleRegister(register(1, "call-2"))
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(res.GetHeaders("Contact")).To(HaveLen(1))
+	})
+
+	It("should reject too brief interval", func() {
+		res := r.HandleRegister(register(1, "call-1", "Contact: <sip:alice@10.0.0.1>", "Expires: 10"))
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(423)))
+		Expect(res.GetHeaders("Min-Expires")[0].Value()).To(Equal("60"))
+	})
+
+	It("should reject out of order requests", func() {
+		r.HandleRegister(register(5, "call-1", "Contact: <sip:alice@10.0.0.1>"))
+		res := r.HandleRegister(register(4, "call-1", "Contact: <sip:alice@10.0.0.1>"))
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(500)))
+	})
+
+	It("should remove bindings", func() {
+		r.HandleRegister(register(1, "call-1", "Contact: <sip:alice@10.0.0.1>", "Contact: <sip:alice@10.0.0.2>"))
+
+		res := r.HandleRegister(register(2, "call-1", "Contact: <sip:alice@10.0.0.1>;expires=0"))
+		Expect(res.GetHeaders("Contact")).To(HaveLen(1))
+
+		res = r.HandleRegister(register(3, "call-1", "Contact: *"))
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(400)))
+
+		res = r.HandleRegister(register(3, "call-1", "Contact: *", "Expires: 0"))
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(res.GetHeaders("Contact")).To(BeEmpty())
+
+		bindings, err := r.Lookup(aor)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bindings).To(BeEmpty())
+	})
+
+	It("should reject foreign domains", func() {
+		req := testutils.Request([]string{
+			"REGISTER sip:other.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@other.com>;tag=reg-tag",
+			"To: <sip:alice@other.com>",
+			"Call-ID: call-1",
+			"CSeq: 1 REGISTER",
+			"Contact: <sip:alice@10.0.0.1>",
+			"",
+			"",
+		})
+		Expect(r.HandleRegister(req).StatusCode()).To(Equal(sip.StatusCode(404)))
+	})
+
+	Context("with bindings expired", func() {
+		var (
+			clock timing.FakeClock
+			bus   eventbus.Bus
+			store registrar.LocationStore
+			mu    sync.Mutex
+			calls []string
+		)
+
+		BeforeEach(func() {
+			clock = timing.NewFakeClock(time.Now())
+			timing.SetClock(clock)
+			bus = eventbus.NewBus()
+			store = registrar.NewMemoryStore()
+			calls = nil
+			bus.Subscribe(func(ev eventbus.Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls = append(calls, ev.(*eventbus.RegistrationExpiredEvent).CallID)
+			}, eventbus.RegistrationExpired)
+			r = registrar.NewRegistrar(registrar.Config{
+				Domains:  []string{"example.com"},
+				Store:    store,
+				EventBus: bus,
+			}, testutils.NewLogrusLogger())
+		})
+
+		AfterEach(func() {
+			timing.SetClock(nil)
+		})
+
+		expired := func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), calls...)
+		}
+
+		It("should remove them from the store on timer and publish to the bus", func() {
+			r.HandleRegister(register(1, "call-1", "Contact: <sip:alice@10.0.0.1>;expires=60"))
+			r.HandleRegister(register(1, "call-2", "Contact: <sip:alice@10.0.0.2>;expires=120"))
+
+			clock.Advance(61 * time.Second)
+			Eventually(expired).Should(Equal([]string{"call-1"}))
+			Eventually(func() int {
+				bindings, _ := store.Get("sip:alice@example.com")
+				return len(bindings)
+			}).Should(Equal(1))
+
+			clock.Advance(60 * time.Second)
+			Eventually(expired).Should(Equal([]string{"call-1", "call-2"}))
+			Eventually(store.AORs).Should(BeEmpty())
+			Consistently(expired, 50*time.Millisecond).Should(HaveLen(2))
+		})
+	})
+})
@@ -0,0 +1,108 @@
+package registrar
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Binding is a Contact address bound to the address-of-record - RFC 3261 10.3.
+type Binding struct {
+	Contact *sip.ContactHeader
+	CallID  string
+	CSeq    uint32
+	// Expires is an absolute expiration time of the binding.
+	Expires time.Time
+	// Q is a binding preference from the 'q' Contact param, default is 1.
+	Q float32
+}
+
+func (b *Binding) Clone() *Binding {
+	if b == nil {
+		return nil
+	}
+
+	clone := *b
+	if b.Contact != nil {
+		clone.Contact = b.Contact.Clone().(*sip.ContactHeader)
+	}
+
+	return &clone
+}
+
+// IsExpired checks the binding expiration relative to the provided time.
+func (b *Binding) IsExpired(now time.Time) bool {
+	return !now.Before(b.Expires)
+}
+
+// ErrConflict is returned by LocationStore.Set of shared stores when bindings of the AOR
+// were changed by another node since Get, the registrar retries the update.
+var ErrConflict = errors.New("bindings were changed concurrently")
+
+// LocationStore is a location service backend that keeps bindings of AORs.
+// Implementations should be safe for concurrent use.
+type LocationStore interface {
+	// Get returns all stored bindings of the AOR, expired bindings can be included.
+	Get(aor string) ([]*Binding, error)
+	// Set replaces all bindings of the AOR, empty bindings list removes the AOR.
+	// Shared stores return ErrConflict if the bindings were changed since the last Get of the AOR.
+	Set(aor string, bindings []*Binding) error
+	// AORs returns all stored AORs.
+	AORs() ([]string, error)
+}
+
+type memoryStore struct {
+	mu       sync.RWMutex
+	bindings map[string][]*Binding
+}
+
+// NewMemoryStore creates in-memory location store.
+func NewMemoryStore() LocationStore {
+	return &memoryStore{
+		bindings: make(map[string][]*Binding),
+	}
+}
+
+func (store *memoryStore) Get(aor string) ([]*Binding, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	bindings := make([]*Binding, 0, len(store.bindings[aor]))
+	for _, binding := range store.bindings[aor] {
+		bindings = append(bindings, binding.Clone())
+	}
+
+	return bindings, nil
+}
+
+func (store *memoryStore) Set(aor string, bindings []*Binding) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if len(bindings) == 0 {
+		delete(store.bindings, aor)
+		return nil
+	}
+
+	stored := make([]*Binding, 0, len(bindings))
+	for _, binding := range bindings {
+		stored = append(stored, binding.Clone())
+	}
+	store.bindings[aor] = stored
+
+	return nil
+}
+
+func (store *memoryStore) AORs() ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	aors := make([]string, 0, len(store.bindings))
+	for aor := range store.bindings {
+		aors = append(aors, aor)
+	}
+
+	return aors, nil
+}
@@ -0,0 +1,501 @@
+// registration package implements SIP registration client - RFC 3261 10.
+package registration
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	DefaultExpires       = time.Hour
+	DefaultRefreshBefore = 30 * time.Second
+	DefaultRetryInterval = 30 * time.Second
+)
+
+type State int
+
+const (
+	Unregistered State = iota
+	Registering
+	Registered
+	Unregistering
+	Failed
+)
+
+func (state State) String() string {
+	switch state {
+	case Unregistered:
+		return "Unregistered"
+	case Registering:
+		return "Registering"
+	case Registered:
+		return "Registered"
+	case Unregistering:
+		return "Unregistering"
+	case Failed:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+// StateChange describes registration state transition.
+type StateChange struct {
+	Previous State
+	State    State
+	// Bindings are all Contact bindings of the AOR returned by the registrar.
+	Bindings []*sip.ContactHeader
+	// Expires is the granted expiration interval of the client binding.
+	Expires time.Duration
+	// Err is the reason of the Failed state.
+	Err error
+	// Response is the registrar response that caused the transition, nil if there is none.
+	Response sip.Response
+}
+
+// Config describes registration client options.
+type Config struct {
+	// Registrar is a Request-URI of REGISTER requests.
+	Registrar sip.Uri
+	// AOR is an address-of-record used in To and From headers.
+	AOR *sip.Address
+	// Contact is a binding to register.
+	Contact *sip.ContactHeader
+	// Expires is a requested expiration interval, default is DefaultExpires.
+	Expires time.Duration
+	// RefreshBefore defines how long before expiry the binding is refreshed, default is DefaultRefreshBefore.
+	// Short registrations are refreshed at the middle of the interval.
+	RefreshBefore time.Duration
+	// RetryInterval is a delay before re-registration after failure, default is DefaultRetryInterval.
+	RetryInterval time.Duration
+	// Authorizer answers 401/407 challenges.
+	Authorizer sip.Authorizer
+	// Headers are appended to each REGISTER request.
+	Headers []sip.Header
+	// OnStateChange is called on each registration state transition.
+	OnStateChange func(change StateChange)
+	// KeepAlive enables keep-alives of the registration over UDP, nil disables them.
+	KeepAlive *KeepAliveConfig
+}
+
+// Client maintains registration of the single Contact binding.
+type Client interface {
+	// Register sends REGISTER and waits for the result.
+	// On success the binding is automatically refreshed before expiry,
+	// on failure the registration is retried after RetryInterval.
+	Register(ctx context.Context) error
+	// Unregister removes the binding and stops refreshing.
+	Unregister(ctx context.Context) error
+	// FlowFailed notifies the client that transport flow to the registrar is broken,
+	// the client immediately re-registers if it was registered.
+	FlowFailed()
+	// Stop cancels scheduled refreshes without unregistering.
+	Stop()
+	State() State
+	Bindings() []*sip.ContactHeader
+	Expires() time.Duration
+}
+
+type client struct {
+	requester gosip.Requester
+	config    Config
+	callID    sip.CallID
+	fromTag   string
+
+	mu       sync.Mutex
+	seqNo    uint32
+	state    State
+	expires  time.Duration
+	bindings []*sip.ContactHeader
+	timer    timing.Timer
+	active   bool
+	// minExpires is the lower bound of the expiration interval received in 423 response.
+	minExpires time.Duration
+
+	keepAliveTimer  timing.Timer
+	keepAlivePaused bool
+
+	log log.Logger
+}
+
+// NewClient creates registration client.
+func NewClient(requester gosip.Requester, config Config, logger log.Logger) Client {
+	if config.Expires <= 0 {
+		config.Expires = DefaultExpires
+	}
+	if config.RefreshBefore <= 0 {
+		config.RefreshBefore = DefaultRefreshBefore
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = DefaultRetryInterval
+	}
+	if config.KeepAlive != nil {
+		keepAlive := *config.KeepAlive
+		if keepAlive.Interval <= 0 {
+			keepAlive.Interval = DefaultKeepAliveInterval
+		}
+		if keepAlive.Jitter <= 0 || keepAlive.Jitter >= 1 {
+			keepAlive.Jitter = DefaultKeepAliveJitter
+		}
+		if keepAlive.KeepAliver == nil {
+			keepAlive.KeepAliver = OptionsKeepAliver(requester, config.AOR)
+		}
+		config.KeepAlive = &keepAlive
+	}
+
+	c := &client{
+		requester: requester,
+		config:    config,
+		callID:    sip.CallID(util.RandString(32)),
+		fromTag:   util.RandString(8),
+	}
+	c.log = logger.
+		WithPrefix("registration.Client").
+		WithFields(log.Fields{
+			"registration_ptr": fmt.Sprintf("%p", c),
+		})
+
+	return c
+}
+
+func (c *client) Log() log.Logger {
+	return c.log
+}
+
+func (c *client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+func (c *client) Bindings() []*sip.ContactHeader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bindings := make([]*sip.ContactHeader, 0, len(c.bindings))
+	for _, binding := range c.bindings {
+		bindings = append(bindings, binding.Clone().(*sip.ContactHeader))
+	}
+
+	return bindings
+}
+
+func (c *client) Expires() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.expires
+}
+
+func (c *client) Register(ctx context.Context) error {
+	c.mu.Lock()
+	c.active = true
+	c.stopTimer()
+	c.mu.Unlock()
+
+	return c.register(ctx)
+}
+
+func (c *client) Unregister(ctx context.Context) error {
+	c.mu.Lock()
+	c.active = false
+	c.stopTimer()
+	c.mu.Unlock()
+
+	c.setState(Unregistering, nil, 0, nil, nil)
+
+	res, err := c.send(ctx, 0)
+	if err != nil {
+		c.setState(Failed, nil, 0, err, nil)
+
+		return err
+	}
+
+	c.setState(Unregistered, contactHeaders(res), 0, nil, res)
+
+	return nil
+}
+
+func (c *client) FlowFailed() {
+	c.mu.Lock()
+	if !c.active {
+		c.mu.Unlock()
+		return
+	}
+	c.stopTimer()
+	c.mu.Unlock()
+
+	c.Log().Debug("transport flow failed, re-registering")
+
+	go func() {
+		_ = c.register(context.Background())
+	}()
+}
+
+func (c *client) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active = false
+	c.stopTimer()
+}
+
+func (c *client) register(ctx context.Context) error {
+	c.setState(Registering, nil, 0, nil, nil)
+
+	c.mu.Lock()
+	expires := c.config.Expires
+	if expires < c.minExpires {
+		expires = c.minExpires
+	}
+	c.mu.Unlock()
+
+	res, err := c.send(ctx, expires)
+	// RFC 3261 10.2.8. 423 Interval Too Brief, retry with Min-Expires
+	if reqErr, ok := err.(*sip.RequestError); ok && reqErr.Code == 423 && reqErr.Response != nil {
+		if minExpires, ok := parseMinExpires(reqErr.Response); ok && minExpires > expires {
+			c.mu.Lock()
+			c.minExpires = minExpires
+			c.mu.Unlock()
+
+			c.Log().Debugf("registrar requires min expires %s", minExpires)
+
+			expires = minExpires
+			res, err = c.send(ctx, expires)
+		}
+	}
+	if err != nil {
+		c.setState(Failed, nil, 0, err, nil)
+		c.schedule(c.config.RetryInterval)
+
+		return err
+	}
+
+	granted := c.grantedExpires(res, expires)
+	if granted <= 0 {
+		err = fmt.Errorf("registrar did not keep the binding %s", c.config.Contact.Address)
+		c.setState(Failed, contactHeaders(res), 0, err, res)
+		c.schedule(c.config.RetryInterval)
+
+		return err
+	}
+
+	c.setState(Registered, contactHeaders(res), granted, nil, res)
+	c.schedule(c.refreshDelay(granted))
+	c.scheduleKeepAlive(res)
+
+	return nil
+}
+
+func (c *client) send(ctx context.Context, expires time.Duration) (sip.Response, error) {
+	req := c.newRequest(expires)
+
+	options := make([]gosip.RequestWithContextOption, 0)
+	if c.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(c.config.Authorizer))
+	}
+
+	res, err := c.requester.RequestWithContext(ctx, req, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	// authorizer increments CSeq of the request
+	if cseq, ok := res.CSeq(); ok {
+		c.mu.Lock()
+		if cseq.SeqNo > c.seqNo {
+			c.seqNo = cseq.SeqNo
+		}
+		c.mu.Unlock()
+	}
+
+	return res, nil
+}
+
+// RFC 3261 10.2. All REGISTER requests of the client share the same Call-ID and increment CSeq.
+func (c *client) newRequest(expires time.Duration) sip.Request {
+	c.mu.Lock()
+	c.seqNo++
+	seqNo := c.seqNo
+	c.mu.Unlock()
+
+	to := c.config.AOR.AsToHeader()
+	to.Params = sip.NewParams()
+	from := c.config.AOR.AsFromHeader()
+	from.Params = sip.NewParams().Add("tag", sip.String{Str: c.fromTag})
+	contact := c.config.Contact.Clone().(*sip.ContactHeader)
+	expiresHdr := sip.Expires(uint32(expires / time.Second))
+	maxForwards := sip.MaxForwards(70)
+	callID := c.callID
+
+	hdrs := []sip.Header{
+		sip.ViaHeader{
+			&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       sip.DefaultProtocol,
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			},
+		},
+		&maxForwards,
+		from,
+		to,
+		&callID,
+		&sip.CSeq{SeqNo: seqNo, MethodName: sip.REGISTER},
+		contact,
+		&expiresHdr,
+	}
+	for _, hdr := range c.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	return sip.NewRequest(
+		"",
+		sip.REGISTER,
+		c.config.Registrar.Clone(),
+		"SIP/2.0",
+		hdrs,
+		"",
+		log.Fields{
+			"registration_ptr": fmt.Sprintf("%p", c),
+		},
+	)
+}
+
+// RFC 3261 10.2.4. Expiration interval of the binding is taken from the matching Contact
+// 'expires' param, Expires header or the requested value.
+func (c *client) grantedExpires(res sip.Response, requested time.Duration) time.Duration {
+	for _, hdr := range res.GetHeaders("Contact") {
+		contact, ok := hdr.(*sip.ContactHeader)
+		if !ok || contact.Address == nil || !c.config.Contact.Address.Equals(contact.Address) {
+			continue
+		}
+		if contact.Params != nil {
+			if val, ok := contact.Params.Get("expires"); ok && val != nil {
+				if sec, err := strconv.ParseUint(val.String(), 10, 32); err == nil {
+					return time.Duration(sec) * time.Second
+				}
+			}
+		}
+
+		return responseExpires(res, requested)
+	}
+
+	if len(res.GetHeaders("Contact")) > 0 {
+		// registrar returned bindings without our contact
+		return 0
+	}
+
+	return responseExpires(res, requested)
+}
+
+func (c *client) refreshDelay(expires time.Duration) time.Duration {
+	if expires <= 2*c.config.RefreshBefore {
+		return expires / 2
+	}
+
+	return expires - c.config.RefreshBefore
+}
+
+func (c *client) schedule(delay time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active {
+		return
+	}
+
+	c.stopTimer()
+	c.timer = timing.AfterFunc(delay, func() {
+		c.mu.Lock()
+		active := c.active
+		c.mu.Unlock()
+
+		if active {
+			_ = c.register(context.Background())
+		}
+	})
+}
+
+// should be called under lock
+func (c *client) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.stopKeepAlive()
+}
+
+func (c *client) setState(state State, bindings []*sip.ContactHeader, expires time.Duration, err error, res sip.Response) {
+	c.mu.Lock()
+	prev := c.state
+	c.state = state
+	if state != Registering && state != Unregistering {
+		c.bindings = bindings
+		c.expires = expires
+	}
+	c.mu.Unlock()
+
+	if prev == state && err == nil {
+		return
+	}
+
+	c.Log().Debugf("registration state changed %s -> %s", prev, state)
+
+	if c.config.OnStateChange != nil {
+		c.config.OnStateChange(StateChange{
+			Previous: prev,
+			State:    state,
+			Bindings: bindings,
+			Expires:  expires,
+			Err:      err,
+			Response: res,
+		})
+	}
+}
+
+func responseExpires(res sip.Response, requested time.Duration) time.Duration {
+	if hdrs := res.GetHeaders("Expires"); len(hdrs) > 0 {
+		if expires, ok := hdrs[0].(*sip.Expires); ok {
+			return time.Duration(*expires) * time.Second
+		}
+	}
+
+	return requested
+}
+
+func parseMinExpires(res sip.Response) (time.Duration, bool) {
+	hdrs := res.GetHeaders("Min-Expires")
+	if len(hdrs) == 0 {
+		return 0, false
+	}
+
+	sec, err := strconv.ParseUint(strings.TrimSpace(hdrs[0].Value()), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(sec) * time.Second, true
+}
+
+func contactHeaders(res sip.Response) []*sip.ContactHeader {
+	contacts := make([]*sip.ContactHeader, 0)
+	for _, hdr := range res.GetHeaders("Contact") {
+		if contact, ok := hdr.(*sip.ContactHeader); ok {
+			contacts = append(contacts, contact.Clone().(*sip.ContactHeader))
+		}
+	}
+
+	return contacts
+}
@@ -0,0 +1,230 @@
+package registration_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/registration"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+func okResponse(req sip.Request, contacts ...string) sip.Response {
+	res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+	for _, contact := range contacts {
+		res.AppendHeader(testutils.Response([]string{
+			"SIP/2.0 200 OK",
+			"Contact: " + contact,
+			"",
+			"",
+		}).GetHeaders("Contact")[0])
+	}
+	return res
+}
+
+var _ = Describe("Registration Client", func() {
+	var (
+		requester *testutils.MockRequester
+		config    registration.Config
+		changes   chan registration.StateChange
+	)
+
+	BeforeEach(func() {
+		requester = testutils.NewMockRequester(nil)
+		changes = make(chan registration.StateChange, 100)
+		// registrations in flight may outlive the spec, so they must not read the variable of the next one
+		stateChanges := changes
+		config = registration.Config{
+			Registrar: &sip.SipUri{FHost: "example.com"},
+			AOR: &sip.Address{
+				Uri: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "example.com"},
+			},
+			Contact: &sip.ContactHeader{
+				Address: &sip.SipUri{FUser: sip.String{Str: "alice"}, FHost: "10.0.0.1"},
+			},
+			RetryInterval: 50 * time.Millisecond,
+			OnStateChange: func(change registration.StateChange) {
+				stateChanges <- change
+			},
+		}
+	})
+
+	It("should register and parse granted expires of the binding", func() {
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			return okResponse(req, "<sip:alice@10.0.0.1>;expires=120", "<sip:alice@10.0.0.2>;expires=3600"), nil
+		})
+		c := registration.NewClient(requester, config, testutils.NewLogrusLogger())
+		defer c.Stop()
+
+		Expect(c.Register(context.Background())).To(Succeed())
+		Expect(c.State()).To(Equal(registration.Registered))
+		Expect(c.Expires()).To(Equal(120 * time.Second))
+		Expect(c.Bindings()).To(HaveLen(2))
+
+		req := requester.Requests()[0]
+		Expect(req.Method()).To(Equal(sip.REGISTER))
+		expires := req.GetHeaders("Expires")
+		Expect(expires[0].Value()).To(Equal("3600"))
+
+		Expect((<-changes).State).To(Equal(registration.Registering))
+		Expect((<-changes).State).To(Equal(registration.Registered))
+	})
+
+	It("should retry with Min-Expires on 423", func() {
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			expires := req.GetHeaders("Expires")[0].Value()
+			if expires == "60" {
+				res := sip.NewResponseFromRequest("", req, 423, "Interval Too Brief", "")
+				res.AppendHeader(&sip.GenericHeader{HeaderName: "Min-Expires", Contents: "300"})
+				return nil, sip.NewRequestError(423, "Interval Too Brief", req, res)
+			}
+			return okResponse(req, "<sip:alice@10.0.0.1>;expires="+expires), nil
+		})
+		config.Expires = time.Minute
+		c := registration.NewClient(requester, config, testutils.NewLogrusLogger())
+		defer c.Stop()
+
+		Expect(c.Register(context.Background())).To(Succeed())
+		Expect(c.Expires()).To(Equal(300 * time.Second))
+
+		reqs := requester.Requests()
+		Expect(reqs).To(HaveLen(2))
+		cseq1, _ := reqs[0].CSeq()
+		cseq2, _ := reqs[1].CSeq()
+		Expect(cseq2.SeqNo).To(Equal(cseq1.SeqNo + 1))
+		callID1, _ := reqs[0].CallID()
+		callID2, _ := reqs[1].CallID()
+		Expect(callID2.Value()).To(Equal(callID1.Value()))
+	})
+
+	It("should refresh binding before expiry", func() {
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			return okResponse(req, "<sip:alice@10.0.0.1>;expires=1"), nil
+		})
+		c := registration.NewClient(requester, config, testutils.NewLogrusLogger())
+		defer c.Stop()
+
+		Expect(c.Register(context.Background())).To(Succeed())
+		Eventually(func() int { return len(requester.Requests()) }, 2*time.Second).Should(BeNumerically(">=", 2))
+	})
+
+	It("should retry registration after failure", func() {
+		var failed bool
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			if !failed {
+				failed = true
+				return nil, sip.NewRequestError(503, "Service Unavailable", req, nil)
+			}
+			return okResponse(req, "<sip:alice@10.0.0.1>;expires=3600"), nil
+		})
+		c := registration.NewClient(requester, config, testutils.NewLogrusLogger())
+		defer c.Stop()
+
+		Expect(c.Register(context.Background())).ToNot(Succeed())
+		Expect(c.State()).To(Equal(registration.Failed))
+		Eventually(c.State, time.Second).Should(Equal(registration.Registered))
+	})
+
+	It("should re-register on flow failure and unregister", func() {
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			return okResponse(req, "<sip:alice@10.0.0.1>;expires="+req.GetHeaders("Expires")[0].Value()), nil
+		})
+		c := registration.NewClient(requester, config, testutils.NewLogrusLogger())
+
+		Expect(c.Register(context.Background())).To(Succeed())
+		c.FlowFailed()
+		Eventually(func() int { return len(requester.Requests()) }, time.Second).Should(Equal(2))
+		Eventually(c.State, time.Second).Should(Equal(registration.Registered))
+
+		Expect(c.Unregister(context.Background())).To(Succeed())
+		Expect(c.State()).To(Equal(registration.Unregistered))
+		reqs := requester.Requests()
+		Expect(reqs[len(reqs)-1].GetHeaders("Expires")[0].Value()).To(Equal("0"))
+	})
+
+	It("should send keep-alives over UDP and pause them over TCP", func() {
+		var (
+			mu        sync.Mutex
+			transport = "UDP"
+		)
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			if req.Method() == sip.OPTIONS {
+				return sip.NewResponseFromRequest("", req, 200, "OK", ""), nil
+			}
+			res := okResponse(req, "<sip:alice@10.0.0.1>;expires=3600")
+			mu.Lock()
+			res.SetTransport(transport)
+			mu.Unlock()
+			return res, nil
+		})
+		options := func() int {
+			count := 0
+			for _, req := range requester.Requests() {
+				if req.Method() == sip.OPTIONS {
+					count++
+				}
+			}
+			return count
+		}
+		config.KeepAlive = &registration.KeepAliveConfig{Interval: 20 * time.Millisecond}
+		c := registration.NewClient(requester, config, testutils.NewLogrusLogger())
+		defer c.Stop()
+
+		Expect(c.Register(context.Background())).To(Succeed())
+		Eventually(options, time.Second).Should(BeNumerically(">=", 2))
+
+		mu.Lock()
+		transport = "TCP"
+		mu.Unlock()
+		Expect(c.Register(context.Background())).To(Succeed())
+		sent := options()
+		Consistently(options, 100*time.Millisecond).Should(BeNumerically("<=", sent+1))
+	})
+
+	It("should re-register when keep-alive fails", func() {
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			return okResponse(req, "<sip:alice@10.0.0.1>;expires=3600"), nil
+		})
+		var keepAlives int32
+		config.KeepAlive = &registration.KeepAliveConfig{
+			Interval: 20 * time.Millisecond,
+			KeepAliver: registration.KeepAliverFunc(func(ctx context.Context, target sip.Uri) error {
+				Expect(target.Host()).To(Equal("example.com"))
+				atomic.AddInt32(&keepAlives, 1)
+				return fmt.Errorf("flow is broken")
+			}),
+		}
+		c := registration.NewClient(requester, config, testutils.NewLogrusLogger())
+		defer c.Stop()
+
+		Expect(c.Register(context.Background())).To(Succeed())
+		Eventually(func() int { return len(requester.Requests()) }, time.Second).Should(BeNumerically(">=", 2))
+		Expect(atomic.LoadInt32(&keepAlives)).To(BeNumerically(">=", 1))
+	})
+
+	It("should re-register when the connection to the registrar is reconnected", func() {
+		requester.SetRespond(func(req sip.Request) (sip.Response, error) {
+			return okResponse(req, "<sip:alice@10.0.0.1>;expires=3600"), nil
+		})
+		c := registration.NewClient(requester, config, testutils.NewLogrusLogger())
+		defer c.Stop()
+		bus := eventbus.NewBus()
+		cancel := registration.RefreshOnReconnect(bus, c, "wss", "192.0.2.1:443")
+		defer cancel()
+
+		Expect(c.Register(context.Background())).To(Succeed())
+		bus.Publish(&eventbus.ConnectionReconnectedEvent{Network: "wss", RemoteAddr: "192.0.2.2:443"})
+		eventbus.Default.Publish(&eventbus.ConnectionReconnectedEvent{Network: "wss", RemoteAddr: "192.0.2.1:443"})
+		Consistently(func() int { return len(requester.Requests()) }, 100*time.Millisecond).Should(Equal(1))
+
+		bus.Publish(&eventbus.ConnectionReconnectedEvent{Network: "wss", RemoteAddr: "192.0.2.1:443"})
+		Eventually(func() int { return len(requester.Requests()) }, time.Second).Should(Equal(2))
+	})
+})
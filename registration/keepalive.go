@@ -0,0 +1,160 @@
+package registration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	// DefaultKeepAliveInterval is shorter than UDP binding timeouts of common NATs.
+	DefaultKeepAliveInterval = 30 * time.Second
+	// DefaultKeepAliveJitter sends keep-alives between 80 and 100 percent of the interval like RFC 5626 4.4.1.
+	DefaultKeepAliveJitter = 0.2
+)
+
+// KeepAliver sends keep-alive to the registrar over the flow of the registration.
+type KeepAliver interface {
+	// KeepAlive returns error if the flow is broken.
+	KeepAlive(ctx context.Context, target sip.Uri) error
+}
+
+// KeepAliverFunc is an adapter to use ordinary function as KeepAliver.
+type KeepAliverFunc func(ctx context.Context, target sip.Uri) error
+
+func (f KeepAliverFunc) KeepAlive(ctx context.Context, target sip.Uri) error {
+	return f(ctx, target)
+}
+
+// KeepAliveConfig describes keep-alives that refresh NAT bindings of the registration over UDP.
+// Keep-alives are sent only while the client is registered and are paused while the registrar
+// is reached over reliable transport, like TCP, which keeps the connection by itself.
+type KeepAliveConfig struct {
+	// Interval between keep-alives, default is DefaultKeepAliveInterval.
+	Interval time.Duration
+	// Jitter is a fraction of the interval randomly subtracted from each delay, so keep-alives
+	// of many clients behind the same NAT are spread, default is DefaultKeepAliveJitter.
+	Jitter float64
+	// KeepAliver sends keep-alives, default is OptionsKeepAliver from the AOR.
+	KeepAliver KeepAliver
+}
+
+// OptionsKeepAliver sends OPTIONS to the registrar, any response means the flow is alive.
+func OptionsKeepAliver(requester gosip.Requester, from *sip.Address) KeepAliver {
+	return KeepAliverFunc(func(ctx context.Context, target sip.Uri) error {
+		fromHdr := from.AsFromHeader()
+		fromHdr.Params = sip.NewParams().Add("tag", sip.String{Str: util.RandString(8)})
+		callID := sip.CallID(util.RandString(32))
+		maxForwards := sip.MaxForwards(70)
+
+		req := sip.NewRequest(
+			"",
+			sip.OPTIONS,
+			target.Clone(),
+			"SIP/2.0",
+			[]sip.Header{
+				sip.ViaHeader{
+					&sip.ViaHop{
+						ProtocolName:    "SIP",
+						ProtocolVersion: "2.0",
+						Transport:       sip.DefaultProtocol,
+						Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+					},
+				},
+				&maxForwards,
+				fromHdr,
+				&sip.ToHeader{Address: target.Clone()},
+				&callID,
+				&sip.CSeq{SeqNo: 1, MethodName: sip.OPTIONS},
+			},
+			"",
+			nil,
+		)
+
+		_, err := requester.RequestWithContext(ctx, req)
+		var reqErr *sip.RequestError
+		if errors.As(err, &reqErr) && reqErr.Response != nil {
+			return nil
+		}
+
+		return err
+	})
+}
+
+// CRLFKeepAliver sends double CRLF to the registrar - RFC 5626 3.5.1.
+// The transport layer does not expose raw writes, so write must send data from the socket
+// the registration is sent from, otherwise the NAT binding of the registration is not refreshed.
+func CRLFKeepAliver(write func(ctx context.Context, addr string, data []byte) error) KeepAliver {
+	return KeepAliverFunc(func(ctx context.Context, target sip.Uri) error {
+		port := sip.DefaultPort("UDP")
+		if target.Port() != nil {
+			port = *target.Port()
+		}
+
+		return write(ctx, fmt.Sprintf("%s:%d", target.Host(), port), []byte("\r\n\r\n"))
+	})
+}
+
+// scheduleKeepAlive starts keep-alives of the registration, keep-alives are paused
+// if the registrar response is received over reliable transport.
+func (c *client) scheduleKeepAlive(res sip.Response) {
+	if c.config.KeepAlive == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if res != nil {
+		c.keepAlivePaused = res.Transport() != "UDP"
+	}
+	c.stopKeepAlive()
+	if !c.active || c.keepAlivePaused || c.state != Registered {
+		return
+	}
+
+	c.keepAliveTimer = timing.AfterFunc(keepAliveDelay(c.config.KeepAlive), c.keepAlive)
+}
+
+func (c *client) keepAlive() {
+	c.mu.Lock()
+	active := c.active && c.state == Registered
+	c.mu.Unlock()
+	if !active {
+		return
+	}
+
+	if err := c.config.KeepAlive.KeepAliver.KeepAlive(context.Background(), c.config.Registrar); err != nil {
+		c.Log().Debugf("keep-alive failed, re-registering: %s", err)
+		c.FlowFailed()
+
+		return
+	}
+
+	c.scheduleKeepAlive(nil)
+}
+
+// should be called under lock
+func (c *client) stopKeepAlive() {
+	if c.keepAliveTimer != nil {
+		c.keepAliveTimer.Stop()
+		c.keepAliveTimer = nil
+	}
+}
+
+// keepAliveDelay returns random value between (1 - Jitter) and 100 percent of the interval.
+func keepAliveDelay(config *KeepAliveConfig) time.Duration {
+	jitter := time.Duration(float64(config.Interval) * config.Jitter)
+	if jitter <= 0 {
+		return config.Interval
+	}
+
+	return config.Interval - jitter + time.Duration(rand.Int63n(int64(jitter)+1))
+}
@@ -0,0 +1,25 @@
+package registration
+
+import (
+	"strings"
+
+	"github.com/ghettovoice/gosip/eventbus"
+)
+
+// RefreshOnReconnect re-registers the client each time the transport re-establishes the connection to the registrar,
+// like WebSocket connections of transport.WsClientConfig with Reconnect, so the registrar binds the new flow.
+// The remote address is the resolved IP and port of the registrar, e.g. "192.0.2.1:443".
+// The bus is the event bus of the server that owns the transport, nil means eventbus.Default.
+// Returned function cancels the refreshing.
+func RefreshOnReconnect(bus eventbus.Bus, client Client, network string, remoteAddr string) func() {
+	if bus == nil {
+		bus = eventbus.Default
+	}
+
+	return bus.Subscribe(func(ev eventbus.Event) {
+		if ev, ok := ev.(*eventbus.ConnectionReconnectedEvent); ok &&
+			strings.EqualFold(ev.Network, network) && ev.RemoteAddr == remoteAddr {
+			client.FlowFailed()
+		}
+	}, eventbus.ConnectionReconnected)
+}
@@ -0,0 +1,175 @@
+package gosip
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghettovoice/gosip/transaction"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// ReloadConfig is a desired configuration of the running server applied by Server.Reload.
+// The server diffs it with the current configuration and applies only changes,
+// so established connections, transactions and dialogs are not affected.
+type ReloadConfig struct {
+	// Listen is a full set of listen addresses: missing listeners are closed, new ones are started.
+	// Connections accepted by the closed listeners are kept until they are closed by peers or expired.
+	Listen []ListenAddr
+	// TLSConfig is a certificate of TLS and WSS listeners, they are restarted when it is changed
+	// or the certificate or key file is rewritten, like on rotation of the certificate in place.
+	TLSConfig *transport.TLSConfig
+	// ACL restricts sources of the incoming messages, nil allows all sources.
+	ACL *ACL
+	// Timers are base values of timers of new transactions, zero values are replaced by defaults.
+	Timers transaction.Timers
+}
+
+// listenEntry is a listener started by the server.
+type listenEntry struct {
+	network string
+	addr    string
+	options []transport.ListenOption
+	tls     *transport.TLSConfig
+	// tlsDigest is the hash of the certificate and key files read when the entry is created
+	tlsDigest [sha256.Size]byte
+}
+
+func newListenEntry(network, addr string, options []transport.ListenOption) *listenEntry {
+	entry := &listenEntry{
+		network: strings.ToLower(network),
+		addr:    addr,
+		options: options,
+	}
+	if target, err := transport.NewTargetFromAddr(addr); err == nil {
+		entry.addr = transport.FillTargetHostAndPort(network, target).Addr()
+	}
+	for _, option := range options {
+		switch option := option.(type) {
+		case transport.TLSConfig:
+			entry.tls = &option
+		case *transport.TLSConfig:
+			entry.tls = option
+		}
+	}
+	if entry.tls != nil {
+		entry.tlsDigest = tlsFilesDigest(entry.tls)
+	}
+
+	return entry
+}
+
+// tlsFilesDigest hashes content of the certificate and key files, unreadable files are hashed as empty,
+// the listener fails to load them anyway.
+func tlsFilesDigest(config *transport.TLSConfig) [sha256.Size]byte {
+	h := sha256.New()
+	for _, file := range []string{config.Cert, config.Key} {
+		data, _ := ioutil.ReadFile(file)
+		h.Write(data)
+		h.Write([]byte{0})
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+
+	return digest
+}
+
+func (entry *listenEntry) key() string {
+	return entry.network + " " + entry.addr
+}
+
+// equal checks that the listener does not need restart.
+func (entry *listenEntry) equal(other *listenEntry) bool {
+	if entry.key() != other.key() {
+		return false
+	}
+	if entry.tls == nil || other.tls == nil {
+		return entry.tls == other.tls
+	}
+
+	return *entry.tls == *other.tls && entry.tlsDigest == other.tlsDigest
+}
+
+// Reload applies the new configuration atomically: if any listener fails to start
+// all listener changes are rolled back and the previous configuration is kept.
+func (srv *server) Reload(config ReloadConfig) error {
+	if !srv.running.IsSet() {
+		return fmt.Errorf("can not reload stopped server")
+	}
+
+	acl, err := config.ACL.compile()
+	if err != nil {
+		return err
+	}
+
+	srv.lmu.Lock()
+	defer srv.lmu.Unlock()
+
+	wanted := make(map[string]*listenEntry, len(config.Listen))
+	wantedOrder := make([]*listenEntry, 0, len(config.Listen))
+	for _, addr := range config.Listen {
+		var options []transport.ListenOption
+		if config.TLSConfig != nil && isSecureNetwork(addr.Network) {
+			options = append(options, *config.TLSConfig)
+		}
+		entry := newListenEntry(addr.Network, addr.Addr, options)
+		if _, ok := wanted[entry.key()]; ok {
+			continue
+		}
+		wanted[entry.key()] = entry
+		wantedOrder = append(wantedOrder, entry)
+	}
+
+	current := make(map[string]*listenEntry, len(srv.listens))
+	var removed []*listenEntry
+	for _, entry := range srv.listens {
+		current[entry.key()] = entry
+		if other, ok := wanted[entry.key()]; !ok || !entry.equal(other) {
+			removed = append(removed, entry)
+		}
+	}
+	var added []*listenEntry
+	for _, entry := range wantedOrder {
+		if other, ok := current[entry.key()]; !ok || !entry.equal(other) {
+			added = append(added, entry)
+		}
+	}
+
+	var closed, opened []*listenEntry
+	rollback := func() {
+		for _, entry := range opened {
+			if err := srv.unlisten(entry); err != nil {
+				srv.Log().Errorf("rollback of %s %s listener failed: %s", entry.network, entry.addr, err)
+			}
+		}
+		for _, entry := range closed {
+			if err := srv.listen(entry); err != nil {
+				srv.Log().Errorf("rollback of %s %s listener failed: %s", entry.network, entry.addr, err)
+			}
+		}
+	}
+
+	for _, entry := range removed {
+		if err := srv.unlisten(entry); err != nil {
+			rollback()
+			return fmt.Errorf("stop listening on %s %s: %w", entry.network, entry.addr, err)
+		}
+		closed = append(closed, entry)
+	}
+	for _, entry := range added {
+		if err := srv.listen(entry); err != nil {
+			rollback()
+			return fmt.Errorf("listen on %s %s: %w", entry.network, entry.addr, err)
+		}
+		opened = append(opened, entry)
+	}
+
+	srv.acl.Store(acl)
+	srv.tx.SetTimers(config.Timers)
+
+	srv.Log().Infof("configuration reloaded: %d listeners stopped, %d listeners started", len(closed), len(opened))
+
+	return nil
+}
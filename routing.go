@@ -0,0 +1,134 @@
+package gosip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// ResponseRouting is the address responses to requests received over UDP are sent to.
+// Responses to requests received over stream transports are always sent over the same connection - RFC 3261 18.2.2.
+type ResponseRouting int
+
+const (
+	// RouteToReceived sends responses to the received address and the sent-by port of Via,
+	// or to the source port if Via has 'rport' - RFC 3261 18.2.2, RFC 3581.
+	RouteToReceived ResponseRouting = iota
+	// RouteToSentBy sends responses strictly to the sent-by address of Via, or to 'maddr',
+	// like legacy PBXes that send requests from the other address than they listen on expect.
+	RouteToSentBy
+	// RouteToSource sends responses to the address requests actually arrive from even without 'rport',
+	// like peers behind NAT that do not support RFC 3581 need.
+	RouteToSource
+)
+
+func (routing ResponseRouting) String() string {
+	switch routing {
+	case RouteToReceived:
+		return "received"
+	case RouteToSentBy:
+		return "sent-by"
+	case RouteToSource:
+		return "source"
+	default:
+		return fmt.Sprintf("ResponseRouting(%d)", int(routing))
+	}
+}
+
+// ResponseRoutingRule overrides routing of responses to peers.
+type ResponseRoutingRule struct {
+	// Peers lists networks of peers in CIDR notation or single IP addresses.
+	Peers   []string
+	Routing ResponseRouting
+}
+
+// ResponseRoutingConfig describes routing of responses to requests received over UDP.
+type ResponseRoutingConfig struct {
+	// Routing of responses to all peers, default is RouteToReceived.
+	Routing ResponseRouting
+	// Exceptions override Routing for peers, the first rule with the network of the peer wins.
+	Exceptions []ResponseRoutingRule
+}
+
+type responseRoutingRule struct {
+	peers   []*net.IPNet
+	routing ResponseRouting
+}
+
+// responseRouting is a parsed ResponseRoutingConfig.
+type responseRouting struct {
+	routing    ResponseRouting
+	exceptions []responseRoutingRule
+}
+
+func (config *ResponseRoutingConfig) compile() (*responseRouting, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	rr := &responseRouting{routing: config.Routing}
+	for i, rule := range config.Exceptions {
+		peers, err := parseNetworks(rule.Peers)
+		if err != nil {
+			return nil, fmt.Errorf("parse peers of response routing exception %d: %w", i, err)
+		}
+		rr.exceptions = append(rr.exceptions, responseRoutingRule{peers, rule.Routing})
+	}
+
+	return rr, nil
+}
+
+// routingOf returns routing of responses to the peer.
+func (rr *responseRouting) routingOf(host string) ResponseRouting {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return rr.routing
+	}
+
+	for _, rule := range rr.exceptions {
+		for _, network := range rule.peers {
+			if network.Contains(ip) {
+				return rule.routing
+			}
+		}
+	}
+
+	return rr.routing
+}
+
+// apply redirects the response to UDP request by the routing of the peer.
+func (rr *responseRouting) apply(res sip.Response) {
+	if !strings.EqualFold(res.Transport(), "UDP") {
+		return
+	}
+	receivedFrom, _ := res.Fields()[transport.ReceivedFromField].(string)
+	host, _, err := net.SplitHostPort(receivedFrom)
+	if err != nil {
+		return
+	}
+
+	switch rr.routingOf(host) {
+	case RouteToSentBy:
+		viaHop, ok := res.ViaHop()
+		if !ok {
+			return
+		}
+		host := viaHop.Host
+		if viaHop.Params != nil {
+			if maddr, ok := viaHop.Params.Get("maddr"); ok && maddr != nil && maddr.String() != "" {
+				host = maddr.String()
+			}
+		}
+		port := sip.DefaultPort(res.Transport())
+		if viaHop.Port != nil {
+			port = *viaHop.Port
+		}
+
+		res.SetDestination(net.JoinHostPort(strings.Trim(host, "[]"), fmt.Sprintf("%d", port)))
+	case RouteToSource:
+		res.SetDestination(receivedFrom)
+	}
+}
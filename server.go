@@ -6,10 +6,17 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
 	"github.com/ghettovoice/gosip/transaction"
 	"github.com/ghettovoice/gosip/transport"
 	"github.com/ghettovoice/gosip/util"
@@ -24,9 +31,19 @@ type RequestHandler func(req sip.Request, tx sip.ServerTransaction)
 
 type Server interface {
 	Shutdown()
+	// Wait blocks until all goroutines started by the server, including request handlers, are finished.
+	// It should be called after Shutdown to make sure that nothing leaks across restarts of the stack.
+	Wait()
+	// Drain gracefully drains transaction layer before Shutdown and stops listening when transactions are done,
+	// see transaction.Layer Drain method.
+	Drain(ctx context.Context) error
 
 	Listen(network, addr string, options ...transport.ListenOption) error
+	// ListenContext starts listening on the address until the context is done.
+	ListenContext(ctx context.Context, network, addr string, options ...transport.ListenOption) error
 	Send(msg sip.Message) error
+	// SendContext sends message, the context deadline limits DNS lookup and establishing of the new connection.
+	SendContext(ctx context.Context, msg sip.Message) error
 
 	Request(req sip.Request) (sip.ClientTransaction, error)
 	RequestWithContext(
@@ -43,13 +60,42 @@ type Server interface {
 		reason, body string,
 		headers []sip.Header,
 	) (sip.ServerTransaction, error)
+
+	// Health reports liveness of the server.
+	Health() HealthReport
+	// Ready reports readiness of the server to handle traffic, see HealthConfig.
+	Ready() HealthReport
+	// Reload applies the new configuration without restart, see ReloadConfig.
+	Reload(config ReloadConfig) error
+	// UpgradeHandler returns HTTP handler that accepts WebSocket connections of the network (WS or WSS),
+	// so they can be mounted to the HTTP server of the application, see transport.HTTPUpgrader.
+	UpgradeHandler(network string) (http.Handler, error)
+}
+
+// Requester sends request and waits for the final response, Server implements it.
+type Requester interface {
+	RequestWithContext(
+		ctx context.Context,
+		request sip.Request,
+		options ...RequestWithContextOption,
+	) (sip.Response, error)
+}
+
+// RequestSender sends requests and stateless messages, like in-dialog ACKs and forwarded responses,
+// Server implements it.
+type RequestSender interface {
+	Requester
+	Send(msg sip.Message) error
 }
 
+// TransportLayerFactory creates the transport layer of the server,
+// options configure the layer like the event bus of the server, see transport.NewLayer.
 type TransportLayerFactory func(
 	ip net.IP,
 	dnsResolver *net.Resolver,
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...transport.LayerOption,
 ) transport.Layer
 
 type TransactionLayerFactory func(tpl sip.Transport, logger log.Logger) transaction.Layer
@@ -59,24 +105,194 @@ type ServerConfig struct {
 	// Public IP address or domain name, if empty auto resolved IP will be used.
 	Host string
 	// Dns is an address of the public DNS server to use in SRV lookup.
-	Dns        string
+	Dns string
+	// Resolver is a DNS resolver to use in SRV lookup, it takes precedence over Dns.
+	Resolver *net.Resolver
+	// SecureDNS sends queries of SRV lookup to the trusted upstream over TLS or HTTPS and optionally requires
+	// DNSSEC authenticated answers, it takes precedence over Dns. Resolver takes precedence over it.
+	SecureDNS *transport.SecureDNSConfig
+	// Extensions are option tags of the enabled extensions advertised in Supported header - RFC 3261 20.37.
 	Extensions []string
-	MsgMapper  sip.MessageMapper
-	UserAgent  string
+	// Accept are media types of bodies accepted by handlers advertised in Accept header
+	// of OPTIONS and 415 responses, empty means application/sdp only - RFC 3261 11.2, 21.4.13.
+	Accept []string
+	// OptionsResponder answers out-of-dialog OPTIONS requests without OPTIONS handler, nil answers them with 405.
+	OptionsResponder *OptionsResponder
+	MsgMapper        sip.MessageMapper
+	// UserAgent is a value of User-Agent header stamped on outgoing requests, default is "GoSIP".
+	UserAgent string
+	// ServerName is a value of Server header stamped on outgoing responses, default is UserAgent.
+	ServerName string
+	// HideUserAgent disables stamping of User-Agent and Server headers, so the software of the stack
+	// is not disclosed to peers. Headers set by the application are sent as is.
+	HideUserAgent bool
+	// Observer receives events of the server for monitoring, like metrics.Metrics.
+	Observer Observer
+	// Tracer traces processing of messages by the server, like tracing.Tracer.
+	Tracer Tracer
+	// Profiler receives timings of the pipeline stages of processed messages, like latency.Profiler.
+	Profiler Profiler
+	// Health describes thresholds of the readiness check.
+	Health HealthConfig
+	// ACL restricts sources of the incoming messages, nil allows all sources.
+	ACL *ACL
+	// Admission decides on the new incoming requests before transactions are created, nil admits all requests.
+	Admission Admission
+	// Symmetric sends responses and in-dialog requests to the address messages of the dialog peer
+	// actually arrive from, ignoring Contact and Via addresses, like SBCs do for NATted endpoints.
+	Symmetric bool
+	// ResponseRouting selects addresses responses to requests received over UDP are sent to,
+	// nil routes them by RFC 3261 18.2.2 and RFC 3581.
+	ResponseRouting *ResponseRoutingConfig
+	// ResponseTranslation rewrites codes and reasons of responses sent to peers, nil sends them as is.
+	ResponseTranslation *ResponseTranslationConfig
+	// Tenant identifies the logical stack in the multi-tenant process, see Tenants.
+	// It is attached to all incoming and outgoing messages of the server as TenantField.
+	Tenant string
+	// CircuitBreaker fast-fails requests of RequestWithContext to failing destinations with local 503 response
+	// and limits failover retries, nil disables it.
+	CircuitBreaker *BreakerConfig
+	// Queue runs request handlers by the bounded pool of workers with prioritized queues and load shedding,
+	// nil runs each handler in the new goroutine.
+	Queue *QueueConfig
+	// Overload enables SIP overload control: the server advertises its reduction to upstream clients
+	// and throttles requests of RequestWithContext to overloaded downstream servers - RFC 7339. Nil disables it.
+	Overload *OverloadConfig
+	// Memory sheds new requests while the heap exceeds the memory budget, nil disables it.
+	Memory *MemoryConfig
+	// Limits bounds headers and URIs of incoming messages, nil disables it.
+	Limits *MessageLimits
+	// Sips enforces secure signaling of requests to SIPS URIs, nil disables it.
+	Sips *SipsPolicy
+	// SourceValidation challenges new sources of UDP requests before transactions are created,
+	// so floods of requests with spoofed sources do not create state, nil disables it.
+	SourceValidation *SourceValidationConfig
+	// WsClient configures outgoing connections of WS and WSS transports, like connections to WebRTC platforms.
+	WsClient *transport.WsClientConfig
+	// TLSClient configures verification of servers of TLS transport - RFC 5922, nil verifies them by system roots.
+	TLSClient *transport.TLSClientConfig
+	// Normalizer repairs datagrams of broken peers before they are parsed, like normalize.Normalizer.
+	Normalizer transport.Normalizer
+	// FaultInjector breaks connections of the server for resilience testing, nil disables faults.
+	FaultInjector transport.FaultInjector
+	// ParserWorkers is the number of goroutines parsing datagrams of each packet transport, default is GOMAXPROCS.
+	ParserWorkers int
+	// StrayResponseHandler is called on responses that are not matched to client transactions
+	// or do not echo the request of the matched transaction, like spoofed responses, see transaction.StrayResponseError.
+	StrayResponseHandler transaction.StrayResponseHandler
+	// EventBus receives events of transports and transactions of the server, default is eventbus.Default.
+	// Servers of the same process should have own buses to not receive events of each other.
+	// It is not passed to the custom transaction layer, see transaction.WithEventBus.
+	EventBus eventbus.Bus
+}
+
+// New creates the server configured by the options and starts listening on the addresses of WithListenAddrs.
+// It is an extensible alternative of NewServer.
+func New(options ...ServerOption) (Server, error) {
+	opts := ServerOptions{}
+	for _, o := range options {
+		o.ApplyServer(&opts)
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = log.NewDefaultLogrusLogger()
+	}
+	if opts.EventBus == nil {
+		opts.EventBus = eventbus.Default
+	}
+	txFactory := opts.TransactionLayerFactory
+	if txFactory == nil {
+		timers := opts.Timers
+		wheel := opts.TimerWheel
+		bus := opts.EventBus
+		txFactory = func(tpl sip.Transport, logger log.Logger) transaction.Layer {
+			if wheel == nil {
+				return transaction.NewLayer(tpl, logger, transaction.WithTimers(timers), transaction.WithEventBus(bus))
+			}
+
+			clock := timing.NewWheelClock(*wheel)
+			tx := transaction.NewLayer(tpl, logger,
+				transaction.WithTimers(timers), transaction.WithClock(clock), transaction.WithEventBus(bus))
+			go func() {
+				<-tx.Done()
+				clock.Stop()
+			}()
+
+			return tx
+		}
+	}
+
+	if _, err := opts.ACL.compile(); err != nil {
+		return nil, err
+	}
+	if _, err := opts.ResponseRouting.compile(); err != nil {
+		return nil, err
+	}
+	if _, err := opts.ResponseTranslation.compile(); err != nil {
+		return nil, err
+	}
+
+	srv := NewServer(opts.ServerConfig, opts.TransportLayerFactory, txFactory, opts.Logger)
+	for _, addr := range opts.Listen {
+		var listenOpts []transport.ListenOption
+		if opts.TLSConfig != nil && isSecureNetwork(addr.Network) {
+			listenOpts = append(listenOpts, *opts.TLSConfig)
+		}
+		if err := srv.Listen(addr.Network, addr.Addr, listenOpts...); err != nil {
+			srv.Shutdown()
+			return nil, fmt.Errorf("listen on %s %s: %w", addr.Network, addr.Addr, err)
+		}
+	}
+
+	return srv, nil
+}
+
+func isSecureNetwork(network string) bool {
+	network = strings.ToUpper(network)
+	return network == "TLS" || network == "WSS"
 }
 
 // Server is a SIP server
 type server struct {
-	running         abool.AtomicBool
-	tp              transport.Layer
-	tx              transaction.Layer
-	host            string
-	ip              net.IP
-	hwg             *sync.WaitGroup
-	hmu             *sync.RWMutex
-	requestHandlers map[sip.RequestMethod]RequestHandler
-	extensions      []string
-	userAgent       string
+	running          abool.AtomicBool
+	tp               transport.Layer
+	tx               transaction.Layer
+	host             string
+	ip               net.IP
+	dnsResolver      *net.Resolver
+	hwg              *sync.WaitGroup
+	gwg              *sync.WaitGroup
+	done             chan struct{}
+	hmu              *sync.RWMutex
+	requestHandlers  map[sip.RequestMethod]RequestHandler
+	extensions       []string
+	accept           []string
+	optionsResponder *OptionsResponder
+	symmetric        *symmetricPeers
+	responseRouting  *responseRouting
+	translation      *responseTranslation
+	breakers         *breakers
+	queue            *workQueue
+	overload         *overloadControl
+	memory           *memoryBudget
+	stopMemory       func()
+	userAgent        string
+	serverName       string
+	tenant           string
+	observer         Observer
+	tracer           Tracer
+	profiler         Profiler
+	sent             *sentMessages
+	tmu              sync.Mutex
+	observedTxs      map[sip.Transaction]func()
+	health           HealthConfig
+	listeners        *listenerStatuses
+	acl              atomic.Value
+	lmu              sync.Mutex
+	listens          []*listenEntry
+	draining         abool.AtomicBool
+	unsubscribe      func()
+	unobserve        func()
 
 	log log.Logger
 }
@@ -88,14 +304,23 @@ func NewServer(
 	txFactory TransactionLayerFactory,
 	logger log.Logger,
 ) Server {
+	if config.EventBus == nil {
+		config.EventBus = eventbus.Default
+	}
 	if tpFactory == nil {
 		tpFactory = transport.NewLayer
 	}
 	if txFactory == nil {
-		txFactory = transaction.NewLayer
+		bus := config.EventBus
+		txFactory = func(tpl sip.Transport, logger log.Logger) transaction.Layer {
+			return transaction.NewLayer(tpl, logger, transaction.WithEventBus(bus))
+		}
 	}
 
 	logger = logger.WithPrefix("gosip.Server")
+	if config.Tenant != "" {
+		logger = logger.WithFields(log.Fields{TenantField: config.Tenant})
+	}
 
 	var host string
 	var ip net.IP
@@ -116,7 +341,14 @@ func NewServer(
 	}
 
 	var dnsResolver *net.Resolver
-	if config.Dns != "" {
+	if config.Resolver != nil {
+		dnsResolver = config.Resolver
+	} else if config.SecureDNS != nil {
+		var err error
+		if dnsResolver, err = transport.NewSecureResolver(*config.SecureDNS); err != nil {
+			logger.Panicf("create secure DNS resolver failed: %s", err)
+		}
+	} else if config.Dns != "" {
 		dnsResolver = &net.Resolver{
 			PreferGo: true,
 			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
@@ -137,28 +369,188 @@ func NewServer(
 	if userAgent == "" {
 		userAgent = "GoSIP"
 	}
+	serverName := config.ServerName
+	if serverName == "" {
+		serverName = userAgent
+	}
+	if config.HideUserAgent {
+		userAgent, serverName = "", ""
+	}
+
+	if config.Health.DNSTimeout <= 0 {
+		config.Health.DNSTimeout = DefaultHealthDNSTimeout
+	}
+
+	acl, err := config.ACL.compile()
+	if err != nil {
+		logger.Panicf("invalid ACL: %s", err)
+	}
+	routing, err := config.ResponseRouting.compile()
+	if err != nil {
+		logger.Panicf("invalid response routing: %s", err)
+	}
+	translation, err := config.ResponseTranslation.compile()
+	if err != nil {
+		logger.Panicf("invalid response translation: %s", err)
+	}
+
+	var srv *server
+	msgMapper := func(msg sip.Message) sip.Message {
+		// ACL is checked first, so rejected messages are not observed
+		if !srv.getACL().permits(msg) {
+			srv.Log().WithFields(msg.Fields()).Debugf("drop message from %s rejected by ACL", msg.Source())
+			return nil
+		}
+		srv.tagTenant(msg)
+		if srv.symmetric != nil {
+			srv.symmetric.learn(msg)
+		}
+		if config.MsgMapper != nil {
+			msg = config.MsgMapper(msg)
+		}
+		if msg == nil {
+			return nil
+		}
+		if config.Observer != nil {
+			config.Observer.MessageReceived(msg)
+		}
+		if config.Tracer != nil {
+			config.Tracer.Receive(msg)
+		}
+		// responses are passed to the TU by client transactions, so only parse is profiled
+		if _, ok := msg.(sip.Response); ok && config.Profiler != nil {
+			timings, _ := messageTimings(msg)
+			config.Profiler.MessageProcessed(msg, timings)
+		}
+
+		return msg
+	}
 
-	srv := &server{
-		host:            host,
-		ip:              ip,
-		hwg:             new(sync.WaitGroup),
-		hmu:             new(sync.RWMutex),
-		requestHandlers: make(map[sip.RequestMethod]RequestHandler),
-		extensions:      extensions,
-		userAgent:       userAgent,
+	srv = &server{
+		host:             host,
+		ip:               ip,
+		dnsResolver:      dnsResolver,
+		hwg:              new(sync.WaitGroup),
+		gwg:              new(sync.WaitGroup),
+		done:             make(chan struct{}),
+		hmu:              new(sync.RWMutex),
+		requestHandlers:  make(map[sip.RequestMethod]RequestHandler),
+		extensions:       extensions,
+		accept:           config.Accept,
+		optionsResponder: config.OptionsResponder,
+		userAgent:        userAgent,
+		serverName:       serverName,
+		tenant:           config.Tenant,
+		observer:         config.Observer,
+		tracer:           config.Tracer,
+		profiler:         config.Profiler,
+		health:           config.Health,
+		listeners:        new(listenerStatuses),
+		observedTxs:      make(map[sip.Transaction]func()),
+		responseRouting:  routing,
+		translation:      translation,
+	}
+	srv.acl.Store(acl)
+	if config.Symmetric {
+		srv.symmetric = newSymmetricPeers()
+	}
+	if config.CircuitBreaker != nil {
+		srv.breakers = newBreakers(*config.CircuitBreaker)
+	}
+	if config.Queue != nil {
+		srv.queue = newWorkQueue(*config.Queue)
+		for i := 0; i < srv.queue.config.Workers; i++ {
+			srv.goroutine(srv.queue.work)
+		}
+	}
+	if config.Memory != nil {
+		srv.memory = newMemoryBudget(*config.Memory)
+		srv.stopMemory = srv.memory.start()
+	}
+	if config.Overload != nil {
+		srv.overload = newOverloadControl(*config.Overload, srv.load)
+	}
+	if srv.observer != nil {
+		srv.sent = newSentMessages()
 	}
 	srv.log = logger.WithFields(log.Fields{
 		"sip_server_ptr": fmt.Sprintf("%p", srv),
 	})
-	srv.tp = tpFactory(ip, dnsResolver, config.MsgMapper, srv.Log())
+	srv.tp = tpFactory(ip, dnsResolver, msgMapper, srv.Log(),
+		transport.WithEventBus(config.EventBus),
+		transport.WithFaultInjector(config.FaultInjector),
+		transport.WithParserWorkers(config.ParserWorkers),
+	)
 	sipTp := &sipTransport{
 		tpl: srv.tp,
 		srv: srv,
 	}
 	srv.tx = txFactory(sipTp, log.AddFieldsFrom(srv.Log(), srv.tp))
+	if observer, ok := srv.observer.(ConnectionObserver); ok {
+		if counter, ok := srv.tp.(transport.ConnectionCounter); ok {
+			srv.unobserve = observer.ObserveConnections(counter.OpenConnections)
+		} else {
+			srv.Log().Warn("observe connections failed: transport layer does not count connections")
+		}
+	}
+	if notifier, ok := srv.tx.(transaction.TerminationNotifier); ok {
+		notifier.SetTerminatedHandler(srv.txTerminated)
+	}
+	if config.WsClient != nil {
+		for _, network := range []string{"ws", "wss"} {
+			if client, ok := srv.protocol(network).(transport.WsClient); ok {
+				client.SetClientConfig(*config.WsClient)
+			} else {
+				srv.Log().Warnf("configure %s client failed: protocol does not dial WebSocket connections", network)
+			}
+		}
+	}
+	if config.TLSClient != nil {
+		if client, ok := srv.protocol("tls").(transport.TLSClient); ok {
+			client.SetTLSClientConfig(*config.TLSClient)
+		} else {
+			srv.Log().Warn("configure tls client failed: protocol does not verify TLS servers")
+		}
+	}
+	if config.Normalizer != nil {
+		if normalizable, ok := srv.protocol("udp").(transport.Normalizable); ok {
+			normalizable.SetNormalizer(config.Normalizer)
+		} else {
+			srv.Log().Warn("configure udp normalizer failed: protocol does not normalize incoming data")
+		}
+	}
+	if config.Limits != nil {
+		srv.setMessageLimits(*config.Limits)
+	}
+	if config.StrayResponseHandler != nil {
+		srv.tx.SetStrayResponseHandler(config.StrayResponseHandler)
+	}
+	// built-in policies are applied before the policy of the application, cheapest first
+	policies := make([]Admission, 0)
+	if srv.memory != nil {
+		policies = append(policies, srv.memory)
+	}
+	if config.Sips != nil {
+		policies = append(policies, newSipsPolicy(*config.Sips))
+	}
+	if config.SourceValidation != nil {
+		policies = append(policies, newSourceValidation(*config.SourceValidation))
+	}
+	if config.Admission != nil {
+		policies = append(policies, config.Admission)
+	}
+	switch len(policies) {
+	case 0:
+	case 1:
+		srv.tx.SetAdmission(srv.admit(policies[0]))
+	default:
+		srv.tx.SetAdmission(srv.admit(ChainAdmission(policies...)))
+	}
+
+	srv.unsubscribe = config.EventBus.Subscribe(srv.listeners.onEvent, eventbus.ListenerFailed, eventbus.ConnectionDown)
 
 	srv.running.Set()
-	go srv.serve()
+	srv.goroutine(srv.serve)
 
 	return srv
 }
@@ -169,7 +561,107 @@ func (srv *server) Log() log.Logger {
 
 // ListenAndServe starts serving listeners on the provided address
 func (srv *server) Listen(network string, listenAddr string, options ...transport.ListenOption) error {
-	return srv.tp.Listen(network, listenAddr, options...)
+	srv.lmu.Lock()
+	defer srv.lmu.Unlock()
+
+	return srv.listen(newListenEntry(network, listenAddr, options))
+}
+
+func (srv *server) ListenContext(
+	ctx context.Context,
+	network string,
+	listenAddr string,
+	options ...transport.ListenOption,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	entry := newListenEntry(network, listenAddr, options)
+	srv.lmu.Lock()
+	err := srv.listen(entry)
+	srv.lmu.Unlock()
+	if err != nil || ctx.Done() == nil {
+		return err
+	}
+
+	srv.goroutine(func() {
+		select {
+		case <-srv.done:
+			return
+		case <-ctx.Done():
+		}
+
+		srv.lmu.Lock()
+		defer srv.lmu.Unlock()
+		// the listener could be already removed by Reload
+		for _, e := range srv.listens {
+			if e == entry {
+				if err := srv.unlisten(entry); err != nil {
+					srv.Log().Debugf("stop listening on %s %s failed: %s", entry.network, entry.addr, err)
+				}
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// listen must be called with locked lmu.
+func (srv *server) listen(entry *listenEntry) error {
+	if err := srv.tp.Listen(entry.network, entry.addr, entry.options...); err != nil {
+		return err
+	}
+	srv.listeners.add(entry.network, entry.addr)
+	srv.listens = append(srv.listens, entry)
+
+	return nil
+}
+
+// unlisten must be called with locked lmu.
+func (srv *server) unlisten(entry *listenEntry) error {
+	// forget the listener before close, so its close event is not reported as failure
+	srv.listeners.remove(entry.network, entry.addr)
+	if err := srv.tp.Unlisten(entry.network, entry.addr); err != nil {
+		return err
+	}
+	for i, e := range srv.listens {
+		if e == entry {
+			srv.listens = append(srv.listens[:i:i], srv.listens[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (srv *server) UpgradeHandler(network string) (http.Handler, error) {
+	upgrader, ok := srv.protocol(network).(transport.HTTPUpgrader)
+	if !ok {
+		return nil, transport.UnsupportedProtocolError(fmt.Sprintf("protocol %s does not upgrade HTTP connections", network))
+	}
+
+	return upgrader.UpgradeHandler(), nil
+}
+
+// protocol returns the protocol of the network, nil if the transport layer does not expose its protocols.
+func (srv *server) protocol(network string) transport.Protocol {
+	layer, ok := srv.tp.(transport.ProtocolLayer)
+	if !ok {
+		return nil
+	}
+	protocol, err := layer.Protocol(network)
+	if err != nil {
+		srv.Log().Debugf("get %s protocol failed: %s", network, err)
+		return nil
+	}
+
+	return protocol
+}
+
+func (srv *server) getACL() *accessList {
+	return srv.acl.Load().(*accessList)
 }
 
 func (srv *server) serve() {
@@ -181,6 +673,11 @@ func (srv *server) serve() {
 			if !ok {
 				return
 			}
+			var endTrace func()
+			if srv.tracer != nil {
+				endTrace = srv.tracer.StartTransaction(tx.Origin(), false)
+			}
+			srv.observeTx(tx, tx.Origin().Method(), false, endTrace)
 			srv.hwg.Add(1)
 			go srv.handleRequest(tx.Origin(), tx)
 		case ack, ok := <-srv.tx.Acks():
@@ -213,11 +710,20 @@ func (srv *server) serve() {
 				return
 			}
 
-			var ferr *sip.MalformedMessageError
+			var (
+				lerr *MessageLimitError
+				ferr *sip.MalformedMessageError
+			)
 			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
 				srv.Log().Debugf("received SIP transport error: %s", err)
+			} else if errors.As(err, &lerr) {
+				srv.Log().Warnf("received SIP transport error: %s", err)
+				srv.rejectOverLimit(lerr)
 			} else if errors.As(err, &ferr) {
 				srv.Log().Warnf("received SIP transport error: %s", err)
+				if srv.observer != nil {
+					srv.observer.ParseError(err)
+				}
 			} else {
 				srv.Log().Errorf("received SIP transport error: %s", err)
 			}
@@ -235,12 +741,19 @@ func (srv *server) handleRequest(req sip.Request, tx sip.ServerTransaction) {
 	handler, ok := srv.requestHandlers[req.Method()]
 	srv.hmu.RUnlock()
 
+	if !ok && srv.answersOptions(req) {
+		if _, err := srv.Respond(srv.optionsResponder.response(req)); err != nil {
+			logger.Errorf("respond on OPTIONS request failed: %s", err)
+		}
+
+		return
+	}
 	if !ok {
 		logger.Warn("SIP request handler not found")
 
 		// ACK request doesn't have any transaction, so just skip this step
 		if tx != nil {
-			go func(tx sip.ServerTransaction, logger log.Logger) {
+			srv.goroutine(func() {
 				for {
 					select {
 					case <-srv.tx.Done():
@@ -253,12 +766,14 @@ func (srv *server) handleRequest(req sip.Request, tx sip.ServerTransaction) {
 						logger.Warnf("error from SIP server transaction %s: %s", tx, err)
 					}
 				}
-			}(tx, logger)
+			})
 		}
 
 		// ACK request doesn't require any response, so just skip this step
 		if !req.IsAck() {
+			// RFC 3261 21.4.6. 405 response must contain Allow header
 			res := sip.NewResponseFromRequest("", req, 405, "Method Not Allowed", "")
+			res.AppendHeader(sip.AllowHeader(srv.getAllowedMethods()))
 			if _, err := srv.Respond(res); err != nil {
 				logger.Errorf("respond '405 Method Not Allowed' failed: %s", err)
 			}
@@ -267,7 +782,46 @@ func (srv *server) handleRequest(req sip.Request, tx sip.ServerTransaction) {
 		return
 	}
 
-	go handler(req, tx)
+	run := func() {
+		if srv.profiler != nil {
+			defer srv.profileRequest(req)()
+		}
+		if srv.tracer != nil {
+			defer srv.tracer.StartHandler(req)()
+		}
+
+		handler(req, tx)
+	}
+	if srv.queue != nil {
+		srv.enqueue(req, run)
+		return
+	}
+
+	srv.goroutine(run)
+}
+
+// goroutine runs fn in the new goroutine tracked by Wait.
+func (srv *server) goroutine(fn func()) {
+	srv.gwg.Add(1)
+	go func() {
+		defer srv.gwg.Done()
+
+		fn()
+	}()
+}
+
+// profileRequest returns function that reports timings of the incoming request when the handler returns.
+func (srv *server) profileRequest(req sip.Request) func() {
+	timings, receivedAt := messageTimings(req)
+	start := time.Now()
+	if !receivedAt.IsZero() {
+		timings.Transaction = start.Sub(receivedAt)
+	}
+
+	return func() {
+		timings.Handler = time.Since(start)
+		srv.profiler.MessageProcessed(req, timings)
+	}
 }
 
 // Send SIP message
@@ -276,7 +830,73 @@ func (srv *server) Request(req sip.Request) (sip.ClientTransaction, error) {
 		return nil, fmt.Errorf("can not send through stopped server")
 	}
 
-	return srv.tx.Request(srv.prepareRequest(req))
+	req = srv.prepareRequest(req)
+	// the trace of the transaction is started before the request is sent by the transaction
+	var endTrace func()
+	if srv.tracer != nil {
+		endTrace = srv.tracer.StartTransaction(req, true)
+	}
+
+	tx, err := srv.tx.Request(req)
+	if err != nil {
+		if endTrace != nil {
+			endTrace()
+		}
+
+		return nil, err
+	}
+	srv.observeTx(tx, req.Method(), true, endTrace)
+
+	return tx, nil
+}
+
+// observeTx reports duration of the transaction to the observer
+// and ends the trace of the transaction when the transaction is terminated.
+func (srv *server) observeTx(tx sip.Transaction, method sip.RequestMethod, client bool, endTrace func()) {
+	if srv.observer == nil && endTrace == nil {
+		return
+	}
+
+	start := time.Now()
+	done := func() {
+		if srv.observer != nil {
+			srv.observer.TransactionCompleted(method, client, time.Since(start))
+		}
+		if endTrace != nil {
+			endTrace()
+		}
+	}
+
+	if _, ok := srv.tx.(transaction.TerminationNotifier); !ok {
+		srv.goroutine(func() {
+			<-tx.Done()
+			done()
+		})
+
+		return
+	}
+
+	srv.tmu.Lock()
+	srv.observedTxs[tx] = done
+	srv.tmu.Unlock()
+	// the transaction could be terminated before it is observed
+	select {
+	case <-tx.Done():
+		srv.txTerminated(tx)
+	default:
+	}
+}
+
+// txTerminated completes observation of the terminated transaction once.
+func (srv *server) txTerminated(tx sip.Transaction) {
+	srv.tmu.Lock()
+	done, ok := srv.observedTxs[tx]
+	delete(srv.observedTxs, tx)
+	srv.tmu.Unlock()
+
+	if ok {
+		done()
+	}
 }
 
 func (srv *server) RequestWithContext(
@@ -284,7 +904,114 @@ func (srv *server) RequestWithContext(
 	request sip.Request,
 	options ...RequestWithContextOption,
 ) (sip.Response, error) {
-	return srv.requestWithContext(ctx, request, 1, options...)
+	optionsHash := &RequestWithContextOptions{}
+	for _, opt := range options {
+		opt.ApplyRequestWithContext(optionsHash)
+	}
+
+	if optionsHash.UserAgent != nil {
+		request.RemoveHeader("User-Agent")
+		if *optionsHash.UserAgent != "" {
+			userAgent := sip.UserAgentHeader(*optionsHash.UserAgent)
+			request.AppendHeader(&userAgent)
+		}
+	}
+
+	if optionsHash.Redirect != nil {
+		return srv.requestWithRedirect(ctx, request, *optionsHash.Redirect, options...)
+	}
+
+	return srv.request(ctx, request, optionsHash, options...)
+}
+
+func (srv *server) request(
+	ctx context.Context,
+	request sip.Request,
+	optionsHash *RequestWithContextOptions,
+	options ...RequestWithContextOption,
+) (sip.Response, error) {
+	if optionsHash.Failover {
+		var policy FailoverPolicy
+		if optionsHash.FailoverPolicy != nil {
+			policy = *optionsHash.FailoverPolicy
+		}
+
+		return srv.requestWithFailover(ctx, request, policy, options...)
+	}
+
+	return srv.requestToDestination(ctx, request, options...)
+}
+
+// requestToDestination sends the request through the circuit breaker of its destination.
+func (srv *server) requestToDestination(
+	ctx context.Context,
+	request sip.Request,
+	options ...RequestWithContextOption,
+) (sip.Response, error) {
+	dest := request.Destination()
+	if srv.overload != nil && srv.overload.throttle(request, dest) {
+		srv.Log().WithFields(request.Fields()).Debugf("%s is overloaded, reject request locally", dest)
+
+		res := sip.NewResponseFromRequest("", request, 503, "Service Unavailable", "")
+		return nil, sip.NewRequestError(503, "Service Unavailable", request, res)
+	}
+
+	if srv.breakers == nil {
+		return srv.requestWithContext(ctx, request, 1, options...)
+	}
+
+	if retryAfter, ok := srv.breakers.allow(dest); !ok {
+		srv.Log().WithFields(request.Fields()).Debugf("circuit breaker of %s is open, reject request locally", dest)
+
+		res := localUnavailable(request, retryAfter)
+		return nil, sip.NewRequestError(503, "Service Unavailable", request, res)
+	}
+
+	res, err := srv.requestWithContext(ctx, request, 1, options...)
+
+	result := breakerSuccess
+	switch {
+	case ctx.Err() != nil:
+		result = breakerIgnored
+	case err != nil && isFailoverError(err):
+		result = breakerFailure
+	}
+	if state := srv.breakers.report(dest, result); state == BreakerOpen && result == breakerFailure {
+		srv.Log().WithFields(request.Fields()).Debugf("circuit breaker of %s is open", dest)
+	}
+
+	return res, err
+}
+
+func isFailoverError(err error) bool {
+	var reqErr *sip.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.Code == 503
+	}
+
+	var txErr transaction.TxError
+	if errors.As(err, &txErr) {
+		return txErr.Transport() || txErr.Timeout()
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func requestTargetUri(req sip.Request) *sip.SipUri {
+	if hdrs := req.GetHeaders("Route"); len(hdrs) > 0 {
+		if route, ok := hdrs[0].(*sip.RouteHeader); ok && len(route.Addresses) > 0 {
+			if uri, ok := route.Addresses[0].(*sip.SipUri); ok {
+				return uri
+			}
+		}
+	}
+
+	if uri, ok := req.Recipient().(*sip.SipUri); ok {
+		return uri
+	}
+
+	return nil
 }
 
 func (srv *server) requestWithContext(
@@ -316,6 +1043,12 @@ func (srv *server) requestWithContext(
 		select {
 		case <-done:
 		case <-ctx.Done():
+			// non-INVITE request can't be canceled - RFC 3261 9.1,
+			// so the transaction is abandoned instead of waiting for the timeout
+			if terminator, ok := tx.(interface{ Terminate() }); ok && !request.IsInvite() {
+				terminator.Terminate()
+				return
+			}
 			if err := tx.Cancel(); err != nil {
 				srv.Log().Error("cancel transaction failed", log.Fields{
 					"transaction_key": tx.Key(),
@@ -360,6 +1093,10 @@ func (srv *server) requestWithContext(
 				response = sip.CopyResponse(response)
 				lastResponse = response
 
+				if srv.overload != nil {
+					srv.overload.learn(response, request.Destination())
+				}
+
 				if optionsHash.ResponseHandler != nil {
 					optionsHash.ResponseHandler(response, request)
 				}
@@ -378,13 +1115,13 @@ func (srv *server) requestWithContext(
 					response.SetPrevious(previousMessages)
 					responses <- response
 
-					go func() {
+					srv.goroutine(func() {
 						for response := range tx.Responses() {
 							if optionsHash.ResponseHandler != nil {
 								optionsHash.ResponseHandler(response, request)
 							}
 						}
-					}()
+					})
 
 					return
 				}
@@ -429,6 +1166,13 @@ func (srv *server) requestWithContext(
 
 func (srv *server) prepareRequest(req sip.Request) sip.Request {
 	srv.appendAutoHeaders(req)
+	srv.tagTenant(req)
+	if srv.symmetric != nil {
+		srv.symmetric.apply(req)
+	}
+	if srv.overload != nil {
+		srv.overload.supportOverload(req)
+	}
 
 	return req
 }
@@ -461,6 +1205,10 @@ func (srv *server) RespondOnRequest(
 }
 
 func (srv *server) Send(msg sip.Message) error {
+	return srv.SendContext(context.Background(), msg)
+}
+
+func (srv *server) SendContext(ctx context.Context, msg sip.Message) error {
 	if !srv.running.IsSet() {
 		return fmt.Errorf("can not send through stopped server")
 	}
@@ -472,21 +1220,83 @@ func (srv *server) Send(msg sip.Message) error {
 		msg = srv.prepareResponse(m)
 	}
 
-	return srv.tp.Send(msg)
+	var endTrace func(err error)
+	if srv.tracer != nil {
+		endTrace = srv.tracer.StartSend(msg)
+	}
+
+	start := time.Now()
+	err := srv.send(ctx, msg)
+	if srv.profiler != nil && err == nil {
+		srv.profiler.MessageProcessed(msg, Timings{Send: time.Since(start)})
+	}
+	if endTrace != nil {
+		endTrace(err)
+	}
+
+	return err
+}
+
+func (srv *server) send(ctx context.Context, msg sip.Message) error {
+	if srv.observer == nil {
+		return srv.tp.SendContext(ctx, msg)
+	}
+
+	retransmission := srv.sent.add(msg)
+	err := srv.tp.SendContext(ctx, msg)
+	if err == nil {
+		// message is reported after the transport layer has filled sent-by and destination
+		srv.observer.MessageSent(msg)
+		if retransmission {
+			srv.observer.Retransmission(msg)
+		}
+
+		return nil
+	}
+
+	var dnsErr *net.DNSError
+	if errors.Is(err, sip.ErrDNS) || errors.As(err, &dnsErr) {
+		srv.observer.DNSFailure(err)
+	}
+
+	return err
 }
 
 func (srv *server) prepareResponse(res sip.Response) sip.Response {
 	srv.appendAutoHeaders(res)
+	srv.tagTenant(res)
+	if srv.responseRouting != nil {
+		srv.responseRouting.apply(res)
+	}
+	if srv.symmetric != nil {
+		srv.symmetric.apply(res)
+	}
+	if srv.translation != nil {
+		srv.translation.apply(res)
+	}
+	if srv.overload != nil {
+		srv.overload.advertise(res)
+	}
 
 	return res
 }
 
 // Shutdown gracefully shutdowns SIP server
 func (srv *server) Shutdown() {
-	if !srv.running.IsSet() {
+	if !srv.running.SetToIf(true, false) {
 		return
 	}
-	srv.running.UnSet()
+	close(srv.done)
+	srv.unsubscribe()
+	if srv.unobserve != nil {
+		srv.unobserve()
+	}
+	if srv.queue != nil {
+		srv.queue.close()
+	}
+	if srv.stopMemory != nil {
+		srv.stopMemory()
+	}
 	// stop transaction layer
 	srv.tx.Cancel()
 	<-srv.tx.Done()
@@ -497,6 +1307,35 @@ func (srv *server) Shutdown() {
 	srv.hwg.Wait()
 }
 
+func (srv *server) Wait() {
+	srv.gwg.Wait()
+}
+
+// Drain rejects new out-of-dialog requests and waits for existing transactions to complete,
+// then the server stops listening. Established connections are kept until Shutdown.
+func (srv *server) Drain(ctx context.Context) error {
+	if !srv.running.IsSet() {
+		return fmt.Errorf("can not drain stopped server")
+	}
+	srv.draining.Set()
+
+	if err := srv.tx.Drain(ctx); err != nil {
+		return err
+	}
+
+	srv.lmu.Lock()
+	defer srv.lmu.Unlock()
+
+	for len(srv.listens) > 0 {
+		entry := srv.listens[0]
+		if err := srv.unlisten(entry); err != nil {
+			return fmt.Errorf("stop listening on %s %s: %w", entry.network, entry.addr, err)
+		}
+	}
+
+	return nil
+}
+
 // OnRequest registers new request callback
 func (srv *server) OnRequest(method sip.RequestMethod, handler RequestHandler) error {
 	srv.hmu.Lock()
@@ -507,12 +1346,15 @@ func (srv *server) OnRequest(method sip.RequestMethod, handler RequestHandler) e
 }
 
 func (srv *server) appendAutoHeaders(msg sip.Message) {
+	// capabilities are advertised in messages that create or refresh dialogs and in OPTIONS - RFC 3261 11, 20.5
 	autoAppendMethods := map[sip.RequestMethod]bool{
-		sip.INVITE:   true,
-		sip.REGISTER: true,
-		sip.OPTIONS:  true,
-		sip.REFER:    true,
-		sip.NOTIFY:   true,
+		sip.INVITE:    true,
+		sip.REGISTER:  true,
+		sip.OPTIONS:   true,
+		sip.REFER:     true,
+		sip.NOTIFY:    true,
+		sip.SUBSCRIBE: true,
+		sip.UPDATE:    true,
 	}
 
 	var msgMethod sip.RequestMethod
@@ -528,13 +1370,8 @@ func (srv *server) appendAutoHeaders(msg sip.Message) {
 		if _, ok := autoAppendMethods[msgMethod]; ok {
 			hdrs := msg.GetHeaders("Allow")
 			if len(hdrs) == 0 {
-				allow := make(sip.AllowHeader, 0)
-				for _, method := range srv.getAllowedMethods() {
-					allow = append(allow, method)
-				}
-
-				if len(allow) > 0 {
-					msg.AppendHeader(allow)
+				if allow := srv.getAllowedMethods(); len(allow) > 0 {
+					msg.AppendHeader(sip.AllowHeader(allow))
 				}
 			}
 
@@ -547,9 +1384,23 @@ func (srv *server) appendAutoHeaders(msg sip.Message) {
 		}
 	}
 
-	if hdrs := msg.GetHeaders("User-Agent"); len(hdrs) == 0 {
-		userAgent := sip.UserAgentHeader(srv.userAgent)
-		msg.AppendHeader(&userAgent)
+	if res, ok := msg.(sip.Response); (msgMethod == sip.OPTIONS || ok && res.StatusCode() == 415) &&
+		len(srv.accept) > 0 && len(msg.GetHeaders("Accept")) == 0 {
+		accept := sip.Accept(strings.Join(srv.accept, ", "))
+		msg.AppendHeader(&accept)
+	}
+
+	// RFC 3261 20.35, 20.41
+	switch msg.(type) {
+	case sip.Request:
+		if hdrs := msg.GetHeaders("User-Agent"); len(hdrs) == 0 && srv.userAgent != "" {
+			userAgent := sip.UserAgentHeader(srv.userAgent)
+			msg.AppendHeader(&userAgent)
+		}
+	case sip.Response:
+		if hdrs := msg.GetHeaders("Server"); len(hdrs) == 0 && srv.serverName != "" {
+			msg.AppendHeader(&sip.GenericHeader{HeaderName: "Server", Contents: srv.serverName})
+		}
 	}
 
 	if hdrs := msg.GetHeaders("Content-Length"); len(hdrs) == 0 {
@@ -557,26 +1408,35 @@ func (srv *server) appendAutoHeaders(msg sip.Message) {
 	}
 }
 
+// getAllowedMethods returns methods of the registered handlers sorted by name.
+// ACK and CANCEL are handled by the transaction layer, so they are allowed with INVITE,
+// OPTIONS is allowed with OptionsResponder.
 func (srv *server) getAllowedMethods() []sip.RequestMethod {
-	methods := []sip.RequestMethod{
-		sip.INVITE,
-		sip.ACK,
-		sip.CANCEL,
-	}
-	added := map[sip.RequestMethod]bool{
-		sip.INVITE: true,
-		sip.ACK:    true,
-		sip.CANCEL: true,
-	}
-
 	srv.hmu.RLock()
+	methods := make([]sip.RequestMethod, 0, len(srv.requestHandlers)+2)
 	for method := range srv.requestHandlers {
-		if _, ok := added[method]; !ok {
-			methods = append(methods, method)
-		}
+		methods = append(methods, method)
 	}
+	_, invite := srv.requestHandlers[sip.INVITE]
+	_, ack := srv.requestHandlers[sip.ACK]
+	_, cancel := srv.requestHandlers[sip.CANCEL]
+	_, options := srv.requestHandlers[sip.OPTIONS]
 	srv.hmu.RUnlock()
 
+	if srv.optionsResponder != nil && !options {
+		methods = append(methods, sip.OPTIONS)
+	}
+
+	if invite && !ack {
+		methods = append(methods, sip.ACK)
+	}
+	if invite && !cancel {
+		methods = append(methods, sip.CANCEL)
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		return methods[i] < methods[j]
+	})
+
 	return methods
 }
 
@@ -593,6 +1453,10 @@ func (tp *sipTransport) Send(msg sip.Message) error {
 	return tp.srv.Send(msg)
 }
 
+func (tp *sipTransport) SendContext(ctx context.Context, msg sip.Message) error {
+	return tp.srv.SendContext(ctx, msg)
+}
+
 func (tp *sipTransport) IsReliable(network string) bool {
 	return tp.tpl.IsReliable(network)
 }
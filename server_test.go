@@ -2,7 +2,24 @@ package gosip_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,9 +30,14 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/latency"
+	"github.com/ghettovoice/gosip/normalize"
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/sip/parser"
 	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
 	"github.com/ghettovoice/gosip/transport"
 )
 
@@ -346,4 +368,2432 @@ var _ = Describe("GoSIP Server", func() {
 
 		wg.Wait()
 	}, 3)
+
+	It("should follow 3xx redirects in q-value order with loop protection", func(done Done) {
+		defer close(done)
+
+		msgReq := testutils.Request([]string{
+			"MESSAGE sip:bob@" + clientAddr + " SIP/2.0",
+			"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+			"To: \"Bob\" <sip:bob@far-far-away.com>",
+			"CSeq: 1 MESSAGE",
+			"",
+			"Hello world!",
+		})
+
+		recipients := make(chan string, 10)
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := net.ListenPacket("udp", clientAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+
+			branches := make(map[string]bool)
+			buf := make([]byte, transport.MTU)
+			for {
+				num, raddr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+
+				msg, err := parser.ParseMessage(buf[:num], logger)
+				Expect(err).ShouldNot(HaveOccurred())
+				viaHop, ok := msg.ViaHop()
+				Expect(ok).Should(BeTrue())
+				branch, _ := viaHop.Params.Get("branch")
+				if branches[branch.String()] {
+					continue
+				}
+				branches[branch.String()] = true
+				viaHop.Params.Add("received", sip.String{Str: raddr.(*net.UDPAddr).IP.String()})
+				req, ok := msg.(sip.Request)
+				Expect(ok).Should(BeTrue())
+				recipients <- req.Recipient().String()
+
+				var res sip.Response
+				switch req.Recipient().User().String() {
+				case "bob":
+					res = sip.NewResponseFromRequest("", req, 302, "Moved Temporarily", "")
+					for _, contact := range []string{
+						"<sip:carol@" + clientAddr + ">;q=0.5",
+						"<sip:bob@" + clientAddr + ">",
+						"<sip:dave@" + clientAddr + ">;q=0.9",
+					} {
+						res.AppendHeader(&sip.GenericHeader{HeaderName: "Contact", Contents: contact})
+					}
+				case "dave":
+					res = sip.NewResponseFromRequest("", req, 404, "Not Found", "")
+				default:
+					res = sip.NewResponseFromRequest("", req, 200, "Ok", "")
+				}
+				raddr, err = net.ResolveUDPAddr("udp", res.Destination())
+				Expect(err).ShouldNot(HaveOccurred())
+				// reparse to get typed Contact headers in the response
+				_, err = conn.WriteTo([]byte(res.String()), raddr)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				if res.IsSuccess() {
+					return
+				}
+			}
+		}()
+
+		res, err := srv.RequestWithContext(context.Background(), msgReq, gosip.WithRedirect(gosip.RedirectPolicy{}))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(int(res.StatusCode())).Should(Equal(200))
+		cseq, ok := res.CSeq()
+		Expect(ok).Should(BeTrue())
+		Expect(cseq.SeqNo).Should(Equal(uint32(3)))
+
+		Expect(recipients).Should(Receive(Equal("sip:bob@" + clientAddr)))
+		Expect(recipients).Should(Receive(Equal("sip:dave@" + clientAddr)))
+		Expect(recipients).Should(Receive(Equal("sip:carol@" + clientAddr)))
+
+		wg.Wait()
+	}, 5)
+
+	It("should route requests through Mux and reject unhandled methods with Allow", func(done Done) {
+		defer close(done)
+
+		mux := gosip.NewMux(srv, logger)
+		var calls []string
+		mu := new(sync.Mutex)
+		trace := func(name string) gosip.Middleware {
+			return func(next gosip.HandlerFunc) gosip.HandlerFunc {
+				return func(w gosip.ResponseWriter, req sip.Request) {
+					mu.Lock()
+					calls = append(calls, name)
+					mu.Unlock()
+					next(w, req)
+				}
+			}
+		}
+		mux.Use(trace("global"), func(next gosip.HandlerFunc) gosip.HandlerFunc {
+			return func(w gosip.ResponseWriter, req sip.Request) {
+				w.AddHeader(&sip.GenericHeader{HeaderName: "Server", Contents: "mux-test"})
+				next(w, req)
+			}
+		})
+		Expect(mux.OnMessage(func(w gosip.ResponseWriter, req sip.Request) {
+			Expect(w.Status()).To(BeZero())
+			Expect(w.Write(200, "OK", "")).To(Succeed())
+			Expect(w.Status()).To(Equal(sip.StatusCode(200)))
+		}, trace("message"))).To(Succeed())
+
+		conn, err := net.ListenPacket("udp", clientAddr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+		srvAddr, err := net.ResolveUDPAddr("udp", localTarget.Addr())
+		Expect(err).ShouldNot(HaveOccurred())
+
+		request := func(method sip.RequestMethod) sip.Response {
+			req := testutils.Request([]string{
+				string(method) + " sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+				"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+				"To: \"Bob\" <sip:bob@far-far-away.com>",
+				"Call-ID: mux-" + string(method),
+				"CSeq: 1 " + string(method),
+				"Content-Length: 0",
+				"",
+				"",
+			})
+			_, err := conn.WriteTo([]byte(req.String()), srvAddr)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			buf := make([]byte, transport.MTU)
+			num, _, err := conn.ReadFrom(buf)
+			Expect(err).ShouldNot(HaveOccurred())
+			msg, err := parser.ParseMessage(buf[:num], logger)
+			Expect(err).ShouldNot(HaveOccurred())
+			res, ok := msg.(sip.Response)
+			Expect(ok).Should(BeTrue())
+			return res
+		}
+
+		res := request(sip.MESSAGE)
+		Expect(int(res.StatusCode())).Should(Equal(200))
+		Expect(res.GetHeaders("Server")[0].Value()).Should(Equal("mux-test"))
+		mu.Lock()
+		Expect(calls).Should(Equal([]string{"global", "message"}))
+		mu.Unlock()
+
+		res = request(sip.SUBSCRIBE)
+		Expect(int(res.StatusCode())).Should(Equal(405))
+		allow := res.GetHeaders("Allow")
+		Expect(allow).Should(HaveLen(1))
+		Expect(allow[0].Value()).Should(ContainSubstring("MESSAGE"))
+		Expect(allow[0].Value()).ShouldNot(ContainSubstring("SUBSCRIBE"))
+	}, 3)
+
+	It("should report health and readiness of listeners and draining", func() {
+		Expect(srv.Health().OK).Should(BeTrue())
+
+		ready := srv.Ready()
+		Expect(ready.OK).Should(BeTrue())
+		Expect(ready.Checks).Should(ContainElement(gosip.HealthCheck{
+			Name:    "listeners",
+			OK:      true,
+			Details: "udp 127.0.0.1:5060 up; tcp 127.0.0.1:5060 up; ws 127.0.0.1:8080 up",
+		}))
+
+		// sockets of other servers and outgoing connections are not listeners of the server
+		eventbus.Default.Publish(&eventbus.ConnectionDownEvent{Network: "udp", LocalAddr: "127.0.0.2:5060"})
+		eventbus.Default.Publish(&eventbus.ConnectionDownEvent{Network: "udp", LocalAddr: "0.0.0.0:5060"})
+		eventbus.Default.Publish(&eventbus.ConnectionDownEvent{
+			Network:    "tcp",
+			LocalAddr:  "127.0.0.1:5060",
+			RemoteAddr: "127.0.0.1:5555",
+		})
+		Consistently(func() bool { return srv.Ready().OK }, 100*time.Millisecond).Should(BeTrue())
+
+		handler := gosip.NewHealthHandler(srv)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		Expect(rec.Code).Should(Equal(200))
+		Expect(rec.Body.String()).Should(ContainSubstring(`"ok":true`))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		Expect(srv.Drain(ctx)).Should(Succeed())
+		Expect(srv.Ready().OK).Should(BeFalse())
+		Expect(srv.Ready().Checks).Should(ContainElement(gosip.HealthCheck{
+			Name:    "listeners",
+			OK:      false,
+			Details: "no listeners",
+		}))
+		Expect(srv.Health().OK).Should(BeTrue())
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		Expect(rec.Code).Should(Equal(503))
+
+		srv.Shutdown()
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		Expect(rec.Code).Should(Equal(503))
+	}, 3)
+
+	Context("with profiler", func() {
+		var profiler latency.Profiler
+
+		BeforeEach(func() {
+			profiler = latency.NewProfiler(latency.Config{SlowThreshold: 10 * time.Millisecond}, logger)
+			srvConf.Profiler = profiler
+		})
+
+		AfterEach(func() {
+			srvConf.Profiler = nil
+		})
+
+		It("should report timings of pipeline stages", func(done Done) {
+			client1 = testutils.CreateClient("udp", localTarget.Addr(), clientAddr)
+			defer func() {
+				Expect(client1.Close()).To(BeNil())
+			}()
+			inviteReq = testutils.Request([]string{
+				"INVITE sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+				"From: \"Alice\" <sip:alice@wonderland.com>;tag=1928301774",
+				"To: \"Bob\" <sip:bob@far-far-away.com>",
+				"Call-ID: profiler-call",
+				"CSeq: 1 INVITE",
+				"Content-Length: 0",
+				"",
+				"",
+			})
+
+			Expect(srv.OnRequest(sip.INVITE, func(req sip.Request, tx sip.ServerTransaction) {
+				time.Sleep(20 * time.Millisecond)
+				res := sip.NewResponseFromRequest("", req, 486, "Busy Here", "")
+				Expect(tx.Respond(res)).To(Succeed())
+			})).To(BeNil())
+
+			testutils.WriteToConn(client1, []byte(inviteReq.String()))
+
+			Eventually(profiler.Stats).Should(HaveKey(gosip.StageHandler))
+			stats := profiler.Stats()
+			Expect(stats[gosip.StageHandler].Count).Should(BeEquivalentTo(1))
+			Expect(stats[gosip.StageHandler].P50).Should(BeNumerically(">=", 20*time.Millisecond))
+			Expect(stats).Should(HaveKey(gosip.StageParse))
+			Expect(stats).Should(HaveKey(gosip.StageTransaction))
+			Expect(stats).Should(HaveKey(gosip.StageSend))
+			close(done)
+		}, 3)
+	})
+})
+
+var _ = Describe("GoSIP New", func() {
+	logger := testutils.NewLogrusLogger()
+
+	It("should listen on the addresses and apply the options", func(done Done) {
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithUserAgent("Test UA"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5273"}),
+			gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+			gosip.WithResolver(net.DefaultResolver),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+		Expect(srv.Ready().Checks).Should(ContainElement(gosip.HealthCheck{
+			Name:    "listeners",
+			OK:      true,
+			Details: "udp 127.0.0.1:5273 up",
+		}))
+
+		peer, err := net.ListenPacket("udp", "127.0.0.1:5274")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer peer.Close()
+
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@127.0.0.1:5274 SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5273;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: new-options-call",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		start := time.Now()
+		// the peer never responds, so timer F = 64*T1 expires the transaction
+		_, err = srv.RequestWithContext(context.Background(), req)
+		Expect(errors.Is(err, sip.ErrTransactionTimeout)).Should(BeTrue())
+		var timeoutErr *sip.TransactionTimeout
+		Expect(errors.As(err, &timeoutErr)).Should(BeTrue())
+		Expect(timeoutErr.Method).Should(Equal(sip.OPTIONS))
+		Expect(time.Since(start)).Should(BeNumerically("<", 2*time.Second))
+
+		buf := make([]byte, 65535)
+		num, _, err := peer.ReadFrom(buf)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(buf[:num])).Should(ContainSubstring("User-Agent: Test UA"))
+		close(done)
+	}, 5)
+
+	It("should report failure of the listener socket", func() {
+		bus := eventbus.NewBus()
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5329"}),
+			gosip.WithEventBus(bus),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+		ready := func() []gosip.HealthCheck {
+			return srv.Ready().Checks
+		}
+		failed := gosip.HealthCheck{
+			Name:    "listeners",
+			OK:      false,
+			Details: "udp 127.0.0.1:5329 failed: socket closed",
+		}
+
+		// events of other servers are published to their buses
+		eventbus.Default.Publish(&eventbus.ConnectionDownEvent{Network: "udp", LocalAddr: "127.0.0.1:5329"})
+		bus.Publish(&eventbus.ConnectionDownEvent{Network: "udp", LocalAddr: "127.0.0.1:5330"})
+		Consistently(ready, 100*time.Millisecond).ShouldNot(ContainElement(failed))
+
+		bus.Publish(&eventbus.ConnectionDownEvent{Network: "udp", LocalAddr: "127.0.0.1:5329"})
+		Eventually(ready).Should(ContainElement(failed))
+	})
+
+	It("should publish events of transactions to the bus of the server", func() {
+		bus := eventbus.NewBus()
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5338"}),
+			gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+			gosip.WithEventBus(bus),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+
+		timeouts, others := make(chan eventbus.Event, 1), make(chan eventbus.Event, 1)
+		defer bus.Subscribe(func(ev eventbus.Event) {
+			select {
+			case timeouts <- ev:
+			default:
+			}
+		}, eventbus.TransactionTimeout)()
+		defer eventbus.Default.Subscribe(func(ev eventbus.Event) {
+			if ev.(*eventbus.TransactionTimeoutEvent).Method == sip.OPTIONS {
+				select {
+				case others <- ev:
+				default:
+				}
+			}
+		}, eventbus.TransactionTimeout)()
+
+		peer, err := net.ListenPacket("udp", "127.0.0.1:5339")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer peer.Close()
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@127.0.0.1:5339 SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5338;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=bus-tag",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: bus-call-id",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		_, err = srv.RequestWithContext(context.Background(), req)
+		Expect(errors.Is(err, sip.ErrTransactionTimeout)).Should(BeTrue())
+
+		Eventually(timeouts).Should(Receive())
+		Consistently(others, 100*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should return upgrade handler of WebSocket protocols only", func() {
+		srv, err := gosip.New(gosip.WithLogger(logger), gosip.WithHost("127.0.0.1"))
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+
+		handler, err := srv.UpgradeHandler("ws")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(handler).ShouldNot(BeNil())
+		_, err = srv.UpgradeHandler("udp")
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should fail on invalid listen address", func() {
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:bad"}),
+		)
+		Expect(err).Should(HaveOccurred())
+		Expect(srv).Should(BeNil())
+	})
+})
+
+var _ = Describe("GoSIP Reload", func() {
+	var (
+		srv    gosip.Server
+		client net.PacketConn
+	)
+
+	logger := testutils.NewLogrusLogger()
+	clientAddr := "127.0.0.1:5277"
+
+	options := func(network, via, callID string) string {
+		return testutils.Request([]string{
+			"OPTIONS sip:bob@127.0.0.1 SIP/2.0",
+			"Via: SIP/2.0/" + network + " " + via + ";branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: " + callID,
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}).String()
+	}
+	receive := func(conn net.Conn) string {
+		buf := make([]byte, 65535)
+		Expect(conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))).To(Succeed())
+		num, err := conn.Read(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:num])
+	}
+	request := func(addr, callID string) string {
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = client.WriteTo([]byte(options("UDP", clientAddr, callID)), raddr)
+		Expect(err).ShouldNot(HaveOccurred())
+		return receive(client.(net.Conn))
+	}
+
+	BeforeEach(func() {
+		var err error
+		srv, err = gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(
+				gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5275"},
+				gosip.ListenAddr{Network: "tcp", Addr: "127.0.0.1:5275"},
+			),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		client, err = net.ListenPacket("udp", clientAddr)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		srv.Shutdown()
+	}, 3)
+
+	It("should apply changed listeners and keep established connections", func() {
+		tcpConn, err := net.Dial("tcp", "127.0.0.1:5275")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer tcpConn.Close()
+		testutils.WriteToConn(tcpConn, []byte(options("TCP", tcpConn.LocalAddr().String(), "reload-tcp-1")))
+		Expect(receive(tcpConn)).Should(HavePrefix("SIP/2.0 200 OK"))
+
+		Expect(srv.Reload(gosip.ReloadConfig{
+			Listen: []gosip.ListenAddr{
+				{Network: "udp", Addr: "127.0.0.1:5275"},
+				{Network: "udp", Addr: "127.0.0.1:5276"},
+			},
+		})).To(Succeed())
+		Expect(srv.Ready().Checks).Should(ContainElement(gosip.HealthCheck{
+			Name:    "listeners",
+			OK:      true,
+			Details: "udp 127.0.0.1:5275 up; udp 127.0.0.1:5276 up",
+		}))
+
+		Expect(request("127.0.0.1:5275", "reload-udp-1")).Should(HavePrefix("SIP/2.0 200 OK"))
+		Expect(request("127.0.0.1:5276", "reload-udp-2")).Should(HavePrefix("SIP/2.0 200 OK"))
+
+		_, err = net.Dial("tcp", "127.0.0.1:5275")
+		Expect(err).Should(HaveOccurred())
+		testutils.WriteToConn(tcpConn, []byte(options("TCP", tcpConn.LocalAddr().String(), "reload-tcp-2")))
+		Expect(receive(tcpConn)).Should(HavePrefix("SIP/2.0 200 OK"))
+	})
+
+	It("should roll back listeners on failure", func() {
+		busy, err := net.ListenPacket("udp", "127.0.0.1:5276")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer busy.Close()
+
+		Expect(srv.Reload(gosip.ReloadConfig{
+			Listen: []gosip.ListenAddr{
+				{Network: "udp", Addr: "127.0.0.1:5276"},
+			},
+		})).ShouldNot(Succeed())
+		Expect(srv.Ready().Checks).Should(ContainElement(gosip.HealthCheck{
+			Name:    "listeners",
+			OK:      true,
+			Details: "udp 127.0.0.1:5275 up; tcp 127.0.0.1:5275 up",
+		}))
+		Expect(request("127.0.0.1:5275", "reload-rollback")).Should(HavePrefix("SIP/2.0 200 OK"))
+	})
+
+	It("should stop listener started with context when the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		Expect(srv.ListenContext(ctx, "udp", "127.0.0.1:5276")).To(Succeed())
+		Expect(request("127.0.0.1:5276", "reload-ctx-1")).Should(HavePrefix("SIP/2.0 200 OK"))
+
+		cancel()
+		Eventually(func() []gosip.HealthCheck {
+			return srv.Ready().Checks
+		}, 2).Should(ContainElement(gosip.HealthCheck{
+			Name:    "listeners",
+			OK:      true,
+			Details: "udp 127.0.0.1:5275 up; tcp 127.0.0.1:5275 up",
+		}))
+		Expect(request("127.0.0.1:5276", "reload-ctx-2")).Should(BeEmpty())
+	})
+
+	It("should apply ACL to the incoming messages", func() {
+		listen := []gosip.ListenAddr{{Network: "udp", Addr: "127.0.0.1:5275"}}
+		Expect(srv.Reload(gosip.ReloadConfig{
+			Listen: listen,
+			ACL:    &gosip.ACL{Allow: []string{"10.0.0.0/8"}},
+		})).To(Succeed())
+		Expect(request("127.0.0.1:5275", "reload-acl-1")).Should(BeEmpty())
+
+		Expect(srv.Reload(gosip.ReloadConfig{
+			Listen: listen,
+			ACL:    &gosip.ACL{Allow: []string{"127.0.0.0/8"}, Deny: []string{"10.0.0.1"}},
+		})).To(Succeed())
+		Expect(request("127.0.0.1:5275", "reload-acl-2")).Should(HavePrefix("SIP/2.0 200 OK"))
+
+		Expect(srv.Reload(gosip.ReloadConfig{
+			Listen: listen,
+			ACL:    &gosip.ACL{Deny: []string{"bad"}},
+		})).ShouldNot(Succeed())
+	})
+
+	It("should restart TLS listeners on the certificate rotated in place", func() {
+		dir, err := ioutil.TempDir("", "gosip-reload")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		config := gosip.ReloadConfig{
+			Listen:    []gosip.ListenAddr{{Network: "tls", Addr: "127.0.0.1:5334"}},
+			TLSConfig: &transport.TLSConfig{Cert: certFile, Key: keyFile},
+		}
+		serial := func() int64 {
+			conn, err := tls.Dial("tcp", "127.0.0.1:5334", &tls.Config{InsecureSkipVerify: true})
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+		}
+
+		writeTestCert(certFile, keyFile, 1)
+		Expect(srv.Reload(config)).To(Succeed())
+		Expect(serial()).To(Equal(int64(1)))
+
+		writeTestCert(certFile, keyFile, 2)
+		Expect(srv.Reload(config)).To(Succeed())
+		Expect(serial()).To(Equal(int64(2)))
+	})
+})
+
+// writeTestCert writes the self-signed certificate of 127.0.0.1 and its key.
+func writeTestCert(certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ShouldNot(HaveOccurred())
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, &x509.Certificate{SerialNumber: big.NewInt(serial)}, &key.PublicKey, key)
+	Expect(err).ShouldNot(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ShouldNot(HaveOccurred())
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+}
+
+var _ = Describe("GoSIP Wait", func() {
+	logger := testutils.NewLogrusLogger()
+
+	It("should not leak goroutines across restarts", func(done Done) {
+		defer close(done)
+
+		start := func() gosip.Server {
+			srv, err := gosip.New(
+				gosip.WithLogger(logger),
+				gosip.WithHost("127.0.0.1"),
+				gosip.WithListenAddrs(
+					gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5280"},
+					gosip.ListenAddr{Network: "tcp", Addr: "127.0.0.1:5280"},
+				),
+			)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+				Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+			})).To(Succeed())
+
+			conn, err := net.Dial("tcp", "127.0.0.1:5280")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+			testutils.WriteToConn(conn, []byte(testutils.Request([]string{
+				"OPTIONS sip:bob@127.0.0.1 SIP/2.0",
+				"Via: SIP/2.0/TCP " + conn.LocalAddr().String() + ";branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@127.0.0.1>;tag=1928301774",
+				"To: <sip:bob@127.0.0.1>",
+				"Call-ID: wait-options-call",
+				"CSeq: 1 OPTIONS",
+				"Content-Length: 0",
+				"",
+				"",
+			}).String()))
+			buf := make([]byte, 65535)
+			Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			num, err := conn.Read(buf)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(buf[:num])).Should(HavePrefix("SIP/2.0 200 OK"))
+
+			return srv
+		}
+
+		// the first run warms up lazily started goroutines of the runtime and dependencies
+		srv := start()
+		srv.Shutdown()
+		srv.Wait()
+		before := runtime.NumGoroutine()
+
+		for i := 0; i < 3; i++ {
+			srv = start()
+			srv.Shutdown()
+			srv.Wait()
+		}
+
+		Eventually(runtime.NumGoroutine, 1).Should(BeNumerically("<=", before))
+	}, 10)
+})
+
+var _ = Describe("GoSIP Tenants", func() {
+	var (
+		tenants gosip.Tenants
+		client  net.PacketConn
+	)
+
+	logger := testutils.NewLogrusLogger()
+	clientAddr := "127.0.0.1:5283"
+
+	request := func(addr, callID string) string {
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = client.WriteTo([]byte(testutils.Request([]string{
+			"OPTIONS sip:bob@127.0.0.1 SIP/2.0",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: " + callID,
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}).String()), raddr)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		buf := make([]byte, 65535)
+		Expect(client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))).To(Succeed())
+		num, _, err := client.ReadFrom(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:num])
+	}
+	add := func(tenant, addr string) {
+		srv, err := tenants.Add(tenant, gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: addr}))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+			res.AppendHeader(&sip.GenericHeader{HeaderName: "X-Tenant", Contents: gosip.MessageTenant(req)})
+			Expect(tx.Respond(res)).To(Succeed())
+		})).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tenants = gosip.NewTenants(gosip.WithLogger(logger), gosip.WithHost("127.0.0.1"))
+		client, err = net.ListenPacket("udp", clientAddr)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		tenants.Shutdown()
+	}, 3)
+
+	It("should serve tenants by separate stacks", func() {
+		add("acme", "127.0.0.1:5281")
+		add("globex", "127.0.0.1:5282")
+		Expect(tenants.List()).Should(Equal([]string{"acme", "globex"}))
+
+		_, err := tenants.Add("acme")
+		Expect(err).Should(HaveOccurred())
+
+		Expect(request("127.0.0.1:5281", "tenant-1")).Should(ContainSubstring("X-Tenant: acme"))
+		Expect(request("127.0.0.1:5282", "tenant-2")).Should(ContainSubstring("X-Tenant: globex"))
+
+		Expect(tenants.Remove("acme")).To(Succeed())
+		_, ok := tenants.Get("acme")
+		Expect(ok).Should(BeFalse())
+		Expect(request("127.0.0.1:5281", "tenant-3")).Should(BeEmpty())
+		Expect(request("127.0.0.1:5282", "tenant-4")).Should(ContainSubstring("X-Tenant: globex"))
+
+		// the listener of the removed tenant is released
+		add("acme", "127.0.0.1:5281")
+		Expect(request("127.0.0.1:5281", "tenant-5")).Should(ContainSubstring("X-Tenant: acme"))
+	})
+
+	It("should check connections of each tenant only", func() {
+		add("acme", "127.0.0.1:5281")
+		_, err := tenants.Add("globex", gosip.WithListenAddrs(
+			gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5282"},
+			gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5337"},
+		))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		connections := func(tenant string) gosip.HealthCheck {
+			srv, ok := tenants.Get(tenant)
+			Expect(ok).Should(BeTrue())
+			for _, check := range srv.Ready().Checks {
+				if check.Name == "connections" {
+					return check
+				}
+			}
+			return gosip.HealthCheck{}
+		}
+		Expect(connections("acme")).Should(Equal(gosip.HealthCheck{Name: "connections", OK: true, Details: "1"}))
+		Expect(connections("globex")).Should(Equal(gosip.HealthCheck{Name: "connections", OK: true, Details: "2"}))
+	})
+})
+
+var _ = Describe("GoSIP Admission", func() {
+	var (
+		srv      gosip.Server
+		client   net.PacketConn
+		admitted chan gosip.AdmissionRequest
+	)
+
+	logger := testutils.NewLogrusLogger()
+	clientAddr := "127.0.0.1:5285"
+
+	request := func(method sip.RequestMethod) string {
+		raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:5284")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = client.WriteTo([]byte(testutils.Request([]string{
+			string(method) + " sip:bob@127.0.0.1 SIP/2.0",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: admission-" + string(method),
+			"CSeq: 1 " + string(method),
+			"Content-Length: 0",
+			"",
+			"",
+		}).String()), raddr)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		buf := make([]byte, 65535)
+		Expect(client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))).To(Succeed())
+		num, _, err := client.ReadFrom(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:num])
+	}
+
+	BeforeEach(func() {
+		admitted = make(chan gosip.AdmissionRequest, 10)
+		rateLimit := gosip.AdmissionFunc(func(req gosip.AdmissionRequest) gosip.AdmissionDecision {
+			if req.Request.IsInvite() {
+				return gosip.Reject(503, "", &sip.GenericHeader{HeaderName: "Retry-After", Contents: "30"})
+			}
+			return gosip.Accept()
+		})
+		auth := gosip.AdmissionFunc(func(req gosip.AdmissionRequest) gosip.AdmissionDecision {
+			if req.Request.Method() == sip.REGISTER {
+				return gosip.Challenge(&sip.GenericHeader{
+					HeaderName: "WWW-Authenticate",
+					Contents:   `Digest realm="example.com", nonce="abc"`,
+				})
+			}
+			admitted <- req
+			return gosip.Accept()
+		})
+
+		var err error
+		srv, err = gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5284"}),
+			gosip.WithAdmission(gosip.ChainAdmission(rateLimit, auth)),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		client, err = net.ListenPacket("udp", clientAddr)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		srv.Shutdown()
+	}, 3)
+
+	It("should apply the policy before transactions", func() {
+		res := request(sip.INVITE)
+		Expect(res).Should(HavePrefix("SIP/2.0 503 Service Unavailable"))
+		Expect(res).Should(ContainSubstring("Retry-After: 30"))
+
+		res = request(sip.REGISTER)
+		Expect(res).Should(HavePrefix("SIP/2.0 401 Unauthorized"))
+		Expect(res).Should(ContainSubstring(`WWW-Authenticate: Digest realm="example.com", nonce="abc"`))
+
+		Expect(request(sip.OPTIONS)).Should(HavePrefix("SIP/2.0 200 OK"))
+		var req gosip.AdmissionRequest
+		Eventually(admitted).Should(Receive(&req))
+		Expect(req.Source).Should(Equal(clientAddr))
+		Expect(req.Transport).Should(Equal("UDP"))
+		Expect(req.Connection).ShouldNot(BeEmpty())
+	})
+})
+
+var _ = Describe("GoSIP Source Validation", func() {
+	var (
+		srv             gosip.Server
+		client, spoofer net.PacketConn
+	)
+
+	logger := testutils.NewLogrusLogger()
+	request := func(conn net.PacketConn, authorization string) string {
+		raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:5315")
+		Expect(err).ShouldNot(HaveOccurred())
+		lines := []string{
+			"OPTIONS sip:bob@127.0.0.1 SIP/2.0",
+			"Via: SIP/2.0/UDP " + conn.LocalAddr().String() + ";branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+		}
+		if authorization != "" {
+			lines = append(lines, "Authorization: "+authorization)
+		}
+		_, err = conn.WriteTo([]byte(testutils.Request(append(lines, "Content-Length: 0", "", "")).String()), raddr)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		buf := make([]byte, 65535)
+		Expect(conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))).To(Succeed())
+		num, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:num])
+	}
+	nonce := func(res string) string {
+		msg, err := parser.ParseMessage([]byte(res), logger)
+		Expect(err).ShouldNot(HaveOccurred())
+		hdrs := msg.GetHeaders("WWW-Authenticate")
+		Expect(hdrs).Should(HaveLen(1))
+		challenge := sip.AuthFromValue(hdrs[0].Value())
+		Expect(challenge.Realm()).Should(Equal("edge"))
+
+		return challenge.Nonce()
+	}
+
+	BeforeEach(func() {
+		var err error
+		srv, err = gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5315"}),
+			gosip.WithSourceValidation(gosip.SourceValidationConfig{Realm: "edge"}),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		client, err = net.ListenPacket("udp", "127.0.0.1:5316")
+		Expect(err).ShouldNot(HaveOccurred())
+		spoofer, err = net.ListenPacket("udp", "127.0.0.1:5317")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		spoofer.Close()
+		srv.Shutdown()
+	}, 3)
+
+	It("should challenge new sources before transactions", func() {
+		res := request(client, "")
+		Expect(res).Should(HavePrefix("SIP/2.0 401 Unauthorized"))
+		issued := nonce(res)
+
+		authorization := `Digest username="alice",realm="edge",nonce="` + issued +
+			`",uri="sip:bob@127.0.0.1",response="00000000000000000000000000000000"`
+		// the nonce is signed for the address of the client
+		Expect(request(spoofer, authorization)).Should(HavePrefix("SIP/2.0 401 Unauthorized"))
+
+		Expect(request(client, authorization)).Should(HavePrefix("SIP/2.0 200 OK"))
+		// the validated source is not challenged anymore
+		Expect(request(client, "")).Should(HavePrefix("SIP/2.0 200 OK"))
+		Expect(request(spoofer, "")).Should(HavePrefix("SIP/2.0 401 Unauthorized"))
+	})
+})
+
+var _ = Describe("GoSIP Sips Policy", func() {
+	logger := testutils.NewLogrusLogger()
+	request := func(conn net.Conn, ruri string, headers ...string) string {
+		lines := append([]string{
+			"OPTIONS " + ruri + " SIP/2.0",
+			"Via: SIP/2.0/" + strings.ToUpper(conn.LocalAddr().Network()) + " " + conn.LocalAddr().String() +
+				";branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+		}, headers...)
+		_, err := conn.Write([]byte(testutils.Request(append(lines, "Content-Length: 0", "", "")).String()))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		buf := make([]byte, 65535)
+		Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		num, err := conn.Read(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:num])
+	}
+	newServer := func(policy gosip.SipsPolicy, options ...gosip.ServerOption) gosip.Server {
+		srv, err := gosip.New(append([]gosip.ServerOption{
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5318"}),
+			gosip.WithSips(policy),
+		}, options...)...)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		return srv
+	}
+	dialUDP := func() net.Conn {
+		conn, err := net.Dial("udp", "127.0.0.1:5318")
+		Expect(err).ShouldNot(HaveOccurred())
+		return conn
+	}
+
+	It("should reject SIPS requests received over insecure transport", func() {
+		srv := newServer(gosip.SipsPolicy{})
+		defer srv.Shutdown()
+		conn := dialUDP()
+		defer conn.Close()
+
+		Expect(request(conn, "sips:bob@127.0.0.1")).Should(HavePrefix("SIP/2.0 416 Unsupported URI Scheme"))
+		Expect(request(conn, "sip:bob@127.0.0.1")).Should(HavePrefix("SIP/2.0 200 OK"))
+	})
+
+	It("should reject all requests received over insecure transport in TLS only mode", func() {
+		srv := newServer(gosip.SipsPolicy{TLSOnly: true})
+		defer srv.Shutdown()
+		conn := dialUDP()
+		defer conn.Close()
+
+		Expect(request(conn, "sip:bob@127.0.0.1")).Should(HavePrefix("SIP/2.0 403 TLS Required"))
+	})
+
+	It("should reject SIPS requests routed over insecure hops", func() {
+		dir, err := ioutil.TempDir("", "gosip-sips")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		writeTestCert(certFile, keyFile, 1)
+
+		srv := newServer(gosip.SipsPolicy{},
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "tls", Addr: "127.0.0.1:5319"}),
+			gosip.WithTLSConfig(transport.TLSConfig{Cert: certFile, Key: keyFile}),
+		)
+		defer srv.Shutdown()
+		conn, err := tls.Dial("tcp", "127.0.0.1:5319", &tls.Config{InsecureSkipVerify: true})
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+
+		Expect(request(conn, "sips:bob@127.0.0.1", "Record-Route: <sip:proxy.example.com;lr;transport=udp>")).
+			Should(HavePrefix("SIP/2.0 403 Insecure Route"))
+		Expect(request(conn, "sips:bob@127.0.0.1", "Record-Route: <sip:proxy.example.com;lr;transport=tls>")).
+			Should(HavePrefix("SIP/2.0 200 OK"))
+	})
+})
+
+// limitObserver records limit violations and parse errors of the server.
+type limitObserver struct {
+	mu          sync.Mutex
+	errs        []*gosip.MessageLimitError
+	parseErrors int
+}
+
+func (o *limitObserver) MessageReceived(msg sip.Message) {}
+func (o *limitObserver) MessageSent(msg sip.Message)     {}
+func (o *limitObserver) Retransmission(msg sip.Message)  {}
+func (o *limitObserver) TransactionCompleted(method sip.RequestMethod, client bool, duration time.Duration) {
+}
+func (o *limitObserver) DNSFailure(err error) {}
+func (o *limitObserver) ParseError(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.parseErrors++
+}
+func (o *limitObserver) LimitExceeded(err *gosip.MessageLimitError) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.errs = append(o.errs, err)
+}
+func (o *limitObserver) Errors() []*gosip.MessageLimitError {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*gosip.MessageLimitError(nil), o.errs...)
+}
+func (o *limitObserver) ParseErrors() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.parseErrors
+}
+
+var _ = Describe("GoSIP Message Limits", func() {
+	var (
+		srv      gosip.Server
+		conn     net.Conn
+		observer *limitObserver
+	)
+
+	logger := testutils.NewLogrusLogger()
+	request := func(ruri string, headers ...string) string {
+		lines := append([]string{
+			"OPTIONS " + ruri + " SIP/2.0",
+			"Via: SIP/2.0/UDP " + conn.LocalAddr().String() + ";branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+		}, headers...)
+		_, err := conn.Write([]byte(testutils.Request(append(lines, "Content-Length: 0", "", "")).String()))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		buf := make([]byte, 65535)
+		Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		num, err := conn.Read(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:num])
+	}
+
+	BeforeEach(func() {
+		var err error
+		observer = &limitObserver{}
+		srv, err = gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(
+				gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5320"},
+				gosip.ListenAddr{Network: "tcp", Addr: "127.0.0.1:5331"},
+			),
+			gosip.WithMessageLimits(gosip.MessageLimits{MaxHeaders: 10, MaxHeaderLength: 100, MaxUriLength: 50}),
+			gosip.WithMetrics(observer),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		conn, err = net.Dial("udp", "127.0.0.1:5320")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		srv.Shutdown()
+	})
+
+	It("should admit requests within limits", func() {
+		Expect(request("sip:bob@127.0.0.1")).Should(HavePrefix("SIP/2.0 200 OK"))
+		Expect(observer.Errors()).To(BeEmpty())
+	})
+
+	It("should reject requests with too many headers", func() {
+		headers := make([]string, 0)
+		for i := 0; i < 5; i++ {
+			headers = append(headers, "X-Bomb: "+strconv.Itoa(i))
+		}
+
+		Expect(request("sip:bob@127.0.0.1", headers...)).Should(HavePrefix("SIP/2.0 513 Message Too Large"))
+		Expect(observer.Errors()).To(HaveLen(1))
+		Expect(observer.Errors()[0].Limit).To(Equal(gosip.LimitHeaders))
+		Expect(observer.Errors()[0].Source).To(Equal(conn.LocalAddr().String()))
+		Expect(observer.ParseErrors()).To(BeZero())
+	})
+
+	It("should reject requests with too long header", func() {
+		Expect(request("sip:bob@127.0.0.1", "Subject: "+strings.Repeat("a", 101))).
+			Should(HavePrefix("SIP/2.0 513 Message Too Large"))
+	})
+
+	It("should reject requests with too long URI", func() {
+		Expect(request("sip:" + strings.Repeat("b", 50) + "@127.0.0.1")).
+			Should(HavePrefix("SIP/2.0 414 Request-URI Too Long"))
+		Expect(request("sip:bob@127.0.0.1", "Contact: <sip:"+strings.Repeat("c", 50)+"@127.0.0.1>")).
+			Should(HavePrefix("SIP/2.0 400 Bad Request"))
+		Expect(observer.Errors()).To(HaveLen(2))
+	})
+
+	It("should drop responses over limits", func() {
+		_, err := conn.Write([]byte(strings.Join([]string{
+			"SIP/2.0 200 OK",
+			"Via: SIP/2.0/UDP 127.0.0.1:5320;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>;tag=a6c85cf",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"Subject: " + strings.Repeat("a", 101),
+			"Content-Length: 0",
+			"",
+			"",
+		}, "\r\n")))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Eventually(observer.Errors, time.Second).Should(HaveLen(1))
+		Expect(observer.Errors()[0].Limit).To(Equal(gosip.LimitHeaderLength))
+		Expect(observer.Errors()[0].Msg).To(BeAssignableToTypeOf(sip.NewResponse("", "SIP/2.0", 200, "OK", nil, "", nil)))
+	})
+
+	It("should keep framing of TCP stream after request over limits", func() {
+		tcpConn, err := net.Dial("tcp", "127.0.0.1:5331")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer tcpConn.Close()
+
+		request := func(subject string) string {
+			return strings.Join([]string{
+				"OPTIONS sip:bob@127.0.0.1 SIP/2.0",
+				"Via: SIP/2.0/TCP " + tcpConn.LocalAddr().String() + ";branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@127.0.0.1>;tag=1928301774",
+				"To: <sip:bob@127.0.0.1>",
+				"Call-ID: " + sip.GenerateBranch(),
+				"CSeq: 1 OPTIONS",
+				"Subject: " + subject,
+				"Content-Length: 0",
+				"",
+				"",
+			}, "\r\n")
+		}
+		_, err = tcpConn.Write([]byte(request(strings.Repeat("a", 100000)) + request("hi")))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var data string
+		buf := make([]byte, 65535)
+		Expect(tcpConn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		for !strings.Contains(data, "SIP/2.0 200 OK") {
+			num, err := tcpConn.Read(buf)
+			Expect(err).ShouldNot(HaveOccurred())
+			data += string(buf[:num])
+		}
+		Expect(data).To(HavePrefix("SIP/2.0 513 Message Too Large"))
+		Expect(observer.Errors()).To(HaveLen(1))
+	})
+})
+
+// connectionObserver records completed transactions and counters of open connections of servers.
+type connectionObserver struct {
+	limitObserver
+	completed int
+	counters  map[int]func() map[string]int
+	next      int
+}
+
+func (o *connectionObserver) TransactionCompleted(method sip.RequestMethod, client bool, duration time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.completed++
+}
+func (o *connectionObserver) ObserveConnections(counter func() map[string]int) func() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	id := o.next
+	o.next++
+	o.counters[id] = counter
+	return func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		delete(o.counters, id)
+	}
+}
+func (o *connectionObserver) Completed() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.completed
+}
+func (o *connectionObserver) Connections() []map[string]int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	counts := make([]map[string]int, 0)
+	for _, counter := range o.counters {
+		counts = append(counts, counter())
+	}
+	return counts
+}
+
+var _ = Describe("GoSIP Observer", func() {
+	logger := testutils.NewLogrusLogger()
+
+	It("should report transactions and connections of the server", func() {
+		observer := &connectionObserver{counters: make(map[int]func() map[string]int)}
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "tcp", Addr: "127.0.0.1:5335"}),
+			gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+			gosip.WithMetrics(observer),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+		// other servers of the process are not counted
+		other, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5336"}),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer other.Shutdown()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:5335")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte(strings.Join([]string{
+			"OPTIONS sip:bob@127.0.0.1 SIP/2.0",
+			"Via: SIP/2.0/TCP " + conn.LocalAddr().String() + ";branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}, "\r\n")))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Eventually(observer.Completed, 2*time.Second).Should(Equal(1))
+		Expect(observer.Connections()).To(Equal([]map[string]int{{"TCP": 1}}))
+
+		srv.Shutdown()
+		Expect(observer.Connections()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("GoSIP Response Routing", func() {
+	var (
+		client          net.PacketConn
+		local, external net.PacketConn
+	)
+
+	logger := testutils.NewLogrusLogger()
+	// the request is sent from 127.0.0.1:5322 with sent-by 127.0.0.2:5323 without rport
+	request := func(routing gosip.ResponseRoutingConfig) string {
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5321"}),
+			gosip.WithResponseRouting(routing),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		req := testutils.Request([]string{
+			"OPTIONS sip:bob@127.0.0.1 SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.2:5323;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.2>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:5321")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = client.WriteTo([]byte(req.String()), raddr)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		type received struct {
+			conn string
+			data string
+		}
+		results := make(chan received, 3)
+		for name, conn := range map[string]net.PacketConn{"client": client, "local": local, "external": external} {
+			go func(name string, conn net.PacketConn) {
+				buf := make([]byte, 65535)
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				if num, _, err := conn.ReadFrom(buf); err == nil {
+					results <- received{name, string(buf[:num])}
+				}
+			}(name, conn)
+		}
+
+		select {
+		case res := <-results:
+			Expect(res.data).Should(HavePrefix("SIP/2.0 200 OK"))
+			return res.conn
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		client, err = net.ListenPacket("udp", "127.0.0.1:5322")
+		Expect(err).ShouldNot(HaveOccurred())
+		local, err = net.ListenPacket("udp", "127.0.0.1:5323")
+		Expect(err).ShouldNot(HaveOccurred())
+		external, err = net.ListenPacket("udp", "127.0.0.2:5323")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		local.Close()
+		external.Close()
+	})
+
+	It("should send responses to the received address and sent-by port by default", func() {
+		Expect(request(gosip.ResponseRoutingConfig{})).To(Equal("local"))
+	})
+
+	It("should send responses to the sent-by address", func() {
+		Expect(request(gosip.ResponseRoutingConfig{Routing: gosip.RouteToSentBy})).To(Equal("external"))
+	})
+
+	It("should send responses to the source address", func() {
+		Expect(request(gosip.ResponseRoutingConfig{Routing: gosip.RouteToSource})).To(Equal("client"))
+	})
+
+	It("should route responses to peers by exceptions", func() {
+		Expect(request(gosip.ResponseRoutingConfig{
+			Routing: gosip.RouteToSentBy,
+			Exceptions: []gosip.ResponseRoutingRule{
+				{Peers: []string{"10.0.0.0/8"}, Routing: gosip.RouteToReceived},
+				{Peers: []string{"127.0.0.0/8"}, Routing: gosip.RouteToSource},
+			},
+		})).To(Equal("client"))
+	})
+
+	It("should reject invalid peers of exceptions", func() {
+		_, err := gosip.New(gosip.WithResponseRouting(gosip.ResponseRoutingConfig{
+			Exceptions: []gosip.ResponseRoutingRule{{Peers: []string{"peer.example.com"}}},
+		}))
+		Expect(err).Should(HaveOccurred())
+	})
+})
+
+var _ = Describe("GoSIP Normalizer", func() {
+	logger := testutils.NewLogrusLogger()
+
+	It("should repair datagrams of broken peers before parsing", func() {
+		n, err := normalize.NewNormalizer(normalize.Config{
+			Rules: []normalize.Rule{{
+				Sources: []string{"127.0.0.1"},
+				Profile: normalize.Profile{Name: "legacy-pbx", Repairs: normalize.RepairAll},
+			}},
+		}, logger)
+		Expect(err).ShouldNot(HaveOccurred())
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5324"}),
+			gosip.WithNormalizer(n),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		conn, err := net.Dial("udp", "127.0.0.1:5324")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte(strings.Join([]string{
+			"OPTIONS sip:bob@127.0.0.1 SIP/2.0",
+			"Via: SIP/2.0/UDP " + conn.LocalAddr().String() + ";rport;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 10",
+			"",
+			"",
+		}, "\n")))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		buf := make([]byte, 65535)
+		Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		num, err := conn.Read(buf)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(buf[:num])).Should(HavePrefix("SIP/2.0 200 OK"))
+		Expect(n.Repaired()).To(Equal(uint64(1)))
+	})
+})
+
+var _ = Describe("GoSIP Auto Headers", func() {
+	var client net.PacketConn
+
+	logger := testutils.NewLogrusLogger()
+	clientAddr := "127.0.0.1:5287"
+
+	newServer := func(options ...gosip.ServerOption) gosip.Server {
+		srv, err := gosip.New(append([]gosip.ServerOption{
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5286"}),
+			gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+		}, options...)...)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		return srv
+	}
+
+	handleOptions := func(srv gosip.Server) {
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+	}
+
+	read := func() string {
+		buf := make([]byte, 65535)
+		Expect(client.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		num, _, err := client.ReadFrom(buf)
+		Expect(err).ShouldNot(HaveOccurred())
+		return string(buf[:num])
+	}
+
+	options := func() string {
+		raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:5286")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = client.WriteTo([]byte(testutils.Request([]string{
+			"OPTIONS sip:bob@127.0.0.1 SIP/2.0",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: user-agent-options",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}).String()), raddr)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		return read()
+	}
+
+	BeforeEach(func() {
+		var err error
+		client, err = net.ListenPacket("udp", clientAddr)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+	})
+
+	It("should stamp User-Agent on requests and Server on responses", func() {
+		srv := newServer(gosip.WithUserAgent("Test UA"), gosip.WithServerName("Test Server"))
+		defer srv.Shutdown()
+		handleOptions(srv)
+
+		res := options()
+		Expect(res).Should(HavePrefix("SIP/2.0 200 OK"))
+		Expect(res).Should(ContainSubstring("Server: Test Server"))
+		Expect(res).ShouldNot(ContainSubstring("User-Agent"))
+
+		req := testutils.Request([]string{
+			"OPTIONS sip:alice@" + clientAddr + " SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5286;branch=" + sip.GenerateBranch(),
+			"From: <sip:bob@127.0.0.1>;tag=user-agent-tag",
+			"To: <sip:alice@127.0.0.1>",
+			"Call-ID: user-agent-request",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		go srv.RequestWithContext(ctx, req, gosip.WithRequestUserAgent("Custom UA"))
+		Expect(read()).Should(ContainSubstring("User-Agent: Custom UA"))
+	})
+
+	It("should advertise capabilities of registered handlers", func() {
+		srv := newServer(gosip.WithExtensions("timer", "100rel"), gosip.WithAccept("application/sdp", "text/plain"))
+		defer srv.Shutdown()
+		handleOptions(srv)
+
+		res := options()
+		Expect(res).Should(ContainSubstring("Allow: OPTIONS\r\n"))
+		Expect(res).Should(ContainSubstring("Supported: timer, 100rel\r\n"))
+		Expect(res).Should(ContainSubstring("Accept: application/sdp, text/plain\r\n"))
+
+		handler := func(req sip.Request, tx sip.ServerTransaction) {}
+		Expect(srv.OnRequest(sip.MESSAGE, handler)).To(Succeed())
+		Expect(srv.OnRequest(sip.INVITE, handler)).To(Succeed())
+
+		res = options()
+		Expect(res).Should(ContainSubstring("Allow: ACK, CANCEL, INVITE, MESSAGE, OPTIONS\r\n"))
+	})
+
+	It("should not stamp hidden User-Agent", func() {
+		srv := newServer(gosip.WithUserAgent("Test UA"), gosip.WithHiddenUserAgent())
+		defer srv.Shutdown()
+		handleOptions(srv)
+
+		res := options()
+		Expect(res).Should(HavePrefix("SIP/2.0 200 OK"))
+		Expect(res).ShouldNot(ContainSubstring("Server:"))
+		Expect(res).ShouldNot(ContainSubstring("Test UA"))
+	})
+
+	It("should answer OPTIONS by the responder unless the handler is registered", func() {
+		srv := newServer(
+			gosip.WithAccept("application/sdp"),
+			gosip.WithOptionsResponder(gosip.OptionsResponder{Body: "v=0\r\n"}),
+		)
+		defer srv.Shutdown()
+
+		res := options()
+		Expect(res).Should(HavePrefix("SIP/2.0 200 OK"))
+		Expect(res).Should(ContainSubstring("Allow: OPTIONS\r\n"))
+		Expect(res).Should(ContainSubstring("Accept: application/sdp\r\n"))
+		Expect(res).Should(ContainSubstring("Content-Type: application/sdp\r\n"))
+		Expect(res).Should(HaveSuffix("\r\n\r\nv=0\r\n"))
+
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 486, "Busy Here", ""))).To(Succeed())
+		})).To(Succeed())
+
+		Expect(options()).Should(HavePrefix("SIP/2.0 486 Busy Here"))
+	})
+})
+
+var _ = Describe("GoSIP Symmetric", func() {
+	It("should send in-dialog requests to the source address of the peer", func() {
+		logger := testutils.NewLogrusLogger()
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5288"}),
+			gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+			gosip.WithSymmetric(),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+		Expect(srv.OnRequest(sip.INVITE, func(req sip.Request, tx sip.ServerTransaction) {
+			res := sip.NewResponseFromRequest("", req, 200, "OK", "")
+			res.AppendHeader(&sip.GenericHeader{HeaderName: "Contact", Contents: "<sip:bob@127.0.0.1:5288>"})
+			Expect(tx.Respond(res)).To(Succeed())
+		})).To(Succeed())
+
+		// the peer is behind NAT and advertises its private address
+		client, err := net.ListenPacket("udp", "127.0.0.1:5289")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		read := func() string {
+			buf := make([]byte, 65535)
+			Expect(client.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			num, _, err := client.ReadFrom(buf)
+			Expect(err).ShouldNot(HaveOccurred())
+			return string(buf[:num])
+		}
+
+		raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:5288")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = client.WriteTo([]byte(testutils.Request([]string{
+			"INVITE sip:bob@127.0.0.1:5288 SIP/2.0",
+			"Via: SIP/2.0/UDP 192.168.0.10:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=symmetric-tag",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: symmetric-call",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@192.168.0.10:5060>",
+			"Content-Length: 0",
+			"",
+			"",
+		}).String()), raddr)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(read()).Should(HavePrefix("SIP/2.0 200 OK"))
+
+		bye := testutils.Request([]string{
+			"BYE sip:alice@192.168.0.10:5060 SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5288;branch=" + sip.GenerateBranch(),
+			"From: <sip:bob@127.0.0.1>;tag=bob-tag",
+			"To: <sip:alice@127.0.0.1>;tag=symmetric-tag",
+			"Call-ID: symmetric-call",
+			"CSeq: 1 BYE",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		_, err = srv.Request(bye)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(read()).Should(HavePrefix("BYE sip:alice@192.168.0.10:5060 SIP/2.0"))
+	})
+})
+
+var _ = Describe("GoSIP Stray Responses", func() {
+	It("should drop responses that do not echo the request", func() {
+		logger := testutils.NewLogrusLogger()
+		reasons := make(chan transaction.StrayResponseReason, 2)
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5313"}),
+			gosip.WithStrayResponseHandler(func(res sip.Response, err error) {
+				var serr *transaction.StrayResponseError
+				Expect(errors.As(err, &serr)).To(BeTrue())
+				Expect(serr.Response).To(Equal(res))
+				reasons <- serr.Reason
+			}),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+
+		peer, err := net.ListenPacket("udp", "127.0.0.1:5314")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer peer.Close()
+		go func() {
+			defer GinkgoRecover()
+
+			buf := make([]byte, 65535)
+			num, raddr, err := peer.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, err := parser.ParseMessage(buf[:num], logger)
+			Expect(err).ShouldNot(HaveOccurred())
+			req := msg.(sip.Request)
+			send := func(res sip.Response) {
+				_, err := peer.WriteTo([]byte(res.String()), raddr)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			// spoofed response guessed the branch but not the sent-by
+			spoofed := sip.NewResponseFromRequest("", req, 200, "OK", "")
+			viaHop, _ := spoofed.ViaHop()
+			port := sip.Port(5399)
+			viaHop.Port = &port
+			send(spoofed)
+			// response of the unknown transaction
+			unknown := sip.NewResponseFromRequest("", req, 200, "OK", "")
+			viaHop, _ = unknown.ViaHop()
+			viaHop.Params.Add("branch", sip.String{Str: sip.GenerateBranch()})
+			send(unknown)
+
+			send(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		res, err := srv.RequestWithContext(ctx, testutils.Request([]string{
+			"OPTIONS sip:bob@127.0.0.1:5314 SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5313;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=stray-tag",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: stray-call",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Eventually(reasons).Should(Receive(Equal(transaction.StrayMismatched)))
+		Eventually(reasons).Should(Receive(Equal(transaction.StrayUnmatched)))
+	})
+})
+
+var _ = Describe("GoSIP Circuit Breaker", func() {
+	It("should fail requests to the failing destination locally until it recovers", func() {
+		logger := testutils.NewLogrusLogger()
+		newServer := func(addr string, options ...gosip.ServerOption) gosip.Server {
+			srv, err := gosip.New(append([]gosip.ServerOption{
+				gosip.WithLogger(logger),
+				gosip.WithHost("127.0.0.1"),
+				gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: addr}),
+				gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+			}, options...)...)
+			Expect(err).ShouldNot(HaveOccurred())
+			return srv
+		}
+
+		var received, healthy int32
+		gateway := newServer("127.0.0.1:5291")
+		defer gateway.Shutdown()
+		Expect(gateway.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			atomic.AddInt32(&received, 1)
+			if atomic.LoadInt32(&healthy) == 1 {
+				Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+			} else {
+				Expect(tx.Respond(sip.NewResponseFromRequest("", req, 503, "Service Unavailable", ""))).To(Succeed())
+			}
+		})).To(Succeed())
+
+		srv := newServer("127.0.0.1:5290", gosip.WithCircuitBreaker(gosip.BreakerConfig{
+			MinRequests: 2,
+			OpenTimeout: 300 * time.Millisecond,
+		}))
+		defer srv.Shutdown()
+
+		request := func() (sip.Response, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			return srv.RequestWithContext(ctx, testutils.Request([]string{
+				"OPTIONS sip:gw@127.0.0.1:5291 SIP/2.0",
+				"Via: SIP/2.0/UDP 127.0.0.1:5290;branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@127.0.0.1>;tag=" + sip.GenerateBranch(),
+				"To: <sip:gw@127.0.0.1>",
+				"Call-ID: " + sip.GenerateBranch(),
+				"CSeq: 1 OPTIONS",
+				"Content-Length: 0",
+				"",
+				"",
+			}))
+		}
+
+		for i := 0; i < 2; i++ {
+			_, err := request()
+			Expect(err).Should(HaveOccurred())
+		}
+		Expect(atomic.LoadInt32(&received)).To(Equal(int32(2)))
+
+		_, err := request()
+		var reqErr *sip.RequestError
+		Expect(errors.As(err, &reqErr)).To(BeTrue())
+		Expect(reqErr.Code).To(Equal(uint(503)))
+		Expect(reqErr.Response.GetHeaders("Retry-After")).To(HaveLen(1))
+		Expect(atomic.LoadInt32(&received)).To(Equal(int32(2)))
+
+		atomic.StoreInt32(&healthy, 1)
+		time.Sleep(350 * time.Millisecond)
+		res, err := request()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		_, err = request()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(atomic.LoadInt32(&received)).To(Equal(int32(4)))
+	})
+})
+
+// srvResolver answers SRV queries by targets on 127.0.0.1 with the ports and priorities
+// and A queries by 127.0.0.1.
+func srvResolver(ports []uint16, priorities []uint16) *net.Resolver {
+	answer := func(query []byte) []byte {
+		i := 12
+		for query[i] != 0 {
+			i += int(query[i]) + 1
+		}
+		qtype := binary.BigEndian.Uint16(query[i+1:])
+
+		records := make([][]byte, 0)
+		switch qtype {
+		case 33:
+			for n, port := range ports {
+				rdata := make([]byte, 6)
+				binary.BigEndian.PutUint16(rdata, priorities[n])
+				binary.BigEndian.PutUint16(rdata[4:], port)
+				rdata = append(rdata, 2, 't', byte('0'+n), 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 4, 't', 'e', 's', 't', 0)
+				records = append(records, append([]byte{0xc0, 0x0c, 0, 33, 0, 1, 0, 0, 0, 60, 0, byte(len(rdata))}, rdata...))
+			}
+		case 1:
+			records = append(records, []byte{0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1})
+		}
+
+		res := append([]byte{}, query[0], query[1], 0x81, 0x80, 0, 1, 0, byte(len(records)), 0, 0, 0, 0)
+		res = append(res, query[12:i+5]...)
+		for _, record := range records {
+			res = append(res, record...)
+		}
+
+		return res
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+
+				var l [2]byte
+				if _, err := io.ReadFull(server, l[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(server, query); err != nil {
+					return
+				}
+				res := answer(query)
+				binary.BigEndian.PutUint16(l[:], uint16(len(res)))
+				_, _ = server.Write(append(l[:], res...))
+			}()
+
+			return client, nil
+		},
+	}
+}
+
+var _ = Describe("GoSIP Failover", func() {
+	var (
+		blackhole net.PacketConn
+		gateway   gosip.Server
+		lost      int32
+	)
+
+	logger := testutils.NewLogrusLogger()
+	request := func(srv gosip.Server, policy gosip.FailoverPolicy) (sip.Response, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		return srv.RequestWithContext(ctx, testutils.Request([]string{
+			"OPTIONS sip:gw@proxies.example.test SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5310;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=" + sip.GenerateBranch(),
+			"To: <sip:gw@proxies.example.test>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}), gosip.WithFailoverPolicy(policy))
+	}
+	newServer := func(priorities []uint16) gosip.Server {
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5310"}),
+			gosip.WithResolver(srvResolver([]uint16{5311, 5312}, priorities)),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		return srv
+	}
+
+	BeforeEach(func() {
+		var err error
+		// the first target never responds
+		blackhole, err = net.ListenPacket("udp", "127.0.0.1:5311")
+		Expect(err).ShouldNot(HaveOccurred())
+		atomic.StoreInt32(&lost, 0)
+		go func(conn net.PacketConn) {
+			buf := make([]byte, 65535)
+			for {
+				if _, _, err := conn.ReadFrom(buf); err != nil {
+					return
+				}
+				atomic.AddInt32(&lost, 1)
+			}
+		}(blackhole)
+
+		gateway, err = gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5312"}),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(gateway.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+	})
+	AfterEach(func() {
+		gateway.Shutdown()
+		blackhole.Close()
+	})
+
+	It("should move to the next target when the attempt times out", func() {
+		srv := newServer([]uint16{10, 20})
+		defer srv.Shutdown()
+
+		start := time.Now()
+		res, err := request(srv, gosip.FailoverPolicy{AttemptTimeout: 300 * time.Millisecond})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		Expect(atomic.LoadInt32(&lost)).To(BeNumerically(">=", 1))
+	})
+
+	It("should time out the attempt on the clock of the timing package", func() {
+		clock := timing.NewFakeClock(time.Now())
+		timing.SetClock(clock)
+		defer timing.SetClock(nil)
+		srv := newServer([]uint16{10, 20})
+		defer srv.Shutdown()
+
+		type result struct {
+			res sip.Response
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			res, err := request(srv, gosip.FailoverPolicy{AttemptTimeout: 10 * time.Second})
+			done <- result{res, err}
+		}()
+
+		Eventually(func() int32 { return atomic.LoadInt32(&lost) }).Should(BeNumerically(">=", 1))
+		Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+		clock.Advance(10 * time.Second)
+		var r result
+		Eventually(done).Should(Receive(&r))
+		Expect(r.err).ShouldNot(HaveOccurred())
+		Expect(r.res.StatusCode()).To(Equal(sip.StatusCode(200)))
+	})
+
+	It("should race targets of the same priority", func() {
+		srv := newServer([]uint16{10, 10})
+		defer srv.Shutdown()
+
+		start := time.Now()
+		res, err := request(srv, gosip.FailoverPolicy{Mode: gosip.FailoverParallel})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Eventually(func() int32 { return atomic.LoadInt32(&lost) }).Should(BeNumerically(">=", 1))
+	})
+
+	It("should move to the next target when the request is not sent", func() {
+		// nothing listens on the first target, so the connection is refused
+		tcpGateway, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "tcp", Addr: "127.0.0.1:5343"}),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer tcpGateway.Shutdown()
+		received := make(chan struct{}, 1)
+		Expect(tcpGateway.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			received <- struct{}{}
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "tcp", Addr: "127.0.0.1:5344"}),
+			gosip.WithResolver(srvResolver([]uint16{5342, 5343}, []uint16{10, 20})),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		start := time.Now()
+		res, err := srv.RequestWithContext(ctx, testutils.Request([]string{
+			"OPTIONS sip:gw@proxies.example.test;transport=tcp SIP/2.0",
+			"Via: SIP/2.0/TCP 127.0.0.1:5344;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=" + sip.GenerateBranch(),
+			"To: <sip:gw@proxies.example.test>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}), gosip.WithFailoverPolicy(gosip.FailoverPolicy{}))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(200)))
+		Expect(received).To(Receive())
+		// the failed send moves to the next target without the attempt timeout
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+})
+
+var _ = Describe("GoSIP Queue", func() {
+	It("should process dialog requests first and shed new requests when the queue is full", func() {
+		srv, err := gosip.New(
+			gosip.WithLogger(testutils.NewLogrusLogger()),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5292"}),
+			gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+			gosip.WithQueue(gosip.QueueConfig{Workers: 1, Size: 1}),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+
+		handled := make(chan string, 10)
+		release := make(chan struct{})
+		handle := func(req sip.Request, tx sip.ServerTransaction) {
+			callID, _ := req.CallID()
+			handled <- string(*callID)
+			if *callID == "queue-busy" {
+				<-release
+			}
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 486, "Busy Here", ""))).To(Succeed())
+		}
+		Expect(srv.OnRequest(sip.INVITE, handle)).To(Succeed())
+		Expect(srv.OnRequest(sip.BYE, handle)).To(Succeed())
+
+		client, err := net.ListenPacket("udp", "127.0.0.1:5293")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer client.Close()
+		raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:5292")
+		Expect(err).ShouldNot(HaveOccurred())
+		send := func(method sip.RequestMethod, callID, toTag string) {
+			_, err := client.WriteTo([]byte(testutils.Request([]string{
+				string(method) + " sip:bob@127.0.0.1:5292 SIP/2.0",
+				"Via: SIP/2.0/UDP 127.0.0.1:5293;branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@127.0.0.1>;tag=queue-tag",
+				"To: <sip:bob@127.0.0.1>" + toTag,
+				"Call-ID: " + callID,
+				"CSeq: 1 " + string(method),
+				"Content-Length: 0",
+				"",
+				"",
+			}).String()), raddr)
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+		readResponse := func(prefix string) string {
+			buf := make([]byte, 65535)
+			for {
+				Expect(client.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+				num, _, err := client.ReadFrom(buf)
+				Expect(err).ShouldNot(HaveOccurred())
+				if msg := string(buf[:num]); strings.HasPrefix(msg, prefix) {
+					return msg
+				}
+			}
+		}
+
+		send(sip.INVITE, "queue-busy", "")
+		Eventually(handled).Should(Receive(Equal("queue-busy")))
+		send(sip.INVITE, "queue-new", "")
+		time.Sleep(100 * time.Millisecond)
+		send(sip.INVITE, "queue-shed", "")
+		Expect(readResponse("SIP/2.0 503")).Should(ContainSubstring("Retry-After: 5"))
+		send(sip.BYE, "queue-dialog", ";tag=bob-tag")
+		time.Sleep(100 * time.Millisecond)
+
+		close(release)
+		Eventually(handled).Should(Receive(Equal("queue-dialog")))
+		Eventually(handled).Should(Receive(Equal("queue-new")))
+		Consistently(handled, 200*time.Millisecond).ShouldNot(Receive())
+	})
+})
+
+type fixedReduction int
+
+func (r fixedReduction) Name() string {
+	return gosip.LossAlgorithmName
+}
+
+func (r fixedReduction) Reduction() int {
+	return int(r)
+}
+
+func (r fixedReduction) Throttle(reduction int) bool {
+	return false
+}
+
+var _ = Describe("GoSIP Overload Control", func() {
+	It("should advertise reduction to clients and throttle requests to overloaded servers", func() {
+		logger := testutils.NewLogrusLogger()
+		newServer := func(addr string, config gosip.OverloadConfig) gosip.Server {
+			srv, err := gosip.New(
+				gosip.WithLogger(logger),
+				gosip.WithHost("127.0.0.1"),
+				gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: addr}),
+				gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+				gosip.WithOverload(config),
+			)
+			Expect(err).ShouldNot(HaveOccurred())
+			return srv
+		}
+
+		vias := make(chan string, 10)
+		overloaded := newServer("127.0.0.1:5295", gosip.OverloadConfig{Algorithm: fixedReduction(100)})
+		defer overloaded.Shutdown()
+		Expect(overloaded.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			vias <- req.GetHeaders("Via")[0].Value()
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		srv := newServer("127.0.0.1:5294", gosip.OverloadConfig{})
+		defer srv.Shutdown()
+
+		request := func(toTag string) (sip.Response, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			return srv.RequestWithContext(ctx, testutils.Request([]string{
+				"OPTIONS sip:gw@127.0.0.1:5295 SIP/2.0",
+				"Via: SIP/2.0/UDP 127.0.0.1:5294;branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@127.0.0.1>;tag=" + sip.GenerateBranch(),
+				"To: <sip:gw@127.0.0.1>" + toTag,
+				"Call-ID: " + sip.GenerateBranch(),
+				"CSeq: 1 OPTIONS",
+				"Content-Length: 0",
+				"",
+				"",
+			}))
+		}
+
+		res, err := request("")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(<-vias).Should(ContainSubstring(";oc;oc-algo="))
+		Expect(res.GetHeaders("Via")[0].Value()).Should(ContainSubstring(";oc=100;"))
+
+		_, err = request("")
+		var reqErr *sip.RequestError
+		Expect(errors.As(err, &reqErr)).To(BeTrue())
+		Expect(reqErr.Code).To(Equal(uint(503)))
+		Expect(vias).ShouldNot(Receive())
+
+		_, err = request(";tag=gw-tag")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(vias).Should(Receive())
+	})
+
+	It("should throttle requests to the overloaded server addressed by the host name", func() {
+		logger := testutils.NewLogrusLogger()
+		overloaded, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5333"}),
+			gosip.WithOverload(gosip.OverloadConfig{Algorithm: fixedReduction(100)}),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer overloaded.Shutdown()
+		received := make(chan struct{}, 10)
+		Expect(overloaded.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			received <- struct{}{}
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5332"}),
+			gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+			gosip.WithOverload(gosip.OverloadConfig{}),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+
+		request := func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err := srv.RequestWithContext(ctx, testutils.Request([]string{
+				"OPTIONS sip:gw@localhost:5333 SIP/2.0",
+				"Via: SIP/2.0/UDP 127.0.0.1:5332;branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@127.0.0.1>;tag=" + sip.GenerateBranch(),
+				"To: <sip:gw@localhost>",
+				"Call-ID: " + sip.GenerateBranch(),
+				"CSeq: 1 OPTIONS",
+				"Content-Length: 0",
+				"",
+				"",
+			}))
+			return err
+		}
+
+		Expect(request()).To(Succeed())
+		Expect(received).Should(Receive())
+
+		// the reduction is learned from 127.0.0.1:5333 and applied to localhost:5333
+		err = request()
+		var reqErr *sip.RequestError
+		Expect(errors.As(err, &reqErr)).To(BeTrue())
+		Expect(reqErr.Code).To(Equal(uint(503)))
+		Expect(received).ShouldNot(Receive())
+	})
+})
+
+var _ = Describe("GoSIP Fault Injector", func() {
+	It("should inject faults into connections of the server", func() {
+		logger := testutils.NewLogrusLogger()
+		fi := transport.NewFaultInjector(transport.FaultConfig{DropRate: 1}, logger)
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5340"}),
+			gosip.WithFaultInjector(fi),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+		handled := make(chan struct{}, 1)
+		Expect(srv.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			handled <- struct{}{}
+		})).To(Succeed())
+
+		peer, err := net.ListenPacket("udp", "127.0.0.1:5341")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer peer.Close()
+		raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:5340")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = peer.WriteTo([]byte("OPTIONS sip:gw@127.0.0.1:5340 SIP/2.0\r\n"+
+			"Via: SIP/2.0/UDP 127.0.0.1:5341;branch="+sip.GenerateBranch()+"\r\n"+
+			"From: <sip:alice@127.0.0.1>;tag=fault-tag\r\n"+
+			"To: <sip:gw@127.0.0.1>\r\n"+
+			"Call-ID: fault-call-id\r\n"+
+			"CSeq: 1 OPTIONS\r\n"+
+			"Content-Length: 0\r\n\r\n"), raddr)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Eventually(func() uint64 { return fi.Stats().Dropped }).Should(BeEquivalentTo(1))
+		Consistently(handled, 100*time.Millisecond).ShouldNot(Receive())
+	})
+})
+
+var _ = Describe("GoSIP Memory Budget", func() {
+	It("should shed new requests while the heap exceeds the budget", func() {
+		logger := testutils.NewLogrusLogger()
+		newServer := func(addr string, options ...gosip.ServerOption) gosip.Server {
+			srv, err := gosip.New(append([]gosip.ServerOption{
+				gosip.WithLogger(logger),
+				gosip.WithHost("127.0.0.1"),
+				gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: addr}),
+				gosip.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+			}, options...)...)
+			Expect(err).ShouldNot(HaveOccurred())
+			return srv
+		}
+
+		handled := make(chan struct{}, 10)
+		// the heap always exceeds the budget of 1 byte
+		exhausted := newServer("127.0.0.1:5306", gosip.WithMemory(gosip.MemoryConfig{Limit: 1}))
+		defer exhausted.Shutdown()
+		Expect(exhausted.OnRequest(sip.OPTIONS, func(req sip.Request, tx sip.ServerTransaction) {
+			handled <- struct{}{}
+			Expect(tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))).To(Succeed())
+		})).To(Succeed())
+
+		srv := newServer("127.0.0.1:5307")
+		defer srv.Shutdown()
+
+		request := func(toTag string) (sip.Response, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			return srv.RequestWithContext(ctx, testutils.Request([]string{
+				"OPTIONS sip:gw@127.0.0.1:5306 SIP/2.0",
+				"Via: SIP/2.0/UDP 127.0.0.1:5307;branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@127.0.0.1>;tag=" + sip.GenerateBranch(),
+				"To: <sip:gw@127.0.0.1>" + toTag,
+				"Call-ID: " + sip.GenerateBranch(),
+				"CSeq: 1 OPTIONS",
+				"Content-Length: 0",
+				"",
+				"",
+			}))
+		}
+
+		_, err := request("")
+		var reqErr *sip.RequestError
+		Expect(errors.As(err, &reqErr)).To(BeTrue())
+		Expect(reqErr.Code).To(Equal(uint(503)))
+		Expect(reqErr.Response.GetHeaders("Retry-After")).To(HaveLen(1))
+		Expect(handled).ShouldNot(Receive())
+
+		_, err = request(";tag=gw-tag")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(handled).Should(Receive())
+	})
+})
+
+var _ = Describe("GoSIP Timer Wheel", func() {
+	It("should retransmit requests by timers of the wheel", func() {
+		peer, err := net.ListenPacket("udp", "127.0.0.1:5297")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer peer.Close()
+
+		srv, err := gosip.New(
+			gosip.WithLogger(testutils.NewLogrusLogger()),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5296"}),
+			gosip.WithTimers(transaction.Timers{T1: 20 * time.Millisecond}),
+			gosip.WithTimerWheel(timing.WheelConfig{Tick: time.Millisecond}),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go srv.RequestWithContext(ctx, testutils.Request([]string{
+			"OPTIONS sip:gw@127.0.0.1:5297 SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5296;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=" + sip.GenerateBranch(),
+			"To: <sip:gw@127.0.0.1>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}))
+
+		buf := make([]byte, 65535)
+		Expect(peer.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		_, _, err = peer.ReadFrom(buf)
+		Expect(err).ShouldNot(HaveOccurred())
+		sentAt := time.Now()
+
+		// Timer A - RFC 3261 17.1.2.2
+		n, _, err := peer.ReadFrom(buf)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(buf[:n])).Should(HavePrefix("OPTIONS sip:gw@127.0.0.1:5297 SIP/2.0"))
+		Expect(time.Since(sentAt)).Should(BeNumerically(">=", 15*time.Millisecond))
+	})
+})
+
+var _ = Describe("GoSIP Response Translation", func() {
+	var client net.PacketConn
+
+	logger := testutils.NewLogrusLogger()
+	// the handler responds 480 with the detailed reason and Warning to the request sent from 127.0.0.1:5326
+	request := func(translation gosip.ResponseTranslationConfig) string {
+		srv, err := gosip.New(
+			gosip.WithLogger(logger),
+			gosip.WithHost("127.0.0.1"),
+			gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "127.0.0.1:5325"}),
+			gosip.WithResponseTranslation(translation),
+		)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer srv.Shutdown()
+		Expect(srv.OnRequest(sip.INVITE, func(req sip.Request, tx sip.ServerTransaction) {
+			res := sip.NewResponseFromRequest("", req, 480, "Callee Registration Expired", "")
+			res.AppendHeader(&sip.GenericHeader{HeaderName: "Warning", Contents: `399 127.0.0.1 "no bindings of bob"`})
+			Expect(tx.Respond(res)).To(Succeed())
+		})).To(Succeed())
+
+		req := testutils.Request([]string{
+			"INVITE sip:bob@127.0.0.1 SIP/2.0",
+			"Via: SIP/2.0/UDP 127.0.0.1:5326;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@127.0.0.1>;tag=1928301774",
+			"To: <sip:bob@127.0.0.1>",
+			"Call-ID: " + sip.GenerateBranch(),
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@127.0.0.1:5326>",
+			"Max-Forwards: 70",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		raddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:5325")
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = client.WriteTo([]byte(req.String()), raddr)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		buf := make([]byte, 65535)
+		Expect(client.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		for {
+			num, _, err := client.ReadFrom(buf)
+			Expect(err).ShouldNot(HaveOccurred())
+			if data := string(buf[:num]); !strings.HasPrefix(data, "SIP/2.0 1") {
+				return data
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		client, err = net.ListenPacket("udp", "127.0.0.1:5326")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		client.Close()
+	})
+
+	It("should translate codes of responses", func() {
+		data := request(gosip.ResponseTranslationConfig{
+			Translation: gosip.ResponseTranslation{
+				Codes: map[sip.StatusCode]sip.StatusCode{480: 486},
+			},
+		})
+		Expect(data).Should(HavePrefix("SIP/2.0 486 Busy Here\r\n"))
+		Expect(data).Should(ContainSubstring("Warning:"))
+	})
+
+	It("should strip reasons of responses to peers by exceptions", func() {
+		data := request(gosip.ResponseTranslationConfig{
+			Exceptions: []gosip.ResponseTranslationRule{{
+				Peers:       []string{"127.0.0.0/8"},
+				Translation: gosip.ResponseTranslation{StripReasons: true},
+			}},
+		})
+		Expect(data).Should(HavePrefix("SIP/2.0 480 Temporarily Unavailable\r\n"))
+		Expect(data).ShouldNot(ContainSubstring("Warning:"))
+	})
+
+	It("should reject translation of non-error codes", func() {
+		_, err := gosip.New(gosip.WithResponseTranslation(gosip.ResponseTranslationConfig{
+			Translation: gosip.ResponseTranslation{
+				Codes: map[sip.StatusCode]sip.StatusCode{200: 486},
+			},
+		}))
+		Expect(err).Should(HaveOccurred())
+	})
 })
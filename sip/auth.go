@@ -2,13 +2,20 @@ package sip
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"regexp"
 	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip/util"
 )
 
-// currently only Digest and MD5
+var authParamRe = regexp.MustCompile(`([\w-]+)\s*=\s*(?:"((?:[^"\\]|\\.)*)"|([^,\s]+))`)
+
+// Digest authorization, supported algorithms are MD5, MD5-sess, SHA-256 and SHA-256-sess - RFC 7616.
 type Authorization struct {
 	realm     string
 	nonce     string
@@ -21,6 +28,9 @@ type Authorization struct {
 	qop       string
 	nc        string
 	cnonce    string
+	opaque    string
+	body      string
+	ha1       string
 	other     map[string]string
 }
 
@@ -30,36 +40,46 @@ func AuthFromValue(value string) *Authorization {
 		other:     make(map[string]string),
 	}
 
-	re := regexp.MustCompile(`([\w]+)="([^"]+)"`)
-	matches := re.FindAllStringSubmatch(value, -1)
+	matches := authParamRe.FindAllStringSubmatch(value, -1)
 	for _, match := range matches {
-		switch match[1] {
+		val := match[2]
+		if val == "" {
+			val = match[3]
+		}
+
+		switch strings.ToLower(match[1]) {
 		case "realm":
-			auth.realm = match[2]
+			auth.realm = val
 		case "algorithm":
-			auth.algorithm = match[2]
+			auth.algorithm = val
 		case "nonce":
-			auth.nonce = match[2]
+			auth.nonce = val
 		case "username":
-			auth.username = match[2]
+			auth.username = val
 		case "uri":
-			auth.uri = match[2]
+			auth.uri = val
 		case "response":
-			auth.response = match[2]
+			auth.response = val
+		case "opaque":
+			auth.opaque = val
 		case "qop":
-			for _, v := range strings.Split(match[2], ",") {
+			// prefer 'auth' if both are offered, body is not always available
+			for _, v := range strings.Split(val, ",") {
 				v = strings.Trim(v, " ")
-				if v == "auth" || v == "auth-int" {
+				if v == "auth" {
 					auth.qop = "auth"
 					break
 				}
+				if v == "auth-int" {
+					auth.qop = "auth-int"
+				}
 			}
 		case "nc":
-			auth.nc = match[2]
+			auth.nc = val
 		case "cnonce":
-			auth.cnonce = match[2]
+			auth.cnonce = val
 		default:
-			auth.other[match[1]] = match[2]
+			auth.other[match[1]] = val
 		}
 	}
 
@@ -110,6 +130,20 @@ func (auth *Authorization) SetMethod(method string) *Authorization {
 	return auth
 }
 
+// SetHA1 sets precomputed H(username:realm:password) that is used instead of the password.
+func (auth *Authorization) SetHA1(ha1 string) *Authorization {
+	auth.ha1 = ha1
+
+	return auth
+}
+
+// SetBody sets message body used in 'auth-int' qop.
+func (auth *Authorization) SetBody(body string) *Authorization {
+	auth.body = body
+
+	return auth
+}
+
 func (auth *Authorization) Response() string {
 	return auth.response
 }
@@ -142,8 +176,37 @@ func (auth *Authorization) SetCNonce(cnonce string) {
 	auth.cnonce = cnonce
 }
 
+func (auth *Authorization) Opaque() string {
+	return auth.opaque
+}
+
+// Stale checks 'stale' param of the challenge - RFC 7616 3.3.
+func (auth *Authorization) Stale() bool {
+	return strings.EqualFold(auth.other["stale"], "true")
+}
+
+// IsSupported checks that the challenge algorithm can be computed.
+func (auth *Authorization) IsSupported() bool {
+	return digestHash(auth.algorithm) != nil
+}
+
+func (auth *Authorization) Clone() *Authorization {
+	if auth == nil {
+		return nil
+	}
+
+	clone := *auth
+	clone.other = make(map[string]string, len(auth.other))
+	for k, v := range auth.other {
+		clone.other[k] = v
+	}
+
+	return &clone
+}
+
 func (auth *Authorization) CalcResponse() string {
 	return calcResponse(
+		auth.algorithm,
 		auth.username,
 		auth.realm,
 		auth.password,
@@ -153,6 +216,8 @@ func (auth *Authorization) CalcResponse() string {
 		auth.qop,
 		auth.cnonce,
 		auth.nc,
+		auth.body,
+		auth.ha1,
 	)
 }
 
@@ -170,88 +235,144 @@ func (auth *Authorization) String() string {
 		auth.uri,
 		auth.response,
 	)
-	if auth.qop == "auth" {
+	if auth.opaque != "" {
+		str += fmt.Sprintf(`,opaque="%s"`, auth.opaque)
+	}
+	if auth.qop != "" {
 		str += fmt.Sprintf(`,qop=%s,nc=%s,cnonce="%s"`, auth.qop, auth.nc, auth.cnonce)
 	}
 
 	return str
 }
 
-// calculates Authorization response https://www.ietf.org/rfc/rfc2617.txt
-func calcResponse(username, realm, password, method, uri, nonce, qop, cnonce, nc string) string {
-	calcA1 := func() string {
-		encoder := md5.New()
-		encoder.Write([]byte(username + ":" + realm + ":" + password))
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	default:
+		return nil
+	}
+}
 
-		return hex.EncodeToString(encoder.Sum(nil))
+// calculates Authorization response https://www.ietf.org/rfc/rfc2617.txt, https://tools.ietf.org/html/rfc7616
+func calcResponse(algorithm, username, realm, password, method, uri, nonce, qop, cnonce, nc, body, ha1 string) string {
+	newHash := digestHash(algorithm)
+	if newHash == nil {
+		newHash = md5.New
 	}
-	calcA2 := func() string {
-		encoder := md5.New()
-		encoder.Write([]byte(method + ":" + uri))
+	h := func(data string) string {
+		encoder := newHash()
+		encoder.Write([]byte(data))
 
 		return hex.EncodeToString(encoder.Sum(nil))
 	}
 
-	encoder := md5.New()
-	encoder.Write([]byte(calcA1() + ":" + nonce + ":"))
+	a1 := ha1
+	if a1 == "" {
+		a1 = h(username + ":" + realm + ":" + password)
+	}
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		a1 = h(a1 + ":" + nonce + ":" + cnonce)
+	}
+
+	a2 := method + ":" + uri
+	if qop == "auth-int" {
+		a2 += ":" + h(body)
+	}
+
 	if qop != "" {
-		encoder.Write([]byte(nc + ":" + cnonce + ":" + qop + ":"))
+		return h(a1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + h(a2))
 	}
-	encoder.Write([]byte(calcA2()))
 
-	return hex.EncodeToString(encoder.Sum(nil))
+	return h(a1 + ":" + nonce + ":" + h(a2))
 }
 
-func AuthorizeRequest(request Request, response Response, user, password MaybeString) error {
-	if user == nil {
-		return fmt.Errorf("authorize request: user is nil")
+// CalcHA1 calculates H(username:realm:password) for the algorithm, can be used to store credentials without passwords.
+func CalcHA1(algorithm, username, realm, password string) string {
+	newHash := digestHash(algorithm)
+	if newHash == nil {
+		newHash = md5.New
 	}
+	encoder := newHash()
+	encoder.Write([]byte(username + ":" + realm + ":" + password))
+
+	return hex.EncodeToString(encoder.Sum(nil))
+}
 
-	var authenticateHeaderName, authorizeHeaderName string
+// authHeaderNames returns challenge and credentials header names for 401 and 407 responses.
+func authHeaderNames(response Response) (string, string) {
 	if response.StatusCode() == 401 {
 		// on 401 Unauthorized increase request seq num, add Authorization header and send once again
-		authenticateHeaderName = "WWW-Authenticate"
-		authorizeHeaderName = "Authorization"
-	} else {
-		// 407 Proxy authentication
-		authenticateHeaderName = "Proxy-Authenticate"
-		authorizeHeaderName = "Proxy-Authorization"
-	}
-
-	if hdrs := response.GetHeaders(authenticateHeaderName); len(hdrs) > 0 {
-		authenticateHeader := hdrs[0].(*GenericHeader)
-		auth := AuthFromValue(authenticateHeader.Contents).
-			SetMethod(string(request.Method())).
-			SetUri(request.Recipient().String()).
-			SetUsername(user.String())
-		if password != nil {
-			auth.SetPassword(password.String())
+		return "WWW-Authenticate", "Authorization"
+	}
+	// 407 Proxy authentication
+	return "Proxy-Authenticate", "Proxy-Authorization"
+}
+
+// ParseChallenges returns supported digest challenges of the 401/407 response, the strongest algorithm first.
+func ParseChallenges(response Response) []*Authorization {
+	authenticateHeaderName, _ := authHeaderNames(response)
+
+	challenges := make([]*Authorization, 0)
+	for _, hdr := range response.GetHeaders(authenticateHeaderName) {
+		value := hdr.Value()
+		if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(value)), "digest") {
+			continue
 		}
-		if auth.Qop() == "auth" {
-			auth.SetNc("00000001")
-			encoder := md5.New()
-			encoder.Write([]byte(user.String() + request.Recipient().String()))
-			if password != nil {
-				encoder.Write([]byte(password.String()))
-			}
-			auth.SetCNonce(hex.EncodeToString(encoder.Sum(nil)))
+		if auth := AuthFromValue(value); auth.IsSupported() {
+			challenges = append(challenges, auth)
+		}
+	}
+
+	// RFC 7616 3.7. SHA-256 is preferred over MD5
+	for i := 1; i < len(challenges); i++ {
+		for j := i; j > 0 && algorithmRank(challenges[j].algorithm) > algorithmRank(challenges[j-1].algorithm); j-- {
+			challenges[j], challenges[j-1] = challenges[j-1], challenges[j]
 		}
-		auth.SetResponse(auth.CalcResponse())
-
-		if hdrs = request.GetHeaders(authorizeHeaderName); len(hdrs) > 0 {
-			authorizationHeader := hdrs[0].Clone().(*GenericHeader)
-			authorizationHeader.Contents = auth.String()
-			request.ReplaceHeaders(authorizationHeader.Name(), []Header{authorizationHeader})
-		} else {
-			request.AppendHeader(&GenericHeader{
-				HeaderName: authorizeHeaderName,
-				Contents:   auth.String(),
-			})
+	}
+
+	return challenges
+}
+
+func algorithmRank(algorithm string) int {
+	if strings.HasPrefix(strings.ToUpper(algorithm), "SHA-256") {
+		return 1
+	}
+	return 0
+}
+
+// applyAuthorization computes credentials for the request and replaces credentials header of the challenge realm,
+// credentials of other realms are kept, so the request passes all proxies on the path - RFC 3261 22.3.
+func applyAuthorization(request Request, challenge *Authorization, headerName, user, password, nc string) {
+	auth := challenge.Clone().
+		SetMethod(string(request.Method())).
+		SetUri(request.Recipient().String()).
+		SetUsername(user).
+		SetPassword(password).
+		SetBody(request.Body())
+	if auth.Qop() != "" {
+		auth.SetNc(nc)
+		auth.SetCNonce(util.RandString(16))
+	}
+	auth.SetResponse(auth.CalcResponse())
+
+	hdrs := request.GetHeaders(headerName)
+	request.RemoveHeader(headerName)
+	for _, hdr := range hdrs {
+		if AuthFromValue(hdr.Value()).Realm() != auth.Realm() {
+			request.AppendHeader(hdr)
 		}
-	} else {
-		return fmt.Errorf("authorize request: header '%s' not found in response", authenticateHeaderName)
 	}
+	request.AppendHeader(&GenericHeader{
+		HeaderName: headerName,
+		Contents:   auth.String(),
+	})
+}
 
+// prepareAuthorizedRequest updates Via branch and CSeq of the request that is resent with credentials.
+func prepareAuthorizedRequest(request Request) {
 	if viaHop, ok := request.ViaHop(); ok {
 		viaHop.Params.Add("branch", String{Str: GenerateBranch()})
 	}
@@ -261,6 +382,25 @@ func AuthorizeRequest(request Request, response Response, user, password MaybeSt
 		cseq.SeqNo++
 		request.ReplaceHeaders(cseq.Name(), []Header{cseq})
 	}
+}
+
+func AuthorizeRequest(request Request, response Response, user, password MaybeString) error {
+	if user == nil {
+		return &AuthError{Reason: "user is nil"}
+	}
+
+	authenticateHeaderName, authorizeHeaderName := authHeaderNames(response)
+	challenges := ParseChallenges(response)
+	if len(challenges) == 0 {
+		return &AuthError{Reason: fmt.Sprintf("header '%s' not found in response", authenticateHeaderName)}
+	}
+
+	var pass string
+	if password != nil {
+		pass = password.String()
+	}
+	applyAuthorization(request, challenges[0], authorizeHeaderName, user.String(), pass, "00000001")
+	prepareAuthorizedRequest(request)
 
 	return nil
 }
@@ -277,3 +417,130 @@ type DefaultAuthorizer struct {
 func (auth *DefaultAuthorizer) AuthorizeRequest(request Request, response Response) error {
 	return AuthorizeRequest(request, response, auth.User, auth.Password)
 }
+
+// DigestAuthorizer answers digest challenges with per-realm credentials
+// and caches received nonces by the destination and the realm, so subsequent requests
+// to the same destination can be authorized in advance.
+type DigestAuthorizer struct {
+	mu          sync.Mutex
+	credentials map[string][2]string
+	challenges  map[digestChallengeKey]*digestChallenge
+}
+
+type digestChallengeKey struct {
+	headerName  string
+	destination string
+	realm       string
+}
+
+type digestChallenge struct {
+	auth       *Authorization
+	headerName string
+	nc         uint32
+}
+
+// NewDigestAuthorizer creates authorizer with default credentials used for any realm.
+func NewDigestAuthorizer(user, password string) *DigestAuthorizer {
+	auth := &DigestAuthorizer{
+		credentials: make(map[string][2]string),
+		challenges:  make(map[digestChallengeKey]*digestChallenge),
+	}
+	auth.SetCredentials("", user, password)
+
+	return auth
+}
+
+// SetCredentials sets credentials for the realm, empty realm sets default credentials.
+func (auth *DigestAuthorizer) SetCredentials(realm, user, password string) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+
+	auth.credentials[realm] = [2]string{user, password}
+}
+
+func (auth *DigestAuthorizer) lookupCredentials(realm string) ([2]string, bool) {
+	if creds, ok := auth.credentials[realm]; ok {
+		return creds, true
+	}
+	creds, ok := auth.credentials[""]
+
+	return creds, ok
+}
+
+func (auth *DigestAuthorizer) AuthorizeRequest(request Request, response Response) error {
+	authenticateHeaderName, authorizeHeaderName := authHeaderNames(response)
+	challenges := ParseChallenges(response)
+	if len(challenges) == 0 {
+		return &AuthError{Reason: fmt.Sprintf("header '%s' not found in response", authenticateHeaderName)}
+	}
+
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+
+	// the strongest challenge of each realm is answered, like challenges of forked branches behind different proxies
+	destination := requestDestination(request)
+	answered := make(map[string]bool)
+	for _, challenge := range challenges {
+		if answered[challenge.Realm()] {
+			continue
+		}
+		creds, ok := auth.lookupCredentials(challenge.Realm())
+		if !ok {
+			continue
+		}
+
+		cached := &digestChallenge{
+			auth:       challenge,
+			headerName: authorizeHeaderName,
+			nc:         1,
+		}
+		auth.challenges[digestChallengeKey{authorizeHeaderName, destination, challenge.Realm()}] = cached
+		applyAuthorization(request, challenge, authorizeHeaderName, creds[0], creds[1], fmt.Sprintf("%08x", cached.nc))
+		answered[challenge.Realm()] = true
+	}
+	if len(answered) == 0 {
+		return &AuthError{Realm: challenges[0].Realm(), Reason: "no credentials"}
+	}
+	prepareAuthorizedRequest(request)
+
+	return nil
+}
+
+// Preauthorize adds credentials computed with nonces cached for the destination of the request.
+// Returns false if there are no cached challenges of the destination.
+func (auth *DigestAuthorizer) Preauthorize(request Request) bool {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+
+	destination := requestDestination(request)
+	applied := false
+	for key, cached := range auth.challenges {
+		if key.destination != destination {
+			continue
+		}
+		creds, ok := auth.lookupCredentials(cached.auth.Realm())
+		if !ok {
+			continue
+		}
+
+		cached.nc++
+		applyAuthorization(request, cached.auth, cached.headerName, creds[0], creds[1], fmt.Sprintf("%08x", cached.nc))
+		applied = true
+	}
+
+	return applied
+}
+
+// requestDestination is the host and port of the Request-URI the credentials are cached for.
+func requestDestination(request Request) string {
+	recipient := request.Recipient()
+	if recipient == nil {
+		return ""
+	}
+	destination := strings.ToLower(recipient.Host())
+	if port := recipient.Port(); port != nil {
+		destination += fmt.Sprintf(":%d", *port)
+	}
+
+	return destination
+}
@@ -0,0 +1,180 @@
+package sip_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func TestAuthorization_CalcResponse(t *testing.T) {
+	// RFC 7616 3.9.1 examples
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			auth := sip.AuthFromValue(`Digest realm="http-auth@example.org", qop="auth, auth-int", ` +
+				`algorithm=` + tt.algorithm + `, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", ` +
+				`opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS", ` +
+				`nc=00000001, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"`).
+				SetMethod("GET").
+				SetUri("/dir/index.html").
+				SetUsername("Mufasa").
+				SetPassword("Circle of Life")
+			if auth.Qop() != "auth" {
+				t.Fatalf("expected qop 'auth', got '%s'", auth.Qop())
+			}
+			if res := auth.CalcResponse(); res != tt.expected {
+				t.Errorf("expected response '%s', got '%s'", tt.expected, res)
+			}
+			if !strings.Contains(auth.String(), `opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`) {
+				t.Errorf("opaque is missing in '%s'", auth.String())
+			}
+		})
+	}
+}
+
+func authRequest(method sip.RequestMethod, host string) sip.Request {
+	return sip.NewRequest(
+		"",
+		method,
+		&sip.SipUri{FHost: host},
+		"SIP/2.0",
+		[]sip.Header{
+			sip.ViaHeader{&sip.ViaHop{
+				ProtocolName:    "SIP",
+				ProtocolVersion: "2.0",
+				Transport:       "UDP",
+				Host:            "10.0.0.1",
+				Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+			}},
+			&sip.CSeq{SeqNo: 1, MethodName: method},
+		},
+		"",
+		nil,
+	)
+}
+
+func authChallenge(req sip.Request, code sip.StatusCode, headerName string, challenges ...string) sip.Response {
+	res := sip.NewResponseFromRequest("", req, code, "Unauthorized", "")
+	for _, challenge := range challenges {
+		res.AppendHeader(&sip.GenericHeader{HeaderName: headerName, Contents: challenge})
+	}
+
+	return res
+}
+
+func TestDigestAuthorizer(t *testing.T) {
+	req := authRequest(sip.REGISTER, "example.com")
+	res := sip.NewResponseFromRequest("", req, 401, "Unauthorized", "")
+	res.AppendHeader(&sip.GenericHeader{
+		HeaderName: "WWW-Authenticate",
+		Contents:   `Digest realm="example.com", nonce="md5nonce", algorithm=MD5`,
+	})
+	res.AppendHeader(&sip.GenericHeader{
+		HeaderName: "WWW-Authenticate",
+		Contents:   `Digest realm="example.com", nonce="shanonce", algorithm=SHA-256, qop="auth-int"`,
+	})
+
+	authorizer := sip.NewDigestAuthorizer("alice", "secret")
+	if err := authorizer.AuthorizeRequest(req, res); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	hdrs := req.GetHeaders("Authorization")
+	if len(hdrs) != 1 {
+		t.Fatalf("expected single Authorization header, got %d", len(hdrs))
+	}
+	if !strings.Contains(hdrs[0].Value(), "algorithm=SHA-256") || !strings.Contains(hdrs[0].Value(), "qop=auth-int,nc=00000001") {
+		t.Errorf("unexpected Authorization '%s'", hdrs[0].Value())
+	}
+	if cseq, _ := req.CSeq(); cseq.SeqNo != 2 {
+		t.Errorf("expected CSeq 2, got %d", cseq.SeqNo)
+	}
+
+	req.RemoveHeader("Authorization")
+	if !authorizer.Preauthorize(req) {
+		t.Fatalf("expected request to be preauthorized")
+	}
+	if hdrs := req.GetHeaders("Authorization"); len(hdrs) != 1 || !strings.Contains(hdrs[0].Value(), "nc=00000002") {
+		t.Errorf("unexpected Authorization %v", hdrs)
+	}
+}
+
+func TestDigestAuthorizer_Destinations(t *testing.T) {
+	authorizer := sip.NewDigestAuthorizer("alice", "secret")
+	req := authRequest(sip.REGISTER, "example.com")
+	res := authChallenge(req, 401, "WWW-Authenticate", `Digest realm="example.com", nonce="examplenonce"`)
+	if err := authorizer.AuthorizeRequest(req, res); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	other := authRequest(sip.REGISTER, "other.com")
+	if authorizer.Preauthorize(other) {
+		t.Errorf("expected request to other destination not to be preauthorized, got %v", other.GetHeaders("Authorization"))
+	}
+
+	next := authRequest(sip.REGISTER, "EXAMPLE.com")
+	if !authorizer.Preauthorize(next) {
+		t.Fatalf("expected request to the same destination to be preauthorized")
+	}
+	if hdrs := next.GetHeaders("Authorization"); len(hdrs) != 1 || !strings.Contains(hdrs[0].Value(), `nonce="examplenonce"`) {
+		t.Errorf("unexpected Authorization %v", hdrs)
+	}
+}
+
+func TestDigestAuthorizer_Realms(t *testing.T) {
+	authorizer := sip.NewDigestAuthorizer("alice", "secret")
+	authorizer.SetCredentials("proxy2.example.com", "alice2", "secret2")
+	req := authRequest(sip.INVITE, "example.com")
+
+	// proxies on the path challenge one after another
+	res := authChallenge(req, 407, "Proxy-Authenticate", `Digest realm="proxy1.example.com", nonce="nonce1"`)
+	if err := authorizer.AuthorizeRequest(req, res); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	res = authChallenge(req, 407, "Proxy-Authenticate", `Digest realm="proxy2.example.com", nonce="nonce2"`)
+	if err := authorizer.AuthorizeRequest(req, res); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	realms := func(req sip.Request) map[string]string {
+		users := make(map[string]string)
+		for _, hdr := range req.GetHeaders("Proxy-Authorization") {
+			auth := sip.AuthFromValue(hdr.Value())
+			if _, ok := users[auth.Realm()]; ok {
+				t.Errorf("duplicated credentials of realm '%s'", auth.Realm())
+			}
+			users[auth.Realm()] = auth.Username()
+		}
+
+		return users
+	}
+	expected := map[string]string{"proxy1.example.com": "alice", "proxy2.example.com": "alice2"}
+	if users := realms(req); !reflect.DeepEqual(users, expected) {
+		t.Errorf("expected credentials %v, got %v", expected, users)
+	}
+
+	// the stale nonce of the realm is replaced
+	res = authChallenge(req, 407, "Proxy-Authenticate", `Digest realm="proxy1.example.com", nonce="nonce3", stale=true`)
+	if err := authorizer.AuthorizeRequest(req, res); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if users := realms(req); !reflect.DeepEqual(users, expected) {
+		t.Errorf("expected credentials %v, got %v", expected, users)
+	}
+
+	next := authRequest(sip.INVITE, "example.com")
+	if !authorizer.Preauthorize(next) {
+		t.Fatalf("expected request to be preauthorized")
+	}
+	if users := realms(next); !reflect.DeepEqual(users, expected) {
+		t.Errorf("expected credentials %v, got %v", expected, users)
+	}
+}
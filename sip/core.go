@@ -274,8 +274,10 @@ type BrokenMessageError struct {
 	Msg string
 }
 
-func (err *BrokenMessageError) Malformed() bool { return false }
-func (err *BrokenMessageError) Broken() bool    { return true }
+func (err *BrokenMessageError) Malformed() bool      { return false }
+func (err *BrokenMessageError) Broken() bool         { return true }
+func (err *BrokenMessageError) Unwrap() error        { return err.Err }
+func (err *BrokenMessageError) Is(target error) bool { return target == ErrParse }
 func (err *BrokenMessageError) Error() string {
 	if err == nil {
 		return "<nil>"
@@ -295,8 +297,10 @@ type MalformedMessageError struct {
 	Msg string
 }
 
-func (err *MalformedMessageError) Malformed() bool { return true }
-func (err *MalformedMessageError) Broken() bool    { return false }
+func (err *MalformedMessageError) Malformed() bool      { return true }
+func (err *MalformedMessageError) Broken() bool         { return false }
+func (err *MalformedMessageError) Unwrap() error        { return err.Err }
+func (err *MalformedMessageError) Is(target error) bool { return target == ErrParse }
 func (err *MalformedMessageError) Error() string {
 	if err == nil {
 		return "<nil>"
@@ -315,8 +319,10 @@ type UnsupportedMessageError struct {
 	Msg string
 }
 
-func (err *UnsupportedMessageError) Malformed() bool { return true }
-func (err *UnsupportedMessageError) Broken() bool    { return false }
+func (err *UnsupportedMessageError) Malformed() bool      { return true }
+func (err *UnsupportedMessageError) Broken() bool         { return false }
+func (err *UnsupportedMessageError) Unwrap() error        { return err.Err }
+func (err *UnsupportedMessageError) Is(target error) bool { return target == ErrParse }
 func (err *UnsupportedMessageError) Error() string {
 	if err == nil {
 		return "<nil>"
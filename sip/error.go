@@ -1,6 +1,10 @@
 package sip
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net"
+)
 
 type RequestError struct {
 	Request  Request
@@ -35,3 +39,148 @@ func (err *RequestError) Error() string {
 
 	return fmt.Sprintf("sip.RequestError: request failed with reason '%s'", reason)
 }
+
+// Kinds of errors returned by the stack. Errors of all layers match one of them with errors.Is,
+// so applications can branch on the failure cause, e.g.
+//
+//	if errors.Is(err, sip.ErrTransactionTimeout) { ... }
+//
+// Structured details are extracted with errors.As and the corresponding error type.
+var (
+	// ErrTransport is a failure to send or receive message over the network, see TransportError.
+	ErrTransport = errors.New("transport error")
+	// ErrDNS is a failure to resolve the target host, see DNSError.
+	ErrDNS = errors.New("DNS error")
+	// ErrParse is a failure to parse the message, see ParseError.
+	ErrParse = errors.New("parse error")
+	// ErrTransactionTimeout is an expiration of the transaction without final response, see TransactionTimeout.
+	// RequestError with code 408 matches it too.
+	ErrTransactionTimeout = errors.New("transaction timeout")
+	// ErrAuth is a failure to authorize the request, see AuthError.
+	// RequestError with code 401 or 407 matches it too.
+	ErrAuth = errors.New("auth error")
+)
+
+// Is matches RequestError with ErrAuth and ErrTransactionTimeout by the response code.
+func (err *RequestError) Is(target error) bool {
+	switch target {
+	case ErrAuth:
+		return err.Code == 401 || err.Code == 407
+	case ErrTransactionTimeout:
+		return err.Code == 408
+	default:
+		return false
+	}
+}
+
+// TransportError is a failure of the transport operation.
+type TransportError struct {
+	// Op is a failed operation, like "send" or "listen".
+	Op      string
+	Network string
+	// Addr is a destination address of the sent message or a listen address.
+	Addr string
+	Err  error
+}
+
+func (err *TransportError) Unwrap() error        { return err.Err }
+func (err *TransportError) Is(target error) bool { return target == ErrTransport }
+func (err *TransportError) Timeout() bool        { return isTimeout(err.Err) }
+func (err *TransportError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("sip.TransportError: %s %s %s: %s", err.Op, err.Network, err.Addr, err.Err)
+}
+
+// DNSError is a failure to resolve the host.
+type DNSError struct {
+	Host string
+	// Type is a type of the failed lookup, like "SRV" or "A".
+	Type string
+	Err  error
+}
+
+func (err *DNSError) Unwrap() error        { return err.Err }
+func (err *DNSError) Is(target error) bool { return target == ErrDNS }
+func (err *DNSError) Timeout() bool        { return isTimeout(err.Err) }
+
+// NotFound indicates that the host does not exist.
+func (err *DNSError) NotFound() bool {
+	var dnsErr *net.DNSError
+	return errors.As(err.Err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func (err *DNSError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("sip.DNSError: lookup %s %s: %s", err.Type, err.Host, err.Err)
+}
+
+// ParseError is a failure to parse the message.
+type ParseError struct {
+	Err error
+	// Data is the raw message.
+	Data string
+}
+
+func (err *ParseError) Unwrap() error        { return err.Err }
+func (err *ParseError) Is(target error) bool { return target == ErrParse }
+func (err *ParseError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("sip.ParseError: %s", err.Err)
+}
+
+// TransactionTimeout is an expiration of the transaction - RFC 3261 17.1.1.2, 17.1.2.2, 17.2.1.
+type TransactionTimeout struct {
+	Key    string
+	Method RequestMethod
+	// Client indicates timeout of the client transaction.
+	Client bool
+}
+
+func (err *TransactionTimeout) Is(target error) bool { return target == ErrTransactionTimeout }
+func (err *TransactionTimeout) Timeout() bool        { return true }
+func (err *TransactionTimeout) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	kind := "server"
+	if err.Client {
+		kind = "client"
+	}
+
+	return fmt.Sprintf("sip.TransactionTimeout: %s transaction %s of %s request timed out", kind, err.Key, err.Method)
+}
+
+// AuthError is a failure to authorize the request on the received challenge.
+type AuthError struct {
+	// Realm is a realm of the challenge, empty if there is no challenge.
+	Realm  string
+	Reason string
+}
+
+func (err *AuthError) Is(target error) bool { return target == ErrAuth }
+func (err *AuthError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	if err.Realm == "" {
+		return fmt.Sprintf("sip.AuthError: authorize request: %s", err.Reason)
+	}
+
+	return fmt.Sprintf("sip.AuthError: authorize request for realm '%s': %s", err.Realm, err.Reason)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
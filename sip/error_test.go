@@ -0,0 +1,92 @@
+package sip_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func TestErrorKinds(t *testing.T) {
+	dnsErr := &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}
+	tests := []struct {
+		name     string
+		err      error
+		kinds    []error
+		notKinds []error
+	}{
+		{
+			"transport with DNS",
+			fmt.Errorf("request: %w", &sip.TransportError{
+				Op:      "send",
+				Network: "udp",
+				Addr:    "example.invalid:5060",
+				Err:     &sip.DNSError{Host: "example.invalid", Type: "A", Err: dnsErr},
+			}),
+			[]error{sip.ErrTransport, sip.ErrDNS},
+			[]error{sip.ErrParse, sip.ErrAuth},
+		},
+		{
+			"broken message",
+			&sip.ParseError{Err: &sip.BrokenMessageError{Err: errors.New("bad start line")}},
+			[]error{sip.ErrParse},
+			[]error{sip.ErrTransport},
+		},
+		{
+			"transaction timeout",
+			fmt.Errorf("tx: %w", &sip.TransactionTimeout{Key: "z9hG4bK1", Method: sip.INVITE, Client: true}),
+			[]error{sip.ErrTransactionTimeout},
+			[]error{sip.ErrTransport},
+		},
+		{"408 response", sip.NewRequestError(408, "Request Timeout", nil, nil), []error{sip.ErrTransactionTimeout}, []error{sip.ErrAuth}},
+		{"407 response", sip.NewRequestError(407, "Proxy Authentication Required", nil, nil), []error{sip.ErrAuth}, nil},
+		{"486 response", sip.NewRequestError(486, "Busy Here", nil, nil), nil, []error{sip.ErrAuth, sip.ErrTransactionTimeout}},
+		{"auth", &sip.AuthError{Realm: "example.com", Reason: "no credentials"}, []error{sip.ErrAuth}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, kind := range test.kinds {
+				if !errors.Is(test.err, kind) {
+					t.Errorf("expected %q to be %q", test.err, kind)
+				}
+			}
+			for _, kind := range test.notKinds {
+				if errors.Is(test.err, kind) {
+					t.Errorf("expected %q not to be %q", test.err, kind)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorFields(t *testing.T) {
+	err := fmt.Errorf("request: %w", &sip.TransportError{
+		Op:      "send",
+		Network: "udp",
+		Addr:    "example.invalid:5060",
+		Err: &sip.DNSError{
+			Host: "example.invalid",
+			Type: "A",
+			Err:  &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true},
+		},
+	})
+
+	var transportErr *sip.TransportError
+	if !errors.As(err, &transportErr) || transportErr.Op != "send" || transportErr.Addr != "example.invalid:5060" {
+		t.Fatalf("unexpected transport error %#v", transportErr)
+	}
+	var dnsErr *sip.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.Host != "example.invalid" || !dnsErr.NotFound() {
+		t.Fatalf("unexpected DNS error %#v", dnsErr)
+	}
+
+	res := sip.NewResponse("", "SIP/2.0", 401, "Unauthorized", nil, "", nil)
+	req := sip.NewRequest("", sip.REGISTER, &sip.SipUri{FHost: "example.com"}, "SIP/2.0", nil, "", nil)
+	var authErr *sip.AuthError
+	if err := sip.NewDigestAuthorizer("alice", "secret").AuthorizeRequest(req, res); !errors.As(err, &authErr) {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
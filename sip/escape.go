@@ -160,7 +160,7 @@ func shouldEscape(c byte, mode encoding) bool {
 		case EncodeUserPassword:
 			return c == '@' || c == '/' || c == '?' || c == ':'
 		case EncodeQueryComponent:
-			return c == '&' || c == ';'
+			return c == '&' || c == ';' || c == '='
 		}
 	}
 
@@ -529,6 +529,63 @@ func (uri WildcardUri) Equals(other interface{}) bool {
 	}
 }
 
+// UrnUri is a URN like service URN urn:service:sos used as Request-URI and To URI - RFC 5031.
+type UrnUri struct {
+	// FNid is a namespace identifier, like 'service'.
+	FNid string
+	// FNss is a namespace specific string, like 'sos.fire'.
+	FNss string
+}
+
+func (uri *UrnUri) IsEncrypted() bool { return false }
+
+func (uri *UrnUri) SetEncrypted(flag bool) {}
+
+func (uri *UrnUri) User() MaybeString { return nil }
+
+func (uri *UrnUri) SetUser(user MaybeString) {}
+
+func (uri *UrnUri) Password() MaybeString { return nil }
+
+func (uri *UrnUri) SetPassword(pass MaybeString) {}
+
+func (uri *UrnUri) Host() string { return "" }
+
+func (uri *UrnUri) SetHost(host string) {}
+
+func (uri *UrnUri) Port() *Port { return nil }
+
+func (uri *UrnUri) SetPort(port *Port) {}
+
+func (uri *UrnUri) UriParams() Params { return nil }
+
+func (uri *UrnUri) SetUriParams(params Params) {}
+
+func (uri *UrnUri) Headers() Params { return nil }
+
+func (uri *UrnUri) SetHeaders(params Params) {}
+
+func (uri *UrnUri) IsWildcard() bool { return false }
+
+func (uri *UrnUri) Clone() Uri {
+	newUri := *uri
+	return &newUri
+}
+
+func (uri *UrnUri) String() string {
+	return "urn:" + uri.FNid + ":" + uri.FNss
+}
+
+// Equals compares URNs case-insensitively - RFC 5031 4.3.
+func (uri *UrnUri) Equals(other interface{}) bool {
+	otherPtr, ok := other.(*UrnUri)
+	if !ok {
+		return false
+	}
+
+	return strings.EqualFold(uri.FNid, otherPtr.FNid) && strings.EqualFold(uri.FNss, otherPtr.FNss)
+}
+
 // Encapsulates a header that gossip does not natively support.
 // This allows header data that is not understood to be parsed by gossip and relayed to the parent application.
 type GenericHeader struct {
@@ -954,7 +1011,15 @@ func (maxForwards *MaxForwards) Name() string { return "Max-Forwards" }
 
 func (maxForwards MaxForwards) Value() string { return fmt.Sprintf("%d", maxForwards) }
 
-func (maxForwards *MaxForwards) Clone() Header { return maxForwards }
+func (maxForwards *MaxForwards) Clone() Header {
+	if maxForwards == nil {
+		var newMaxForwards *MaxForwards
+		return newMaxForwards
+	}
+
+	newMaxForwards := *maxForwards
+	return &newMaxForwards
+}
 
 func (maxForwards *MaxForwards) Equals(other interface{}) bool {
 	if h, ok := other.(MaxForwards); ok {
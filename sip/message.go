@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	uuid "github.com/satori/go.uuid"
 
@@ -119,6 +120,26 @@ type Message interface {
 	WithFields(fields log.Fields) Message
 }
 
+// bufferPool holds buffers of message serialization.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	// large buffers of rare huge messages are not kept
+	if buf.Cap() <= 64*1024 {
+		bufferPool.Put(buf)
+	}
+}
+
 // headers is a struct with methods to work with SIP headers.
 type headers struct {
 	mu sync.RWMutex
@@ -126,6 +147,8 @@ type headers struct {
 	headers map[string][]Header
 	// The order the headers should be displayed in.
 	headerOrder []string
+	// gen is incremented on each change of the message, it invalidates the cached wire form
+	gen uint64
 }
 
 func newHeaders(hdrs []Header) *headers {
@@ -139,25 +162,40 @@ func newHeaders(hdrs []Header) *headers {
 }
 
 func (hs *headers) String() string {
-	buffer := bytes.Buffer{}
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+
+	hs.writeTo(buffer)
+
+	return buffer.String()
+}
+
+// writeTo appends headers to the buffer.
+func (hs *headers) writeTo(buffer *bytes.Buffer) {
 	hs.mu.RLock()
 	// Construct each header in turn and add it to the message.
-	for typeIdx, name := range hs.headerOrder {
-		headers := hs.headers[name]
-		for idx, header := range headers {
+	for _, name := range hs.headerOrder {
+		for _, header := range hs.headers[name] {
 			buffer.WriteString(header.String())
-			if typeIdx < len(hs.headerOrder) || idx < len(headers) {
-				buffer.WriteString("\r\n")
-			}
+			buffer.WriteString("\r\n")
 		}
 	}
 	hs.mu.RUnlock()
-	return buffer.String()
+}
+
+// touch invalidates the cached wire form of the message.
+func (hs *headers) touch() {
+	atomic.AddUint64(&hs.gen, 1)
+}
+
+func (hs *headers) generation() uint64 {
+	return atomic.LoadUint64(&hs.gen)
 }
 
 // Add the given header.
 func (hs *headers) AppendHeader(header Header) {
 	name := strings.ToLower(header.Name())
+	hs.touch()
 	hs.mu.Lock()
 	if _, ok := hs.headers[name]; ok {
 		hs.headers[name] = append(hs.headers[name], header)
@@ -173,6 +211,7 @@ func (hs *headers) AppendHeader(header Header) {
 // if there are some headers have h's name, add h to front of the sublist
 func (hs *headers) PrependHeader(header Header) {
 	name := strings.ToLower(header.Name())
+	hs.touch()
 	hs.mu.Lock()
 	if hdrs, ok := hs.headers[name]; ok {
 		hs.headers[name] = append([]Header{header}, hdrs...)
@@ -188,6 +227,7 @@ func (hs *headers) PrependHeader(header Header) {
 func (hs *headers) PrependHeaderAfter(header Header, afterName string) {
 	headerName := strings.ToLower(header.Name())
 	afterName = strings.ToLower(afterName)
+	hs.touch()
 	hs.mu.Lock()
 	if _, ok := hs.headers[afterName]; ok {
 		afterIdx := -1
@@ -233,6 +273,7 @@ func (hs *headers) PrependHeaderAfter(header Header, afterName string) {
 
 func (hs *headers) ReplaceHeaders(name string, headers []Header) {
 	name = strings.ToLower(name)
+	hs.touch()
 	hs.mu.Lock()
 	if _, ok := hs.headers[name]; ok {
 		hs.headers[name] = headers
@@ -269,6 +310,7 @@ func (hs *headers) GetHeaders(name string) []Header {
 
 func (hs *headers) RemoveHeader(name string) {
 	name = strings.ToLower(name)
+	hs.touch()
 	hs.mu.Lock()
 	delete(hs.headers, name)
 	// update order slice
@@ -417,6 +459,9 @@ type message struct {
 	src        string
 	dest       string
 	fields     log.Fields
+	// wire is the cached wire form of the message of the wireGen generation
+	wire    []byte
+	wireGen uint64
 }
 
 func (msg *message) MessageID() MessageID {
@@ -438,18 +483,102 @@ func (msg *message) Fields() log.Fields {
 }
 
 func (msg *message) String() string {
-	var buffer bytes.Buffer
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+
+	msg.writeTo(buffer)
+
+	return buffer.String()
+}
 
+// writeTo appends the message in RFC 3261 form to the buffer.
+func (msg *message) writeTo(buffer *bytes.Buffer) {
 	// write message start line
-	buffer.WriteString(msg.StartLine() + "\r\n")
+	buffer.WriteString(msg.StartLine())
+	buffer.WriteString("\r\n")
 	// Write the headers.
+	msg.headers.writeTo(buffer)
+	// message body
+	buffer.WriteString("\r\n")
+	buffer.WriteString(msg.Body())
+}
+
+// wireBytes returns the cached wire form or serializes the message without caching.
+func (msg *message) wireBytes() []byte {
 	msg.mu.RLock()
-	buffer.WriteString(msg.headers.String())
+	wire := msg.wire
+	cached := wire != nil && msg.wireGen == msg.headers.generation()
 	msg.mu.RUnlock()
-	// message body
-	buffer.WriteString("\r\n" + msg.Body())
+	if cached {
+		return wire
+	}
 
-	return buffer.String()
+	return msg.serialize()
+}
+
+func (msg *message) serialize() []byte {
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+
+	msg.writeTo(buffer)
+
+	return append(make([]byte, 0, buffer.Len()), buffer.Bytes()...)
+}
+
+func (msg *message) cacheWire() {
+	gen := msg.headers.generation()
+	msg.mu.RLock()
+	cached := msg.wire != nil && msg.wireGen == gen
+	msg.mu.RUnlock()
+	if cached {
+		return
+	}
+
+	wire := msg.serialize()
+
+	msg.mu.Lock()
+	msg.wire = wire
+	msg.wireGen = gen
+	msg.mu.Unlock()
+}
+
+func (msg *message) invalidateWire() {
+	msg.mu.Lock()
+	msg.wire = nil
+	msg.mu.Unlock()
+}
+
+type wireMessage interface {
+	wireBytes() []byte
+	cacheWire()
+	invalidateWire()
+}
+
+// Wire returns the message in RFC 3261 form for sending, the result must not be modified.
+// It is the wire form cached by CacheWire, otherwise the message is serialized like String.
+func Wire(msg Message) []byte {
+	if wm, ok := msg.(wireMessage); ok {
+		return wm.wireBytes()
+	}
+
+	return []byte(msg.String())
+}
+
+// CacheWire keeps the wire form of the sent message, so retransmissions of the transaction layer
+// are not serialized again - RFC 3261 17. The cache is dropped by methods changing the message
+// like AppendHeader, SetBody or SetRecipient, headers changed in place are not tracked,
+// so the code changing them after the message is cached calls InvalidateWire.
+func CacheWire(msg Message) {
+	if wm, ok := msg.(wireMessage); ok {
+		wm.cacheWire()
+	}
+}
+
+// InvalidateWire drops the cached wire form of the message.
+func InvalidateWire(msg Message) {
+	if wm, ok := msg.(wireMessage); ok {
+		wm.invalidateWire()
+	}
 }
 
 func (msg *message) SipVersion() string {
@@ -462,6 +591,7 @@ func (msg *message) SetSipVersion(version string) {
 	msg.mu.Lock()
 	msg.sipVersion = version
 	msg.mu.Unlock()
+	msg.touch()
 }
 
 func (msg *message) Body() string {
@@ -475,6 +605,7 @@ func (msg *message) SetBody(body string, setContentLength bool) {
 	msg.mu.Lock()
 	msg.body = body
 	msg.mu.Unlock()
+	msg.touch()
 	if setContentLength {
 		hdrs := msg.GetHeaders("Content-Length")
 		if len(hdrs) == 0 {
@@ -2,6 +2,7 @@ package sip_test
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/ghettovoice/gosip/sip"
@@ -566,3 +567,88 @@ func TestHeaders_String(t *testing.T) {
 		},
 	}, t)
 }
+
+func TestMessage_Fields(t *testing.T) {
+	req := routeRequest("sip:bob@example.com")
+	res := sip.NewResponseFromRequest("", req, 180, "Ringing", "")
+
+	for _, msg := range []sip.Message{req, res} {
+		fields := msg.Fields()
+		if fields["call_id"] != "a84b4c76e66710" {
+			t.Errorf("expected call_id field of '%s', got %v", msg.Short(), fields["call_id"])
+		}
+		if fmt.Sprint(fields["method"]) != "INVITE" {
+			t.Errorf("expected method field of '%s', got %v", msg.Short(), fields["method"])
+		}
+	}
+}
+
+func TestWire(t *testing.T) {
+	req := routeRequest("sip:bob@example.com")
+	if &sip.Wire(req)[0] == &sip.Wire(req)[0] {
+		t.Errorf("expected serialized wire form of the request without cache")
+	}
+
+	sip.CacheWire(req)
+	wire := string(sip.Wire(req))
+	if wire != req.String() {
+		t.Fatalf("expected wire form equal to '%s', got '%s'", req.String(), wire)
+	}
+	if &sip.Wire(req)[0] != &sip.Wire(req)[0] {
+		t.Errorf("expected cached wire form of the unchanged request")
+	}
+
+	// headers changed in place are not tracked by the cache, but String is always fresh
+	viaHop, _ := req.ViaHop()
+	viaHop.Host = "192.0.2.1"
+	if wire := string(sip.Wire(req)); strings.Contains(wire, "192.0.2.1") {
+		t.Errorf("expected cached wire form of the request, got '%s'", wire)
+	}
+	if str := req.String(); !strings.Contains(str, "192.0.2.1") {
+		t.Errorf("expected string with changed Via, got '%s'", str)
+	}
+	sip.InvalidateWire(req)
+	if wire := string(sip.Wire(req)); !strings.Contains(wire, "192.0.2.1") {
+		t.Errorf("expected wire form with changed Via, got '%s'", wire)
+	}
+
+	sip.CacheWire(req)
+	req.AppendHeader(&sip.GenericHeader{HeaderName: "X-Test", Contents: "1"})
+	if wire := string(sip.Wire(req)); !strings.Contains(wire, "X-Test: 1\r\n") {
+		t.Errorf("expected wire form with appended header, got '%s'", wire)
+	}
+
+	sip.CacheWire(req)
+	req.SetBody("v=0\r\n", true)
+	if wire := string(sip.Wire(req)); !strings.HasSuffix(wire, "Content-Length: 5\r\n\r\nv=0\r\n") {
+		t.Errorf("expected wire form with new body, got '%s'", wire)
+	}
+
+	sip.CacheWire(req)
+	req.SetRecipient(&sip.SipUri{FUser: sip.String{Str: "carol"}, FHost: "example.com"})
+	if wire := string(sip.Wire(req)); !strings.HasPrefix(wire, "INVITE sip:carol@example.com SIP/2.0\r\n") {
+		t.Errorf("expected wire form with new Request-URI, got '%s'", wire)
+	}
+	if req.String() != string(sip.Wire(req)) {
+		t.Errorf("expected String equal to the wire form")
+	}
+}
+
+func BenchmarkWire(b *testing.B) {
+	req := routeRequest("sip:bob@example.com")
+	sip.CacheWire(req)
+
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			req.RemoveHeader("X-Bench")
+			_ = []byte(req.String())
+		}
+	})
+	b.Run("Retransmission", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = sip.Wire(req)
+		}
+	})
+}
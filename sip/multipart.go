@@ -0,0 +1,253 @@
+package sip
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/ghettovoice/gosip/util"
+)
+
+// MIMEHeader is a header of the multipart body part.
+type MIMEHeader struct {
+	Name  string
+	Value string
+}
+
+// BodyPart is a part of the multipart body - RFC 2046 5.1.
+// Body is kept byte to byte as received, so binary contents like application/isup pass through unchanged.
+type BodyPart struct {
+	// Headers are MIME headers of the part in order, like Content-Type and Content-Disposition.
+	Headers []MIMEHeader
+	Body    string
+}
+
+// NewBodyPart creates body part with Content-Type header.
+func NewBodyPart(contentType, body string) *BodyPart {
+	return &BodyPart{
+		Headers: []MIMEHeader{{Name: "Content-Type", Value: contentType}},
+		Body:    body,
+	}
+}
+
+// Header returns value of the first part header with the name.
+func (part *BodyPart) Header(name string) (string, bool) {
+	for _, hdr := range part.Headers {
+		if strings.EqualFold(hdr.Name, name) {
+			return hdr.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// SetHeader replaces values of the part header with the name or appends the header.
+func (part *BodyPart) SetHeader(name, value string) {
+	headers := part.Headers[:0]
+	found := false
+	for _, hdr := range part.Headers {
+		if !strings.EqualFold(hdr.Name, name) {
+			headers = append(headers, hdr)
+			continue
+		}
+		if !found {
+			headers = append(headers, MIMEHeader{Name: name, Value: value})
+			found = true
+		}
+	}
+	if !found {
+		headers = append(headers, MIMEHeader{Name: name, Value: value})
+	}
+	part.Headers = headers
+}
+
+// MediaType returns lower-cased media type of the part without params, text/plain by default - RFC 2046 5.1.
+func (part *BodyPart) MediaType() string {
+	value, ok := part.Header("Content-Type")
+	if !ok {
+		return "text/plain"
+	}
+
+	return mediaType(value)
+}
+
+func (part *BodyPart) String() string {
+	var buf strings.Builder
+	for _, hdr := range part.Headers {
+		buf.WriteString(hdr.Name + ": " + hdr.Value + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(part.Body)
+
+	return buf.String()
+}
+
+// Multipart is a multipart body - RFC 2046 5.1, RFC 5621.
+type Multipart struct {
+	// Subtype is a multipart subtype like mixed, related or alternative.
+	Subtype  string
+	Boundary string
+	Parts    []*BodyPart
+}
+
+// NewMultipart creates multipart/mixed body with random boundary.
+func NewMultipart(parts ...*BodyPart) *Multipart {
+	return &Multipart{
+		Subtype:  "mixed",
+		Boundary: "boundary." + util.RandString(16),
+		Parts:    parts,
+	}
+}
+
+// ParseMultipart parses body of multipart Content-Type.
+// Preamble and epilogue of the body are dropped.
+func ParseMultipart(contentType, body string) (*Multipart, error) {
+	typ, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("parse Content-Type %q: %w", contentType, err)
+	}
+	if !strings.HasPrefix(typ, "multipart/") {
+		return nil, fmt.Errorf("Content-Type %q is not multipart", contentType)
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("Content-Type %q has no boundary", contentType)
+	}
+
+	// delimiter includes the line break before it, first delimiter may start the body
+	eol := "\r\n"
+	if !strings.Contains("\r\n"+body, "\r\n--"+boundary) {
+		eol = "\n"
+	}
+	segments := strings.Split(eol+body, eol+"--"+boundary)
+	if len(segments) < 2 {
+		return nil, fmt.Errorf("multipart body has no boundary %q", boundary)
+	}
+
+	mp := &Multipart{
+		Subtype:  strings.TrimPrefix(typ, "multipart/"),
+		Boundary: boundary,
+	}
+	closed := false
+	for _, segment := range segments[1:] {
+		if strings.HasPrefix(segment, "--") {
+			closed = true
+			break
+		}
+		// transport padding up to the end of the delimiter line
+		idx := strings.Index(segment, "\n")
+		if idx == -1 || strings.TrimSpace(segment[:idx]) != "" {
+			return nil, fmt.Errorf("malformed multipart delimiter %q", boundary)
+		}
+
+		part, err := parseBodyPart(segment[idx+1:], eol)
+		if err != nil {
+			return nil, err
+		}
+		mp.Parts = append(mp.Parts, part)
+	}
+	if !closed {
+		return nil, fmt.Errorf("multipart body has no close delimiter %q", boundary)
+	}
+
+	return mp, nil
+}
+
+func parseBodyPart(data, eol string) (*BodyPart, error) {
+	part := &BodyPart{}
+
+	var head string
+	if strings.HasPrefix(data, eol) {
+		part.Body = data[len(eol):]
+	} else {
+		idx := strings.Index(data, eol+eol)
+		if idx == -1 {
+			return nil, fmt.Errorf("malformed multipart body part headers")
+		}
+		head, part.Body = data[:idx], data[idx+2*len(eol):]
+	}
+
+	for _, line := range strings.Split(head, eol) {
+		if line == "" {
+			continue
+		}
+		// folded header lines
+		if (line[0] == ' ' || line[0] == '\t') && len(part.Headers) > 0 {
+			part.Headers[len(part.Headers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		idx := strings.Index(line, ":")
+		if idx == -1 {
+			return nil, fmt.Errorf("malformed multipart body part header %q", line)
+		}
+		part.Headers = append(part.Headers, MIMEHeader{
+			Name:  strings.TrimSpace(line[:idx]),
+			Value: strings.TrimSpace(line[idx+1:]),
+		})
+	}
+
+	return part, nil
+}
+
+// ContentType returns value of Content-Type header of the body.
+func (mp *Multipart) ContentType() string {
+	subtype := mp.Subtype
+	if subtype == "" {
+		subtype = "mixed"
+	}
+
+	return mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": mp.Boundary})
+}
+
+// Part returns the first part of the media type.
+func (mp *Multipart) Part(mediaType string) (*BodyPart, bool) {
+	mediaType = strings.ToLower(mediaType)
+	for _, part := range mp.Parts {
+		if part.MediaType() == mediaType {
+			return part, true
+		}
+	}
+
+	return nil, false
+}
+
+func (mp *Multipart) String() string {
+	var buf strings.Builder
+	for _, part := range mp.Parts {
+		buf.WriteString("--" + mp.Boundary + "\r\n")
+		buf.WriteString(part.String())
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("--" + mp.Boundary + "--\r\n")
+
+	return buf.String()
+}
+
+// MessageMultipart parses multipart body of the message.
+func MessageMultipart(msg Message) (*Multipart, error) {
+	contentType, ok := msg.ContentType()
+	if !ok {
+		return nil, fmt.Errorf("message has no Content-Type")
+	}
+
+	return ParseMultipart(contentType.Value(), msg.Body())
+}
+
+// SetMessageMultipart sets multipart body of the message with Content-Type and Content-Length headers.
+func SetMessageMultipart(msg Message, mp *Multipart) {
+	contentType := ContentType(mp.ContentType())
+	if len(msg.GetHeaders("Content-Type")) == 0 {
+		msg.AppendHeader(&contentType)
+	} else {
+		msg.ReplaceHeaders("Content-Type", []Header{&contentType})
+	}
+	msg.SetBody(mp.String(), true)
+}
+
+func mediaType(contentType string) string {
+	if idx := strings.Index(contentType, ";"); idx != -1 {
+		contentType = contentType[:idx]
+	}
+
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
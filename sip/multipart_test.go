@@ -0,0 +1,56 @@
+package sip_test
+
+import (
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func TestParseMultipart(t *testing.T) {
+	body := "preamble\r\n" +
+		"--unique-boundary-1\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		"v=0\r\n" +
+		"\r\n" +
+		"--unique-boundary-1\r\n" +
+		"Content-Type: application/isup;version=itu-t92+\r\n" +
+		"Content-Disposition: signal;\r\n" +
+		" handling=optional\r\n" +
+		"\r\n" +
+		"\x01\r\n\x00\xff\r\n" +
+		"--unique-boundary-1--\r\n"
+
+	mp, err := sip.ParseMultipart(`multipart/mixed; boundary="unique-boundary-1"`, body)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if mp.Subtype != "mixed" || len(mp.Parts) != 2 {
+		t.Fatalf("unexpected multipart %#v", mp)
+	}
+	if mp.Parts[0].MediaType() != "application/sdp" || mp.Parts[0].Body != "v=0\r\n" {
+		t.Errorf("unexpected first part %#v", mp.Parts[0])
+	}
+	part, ok := mp.Part("application/ISUP")
+	if !ok || part.Body != "\x01\r\n\x00\xff" {
+		t.Fatalf("unexpected ISUP part %#v", part)
+	}
+	if value, _ := part.Header("content-disposition"); value != "signal; handling=optional" {
+		t.Errorf("unexpected folded header %q", value)
+	}
+
+	again, err := sip.ParseMultipart(mp.ContentType(), mp.String())
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(again.Parts) != 2 || again.Parts[1].Body != part.Body {
+		t.Errorf("unexpected multipart after serialization %#v", again)
+	}
+
+	if _, err := sip.ParseMultipart("application/sdp", body); err == nil {
+		t.Errorf("expected error on non-multipart Content-Type")
+	}
+	if _, err := sip.ParseMultipart(`multipart/mixed;boundary=unique-boundary-1`, body[:len(body)-25]); err == nil {
+		t.Errorf("expected error on body without close delimiter")
+	}
+}
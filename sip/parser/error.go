@@ -1,5 +1,11 @@
 package parser
 
+import (
+	"fmt"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
 type Error interface {
 	error
 	// Syntax indicates that this is syntax error
@@ -8,19 +14,64 @@ type Error interface {
 
 type InvalidStartLineError string
 
-func (err InvalidStartLineError) Syntax() bool    { return true }
-func (err InvalidStartLineError) Malformed() bool { return false }
-func (err InvalidStartLineError) Broken() bool    { return true }
-func (err InvalidStartLineError) Error() string   { return "parser.InvalidStartLineError: " + string(err) }
+func (err InvalidStartLineError) Syntax() bool         { return true }
+func (err InvalidStartLineError) Malformed() bool      { return false }
+func (err InvalidStartLineError) Broken() bool         { return true }
+func (err InvalidStartLineError) Is(target error) bool { return target == sip.ErrParse }
+func (err InvalidStartLineError) Error() string {
+	return "parser.InvalidStartLineError: " + string(err)
+}
 
 type InvalidMessageFormat string
 
-func (err InvalidMessageFormat) Syntax() bool    { return true }
-func (err InvalidMessageFormat) Malformed() bool { return true }
-func (err InvalidMessageFormat) Broken() bool    { return true }
-func (err InvalidMessageFormat) Error() string   { return "parser.InvalidMessageFormat: " + string(err) }
+func (err InvalidMessageFormat) Syntax() bool         { return true }
+func (err InvalidMessageFormat) Malformed() bool      { return true }
+func (err InvalidMessageFormat) Broken() bool         { return true }
+func (err InvalidMessageFormat) Is(target error) bool { return target == sip.ErrParse }
+func (err InvalidMessageFormat) Error() string        { return "parser.InvalidMessageFormat: " + string(err) }
 
 type WriteError string
 
 func (err WriteError) Syntax() bool  { return false }
 func (err WriteError) Error() string { return "parser.WriteError: " + string(err) }
+
+// Limit names the limit of Limits.
+type Limit string
+
+const (
+	LimitHeaders      Limit = "headers"
+	LimitHeaderLength Limit = "header_length"
+	LimitUriLength    Limit = "uri_length"
+)
+
+// LimitError is sent to the errs chan of the parser for the message over Limits instead of the message.
+type LimitError struct {
+	Limit Limit
+	// Header is the name of the header over the limit, empty for Request-URI and the number of headers.
+	Header string
+	Value  int
+	Max    int
+	// Source is the address the message is received from, it is filled by the transport.
+	Source string
+	// Msg is the message over limits with headers required to answer the request statelessly,
+	// i.e. the first Via, From, To, Call-ID and CSeq. Request-URI of the request over the limit is nil.
+	Msg sip.Message
+}
+
+func (err *LimitError) Syntax() bool { return false }
+func (err *LimitError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	subject := string(err.Limit)
+	if err.Header != "" {
+		subject = fmt.Sprintf("%s of %s", err.Limit, err.Header)
+	}
+	source := err.Source
+	if source == "" {
+		source = "???"
+	}
+
+	return fmt.Sprintf("parser.LimitError: message from %s exceeds %s limit: %d > %d", source, subject, err.Value, err.Max)
+}
@@ -0,0 +1,136 @@
+package parser
+
+import (
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Limits bounds headers of incoming messages against header bombing, zero field disables the limit.
+// Limits are checked on the raw data while the message is framed, so header lines over the limit
+// are not buffered and headers over the limit are not parsed.
+type Limits struct {
+	// MaxHeaders is the max number of header fields, header fields with comma-separated values count once.
+	MaxHeaders int
+	// MaxHeaderLength is the max length of the header field including folded lines.
+	MaxHeaderLength int
+	// MaxUriLength is the max length of Request-URI and URIs of address headers, like From, To, Contact or Route.
+	MaxUriLength int
+}
+
+// Limiter is implemented by parsers that enforce Limits.
+type Limiter interface {
+	// SetLimits sets limits of messages parsed after the call.
+	SetLimits(limits Limits)
+}
+
+// framingHeaders are parsed from the message over limits, they are required to frame the message
+// and to answer the request statelessly.
+var framingHeaders = map[string]string{
+	"via":            "Via",
+	"v":              "Via",
+	"from":           "From",
+	"f":              "From",
+	"to":             "To",
+	"t":              "To",
+	"call-id":        "Call-ID",
+	"i":              "Call-ID",
+	"cseq":           "CSeq",
+	"content-length": "Content-Length",
+	"l":              "Content-Length",
+}
+
+// addressHeaders are headers with URIs bounded by Limits.MaxUriLength.
+var addressHeaders = map[string]string{
+	"from":         "From",
+	"f":            "From",
+	"to":           "To",
+	"t":            "To",
+	"contact":      "Contact",
+	"m":            "Contact",
+	"route":        "Route",
+	"record-route": "Record-Route",
+}
+
+func (p *parser) SetLimits(limits Limits) {
+	p.mu.Lock()
+	p.limits = limits
+	p.mu.Unlock()
+}
+
+func (p *parser) getLimits() Limits {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.limits
+}
+
+func (pp *PacketParser) SetLimits(limits Limits) {
+	if limiter, ok := pp.p.(Limiter); ok {
+		limiter.SetLimits(limits)
+	}
+}
+
+// headerName returns the field name of the header line.
+func headerName(line string) string {
+	if i := strings.Index(line, ":"); i >= 0 {
+		return strings.TrimSpace(line[:i])
+	}
+
+	return strings.TrimSpace(line)
+}
+
+// keepFraming tells whether the header of the message over limits is parsed,
+// only the first header of each framing header is kept.
+func keepFraming(line string, headers []sip.Header) bool {
+	name, ok := framingHeaders[strings.ToLower(headerName(line))]
+	if !ok {
+		return false
+	}
+	for _, hdr := range headers {
+		if hdr.Name() == name {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestUriLength returns the length of Request-URI of the request line.
+func requestUriLength(startLine string) int {
+	return strings.LastIndex(startLine, " ") - strings.Index(startLine, " ") - 1
+}
+
+// uriLength returns the length of the longest URI of the address header value,
+// URIs are enclosed in angle brackets or end at parameters of the addr-spec form.
+func uriLength(value string) int {
+	max := 0
+	if strings.Contains(value, "<") {
+		for {
+			i := strings.Index(value, "<")
+			if i < 0 {
+				return max
+			}
+			value = value[i+1:]
+			j := strings.Index(value, ">")
+			if j < 0 {
+				j = len(value)
+			}
+			if j > max {
+				max = j
+			}
+			value = value[j:]
+		}
+	}
+
+	for _, addr := range strings.Split(value, ",") {
+		if i := strings.Index(addr, ";"); i >= 0 {
+			addr = addr[:i]
+		}
+		if n := len(strings.TrimSpace(addr)); n > max {
+			max = n
+		}
+	}
+
+	return max
+}
@@ -86,6 +86,24 @@ func defaultHeaderParsers() map[string]HeaderParser {
 	}
 }
 
+// ParseHeader parses the header line with the default header parsers,
+// headers without the parser are returned as sip.GenericHeader.
+func ParseHeader(headerText string) ([]sip.Header, error) {
+	colonIdx := strings.Index(headerText, ":")
+	if colonIdx == -1 {
+		return nil, fmt.Errorf("field name with no value in header: %s", headerText)
+	}
+
+	fieldName := strings.TrimSpace(headerText[:colonIdx])
+	lowerFieldName := strings.ToLower(fieldName)
+	fieldText := strings.TrimSpace(headerText[colonIdx+1:])
+	if headerParser, ok := defaultHeaderParsers()[lowerFieldName]; ok {
+		return headerParser(lowerFieldName, fieldText)
+	}
+
+	return []sip.Header{&sip.GenericHeader{HeaderName: fieldName, Contents: fieldText}}, nil
+}
+
 // Parse a SIP message by creating a parser on the fly.
 // This is more costly than reusing a parser, but is necessary when we do not
 // have a guarantee that all messages coming over a connection are from the
@@ -105,7 +123,7 @@ func ParseMessage(msgData []byte, logger log.Logger) (sip.Message, error) {
 	case msg := <-output:
 		return msg, nil
 	case err := <-errs:
-		return nil, err
+		return nil, &sip.ParseError{Err: err, Data: string(msgData)}
 	}
 }
 
@@ -137,7 +155,7 @@ func (pp *PacketParser) ParseMessage(msgData []byte) (sip.Message, error) {
 	case msg := <-pp.out:
 		return msg, nil
 	case err := <-pp.errs:
-		return nil, err
+		return nil, &sip.ParseError{Err: err, Data: string(msgData)}
 	}
 }
 
@@ -209,8 +227,9 @@ type parser struct {
 
 	stopped abool.AtomicBool
 
-	mu   sync.Mutex
-	done chan struct{}
+	mu     sync.Mutex
+	done   chan struct{}
+	limits Limits
 
 	log log.Logger
 }
@@ -332,10 +351,24 @@ func (p *parser) parse(requireContentLength bool, done chan<- struct{}) {
 
 		p.Log().Tracef("start reading start line: %s", startLine)
 
+		limits := p.getLimits()
+		// lerr is the first limit the message exceeds, the rest of the message is read only to frame it
+		var lerr *LimitError
+
 		var termErr error
 		if isRequest(startLine) {
-			method, recipient, sipVersion, err := ParseRequestLine(startLine)
-			if err == nil {
+			if n := requestUriLength(startLine); limits.MaxUriLength > 0 && n > limits.MaxUriLength {
+				lerr = &LimitError{Limit: LimitUriLength, Value: n, Max: limits.MaxUriLength}
+				msg = sip.NewRequest(
+					"",
+					sip.RequestMethod(startLine[:strings.Index(startLine, " ")]),
+					nil,
+					startLine[strings.LastIndex(startLine, " ")+1:],
+					[]sip.Header{},
+					"",
+					nil,
+				)
+			} else if method, recipient, sipVersion, err := ParseRequestLine(startLine); err == nil {
 				msg = sip.NewRequest("", method, recipient, sipVersion, []sip.Header{}, "", nil)
 			} else {
 				termErr = err
@@ -387,24 +420,43 @@ func (p *parser) parse(requireContentLength bool, done chan<- struct{}) {
 
 		flushBuffer := func() {
 			if buffer.Len() > 0 {
-				newHeaders, err := p.ParseHeader(buffer.String())
-				if err == nil {
-					headers = append(headers, newHeaders...)
-				} else {
-					p.Log().Warnf("skip header '%s' due to error: %s", buffer, err)
+				name := headerName(buffer.String())
+				if addr, ok := addressHeaders[strings.ToLower(name)]; ok && lerr == nil && limits.MaxUriLength > 0 {
+					if n := uriLength(buffer.String()[len(name)+1:]); n > limits.MaxUriLength {
+						lerr = &LimitError{Limit: LimitUriLength, Header: addr, Value: n, Max: limits.MaxUriLength}
+					}
+				}
+
+				if lerr == nil || keepFraming(buffer.String(), headers) {
+					newHeaders, err := p.ParseHeader(buffer.String())
+					if err == nil {
+						headers = append(headers, newHeaders...)
+					} else {
+						p.Log().Warnf("skip header '%s' due to error: %s", buffer, err)
+					}
 				}
 				buffer.Reset()
 			}
 		}
+		// skipLine skips the header over the length limit with its continuation lines
+		var skipLine bool
+		skipHeader := func(name string, length int) {
+			if lerr == nil {
+				lerr = &LimitError{Limit: LimitHeaderLength, Header: name, Value: length, Max: limits.MaxHeaderLength}
+			}
+			buffer.Reset()
+			skipLine = true
+		}
+		count := 0
 
 		for {
-			line, err := p.input.NextLine()
+			line, length, err := p.input.nextLine(limits.MaxHeaderLength)
 
 			if err != nil {
 				break
 			}
 
-			if len(line) == 0 {
+			if length == 0 {
 				// We've hit the end of the header section.
 				// Parse anything remaining in the buffer, then break out.
 				flushBuffer()
@@ -416,9 +468,26 @@ func (p *parser) parse(requireContentLength bool, done chan<- struct{}) {
 				// This line starts a new header.
 				// Parse anything currently in the buffer, then store the new header line in the buffer.
 				flushBuffer()
-				buffer.WriteString(line)
+				skipLine = false
+				count++
+				if lerr == nil && limits.MaxHeaders > 0 && count > limits.MaxHeaders {
+					lerr = &LimitError{Limit: LimitHeaders, Max: limits.MaxHeaders}
+				}
+
+				if limits.MaxHeaderLength > 0 && length > limits.MaxHeaderLength {
+					skipHeader(headerName(line), length)
+				} else {
+					buffer.WriteString(line)
+				}
+			} else if skipLine {
+				continue
 			} else if buffer.Len() > 0 {
 				// This is a continuation line, so just add it to the buffer.
+				if limits.MaxHeaderLength > 0 && buffer.Len()+1+length > limits.MaxHeaderLength {
+					skipHeader(headerName(buffer.String()), buffer.Len()+1+length)
+
+					continue
+				}
 				buffer.WriteString(" ")
 				buffer.WriteString(line)
 			} else {
@@ -436,6 +505,9 @@ func (p *parser) parse(requireContentLength bool, done chan<- struct{}) {
 		for _, header := range headers {
 			msg.AppendHeader(header)
 		}
+		if lerr != nil && lerr.Limit == LimitHeaders {
+			lerr.Value = count
+		}
 
 		var contentLength int
 		// Determine the length of the body, so we know when to stop parsing this message.
@@ -500,6 +572,13 @@ func (p *parser) parse(requireContentLength bool, done chan<- struct{}) {
 			continue
 		}
 
+		if lerr != nil {
+			lerr.Msg = msg
+			p.errs <- lerr
+
+			continue
+		}
+
 		if strings.TrimSpace(body) != "" {
 			msg.SetBody(body, false)
 		}
@@ -639,6 +718,10 @@ func ParseUri(uriStr string) (uri sip.Uri, err error) {
 		var sipUri sip.SipUri
 		sipUri, err = ParseSipUri(uriStr)
 		uri = &sipUri
+	case "urn":
+		var urnUri sip.UrnUri
+		urnUri, err = ParseUrnUri(uriStr)
+		uri = &urnUri
 	default:
 		err = fmt.Errorf("unsupported URI schema %s", uriStr[:colonIdx])
 	}
@@ -646,6 +729,20 @@ func ParseUri(uriStr string) (uri sip.Uri, err error) {
 	return
 }
 
+// ParseUrnUri converts a string representation of a URN into a UrnUri object - RFC 8141.
+func ParseUrnUri(uriStr string) (uri sip.UrnUri, err error) {
+	parts := strings.SplitN(uriStr, ":", 3)
+	if len(parts) != 3 || !strings.EqualFold(parts[0], "urn") || parts[1] == "" || parts[2] == "" {
+		err = fmt.Errorf("invalid URN '%s'", uriStr)
+		return
+	}
+
+	uri.FNid = parts[1]
+	uri.FNss = parts[2]
+
+	return
+}
+
 // ParseSipUri converts a string representation of a SIP or SIPS URI into a SipUri object.
 func ParseSipUri(uriStr string) (uri sip.SipUri, err error) {
 	// Store off the original URI in case we need to print it in an error.
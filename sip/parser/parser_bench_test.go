@@ -0,0 +1,73 @@
+package parser_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var benchInvite = []byte(strings.Join([]string{
+	"INVITE sip:bob@biloxi.com SIP/2.0",
+	"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds",
+	"Max-Forwards: 70",
+	"To: Bob <sip:bob@biloxi.com>",
+	"From: Alice <sip:alice@atlanta.com>;tag=1928301774",
+	"Call-ID: a84b4c76e66710@pc33.atlanta.com",
+	"CSeq: 314159 INVITE",
+	"Contact: <sip:alice@pc33.atlanta.com>",
+	"Content-Type: application/sdp",
+	"Content-Length: 124",
+	"",
+	"v=0",
+	"o=alice 2890844526 2890844526 IN IP4 pc33.atlanta.com",
+	"s=-",
+	"c=IN IP4 pc33.atlanta.com",
+	"t=0 0",
+	"m=audio 49172 RTP/AVP 0",
+	"",
+}, "\r\n"))
+
+func BenchmarkPacketParser_ParseMessage(b *testing.B) {
+	p := parser.NewPacketParser(testutils.NewLogrusLogger())
+	defer p.Stop()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchInvite)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.ParseMessage(benchInvite); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParser_Stream(b *testing.B) {
+	msgs := make(chan sip.Message)
+	errs := make(chan error)
+	p := parser.NewParser(msgs, errs, true, testutils.NewLogrusLogger())
+	defer p.Stop()
+
+	go func() {
+		for err := range errs {
+			b.Error(err)
+		}
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchInvite)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := p.Write(benchInvite); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		<-msgs
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/sip/parser"
 	"github.com/ghettovoice/gosip/testutils"
@@ -292,6 +293,197 @@ func TestSipUris(t *testing.T) {
 	}, t)
 }
 
+func TestUrnUris(t *testing.T) {
+	uri, err := parser.ParseUri("urn:service:sos.fire")
+	if err != nil {
+		t.Fatalf("parse URN failed: %s", err)
+	}
+	if !uri.Equals(&sip.UrnUri{FNid: "service", FNss: "SOS.fire"}) {
+		t.Errorf("unexpected URN %#v", uri)
+	}
+	if uri.String() != "urn:service:sos.fire" {
+		t.Errorf("expected 'urn:service:sos.fire', got '%s'", uri)
+	}
+
+	for _, str := range []string{"urn:service", "urn::sos", "urn:service:"} {
+		if _, err := parser.ParseUri(str); err == nil {
+			t.Errorf("expected failure on URN '%s'", str)
+		}
+	}
+
+	msg, err := parser.ParseMessage([]byte(strings.Join([]string{
+		"INVITE urn:service:sos SIP/2.0",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+		"From: <sip:alice@example.com>;tag=alice-tag",
+		"To: <urn:service:sos>",
+		"Call-ID: sos-call",
+		"CSeq: 1 INVITE",
+		"Content-Length: 0",
+		"",
+		"",
+	}, "\r\n")), log.NewDefaultLogrusLogger())
+	if err != nil {
+		t.Fatalf("parse request failed: %s", err)
+	}
+	req := msg.(sip.Request)
+	if req.Recipient().String() != "urn:service:sos" {
+		t.Errorf("expected Request-URI 'urn:service:sos', got '%s'", req.Recipient())
+	}
+	if to, ok := req.To(); !ok || to.Address.String() != "urn:service:sos" {
+		t.Errorf("unexpected To header %v", to)
+	}
+}
+
+func TestParseMessageError(t *testing.T) {
+	data := []byte("NOT A SIP MESSAGE\r\n\r\n")
+	_, err := parser.ParseMessage(data, log.NewDefaultLogrusLogger())
+	if !errors.Is(err, sip.ErrParse) {
+		t.Fatalf("expected parse error, got %v", err)
+	}
+	var parseErr *sip.ParseError
+	if !errors.As(err, &parseErr) || parseErr.Data != string(data) {
+		t.Fatalf("unexpected parse error %#v", parseErr)
+	}
+	var perr parser.Error
+	if !errors.As(err, &perr) || !perr.Syntax() {
+		t.Errorf("expected syntax error in chain, got %v", err)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	prs := parser.NewPacketParser(log.NewDefaultLogrusLogger())
+	defer prs.Stop()
+	prs.SetLimits(parser.Limits{MaxHeaders: 8, MaxHeaderLength: 100, MaxUriLength: 50})
+
+	request := func(ruri string, headers ...string) string {
+		return strings.Join(append(append([]string{
+			"OPTIONS " + ruri + " SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK123",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: limits-call",
+			"CSeq: 1 OPTIONS",
+		}, headers...), "Content-Length: 0", "", ""), "\r\n")
+	}
+
+	cases := []struct {
+		data   string
+		limit  parser.Limit
+		header string
+		value  int
+	}{
+		{request("sip:bob@example.com", "Subject: limits"), "", "", 0},
+		{request("sip:bob@example.com", "X-1: 1", "X-2: 2", "X-3: 3"), parser.LimitHeaders, "", 9},
+		{request("sip:bob@example.com", "Subject: "+strings.Repeat("a", 100)), parser.LimitHeaderLength, "Subject", 109},
+		{request("sip:bob@example.com", "Subject: "+strings.Repeat("a", 50), " "+strings.Repeat("a", 50)), parser.LimitHeaderLength, "Subject", 111},
+		{request("sip:" + strings.Repeat("b", 50) + "@example.com"), parser.LimitUriLength, "", 66},
+		{request("sip:bob@example.com", "Contact: <sip:"+strings.Repeat("c", 50)+"@example.com>"), parser.LimitUriLength, "Contact", 66},
+		{request("sip:bob@example.com", "Route: sip:"+strings.Repeat("r", 50)+"@example.com;lr"), parser.LimitUriLength, "Route", 66},
+	}
+	for _, c := range cases {
+		msg, err := prs.ParseMessage([]byte(c.data))
+		if c.limit == "" {
+			if err != nil {
+				t.Errorf("unexpected error %s", err)
+			} else if len(msg.GetHeaders("Subject")) != 1 {
+				t.Errorf("expected Subject header in %s", msg)
+			}
+			continue
+		}
+
+		var lerr *parser.LimitError
+		if !errors.As(err, &lerr) {
+			t.Errorf("expected limit error, got %v", err)
+			continue
+		}
+		if lerr.Limit != c.limit || lerr.Header != c.header || lerr.Value != c.value {
+			t.Errorf("expected %s limit of '%s' with value %d, got %s", c.limit, c.header, c.value, lerr)
+		}
+		// the request is answered statelessly
+		req, ok := lerr.Msg.(sip.Request)
+		if !ok || req.Method() != sip.OPTIONS {
+			t.Fatalf("unexpected message over limits %v", lerr.Msg)
+		}
+		for _, name := range []string{"Via", "From", "To", "Call-ID", "CSeq"} {
+			if len(req.GetHeaders(name)) != 1 {
+				t.Errorf("expected single %s header, got %v", name, req.GetHeaders(name))
+			}
+		}
+		if len(req.GetHeaders("Subject")) != 0 {
+			t.Errorf("unexpected Subject header of the request over limits")
+		}
+	}
+}
+
+func TestStreamedParseLimits(t *testing.T) {
+	output := make(chan sip.Message, 2)
+	errs := make(chan error, 2)
+	prs := parser.NewParser(output, errs, true, log.NewDefaultLogrusLogger())
+	defer prs.Stop()
+	prs.(parser.Limiter).SetLimits(parser.Limits{MaxHeaderLength: 100})
+
+	request := func(callID, subject string) string {
+		return strings.Join([]string{
+			"MESSAGE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/TCP 10.0.0.1:5060;branch=z9hG4bK" + callID,
+			"Call-ID: " + callID,
+			"CSeq: 1 MESSAGE",
+			"Subject: " + subject,
+			"Content-Length: 5",
+			"",
+			"hello",
+		}, "\r\n")
+	}
+	if _, err := prs.Write([]byte(request("bomb", strings.Repeat("a", 10000)) + request("next", "hi"))); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		var lerr *parser.LimitError
+		if !errors.As(err, &lerr) || lerr.Limit != parser.LimitHeaderLength || lerr.Value != 10009 {
+			t.Fatalf("expected header length limit error, got %v", err)
+		}
+	case msg := <-output:
+		t.Fatalf("unexpected message %s", msg.Short())
+	case <-time.After(time.Second):
+		t.Fatal("limit error not received")
+	}
+	// the stream is framed by Content-Length of the message over limits
+	select {
+	case msg := <-output:
+		if callID, _ := msg.CallID(); callID.Value() != "next" || msg.Body() != "hello" {
+			t.Errorf("unexpected message %s", msg)
+		}
+	case err := <-errs:
+		t.Fatalf("unexpected error %s", err)
+	case <-time.After(time.Second):
+		t.Fatal("next message not received")
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	hdrs, err := parser.ParseHeader("Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1, SIP/2.0/TCP 10.0.0.2")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if via, ok := hdrs[0].(sip.ViaHeader); len(hdrs) != 1 || !ok || len(via) != 2 {
+		t.Fatalf("unexpected Via headers %v", hdrs)
+	}
+
+	hdrs, err = parser.ParseHeader("X-Custom: value")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if hdr, ok := hdrs[0].(*sip.GenericHeader); !ok || hdr.Contents != "value" {
+		t.Errorf("unexpected generic header %v", hdrs)
+	}
+
+	if _, err := parser.ParseHeader("no colon"); err == nil {
+		t.Errorf("expected error on header without value")
+	}
+}
+
 func TestHostPort(t *testing.T) {
 	doTests([]test{
 		{hostPortInput("example.com"), &hostPortResult{pass, "example.com", nil}},
@@ -6,9 +6,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 
 	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/redact"
 )
 
 // parserBuffer is a specialized buffer for use in the parser.
@@ -61,33 +63,52 @@ func (pb *parserBuffer) Write(p []byte) (n int, err error) {
 // Return the line, excluding the terminal CRLF, and delete it from the buffer.
 // Returns an error if the parserbuffer has been stopped.
 func (pb *parserBuffer) NextLine() (response string, err error) {
+	response, _, err = pb.nextLine(0)
+
+	return
+}
+
+// nextLine is NextLine that keeps about max bytes of the line, max <= 0 keeps the whole line.
+// It returns the full length of the line, so too long lines are detected without buffering them.
+func (pb *parserBuffer) nextLine(max int) (response string, length int, err error) {
 	var buffer bytes.Buffer
-	var data string
+	var data []byte
 	var b byte
 
-	// There has to be a better way!
+	write := func(data []byte) {
+		length += len(data)
+		if max <= 0 || buffer.Len() <= max {
+			buffer.Write(data)
+		}
+	}
+
 	for {
-		data, err = pb.reader.ReadString('\r')
+		data, err = pb.reader.ReadSlice('\r')
+		if err == bufio.ErrBufferFull {
+			write(data)
+			continue
+		}
 		if err != nil {
 			return
 		}
 
-		buffer.WriteString(data)
+		write(data)
 
 		b, err = pb.reader.ReadByte()
 		if err != nil {
 			return
 		}
 
-		buffer.WriteByte(b)
 		if b == '\n' {
-			response = buffer.String()
-			response = response[:len(response)-2]
+			// the line over max is truncated without the final CR
+			response = strings.TrimSuffix(buffer.String(), "\r")
+			length--
 
 			pb.Log().Tracef("return line '%s'", response)
 
 			return
 		}
+		write([]byte{b})
 	}
 }
 
@@ -107,7 +128,7 @@ func (pb *parserBuffer) NextChunk(n int) (response string, err error) {
 
 	response = string(data)
 
-	pb.Log().Tracef("return chunk:\n%s", response)
+	pb.Log().Tracef("return chunk:\n%s", redact.Body(response))
 
 	return
 }
@@ -0,0 +1,185 @@
+package sip
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/ghettovoice/gosip/util"
+)
+
+var reasonPhrases = map[StatusCode]string{
+	100: "Trying",
+	180: "Ringing",
+	181: "Call Is Being Forwarded",
+	182: "Queued",
+	183: "Session Progress",
+	199: "Early Dialog Terminated",
+	200: "OK",
+	202: "Accepted",
+	204: "No Notification",
+	300: "Multiple Choices",
+	301: "Moved Permanently",
+	302: "Moved Temporarily",
+	305: "Use Proxy",
+	380: "Alternative Service",
+	400: "Bad Request",
+	401: "Unauthorized",
+	402: "Payment Required",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	410: "Gone",
+	412: "Conditional Request Failed",
+	413: "Request Entity Too Large",
+	414: "Request-URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Unsupported URI Scheme",
+	420: "Bad Extension",
+	421: "Extension Required",
+	422: "Session Interval Too Small",
+	423: "Interval Too Brief",
+	428: "Use Identity Header",
+	429: "Provide Referrer Identity",
+	430: "Flow Failed",
+	433: "Anonymity Disallowed",
+	439: "First Hop Lacks Outbound Support",
+	480: "Temporarily Unavailable",
+	481: "Call/Transaction Does Not Exist",
+	482: "Loop Detected",
+	483: "Too Many Hops",
+	484: "Address Incomplete",
+	485: "Ambiguous",
+	486: "Busy Here",
+	487: "Request Terminated",
+	488: "Not Acceptable Here",
+	489: "Bad Event",
+	491: "Request Pending",
+	493: "Undecipherable",
+	494: "Security Agreement Required",
+	500: "Server Internal Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Server Time-out",
+	505: "Version Not Supported",
+	513: "Message Too Large",
+	580: "Precondition Failure",
+	600: "Busy Everywhere",
+	603: "Decline",
+	604: "Does Not Exist Anywhere",
+	606: "Not Acceptable",
+	607: "Unwanted",
+}
+
+// ReasonPhrase returns the default reason phrase of the status code - RFC 3261 21.
+// Unknown codes get the phrase of their class.
+func ReasonPhrase(code StatusCode) string {
+	if reason, ok := reasonPhrases[code]; ok {
+		return reason
+	}
+
+	switch {
+	case code < 200:
+		return "Session Progress"
+	case code < 300:
+		return "OK"
+	case code < 400:
+		return "Multiple Choices"
+	case code < 500:
+		return "Bad Request"
+	case code < 600:
+		return "Server Internal Error"
+	default:
+		return "Busy Everywhere"
+	}
+}
+
+// tagSalt makes local tags of different UAS instances unique for the same request
+var tagSalt = util.RandString(16)
+
+// LocalTag returns To tag of the responses on the request without To tag.
+// It is derived from the request, so all responses of the transaction get the same tag,
+// and different forks of the request get different tags - RFC 3261 8.2.6.2.
+func LocalTag(req Request) string {
+	h := fnv.New64a()
+	write := func(str string) {
+		_, _ = h.Write([]byte(str))
+		_, _ = h.Write([]byte{0})
+	}
+
+	write(tagSalt)
+	if callID, ok := req.CallID(); ok {
+		write(callID.Value())
+	}
+	if from, ok := req.From(); ok && from.Params != nil {
+		if tag, ok := from.Params.Get("tag"); ok && tag != nil {
+			write(tag.String())
+		}
+	}
+	if viaHop, ok := req.ViaHop(); ok && viaHop.Params != nil {
+		if branch, ok := viaHop.Params.Get("branch"); ok && branch != nil {
+			write(branch.String())
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// NewReply builds the response on the request like NewResponseFromRequest and derives the rest of headers:
+// empty reason is filled with the default reason phrase, To tag from LocalTag is added to all responses except 100,
+// Record-Route is echoed only in responses that can establish a dialog - RFC 3261 8.2.6, 12.1.1.
+func NewReply(req Request, code StatusCode, reason, body string) Response {
+	if reason == "" {
+		reason = ReasonPhrase(code)
+	}
+
+	res := NewResponseFromRequest("", req, code, reason, body)
+	if code == 100 || code >= 300 {
+		res.RemoveHeader("Record-Route")
+	}
+
+	if code != 100 {
+		if to, ok := res.To(); ok {
+			if to.Params == nil {
+				to.Params = NewParams()
+			}
+			if tag, ok := to.Params.Get("tag"); !ok || tag == nil || tag.String() == "" {
+				to.Params.Add("tag", String{Str: LocalTag(req)})
+			}
+		}
+	}
+
+	return res
+}
+
+// NewTrying builds '100 Trying' response on the request.
+func NewTrying(req Request) Response {
+	return NewReply(req, 100, "", "")
+}
+
+// NewRinging builds '180 Ringing' response on the request.
+func NewRinging(req Request) Response {
+	return NewReply(req, 180, "", "")
+}
+
+// NewOK builds '200 OK' response on the request.
+func NewOK(req Request) Response {
+	return NewReply(req, 200, "", "")
+}
+
+// NewOKWithSDP builds '200 OK' response with SDP body, like the answer on INVITE.
+func NewOKWithSDP(req Request, sdp string) Response {
+	res := NewReply(req, 200, "", sdp)
+	contentType := ContentType("application/sdp")
+	res.AppendHeader(&contentType)
+
+	return res
+}
+
+// NewBusyHere builds '486 Busy Here' response on the request.
+func NewBusyHere(req Request) Response {
+	return NewReply(req, 486, "", "")
+}
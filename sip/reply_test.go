@@ -0,0 +1,73 @@
+package sip_test
+
+import (
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func TestReasonPhrase(t *testing.T) {
+	for code, expected := range map[sip.StatusCode]string{
+		180: "Ringing",
+		481: "Call/Transaction Does Not Exist",
+		499: "Bad Request",
+		699: "Busy Everywhere",
+	} {
+		if reason := sip.ReasonPhrase(code); reason != expected {
+			t.Errorf("expected reason '%s' of %d, got '%s'", expected, code, reason)
+		}
+	}
+}
+
+func TestNewReply(t *testing.T) {
+	req := routeRequest("sip:bob@example.com")
+	req.AppendHeader(&sip.RecordRouteHeader{Addresses: []sip.Uri{parseUri("sip:proxy.example.com;lr")}})
+
+	trying := sip.NewTrying(req)
+	if trying.Reason() != "Trying" {
+		t.Errorf("expected reason 'Trying', got '%s'", trying.Reason())
+	}
+	if to, _ := trying.To(); to.Params.Has("tag") {
+		t.Errorf("unexpected To tag in '%s'", trying.Short())
+	}
+	if len(trying.GetHeaders("Record-Route")) != 0 {
+		t.Errorf("unexpected Record-Route in '%s'", trying.Short())
+	}
+
+	ringing := sip.NewRinging(req)
+	ok := sip.NewOKWithSDP(req, "v=0\r\n")
+	ringingTo, _ := ringing.To()
+	okTo, _ := ok.To()
+	ringingTag, _ := ringingTo.Params.Get("tag")
+	okTag, _ := okTo.Params.Get("tag")
+	if ringingTag == nil || okTag == nil || ringingTag.String() != okTag.String() {
+		t.Errorf("expected the same To tag in responses, got %v and %v", ringingTag, okTag)
+	}
+	if len(ok.GetHeaders("Record-Route")) != 1 {
+		t.Errorf("expected Record-Route in '%s'", ok.Short())
+	}
+	if ct, _ := ok.ContentType(); ct == nil || ct.Value() != "application/sdp" {
+		t.Errorf("expected SDP content type, got %v", ct)
+	}
+	if callID, _ := ok.CallID(); callID.Value() != "a84b4c76e66710" {
+		t.Errorf("unexpected Call-ID %s", callID)
+	}
+
+	busy := sip.NewBusyHere(req)
+	if busy.StatusCode() != 486 || busy.Reason() != "Busy Here" || len(busy.GetHeaders("Record-Route")) != 0 {
+		t.Errorf("unexpected response '%s'", busy.Short())
+	}
+
+	// the other fork of the request gets another tag
+	fork := routeRequest("sip:bob@example.com")
+	fork.ReplaceHeaders("Via", []sip.Header{sip.ViaHeader{&sip.ViaHop{
+		ProtocolName:    "SIP",
+		ProtocolVersion: "2.0",
+		Transport:       "UDP",
+		Host:            "10.0.0.1",
+		Params:          sip.NewParams().Add("branch", sip.String{Str: sip.GenerateBranch()}),
+	}}})
+	if sip.LocalTag(fork) == sip.LocalTag(req) {
+		t.Errorf("expected different tags of forks")
+	}
+}
@@ -83,6 +83,7 @@ func (req *request) SetMethod(method RequestMethod) {
 	req.mu.Lock()
 	req.method = method
 	req.mu.Unlock()
+	req.touch()
 }
 
 func (req *request) Recipient() Uri {
@@ -94,6 +95,7 @@ func (req *request) SetRecipient(recipient Uri) {
 	req.mu.Lock()
 	req.recipient = recipient
 	req.mu.Unlock()
+	req.touch()
 }
 
 // StartLine returns Request Line - RFC 2361 7.1.
@@ -117,12 +119,19 @@ func (req *request) Clone() Message {
 	return cloneRequest(req, "", nil)
 }
 
+// Fields returns log fields of the request, call_id and method correlate log entries of the call.
 func (req *request) Fields() log.Fields {
-	return req.fields.WithFields(log.Fields{
+	fields := log.Fields{
 		"transport":   req.Transport(),
 		"source":      req.Source(),
 		"destination": req.Destination(),
-	})
+		"method":      req.Method(),
+	}
+	if callID, ok := req.CallID(); ok {
+		fields["call_id"] = callID.Value()
+	}
+
+	return req.fields.WithFields(fields)
 }
 
 func (req *request) WithFields(fields log.Fields) Message {
@@ -94,6 +94,7 @@ func (res *response) SetStatusCode(code StatusCode) {
 	res.mu.Lock()
 	res.status = code
 	res.mu.Unlock()
+	res.touch()
 }
 
 func (res *response) Reason() string {
@@ -105,6 +106,7 @@ func (res *response) SetReason(reason string) {
 	res.mu.Lock()
 	res.reason = reason
 	res.mu.Unlock()
+	res.touch()
 }
 
 func (res *response) Previous() []Response {
@@ -140,12 +142,21 @@ func (res *response) Clone() Message {
 	return cloneResponse(res, "", nil)
 }
 
+// Fields returns log fields of the response, call_id and method correlate log entries of the call.
 func (res *response) Fields() log.Fields {
-	return res.fields.WithFields(log.Fields{
+	fields := log.Fields{
 		"transport":   res.Transport(),
 		"source":      res.Source(),
 		"destination": res.Destination(),
-	})
+	}
+	if cseq, ok := res.CSeq(); ok {
+		fields["method"] = cseq.MethodName
+	}
+	if callID, ok := res.CallID(); ok {
+		fields["call_id"] = callID.Value()
+	}
+
+	return res.fields.WithFields(fields)
 }
 
 func (res *response) WithFields(fields log.Fields) Message {
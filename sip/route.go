@@ -0,0 +1,200 @@
+package sip
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RouteUris returns URIs of all Route header values of the message in order.
+func RouteUris(msg Message) []Uri {
+	uris := make([]Uri, 0)
+	for _, hdr := range msg.GetHeaders("Route") {
+		if route, ok := hdr.(*RouteHeader); ok {
+			uris = append(uris, route.Addresses...)
+		}
+	}
+
+	return uris
+}
+
+// RecordRouteUris returns URIs of all Record-Route header values of the message in order.
+func RecordRouteUris(msg Message) []Uri {
+	uris := make([]Uri, 0)
+	for _, hdr := range msg.GetHeaders("Record-Route") {
+		if rr, ok := hdr.(*RecordRouteHeader); ok {
+			uris = append(uris, rr.Addresses...)
+		}
+	}
+
+	return uris
+}
+
+// SetRouteUris replaces Route header values of the message, empty list removes Route headers.
+func SetRouteUris(msg Message, uris []Uri) {
+	msg.RemoveHeader("Route")
+	if len(uris) == 0 {
+		return
+	}
+
+	route := &RouteHeader{}
+	for _, uri := range uris {
+		route.Addresses = append(route.Addresses, uri.Clone())
+	}
+	msg.PrependHeaderAfter(route, "Max-Forwards")
+}
+
+// IsLooseRouter checks that the Route or Record-Route URI has 'lr' param - RFC 3261 19.1.1.
+// The param value is ignored and the name is case-insensitive, since some elements send 'lr=on' or 'LR'.
+func IsLooseRouter(uri Uri) bool {
+	if uri == nil || uri.UriParams() == nil {
+		return false
+	}
+	for _, key := range uri.UriParams().Keys() {
+		if strings.EqualFold(key, "lr") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NextHop returns URI of the element the request is sent to:
+// the first Route entry or the Request-URI if there is no Route - RFC 3261 8.1.2.
+// It should be called before CompensateStrictRoute, that moves the strict router into the Request-URI.
+func NextHop(req Request) Uri {
+	if routes := RouteUris(req); len(routes) > 0 {
+		return routes[0]
+	}
+
+	return req.Recipient()
+}
+
+// IsLocalUri checks that the URI has host and port of one of the local URIs.
+// Absent port is equal to the default port of the URI scheme.
+func IsLocalUri(uri Uri, local ...Uri) bool {
+	if uri == nil {
+		return false
+	}
+	for _, l := range local {
+		if l != nil && strings.EqualFold(uri.Host(), l.Host()) && uriPort(uri) == uriPort(l) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RestoreStrictRoute restores the Request-URI of the request received from the strict router.
+// Such router replaces the Request-URI with the local Record-Route URI
+// and puts the original Request-URI into the last Route entry - RFC 3261 16.4.
+// It returns true if the request was rewritten.
+func RestoreStrictRoute(req Request, local ...Uri) bool {
+	routes := RouteUris(req)
+	if len(routes) == 0 || !IsLocalUri(req.Recipient(), local...) {
+		return false
+	}
+
+	req.SetRecipient(routes[len(routes)-1].Clone())
+	SetRouteUris(req, routes[:len(routes)-1])
+
+	return true
+}
+
+// StripLocalRoutes removes the topmost Route entries that point to the local element - RFC 3261 16.4.
+// Several entries are removed when the element doubled Record-Route - RFC 5658.
+// It returns number of removed entries.
+func StripLocalRoutes(req Request, local ...Uri) int {
+	routes := RouteUris(req)
+
+	var n int
+	for n < len(routes) && IsLocalUri(routes[n], local...) {
+		n++
+	}
+	if n > 0 {
+		SetRouteUris(req, routes[n:])
+	}
+
+	return n
+}
+
+// CompensateStrictRoute rewrites the request whose next hop is a strict router:
+// the first Route entry becomes the Request-URI and the Request-URI is appended to Route - RFC 3261 16.6 step 7.
+// The request destination is set to the strict router, since the rest of Route is not used for sending.
+// It returns true if the request was rewritten.
+func CompensateStrictRoute(req Request) bool {
+	routes := RouteUris(req)
+	if len(routes) == 0 || IsLooseRouter(routes[0]) {
+		return false
+	}
+
+	recipient := req.Recipient()
+	req.SetRecipient(routes[0].Clone())
+	SetRouteUris(req, append(routes[1:], recipient))
+	req.SetDestination(fmt.Sprintf("%v:%v", routes[0].Host(), uriPort(routes[0])))
+
+	return true
+}
+
+// AddRecordRoute inserts Record-Route of the element that forwards the request.
+// inbound is the URI of the interface the request was received on, outbound is the URI of the interface
+// the request is sent from. When they differ in host, port or transport Record-Route is doubled,
+// so both sides of the dialog route requests to the interface reachable for them - RFC 5658.
+// Inserted URIs get 'lr' param. It returns number of inserted entries.
+func AddRecordRoute(req Request, inbound, outbound Uri) int {
+	if outbound == nil {
+		outbound = inbound
+	}
+	if inbound == nil {
+		inbound = outbound
+	}
+	if inbound == nil {
+		return 0
+	}
+
+	uris := []Uri{looseUri(outbound)}
+	if !IsLocalUri(inbound, outbound) || uriTransport(inbound) != uriTransport(outbound) {
+		uris = append(uris, looseUri(inbound))
+	}
+	// the last prepended is the topmost
+	for i := len(uris) - 1; i >= 0; i-- {
+		req.PrependHeader(&RecordRouteHeader{Addresses: []Uri{uris[i]}})
+	}
+
+	return len(uris)
+}
+
+func looseUri(uri Uri) Uri {
+	uri = uri.Clone()
+	if uri.UriParams() == nil {
+		uri.SetUriParams(NewParams())
+	}
+	if !IsLooseRouter(uri) {
+		uri.UriParams().Add("lr", nil)
+	}
+
+	return uri
+}
+
+func uriPort(uri Uri) Port {
+	if port := uri.Port(); port != nil {
+		return *port
+	}
+	if uri.IsEncrypted() {
+		return DefaultPort("TLS")
+	}
+
+	return DefaultPort(uriTransport(uri))
+}
+
+func uriTransport(uri Uri) string {
+	if uri.UriParams() != nil {
+		if tp, ok := uri.UriParams().Get("transport"); ok && tp != nil && tp.String() != "" {
+			return strings.ToUpper(tp.String())
+		}
+	}
+	if uri.IsEncrypted() {
+		return "TLS"
+	}
+
+	return DefaultProtocol
+}
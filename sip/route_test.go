@@ -0,0 +1,196 @@
+package sip_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+func parseUri(str string) sip.Uri {
+	uri, err := parser.ParseUri(str)
+	if err != nil {
+		panic(err)
+	}
+	return uri
+}
+
+func routeRequest(uri string, routes ...string) sip.Request {
+	lines := []string{
+		"INVITE " + uri + " SIP/2.0",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK776asdhds",
+		"Max-Forwards: 70",
+	}
+	for _, route := range routes {
+		lines = append(lines, "Route: "+route)
+	}
+	lines = append(lines,
+		"From: <sip:alice@example.com>;tag=1928301774",
+		"To: <sip:bob@example.com>",
+		"Call-ID: a84b4c76e66710",
+		"CSeq: 314159 INVITE",
+		"",
+		"",
+	)
+
+	msg, err := parser.ParseMessage([]byte(strings.Join(lines, "\r\n")), log.NewDefaultLogrusLogger())
+	if err != nil {
+		panic(err)
+	}
+	return msg.(sip.Request)
+}
+
+func uriList(uris []sip.Uri) string {
+	strs := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		strs = append(strs, "<"+uri.String()+">")
+	}
+	return strings.Join(strs, ", ")
+}
+
+// TestRouteProcessing runs route processing of the proxy against route sets produced by common elements.
+func TestRouteProcessing(t *testing.T) {
+	local := []sip.Uri{
+		parseUri("sip:10.0.0.100"),
+		parseUri("sip:192.168.1.1:5080;transport=tcp"),
+	}
+
+	tests := []struct {
+		description string
+		request     sip.Request
+		recipient   string
+		routes      string
+		nextHop     string
+		destination string
+	}{
+		{
+			"no Route",
+			routeRequest("sip:bob@pbx.example.com"),
+			"sip:bob@pbx.example.com",
+			"",
+			"sip:bob@pbx.example.com",
+			"pbx.example.com:5060",
+		},
+		{
+			"RFC 3261 loose routers",
+			routeRequest("sip:bob@pbx.example.com", "<sip:10.0.0.100;lr>", "<sip:sbc.example.com;lr>"),
+			"sip:bob@pbx.example.com",
+			"<sip:sbc.example.com;lr>",
+			"sip:sbc.example.com;lr",
+			"sbc.example.com:5060",
+		},
+		{
+			"lr=on from SER based proxies",
+			routeRequest("sip:bob@pbx.example.com", "<sip:10.0.0.100;lr=on>", "<sip:sbc.example.com;lr=on>"),
+			"sip:bob@pbx.example.com",
+			"<sip:sbc.example.com;lr=on>",
+			"sip:sbc.example.com;lr=on",
+			"sbc.example.com:5060",
+		},
+		{
+			"upper case LR param",
+			routeRequest("sip:bob@pbx.example.com", "<sip:10.0.0.100;LR>", "<sip:sbc.example.com;LR>"),
+			"sip:bob@pbx.example.com",
+			"<sip:sbc.example.com;LR>",
+			"sip:sbc.example.com;LR",
+			"sbc.example.com:5060",
+		},
+		{
+			"explicit default port of local URI",
+			routeRequest("sip:bob@pbx.example.com", "<sip:10.0.0.100:5060;lr>"),
+			"sip:bob@pbx.example.com",
+			"",
+			"sip:bob@pbx.example.com",
+			"pbx.example.com:5060",
+		},
+		{
+			"other port of local host is not local",
+			routeRequest("sip:bob@pbx.example.com", "<sip:10.0.0.100:5070;lr>"),
+			"sip:bob@pbx.example.com",
+			"<sip:10.0.0.100:5070;lr>",
+			"sip:10.0.0.100:5070;lr",
+			"10.0.0.100:5070",
+		},
+		{
+			"doubled Record-Route of multi-homed proxy",
+			routeRequest("sip:bob@pbx.example.com", "<sip:10.0.0.100;lr>, <sip:192.168.1.1:5080;transport=tcp;lr>", "<sip:pbx.example.com;lr>"),
+			"sip:bob@pbx.example.com",
+			"<sip:pbx.example.com;lr>",
+			"sip:pbx.example.com;lr",
+			"pbx.example.com:5060",
+		},
+		{
+			"previous hop is RFC 2543 strict router",
+			routeRequest("sip:10.0.0.100", "<sip:sbc.example.com;lr>", "<sip:bob@pbx.example.com>"),
+			"sip:bob@pbx.example.com",
+			"<sip:sbc.example.com;lr>",
+			"sip:sbc.example.com;lr",
+			"sbc.example.com:5060",
+		},
+		{
+			"next hop is RFC 2543 strict router",
+			routeRequest("sip:bob@pbx.example.com", "<sip:10.0.0.100;lr>", "<sip:legacy.example.com>", "<sip:sbc.example.com;lr>"),
+			"sip:legacy.example.com",
+			"<sip:sbc.example.com;lr>, <sip:bob@pbx.example.com>",
+			"sip:legacy.example.com",
+			"legacy.example.com:5060",
+		},
+		{
+			"strict routers on both sides",
+			routeRequest("sip:10.0.0.100", "<sip:legacy.example.com>", "<sip:bob@pbx.example.com>"),
+			"sip:legacy.example.com",
+			"<sip:bob@pbx.example.com>",
+			"sip:legacy.example.com",
+			"legacy.example.com:5060",
+		},
+	}
+
+	for _, test := range tests {
+		req := test.request
+		sip.RestoreStrictRoute(req, local...)
+		sip.StripLocalRoutes(req, local...)
+		nextHop := sip.NextHop(req)
+		sip.CompensateStrictRoute(req)
+
+		if got := req.Recipient().String(); got != test.recipient {
+			t.Errorf("[FAIL] %s: Request-URI expected: \"%s\", got: \"%s\"", test.description, test.recipient, got)
+		}
+		if got := uriList(sip.RouteUris(req)); got != test.routes {
+			t.Errorf("[FAIL] %s: Route expected: \"%s\", got: \"%s\"", test.description, test.routes, got)
+		}
+		if got := nextHop.String(); got != test.nextHop {
+			t.Errorf("[FAIL] %s: next hop expected: \"%s\", got: \"%s\"", test.description, test.nextHop, got)
+		}
+		if got := req.Destination(); got != test.destination {
+			t.Errorf("[FAIL] %s: destination expected: \"%s\", got: \"%s\"", test.description, test.destination, got)
+		}
+	}
+}
+
+func TestAddRecordRoute(t *testing.T) {
+	udp := parseUri("sip:10.0.0.100")
+	tcp := parseUri("sip:10.0.0.100;transport=tcp")
+	lan := parseUri("sip:192.168.1.1:5080")
+
+	tests := []struct {
+		description string
+		inbound     sip.Uri
+		outbound    sip.Uri
+		expected    string
+	}{
+		{"same interface", udp, udp, "<sip:10.0.0.100;lr>"},
+		{"other transport", udp, tcp, "<sip:10.0.0.100;transport=tcp;lr>, <sip:10.0.0.100;lr>"},
+		{"other interface", lan, udp, "<sip:10.0.0.100;lr>, <sip:192.168.1.1:5080;lr>"},
+		{"unknown outbound interface", lan, nil, "<sip:192.168.1.1:5080;lr>"},
+	}
+
+	for _, test := range tests {
+		req := routeRequest("sip:bob@pbx.example.com")
+		sip.AddRecordRoute(req, test.inbound, test.outbound)
+		if got := uriList(sip.RecordRouteUris(req)); got != test.expected {
+			t.Errorf("[FAIL] %s: Record-Route expected: \"%s\", got: \"%s\"", test.description, test.expected, got)
+		}
+	}
+}
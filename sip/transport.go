@@ -1,8 +1,29 @@
 package sip
 
+import "context"
+
 type Transport interface {
 	Messages() <-chan Message
 	Send(msg Message) error
 	IsReliable(network string) bool
 	IsStreamed(network string) bool
 }
+
+// ContextTransport is a Transport that accepts context on send,
+// the context deadline limits DNS lookup and establishing of the new connection.
+type ContextTransport interface {
+	Transport
+	SendContext(ctx context.Context, msg Message) error
+}
+
+// SendContext sends the message through the transport with the context if it is supported.
+func SendContext(ctx context.Context, tpl Transport, msg Message) error {
+	if tpl, ok := tpl.(ContextTransport); ok {
+		return tpl.SendContext(ctx, msg)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return tpl.Send(msg)
+}
@@ -0,0 +1,48 @@
+package sip
+
+import "sync"
+
+// Values is the application data attached to dialogs, transactions and connections,
+// so the application does not need parallel maps keyed by Call-ID or transaction key.
+// Keys should be values of the unexported types like context.Context keys to avoid collisions between packages.
+// Transactions and connections of the library implement Values, it is reached by the type assertion:
+//
+//	if values, ok := tx.(sip.Values); ok {
+//		values.SetValue(callStateKey{}, state)
+//	}
+type Values interface {
+	// Value returns the value of the key, nil if it is not set.
+	Value(key interface{}) interface{}
+	SetValue(key, value interface{})
+	DeleteValue(key interface{})
+}
+
+// ValueStore is a thread-safe implementation of Values, zero value is ready to use.
+type ValueStore struct {
+	mu     sync.RWMutex
+	values map[interface{}]interface{}
+}
+
+func (store *ValueStore) Value(key interface{}) interface{} {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.values[key]
+}
+
+func (store *ValueStore) SetValue(key, value interface{}) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.values == nil {
+		store.values = make(map[interface{}]interface{})
+	}
+	store.values[key] = value
+}
+
+func (store *ValueStore) DeleteValue(key interface{}) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.values, key)
+}
@@ -0,0 +1,48 @@
+package sip_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+type callStateKey struct{}
+
+func TestValueStore(t *testing.T) {
+	var store sip.ValueStore
+	var values sip.Values = &store
+
+	if v := values.Value(callStateKey{}); v != nil {
+		t.Fatalf("unexpected value %v of the empty store", v)
+	}
+
+	values.SetValue(callStateKey{}, "ringing")
+	values.SetValue("call-state", "other")
+	if v := values.Value(callStateKey{}); v != "ringing" {
+		t.Fatalf("expected 'ringing', got %v", v)
+	}
+
+	values.DeleteValue(callStateKey{})
+	if v := values.Value(callStateKey{}); v != nil {
+		t.Fatalf("unexpected value %v after delete", v)
+	}
+	if v := values.Value("call-state"); v != "other" {
+		t.Fatalf("expected 'other', got %v", v)
+	}
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			values.SetValue(key, i)
+			if v := values.Value(key); v != i {
+				t.Errorf("expected %d, got %v", i, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
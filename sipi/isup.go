@@ -0,0 +1,231 @@
+package sipi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ISUP message type codes - ITU-T Q.763 Table 4.
+const (
+	TypeIAM byte = 0x01
+	TypeACM byte = 0x06
+	TypeANM byte = 0x09
+	TypeREL byte = 0x0c
+	TypeRLC byte = 0x10
+	TypeCPG byte = 0x2c
+)
+
+// ISUP parameter codes - ITU-T Q.763 Table 5.
+const (
+	ParamEndOfOptional        byte = 0x00
+	ParamCalledPartyNumber    byte = 0x04
+	ParamCallingPartyNumber   byte = 0x0a
+	ParamRedirectingNumber    byte = 0x0b
+	ParamCauseIndicators      byte = 0x12
+	ParamOriginalCalledNumber byte = 0x28
+)
+
+// ErrMalformed is returned on truncated or inconsistent ISUP message.
+var ErrMalformed = errors.New("malformed ISUP message")
+
+// Parameter is a raw optional ISUP parameter.
+type Parameter struct {
+	Code  byte
+	Value []byte
+}
+
+// Number is a called, calling or other party number parameter - ITU-T Q.763 3.9, 3.10.
+type Number struct {
+	NatureOfAddress byte
+	NumberingPlan   byte
+	// Indicator is INN indicator of the called number or NI (number incomplete) indicator of the calling number.
+	Indicator bool
+	// Presentation and Screening are address presentation restricted and screening indicators of the calling number.
+	Presentation byte
+	Screening    byte
+	// Digits are address signals as hex digits: 0-9, B and C for codes 11 and 12, F for ST.
+	Digits string
+}
+
+// IAM is an initial address message - ITU-T Q.763 Table 32.
+type IAM struct {
+	NatureOfConnection    byte
+	ForwardCallIndicators uint16
+	CallingPartyCategory  byte
+	TransmissionMedium    byte
+	Called                Number
+	// Calling is an optional calling party number, nil if it is absent.
+	Calling *Number
+	// Optional are other optional parameters in order.
+	Optional []Parameter
+}
+
+// REL is a release message - ITU-T Q.763 Table 33.
+type REL struct {
+	// Cause is a cause value of cause indicators - ITU-T Q.850.
+	Cause          byte
+	Location       byte
+	CodingStandard byte
+	Diagnostics    []byte
+	// Optional are optional parameters in order.
+	Optional []Parameter
+}
+
+// MessageType returns ISUP message type code of the raw ISUP message of SIP-I body,
+// which starts with the message type code without CIC and routing label - RFC 3204 4.
+func MessageType(data []byte) (byte, error) {
+	if len(data) == 0 {
+		return 0, ErrMalformed
+	}
+
+	return data[0], nil
+}
+
+// DecodeIAM decodes mandatory and calling party number parameters of IAM.
+func DecodeIAM(data []byte) (*IAM, error) {
+	if len(data) < 8 || data[0] != TypeIAM {
+		return nil, fmt.Errorf("decode IAM: %w", ErrMalformed)
+	}
+
+	iam := &IAM{
+		NatureOfConnection:    data[1],
+		ForwardCallIndicators: uint16(data[2]) | uint16(data[3])<<8,
+		CallingPartyCategory:  data[4],
+		TransmissionMedium:    data[5],
+	}
+	// pointers are relative to their own octets
+	called, err := variable(data, 6)
+	if err != nil {
+		return nil, fmt.Errorf("decode IAM called party number: %w", err)
+	}
+	if iam.Called, err = decodeNumber(called); err != nil {
+		return nil, fmt.Errorf("decode IAM called party number: %w", err)
+	}
+
+	params, err := optional(data, 7)
+	if err != nil {
+		return nil, fmt.Errorf("decode IAM optional parameters: %w", err)
+	}
+	for _, param := range params {
+		if param.Code == ParamCallingPartyNumber && iam.Calling == nil {
+			num, err := decodeNumber(param.Value)
+			if err != nil {
+				return nil, fmt.Errorf("decode IAM calling party number: %w", err)
+			}
+			iam.Calling = &num
+
+			continue
+		}
+		iam.Optional = append(iam.Optional, param)
+	}
+
+	return iam, nil
+}
+
+// DecodeREL decodes cause indicators and optional parameters of REL.
+func DecodeREL(data []byte) (*REL, error) {
+	if len(data) < 3 || data[0] != TypeREL {
+		return nil, fmt.Errorf("decode REL: %w", ErrMalformed)
+	}
+
+	cause, err := variable(data, 1)
+	if err != nil || len(cause) < 2 {
+		return nil, fmt.Errorf("decode REL cause indicators: %w", ErrMalformed)
+	}
+	rel := &REL{
+		Location:       cause[0] & 0x0f,
+		CodingStandard: cause[0] >> 5 & 0x03,
+	}
+	idx := 1
+	// octet 1a of recommendation is present when the extension bit is 0
+	if cause[0]&0x80 == 0 {
+		idx++
+	}
+	if idx >= len(cause) {
+		return nil, fmt.Errorf("decode REL cause indicators: %w", ErrMalformed)
+	}
+	rel.Cause = cause[idx] & 0x7f
+	if idx+1 < len(cause) {
+		rel.Diagnostics = cause[idx+1:]
+	}
+
+	if rel.Optional, err = optional(data, 2); err != nil {
+		return nil, fmt.Errorf("decode REL optional parameters: %w", err)
+	}
+
+	return rel, nil
+}
+
+// variable returns mandatory variable parameter pointed by the octet.
+func variable(data []byte, ptr int) ([]byte, error) {
+	if ptr >= len(data) || data[ptr] == 0 {
+		return nil, ErrMalformed
+	}
+	start := ptr + int(data[ptr])
+	if start >= len(data) {
+		return nil, ErrMalformed
+	}
+	end := start + 1 + int(data[start])
+	if end > len(data) {
+		return nil, ErrMalformed
+	}
+
+	return data[start+1 : end], nil
+}
+
+// optional returns optional parameters pointed by the octet, zero pointer means no optional part.
+func optional(data []byte, ptr int) ([]Parameter, error) {
+	if ptr >= len(data) {
+		return nil, ErrMalformed
+	}
+	if data[ptr] == 0 {
+		return nil, nil
+	}
+
+	var params []Parameter
+	for idx := ptr + int(data[ptr]); ; {
+		if idx >= len(data) {
+			return nil, ErrMalformed
+		}
+		if data[idx] == ParamEndOfOptional {
+			return params, nil
+		}
+		if idx+1 >= len(data) || idx+2+int(data[idx+1]) > len(data) {
+			return nil, ErrMalformed
+		}
+		params = append(params, Parameter{
+			Code:  data[idx],
+			Value: data[idx+2 : idx+2+int(data[idx+1])],
+		})
+		idx += 2 + int(data[idx+1])
+	}
+}
+
+func decodeNumber(data []byte) (Number, error) {
+	if len(data) < 2 {
+		return Number{}, ErrMalformed
+	}
+
+	num := Number{
+		NatureOfAddress: data[0] & 0x7f,
+		Indicator:       data[1]&0x80 != 0,
+		NumberingPlan:   data[1] >> 4 & 0x07,
+		Presentation:    data[1] >> 2 & 0x03,
+		Screening:       data[1] & 0x03,
+	}
+
+	const hex = "0123456789ABCDEF"
+	var digits strings.Builder
+	for _, b := range data[2:] {
+		digits.WriteByte(hex[b&0x0f])
+		digits.WriteByte(hex[b>>4])
+	}
+	num.Digits = digits.String()
+	// odd number of address signals has the filler
+	if data[0]&0x80 != 0 && len(num.Digits) > 0 {
+		num.Digits = num.Digits[:len(num.Digits)-1]
+	}
+
+	return num, nil
+}
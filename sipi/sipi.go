@@ -0,0 +1,127 @@
+// sipi package implements SIP-I ISUP bodies of carrier interconnects - ITU-T Q.1912.5, RFC 3204.
+// ISUP messages are carried as application/isup parts of multipart bodies next to SDP.
+// Parts are passed through byte to byte without re-encoding, typed decoding of common
+// IAM and REL parameters is optional.
+package sipi
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const (
+	ContentType = "application/isup"
+	// DefaultVersion is a version param of ISUP Content-Type - RFC 3204 4.
+	DefaultVersion = "itu-t92+"
+	// DefaultDisposition is a Content-Disposition of ISUP parts - Q.1912.5 5.4.1.
+	DefaultDisposition = "signal;handling=optional"
+)
+
+// Part returns ISUP part of the message body, either the whole application/isup body
+// or the part of multipart body.
+func Part(msg sip.Message) (*sip.BodyPart, bool) {
+	contentType, ok := msg.ContentType()
+	if !ok {
+		return nil, false
+	}
+
+	typ, _, err := mime.ParseMediaType(contentType.Value())
+	if err != nil {
+		return nil, false
+	}
+	switch {
+	case typ == ContentType:
+		return &sip.BodyPart{
+			Headers: []sip.MIMEHeader{{Name: "Content-Type", Value: contentType.Value()}},
+			Body:    msg.Body(),
+		}, true
+	case strings.HasPrefix(typ, "multipart/"):
+		mp, err := sip.ParseMultipart(contentType.Value(), msg.Body())
+		if err != nil {
+			return nil, false
+		}
+		return mp.Part(ContentType)
+	}
+
+	return nil, false
+}
+
+// Body returns raw ISUP message of the message body.
+func Body(msg sip.Message) ([]byte, bool) {
+	part, ok := Part(msg)
+	if !ok {
+		return nil, false
+	}
+
+	return []byte(part.Body), true
+}
+
+// NewPart creates ISUP part with the raw ISUP message, empty version is DefaultVersion.
+func NewPart(isup []byte, version string) *sip.BodyPart {
+	if version == "" {
+		version = DefaultVersion
+	}
+
+	return &sip.BodyPart{
+		Headers: []sip.MIMEHeader{
+			{Name: "Content-Type", Value: mime.FormatMediaType(ContentType, map[string]string{"version": version})},
+			{Name: "Content-Disposition", Value: DefaultDisposition},
+		},
+		Body: string(isup),
+	}
+}
+
+// SetPart sets ISUP part of the message body: the existing ISUP part is replaced,
+// other body like SDP is kept in the multipart/mixed body with the part.
+func SetPart(msg sip.Message, part *sip.BodyPart) error {
+	contentType, ok := msg.ContentType()
+	if !ok || msg.Body() == "" {
+		sip.SetMessageMultipart(msg, sip.NewMultipart(part))
+		return nil
+	}
+
+	var mp *sip.Multipart
+	typ, _, err := mime.ParseMediaType(contentType.Value())
+	switch {
+	case err != nil:
+		return fmt.Errorf("parse Content-Type %q: %w", contentType.Value(), err)
+	case strings.HasPrefix(typ, "multipart/"):
+		if mp, err = sip.ParseMultipart(contentType.Value(), msg.Body()); err != nil {
+			return err
+		}
+	case typ == ContentType:
+		mp = sip.NewMultipart()
+	default:
+		mp = sip.NewMultipart(sip.NewBodyPart(contentType.Value(), msg.Body()))
+	}
+
+	parts := make([]*sip.BodyPart, 0, len(mp.Parts)+1)
+	for _, p := range mp.Parts {
+		if p.MediaType() != ContentType {
+			parts = append(parts, p)
+		}
+	}
+	mp.Parts = append(parts, part)
+	sip.SetMessageMultipart(msg, mp)
+
+	return nil
+}
+
+// Passthrough copies ISUP part of the message to another message as is, like B2BUA does
+// between call legs. Reports whether the part was found.
+func Passthrough(from, to sip.Message) (bool, error) {
+	part, ok := Part(from)
+	if !ok {
+		return false, nil
+	}
+
+	clone := &sip.BodyPart{
+		Headers: append([]sip.MIMEHeader(nil), part.Headers...),
+		Body:    part.Body,
+	}
+
+	return true, SetPart(to, clone)
+}
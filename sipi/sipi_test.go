@@ -0,0 +1,133 @@
+package sipi_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sipi"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var (
+	iam = []byte{
+		0x01, 0x00, 0x20, 0x01, 0x0a, 0x00, 0x02, 0x07,
+		// called party number 12345
+		0x05, 0x83, 0x90, 0x21, 0x43, 0x05,
+		// calling party number 1234
+		0x0a, 0x04, 0x03, 0x11, 0x21, 0x43,
+		0x39, 0x02, 0xaa, 0xbb,
+		0x00,
+	}
+	rel = []byte{0x0c, 0x02, 0x00, 0x02, 0x84, 0x90}
+)
+
+var _ = Describe("SIP-I", func() {
+	var invite sip.Request
+
+	BeforeEach(func() {
+		invite = testutils.Request([]string{
+			"INVITE sip:12345@carrier.example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:1234@example.com>;tag=from-tag",
+			"To: <sip:12345@carrier.example.com>",
+			"Call-ID: sipi-call-id",
+			"CSeq: 1 INVITE",
+			"Content-Type: application/sdp",
+			"Content-Length: 10",
+			"",
+			"v=0\r\no=-\r\n",
+		})
+	})
+
+	It("should pass ISUP part through without re-encoding", func() {
+		Expect(sipi.SetPart(invite, sipi.NewPart(iam, ""))).To(Succeed())
+
+		contentType, ok := invite.ContentType()
+		Expect(ok).To(BeTrue())
+		Expect(contentType.Value()).To(HavePrefix("multipart/mixed;"))
+		mp, err := sip.MessageMultipart(invite)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mp.Parts).To(HaveLen(2))
+		Expect(mp.Parts[0].MediaType()).To(Equal("application/sdp"))
+		Expect(mp.Parts[0].Body).To(Equal("v=0\r\no=-\r\n"))
+
+		// the message goes over the wire
+		received := testutils.Message([]string{invite.String()}).(sip.Request)
+		out := testutils.Request([]string{
+			"INVITE sip:12345@gw.example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:1234@example.com>;tag=b2bua-tag",
+			"To: <sip:12345@gw.example.com>",
+			"Call-ID: sipi-call-id-b",
+			"CSeq: 1 INVITE",
+			"Content-Length: 0",
+			"",
+			"",
+		})
+		ok, err = sipi.Passthrough(received, out)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		body, ok := sipi.Body(out)
+		Expect(ok).To(BeTrue())
+		Expect(body).To(Equal(iam))
+		part, _ := sipi.Part(out)
+		disposition, _ := part.Header("Content-Disposition")
+		Expect(disposition).To(Equal(sipi.DefaultDisposition))
+	})
+
+	It("should replace the existing ISUP part", func() {
+		Expect(sipi.SetPart(invite, sipi.NewPart(iam, ""))).To(Succeed())
+		Expect(sipi.SetPart(invite, sipi.NewPart(rel, ""))).To(Succeed())
+
+		mp, err := sip.MessageMultipart(invite)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mp.Parts).To(HaveLen(2))
+		body, _ := sipi.Body(invite)
+		Expect(body).To(Equal(rel))
+	})
+
+	It("should decode IAM", func() {
+		typ, err := sipi.MessageType(iam)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(typ).To(Equal(sipi.TypeIAM))
+
+		msg, err := sipi.DecodeIAM(iam)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(msg.ForwardCallIndicators).To(Equal(uint16(0x0120)))
+		Expect(msg.CallingPartyCategory).To(Equal(byte(0x0a)))
+		Expect(msg.Called).To(Equal(sipi.Number{
+			NatureOfAddress: 3,
+			NumberingPlan:   1,
+			Indicator:       true,
+			Digits:          "12345",
+		}))
+		Expect(msg.Calling).To(Equal(&sipi.Number{
+			NatureOfAddress: 3,
+			NumberingPlan:   1,
+			Screening:       1,
+			Digits:          "1234",
+		}))
+		Expect(msg.Optional).To(Equal([]sipi.Parameter{{Code: 0x39, Value: []byte{0xaa, 0xbb}}}))
+	})
+
+	It("should decode REL", func() {
+		msg, err := sipi.DecodeREL(rel)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(msg.Cause).To(Equal(byte(16)))
+		Expect(msg.Location).To(Equal(byte(4)))
+		Expect(msg.Optional).To(BeEmpty())
+	})
+
+	It("should fail on truncated messages", func() {
+		_, err := sipi.DecodeIAM(iam[:12])
+		Expect(errors.Is(err, sipi.ErrMalformed)).To(BeTrue())
+		_, err = sipi.DecodeREL(rel[:4])
+		Expect(errors.Is(err, sipi.ErrMalformed)).To(BeTrue())
+		_, err = sipi.DecodeREL(iam)
+		Expect(errors.Is(err, sipi.ErrMalformed)).To(BeTrue())
+	})
+})
@@ -0,0 +1,73 @@
+package gosip
+
+import (
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// SipsPolicy enforces secure signaling for secure deployments - RFC 3261 26.2.2, RFC 5630.
+// Requests to SIPS URIs must arrive over TLS and must not be routed over insecure hops:
+// requests with SIPS Request-URI received over insecure transport are rejected with '416 Unsupported URI Scheme',
+// requests with SIPS Request-URI and Route or Record-Route URIs that are not secure are rejected with '403 Insecure Route'.
+// TLS and WSS transports are secure, SIP URIs are secure only with transport=tls.
+type SipsPolicy struct {
+	// TLSOnly rejects all requests received over insecure transports with '403 TLS Required'.
+	TLSOnly bool
+}
+
+// sipsPolicy is the Admission of the SipsPolicy.
+type sipsPolicy struct {
+	policy SipsPolicy
+}
+
+func newSipsPolicy(policy SipsPolicy) *sipsPolicy {
+	return &sipsPolicy{policy: policy}
+}
+
+func (sp *sipsPolicy) Admit(req AdmissionRequest) AdmissionDecision {
+	secure := isSecureNetwork(req.Transport)
+	if sp.policy.TLSOnly && !secure {
+		return Reject(403, "TLS Required")
+	}
+
+	uri := req.Request.Recipient()
+	if uri == nil || !uri.IsEncrypted() {
+		return Accept()
+	}
+	if !secure {
+		return Reject(416, "Unsupported URI Scheme")
+	}
+
+	for _, name := range []string{"Route", "Record-Route"} {
+		for _, hdr := range req.Request.GetHeaders(name) {
+			var addrs []sip.Uri
+			switch hdr := hdr.(type) {
+			case *sip.RouteHeader:
+				addrs = hdr.Addresses
+			case *sip.RecordRouteHeader:
+				addrs = hdr.Addresses
+			}
+			for _, addr := range addrs {
+				if !isSecureUri(addr) {
+					return Reject(403, "Insecure Route")
+				}
+			}
+		}
+	}
+
+	return Accept()
+}
+
+// isSecureUri checks that the URI is SIPS or SIP with transport=tls.
+func isSecureUri(uri sip.Uri) bool {
+	if uri.IsEncrypted() {
+		return true
+	}
+	if uri.UriParams() == nil {
+		return false
+	}
+	transport, ok := uri.UriParams().Get("transport")
+
+	return ok && transport != nil && strings.EqualFold(transport.String(), "tls")
+}
@@ -0,0 +1,318 @@
+package siptest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+type memoryPeer struct {
+	*inbox
+	network string
+	addr    string
+
+	mu     sync.Mutex
+	parser *parser.PacketParser
+	layer  *memoryLayer
+
+	log log.Logger
+}
+
+// NewMemoryPeer creates peer with address addr connected to the application through the memory.
+// Returned factory should be passed to gosip.NewServer, server listen address is used as peer remote address.
+// All messages sent by the server are delivered to the peer regardless of the destination,
+// messages are serialized and parsed on both sides like on the real network.
+// The reliability of the network (udp or tcp) defines transaction timers of the server.
+func NewMemoryPeer(network, addr string, logger log.Logger) (Peer, gosip.TransportLayerFactory) {
+	p := &memoryPeer{
+		inbox:   newInbox(),
+		network: strings.ToLower(network),
+		addr:    addr,
+	}
+	p.log = logger.
+		WithPrefix("siptest.MemoryPeer").
+		WithFields(log.Fields{
+			"peer_ptr": fmt.Sprintf("%p", p),
+		})
+	p.parser = parser.NewPacketParser(p.Log())
+
+	// the memory layer has no connections and listeners, so options of events are not used
+	factory := func(
+		ip net.IP,
+		dnsResolver *net.Resolver,
+		msgMapper sip.MessageMapper,
+		logger log.Logger,
+		options ...transport.LayerOption,
+	) transport.Layer {
+		tpl := &memoryLayer{
+			peer:      p,
+			ip:        ip,
+			msgMapper: msgMapper,
+			msgs:      make(chan sip.Message),
+			errs:      make(chan error),
+			done:      make(chan struct{}),
+		}
+		tpl.log = logger.
+			WithPrefix("siptest.MemoryLayer").
+			WithFields(log.Fields{
+				"transport_layer_ptr": fmt.Sprintf("%p", tpl),
+			})
+
+		p.mu.Lock()
+		p.layer = tpl
+		p.mu.Unlock()
+
+		return tpl
+	}
+
+	return p, factory
+}
+
+func (p *memoryPeer) Log() log.Logger {
+	return p.log
+}
+
+func (p *memoryPeer) Network() string {
+	return p.network
+}
+
+func (p *memoryPeer) LocalAddr() string {
+	return p.addr
+}
+
+func (p *memoryPeer) RemoteAddr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.layer == nil {
+		return ""
+	}
+
+	return p.layer.addr()
+}
+
+func (p *memoryPeer) Send(data []byte) error {
+	p.mu.Lock()
+	tpl := p.layer
+	msg, err := p.parser.ParseMessage(data)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if tpl == nil {
+		return fmt.Errorf("%s is not connected to the server", p)
+	}
+
+	return tpl.receive(msg)
+}
+
+// deliver passes the message sent by the server to the peer through the text, like the real network does.
+func (p *memoryPeer) deliver(msg sip.Message) error {
+	p.mu.Lock()
+	msg, err := p.parser.ParseMessage([]byte(msg.String()))
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	p.put(msg)
+
+	return nil
+}
+
+func (p *memoryPeer) Close() error {
+	if !p.close() {
+		return nil
+	}
+
+	p.mu.Lock()
+	p.parser.Stop()
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *memoryPeer) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("siptest.MemoryPeer<%s>", p.Log().Fields())
+}
+
+// memoryLayer is the transport layer of the server connected to the memory peer.
+type memoryLayer struct {
+	peer      *memoryPeer
+	ip        net.IP
+	msgMapper sip.MessageMapper
+
+	mu         sync.Mutex
+	listenAddr string
+
+	msgs       chan sip.Message
+	errs       chan error
+	done       chan struct{}
+	cancelOnce sync.Once
+
+	log log.Logger
+}
+
+func (tpl *memoryLayer) Log() log.Logger {
+	return tpl.log
+}
+
+func (tpl *memoryLayer) String() string {
+	if tpl == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("siptest.MemoryLayer<%s>", tpl.Log().Fields())
+}
+
+func (tpl *memoryLayer) Cancel() {
+	tpl.cancelOnce.Do(func() {
+		close(tpl.done)
+	})
+}
+
+func (tpl *memoryLayer) Done() <-chan struct{} {
+	return tpl.done
+}
+
+func (tpl *memoryLayer) Messages() <-chan sip.Message {
+	return tpl.msgs
+}
+
+func (tpl *memoryLayer) Errors() <-chan error {
+	return tpl.errs
+}
+
+func (tpl *memoryLayer) Listen(network string, addr string, options ...transport.ListenOption) error {
+	if !strings.EqualFold(network, tpl.peer.network) {
+		return fmt.Errorf("%s supports only %s network", tpl, tpl.peer.network)
+	}
+
+	tpl.mu.Lock()
+	if tpl.listenAddr == "" {
+		tpl.listenAddr = addr
+	}
+	tpl.mu.Unlock()
+
+	return nil
+}
+
+func (tpl *memoryLayer) ListenContext(
+	ctx context.Context,
+	network string,
+	addr string,
+	options ...transport.ListenOption,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return tpl.Listen(network, addr, options...)
+}
+
+func (tpl *memoryLayer) Unlisten(network string, addr string) error {
+	tpl.mu.Lock()
+	if tpl.listenAddr == addr {
+		tpl.listenAddr = ""
+	}
+	tpl.mu.Unlock()
+
+	return nil
+}
+
+func (tpl *memoryLayer) addr() string {
+	tpl.mu.Lock()
+	defer tpl.mu.Unlock()
+
+	if tpl.listenAddr != "" {
+		return tpl.listenAddr
+	}
+
+	return net.JoinHostPort(tpl.ip.String(), strconv.Itoa(int(sip.DefaultPort(tpl.peer.network))))
+}
+
+func (tpl *memoryLayer) SendContext(ctx context.Context, msg sip.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return tpl.Send(msg)
+}
+
+func (tpl *memoryLayer) Send(msg sip.Message) error {
+	select {
+	case <-tpl.done:
+		return fmt.Errorf("transport layer is canceled")
+	default:
+	}
+
+	viaHop, ok := msg.ViaHop()
+	if !ok {
+		return &sip.MalformedMessageError{
+			Err: fmt.Errorf("missing required 'Via' header"),
+			Msg: msg.String(),
+		}
+	}
+
+	// rewrite sent-by like the real transport layer does
+	if _, ok := msg.(sip.Request); ok {
+		host, port, _ := net.SplitHostPort(tpl.addr())
+		viaHop.Transport = strings.ToUpper(tpl.peer.network)
+		viaHop.Host = host
+		if viaHop.Port == nil {
+			if p, err := strconv.Atoi(port); err == nil {
+				sentByPort := sip.Port(p)
+				viaHop.Port = &sentByPort
+			}
+		}
+	}
+
+	tpl.Log().Debugf("sending SIP message:\n%s", msg)
+
+	return tpl.peer.deliver(msg)
+}
+
+// receive passes the message sent by the peer up to the server.
+func (tpl *memoryLayer) receive(msg sip.Message) error {
+	msg.SetTransport(strings.ToUpper(tpl.peer.network))
+	msg.SetSource(tpl.peer.addr)
+	msg.SetDestination(tpl.addr())
+
+	msg = msg.WithFields(log.Fields{
+		"received_at": time.Now(),
+		"direction":   "in",
+		"remote_addr": tpl.peer.addr,
+	})
+	if tpl.msgMapper != nil {
+		msg = tpl.msgMapper(msg)
+	}
+
+	select {
+	case <-tpl.done:
+		return fmt.Errorf("transport layer is canceled")
+	case tpl.msgs <- msg:
+		return nil
+	}
+}
+
+func (tpl *memoryLayer) IsReliable(network string) bool {
+	return strings.EqualFold(network, "tcp")
+}
+
+func (tpl *memoryLayer) IsStreamed(network string) bool {
+	return strings.EqualFold(network, "tcp")
+}
@@ -0,0 +1,313 @@
+package siptest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// Peer is a remote side of the application played by the scenario.
+type Peer interface {
+	// Network returns network of the peer: udp or tcp.
+	Network() string
+	// LocalAddr returns address of the peer.
+	LocalAddr() string
+	// RemoteAddr returns address of the application.
+	RemoteAddr() string
+	// Send sends raw message to the application.
+	Send(data []byte) error
+	// Receive waits for the next message from the application.
+	Receive(ctx context.Context) (sip.Message, error)
+	Close() error
+}
+
+// inbox is a queue of received messages shared by peers.
+type inbox struct {
+	msgs      chan sip.Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newInbox() *inbox {
+	return &inbox{
+		msgs: make(chan sip.Message, 128),
+		done: make(chan struct{}),
+	}
+}
+
+func (in *inbox) put(msg sip.Message) {
+	select {
+	case <-in.done:
+	case in.msgs <- msg:
+	}
+}
+
+func (in *inbox) Receive(ctx context.Context) (sip.Message, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-in.done:
+		return nil, io.EOF
+	case msg := <-in.msgs:
+		return msg, nil
+	}
+}
+
+func (in *inbox) close() bool {
+	closed := false
+	in.closeOnce.Do(func() {
+		close(in.done)
+		closed = true
+	})
+
+	return closed
+}
+
+type netPeer struct {
+	*inbox
+	network    string
+	localAddr  string
+	remoteAddr string
+
+	packetConn net.PacketConn
+	listener   net.Listener
+	mu         sync.Mutex
+	conn       net.Conn
+	wg         sync.WaitGroup
+
+	log log.Logger
+}
+
+// NewPeer creates peer over the network socket bound to localAddr.
+// UDP peer sends datagrams to remoteAddr. TCP peer accepts connections on localAddr
+// and sends over the last accepted connection, or connects to remoteAddr if there is no one.
+func NewPeer(network, localAddr, remoteAddr string, logger log.Logger) (Peer, error) {
+	p := &netPeer{
+		inbox:      newInbox(),
+		network:    strings.ToLower(network),
+		remoteAddr: remoteAddr,
+	}
+	p.log = logger.
+		WithPrefix("siptest.Peer").
+		WithFields(log.Fields{
+			"peer_ptr": fmt.Sprintf("%p", p),
+		})
+
+	switch p.network {
+	case "udp":
+		conn, err := net.ListenPacket(p.network, localAddr)
+		if err != nil {
+			return nil, err
+		}
+		p.packetConn = conn
+		p.localAddr = conn.LocalAddr().String()
+
+		p.wg.Add(1)
+		go p.readPackets()
+	case "tcp":
+		listener, err := net.Listen(p.network, localAddr)
+		if err != nil {
+			return nil, err
+		}
+		p.listener = listener
+		p.localAddr = listener.Addr().String()
+
+		p.wg.Add(1)
+		go p.accept()
+	default:
+		return nil, fmt.Errorf("network %s is not supported", network)
+	}
+
+	return p, nil
+}
+
+func (p *netPeer) Log() log.Logger {
+	return p.log
+}
+
+func (p *netPeer) Network() string {
+	return p.network
+}
+
+func (p *netPeer) LocalAddr() string {
+	return p.localAddr
+}
+
+func (p *netPeer) RemoteAddr() string {
+	return p.remoteAddr
+}
+
+func (p *netPeer) Send(data []byte) error {
+	if p.packetConn != nil {
+		raddr, err := net.ResolveUDPAddr(p.network, p.remoteAddr)
+		if err != nil {
+			return err
+		}
+		_, err = p.packetConn.WriteTo(data, raddr)
+
+		return err
+	}
+
+	conn, err := p.connection()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+
+	return err
+}
+
+func (p *netPeer) Close() error {
+	if !p.close() {
+		return nil
+	}
+
+	var err error
+	if p.packetConn != nil {
+		err = p.packetConn.Close()
+	}
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	p.mu.Lock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return err
+}
+
+func (p *netPeer) readPackets() {
+	defer p.wg.Done()
+
+	pp := parser.NewPacketParser(p.Log())
+	defer pp.Stop()
+
+	buf := make([]byte, 65535)
+	for {
+		num, _, err := p.packetConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		msg, err := pp.ParseMessage(append([]byte{}, buf[:num]...))
+		if err != nil {
+			p.Log().Warnf("failed to parse message: %s", err)
+			continue
+		}
+
+		p.put(msg)
+	}
+}
+
+func (p *netPeer) accept() {
+	defer p.wg.Done()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.serve(conn)
+	}
+}
+
+// connection returns the last accepted or new outgoing connection.
+func (p *netPeer) connection() (net.Conn, error) {
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := net.Dial(p.network, p.remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	p.serve(conn)
+
+	return conn, nil
+}
+
+func (p *netPeer) serve(conn net.Conn) {
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go p.readStream(conn)
+}
+
+func (p *netPeer) readStream(conn net.Conn) {
+	defer p.wg.Done()
+
+	msgs := make(chan sip.Message)
+	errs := make(chan error)
+	sp := parser.NewParser(msgs, errs, true, p.Log())
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		buf := make([]byte, 65535)
+		for {
+			num, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := sp.Write(append([]byte{}, buf[:num]...)); err != nil {
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		conn.Close()
+
+		p.mu.Lock()
+		if p.conn == conn {
+			p.conn = nil
+		}
+		p.mu.Unlock()
+
+		// parser may be blocked on the output, so drain it until stopped
+		stopped := make(chan struct{})
+		go func() {
+			sp.Stop()
+			close(stopped)
+		}()
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-msgs:
+			case <-errs:
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-closed:
+			return
+		case msg := <-msgs:
+			p.put(msg)
+		case err := <-errs:
+			p.Log().Warnf("failed to parse message: %s", err)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+// siptest package runs SIPp-like scenarios against applications built on gosip in integration tests.
+// The scenario is a sequence of steps: messages sent from templates, expected messages and pauses.
+// The scenario plays the remote side over a real socket (NewPeer) or in-memory transport (NewMemoryPeer).
+//
+//	scenario := siptest.Scenario{
+//		Name: "uac",
+//		Steps: []siptest.Step{
+//			siptest.Send(`
+//				INVITE sip:bob@[remote_ip]:[remote_port] SIP/2.0
+//				Via: SIP/2.0/[transport] [local_ip]:[local_port];branch=[branch]
+//				From: <sip:alice@[local_ip]>;tag=[local_tag]
+//				To: <sip:bob@[remote_ip]>
+//				Call-ID: [call_id]
+//				CSeq: 1 INVITE
+//				Content-Length: [len]
+//			`),
+//			siptest.Expect("100", siptest.Optional()),
+//			siptest.Expect("180", siptest.Optional()),
+//			siptest.Expect("200", siptest.CaptureHeader("to", "To")),
+//			siptest.Send(`
+//				ACK sip:bob@[remote_ip]:[remote_port] SIP/2.0
+//				Via: SIP/2.0/[transport] [local_ip]:[local_port];branch=[branch]
+//				[last_From:]
+//				[last_To:]
+//				[last_Call-ID:]
+//				CSeq: 1 ACK
+//				Content-Length: 0
+//			`),
+//		},
+//	}
+//	vars, err := scenario.Run(ctx, peer, nil)
+//
+// Templates are trimmed line by line, so they can be indented. Built-in variables are
+// [local_ip], [local_port], [remote_ip], [remote_port], [transport], [call_id], [local_tag],
+// [branch] (new on each Send), [len] (length of the body) and [last_Name:] that is replaced with
+// all 'Name' header lines of the last received message. Other variables are passed to Run or captured by Expect.
+package siptest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/util"
+)
+
+// DefaultTimeout is a default timeout of Expect steps.
+const DefaultTimeout = 5 * time.Second
+
+// Vars are template variables of the scenario.
+type Vars map[string]string
+
+// Scenario is a sequence of steps played with the peer.
+type Scenario struct {
+	Name  string
+	Steps []Step
+	// Timeout is a default timeout of Expect steps, default is DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Step is a step of the scenario.
+type Step interface {
+	String() string
+	run(ctx context.Context, r *runner) error
+}
+
+// Error describes the failed step of the scenario.
+type Error struct {
+	Scenario string
+	// Step is an index of the failed step.
+	Step int
+	Name string
+	Err  error
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("scenario '%s' step #%d '%s' failed: %s", err.Scenario, err.Step, err.Name, err.Err)
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// Run plays the scenario with the peer, vars are initial template variables.
+// Returned variables include variables captured by Expect steps.
+func (s Scenario) Run(ctx context.Context, peer Peer, vars Vars) (Vars, error) {
+	if s.Timeout <= 0 {
+		s.Timeout = DefaultTimeout
+	}
+
+	r := &runner{
+		scenario: s,
+		peer:     peer,
+		vars:     make(Vars),
+		seen:     make(map[string]bool),
+	}
+	r.vars["call_id"] = util.RandString(32)
+	r.vars["local_tag"] = util.RandString(8)
+	r.vars["transport"] = strings.ToUpper(peer.Network())
+	r.vars["local_ip"], r.vars["local_port"], _ = net.SplitHostPort(peer.LocalAddr())
+	r.vars["remote_ip"], r.vars["remote_port"], _ = net.SplitHostPort(peer.RemoteAddr())
+	for name, value := range vars {
+		r.vars[name] = value
+	}
+
+	for i, step := range s.Steps {
+		if err := step.run(ctx, r); err != nil {
+			return r.vars, &Error{
+				Scenario: s.Name,
+				Step:     i,
+				Name:     step.String(),
+				Err:      err,
+			}
+		}
+	}
+
+	return r.vars, nil
+}
+
+type runner struct {
+	scenario Scenario
+	peer     Peer
+	vars     Vars
+	// last is the last received message for [last_Name:] variables
+	last sip.Message
+	// pending is a message received by the skipped optional step
+	pending sip.Message
+	// seen are keys of matched messages, their retransmissions are ignored
+	seen map[string]bool
+}
+
+// receive returns the pending or the next new message, retransmissions of matched messages are skipped.
+func (r *runner) receive(ctx context.Context, timeout time.Duration) (sip.Message, error) {
+	if msg := r.pending; msg != nil {
+		r.pending = nil
+		return msg, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		msg, err := r.peer.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !r.seen[messageKey(msg)] {
+			return msg, nil
+		}
+	}
+}
+
+// messageKey identifies the message and its retransmissions.
+func messageKey(msg sip.Message) string {
+	var key string
+	switch msg := msg.(type) {
+	case sip.Request:
+		key = string(msg.Method())
+	case sip.Response:
+		key = strconv.Itoa(int(msg.StatusCode()))
+	}
+	if cseq, ok := msg.CSeq(); ok {
+		key += "/" + cseq.Value()
+	}
+	if callID, ok := msg.CallID(); ok {
+		key += "/" + callID.Value()
+	}
+	if viaHop, ok := msg.ViaHop(); ok && viaHop.Params != nil {
+		if branch, ok := viaHop.Params.Get("branch"); ok && branch != nil {
+			key += "/" + branch.String()
+		}
+	}
+
+	return key
+}
+
+var varRe = regexp.MustCompile(`\[([A-Za-z0-9_.:+\-]+)\]`)
+
+// render substitutes variables of the template and returns the message text.
+func (r *runner) render(template string) (string, error) {
+	vars := make(Vars, len(r.vars)+1)
+	for name, value := range r.vars {
+		vars[name] = value
+	}
+	vars["branch"] = sip.GenerateBranch()
+
+	lines := strings.Split(strings.ReplaceAll(strings.TrimSpace(template), "\r\n", "\n"), "\n")
+	var (
+		head []string
+		body []string
+		err  error
+	)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			for _, line := range lines[i+1:] {
+				body = append(body, strings.TrimSpace(line))
+			}
+			break
+		}
+
+		line = varRe.ReplaceAllStringFunc(line, func(match string) string {
+			value, ok := r.lookup(match[1:len(match)-1], vars)
+			if !ok && err == nil {
+				err = fmt.Errorf("unknown variable %s", match)
+			}
+			return value
+		})
+		// [last_Name:] of the missing header is removed with its line
+		if line != "" {
+			head = append(head, line)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var bodyText string
+	if len(body) > 0 {
+		bodyText = strings.Join(body, "\r\n")
+		bodyText = varRe.ReplaceAllStringFunc(bodyText, func(match string) string {
+			value, ok := r.lookup(match[1:len(match)-1], vars)
+			if !ok && err == nil {
+				err = fmt.Errorf("unknown variable %s", match)
+			}
+			return value
+		})
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasSuffix(bodyText, "\r\n") {
+			bodyText += "\r\n"
+		}
+	}
+
+	text := strings.Join(head, "\r\n") + "\r\n\r\n"
+	text = strings.ReplaceAll(text, "[len]", strconv.Itoa(len(bodyText)))
+
+	return text + bodyText, nil
+}
+
+func (r *runner) lookup(name string, vars Vars) (string, bool) {
+	if name == "len" {
+		// replaced after the body is rendered
+		return "[len]", true
+	}
+	if strings.HasPrefix(name, "last_") {
+		if r.last == nil {
+			return "", false
+		}
+
+		hdrName := strings.TrimSuffix(strings.TrimPrefix(name, "last_"), ":")
+		hdrs := r.last.GetHeaders(hdrName)
+		lines := make([]string, 0, len(hdrs))
+		for _, hdr := range hdrs {
+			lines = append(lines, hdr.String())
+		}
+
+		return strings.Join(lines, "\r\n"), true
+	}
+
+	value, ok := vars[name]
+
+	return value, ok
+}
+
+type sendStep struct {
+	template string
+}
+
+// Send sends the message rendered from the template.
+func Send(template string) Step {
+	return &sendStep{template: template}
+}
+
+func (step *sendStep) String() string {
+	line := strings.TrimSpace(step.template)
+	if i := strings.Index(line, "\n"); i >= 0 {
+		line = line[:i]
+	}
+
+	return "send " + strings.TrimSpace(line)
+}
+
+func (step *sendStep) run(ctx context.Context, r *runner) error {
+	text, err := r.render(step.template)
+	if err != nil {
+		return err
+	}
+
+	return r.peer.Send([]byte(text))
+}
+
+type expectStep struct {
+	match    string
+	optional bool
+	timeout  time.Duration
+	captures []func(msg sip.Message, vars Vars) error
+	checks   []func(msg sip.Message) error
+}
+
+// ExpectOption modifies Expect step.
+type ExpectOption func(step *expectStep)
+
+// Expect waits for the message matched by the method name, like "INVITE", status code, like "180",
+// or class of status codes, like "2xx". Retransmissions of already matched messages are ignored.
+func Expect(match string, options ...ExpectOption) Step {
+	step := &expectStep{match: match}
+	for _, option := range options {
+		option(step)
+	}
+
+	return step
+}
+
+// Optional allows the message to be missed, not matched message is passed to the next step.
+func Optional() ExpectOption {
+	return func(step *expectStep) {
+		step.optional = true
+	}
+}
+
+// Timeout overrides Scenario.Timeout of the step.
+func Timeout(timeout time.Duration) ExpectOption {
+	return func(step *expectStep) {
+		step.timeout = timeout
+	}
+}
+
+// CaptureHeader saves the value of the first header with the name to the variable.
+func CaptureHeader(varName, hdrName string) ExpectOption {
+	return func(step *expectStep) {
+		step.captures = append(step.captures, func(msg sip.Message, vars Vars) error {
+			hdrs := msg.GetHeaders(hdrName)
+			if len(hdrs) == 0 {
+				return fmt.Errorf("header '%s' not found in '%s'", hdrName, msg.Short())
+			}
+			vars[varName] = hdrs[0].Value()
+
+			return nil
+		})
+	}
+}
+
+// CaptureRegexp saves the first group of the pattern matched in the message text to the variable.
+func CaptureRegexp(varName, pattern string) ExpectOption {
+	re := regexp.MustCompile(pattern)
+
+	return func(step *expectStep) {
+		step.captures = append(step.captures, func(msg sip.Message, vars Vars) error {
+			match := re.FindStringSubmatch(msg.String())
+			if len(match) < 2 {
+				return fmt.Errorf("pattern '%s' not matched in '%s'", pattern, msg.Short())
+			}
+			vars[varName] = match[1]
+
+			return nil
+		})
+	}
+}
+
+// Check verifies the matched message.
+func Check(check func(msg sip.Message) error) ExpectOption {
+	return func(step *expectStep) {
+		step.checks = append(step.checks, check)
+	}
+}
+
+func (step *expectStep) String() string {
+	if step.optional {
+		return "expect " + step.match + " (optional)"
+	}
+
+	return "expect " + step.match
+}
+
+func (step *expectStep) matches(msg sip.Message) bool {
+	switch msg := msg.(type) {
+	case sip.Request:
+		return strings.EqualFold(string(msg.Method()), step.match)
+	case sip.Response:
+		code := strconv.Itoa(int(msg.StatusCode()))
+		if len(step.match) == 3 && strings.HasSuffix(strings.ToLower(step.match), "xx") {
+			return code[0] == step.match[0]
+		}
+
+		return code == step.match
+	default:
+		return false
+	}
+}
+
+func (step *expectStep) run(ctx context.Context, r *runner) error {
+	timeout := step.timeout
+	if timeout <= 0 {
+		timeout = r.scenario.Timeout
+	}
+
+	msg, err := r.receive(ctx, timeout)
+	if err != nil {
+		if step.optional && r.pending == nil {
+			return nil
+		}
+
+		return fmt.Errorf("receive failed: %w", err)
+	}
+
+	if !step.matches(msg) {
+		if step.optional {
+			r.pending = msg
+			return nil
+		}
+
+		return fmt.Errorf("unexpected message '%s'", msg.Short())
+	}
+
+	r.seen[messageKey(msg)] = true
+	r.last = msg
+
+	for _, capture := range step.captures {
+		if err := capture(msg, r.vars); err != nil {
+			return err
+		}
+	}
+	for _, check := range step.checks {
+		if err := check(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type pauseStep struct {
+	duration time.Duration
+}
+
+// Pause waits for the duration.
+func Pause(duration time.Duration) Step {
+	return &pauseStep{duration: duration}
+}
+
+func (step *pauseStep) String() string {
+	return "pause " + step.duration.String()
+}
+
+func (step *pauseStep) run(ctx context.Context, r *runner) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(step.duration):
+		return nil
+	}
+}
+
+type doStep struct {
+	name string
+	fn   func(vars Vars) error
+}
+
+// Do runs the function with scenario variables, like application actions between messages.
+func Do(name string, fn func(vars Vars) error) Step {
+	return &doStep{name: name, fn: fn}
+}
+
+func (step *doStep) String() string {
+	return "do " + step.name
+}
+
+func (step *doStep) run(ctx context.Context, r *runner) error {
+	return step.fn(r.vars)
+}
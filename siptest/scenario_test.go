@@ -0,0 +1,231 @@
+package siptest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/load"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/siptest"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+const (
+	srvAddr  = "127.0.0.1:5174"
+	peerAddr = "127.0.0.1:5175"
+)
+
+var uacScenario = siptest.Scenario{
+	Name: "uac",
+	Steps: []siptest.Step{
+		siptest.Send(`
+			INVITE sip:bob@[remote_ip]:[remote_port] SIP/2.0
+			Via: SIP/2.0/[transport] [local_ip]:[local_port];branch=[branch]
+			From: <sip:alice@[local_ip]>;tag=[local_tag]
+			To: <sip:bob@[remote_ip]>
+			Call-ID: [call_id]
+			CSeq: 1 INVITE
+			Contact: <sip:alice@[local_ip]:[local_port]>
+			Max-Forwards: 70
+			Content-Type: application/sdp
+			Content-Length: [len]
+
+			v=0
+			o=alice 1 1 IN IP4 [local_ip]
+			s=-
+			c=IN IP4 [local_ip]
+			t=0 0
+			m=audio [media_port] RTP/AVP 0
+		`),
+		siptest.Expect("100", siptest.Optional()),
+		siptest.Expect("180"),
+		siptest.Expect("200",
+			siptest.CaptureRegexp("to_tag", `(?m)^To:.*;tag=(\w+)`),
+			siptest.Check(func(msg sip.Message) error {
+				if msg.Body() == "" {
+					return errors.New("missing SDP answer")
+				}
+				return nil
+			}),
+		),
+		siptest.Send(`
+			ACK sip:bob@[remote_ip]:[remote_port] SIP/2.0
+			Via: SIP/2.0/[transport] [local_ip]:[local_port];branch=[branch]
+			[last_From:]
+			[last_To:]
+			[last_Call-ID:]
+			CSeq: 1 ACK
+			Max-Forwards: 70
+			Content-Length: [len]
+		`),
+		siptest.Pause(10 * time.Millisecond),
+		siptest.Send(`
+			BYE sip:bob@[remote_ip]:[remote_port] SIP/2.0
+			Via: SIP/2.0/[transport] [local_ip]:[local_port];branch=[branch]
+			From: <sip:alice@[local_ip]>;tag=[local_tag]
+			To: <sip:bob@[remote_ip]>;tag=[to_tag]
+			Call-ID: [call_id]
+			CSeq: 2 BYE
+			Max-Forwards: 70
+			Content-Length: 0
+		`),
+		siptest.Expect("2xx"),
+	},
+}
+
+var _ = Describe("Scenario", func() {
+	logger := testutils.NewLogrusLogger()
+
+	Context("over the memory transport", func() {
+		var (
+			srv  gosip.Server
+			peer siptest.Peer
+		)
+
+		BeforeEach(func() {
+			var tpFactory gosip.TransportLayerFactory
+			peer, tpFactory = siptest.NewMemoryPeer("udp", peerAddr, logger)
+			srv = gosip.NewServer(gosip.ServerConfig{Host: "127.0.0.1"}, tpFactory, nil, logger)
+			Expect(srv.Listen("udp", srvAddr)).To(Succeed())
+			Expect(load.NewUAS(load.UASConfig{RingTime: 10 * time.Millisecond}, logger).Serve(srv)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			srv.Shutdown()
+			Expect(peer.Close()).To(Succeed())
+		})
+
+		It("should play the call with the application", func() {
+			Expect(peer.RemoteAddr()).To(Equal(srvAddr))
+
+			vars, err := uacScenario.Run(context.Background(), peer, siptest.Vars{"media_port": "49170"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vars).To(HaveKeyWithValue("to_tag", Not(BeEmpty())))
+			Expect(vars).To(HaveKeyWithValue("remote_port", "5174"))
+		}, 5)
+
+		It("should report the failed step", func() {
+			scenario := siptest.Scenario{
+				Name: "unexpected",
+				Steps: []siptest.Step{
+					siptest.Send(`
+						OPTIONS sip:[remote_ip]:[remote_port] SIP/2.0
+						Via: SIP/2.0/[transport] [local_ip]:[local_port];branch=[branch]
+						From: <sip:alice@[local_ip]>;tag=[local_tag]
+						To: <sip:[remote_ip]>
+						Call-ID: [call_id]
+						CSeq: 1 OPTIONS
+						Content-Length: 0
+					`),
+					siptest.Expect("486"),
+				},
+			}
+
+			_, err := scenario.Run(context.Background(), peer, nil)
+			var serr *siptest.Error
+			Expect(errors.As(err, &serr)).To(BeTrue())
+			Expect(serr.Scenario).To(Equal("unexpected"))
+			Expect(serr.Step).To(Equal(1))
+			Expect(serr.Error()).To(ContainSubstring("unexpected message"))
+		}, 5)
+
+		It("should fail on timeout and unknown variable", func() {
+			scenario := siptest.Scenario{
+				Name:    "timeout",
+				Timeout: 50 * time.Millisecond,
+				Steps: []siptest.Step{
+					siptest.Expect("INVITE"),
+				},
+			}
+			_, err := scenario.Run(context.Background(), peer, nil)
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+			scenario = siptest.Scenario{
+				Name:  "unknown",
+				Steps: []siptest.Step{siptest.Send("OPTIONS sip:[unknown] SIP/2.0")},
+			}
+			_, err = scenario.Run(context.Background(), peer, nil)
+			Expect(err).To(MatchError(ContainSubstring("unknown variable [unknown]")))
+		}, 5)
+	})
+
+	Context("over the network", func() {
+		var (
+			srv  gosip.Server
+			peer siptest.Peer
+		)
+
+		BeforeEach(func() {
+			var err error
+			peer, err = siptest.NewPeer("udp", peerAddr, srvAddr, logger)
+			Expect(err).NotTo(HaveOccurred())
+			srv = gosip.NewServer(gosip.ServerConfig{Host: "127.0.0.1"}, nil, nil, logger)
+			Expect(srv.Listen("udp", srvAddr)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			srv.Shutdown()
+			Expect(peer.Close()).To(Succeed())
+		})
+
+		It("should answer requests of the application", func() {
+			gen, err := load.NewGenerator(srv, load.Config{
+				Scenario: load.Register,
+				Target:   peerAddr,
+				Contact:  srvAddr,
+				Total:    1,
+				Timeout:  5 * time.Second,
+			}, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			reports := make(chan load.Report, 1)
+			go func() {
+				reports <- gen.Run(context.Background())
+			}()
+
+			scenario := siptest.Scenario{
+				Name: "registrar",
+				Steps: []siptest.Step{
+					siptest.Expect("REGISTER", siptest.CaptureHeader("contact", "Contact")),
+					siptest.Send(`
+						SIP/2.0 200 OK
+						[last_Via:]
+						[last_From:]
+						[last_To:];tag=[local_tag]
+						[last_Call-ID:]
+						[last_CSeq:]
+						Contact: [contact];expires=60
+						Content-Length: 0
+					`),
+				},
+			}
+			vars, err := scenario.Run(context.Background(), peer, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vars["contact"]).To(ContainSubstring(srvAddr))
+
+			var report load.Report
+			Eventually(reports, 3).Should(Receive(&report))
+			Expect(report.Succeeded).To(Equal(1), fmt.Sprint(report))
+		}, 5)
+
+		It("should play the call over TCP", func() {
+			tcpSrv := gosip.NewServer(gosip.ServerConfig{Host: "127.0.0.1"}, nil, nil, logger)
+			defer tcpSrv.Shutdown()
+			Expect(tcpSrv.Listen("tcp", srvAddr)).To(Succeed())
+			Expect(load.NewUAS(load.UASConfig{RingTime: 10 * time.Millisecond}, logger).Serve(tcpSrv)).To(Succeed())
+
+			tcpPeer, err := siptest.NewPeer("tcp", peerAddr, srvAddr, logger)
+			Expect(err).NotTo(HaveOccurred())
+			defer tcpPeer.Close()
+
+			_, err = uacScenario.Run(context.Background(), tcpPeer, siptest.Vars{"media_port": "49170"})
+			Expect(err).NotTo(HaveOccurred())
+		}, 5)
+	})
+})
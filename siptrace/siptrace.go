@@ -0,0 +1,181 @@
+// siptrace package prints full SIP messages sent and received by the server in ngrep-like format,
+// like Kamailio siptrace module. Sink implements gosip.Observer, so it is passed to gosip.ServerConfig.
+package siptrace
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/redact"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+const DefaultTimeFormat = "2006/01/02 15:04:05.000000"
+
+// Config describes message trace options.
+type Config struct {
+	// Output receives traced messages, default is os.Stdout.
+	Output io.Writer
+	// All enables tracing of all messages from the start, otherwise only filtered peers and calls are traced.
+	All bool
+	// TimeFormat is a layout of message timestamps, default is DefaultTimeFormat.
+	TimeFormat string
+}
+
+// Sink prints messages matched by filters, filters are toggled at runtime.
+// Each message is printed with header line:
+//
+//	U 2020/01/02 15:04:05.000000 10.0.0.1:5060 -> 10.0.0.2:5060 <<< received
+//
+// where the first letter is a transport, like in ngrep output.
+type Sink interface {
+	gosip.Observer
+	// TraceAll toggles tracing of all messages.
+	TraceAll(enabled bool)
+	// TracePeer toggles tracing of messages from and to the peer IP address.
+	TracePeer(ip string, enabled bool)
+	// TraceCall toggles tracing of messages of the call.
+	TraceCall(callID string, enabled bool)
+}
+
+type sink struct {
+	out        io.Writer
+	timeFormat string
+
+	mu    sync.RWMutex
+	all   bool
+	peers map[string]bool
+	calls map[string]bool
+}
+
+// NewSink creates message trace sink.
+func NewSink(config Config) Sink {
+	if config.Output == nil {
+		config.Output = os.Stdout
+	}
+	if config.TimeFormat == "" {
+		config.TimeFormat = DefaultTimeFormat
+	}
+
+	return &sink{
+		out:        config.Output,
+		timeFormat: config.TimeFormat,
+		all:        config.All,
+		peers:      make(map[string]bool),
+		calls:      make(map[string]bool),
+	}
+}
+
+func (s *sink) TraceAll(enabled bool) {
+	s.mu.Lock()
+	s.all = enabled
+	s.mu.Unlock()
+}
+
+func (s *sink) TracePeer(ip string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if enabled {
+		s.peers[ip] = true
+	} else {
+		delete(s.peers, ip)
+	}
+}
+
+func (s *sink) TraceCall(callID string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if enabled {
+		s.calls[callID] = true
+	} else {
+		delete(s.calls, callID)
+	}
+}
+
+func (s *sink) MessageReceived(msg sip.Message) {
+	s.trace(msg, msg.Source(), msg.Destination(), "<<< received", msg.Source())
+}
+
+func (s *sink) MessageSent(msg sip.Message) {
+	src := msg.Source()
+	if src == "" {
+		// sent-by of the outgoing request is filled by the transport layer
+		if viaHop, ok := msg.ViaHop(); ok {
+			src = viaHop.Host
+			if viaHop.Port != nil {
+				src = fmt.Sprintf("%s:%d", src, *viaHop.Port)
+			}
+		}
+	}
+
+	s.trace(msg, src, msg.Destination(), ">>> sent", msg.Destination())
+}
+
+func (s *sink) Retransmission(msg sip.Message) {}
+
+func (s *sink) TransactionCompleted(method sip.RequestMethod, client bool, duration time.Duration) {}
+
+func (s *sink) ParseError(err error) {}
+
+func (s *sink) DNSFailure(err error) {}
+
+func (s *sink) trace(msg sip.Message, src, dest, direction, peer string) {
+	if !s.match(msg, peer) {
+		return
+	}
+
+	tp := msg.Transport()
+	if tp == "" {
+		tp = "?"
+	}
+
+	// single write keeps concurrent messages from interleaving
+	text := fmt.Sprintf("%s %s %s -> %s %s\n%s\n\n",
+		strings.ToUpper(tp[:1]),
+		time.Now().Format(s.timeFormat),
+		src,
+		dest,
+		direction,
+		strings.TrimRight(strings.ReplaceAll(redact.CurrentPolicy().Redact(msg.String()), "\r\n", "\n"), "\n"),
+	)
+
+	s.mu.Lock()
+	_, _ = io.WriteString(s.out, text)
+	s.mu.Unlock()
+}
+
+func (s *sink) match(msg sip.Message, peer string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.all {
+		return true
+	}
+	if len(s.peers) > 0 && s.peers[peerIP(peer)] {
+		return true
+	}
+	if len(s.calls) > 0 {
+		if callID, ok := msg.CallID(); ok && s.calls[callID.Value()] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peerIP returns host of the address without port.
+func peerIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return strings.Trim(addr, "[]")
+}
@@ -0,0 +1,75 @@
+package siptrace_test
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/siptrace"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+var _ = Describe("Sink", func() {
+	var (
+		out  *bytes.Buffer
+		sink siptrace.Sink
+	)
+
+	request := func(callID string) sip.Request {
+		req := testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: " + callID,
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+		req.SetTransport("UDP")
+		req.SetSource("10.0.0.1:5060")
+		req.SetDestination("10.0.0.2:5060")
+
+		return req
+	}
+
+	BeforeEach(func() {
+		out = new(bytes.Buffer)
+		sink = siptrace.NewSink(siptrace.Config{
+			Output:     out,
+			TimeFormat: "15:04:05",
+		})
+	})
+
+	It("should print only filtered messages", func() {
+		sink.MessageReceived(request("call-1"))
+		Expect(out.String()).To(BeEmpty())
+
+		sink.TraceCall("call-1", true)
+		sink.MessageReceived(request("call-1"))
+		sink.MessageReceived(request("call-2"))
+		Expect(out.String()).To(MatchRegexp(`^U \d\d:\d\d:\d\d 10\.0\.0\.1:5060 -> 10\.0\.0\.2:5060 <<< received\n` +
+			`INVITE sip:bob@example\.com SIP/2\.0\n`))
+		Expect(out.String()).To(ContainSubstring("Call-ID: call-1\n"))
+		Expect(out.String()).NotTo(ContainSubstring("call-2"))
+
+		out.Reset()
+		sink.TraceCall("call-1", false)
+		sink.TracePeer("10.0.0.2", true)
+		res := sip.NewResponseFromRequest("", request("call-3"), 180, "Ringing", "")
+		res.SetDestination("10.0.0.2:5060")
+		sink.MessageSent(res)
+		Expect(out.String()).To(MatchRegexp(`^U \S+ 10\.0\.0\.2:5060 -> 10\.0\.0\.2:5060 >>> sent\nSIP/2\.0 180 Ringing\n`))
+
+		out.Reset()
+		sink.TracePeer("10.0.0.2", false)
+		sink.MessageSent(res)
+		Expect(out.String()).To(BeEmpty())
+
+		sink.TraceAll(true)
+		sink.MessageReceived(request("call-4"))
+		Expect(out.String()).To(ContainSubstring("Call-ID: call-4"))
+	})
+})
@@ -0,0 +1,487 @@
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Minimal Cryptographic Message Syntax - RFC 5652, the subset S/MIME bodies of SIP need:
+// detached SignedData signed by RSA or ECDSA keys with SHA-256 and EnvelopedData for RSA recipients with AES-CBC.
+
+var (
+	oidData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAttrContentType  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrDigest       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSA              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAES128CBC        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	errUnsupportedCMS   = errors.New("unsupported CMS structure")
+	errNoMatchingSigner = errors.New("certificate of the signer not found")
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     rawContent   `asn1:"optional,tag:0"`
+	CRLs             rawContent   `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+// rawContent keeps the encoding of the implicitly tagged SET as is,
+// since signed attributes are verified byte to byte.
+type rawContent struct {
+	Raw asn1.RawContent
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version               int
+	IssuerAndSerialNumber issuerAndSerial
+	DigestAlgorithm       pkix.AlgorithmIdentifier
+	SignedAttributes      rawContent `asn1:"optional,tag:0"`
+	SignatureAlgorithm    pkix.AlgorithmIdentifier
+	Signature             []byte
+	UnsignedAttributes    rawContent `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// implicit returns the encoding with the tag replaced by the implicit context-specific tag.
+func implicit(der []byte, tag int) (rawContent, error) {
+	var value asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &value); err != nil {
+		return rawContent{}, err
+	}
+	raw, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        tag,
+		IsCompound: value.IsCompound,
+		Bytes:      value.Bytes,
+	})
+
+	return rawContent{raw}, err
+}
+
+// explicitSet returns the encoding of the implicitly tagged SET with the universal SET tag.
+func explicitSet(raw rawContent) ([]byte, error) {
+	var value asn1.RawValue
+	if _, err := asn1.Unmarshal(raw.Raw, &value); err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+		Bytes:      value.Bytes,
+	})
+}
+
+func newAttribute(typ asn1.ObjectIdentifier, value interface{}) (attribute, error) {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		return attribute{}, err
+	}
+
+	return attribute{
+		Type:   typ,
+		Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der},
+	}, nil
+}
+
+func issuerAndSerialOf(cert *x509.Certificate) issuerAndSerial {
+	return issuerAndSerial{
+		Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+		SerialNumber: cert.SerialNumber,
+	}
+}
+
+func (ias issuerAndSerial) matches(cert *x509.Certificate) bool {
+	return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+// signDetached creates detached SignedData of the content signed by SHA-256 with signed attributes.
+func signDetached(content []byte, cert *x509.Certificate, key crypto.Signer, chain []*x509.Certificate) ([]byte, error) {
+	var sigAlg asn1.ObjectIdentifier
+	switch cert.PublicKeyAlgorithm {
+	case x509.RSA:
+		sigAlg = oidRSA
+	case x509.ECDSA:
+		sigAlg = oidECDSAWithSHA256
+	default:
+		return nil, fmt.Errorf("unsupported signer key algorithm %s", cert.PublicKeyAlgorithm)
+	}
+
+	digest := sha256.Sum256(content)
+	attrs := make([]attribute, 0, 3)
+	for _, attr := range []struct {
+		typ   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidAttrContentType, oidData},
+		{oidAttrSigningTime, time.Now().UTC()},
+		{oidAttrDigest, digest[:]},
+	} {
+		a, err := newAttribute(attr.typ, attr.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, a)
+	}
+	// DER sorts SET OF elements, so the signed encoding is canonical
+	signed, err := asn1.MarshalWithParams(attrs, "set")
+	if err != nil {
+		return nil, err
+	}
+	signedAttrs, err := implicit(signed, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	attrsDigest := sha256.Sum256(signed)
+	signature, err := key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []byte
+	for _, c := range append([]*x509.Certificate{cert}, chain...) {
+		certs = append(certs, c.Raw...)
+	}
+	rawCerts, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      certs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		ContentInfo:      contentInfo{ContentType: oidData},
+		Certificates:     rawContent{rawCerts},
+		SignerInfos: []signerInfo{{
+			Version:               1,
+			IssuerAndSerialNumber: issuerAndSerialOf(cert),
+			DigestAlgorithm:       pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttributes:      signedAttrs,
+			SignatureAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: sigAlg},
+			Signature:             signature,
+		}},
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+// verifyDetached verifies the signature of detached SignedData over the content
+// and returns the certificate of the signer with certificates carried in SignedData.
+func verifyDetached(der, content []byte) (*x509.Certificate, []*x509.Certificate, error) {
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, nil, err
+	} else if len(rest) > 0 || !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, errUnsupportedCMS
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, nil, fmt.Errorf("SignedData has %d signers", len(sd.SignerInfos))
+	}
+
+	var certs []*x509.Certificate
+	if len(sd.Certificates.Raw) > 0 {
+		var raw asn1.RawValue
+		if _, err := asn1.Unmarshal(sd.Certificates.Raw, &raw); err != nil {
+			return nil, nil, err
+		}
+		var err error
+		if certs, err = x509.ParseCertificates(raw.Bytes); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	si := sd.SignerInfos[0]
+	var signer *x509.Certificate
+	for _, cert := range certs {
+		if si.IssuerAndSerialNumber.matches(cert) {
+			signer = cert
+			break
+		}
+	}
+	if signer == nil {
+		return nil, nil, errNoMatchingSigner
+	}
+
+	if !si.DigestAlgorithm.Algorithm.Equal(oidSHA256) {
+		return nil, nil, fmt.Errorf("unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	sigAlg := x509.SHA256WithRSA
+	if signer.PublicKeyAlgorithm == x509.ECDSA {
+		sigAlg = x509.ECDSAWithSHA256
+	}
+	switch alg := si.SignatureAlgorithm.Algorithm; {
+	case alg.Equal(oidRSA), alg.Equal(oidSHA256WithRSA), alg.Equal(oidECDSAWithSHA256):
+	default:
+		return nil, nil, fmt.Errorf("unsupported signature algorithm %s", alg)
+	}
+
+	sum := sha256.Sum256(content)
+	digest := sum[:]
+
+	signed := content
+	if len(si.SignedAttributes.Raw) > 0 {
+		var err error
+		if signed, err = explicitSet(si.SignedAttributes); err != nil {
+			return nil, nil, err
+		}
+		var attrs []attribute
+		if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+			return nil, nil, err
+		}
+		var messageDigest []byte
+		for _, attr := range attrs {
+			if attr.Type.Equal(oidAttrDigest) {
+				if _, err := asn1.Unmarshal(attr.Values.Bytes, &messageDigest); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		if !bytes.Equal(messageDigest, digest) {
+			return nil, nil, errors.New("message digest does not match the content")
+		}
+	}
+
+	if err := signer.CheckSignature(sigAlg, signed, si.Signature); err != nil {
+		return nil, nil, err
+	}
+
+	return signer, certs, nil
+}
+
+// encryptEnvelope creates EnvelopedData of the content encrypted by AES-256-CBC
+// with the key transported to RSA recipients - RFC 5652 6, RFC 3565.
+func encryptEnvelope(content []byte, recipients []*x509.Certificate) ([]byte, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	infos := make([]recipientInfo, 0, len(recipients))
+	for _, cert := range recipients {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported recipient key algorithm %s", cert.PublicKeyAlgorithm)
+		}
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, recipientInfo{
+			IssuerAndSerialNumber:  issuerAndSerialOf(cert),
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		})
+	}
+
+	params, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := asn1.Marshal(envelopedData{
+		RecipientInfos: infos,
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType: oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  oidAES256CBC,
+				Parameters: asn1.RawValue{FullBytes: params},
+			},
+			EncryptedContent: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+// decryptEnvelope decrypts EnvelopedData by the key of the recipient certificate.
+func decryptEnvelope(der []byte, cert *x509.Certificate, key crypto.PrivateKey) ([]byte, error) {
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, err
+	} else if len(rest) > 0 || !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, errUnsupportedCMS
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, err
+	}
+
+	var info *recipientInfo
+	for i := range ed.RecipientInfos {
+		if ed.RecipientInfos[i].IssuerAndSerialNumber.matches(cert) {
+			info = &ed.RecipientInfos[i]
+			break
+		}
+	}
+	if info == nil {
+		return nil, errors.New("EnvelopedData is not encrypted for the certificate")
+	}
+	if !info.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSA) {
+		return nil, fmt.Errorf("unsupported key encryption algorithm %s", info.KeyEncryptionAlgorithm.Algorithm)
+	}
+	decrypter, ok := key.(crypto.Decrypter)
+	if !ok {
+		return nil, errors.New("private key can not decrypt")
+	}
+	contentKey, err := decrypter.Decrypt(rand.Reader, info.EncryptedKey, &rsa.PKCS1v15DecryptOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	eci := ed.EncryptedContentInfo
+	var keyLen int
+	switch alg := eci.ContentEncryptionAlgorithm.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen = 16
+	case alg.Equal(oidAES192CBC):
+		keyLen = 24
+	case alg.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported content encryption algorithm %s", alg)
+	}
+	if len(contentKey) != keyLen {
+		return nil, errors.New("content encryption key has invalid length")
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("content encryption IV has invalid length")
+	}
+
+	encrypted := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		// constructed OCTET STRING of BER encoders
+		if encrypted, err = joinOctets(encrypted); err != nil {
+			return nil, err
+		}
+	}
+	if len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted content has invalid length")
+	}
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, encrypted)
+
+	padding := int(content[len(content)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(content) {
+		return nil, errors.New("encrypted content has invalid padding")
+	}
+	for _, b := range content[len(content)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("encrypted content has invalid padding")
+		}
+	}
+
+	return content[:len(content)-padding], nil
+}
+
+func joinOctets(data []byte) ([]byte, error) {
+	var joined []byte
+	for len(data) > 0 {
+		var octets []byte
+		rest, err := asn1.Unmarshal(data, &octets)
+		if err != nil {
+			return nil, err
+		}
+		joined = append(joined, octets...)
+		data = rest
+	}
+
+	return joined, nil
+}
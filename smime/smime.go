@@ -0,0 +1,434 @@
+// smime package implements S/MIME bodies of SIP messages - RFC 3261 23, RFC 8551.
+// Bodies are signed as multipart/signed with application/pkcs7-signature part and encrypted
+// as application/pkcs7-mime enveloped data, so the message integrity and confidentiality
+// is kept end to end through proxies.
+package smime
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	SignedContentType    = "multipart/signed"
+	SignatureContentType = "application/pkcs7-signature"
+	MIMEContentType      = "application/pkcs7-mime"
+)
+
+var (
+	// ErrIdentityNotFound should be returned by KeyStore when the address of record has no identity.
+	ErrIdentityNotFound = errors.New("S/MIME identity not found")
+	// ErrNotSigned is returned by Verify when the body is not signed.
+	ErrNotSigned = errors.New("body is not signed")
+	// ErrNotEncrypted is returned by Decrypt when the body is not encrypted.
+	ErrNotEncrypted = errors.New("body is not encrypted")
+)
+
+// Identity is the certificate and the private key of the address of record.
+// The certificate should be issued for the address of record - RFC 3261 23.2,
+// i.e. have the SIP URI or the email of the address in subjectAltName.
+type Identity struct {
+	Certificate *x509.Certificate
+	// Key signs outgoing bodies and decrypts incoming ones, RSA keys are required for decryption.
+	Key crypto.Signer
+	// Chain are intermediate certificates sent with signatures.
+	Chain []*x509.Certificate
+}
+
+// KeyStore provides identities of local addresses of record and roots of certificates of peers.
+type KeyStore interface {
+	// Identity returns identity of the address of record like alice@example.com.
+	Identity(aor string) (*Identity, error)
+	// Roots verifies certificates of signers, nil uses roots of the system.
+	Roots() *x509.CertPool
+}
+
+// StaticKeyStore is a simple in-memory KeyStore.
+type StaticKeyStore struct {
+	// Identities are identities by addresses of record like alice@example.com.
+	Identities map[string]*Identity
+	RootCAs    *x509.CertPool
+}
+
+func (store *StaticKeyStore) Identity(aor string) (*Identity, error) {
+	if identity, ok := store.Identities[strings.ToLower(aor)]; ok {
+		return identity, nil
+	}
+
+	return nil, ErrIdentityNotFound
+}
+
+func (store *StaticKeyStore) Roots() *x509.CertPool {
+	return store.RootCAs
+}
+
+// AddressOfRecord returns user@host of the SIP URI.
+func AddressOfRecord(uri sip.Uri) string {
+	if uri == nil {
+		return ""
+	}
+	aor := strings.ToLower(uri.Host())
+	if user := uri.User(); user != nil && user.String() != "" {
+		aor = user.String() + "@" + aor
+	}
+
+	return aor
+}
+
+// Sign replaces the body of the message by multipart/signed body with the detached signature of the identity.
+// Content-Type and Content-Disposition of the message are moved to the signed part.
+func Sign(msg sip.Message, identity *Identity) error {
+	entity := messageEntity(msg)
+	content := entity.String()
+	signature, err := signDetached([]byte(content), identity.Certificate, identity.Key, identity.Chain)
+	if err != nil {
+		return fmt.Errorf("sign body: %w", err)
+	}
+
+	signaturePart := &sip.BodyPart{
+		Headers: []sip.MIMEHeader{
+			{Name: "Content-Type", Value: SignatureContentType + ";name=smime.p7s"},
+			{Name: "Content-Disposition", Value: "attachment;handling=required;filename=smime.p7s"},
+			{Name: "Content-Transfer-Encoding", Value: "binary"},
+		},
+		Body: string(signature),
+	}
+	mp := &sip.Multipart{
+		Subtype:  "signed",
+		Boundary: "boundary." + util.RandString(16),
+		Parts:    []*sip.BodyPart{entity, signaturePart},
+	}
+	setMessageEntity(msg, mime.FormatMediaType(SignedContentType, map[string]string{
+		"boundary": mp.Boundary,
+		"protocol": SignatureContentType,
+		"micalg":   "sha-256",
+	}), "", mp.String())
+
+	return nil
+}
+
+// Verify verifies multipart/signed body of the message and replaces the body by the signed part.
+// The signer certificate must chain to roots and be issued for the address of record of From - RFC 3261 23.3.
+// It returns the certificate of the signer.
+func Verify(msg sip.Message, roots *x509.CertPool) (*x509.Certificate, error) {
+	contentType, ok := msg.ContentType()
+	if !ok {
+		return nil, ErrNotSigned
+	}
+	typ, params, err := mime.ParseMediaType(contentType.Value())
+	if err != nil || typ != SignedContentType {
+		return nil, ErrNotSigned
+	}
+	switch strings.ToLower(params["protocol"]) {
+	case SignatureContentType, "application/x-pkcs7-signature":
+	default:
+		return nil, fmt.Errorf("unsupported signature protocol %q", params["protocol"])
+	}
+
+	// the signature covers the signed part byte to byte, so it is taken from the body as is
+	content, err := firstPart(msg.Body(), params["boundary"])
+	if err != nil {
+		return nil, err
+	}
+	mp, err := sip.ParseMultipart(contentType.Value(), msg.Body())
+	if err != nil {
+		return nil, err
+	}
+	if len(mp.Parts) != 2 {
+		return nil, fmt.Errorf("multipart/signed body has %d parts", len(mp.Parts))
+	}
+	signature, err := partData(mp.Parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	signer, certs, err := verifyDetached(signature, []byte(content))
+	if err != nil {
+		return nil, fmt.Errorf("verify signature: %w", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		if cert != signer {
+			intermediates.AddCert(cert)
+		}
+	}
+	if _, err := signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("verify signer certificate: %w", err)
+	}
+
+	if from, ok := msg.From(); ok {
+		if aor := AddressOfRecord(from.Address); !certificateOf(signer, aor) {
+			return nil, fmt.Errorf("signer certificate is not issued for %s", aor)
+		}
+	}
+
+	entity := mp.Parts[0]
+	disposition, _ := entity.Header("Content-Disposition")
+	partType, ok := entity.Header("Content-Type")
+	if !ok {
+		partType = "text/plain"
+	}
+	setMessageEntity(msg, partType, disposition, entity.Body)
+
+	return signer, nil
+}
+
+// Encrypt replaces the body of the message by application/pkcs7-mime enveloped data for recipients.
+// Content-Type and Content-Disposition of the message are encrypted with the body.
+func Encrypt(msg sip.Message, recipients ...*x509.Certificate) error {
+	if len(recipients) == 0 {
+		return errors.New("no recipients")
+	}
+
+	enveloped, err := encryptEnvelope([]byte(messageEntity(msg).String()), recipients)
+	if err != nil {
+		return fmt.Errorf("encrypt body: %w", err)
+	}
+	setMessageEntity(msg,
+		MIMEContentType+`;smime-type=enveloped-data;name=smime.p7m`,
+		"attachment;handling=required;filename=smime.p7m",
+		string(enveloped),
+	)
+
+	return nil
+}
+
+// Decrypt decrypts application/pkcs7-mime body of the message by the identity and replaces the body by the decrypted one.
+func Decrypt(msg sip.Message, identity *Identity) error {
+	contentType, ok := msg.ContentType()
+	if !ok {
+		return ErrNotEncrypted
+	}
+	typ, params, err := mime.ParseMediaType(contentType.Value())
+	if err != nil || (typ != MIMEContentType && typ != "application/x-pkcs7-mime") {
+		return ErrNotEncrypted
+	}
+	if smimeType := params["smime-type"]; smimeType != "" && !strings.EqualFold(smimeType, "enveloped-data") {
+		return fmt.Errorf("unsupported smime-type %q", smimeType)
+	}
+
+	data := []byte(msg.Body())
+	if encodings := msg.GetHeaders("Content-Transfer-Encoding"); len(encodings) > 0 &&
+		strings.EqualFold(encodings[0].Value(), "base64") {
+		if data, err = decodeBase64(msg.Body()); err != nil {
+			return err
+		}
+	}
+	content, err := decryptEnvelope(data, identity.Certificate, identity.Key)
+	if err != nil {
+		return fmt.Errorf("decrypt body: %w", err)
+	}
+
+	entity, err := parseEntity(string(content))
+	if err != nil {
+		return err
+	}
+	disposition, _ := entity.Header("Content-Disposition")
+	partType, ok := entity.Header("Content-Type")
+	if !ok {
+		partType = "text/plain"
+	}
+	setMessageEntity(msg, partType, disposition, entity.Body)
+
+	return nil
+}
+
+type signerKey struct{}
+
+// Signer returns the certificate of the signer of the request verified by Handler,
+// nil if the request is not signed or the transaction does not implement sip.Values.
+func Signer(tx sip.ServerTransaction) *x509.Certificate {
+	values, ok := tx.(sip.Values)
+	if !ok {
+		return nil
+	}
+	if cert, ok := values.Value(signerKey{}).(*x509.Certificate); ok {
+		return cert
+	}
+
+	return nil
+}
+
+// Handler wraps request handler, bodies of requests are decrypted by the identity of the To address of record
+// and signatures are verified by roots of the store before the handler is called, so the handler gets plain bodies.
+// Requests that can't be decrypted are answered with '493 Undecipherable' - RFC 3261 23.2,
+// requests with invalid signatures are answered with '403 Invalid Signature'.
+// Use Signer to get the verified signer of the request.
+func Handler(store KeyStore, handler gosip.RequestHandler, logger log.Logger) gosip.RequestHandler {
+	logger = logger.WithPrefix("smime.Handler")
+
+	return func(req sip.Request, tx sip.ServerTransaction) {
+		reject := func(code sip.StatusCode, reason string, err error) {
+			logger.WithFields(req.Fields()).Warnf("reject request: %s", err)
+			if tx == nil {
+				return
+			}
+			if err := tx.Respond(sip.NewResponseFromRequest("", req, code, reason, "")); err != nil {
+				logger.WithFields(req.Fields()).Errorf("respond on request failed: %s", err)
+			}
+		}
+
+		if err := decryptRequest(req, store); err != nil && !errors.Is(err, ErrNotEncrypted) {
+			reject(493, "Undecipherable", err)
+			return
+		}
+
+		signer, err := Verify(req, store.Roots())
+		switch {
+		case err == nil:
+			// signed body may be encrypted too
+			if err := decryptRequest(req, store); err != nil && !errors.Is(err, ErrNotEncrypted) {
+				reject(493, "Undecipherable", err)
+				return
+			}
+			if values, ok := tx.(sip.Values); ok {
+				values.SetValue(signerKey{}, signer)
+			}
+		case !errors.Is(err, ErrNotSigned):
+			reject(403, "Invalid Signature", err)
+			return
+		}
+
+		handler(req, tx)
+	}
+}
+
+func decryptRequest(req sip.Request, store KeyStore) error {
+	contentType, ok := req.ContentType()
+	if !ok || !strings.Contains(strings.ToLower(contentType.Value()), "pkcs7-mime") {
+		return ErrNotEncrypted
+	}
+
+	var aor string
+	if to, ok := req.To(); ok {
+		aor = AddressOfRecord(to.Address)
+	}
+	identity, err := store.Identity(aor)
+	if err != nil {
+		return fmt.Errorf("lookup identity of %s: %w", aor, err)
+	}
+
+	return Decrypt(req, identity)
+}
+
+// messageEntity returns the body of the message with content headers as MIME entity.
+func messageEntity(msg sip.Message) *sip.BodyPart {
+	entity := &sip.BodyPart{Body: msg.Body()}
+	if contentType, ok := msg.ContentType(); ok {
+		entity.Headers = append(entity.Headers, sip.MIMEHeader{Name: "Content-Type", Value: contentType.Value()})
+	}
+	if hdrs := msg.GetHeaders("Content-Disposition"); len(hdrs) > 0 {
+		entity.Headers = append(entity.Headers, sip.MIMEHeader{Name: "Content-Disposition", Value: hdrs[0].Value()})
+	}
+
+	return entity
+}
+
+// setMessageEntity replaces the body and content headers of the message, empty disposition removes the header.
+func setMessageEntity(msg sip.Message, contentType, disposition, body string) {
+	ct := sip.ContentType(contentType)
+	if len(msg.GetHeaders("Content-Type")) == 0 {
+		msg.AppendHeader(&ct)
+	} else {
+		msg.ReplaceHeaders("Content-Type", []sip.Header{&ct})
+	}
+	msg.RemoveHeader("Content-Disposition")
+	msg.RemoveHeader("Content-Transfer-Encoding")
+	if disposition != "" {
+		msg.AppendHeader(&sip.GenericHeader{HeaderName: "Content-Disposition", Contents: disposition})
+	}
+	msg.SetBody(body, true)
+}
+
+// firstPart returns the first part of the multipart body byte to byte with part headers - RFC 1847 2.1.
+func firstPart(body, boundary string) (string, error) {
+	if boundary == "" {
+		return "", errors.New("multipart/signed body has no boundary")
+	}
+
+	delimiter := "--" + boundary
+	start := strings.Index(body, delimiter)
+	if start == -1 {
+		return "", fmt.Errorf("multipart body has no boundary %q", boundary)
+	}
+	idx := strings.Index(body[start:], "\n")
+	if idx == -1 {
+		return "", fmt.Errorf("malformed multipart delimiter %q", boundary)
+	}
+	body = body[start+idx+1:]
+
+	eol := "\r\n"
+	end := strings.Index(body, eol+delimiter)
+	if end == -1 {
+		eol = "\n"
+		end = strings.Index(body, eol+delimiter)
+	}
+	if end == -1 {
+		return "", fmt.Errorf("multipart body has no second part %q", boundary)
+	}
+
+	return body[:end], nil
+}
+
+// parseEntity parses MIME entity of headers and body.
+func parseEntity(data string) (*sip.BodyPart, error) {
+	mp, err := sip.ParseMultipart("multipart/mixed;boundary=entity", "--entity\r\n"+data+"\r\n--entity--\r\n")
+	if err != nil || len(mp.Parts) != 1 {
+		return nil, fmt.Errorf("malformed MIME entity: %v", err)
+	}
+
+	return mp.Parts[0], nil
+}
+
+// partData returns the decoded body of the part.
+func partData(part *sip.BodyPart) ([]byte, error) {
+	if encoding, ok := part.Header("Content-Transfer-Encoding"); ok && strings.EqualFold(encoding, "base64") {
+		return decodeBase64(part.Body)
+	}
+
+	return []byte(part.Body), nil
+}
+
+func decodeBase64(data string) ([]byte, error) {
+	data = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, data)
+
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// certificateOf checks that the certificate is issued for the address of record by SIP URI or email of subjectAltName.
+func certificateOf(cert *x509.Certificate, aor string) bool {
+	for _, uri := range cert.URIs {
+		switch strings.ToLower(uri.Scheme) {
+		case "sip", "sips":
+			if strings.EqualFold(uri.Opaque, aor) {
+				return true
+			}
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if strings.EqualFold(email, aor) {
+			return true
+		}
+	}
+
+	return false
+}
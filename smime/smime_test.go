@@ -0,0 +1,213 @@
+package smime_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/smime"
+	"github.com/ghettovoice/gosip/testutils"
+)
+
+func issue(serial int64, name string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		tpl.IsCA = true
+		tpl.BasicConstraintsValid = true
+		tpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tpl, key
+	} else {
+		tpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		tpl.URIs = []*url.URL{{Scheme: "sip", Opaque: name}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	return cert, key
+}
+
+var _ = Describe("S/MIME", func() {
+	var (
+		roots       *x509.CertPool
+		alice, bob  *smime.Identity
+		store       *smime.StaticKeyStore
+		invite      sip.Request
+		logger      log.Logger
+		sdp         = "v=0\r\no=alice 1 1 IN IP4 10.0.0.1\r\n"
+		newIdentity func(serial int64, name string) *smime.Identity
+		caCert      *x509.Certificate
+		caKey       *rsa.PrivateKey
+		received    func(msg sip.Message) sip.Request
+		handle      func(req sip.Request) (*testutils.MockServerTx, sip.Request)
+		issueOnce   sync.Once
+	)
+
+	newIdentity = func(serial int64, name string) *smime.Identity {
+		cert, key := issue(serial, name, caCert, caKey)
+		return &smime.Identity{Certificate: cert, Key: key}
+	}
+	// the message goes over the wire
+	received = func(msg sip.Message) sip.Request {
+		return testutils.Message([]string{msg.String()}).(sip.Request)
+	}
+
+	BeforeEach(func() {
+		issueOnce.Do(func() {
+			caCert, caKey = issue(1, "Test CA", nil, nil)
+			roots = x509.NewCertPool()
+			roots.AddCert(caCert)
+			alice = newIdentity(2, "alice@example.com")
+			bob = newIdentity(3, "bob@example.com")
+		})
+		store = &smime.StaticKeyStore{
+			Identities: map[string]*smime.Identity{"bob@example.com": bob},
+			RootCAs:    roots,
+		}
+		logger = testutils.NewLogrusLogger()
+
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=from-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: smime-call-id",
+			"CSeq: 1 INVITE",
+			"Content-Type: application/sdp",
+			"Content-Disposition: session",
+			"Content-Length: 33",
+			"",
+			sdp,
+		})
+		handle = func(req sip.Request) (*testutils.MockServerTx, sip.Request) {
+			tx := testutils.NewMockServerTx(req)
+			var handled sip.Request
+			smime.Handler(store, func(req sip.Request, tx sip.ServerTransaction) {
+				handled = req
+			}, logger)(req, tx)
+
+			return tx, handled
+		}
+	})
+
+	It("should sign and verify the body", func() {
+		Expect(smime.Sign(invite, alice)).To(Succeed())
+		contentType, ok := invite.ContentType()
+		Expect(ok).To(BeTrue())
+		Expect(contentType.Value()).To(HavePrefix("multipart/signed;"))
+		Expect(contentType.Value()).To(ContainSubstring(`protocol="application/pkcs7-signature"`))
+		Expect(invite.GetHeaders("Content-Disposition")).To(BeEmpty())
+
+		req := received(invite)
+		signer, err := smime.Verify(req, roots)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signer.Equal(alice.Certificate)).To(BeTrue())
+		contentType, _ = req.ContentType()
+		Expect(contentType.Value()).To(Equal("application/sdp"))
+		Expect(req.GetHeaders("Content-Disposition")[0].Value()).To(Equal("session"))
+		Expect(req.Body()).To(Equal(sdp))
+	})
+
+	It("should reject tampered body", func() {
+		Expect(smime.Sign(invite, alice)).To(Succeed())
+		req := received(invite)
+		req.SetBody(strings.Replace(req.Body(), "10.0.0.1", "10.6.6.6", 1), true)
+
+		_, err := smime.Verify(req, roots)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject signature of the other address of record", func() {
+		Expect(smime.Sign(invite, bob)).To(Succeed())
+
+		_, err := smime.Verify(received(invite), roots)
+		Expect(err).To(MatchError(ContainSubstring("not issued for alice@example.com")))
+	})
+
+	It("should reject signer that is not trusted", func() {
+		Expect(smime.Sign(invite, alice)).To(Succeed())
+
+		_, err := smime.Verify(received(invite), x509.NewCertPool())
+		Expect(err).To(MatchError(ContainSubstring("verify signer certificate")))
+	})
+
+	It("should not verify unsigned body", func() {
+		_, err := smime.Verify(invite, roots)
+		Expect(err).To(Equal(smime.ErrNotSigned))
+	})
+
+	It("should encrypt and decrypt the body", func() {
+		Expect(smime.Encrypt(invite, bob.Certificate)).To(Succeed())
+		contentType, _ := invite.ContentType()
+		Expect(contentType.Value()).To(HavePrefix("application/pkcs7-mime;smime-type=enveloped-data"))
+		Expect(invite.Body()).ToNot(ContainSubstring("alice"))
+
+		req := received(invite)
+		Expect(smime.Decrypt(req, bob)).To(Succeed())
+		contentType, _ = req.ContentType()
+		Expect(contentType.Value()).To(Equal("application/sdp"))
+		Expect(req.GetHeaders("Content-Disposition")[0].Value()).To(Equal("session"))
+		Expect(req.Body()).To(Equal(sdp))
+	})
+
+	It("should not decrypt the body with the other key", func() {
+		Expect(smime.Encrypt(invite, bob.Certificate)).To(Succeed())
+
+		Expect(smime.Decrypt(received(invite), alice)).ToNot(Succeed())
+	})
+
+	It("should pass verified and decrypted request to the handler", func() {
+		Expect(smime.Sign(invite, alice)).To(Succeed())
+		Expect(smime.Encrypt(invite, bob.Certificate)).To(Succeed())
+
+		tx, req := handle(received(invite))
+		Expect(tx.Response()).To(BeNil())
+		Expect(req).ToNot(BeNil())
+		Expect(req.Body()).To(Equal(sdp))
+		Expect(smime.Signer(tx).Equal(alice.Certificate)).To(BeTrue())
+	})
+
+	It("should pass plain request to the handler", func() {
+		tx, req := handle(invite)
+		Expect(req).ToNot(BeNil())
+		Expect(smime.Signer(tx)).To(BeNil())
+	})
+
+	It("should answer 493 on the body that can't be decrypted", func() {
+		Expect(smime.Encrypt(invite, alice.Certificate)).To(Succeed())
+
+		tx, req := handle(received(invite))
+		Expect(req).To(BeNil())
+		Expect(tx.Response().StatusCode()).To(Equal(sip.StatusCode(493)))
+	})
+
+	It("should answer 403 on invalid signature", func() {
+		Expect(smime.Sign(invite, bob)).To(Succeed())
+
+		tx, req := handle(received(invite))
+		Expect(req).To(BeNil())
+		Expect(tx.Response().StatusCode()).To(Equal(sip.StatusCode(403)))
+		Expect(tx.Response().Reason()).To(Equal("Invalid Signature"))
+	})
+})
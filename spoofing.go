@@ -0,0 +1,207 @@
+package gosip
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const (
+	DefaultSourceNonceTTL     = 30 * time.Second
+	DefaultSourceValidTTL     = 10 * time.Minute
+	DefaultSourceValidMax     = 65536
+	DefaultSourceRealm        = "gosip"
+	sourceNonceSignatureBytes = 16
+)
+
+// SourceValidationConfig describes validation of sources of UDP requests against spoofed-source floods.
+// Out-of-dialog requests from the source that is not validated yet are answered with the digest challenge
+// statelessly, before transactions are created. The nonce of the challenge is signed for the source address,
+// so only the source that actually receives responses can repeat the request with the nonce.
+// UACs answer challenges with their credentials, the digest response itself is not verified, so the validation
+// does not replace authentication of handlers, like by auth.Authenticator with the other realm.
+// Validated sources are admitted without challenges for ValidTTL.
+type SourceValidationConfig struct {
+	// Realm of challenges, default is DefaultSourceRealm.
+	Realm string
+	// Secret signs nonces, random by default. Servers sharing the address behind the load balancer
+	// should share the secret, so nonces issued by one of them are accepted by others.
+	Secret []byte
+	// Proxy challenges with '407 Proxy Authentication Required' instead of '401 Unauthorized'.
+	Proxy bool
+	// NonceTTL is a lifetime of nonces, default is DefaultSourceNonceTTL.
+	NonceTTL time.Duration
+	// ValidTTL is how long the validated source is admitted without challenges, default is DefaultSourceValidTTL.
+	ValidTTL time.Duration
+	// ValidMax bounds the number of remembered validated sources, default is DefaultSourceValidMax.
+	// Sources over the limit are challenged again.
+	ValidMax int
+}
+
+// sourceValidation is the Admission that challenges new UDP sources.
+type sourceValidation struct {
+	config SourceValidationConfig
+
+	mu    sync.Mutex
+	valid map[string]time.Time
+}
+
+func newSourceValidation(config SourceValidationConfig) *sourceValidation {
+	if config.Realm == "" {
+		config.Realm = DefaultSourceRealm
+	}
+	if len(config.Secret) == 0 {
+		config.Secret = make([]byte, 32)
+		if _, err := rand.Read(config.Secret); err != nil {
+			panic(fmt.Errorf("generate source validation secret: %w", err))
+		}
+	}
+	if config.NonceTTL <= 0 {
+		config.NonceTTL = DefaultSourceNonceTTL
+	}
+	if config.ValidTTL <= 0 {
+		config.ValidTTL = DefaultSourceValidTTL
+	}
+	if config.ValidMax <= 0 {
+		config.ValidMax = DefaultSourceValidMax
+	}
+
+	return &sourceValidation{
+		config: config,
+		valid:  make(map[string]time.Time),
+	}
+}
+
+func (sv *sourceValidation) headerNames() (string, string) {
+	if sv.config.Proxy {
+		return "Proxy-Authenticate", "Proxy-Authorization"
+	}
+
+	return "WWW-Authenticate", "Authorization"
+}
+
+// Admit challenges out-of-dialog UDP requests of sources that are not validated yet.
+func (sv *sourceValidation) Admit(req AdmissionRequest) AdmissionDecision {
+	if !strings.EqualFold(req.Transport, "UDP") || req.Source == "" {
+		return Accept()
+	}
+	if to, ok := req.Request.To(); ok && to.Params != nil && to.Params.Has("tag") {
+		return Accept()
+	}
+
+	now := timing.Now()
+	if sv.validated(req.Source, now) {
+		return Accept()
+	}
+
+	authenticateHeaderName, authorizeHeaderName := sv.headerNames()
+	stale := false
+	for _, hdr := range req.Request.GetHeaders(authorizeHeaderName) {
+		credentials := sip.AuthFromValue(hdr.Value())
+		if credentials.Realm() != sv.config.Realm {
+			continue
+		}
+
+		switch sv.checkNonce(credentials.Nonce(), req.Source, now) {
+		case nil:
+			sv.validate(req.Source, now)
+
+			return Accept()
+		case errSourceNonceExpired:
+			stale = true
+		}
+	}
+
+	value := fmt.Sprintf(`Digest realm="%s",nonce="%s",algorithm=MD5,qop="auth"`,
+		sv.config.Realm, sv.nonce(req.Source, now))
+	if stale {
+		value += ",stale=true"
+	}
+
+	return Challenge(&sip.GenericHeader{
+		HeaderName: authenticateHeaderName,
+		Contents:   value,
+	})
+}
+
+var (
+	errSourceNonceInvalid = errors.New("nonce is not issued for the source")
+	errSourceNonceExpired = errors.New("nonce is expired")
+)
+
+// nonce returns the nonce signed for the source: issue time and signature in hex.
+func (sv *sourceValidation) nonce(source string, issued time.Time) string {
+	ts := strconv.FormatInt(issued.Unix(), 16)
+
+	return ts + sv.sign(source, ts)
+}
+
+func (sv *sourceValidation) sign(source, ts string) string {
+	mac := hmac.New(sha256.New, sv.config.Secret)
+	mac.Write([]byte(source))
+	mac.Write([]byte{0})
+	mac.Write([]byte(ts))
+
+	return hex.EncodeToString(mac.Sum(nil)[:sourceNonceSignatureBytes])
+}
+
+func (sv *sourceValidation) checkNonce(nonce, source string, now time.Time) error {
+	if len(nonce) <= 2*sourceNonceSignatureBytes {
+		return errSourceNonceInvalid
+	}
+
+	ts := nonce[:len(nonce)-2*sourceNonceSignatureBytes]
+	if !hmac.Equal([]byte(nonce[len(ts):]), []byte(sv.sign(source, ts))) {
+		return errSourceNonceInvalid
+	}
+	issued, err := strconv.ParseInt(ts, 16, 64)
+	if err != nil {
+		return errSourceNonceInvalid
+	}
+	if now.Sub(time.Unix(issued, 0)) > sv.config.NonceTTL {
+		return errSourceNonceExpired
+	}
+
+	return nil
+}
+
+func (sv *sourceValidation) validated(source string, now time.Time) bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	expires, ok := sv.valid[source]
+	if ok && now.After(expires) {
+		delete(sv.valid, source)
+		return false
+	}
+
+	return ok
+}
+
+func (sv *sourceValidation) validate(source string, now time.Time) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if len(sv.valid) >= sv.config.ValidMax {
+		for src, expires := range sv.valid {
+			if now.After(expires) {
+				delete(sv.valid, src)
+			}
+		}
+		if len(sv.valid) >= sv.config.ValidMax {
+			return
+		}
+	}
+
+	sv.valid[source] = now.Add(sv.config.ValidTTL)
+}
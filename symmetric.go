@@ -0,0 +1,120 @@
+package gosip
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// SymmetricIdleTimeout is how long the learned address of the dialog peer is kept without messages from the peer.
+const SymmetricIdleTimeout = time.Hour
+
+// symmetricPeers remembers addresses messages of the dialog peers actually arrive from,
+// so responses and in-dialog requests are sent back to them instead of Contact and Via addresses.
+// Dialogs are identified by Call-ID and the tag of the peer, so the proxy learns both sides of the dialog.
+type symmetricPeers struct {
+	mu        sync.Mutex
+	peers     map[string]symmetricPeer
+	lastPrune time.Time
+}
+
+type symmetricPeer struct {
+	addr      string
+	transport string
+	seen      time.Time
+}
+
+func newSymmetricPeers() *symmetricPeers {
+	return &symmetricPeers{
+		peers:     make(map[string]symmetricPeer),
+		lastPrune: timing.Now(),
+	}
+}
+
+// learn remembers source of the incoming message.
+func (sp *symmetricPeers) learn(msg sip.Message) {
+	key, ok := symmetricKey(msg, true)
+	if !ok {
+		return
+	}
+	addr, _ := msg.Fields()[transport.ReceivedFromField].(string)
+	if addr == "" {
+		addr = msg.Source()
+	}
+
+	now := timing.Now()
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.peers[key] = symmetricPeer{
+		addr:      addr,
+		transport: msg.Transport(),
+		seen:      now,
+	}
+	if now.Sub(sp.lastPrune) >= time.Minute {
+		sp.lastPrune = now
+		for key, peer := range sp.peers {
+			if now.Sub(peer.seen) > SymmetricIdleTimeout {
+				delete(sp.peers, key)
+			}
+		}
+	}
+}
+
+// apply redirects the outgoing message to the learned address of the dialog peer.
+func (sp *symmetricPeers) apply(msg sip.Message) {
+	key, ok := symmetricKey(msg, false)
+	if !ok {
+		return
+	}
+
+	sp.mu.Lock()
+	peer, ok := sp.peers[key]
+	sp.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	msg.SetDestination(peer.addr)
+	if _, ok := msg.(sip.Request); ok && peer.transport != "" {
+		msg.SetTransport(peer.transport)
+	}
+}
+
+// symmetricKey returns Call-ID and the tag of the peer: From tag of requests from the peer
+// and responses to the peer, To tag of responses from the peer and requests to the peer.
+func symmetricKey(msg sip.Message, incoming bool) (string, bool) {
+	callID, ok := msg.CallID()
+	if !ok {
+		return "", false
+	}
+
+	_, isRequest := msg.(sip.Request)
+	var params sip.Params
+	if isRequest == incoming {
+		from, ok := msg.From()
+		if !ok {
+			return "", false
+		}
+		params = from.Params
+	} else {
+		to, ok := msg.To()
+		if !ok {
+			return "", false
+		}
+		params = to.Params
+	}
+	if params == nil {
+		return "", false
+	}
+	tag, ok := params.Get("tag")
+	if !ok || tag == nil || tag.String() == "" {
+		return "", false
+	}
+
+	return string(*callID) + ";" + tag.String(), true
+}
@@ -0,0 +1,140 @@
+package gosip
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// TenantField is a message field with the tenant of the server that received or sent the message.
+const TenantField = "tenant"
+
+// MessageTenant returns the tenant attached to the message by the server, empty if the server has no tenant.
+func MessageTenant(msg sip.Message) string {
+	tenant, _ := msg.Fields()[TenantField].(string)
+	return tenant
+}
+
+func (srv *server) tagTenant(msg sip.Message) {
+	if srv.tenant != "" {
+		msg.WithFields(log.Fields{TenantField: srv.tenant})
+	}
+}
+
+// Tenants runs isolated logical SIP stacks inside one process, like customers of the hosted PBX.
+// Every tenant is a separate Server with own listeners, transactions, handlers and ACL,
+// so credentials and registrars of the tenant are bound to its server by the application.
+// Shared options, like WithResolver and WithLogger, are applied to all tenants,
+// so the tenants share the DNS resolver and the logger.
+// Metrics of the tenant are separated by the const label, e.g.
+//
+//	tenants.Add("acme",
+//		gosip.WithListenAddrs(gosip.ListenAddr{Network: "udp", Addr: "10.0.0.1:5060"}),
+//		gosip.WithMetrics(metrics.NewMetrics(metrics.Config{
+//			ConstLabels: prometheus.Labels{gosip.TenantField: "acme"},
+//		})),
+//	)
+type Tenants interface {
+	// Add creates and starts the server of the tenant with the shared options followed by the options.
+	Add(tenant string, options ...ServerOption) (Server, error)
+	// Get returns the server of the tenant.
+	Get(tenant string) (Server, bool)
+	// Remove shutdowns the server of the tenant and waits for its goroutines.
+	Remove(tenant string) error
+	// List returns sorted tenants.
+	List() []string
+	// Shutdown shutdowns servers of all tenants.
+	Shutdown()
+}
+
+type tenants struct {
+	shared  []ServerOption
+	mu      sync.Mutex
+	servers map[string]Server
+}
+
+// NewTenants creates the empty set of tenants, shared options are applied to servers of all tenants.
+func NewTenants(shared ...ServerOption) Tenants {
+	return &tenants{
+		shared:  shared,
+		servers: make(map[string]Server),
+	}
+}
+
+func (ts *tenants) Add(tenant string, options ...ServerOption) (Server, error) {
+	if tenant == "" {
+		return nil, fmt.Errorf("empty tenant")
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, ok := ts.servers[tenant]; ok {
+		return nil, fmt.Errorf("tenant %s already exists", tenant)
+	}
+
+	opts := make([]ServerOption, 0, len(ts.shared)+len(options)+1)
+	opts = append(opts, ts.shared...)
+	opts = append(opts, options...)
+	opts = append(opts, WithTenant(tenant))
+	srv, err := New(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create server of tenant %s: %w", tenant, err)
+	}
+	ts.servers[tenant] = srv
+
+	return srv, nil
+}
+
+func (ts *tenants) Get(tenant string) (Server, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	srv, ok := ts.servers[tenant]
+	return srv, ok
+}
+
+func (ts *tenants) Remove(tenant string) error {
+	ts.mu.Lock()
+	srv, ok := ts.servers[tenant]
+	delete(ts.servers, tenant)
+	ts.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("tenant %s not found", tenant)
+	}
+
+	srv.Shutdown()
+	srv.Wait()
+
+	return nil
+}
+
+func (ts *tenants) List() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	list := make([]string, 0, len(ts.servers))
+	for tenant := range ts.servers {
+		list = append(list, tenant)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+func (ts *tenants) Shutdown() {
+	ts.mu.Lock()
+	servers := ts.servers
+	ts.servers = make(map[string]Server)
+	ts.mu.Unlock()
+
+	for _, srv := range servers {
+		srv.Shutdown()
+	}
+	for _, srv := range servers {
+		srv.Wait()
+	}
+}
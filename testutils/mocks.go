@@ -1,6 +1,7 @@
 package testutils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -134,6 +135,30 @@ func (tpl *MockTransportLayer) Listen(network string, addr string, options ...tr
 	return nil
 }
 
+func (tpl *MockTransportLayer) ListenContext(
+	ctx context.Context,
+	network string,
+	addr string,
+	options ...transport.ListenOption,
+) error {
+	return nil
+}
+
+func (tpl *MockTransportLayer) SendContext(ctx context.Context, msg sip.Message) error {
+	select {
+	case <-tpl.done:
+		return io.EOF
+	case <-ctx.Done():
+		return ctx.Err()
+	case tpl.OutMsgs <- msg:
+		return nil
+	}
+}
+
+func (tpl *MockTransportLayer) Unlisten(network string, addr string) error {
+	return nil
+}
+
 func (tpl *MockTransportLayer) Send(msg sip.Message) error {
 	select {
 	case <-tpl.done:
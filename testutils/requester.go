@@ -0,0 +1,229 @@
+package testutils
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// MockServerTx is a server transaction that records responses of handlers.
+type MockServerTx struct {
+	sip.ValueStore
+
+	req     sip.Request
+	cancels chan sip.Request
+
+	mu        sync.Mutex
+	responses []sip.Response
+}
+
+func NewMockServerTx(req sip.Request) *MockServerTx {
+	return &MockServerTx{
+		req:     req,
+		cancels: make(chan sip.Request, 1),
+	}
+}
+
+func (tx *MockServerTx) Origin() sip.Request         { return tx.req }
+func (tx *MockServerTx) Key() sip.TransactionKey     { return "mock" }
+func (tx *MockServerTx) String() string              { return "MockServerTx" }
+func (tx *MockServerTx) Errors() <-chan error        { return nil }
+func (tx *MockServerTx) Done() <-chan bool           { return nil }
+func (tx *MockServerTx) Acks() <-chan sip.Request    { return nil }
+func (tx *MockServerTx) Cancels() <-chan sip.Request { return tx.cancels }
+
+// Cancel passes CANCEL of the request to the transaction user.
+func (tx *MockServerTx) Cancel(cancel sip.Request) {
+	tx.cancels <- cancel
+}
+
+func (tx *MockServerTx) Respond(res sip.Response) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.responses = append(tx.responses, res)
+	return nil
+}
+
+// Response returns the last response, nil if there were no responses.
+func (tx *MockServerTx) Response() sip.Response {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if len(tx.responses) == 0 {
+		return nil
+	}
+	return tx.responses[len(tx.responses)-1]
+}
+
+func (tx *MockServerTx) Responses() []sip.Response {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return append([]sip.Response{}, tx.responses...)
+}
+
+func (tx *MockServerTx) Codes() []sip.StatusCode {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	codes := make([]sip.StatusCode, 0, len(tx.responses))
+	for _, res := range tx.responses {
+		codes = append(codes, res.StatusCode())
+	}
+	return codes
+}
+
+// Loopback passes requests directly to handlers of their methods and returns final responses of handlers,
+// like the server of the remote side. It implements gosip.RequestSender.
+type Loopback struct {
+	mu       sync.RWMutex
+	handlers map[sip.RequestMethod]gosip.RequestHandler
+}
+
+func NewLoopback() *Loopback {
+	return &Loopback{
+		handlers: make(map[sip.RequestMethod]gosip.RequestHandler),
+	}
+}
+
+func (l *Loopback) OnRequest(method sip.RequestMethod, handler gosip.RequestHandler) error {
+	l.mu.Lock()
+	l.handlers[method] = handler
+	l.mu.Unlock()
+
+	return nil
+}
+
+func (l *Loopback) RequestWithContext(
+	ctx context.Context,
+	request sip.Request,
+	options ...gosip.RequestWithContextOption,
+) (sip.Response, error) {
+	l.mu.RLock()
+	handler, ok := l.handlers[request.Method()]
+	l.mu.RUnlock()
+	if !ok {
+		return nil, sip.NewRequestError(405, "Method Not Allowed", request, nil)
+	}
+
+	tx := NewMockServerTx(request)
+	handler(request, tx)
+	res := tx.Response()
+	if res == nil {
+		return nil, sip.NewRequestError(408, "Request Timeout", request, nil)
+	}
+	if !res.IsSuccess() {
+		return nil, sip.NewRequestError(uint(res.StatusCode()), res.Reason(), request, res)
+	}
+	return res, nil
+}
+
+// Send drops messages, like ACKs of the loopback requests.
+func (l *Loopback) Send(msg sip.Message) error {
+	return nil
+}
+
+// MockRequester records requests and answers them by the respond function, it implements gosip.RequestSender.
+type MockRequester struct {
+	received chan sip.Request
+
+	mu       sync.Mutex
+	requests []sip.Request
+	options  int
+	respond  func(req sip.Request) (sip.Response, error)
+}
+
+// NewMockRequester creates requester, nil respond answers requests with 200 OK.
+func NewMockRequester(respond func(req sip.Request) (sip.Response, error)) *MockRequester {
+	if respond == nil {
+		respond = func(req sip.Request) (sip.Response, error) {
+			return sip.NewResponseFromRequest("", req, 200, "OK", ""), nil
+		}
+	}
+
+	return &MockRequester{
+		received: make(chan sip.Request, 1000),
+		respond:  respond,
+	}
+}
+
+func (r *MockRequester) RequestWithContext(
+	ctx context.Context,
+	request sip.Request,
+	options ...gosip.RequestWithContextOption,
+) (sip.Response, error) {
+	r.mu.Lock()
+	r.requests = append(r.requests, request)
+	r.options = len(options)
+	respond := r.respond
+	r.mu.Unlock()
+
+	r.receive(request)
+
+	return respond(request)
+}
+
+// Send records requests, like ACK and CANCEL.
+func (r *MockRequester) Send(msg sip.Message) error {
+	if req, ok := msg.(sip.Request); ok {
+		r.mu.Lock()
+		r.requests = append(r.requests, req)
+		r.mu.Unlock()
+
+		r.receive(req)
+	}
+
+	return nil
+}
+
+func (r *MockRequester) receive(req sip.Request) {
+	select {
+	case r.received <- req:
+	default:
+	}
+}
+
+// Received returns the channel of requests in order, requests are dropped when it is full.
+func (r *MockRequester) Received() <-chan sip.Request {
+	return r.received
+}
+
+func (r *MockRequester) SetRespond(respond func(req sip.Request) (sip.Response, error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.respond = respond
+}
+
+func (r *MockRequester) Requests() []sip.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]sip.Request{}, r.requests...)
+}
+
+// RequestsTo returns requests routed to the host by the first Route header.
+func (r *MockRequester) RequestsTo(host string) []sip.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reqs := make([]sip.Request, 0)
+	for _, req := range r.requests {
+		if routes := sip.RouteUris(req); len(routes) > 0 && routes[0].Host() == host {
+			reqs = append(reqs, req)
+		}
+	}
+
+	return reqs
+}
+
+// Options returns the number of options of the last request.
+func (r *MockRequester) Options() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.options
+}
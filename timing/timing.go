@@ -2,17 +2,72 @@
 package timing
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
 
-// Controls whether library calls should be mocked, or whether we should use the standard Go time library.
+// Controls whether library calls should be mocked, or whether we should use the current Clock.
 // If we're in Mock Mode, then time does not pass as normal, but only progresses when Elapse is called.
-// False by default, indicating that we just call through to standard Go functions.
+// False by default, indicating that we just call through to the current Clock.
 var MockMode = false
-var currentTimeMock = time.Unix(0, 0)
-var mockTimers = make([]*mockTimer, 0)
-var mockTimerMu = new(sync.Mutex)
+
+// mockClock is the clock of Mock Mode, it is moved forward by Elapse.
+var mockClock = NewFakeClock(time.Unix(0, 0))
+
+var (
+	clockMu sync.RWMutex
+	clock   = NewRealClock()
+)
+
+// Clock is a source of the current time and timers.
+// All timers of the stack (transaction retransmissions, connection TTLs, session timers, refreshes, etc)
+// are created by the current clock, so it can be replaced by the fake one in tests
+// or by the application scheduler with SetClock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates timer that sends the current time on its channel after duration 'd'.
+	NewTimer(d time.Duration) Timer
+	// AfterFunc creates timer that calls 'f' in its own goroutine after duration 'd'.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// FakeClock is a Clock that does not pass on its own, it is moved forward by Advance.
+type FakeClock interface {
+	Clock
+	// Advance moves the time forward by 'd' and fires all expired timers in order of their expiry time.
+	Advance(d time.Duration)
+	// Timers returns number of active timers.
+	Timers() int
+	// BlockUntil blocks until at least 'n' timers are active.
+	// It allows to advance time only after the code under test has started its timers.
+	BlockUntil(n int)
+}
+
+// SetClock replaces the current clock, nil restores the real clock.
+// Timers created before keep working on the previous clock.
+func SetClock(c Clock) {
+	if c == nil {
+		c = NewRealClock()
+	}
+
+	clockMu.Lock()
+	clock = c
+	clockMu.Unlock()
+}
+
+// GetClock returns the current clock.
+func GetClock() Clock {
+	if MockMode {
+		return mockClock
+	}
+
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+
+	return clock
+}
 
 // Interface over Golang's built-in Timers, allowing them to be swapped out for mocked timers.
 type Timer interface {
@@ -29,6 +84,25 @@ type Timer interface {
 	Stop() bool
 }
 
+type realClock struct{}
+
+// NewRealClock creates Clock over the standard Go time library.
+func NewRealClock() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return &realTimer{time.AfterFunc(d, f)}
+}
+
 // Implementation of Timer that just wraps time.Timer.
 type realTimer struct {
 	*time.Timer
@@ -56,40 +130,152 @@ func (t *realTimer) Stop() bool {
 	return true
 }
 
-// Implementation of Timer that mocks time.Timer, firing when the total elapsed time (as controlled by Elapse)
-// exceeds the duration specified when the timer was constructed.
-type mockTimer struct {
-	EndTime time.Time
-	Chan    chan time.Time
-	fired   bool
-	toRun   func()
+type fakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock creates FakeClock that starts at time 'now'.
+func NewFakeClock(now time.Time) FakeClock {
+	c := &fakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.schedule(t, d)
+
+	return t
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), fn: f}
+	c.schedule(t, d)
+
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	// Fire any timers whose time has come up.
+	var fired, remaining []*fakeTimer
+	for _, t := range c.timers {
+		if !t.endTime.After(c.now) {
+			fired = append(fired, t)
+		} else {
+			remaining = append(remaining, t)
+		}
+	}
+	c.timers = remaining
+
+	sort.SliceStable(fired, func(i, j int) bool {
+		return fired[i].endTime.Before(fired[j].endTime)
+	})
+	for _, t := range fired {
+		c.fire(t)
+	}
+}
+
+func (c *fakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
 }
 
-func (t *mockTimer) C() <-chan time.Time {
-	return t.Chan
+func (c *fakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
 }
 
-func (t *mockTimer) Reset(d time.Duration) bool {
-	wasActive := removeMockTimer(t)
+func (c *fakeClock) schedule(t *fakeTimer, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	t.EndTime = currentTimeMock.Add(d)
+	t.endTime = c.now.Add(d)
 	if d > 0 {
-		mockTimerMu.Lock()
-		mockTimers = append(mockTimers, t)
-		mockTimerMu.Unlock()
+		c.timers = append(c.timers, t)
+		c.cond.Broadcast()
 	} else {
 		// The new timer has an expiry time of 0.
 		// Fire it right away, and don't bother tracking it.
-		t.Chan <- currentTimeMock
+		c.fire(t)
 	}
+}
+
+// fire must be called with locked clock.
+func (c *fakeClock) fire(t *fakeTimer) {
+	if t.fn != nil {
+		go t.fn()
+	}
+
+	// Clear the channel if something is already in it.
+	select {
+	case <-t.c:
+	default:
+	}
+
+	t.c <- c.now
+}
+
+// remove stops tracking of the timer, returns false if the timer was already expired.
+func (c *fakeClock) remove(t *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, elt := range c.timers {
+		if elt == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Implementation of Timer that mocks time.Timer, firing when the fake clock
+// is advanced beyond the duration specified when the timer was constructed.
+type fakeTimer struct {
+	clock   *fakeClock
+	endTime time.Time
+	c       chan time.Time
+	fn      func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	wasActive := t.clock.remove(t)
+	t.clock.schedule(t, d)
 
 	return wasActive
 }
 
-func (t *mockTimer) Stop() bool {
-	if !removeMockTimer(t) {
+func (t *fakeTimer) Stop() bool {
+	if !t.clock.remove(t) {
 		select {
-		case <-t.Chan:
+		case <-t.c:
 			return true
 		default:
 			return false
@@ -98,22 +284,9 @@ func (t *mockTimer) Stop() bool {
 	return true
 }
 
-// Creates a new Timer; either a wrapper around a standard Go time.Timer, or a mocked-out Timer,
-// depending on whether MockMode is set.
+// Creates a new Timer of the current Clock; or a mocked-out Timer, depending on whether MockMode is set.
 func NewTimer(d time.Duration) Timer {
-	if MockMode {
-		t := mockTimer{currentTimeMock.Add(d), make(chan time.Time, 1), false, nil}
-		if d == 0 {
-			t.Chan <- currentTimeMock
-		} else {
-			mockTimerMu.Lock()
-			mockTimers = append(mockTimers, &t)
-			mockTimerMu.Unlock()
-		}
-		return &t
-	} else {
-		return &realTimer{time.NewTimer(d)}
-	}
+	return GetClock().NewTimer(d)
 }
 
 // See built-in time.After() function.
@@ -123,22 +296,7 @@ func After(d time.Duration) <-chan time.Time {
 
 // See built-in time.AfterFunc() function.
 func AfterFunc(d time.Duration, f func()) Timer {
-	if MockMode {
-		mockTimerMu.Lock()
-		t := mockTimer{currentTimeMock.Add(d), make(chan time.Time, 1), false, f}
-		mockTimerMu.Unlock()
-		if d == 0 {
-			go f()
-			t.Chan <- currentTimeMock
-		} else {
-			mockTimerMu.Lock()
-			mockTimers = append(mockTimers, &t)
-			mockTimerMu.Unlock()
-		}
-		return &t
-	} else {
-		return &realTimer{time.AfterFunc(d, f)}
-	}
+	return GetClock().AfterFunc(d, f)
 }
 
 // See built-in time.Sleep() function.
@@ -150,53 +308,14 @@ func Sleep(d time.Duration) {
 // This function can only be called in Mock Mode, otherwise we will panic.
 func Elapse(d time.Duration) {
 	requireMockMode()
-	mockTimerMu.Lock()
-	currentTimeMock = currentTimeMock.Add(d)
-	mockTimerMu.Unlock()
-
-	// Fire any timers whose time has come up.
-	mockTimerMu.Lock()
-	for _, t := range mockTimers {
-		t.fired = false
-		if !t.EndTime.After(currentTimeMock) {
-			if t.toRun != nil {
-				go t.toRun()
-			}
-
-			// Clear the channel if something is already in it.
-			select {
-			case <-t.Chan:
-			default:
-			}
-
-			t.Chan <- currentTimeMock
-			t.fired = true
-		}
-	}
-	mockTimerMu.Unlock()
-
-	// Stop tracking any fired timers.
-	remainingTimers := make([]*mockTimer, 0)
-	mockTimerMu.Lock()
-	for _, t := range mockTimers {
-		if !t.fired {
-			remainingTimers = append(remainingTimers, t)
-		}
-	}
-
-	mockTimers = remainingTimers
-	mockTimerMu.Unlock()
+	mockClock.Advance(d)
 }
 
 // Returns the current time.
 // If Mock Mode is set, this will be the sum of all Durations passed into Elapse calls;
-// otherwise it will be the true system time.
+// otherwise it will be the time of the current Clock.
 func Now() time.Time {
-	if MockMode {
-		return currentTimeMock
-	} else {
-		return time.Now()
-	}
+	return GetClock().Now()
 }
 
 // Shortcut method to enforce that Mock Mode is enabled.
@@ -205,30 +324,3 @@ func requireMockMode() {
 		panic("This method requires MockMode to be enabled")
 	}
 }
-
-// Utility method to remove a mockTimer from the list of outstanding timers.
-func removeMockTimer(t *mockTimer) bool {
-	// First, find the index of the timer in our list.
-	found := false
-	var idx int
-	var elt *mockTimer
-	mockTimerMu.Lock()
-	for idx, elt = range mockTimers {
-		if elt == t {
-			found = true
-			break
-		}
-	}
-	mockTimerMu.Unlock()
-
-	if found {
-		mockTimerMu.Lock()
-		// We found the given timer. Remove it.
-		mockTimers = append(mockTimers[:idx], mockTimers[idx+1:]...)
-		mockTimerMu.Unlock()
-		return true
-	} else {
-		// The timer was not present, indicating that it was already expired.
-		return false
-	}
-}
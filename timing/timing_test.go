@@ -194,9 +194,9 @@ func TestNotExpiredReset(t *testing.T) {
 }
 
 // This is a regression test for a bug where:
-//  - Create 3 timers.
-//  - Reset() the first one.
-//  - The third timer is now no longer tracked and won't fire.
+//   - Create 3 timers.
+//   - Reset() the first one.
+//   - The third timer is now no longer tracked and won't fire.
 func TestThreeTimersWithReset(t *testing.T) {
 	MockMode = true
 	timer1 := NewTimer(1 * time.Second)
@@ -232,3 +232,80 @@ func TestThreeTimersWithReset(t *testing.T) {
 	// Panic here if bug exists.
 	<-done3
 }
+
+func TestFakeClockFiresInOrder(t *testing.T) {
+	start := time.Unix(100, 0)
+	clock := NewFakeClock(start)
+
+	fired := make(chan int, 3)
+	clock.AfterFunc(3*time.Second, func() { fired <- 3 })
+	timer := clock.NewTimer(2 * time.Second)
+	clock.AfterFunc(time.Second, func() { fired <- 1 })
+
+	clock.BlockUntil(3)
+	if n := clock.Timers(); n != 3 {
+		t.Fatalf("expected 3 active timers, got %d", n)
+	}
+
+	clock.Advance(2 * time.Second)
+	if now := <-timer.C(); !now.Equal(start.Add(2 * time.Second)) {
+		t.Fatalf("unexpected fire time %s", now)
+	}
+	if v := <-fired; v != 1 {
+		t.Fatalf("expected the first timer to fire, got %d", v)
+	}
+	if n := clock.Timers(); n != 1 {
+		t.Fatalf("expected 1 active timer, got %d", n)
+	}
+
+	clock.Advance(time.Second)
+	if v := <-fired; v != 3 {
+		t.Fatalf("expected the third timer to fire, got %d", v)
+	}
+	if now := clock.Now(); !now.Equal(start.Add(3 * time.Second)) {
+		t.Fatalf("unexpected clock time %s", now)
+	}
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	done := make(chan struct{})
+
+	go func() {
+		<-clock.NewTimer(time.Minute).C()
+		close(done)
+	}()
+
+	// wait for the goroutine to start its timer instead of sleeping
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-done
+}
+
+func TestSetClock(t *testing.T) {
+	MockMode = false
+	defer func() {
+		SetClock(nil)
+		MockMode = true
+	}()
+
+	clock := NewFakeClock(time.Unix(0, 0))
+	SetClock(clock)
+	if GetClock() != clock {
+		t.Fatal("expected the fake clock to be current")
+	}
+
+	done := make(chan struct{})
+	AfterFunc(time.Hour, func() { close(done) })
+	if !Now().Equal(time.Unix(0, 0)) {
+		t.Fatalf("unexpected current time %s", Now())
+	}
+
+	clock.Advance(time.Hour)
+	<-done
+
+	SetClock(nil)
+	if _, ok := GetClock().(FakeClock); ok {
+		t.Fatal("expected the real clock to be restored")
+	}
+}
@@ -0,0 +1,289 @@
+package timing
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWheelTick is the resolution of the timing wheel, timers fire at most one tick late.
+	DefaultWheelTick = 10 * time.Millisecond
+	// DefaultWheelSlots is the number of slots of each level of the timing wheel.
+	DefaultWheelSlots = 256
+	// DefaultWheelLevels is the number of levels of the timing wheel,
+	// with default tick and slots it spans more than a year.
+	DefaultWheelLevels = 4
+)
+
+// WheelConfig describes the hierarchical timing wheel.
+type WheelConfig struct {
+	// Tick is the resolution of timers, default is DefaultWheelTick.
+	// Durations are rounded up to the tick, so timers never fire early.
+	Tick time.Duration
+	// Slots is the number of slots of each level, default is DefaultWheelSlots.
+	Slots int
+	// Levels is the number of levels, each level spans Slots times more ticks than the previous one.
+	// Timers beyond the span of the wheel wait on the last level. Default is DefaultWheelLevels.
+	Levels int
+}
+
+// WheelClock is a Clock that schedules all its timers on the hierarchical timing wheel
+// driven by the single runtime ticker, instead of the runtime timer per timer.
+// It reduces timer pressure of the runtime when hundreds of thousands of timers are active,
+// like retransmission timers of transactions, for the cost of the tick resolution.
+// Callbacks of AfterFunc run in own goroutines like time.AfterFunc does.
+type WheelClock interface {
+	Clock
+	// Stop stops the ticker of the wheel, active timers never fire.
+	Stop()
+}
+
+type wheelClock struct {
+	tick   time.Duration
+	slots  uint64
+	levels int
+	start  time.Time
+	// spans are numbers of ticks covered by slots of each level
+	spans []uint64
+
+	mu sync.Mutex
+	// ticks is the number of processed ticks since the start
+	ticks   uint64
+	wheel   [][]wheelList
+	stop    chan struct{}
+	stopped bool
+}
+
+// wheelList is the doubly linked list of timers of the slot.
+type wheelList struct {
+	head *wheelTimer
+}
+
+// NewWheelClock creates Clock with the hierarchical timing wheel and starts its ticker.
+func NewWheelClock(config WheelConfig) WheelClock {
+	if config.Tick <= 0 {
+		config.Tick = DefaultWheelTick
+	}
+	if config.Slots <= 1 {
+		config.Slots = DefaultWheelSlots
+	}
+	if config.Levels <= 0 {
+		config.Levels = DefaultWheelLevels
+	}
+
+	c := &wheelClock{
+		tick:   config.Tick,
+		slots:  uint64(config.Slots),
+		levels: config.Levels,
+		start:  time.Now(),
+		spans:  make([]uint64, config.Levels+1),
+		wheel:  make([][]wheelList, config.Levels),
+		stop:   make(chan struct{}),
+	}
+	span := uint64(1)
+	for level := 0; level <= config.Levels; level++ {
+		c.spans[level] = span
+		if span > ^uint64(0)/c.slots {
+			span = ^uint64(0)
+		} else {
+			span *= c.slots
+		}
+	}
+	for level := range c.wheel {
+		c.wheel[level] = make([]wheelList, config.Slots)
+	}
+
+	go c.run()
+
+	return c
+}
+
+func (c *wheelClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *wheelClock) NewTimer(d time.Duration) Timer {
+	t := &wheelTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+
+	return t
+}
+
+func (c *wheelClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &wheelTimer{clock: c, c: make(chan time.Time, 1), fn: f}
+	t.Reset(d)
+
+	return t
+}
+
+func (c *wheelClock) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.stopped {
+		c.stopped = true
+		close(c.stop)
+	}
+}
+
+func (c *wheelClock) run() {
+	ticker := time.NewTicker(c.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			c.advance(uint64(now.Sub(c.start) / c.tick))
+		}
+	}
+}
+
+// advance processes ticks up to 'to', the ticker can lag behind under load.
+func (c *wheelClock) advance(to uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.ticks < to {
+		c.ticks++
+		// cascade timers of upper levels whose slot has come up to lower levels
+		for level := 1; level < c.levels && c.ticks%c.spans[level] == 0; level++ {
+			list := &c.wheel[level][(c.ticks/c.spans[level])%c.slots]
+			for t := list.head; t != nil; {
+				next := t.next
+				c.remove(t)
+				c.insert(t)
+				t = next
+			}
+		}
+
+		list := &c.wheel[0][c.ticks%c.slots]
+		for t := list.head; t != nil; {
+			next := t.next
+			c.remove(t)
+			if t.expires <= c.ticks {
+				c.fire(t)
+			} else {
+				// the timer of the next round
+				c.insert(t)
+			}
+			t = next
+		}
+	}
+}
+
+// insert puts the timer to the slot of its expiry tick, must be called with locked clock.
+func (c *wheelClock) insert(t *wheelTimer) {
+	delta := t.expires - c.ticks
+	level := 0
+	for level < c.levels-1 && delta >= c.spans[level+1] {
+		level++
+	}
+	expires := t.expires
+	if delta >= c.spans[c.levels] {
+		// beyond the span of the wheel, wait in the farthest slot
+		expires = c.ticks + c.spans[c.levels] - c.spans[level]
+	}
+
+	list := &c.wheel[level][(expires/c.spans[level])%c.slots]
+	t.list = list
+	t.prev = nil
+	t.next = list.head
+	if list.head != nil {
+		list.head.prev = t
+	}
+	list.head = t
+}
+
+// remove takes the timer out of its slot, must be called with locked clock.
+func (c *wheelClock) remove(t *wheelTimer) bool {
+	if t.list == nil {
+		return false
+	}
+
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		t.list.head = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.list, t.prev, t.next = nil, nil, nil
+
+	return true
+}
+
+// fire must be called with locked clock.
+func (c *wheelClock) fire(t *wheelTimer) {
+	if t.fn != nil {
+		go t.fn()
+		return
+	}
+
+	// Clear the channel if something is already in it.
+	select {
+	case <-t.c:
+	default:
+	}
+
+	t.c <- c.start.Add(time.Duration(c.ticks) * c.tick)
+}
+
+// Implementation of Timer scheduled on the timing wheel.
+type wheelTimer struct {
+	clock   *wheelClock
+	expires uint64
+	c       chan time.Time
+	fn      func()
+
+	list       *wheelList
+	prev, next *wheelTimer
+}
+
+func (t *wheelTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *wheelTimer) Reset(d time.Duration) bool {
+	c := t.clock
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wasActive := c.remove(t)
+
+	// round up to the tick, the current tick is already processed
+	elapsed := time.Since(c.start)
+	ticks := uint64((elapsed + d + c.tick - 1) / c.tick)
+	if d <= 0 {
+		ticks = 0
+	}
+	if ticks <= c.ticks {
+		ticks = c.ticks + 1
+	}
+	t.expires = ticks
+	c.insert(t)
+
+	return wasActive
+}
+
+func (t *wheelTimer) Stop() bool {
+	c := t.clock
+
+	c.mu.Lock()
+	removed := c.remove(t)
+	c.mu.Unlock()
+
+	if !removed {
+		select {
+		case <-t.c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	return true
+}
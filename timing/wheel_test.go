@@ -0,0 +1,134 @@
+package timing
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestWheel creates the wheel with the long tick, so ticks are advanced by the test only.
+func newTestWheel(slots, levels int) *wheelClock {
+	return NewWheelClock(WheelConfig{Tick: time.Hour, Slots: slots, Levels: levels}).(*wheelClock)
+}
+
+func TestWheelClockFiresOnTime(t *testing.T) {
+	c := newTestWheel(4, 2)
+	defer c.Stop()
+
+	// the wheel spans 16 ticks, the last timers wait on the upper level and beyond the span
+	durations := []uint64{1, 3, 4, 5, 15, 17, 40}
+	timers := make([]Timer, len(durations))
+	for i, d := range durations {
+		timers[i] = c.NewTimer(time.Duration(d) * c.tick)
+	}
+
+	fired := make([]uint64, len(durations))
+	for tick := uint64(1); tick <= 45; tick++ {
+		c.advance(tick)
+		for i, timer := range timers {
+			select {
+			case <-timer.C():
+				if fired[i] != 0 {
+					t.Fatalf("timer %d fired twice", i)
+				}
+				fired[i] = tick
+			default:
+			}
+		}
+	}
+
+	for i, d := range durations {
+		// the duration is rounded up to the tick after the current time
+		if fired[i] < d || fired[i] > d+1 {
+			t.Errorf("timer of %d ticks fired at tick %d", d, fired[i])
+		}
+	}
+}
+
+func TestWheelClockStopAndReset(t *testing.T) {
+	c := newTestWheel(4, 2)
+	defer c.Stop()
+
+	stopped := c.NewTimer(2 * c.tick)
+	reset := c.NewTimer(2 * c.tick)
+	if !stopped.Stop() {
+		t.Fatal("active timer should be stopped")
+	}
+	if !reset.Reset(10 * c.tick) {
+		t.Fatal("active timer should be reset")
+	}
+
+	c.advance(5)
+	select {
+	case <-stopped.C():
+		t.Fatal("stopped timer fired")
+	case <-reset.C():
+		t.Fatal("reset timer fired before the new duration")
+	default:
+	}
+
+	c.advance(11)
+	select {
+	case <-reset.C():
+	default:
+		t.Fatal("reset timer did not fire")
+	}
+	if stopped.Stop() {
+		t.Fatal("stopped timer should not be active")
+	}
+}
+
+func TestWheelClockAfterFunc(t *testing.T) {
+	c := NewWheelClock(WheelConfig{Tick: time.Millisecond})
+	defer c.Stop()
+
+	start := time.Now()
+	done := make(chan time.Time)
+	c.AfterFunc(20*time.Millisecond, func() {
+		done <- time.Now()
+	})
+
+	select {
+	case firedAt := <-done:
+		if elapsed := firedAt.Sub(start); elapsed < 20*time.Millisecond {
+			t.Fatalf("timer fired early after %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire")
+	}
+}
+
+// BenchmarkAfterFunc measures start and stop of the timer, like retransmission timers of transactions,
+// while many other timers are active.
+func BenchmarkAfterFunc(b *testing.B) {
+	const active = 100000
+
+	run := func(b *testing.B, clock Clock) {
+		timers := make([]Timer, active)
+		for i := range timers {
+			timers[i] = clock.AfterFunc(time.Minute+time.Duration(i)*time.Millisecond, func() {})
+		}
+		defer func() {
+			for _, timer := range timers {
+				timer.Stop()
+			}
+		}()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				clock.AfterFunc(500*time.Millisecond, func() {}).Stop()
+			}
+		})
+	}
+
+	b.Run("Runtime", func(b *testing.B) {
+		run(b, NewRealClock())
+	})
+	b.Run("Wheel", func(b *testing.B) {
+		c := NewWheelClock(WheelConfig{})
+		defer c.Stop()
+
+		run(b, c)
+	})
+}
@@ -0,0 +1,544 @@
+// topohide package hides internal topology of SBC-like deployments - RFC 5853 3.1.
+// Internal Via hops, Record-Route entries and Contact URIs of messages sent to untrusted peers
+// are replaced by opaque encrypted tokens, the tokens are restored in messages received back,
+// so peers never see internal addresses while the hiding stays stateless.
+package topohide
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// DefaultParam is a name of the URI and Via param with the token.
+const DefaultParam = "th"
+
+// ErrInvalidToken is returned by Restore on the token that was not issued by the Hider or was tampered.
+var ErrInvalidToken = errors.New("invalid topology hiding token")
+
+// Config describes topology hiding options.
+type Config struct {
+	// Key is an AES key of the tokens, 16, 24 or 32 bytes.
+	// All instances serving the same peers must share the key.
+	Key []byte
+	// Host is the public address inserted instead of internal addresses, like sbc.example.com:5060.
+	Host string
+	// Trusted lists internal networks in CIDR notation or single IP addresses.
+	// Messages sent to them are not modified, their addresses are hidden in messages sent to other destinations.
+	Trusted []string
+	// Param is a name of the URI and Via param with the token, default is DefaultParam.
+	Param string
+}
+
+// Hider hides internal topology of messages sent to untrusted peers.
+type Hider interface {
+	// Hide replaces internal Via hops, Record-Route entries and Contact URIs of the message with tokens.
+	Hide(msg sip.Message) error
+	// Restore restores topology hidden by Hide in the message received from the peer:
+	// Via hops of responses, Request-URI and Route entries of requests.
+	// Messages without tokens are not modified.
+	Restore(msg sip.Message) error
+	// TransportLayerFactory wraps the factory, default is transport.NewLayer:
+	// messages sent to untrusted destinations are hidden, received messages are restored
+	// and dropped if they carry invalid tokens.
+	TransportLayerFactory(factory gosip.TransportLayerFactory) gosip.TransportLayerFactory
+}
+
+type hider struct {
+	aead    cipher.AEAD
+	host    string
+	port    *sip.Port
+	trusted []*net.IPNet
+	param   string
+
+	log log.Logger
+}
+
+// NewHider creates topology hider.
+func NewHider(config Config, logger log.Logger) (Hider, error) {
+	block, err := aes.NewCipher(config.Key)
+	if err != nil {
+		return nil, fmt.Errorf("create token cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("create token cipher: %w", err)
+	}
+
+	host, port, err := parser.ParseHostPort(config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("parse public host %q: %w", config.Host, err)
+	}
+
+	trusted := make([]*net.IPNet, 0, len(config.Trusted))
+	for _, value := range config.Trusted {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted IP address %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted network %q: %w", value, err)
+		}
+		trusted = append(trusted, network)
+	}
+
+	if config.Param == "" {
+		config.Param = DefaultParam
+	}
+
+	h := &hider{
+		aead:    aead,
+		host:    host,
+		port:    port,
+		trusted: trusted,
+		param:   config.Param,
+	}
+	h.log = logger.WithPrefix("topohide.Hider")
+
+	return h, nil
+}
+
+func (h *hider) Log() log.Logger {
+	return h.log
+}
+
+// token is an encrypted payload of the hidden topology.
+type token struct {
+	// Kind prevents use of the token in another place.
+	Kind   string   `json:"k"`
+	Values []string `json:"v"`
+	// Reversed marks Record-Route hidden in the response, UAC reverses it into the route set.
+	Reversed bool `json:"r,omitempty"`
+}
+
+const (
+	kindVia    = "via"
+	kindRoute  = "route"
+	kindTarget = "target"
+)
+
+func (h *hider) seal(tok token) (string, error) {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, h.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(h.aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+func (h *hider) open(value sip.MaybeString, kind string) (token, error) {
+	var tok token
+	if value == nil {
+		return tok, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value.String())
+	if err != nil || len(data) < h.aead.NonceSize() {
+		return tok, ErrInvalidToken
+	}
+	nonce, data := data[:h.aead.NonceSize()], data[h.aead.NonceSize():]
+	data, err = h.aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return tok, ErrInvalidToken
+	}
+	if err := json.Unmarshal(data, &tok); err != nil || tok.Kind != kind {
+		return tok, ErrInvalidToken
+	}
+
+	return tok, nil
+}
+
+// isTrusted checks the host, domain names are never trusted.
+func (h *hider) isTrusted(host string) bool {
+	if v, _, err := net.SplitHostPort(host); err == nil {
+		host = v
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return false
+	}
+	for _, network := range h.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// publicUri builds the URI of the public host with the token.
+func (h *hider) publicUri(tok string) *sip.SipUri {
+	uri := &sip.SipUri{
+		FHost:      h.host,
+		FUriParams: sip.NewParams(),
+		FHeaders:   sip.NewParams(),
+	}
+	if h.port != nil {
+		port := *h.port
+		uri.FPort = &port
+	}
+	uri.FUriParams.Add(h.param, sip.String{Str: tok})
+
+	return uri
+}
+
+func (h *hider) Hide(msg sip.Message) error {
+	if req, ok := msg.(sip.Request); ok {
+		if err := h.hideVia(req); err != nil {
+			return err
+		}
+	}
+	if err := h.hideRecordRoute(msg); err != nil {
+		return err
+	}
+
+	return h.hideContact(msg)
+}
+
+// hideVia hides all hops below the top one into the param of the top hop.
+func (h *hider) hideVia(req sip.Request) error {
+	var hops []*sip.ViaHop
+	for _, hdr := range req.GetHeaders("Via") {
+		if via, ok := hdr.(sip.ViaHeader); ok {
+			hops = append(hops, via...)
+		}
+	}
+	if len(hops) < 2 {
+		return nil
+	}
+
+	values := make([]string, 0, len(hops)-1)
+	for _, hop := range hops[1:] {
+		values = append(values, hop.String())
+	}
+	tok, err := h.seal(token{Kind: kindVia, Values: values})
+	if err != nil {
+		return fmt.Errorf("hide Via: %w", err)
+	}
+
+	top := hops[0].Clone()
+	if top.Params == nil {
+		top.Params = sip.NewParams()
+	}
+	top.Params.Add(h.param, sip.String{Str: tok})
+	req.ReplaceHeaders("Via", []sip.Header{sip.ViaHeader{top}})
+
+	return nil
+}
+
+// hideRecordRoute replaces each run of internal entries with the single entry of the public host.
+func (h *hider) hideRecordRoute(msg sip.Message) error {
+	var addrs []sip.Uri
+	for _, hdr := range msg.GetHeaders("Record-Route") {
+		if rr, ok := hdr.(*sip.RecordRouteHeader); ok {
+			addrs = append(addrs, rr.Addresses...)
+		}
+	}
+
+	_, reversed := msg.(sip.Response)
+	hidden := make([]sip.Uri, 0, len(addrs))
+	found := false
+	var run []string
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		tok, err := h.seal(token{Kind: kindRoute, Values: run, Reversed: reversed})
+		if err != nil {
+			return fmt.Errorf("hide Record-Route: %w", err)
+		}
+		uri := h.publicUri(tok)
+		uri.FUriParams.Add("lr", nil)
+		hidden = append(hidden, uri)
+		run = nil
+
+		return nil
+	}
+	for _, addr := range addrs {
+		if h.isTrusted(addr.Host()) {
+			run = append(run, addr.String())
+			found = true
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		hidden = append(hidden, addr)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+
+	msg.ReplaceHeaders("Record-Route", []sip.Header{&sip.RecordRouteHeader{Addresses: hidden}})
+
+	return nil
+}
+
+// hideContact replaces internal Contact URIs with URIs of the public host, header params are kept.
+func (h *hider) hideContact(msg sip.Message) error {
+	for _, hdr := range msg.GetHeaders("Contact") {
+		contact, ok := hdr.(*sip.ContactHeader)
+		if !ok || contact.Address == nil || contact.Address.IsWildcard() || !h.isTrusted(contact.Address.Host()) {
+			continue
+		}
+
+		tok, err := h.seal(token{Kind: kindTarget, Values: []string{contact.Address.String()}})
+		if err != nil {
+			return fmt.Errorf("hide Contact: %w", err)
+		}
+		uri := h.publicUri(tok)
+		uri.FIsEncrypted = contact.Address.IsEncrypted()
+		if params := contact.Address.UriParams(); params != nil {
+			if tp, ok := params.Get("transport"); ok {
+				uri.FUriParams.Add("transport", tp)
+			}
+		}
+		contact.Address = uri
+	}
+
+	return nil
+}
+
+func (h *hider) Restore(msg sip.Message) error {
+	switch msg := msg.(type) {
+	case sip.Response:
+		return h.restoreVia(msg)
+	case sip.Request:
+		if err := h.restoreTarget(msg); err != nil {
+			return err
+		}
+		return h.restoreRoute(msg)
+	}
+
+	return nil
+}
+
+func (h *hider) restoreVia(res sip.Response) error {
+	hop, ok := res.ViaHop()
+	if !ok || hop.Params == nil {
+		return nil
+	}
+	value, ok := hop.Params.Get(h.param)
+	if !ok {
+		return nil
+	}
+
+	tok, err := h.open(value, kindVia)
+	if err != nil {
+		return fmt.Errorf("restore Via: %w", err)
+	}
+	hdrs, err := parser.ParseHeader("Via: " + strings.Join(tok.Values, ", "))
+	if err != nil {
+		return fmt.Errorf("restore Via: %w", err)
+	}
+
+	top := hop.Clone()
+	top.Params.Remove(h.param)
+	restored := sip.ViaHeader{top}
+	for _, hdr := range hdrs {
+		if via, ok := hdr.(sip.ViaHeader); ok {
+			restored = append(restored, via...)
+		}
+	}
+	res.ReplaceHeaders("Via", []sip.Header{restored})
+
+	return nil
+}
+
+func (h *hider) restoreTarget(req sip.Request) error {
+	recipient := req.Recipient()
+	if recipient == nil || recipient.UriParams() == nil {
+		return nil
+	}
+	value, ok := recipient.UriParams().Get(h.param)
+	if !ok {
+		return nil
+	}
+
+	tok, err := h.open(value, kindTarget)
+	if err != nil || len(tok.Values) != 1 {
+		return fmt.Errorf("restore Request-URI: %w", ErrInvalidToken)
+	}
+	uri, err := parser.ParseUri(tok.Values[0])
+	if err != nil {
+		return fmt.Errorf("restore Request-URI: %w", err)
+	}
+	req.SetRecipient(uri)
+
+	return nil
+}
+
+func (h *hider) restoreRoute(req sip.Request) error {
+	var addrs []sip.Uri
+	for _, hdr := range req.GetHeaders("Route") {
+		if route, ok := hdr.(*sip.RouteHeader); ok {
+			addrs = append(addrs, route.Addresses...)
+		}
+	}
+
+	restored := make([]sip.Uri, 0, len(addrs))
+	found := false
+	for _, addr := range addrs {
+		var value sip.MaybeString
+		if params := addr.UriParams(); params != nil {
+			value, _ = params.Get(h.param)
+		}
+		if value == nil {
+			restored = append(restored, addr)
+			continue
+		}
+
+		tok, err := h.open(value, kindRoute)
+		if err != nil {
+			return fmt.Errorf("restore Route: %w", err)
+		}
+		uris := make([]sip.Uri, 0, len(tok.Values))
+		for _, value := range tok.Values {
+			uri, err := parser.ParseUri(value)
+			if err != nil {
+				return fmt.Errorf("restore Route: %w", err)
+			}
+			uris = append(uris, uri)
+		}
+		if tok.Reversed {
+			for i, j := 0, len(uris)-1; i < j; i, j = i+1, j-1 {
+				uris[i], uris[j] = uris[j], uris[i]
+			}
+		}
+		restored = append(restored, uris...)
+		found = true
+	}
+	if !found {
+		return nil
+	}
+
+	req.ReplaceHeaders("Route", []sip.Header{&sip.RouteHeader{Addresses: restored}})
+
+	return nil
+}
+
+// nextHop returns the host the message is sent to.
+func nextHop(msg sip.Message) string {
+	if dest := msg.Destination(); dest != "" {
+		return dest
+	}
+
+	switch msg := msg.(type) {
+	case sip.Request:
+		for _, hdr := range msg.GetHeaders("Route") {
+			if route, ok := hdr.(*sip.RouteHeader); ok && len(route.Addresses) > 0 {
+				return route.Addresses[0].Host()
+			}
+		}
+		if recipient := msg.Recipient(); recipient != nil {
+			return recipient.Host()
+		}
+	case sip.Response:
+		if hop, ok := msg.ViaHop(); ok {
+			if hop.Params != nil {
+				if received, ok := hop.Params.Get("received"); ok && received != nil {
+					return received.String()
+				}
+			}
+			return hop.Host
+		}
+	}
+
+	return ""
+}
+
+func (h *hider) TransportLayerFactory(factory gosip.TransportLayerFactory) gosip.TransportLayerFactory {
+	if factory == nil {
+		factory = transport.NewLayer
+	}
+
+	return func(
+		ip net.IP,
+		dnsResolver *net.Resolver,
+		msgMapper sip.MessageMapper,
+		logger log.Logger,
+		options ...transport.LayerOption,
+	) transport.Layer {
+		restore := func(msg sip.Message) sip.Message {
+			if err := h.Restore(msg); err != nil {
+				h.Log().WithFields(msg.Fields()).Warnf("drop message from %s: %s", msg.Source(), err)
+				return nil
+			}
+			if msgMapper != nil {
+				return msgMapper(msg)
+			}
+			return msg
+		}
+
+		return &hidingLayer{
+			Layer: factory(ip, dnsResolver, restore, logger, options...),
+			h:     h,
+		}
+	}
+}
+
+// hidingLayer hides messages sent to untrusted destinations.
+type hidingLayer struct {
+	transport.Layer
+	h *hider
+}
+
+func (tpl *hidingLayer) Send(msg sip.Message) error {
+	return tpl.SendContext(context.Background(), msg)
+}
+
+func (tpl *hidingLayer) SendContext(ctx context.Context, msg sip.Message) error {
+	if tpl.h.isTrusted(nextHop(msg)) {
+		return tpl.Layer.SendContext(ctx, msg)
+	}
+
+	// the origin is kept intact for transactions
+	var hidden sip.Message
+	switch msg := msg.(type) {
+	case sip.Request:
+		hidden = sip.CopyRequest(msg)
+	case sip.Response:
+		hidden = sip.CopyResponse(msg)
+	default:
+		return tpl.Layer.SendContext(ctx, msg)
+	}
+	if err := tpl.h.Hide(hidden); err != nil {
+		return err
+	}
+	err := tpl.Layer.SendContext(ctx, hidden)
+	msg.SetDestination(hidden.Destination())
+
+	return err
+}
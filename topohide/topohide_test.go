@@ -0,0 +1,192 @@
+package topohide_test
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/topohide"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+var _ = Describe("Hider", func() {
+	var (
+		hider  topohide.Hider
+		invite sip.Request
+	)
+
+	BeforeEach(func() {
+		var err error
+		hider, err = topohide.NewHider(topohide.Config{
+			Key:     []byte("0123456789abcdef"),
+			Host:    "sbc.example.com:5060",
+			Trusted: []string{"10.0.0.0/24", "192.168.1.1"},
+		}, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP sbc.example.com:5060;branch=z9hG4bK-sbc",
+			"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK-proxy,SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK-alice",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: topohide-call-id",
+			"CSeq: 1 INVITE",
+			"Contact: <sip:alice@10.0.0.1:5060;transport=udp>;expires=60",
+			"Record-Route: <sip:10.0.0.2;lr>, <sip:192.168.1.1;lr>",
+			"Record-Route: <sip:proxy.example.org;lr>",
+			"",
+			"",
+		})
+	})
+
+	It("should fail on invalid config", func() {
+		_, err := topohide.NewHider(topohide.Config{
+			Key:  []byte("short"),
+			Host: "sbc.example.com",
+		}, testutils.NewLogrusLogger())
+		Expect(err).To(HaveOccurred())
+
+		_, err = topohide.NewHider(topohide.Config{
+			Key:     []byte("0123456789abcdef"),
+			Host:    "sbc.example.com",
+			Trusted: []string{"10.0.0.0/33"},
+		}, testutils.NewLogrusLogger())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should hide internal topology of the request", func() {
+		Expect(hider.Hide(invite)).To(Succeed())
+
+		vias := invite.GetHeaders("Via")
+		Expect(vias).To(HaveLen(1))
+		Expect(vias[0].(sip.ViaHeader)).To(HaveLen(1))
+		hop, _ := invite.ViaHop()
+		Expect(hop.Host).To(Equal("sbc.example.com"))
+		Expect(hop.Params.Has("th")).To(BeTrue())
+		Expect(invite.String()).ToNot(ContainSubstring("10.0.0."))
+		Expect(invite.String()).ToNot(ContainSubstring("192.168.1.1"))
+
+		rr := invite.GetHeaders("Record-Route")
+		Expect(rr).To(HaveLen(1))
+		addrs := rr[0].(*sip.RecordRouteHeader).Addresses
+		Expect(addrs).To(HaveLen(2))
+		Expect(addrs[0].Host()).To(Equal("sbc.example.com"))
+		Expect(addrs[0].UriParams().Has("lr")).To(BeTrue())
+		Expect(addrs[1].String()).To(Equal("sip:proxy.example.org;lr"))
+
+		contact, ok := invite.Contact()
+		Expect(ok).To(BeTrue())
+		Expect(contact.Address.Host()).To(Equal("sbc.example.com"))
+		Expect(contact.Address.UriParams().Has("transport")).To(BeTrue())
+		Expect(contact.Params.Has("expires")).To(BeTrue())
+	})
+
+	It("should restore hidden topology in messages from the peer", func() {
+		Expect(hider.Hide(invite)).To(Succeed())
+
+		res := sip.NewResponseFromRequest("", invite, 200, "OK", "")
+		Expect(hider.Restore(res)).To(Succeed())
+		var hops []string
+		for _, hdr := range res.GetHeaders("Via") {
+			for _, hop := range hdr.(sip.ViaHeader) {
+				hops = append(hops, hop.String())
+			}
+		}
+		Expect(hops).To(Equal([]string{
+			"SIP/2.0/UDP sbc.example.com:5060;branch=z9hG4bK-sbc",
+			"SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bK-proxy",
+			"SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK-alice",
+		}))
+
+		// the peer sends in-dialog request to the hidden Contact through the hidden route set
+		contact, _ := invite.Contact()
+		rr := invite.GetHeaders("Record-Route")[0].(*sip.RecordRouteHeader)
+		route := &sip.RouteHeader{Addresses: []sip.Uri{rr.Addresses[1], rr.Addresses[0]}}
+		bye := sip.NewRequest(
+			"",
+			sip.BYE,
+			contact.Address.Clone(),
+			"SIP/2.0",
+			[]sip.Header{route},
+			"",
+			nil,
+		)
+		Expect(hider.Restore(bye)).To(Succeed())
+		Expect(bye.Recipient().String()).To(Equal("sip:alice@10.0.0.1:5060;transport=udp"))
+		var routes []string
+		for _, hdr := range bye.GetHeaders("Route") {
+			for _, addr := range hdr.(*sip.RouteHeader).Addresses {
+				routes = append(routes, addr.String())
+			}
+		}
+		Expect(routes).To(Equal([]string{
+			"sip:proxy.example.org;lr",
+			"sip:10.0.0.2;lr",
+			"sip:192.168.1.1;lr",
+		}))
+	})
+
+	It("should reject tampered tokens", func() {
+		Expect(hider.Hide(invite)).To(Succeed())
+
+		res := sip.NewResponseFromRequest("", invite, 200, "OK", "")
+		hop, _ := res.ViaHop()
+		value, _ := hop.Params.Get("th")
+		hop.Params.Add("th", sip.String{Str: strings.ToUpper(value.String())})
+		Expect(errors.Is(hider.Restore(res), topohide.ErrInvalidToken)).To(BeTrue())
+	})
+
+	Context("transport layer", func() {
+		var (
+			tpl  *testutils.MockTransportLayer
+			hide transport.Layer
+		)
+
+		BeforeEach(func() {
+			tpl = testutils.NewMockTransportLayer()
+			factory := hider.TransportLayerFactory(func(
+				ip net.IP,
+				dnsResolver *net.Resolver,
+				msgMapper sip.MessageMapper,
+				logger log.Logger,
+				options ...transport.LayerOption,
+			) transport.Layer {
+				return tpl
+			})
+			hide = factory(nil, nil, nil, testutils.NewLogrusLogger())
+		})
+
+		AfterEach(func() {
+			tpl.Cancel()
+		})
+
+		It("should send messages to trusted destinations as is", func() {
+			invite.SetDestination("10.0.0.3:5060")
+			go func() {
+				defer GinkgoRecover()
+				Expect(hide.Send(invite)).To(Succeed())
+			}()
+			Expect(<-tpl.OutMsgs).To(BeIdenticalTo(invite))
+		})
+
+		It("should send hidden copies to untrusted destinations", func() {
+			origin := invite.String()
+			invite.SetDestination("203.0.113.5:5060")
+			go func() {
+				defer GinkgoRecover()
+				Expect(hide.Send(invite)).To(Succeed())
+			}()
+			msg := <-tpl.OutMsgs
+			Expect(msg).ToNot(BeIdenticalTo(invite))
+			Expect(msg.String()).ToNot(ContainSubstring("10.0.0."))
+			Expect(invite.String()).To(Equal(origin))
+		})
+	})
+})
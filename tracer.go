@@ -0,0 +1,20 @@
+package gosip
+
+import (
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// Tracer traces processing of messages by the server: transport receive and parse, transaction,
+// TU handling and send, tracing package implements it with OpenTelemetry.
+// Stages of the same transaction are correlated by the tracer, returned functions end the stage.
+type Tracer interface {
+	// Receive is called when the incoming message is received and parsed by the transport layer.
+	Receive(msg sip.Message)
+	// StartTransaction is called when the transaction of the request is created,
+	// returned function is called when the transaction is terminated.
+	StartTransaction(req sip.Request, client bool) func()
+	// StartHandler is called before the TU handler of the request, returned function is called when the handler returns.
+	StartHandler(req sip.Request) func()
+	// StartSend is called before the message is sent, trace context is propagated in the outgoing requests.
+	StartSend(msg sip.Message) func(err error)
+}
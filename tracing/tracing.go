@@ -0,0 +1,356 @@
+// tracing package traces processing of SIP messages with OpenTelemetry.
+// Tracer implements gosip.Tracer, so it is passed to gosip.ServerConfig.
+package tracing
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
+)
+
+const (
+	// DefaultHeader carries W3C traceparent in SIP messages.
+	DefaultHeader = "Traceparent"
+	// DefaultStateHeader carries W3C tracestate in SIP messages.
+	DefaultStateHeader = "Tracestate"
+	// DefaultOrphanTimeout ends spans of requests that did not get transaction,
+	// like requests dropped by the transaction layer.
+	DefaultOrphanTimeout = transaction.Timer_B
+
+	instrumentationName = "github.com/ghettovoice/gosip"
+)
+
+// Span attributes.
+const (
+	MethodKey     = attribute.Key("sip.method")
+	CallIDKey     = attribute.Key("sip.call_id")
+	BranchKey     = attribute.Key("sip.branch")
+	StatusCodeKey = attribute.Key("sip.status_code")
+	TransportKey  = attribute.Key("sip.transport")
+)
+
+// Config describes tracing options.
+type Config struct {
+	// TracerProvider creates the tracer, default is the global provider.
+	TracerProvider trace.TracerProvider
+	// Header carries W3C traceparent of incoming and outgoing requests, default is DefaultHeader.
+	Header string
+	// StateHeader carries W3C tracestate of incoming and outgoing requests, default is DefaultStateHeader.
+	StateHeader string
+	// OrphanTimeout is a timeout of the transaction span of the received request without transaction,
+	// default is DefaultOrphanTimeout.
+	OrphanTimeout time.Duration
+}
+
+// Tracer starts spans of the server transaction on the received request with the remote parent
+// extracted from the Header, stages of the transaction are children spans:
+// receive of requests and responses, TU handling and send.
+// Client transaction spans are parented by the trace context of the request,
+// so proxied requests continue the trace of the incoming ones.
+// Span of the send stage is injected into the outgoing requests.
+type Tracer interface {
+	gosip.Tracer
+}
+
+type tracer struct {
+	tracer        trace.Tracer
+	propagator    propagation.TextMapPropagator
+	headers       map[string]string
+	orphanTimeout time.Duration
+
+	mu  sync.Mutex
+	txs map[string]*txSpan
+}
+
+type txSpan struct {
+	ctx   context.Context
+	span  trace.Span
+	timer timing.Timer
+}
+
+// NewTracer creates OpenTelemetry tracer of the server.
+func NewTracer(config Config) Tracer {
+	if config.TracerProvider == nil {
+		config.TracerProvider = otel.GetTracerProvider()
+	}
+	if config.Header == "" {
+		config.Header = DefaultHeader
+	}
+	if config.StateHeader == "" {
+		config.StateHeader = DefaultStateHeader
+	}
+	if config.OrphanTimeout <= 0 {
+		config.OrphanTimeout = DefaultOrphanTimeout
+	}
+
+	return &tracer{
+		tracer:     config.TracerProvider.Tracer(instrumentationName),
+		propagator: propagation.TraceContext{},
+		headers: map[string]string{
+			"traceparent": config.Header,
+			"tracestate":  config.StateHeader,
+		},
+		orphanTimeout: config.OrphanTimeout,
+		txs:           make(map[string]*txSpan),
+	}
+}
+
+func (t *tracer) Receive(msg sip.Message) {
+	switch msg := msg.(type) {
+	case sip.Request:
+		key := txKey(msg, false)
+		if ctx, ok := t.txContext(key); ok {
+			// retransmission or ACK on the non-2xx response
+			t.span(ctx, "SIP receive", msg, trace.SpanKindServer)
+			return
+		}
+
+		ctx := t.extract(msg)
+		if msg.IsAck() {
+			// ACK on 2xx has no transaction
+			t.span(ctx, "SIP receive", msg, trace.SpanKindServer)
+			return
+		}
+
+		ctx, span := t.tracer.Start(ctx, "SIP "+string(msg.Method()),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attributes(msg)...),
+		)
+		tx := &txSpan{ctx: ctx, span: span}
+		tx.timer = timing.AfterFunc(t.orphanTimeout, func() {
+			t.endTx(key, tx)
+		})
+
+		t.mu.Lock()
+		t.txs[key] = tx
+		t.mu.Unlock()
+
+		t.span(ctx, "SIP receive", msg, trace.SpanKindServer)
+	case sip.Response:
+		ctx, ok := t.txContext(txKey(msg, true))
+		if !ok {
+			return
+		}
+
+		trace.SpanFromContext(ctx).SetAttributes(StatusCodeKey.Int(int(msg.StatusCode())))
+		t.span(ctx, "SIP receive", msg, trace.SpanKindClient)
+	}
+}
+
+func (t *tracer) StartTransaction(req sip.Request, client bool) func() {
+	key := txKey(req, client)
+
+	t.mu.Lock()
+	tx, ok := t.txs[key]
+	t.mu.Unlock()
+
+	if ok && !client {
+		tx.timer.Stop()
+		return func() {
+			t.endTx(key, tx)
+		}
+	}
+
+	kind := trace.SpanKindServer
+	if client {
+		kind = trace.SpanKindClient
+	}
+	ctx, span := t.tracer.Start(t.extract(req), "SIP "+string(req.Method()),
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(attributes(req)...),
+	)
+	tx = &txSpan{ctx: ctx, span: span}
+
+	t.mu.Lock()
+	t.txs[key] = tx
+	t.mu.Unlock()
+
+	return func() {
+		t.endTx(key, tx)
+	}
+}
+
+func (t *tracer) StartHandler(req sip.Request) func() {
+	ctx, ok := t.txContext(txKey(req, false))
+	if !ok {
+		ctx = t.extract(req)
+	}
+
+	_, span := t.tracer.Start(ctx, "SIP handle "+string(req.Method()),
+		trace.WithAttributes(attributes(req)...),
+	)
+
+	return func() {
+		span.End()
+	}
+}
+
+func (t *tracer) StartSend(msg sip.Message) func(err error) {
+	var ctx context.Context
+	var kind trace.SpanKind
+	switch msg := msg.(type) {
+	case sip.Request:
+		var ok bool
+		if ctx, ok = t.txContext(txKey(msg, true)); !ok {
+			ctx = t.extract(msg)
+		}
+		kind = trace.SpanKindClient
+	case sip.Response:
+		var ok bool
+		if ctx, ok = t.txContext(txKey(msg, false)); ok {
+			trace.SpanFromContext(ctx).SetAttributes(StatusCodeKey.Int(int(msg.StatusCode())))
+		} else {
+			ctx = context.Background()
+		}
+		kind = trace.SpanKindServer
+	default:
+		ctx = context.Background()
+	}
+
+	ctx, span := t.tracer.Start(ctx, "SIP send",
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(attributes(msg)...),
+	)
+	if _, ok := msg.(sip.Request); ok {
+		t.propagator.Inject(ctx, &headerCarrier{msg: msg, headers: t.headers})
+	}
+
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// span records the instant stage of the transaction.
+func (t *tracer) span(ctx context.Context, name string, msg sip.Message, kind trace.SpanKind) {
+	_, span := t.tracer.Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(attributes(msg)...),
+	)
+	span.End()
+}
+
+func (t *tracer) txContext(key string) (context.Context, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx, ok := t.txs[key]
+	if !ok {
+		return nil, false
+	}
+
+	return tx.ctx, true
+}
+
+func (t *tracer) endTx(key string, tx *txSpan) {
+	t.mu.Lock()
+	if t.txs[key] == tx {
+		delete(t.txs, key)
+	}
+	t.mu.Unlock()
+
+	tx.span.End()
+}
+
+// extract returns context with the remote parent propagated in the message.
+func (t *tracer) extract(msg sip.Message) context.Context {
+	return t.propagator.Extract(context.Background(), &headerCarrier{msg: msg, headers: t.headers})
+}
+
+// txKey matches messages of the transaction, unlike transaction keys CANCEL has own span.
+func txKey(msg sip.Message, client bool) string {
+	var method sip.RequestMethod
+	if cseq, ok := msg.CSeq(); ok {
+		method = cseq.MethodName
+	}
+	if method == sip.ACK {
+		method = sip.INVITE
+	}
+
+	side := "server"
+	if client {
+		side = "client"
+	}
+
+	return strings.Join([]string{side, branch(msg), string(method)}, "__")
+}
+
+func branch(msg sip.Message) string {
+	if viaHop, ok := msg.ViaHop(); ok && viaHop.Params != nil {
+		if branch, ok := viaHop.Params.Get("branch"); ok && branch != nil {
+			return branch.String()
+		}
+	}
+
+	return ""
+}
+
+func attributes(msg sip.Message) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{BranchKey.String(branch(msg))}
+	if callID, ok := msg.CallID(); ok {
+		attrs = append(attrs, CallIDKey.String(callID.Value()))
+	}
+	if cseq, ok := msg.CSeq(); ok {
+		attrs = append(attrs, MethodKey.String(string(cseq.MethodName)))
+	}
+	if res, ok := msg.(sip.Response); ok {
+		attrs = append(attrs, StatusCodeKey.Int(int(res.StatusCode())))
+	}
+	if tp := msg.Transport(); tp != "" {
+		attrs = append(attrs, TransportKey.String(tp))
+	}
+
+	return attrs
+}
+
+// headerCarrier maps W3C trace context keys to SIP headers of the message.
+type headerCarrier struct {
+	msg     sip.Message
+	headers map[string]string
+}
+
+func (c *headerCarrier) Get(key string) string {
+	name, ok := c.headers[key]
+	if !ok {
+		return ""
+	}
+	if hdrs := c.msg.GetHeaders(name); len(hdrs) > 0 {
+		return hdrs[0].Value()
+	}
+
+	return ""
+}
+
+func (c *headerCarrier) Set(key, value string) {
+	name, ok := c.headers[key]
+	if !ok {
+		return
+	}
+
+	c.msg.RemoveHeader(name)
+	c.msg.AppendHeader(&sip.GenericHeader{HeaderName: name, Contents: value})
+}
+
+func (c *headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.headers))
+	for key := range c.headers {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
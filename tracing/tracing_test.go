@@ -0,0 +1,99 @@
+package tracing_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/tracing"
+)
+
+var _ = Describe("Tracer", func() {
+	var (
+		recorder *tracetest.SpanRecorder
+		tracer   tracing.Tracer
+	)
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+
+	request := func(extra ...string) sip.Request {
+		lines := []string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: tracing-call",
+			"CSeq: 1 INVITE",
+		}
+
+		return testutils.Request(append(append(lines, extra...), "", ""))
+	}
+
+	BeforeEach(func() {
+		recorder = tracetest.NewSpanRecorder()
+		tracer = tracing.NewTracer(tracing.Config{
+			TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+			Header:         "X-Trace-Context",
+		})
+	})
+
+	It("should trace the server transaction in the trace of the request", func() {
+		req := request("X-Trace-Context: 00-" + traceID + "-" + spanID + "-01")
+
+		tracer.Receive(req)
+		endTx := tracer.StartTransaction(req, false)
+		tracer.StartHandler(req)()
+		tracer.StartSend(sip.NewResponseFromRequest("", req, 486, "Busy Here", ""))(nil)
+		endTx()
+
+		spans := recorder.Ended()
+		Expect(spans).To(HaveLen(4))
+		names := make([]string, 0, len(spans))
+		for _, span := range spans {
+			Expect(span.SpanContext().TraceID().String()).To(Equal(traceID))
+			names = append(names, span.Name())
+		}
+		Expect(names).To(Equal([]string{"SIP receive", "SIP handle INVITE", "SIP send", "SIP INVITE"}))
+
+		txSpan := spans[3]
+		Expect(txSpan.SpanKind()).To(Equal(trace.SpanKindServer))
+		Expect(txSpan.Parent().SpanID().String()).To(Equal(spanID))
+		Expect(txSpan.Parent().IsRemote()).To(BeTrue())
+		Expect(txSpan.Attributes()).To(ContainElement(tracing.CallIDKey.String("tracing-call")))
+		Expect(txSpan.Attributes()).To(ContainElement(tracing.StatusCodeKey.Int(486)))
+		for _, span := range spans[:3] {
+			Expect(span.Parent().SpanID()).To(Equal(txSpan.SpanContext().SpanID()))
+		}
+	})
+
+	It("should propagate trace context of the client transaction", func() {
+		req := request()
+
+		endTx := tracer.StartTransaction(req, true)
+		tracer.StartSend(req)(errors.New("network unreachable"))
+		endTx()
+
+		spans := recorder.Ended()
+		Expect(spans).To(HaveLen(2))
+		send, tx := spans[0], spans[1]
+		Expect(tx.SpanKind()).To(Equal(trace.SpanKindClient))
+		Expect(tx.Parent().IsValid()).To(BeFalse())
+		Expect(send.Parent().SpanID()).To(Equal(tx.SpanContext().SpanID()))
+		Expect(send.Events()).To(HaveLen(1))
+
+		hdrs := req.GetHeaders("X-Trace-Context")
+		Expect(hdrs).To(HaveLen(1))
+		Expect(hdrs[0].Value()).To(Equal(
+			"00-" + send.SpanContext().TraceID().String() + "-" + send.SpanContext().SpanID().String() + "-01",
+		))
+	})
+})
@@ -1,12 +1,15 @@
 package transaction
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/discoviking/fsm"
 
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/timing"
@@ -27,15 +30,32 @@ type clientTx struct {
 	timer_d_time time.Duration // Current duration of timer D.
 	timer_d      timing.Timer
 	timer_m      timing.Timer
+	timer_c_time time.Duration
+	timer_c      timing.Timer
 	reliable     bool
+	// canceled is set when CANCEL is sent, timer B then waits for the final response to CANCEL
+	canceled bool
+	// sent identifies the request as it was sent, responses are verified with it
+	sent sentRequest
 
+	ctx       context.Context
 	mu        sync.RWMutex
 	closeOnce sync.Once
 }
 
-func NewClientTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (ClientTx, error) {
+func NewClientTx(origin sip.Request, tpl sip.Transport, logger log.Logger, options ...TxOption) (ClientTx, error) {
+	optsHash := TxOptions{
+		KeyMaker: MakeClientTxKey,
+		Timers:   DefaultTimers(),
+		Context:  context.Background(),
+		EventBus: eventbus.Default,
+	}
+	for _, opt := range options {
+		opt.ApplyTx(&optsHash)
+	}
+
 	origin = prepareClientRequest(origin)
-	key, err := MakeClientTxKey(origin)
+	key, err := optsHash.KeyMaker(origin)
 	if err != nil {
 		return nil, err
 	}
@@ -43,6 +63,10 @@ func NewClientTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (Clie
 	tx := new(clientTx)
 	tx.key = key
 	tx.tpl = tpl
+	tx.timers = optsHash.Timers
+	tx.clock = optsHash.Clock
+	tx.bus = optsHash.EventBus
+	tx.ctx = optsHash.Context
 	// buffer chan - about ~10 retransmit responses
 	tx.responses = make(chan sip.Response, 64)
 	tx.errs = make(chan error, 64)
@@ -60,6 +84,9 @@ func NewClientTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (Clie
 		"transaction_key": tx.key,
 	}).(sip.Request)
 	tx.reliable = tx.tpl.IsReliable(origin.Transport())
+	if origin.IsInvite() {
+		tx.timer_c_time = optsHash.TimerC
+	}
 
 	return tx, nil
 }
@@ -89,7 +116,7 @@ func prepareClientRequest(origin sip.Request) sip.Request {
 func (tx *clientTx) Init() error {
 	tx.initFSM()
 
-	if err := tx.tpl.Send(tx.Origin()); err != nil {
+	if err := sip.SendContext(tx.ctx, tx.tpl, tx.Origin()); err != nil {
 		tx.mu.Lock()
 		tx.lastErr = err
 		tx.mu.Unlock()
@@ -103,6 +130,12 @@ func (tx *clientTx) Init() error {
 		return err
 	}
 
+	// transport fills Via of the sent request, so it is captured before retransmissions
+	tx.mu.Lock()
+	tx.sent = newSentRequest(tx.Origin())
+	tx.mu.Unlock()
+	sip.CacheWire(tx.Origin())
+
 	if tx.reliable {
 		tx.mu.Lock()
 		tx.timer_d_time = 0
@@ -113,12 +146,12 @@ func (tx *clientTx) Init() error {
 		// If a reliable transport is being used, the client transaction SHOULD NOT
 		// start timer A (Timer A controls request retransmissions).
 		// Timer A - retransmission
-		tx.Log().Tracef("timer_a set to %v", Timer_A)
+		tx.Log().Tracef("timer_a set to %v", tx.timers.T1)
 
 		tx.mu.Lock()
-		tx.timer_a_time = Timer_A
+		tx.timer_a_time = tx.timers.T1
 
-		tx.timer_a = timing.AfterFunc(tx.timer_a_time, func() {
+		tx.timer_a = tx.afterFunc(tx.timer_a_time, func() {
 			select {
 			case <-tx.done:
 				return
@@ -139,10 +172,10 @@ func (tx *clientTx) Init() error {
 	}
 
 	// Timer B - timeout
-	tx.Log().Tracef("timer_b set to %v", Timer_B)
+	tx.Log().Tracef("timer_b set to %v", tx.timers.timeout())
 
 	tx.mu.Lock()
-	tx.timer_b = timing.AfterFunc(Timer_B, func() {
+	tx.timer_b = tx.afterFunc(tx.timers.timeout(), func() {
 		select {
 		case <-tx.done:
 			return
@@ -159,6 +192,33 @@ func (tx *clientTx) Init() error {
 	})
 	tx.mu.Unlock()
 
+	// Timer C - proxy INVITE timeout
+	tx.mu.Lock()
+	if tx.timer_c_time > 0 {
+		tx.Log().Tracef("timer_c set to %v", tx.timer_c_time)
+
+		tx.timer_c = tx.afterFunc(tx.timer_c_time, func() {
+			select {
+			case <-tx.done:
+				return
+			default:
+			}
+
+			tx.Log().Trace("timer_c fired")
+
+			tx.fsmMu.RLock()
+			if err := tx.fsm.Spin(client_input_timer_c); err != nil {
+				tx.Log().Errorf("spin FSM to client_input_timer_c failed: %s", err)
+			}
+			tx.fsmMu.RUnlock()
+		})
+	}
+	tx.mu.Unlock()
+
+	if tx.ctx.Done() != nil {
+		go tx.watchContext()
+	}
+
 	tx.mu.RLock()
 	err := tx.lastErr
 	tx.mu.RUnlock()
@@ -166,6 +226,40 @@ func (tx *clientTx) Init() error {
 	return err
 }
 
+// watchContext stops the transaction when its context is done.
+func (tx *clientTx) watchContext() {
+	select {
+	case <-tx.done:
+		return
+	case <-tx.ctx.Done():
+	}
+
+	tx.Log().Debugf("transaction context done: %s", tx.ctx.Err())
+
+	if tx.Origin().IsInvite() {
+		if err := tx.Cancel(); err != nil {
+			tx.Log().Debugf("cancel transaction failed: %s", err)
+		}
+
+		return
+	}
+
+	// non-INVITE transaction can not be canceled - RFC 3261 9.1
+	input := client_input_timer_b
+	if !errors.Is(tx.ctx.Err(), context.DeadlineExceeded) {
+		tx.mu.Lock()
+		tx.lastErr = tx.ctx.Err()
+		tx.mu.Unlock()
+		input = client_input_transport_err
+	}
+
+	tx.fsmMu.RLock()
+	if err := tx.fsm.Spin(input); err != nil {
+		tx.Log().Debugf("stop transaction failed: %s", err)
+	}
+	tx.fsmMu.RUnlock()
+}
+
 func (tx *clientTx) Receive(msg sip.Message) error {
 	res, ok := msg.(sip.Response)
 	if !ok {
@@ -203,6 +297,15 @@ func (tx *clientTx) Receive(msg sip.Message) error {
 	return tx.fsm.Spin(input)
 }
 
+// verifyResponse checks that the response matched by the key echoes the sent request.
+func (tx *clientTx) verifyResponse(res sip.Response) error {
+	tx.mu.RLock()
+	sent := tx.sent
+	tx.mu.RUnlock()
+
+	return sent.verify(res)
+}
+
 func (tx *clientTx) Responses() <-chan sip.Response {
 	return tx.responses
 }
@@ -229,9 +332,15 @@ func (tx *clientTx) cancel() {
 		return
 	}
 
-	tx.mu.RLock()
+	tx.mu.Lock()
 	lastResp := tx.lastResp
-	tx.mu.RUnlock()
+	tx.canceled = true
+	// the transaction waits for the final response to CANCEL by timer B, timer C would send CANCEL again
+	if tx.timer_c != nil {
+		tx.timer_c.Stop()
+		tx.timer_c = nil
+	}
+	tx.mu.Unlock()
 
 	cancelRequest := sip.NewCancelRequest("", tx.Origin(), log.Fields{
 		"sent_at": time.Now(),
@@ -309,6 +418,7 @@ const (
 	client_input_timer_b
 	client_input_timer_d
 	client_input_timer_m
+	client_input_timer_c
 	client_input_transport_err
 	client_input_delete
 	client_input_cancel
@@ -339,6 +449,7 @@ func (tx *clientTx) initInviteFSM() {
 			client_input_canceled:      {client_state_calling, tx.act_invite_canceled},
 			client_input_timer_a:       {client_state_calling, tx.act_invite_resend},
 			client_input_timer_b:       {client_state_terminated, tx.act_timeout},
+			client_input_timer_c:       {client_state_terminated, tx.act_timeout},
 			client_input_transport_err: {client_state_terminated, tx.act_trans_err},
 		},
 	}
@@ -347,13 +458,14 @@ func (tx *clientTx) initInviteFSM() {
 	client_state_def_proceeding := fsm.State{
 		Index: client_state_proceeding,
 		Outcomes: map[fsm.Input]fsm.Outcome{
-			client_input_1xx:           {client_state_proceeding, tx.act_passup},
+			client_input_1xx:           {client_state_proceeding, tx.act_invite_provisional},
 			client_input_2xx:           {client_state_accepted, tx.act_passup_accept},
 			client_input_300_plus:      {client_state_completed, tx.act_invite_final},
 			client_input_cancel:        {client_state_proceeding, tx.act_cancel_timeout},
 			client_input_canceled:      {client_state_proceeding, tx.act_invite_canceled},
 			client_input_timer_a:       {client_state_proceeding, fsm.NO_ACTION},
 			client_input_timer_b:       {client_state_terminated, tx.act_timeout},
+			client_input_timer_c:       {client_state_proceeding, tx.act_cancel_timeout},
 			client_input_transport_err: {client_state_terminated, tx.act_trans_err},
 		},
 	}
@@ -370,6 +482,7 @@ func (tx *clientTx) initInviteFSM() {
 			client_input_transport_err: {client_state_terminated, tx.act_trans_err},
 			client_input_timer_a:       {client_state_completed, fsm.NO_ACTION},
 			client_input_timer_b:       {client_state_completed, fsm.NO_ACTION},
+			client_input_timer_c:       {client_state_completed, fsm.NO_ACTION},
 			client_input_timer_d:       {client_state_terminated, tx.act_delete},
 		},
 	}
@@ -388,6 +501,7 @@ func (tx *clientTx) initInviteFSM() {
 			}},
 			client_input_timer_a: {client_state_accepted, fsm.NO_ACTION},
 			client_input_timer_b: {client_state_accepted, fsm.NO_ACTION},
+			client_input_timer_c: {client_state_accepted, fsm.NO_ACTION},
 			client_input_timer_m: {client_state_terminated, tx.act_delete},
 		},
 	}
@@ -403,6 +517,7 @@ func (tx *clientTx) initInviteFSM() {
 			client_input_canceled:      {client_state_terminated, fsm.NO_ACTION},
 			client_input_timer_a:       {client_state_terminated, fsm.NO_ACTION},
 			client_input_timer_b:       {client_state_terminated, fsm.NO_ACTION},
+			client_input_timer_c:       {client_state_terminated, fsm.NO_ACTION},
 			client_input_timer_d:       {client_state_terminated, fsm.NO_ACTION},
 			client_input_timer_m:       {client_state_terminated, fsm.NO_ACTION},
 			client_input_delete:        {client_state_terminated, tx.act_delete},
@@ -572,10 +687,15 @@ func (tx *clientTx) timeoutErr() {
 	defer func() { recover() }()
 
 	err := &TxTimeoutError{
-		fmt.Errorf("transaction timed out"),
+		&sip.TransactionTimeout{Key: tx.Key().String(), Method: tx.Origin().Method(), Client: true},
 		tx.Key(),
 		fmt.Sprintf("%p", tx),
 	}
+	tx.bus.Publish(&eventbus.TransactionTimeoutEvent{
+		Key:    tx.Key().String(),
+		Method: tx.Origin().Method(),
+		Client: true,
+	})
 
 	select {
 	case <-tx.done:
@@ -619,6 +739,10 @@ func (tx *clientTx) delete() {
 		tx.timer_d.Stop()
 		tx.timer_d = nil
 	}
+	if tx.timer_c != nil {
+		tx.timer_c.Stop()
+		tx.timer_c = nil
+	}
 	tx.mu.Unlock()
 }
 
@@ -653,8 +777,8 @@ func (tx *clientTx) act_non_invite_resend() fsm.Input {
 
 	tx.timer_a_time *= 2
 	// For non-INVITE, cap timer A at T2 seconds.
-	if tx.timer_a_time > T2 {
-		tx.timer_a_time = T2
+	if tx.timer_a_time > tx.timers.T2 {
+		tx.timer_a_time = tx.timers.T2
 	}
 	tx.timer_a.Reset(tx.timer_a_time)
 
@@ -693,16 +817,42 @@ func (tx *clientTx) act_invite_proceeding() fsm.Input {
 		tx.timer_a.Stop()
 		tx.timer_a = nil
 	}
-	if tx.timer_b != nil {
+	// timer B of the canceled transaction waits for the final response to CANCEL
+	if tx.timer_b != nil && !tx.canceled {
 		tx.timer_b.Stop()
 		tx.timer_b = nil
 	}
+	tx.resetTimerC()
+
+	tx.mu.Unlock()
+
+	return fsm.NO_INPUT
+}
+
+// act_invite_provisional passes up provisional responses received in the proceeding state,
+// timer B is set there only after CANCEL, so it is kept.
+func (tx *clientTx) act_invite_provisional() fsm.Input {
+	tx.Log().Debug("act_invite_provisional")
 
+	tx.passUp()
+
+	tx.mu.Lock()
+	tx.resetTimerC()
 	tx.mu.Unlock()
 
 	return fsm.NO_INPUT
 }
 
+// resetTimerC restarts timer C on the provisional response - RFC 3261 16.7.2.
+// Timer C is stopped when CANCEL is sent, so it is not restarted after it fired.
+func (tx *clientTx) resetTimerC() {
+	if tx.timer_c != nil {
+		tx.Log().Tracef("timer_c reset to %v", tx.timer_c_time)
+
+		tx.timer_c.Reset(tx.timer_c_time)
+	}
+}
+
 func (tx *clientTx) act_invite_final() fsm.Input {
 	tx.Log().Debug("act_invite_final")
 
@@ -719,10 +869,14 @@ func (tx *clientTx) act_invite_final() fsm.Input {
 		tx.timer_b.Stop()
 		tx.timer_b = nil
 	}
+	if tx.timer_c != nil {
+		tx.timer_c.Stop()
+		tx.timer_c = nil
+	}
 
 	tx.Log().Tracef("timer_d set to %v", tx.timer_d_time)
 
-	tx.timer_d = timing.AfterFunc(tx.timer_d_time, func() {
+	tx.timer_d = tx.afterFunc(tx.timer_d_time, func() {
 		select {
 		case <-tx.done:
 			return
@@ -761,7 +915,7 @@ func (tx *clientTx) act_non_invite_final() fsm.Input {
 
 	tx.Log().Tracef("timer_d set to %v", tx.timer_d_time)
 
-	tx.timer_d = timing.AfterFunc(tx.timer_d_time, func() {
+	tx.timer_d = tx.afterFunc(tx.timer_d_time, func() {
 		select {
 		case <-tx.done:
 			return
@@ -795,13 +949,13 @@ func (tx *clientTx) act_cancel_timeout() fsm.Input {
 
 	tx.cancel()
 
-	tx.Log().Tracef("timer_b set to %v", Timer_B)
+	tx.Log().Tracef("timer_b set to %v", tx.timers.timeout())
 
 	tx.mu.Lock()
 	if tx.timer_b != nil {
 		tx.timer_b.Stop()
 	}
-	tx.timer_b = timing.AfterFunc(Timer_B, func() {
+	tx.timer_b = tx.afterFunc(tx.timers.timeout(), func() {
 		select {
 		case <-tx.done:
 			return
@@ -895,10 +1049,14 @@ func (tx *clientTx) act_passup_accept() fsm.Input {
 		tx.timer_b.Stop()
 		tx.timer_b = nil
 	}
+	if tx.timer_c != nil {
+		tx.timer_c.Stop()
+		tx.timer_c = nil
+	}
 
-	tx.Log().Tracef("timer_m set to %v", Timer_M)
+	tx.Log().Tracef("timer_m set to %v", tx.timers.timeout())
 
-	tx.timer_m = timing.AfterFunc(Timer_M, func() {
+	tx.timer_m = tx.afterFunc(tx.timers.timeout(), func() {
 		select {
 		case <-tx.done:
 			return
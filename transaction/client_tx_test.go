@@ -1,6 +1,8 @@
 package transaction_test
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -271,3 +273,189 @@ var _ = Describe("ClientTx", func() {
 		})
 	})
 })
+
+var _ = Describe("ClientTx with Timer C", func() {
+	var (
+		tpl    *testutils.MockTransportLayer
+		txl    transaction.Layer
+		invite sip.Message
+		branch string
+	)
+
+	clientAddr := "localhost:9001"
+	timerC := 100 * time.Millisecond
+
+	BeforeEach(func() {
+		tpl = testutils.NewMockTransportLayer()
+		txl = transaction.NewLayer(tpl, testutils.NewLogrusLogger())
+		branch = sip.GenerateBranch()
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + branch,
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+	})
+	AfterEach(func(done Done) {
+		txl.Cancel()
+		<-txl.Done()
+		close(done)
+	}, 3)
+
+	It("should time out without provisional response", func(done Done) {
+		defer close(done)
+
+		go func() {
+			<-tpl.OutMsgs
+		}()
+
+		tx, err := txl.Request(invite.(sip.Request), transaction.WithTimerC(timerC))
+		Expect(err).ToNot(HaveOccurred())
+
+		select {
+		case err := <-tx.Errors():
+			txErr, ok := err.(transaction.TxError)
+			Expect(ok).To(BeTrue())
+			Expect(txErr.Timeout()).To(BeTrue())
+		case <-time.After(3 * timerC):
+			Fail("Timer C did not fire")
+		}
+	})
+
+	It("should send CANCEL after provisional response", func(done Done) {
+		defer close(done)
+
+		go func() {
+			<-tpl.OutMsgs
+		}()
+
+		tx, err := txl.Request(invite.(sip.Request), transaction.WithTimerC(timerC))
+		Expect(err).ToNot(HaveOccurred())
+
+		tpl.InMsgs <- testutils.Response([]string{
+			"SIP/2.0 180 Ringing",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + branch,
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+		Expect(<-tx.Responses()).ToNot(BeNil())
+
+		select {
+		case msg := <-tpl.OutMsgs:
+			req, ok := msg.(sip.Request)
+			Expect(ok).To(BeTrue())
+			Expect(req.IsCancel()).To(BeTrue())
+		case <-time.After(3 * timerC):
+			Fail("CANCEL was not sent")
+		}
+	})
+
+	It("should still time out on 1xx after CANCEL", func(done Done) {
+		defer close(done)
+
+		cancels := make(chan sip.Request, 10)
+		go func() {
+			for msg := range tpl.OutMsgs {
+				if req, ok := msg.(sip.Request); ok && req.IsCancel() {
+					cancels <- req
+				}
+			}
+		}()
+
+		// timer B after CANCEL is 64*T1 = 640ms
+		tx, err := txl.Request(invite.(sip.Request),
+			transaction.WithTimerC(timerC),
+			transaction.WithTimers(transaction.Timers{T1: 10 * time.Millisecond}),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		ringing := testutils.Response([]string{
+			"SIP/2.0 180 Ringing",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + branch,
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+		tpl.InMsgs <- ringing
+		Expect(<-tx.Responses()).ToNot(BeNil())
+
+		select {
+		case <-cancels:
+		case <-time.After(3 * timerC):
+			Fail("CANCEL was not sent")
+		}
+
+		tpl.InMsgs <- ringing
+		Expect(<-tx.Responses()).ToNot(BeNil())
+
+		select {
+		case err := <-tx.Errors():
+			txErr, ok := err.(transaction.TxError)
+			Expect(ok).To(BeTrue())
+			Expect(txErr.Timeout()).To(BeTrue())
+		case <-cancels:
+			Fail("CANCEL was sent again")
+		case <-time.After(2 * time.Second):
+			Fail("transaction did not time out after CANCEL")
+		}
+	}, 5)
+})
+
+var _ = Describe("ClientTx with context", func() {
+	var (
+		tpl     *testutils.MockTransportLayer
+		txl     transaction.Layer
+		options sip.Message
+	)
+
+	clientAddr := "localhost:9001"
+	deadline := 100 * time.Millisecond
+
+	BeforeEach(func() {
+		tpl = testutils.NewMockTransportLayer()
+		txl = transaction.NewLayer(tpl, testutils.NewLogrusLogger())
+		options = testutils.Request([]string{
+			"OPTIONS sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"",
+			"",
+		})
+	})
+	AfterEach(func(done Done) {
+		txl.Cancel()
+		<-txl.Done()
+		close(done)
+	}, 3)
+
+	It("should not send request with canceled context", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := txl.RequestContext(ctx, options.(sip.Request))
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+	})
+
+	It("should time out on context deadline", func(done Done) {
+		defer close(done)
+
+		go func() {
+			<-tpl.OutMsgs
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), deadline)
+		defer cancel()
+
+		tx, err := txl.RequestContext(ctx, options.(sip.Request))
+		Expect(err).ToNot(HaveOccurred())
+
+		select {
+		case err := <-tx.Errors():
+			Expect(errors.Is(err, sip.ErrTransactionTimeout)).To(BeTrue())
+		case <-time.After(10 * deadline):
+			Fail("transaction did not time out")
+		}
+	})
+})
@@ -1,11 +1,19 @@
 package transaction
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/tevino/abool"
+
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
 )
 
 // Layer serves client and server transactions.
@@ -13,7 +21,11 @@ type Layer interface {
 	Cancel()
 	Done() <-chan struct{}
 	String() string
-	Request(req sip.Request) (sip.ClientTransaction, error)
+	// Request sends request in the new client transaction.
+	// Options are applied to the created transaction, e.g. WithTimerC for the forwarded INVITE.
+	Request(req sip.Request, options ...TxOption) (sip.ClientTransaction, error)
+	// RequestContext sends request in the new client transaction bound to the context, see WithContext.
+	RequestContext(ctx context.Context, req sip.Request, options ...TxOption) (sip.ClientTransaction, error)
 	Respond(res sip.Response) (sip.ServerTransaction, error)
 	Transport() sip.Transport
 	// Requests returns channel with new incoming server transactions.
@@ -23,6 +35,20 @@ type Layer interface {
 	// Responses returns channel with not matched responses.
 	Responses() <-chan sip.Response
 	Errors() <-chan error
+	// Drain switches layer to draining mode: new out-of-dialog requests are rejected
+	// with '503 Service Unavailable' and Retry-After, while existing transactions are allowed to complete.
+	// Blocks until all transactions are terminated or context is done.
+	Drain(ctx context.Context) error
+	// Count returns number of active transactions.
+	Count() int
+	// SetTimers replaces timers of new transactions, existing transactions keep their timers.
+	SetTimers(timers Timers)
+	// SetAdmission replaces admission of the new requests, nil admits all requests.
+	SetAdmission(admission Admission)
+	// SetStrayResponseHandler replaces handler of stray responses, nil disables it.
+	SetStrayResponseHandler(handler StrayResponseHandler)
+	// StrayResponses returns number of stray responses received by the layer.
+	StrayResponses() uint64
 }
 
 type layer struct {
@@ -40,10 +66,36 @@ type layer struct {
 	serveTxCh  chan Tx
 	cancelOnce sync.Once
 
+	makeServerTxKey TxKeyMaker
+	makeClientTxKey TxKeyMaker
+	tryingDelay     time.Duration
+	tryingDisabled  bool
+	drainRetryAfter time.Duration
+	timersMu        sync.RWMutex
+	timers          Timers
+	clock           timing.Clock
+	bus             eventbus.Bus
+	admission       atomic.Value
+	strayHandler    atomic.Value
+	doneHandler     atomic.Value
+	strayCount      uint64
+	draining        abool.AtomicBool
+
 	log log.Logger
 }
 
-func NewLayer(tpl sip.Transport, logger log.Logger) Layer {
+func NewLayer(tpl sip.Transport, logger log.Logger, options ...LayerOption) Layer {
+	optsHash := LayerOptions{
+		ServerTxKeyMaker: MakeServerTxKey,
+		ClientTxKeyMaker: MakeClientTxKey,
+		TryingDelay:      Timer_1xx,
+		DrainRetryAfter:  DefaultDrainRetryAfter,
+		Timers:           DefaultTimers(),
+	}
+	for _, opt := range options {
+		opt.ApplyLayer(&optsHash)
+	}
+
 	txl := &layer{
 		tpl:          tpl,
 		transactions: newTransactionStore(),
@@ -56,7 +108,19 @@ func NewLayer(tpl sip.Transport, logger log.Logger) Layer {
 		done:      make(chan struct{}),
 		canceled:  make(chan struct{}),
 		serveTxCh: make(chan Tx),
-	}
+
+		makeServerTxKey: optsHash.ServerTxKeyMaker,
+		makeClientTxKey: optsHash.ClientTxKeyMaker,
+		tryingDelay:     optsHash.TryingDelay,
+		tryingDisabled:  optsHash.TryingDisabled,
+		drainRetryAfter: optsHash.DrainRetryAfter,
+		timers:          optsHash.Timers,
+		clock:           optsHash.Clock,
+		bus:             optsHash.EventBus,
+	}
+	txl.SetAdmission(optsHash.Admission)
+	txl.SetStrayResponseHandler(optsHash.StrayResponseHandler)
+	txl.SetTerminatedHandler(optsHash.TerminatedHandler)
 	txl.log = logger.
 		WithPrefix("transaction.Layer").
 		WithFields(log.Fields{
@@ -118,7 +182,102 @@ func (txl *layer) Transport() sip.Transport {
 	return txl.tpl
 }
 
-func (txl *layer) Request(req sip.Request) (sip.ClientTransaction, error) {
+func (txl *layer) Count() int {
+	return txl.transactions.count()
+}
+
+func (txl *layer) SetTimers(timers Timers) {
+	txl.timersMu.Lock()
+	txl.timers = timers.withDefaults()
+	txl.timersMu.Unlock()
+}
+
+func (txl *layer) getTimers() Timers {
+	txl.timersMu.RLock()
+	defer txl.timersMu.RUnlock()
+
+	return txl.timers
+}
+
+func (txl *layer) SetAdmission(admission Admission) {
+	txl.admission.Store(admissionHolder{admission})
+}
+
+func (txl *layer) getAdmission() Admission {
+	return txl.admission.Load().(admissionHolder).admission
+}
+
+// admissionHolder allows to store nil Admission in atomic.Value.
+type admissionHolder struct {
+	admission Admission
+}
+
+func (txl *layer) SetStrayResponseHandler(handler StrayResponseHandler) {
+	txl.strayHandler.Store(strayHandlerHolder{handler})
+}
+
+func (txl *layer) StrayResponses() uint64 {
+	return atomic.LoadUint64(&txl.strayCount)
+}
+
+// strayHandlerHolder allows to store nil StrayResponseHandler in atomic.Value.
+type strayHandlerHolder struct {
+	handler StrayResponseHandler
+}
+
+// TerminatedHandler is called on each transaction deleted from the layer after it is terminated.
+// It is called synchronously from the transaction layer, so it must not block.
+type TerminatedHandler func(tx sip.Transaction)
+
+// TerminationNotifier is implemented by transaction layers that report terminated transactions,
+// like to observe transactions without the goroutine per transaction waiting for Done.
+type TerminationNotifier interface {
+	// SetTerminatedHandler replaces handler of terminated transactions, nil disables it.
+	SetTerminatedHandler(handler TerminatedHandler)
+}
+
+func (txl *layer) SetTerminatedHandler(handler TerminatedHandler) {
+	txl.doneHandler.Store(doneHandlerHolder{handler})
+}
+
+// doneHandlerHolder allows to store nil TerminatedHandler in atomic.Value.
+type doneHandlerHolder struct {
+	handler TerminatedHandler
+}
+
+func (txl *layer) handleStrayResponse(res sip.Response, reason StrayResponseReason, err error) {
+	atomic.AddUint64(&txl.strayCount, 1)
+	if handler := txl.strayHandler.Load().(strayHandlerHolder).handler; handler != nil {
+		handler(res, &StrayResponseError{Err: err, Reason: reason, Response: res})
+	}
+}
+
+func (txl *layer) Drain(ctx context.Context) error {
+	if txl.draining.SetToIf(false, true) {
+		txl.Log().Debug("transaction layer draining")
+	}
+
+	select {
+	case <-txl.transactions.idle():
+		txl.Log().Debug("transaction layer drained")
+
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-txl.canceled:
+		return fmt.Errorf("transaction layer is canceled")
+	}
+}
+
+func (txl *layer) Request(req sip.Request, options ...TxOption) (sip.ClientTransaction, error) {
+	return txl.RequestContext(context.Background(), req, options...)
+}
+
+func (txl *layer) RequestContext(
+	ctx context.Context,
+	req sip.Request,
+	options ...TxOption,
+) (sip.ClientTransaction, error) {
 	select {
 	case <-txl.canceled:
 		return nil, fmt.Errorf("transaction layer is canceled")
@@ -129,7 +288,15 @@ func (txl *layer) Request(req sip.Request) (sip.ClientTransaction, error) {
 		return nil, fmt.Errorf("ACK request must be sent directly through transport")
 	}
 
-	tx, err := NewClientTx(req, txl.tpl, txl.Log())
+	txOpts := append([]TxOption{
+		WithKeyMaker(txl.makeClientTxKey),
+		WithTimers(txl.getTimers()),
+		WithClock(txl.clock),
+		WithEventBus(txl.bus),
+		WithContext(ctx),
+	}, options...)
+
+	tx, err := NewClientTx(req, txl.tpl, txl.Log(), txOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -211,6 +378,10 @@ func (txl *layer) serveTransaction(tx Tx) {
 
 		logger.Debug("transaction deleted")
 
+		if handler := txl.doneHandler.Load().(doneHandlerHolder).handler; handler != nil {
+			handler(tx)
+		}
+
 		txl.txWg.Done()
 	}()
 
@@ -283,8 +454,40 @@ func (txl *layer) handleRequest(req sip.Request, logger log.Logger) {
 		}
 		return
 	}
+	// reject new out-of-dialog requests while draining
+	if txl.draining.IsSet() && !isInDialog(req) {
+		res := sip.NewResponseFromRequest("", req, 503, "Service Unavailable", "")
+		res.AppendHeader(&sip.GenericHeader{
+			HeaderName: "Retry-After",
+			Contents:   fmt.Sprintf("%d", int(math.Max(1, math.Ceil(txl.drainRetryAfter.Seconds())))),
+		})
+		if err := txl.tpl.Send(res); err != nil {
+			logger.Error(fmt.Errorf("respond '503 Service Unavailable' on draining: %w", err))
+		}
+		return
+	}
+	if admission := txl.getAdmission(); admission != nil {
+		if res := admission(req); res != nil {
+			logger.Debugf("request is not admitted: %d %s", res.StatusCode(), res.Reason())
+			if err := txl.tpl.Send(res); err != nil {
+				logger.Error(fmt.Errorf("respond '%d %s' on not admitted request: %w", res.StatusCode(), res.Reason(), err))
+			}
+			return
+		}
+	}
+
+	txOpts := []TxOption{
+		WithKeyMaker(txl.makeServerTxKey),
+		WithTryingDelay(txl.tryingDelay),
+		WithTimers(txl.getTimers()),
+		WithClock(txl.clock),
+		WithEventBus(txl.bus),
+	}
+	if txl.tryingDisabled {
+		txOpts = append(txOpts, WithoutTrying())
+	}
 
-	tx, err = NewServerTx(req, txl.tpl, txl.Log())
+	tx, err = NewServerTx(req, txl.tpl, txl.Log(), txOpts...)
 	if err != nil {
 		logger.Error(err)
 
@@ -327,6 +530,7 @@ func (txl *layer) handleResponse(res sip.Response, logger log.Logger) {
 	tx, err := txl.getClientTx(res)
 	if err != nil {
 		logger.Tracef("passing up non-matched SIP response: %s", err)
+		txl.handleStrayResponse(res, StrayUnmatched, err)
 
 		// RFC 3261 - 17.1.1.2.
 		// Not matched responses should be passed directly to the UA
@@ -341,6 +545,15 @@ func (txl *layer) handleResponse(res sip.Response, logger log.Logger) {
 
 	logger = log.AddFieldsFrom(logger, tx)
 
+	if tx, ok := tx.(responseVerifier); ok {
+		if err := tx.verifyResponse(res); err != nil {
+			logger.Warnf("drop SIP response not matching request of client transaction: %s", err)
+			txl.handleStrayResponse(res, StrayMismatched, err)
+
+			return
+		}
+	}
+
 	if err := tx.Receive(res); err != nil {
 		logger.Error(err)
 
@@ -348,13 +561,18 @@ func (txl *layer) handleResponse(res sip.Response, logger log.Logger) {
 	}
 }
 
+// responseVerifier is implemented by client transactions that verify matched responses.
+type responseVerifier interface {
+	verifyResponse(res sip.Response) error
+}
+
 // RFC 17.1.3.
 func (txl *layer) getClientTx(msg sip.Message) (ClientTx, error) {
 	logger := txl.Log().WithFields(msg.Fields())
 
 	logger.Trace("searching client transaction")
 
-	key, err := MakeClientTxKey(msg)
+	key, err := txl.makeClientTxKey(msg)
 	if err != nil {
 		return nil, fmt.Errorf("%s failed to match message '%s' to client transaction: %w", txl, msg.Short(), err)
 	}
@@ -392,7 +610,7 @@ func (txl *layer) getServerTx(msg sip.Message) (ServerTx, error) {
 
 	logger.Trace("searching server transaction")
 
-	key, err := MakeServerTxKey(msg)
+	key, err := txl.makeServerTxKey(msg)
 	if err != nil {
 		return nil, fmt.Errorf("%s failed to match message '%s' to server transaction: %w", txl, msg.Short(), err)
 	}
@@ -424,8 +642,21 @@ func (txl *layer) getServerTx(msg sip.Message) (ServerTx, error) {
 	}
 }
 
+func isInDialog(req sip.Request) bool {
+	to, ok := req.To()
+	if !ok || to.Params == nil {
+		return false
+	}
+
+	tag, ok := to.Params.Get("tag")
+
+	return ok && tag != nil && tag.String() != ""
+}
+
 type transactionStore struct {
 	transactions map[TxKey]Tx
+	// empty is closed by the removal of the last transaction
+	empty chan struct{}
 
 	mu sync.RWMutex
 }
@@ -456,9 +687,37 @@ func (store *transactionStore) drop(key TxKey) bool {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 	delete(store.transactions, key)
+	if len(store.transactions) == 0 && store.empty != nil {
+		close(store.empty)
+		store.empty = nil
+	}
 	return true
 }
 
+// idle returns the channel closed when the store is empty.
+func (store *transactionStore) idle() <-chan struct{} {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if len(store.transactions) == 0 {
+		empty := make(chan struct{})
+		close(empty)
+		return empty
+	}
+	if store.empty == nil {
+		store.empty = make(chan struct{})
+	}
+
+	return store.empty
+}
+
+func (store *transactionStore) count() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return len(store.transactions)
+}
+
 func (store *transactionStore) all() []Tx {
 	all := make([]Tx, 0)
 	store.mu.RLock()
@@ -0,0 +1,301 @@
+package transaction
+
+import (
+	"context"
+	"time"
+
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// TxKeyMaker builds transaction key from the SIP message.
+// Messages with equal keys are matched to the same transaction.
+type TxKeyMaker func(msg sip.Message) (TxKey, error)
+
+type LayerOption interface {
+	ApplyLayer(opts *LayerOptions)
+}
+
+type LayerOptions struct {
+	// ServerTxKeyMaker is used to match incoming requests to server transactions,
+	// default is MakeServerTxKey (RFC 3261 17.2.3).
+	ServerTxKeyMaker TxKeyMaker
+	// ClientTxKeyMaker is used to match incoming responses to client transactions,
+	// default is MakeClientTxKey (RFC 3261 17.1.3).
+	ClientTxKeyMaker TxKeyMaker
+	// TryingDelay is a delay before automatic '100 Trying' response on INVITE.
+	TryingDelay time.Duration
+	// TryingDisabled disables automatic '100 Trying' response on INVITE.
+	TryingDisabled bool
+	// DrainRetryAfter is a Retry-After value of '503 Service Unavailable' responses sent while draining.
+	DrainRetryAfter time.Duration
+	// Timers are base values of transaction timers, default is DefaultTimers.
+	Timers Timers
+	// Admission decides on the new requests before server transactions are created, nil admits all requests.
+	Admission Admission
+	// Clock runs transaction timers, nil is the current clock of the timing package.
+	Clock timing.Clock
+	// StrayResponseHandler is called on responses not accepted by client transactions, nil disables it.
+	StrayResponseHandler StrayResponseHandler
+	// TerminatedHandler is called on transactions deleted from the layer, nil disables it.
+	TerminatedHandler TerminatedHandler
+	// EventBus receives timeouts of transactions, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+// Admission is called on the new request before the server transaction is created.
+// It returns nil to admit the request, otherwise the request is dropped
+// and the returned response is sent statelessly. Retransmissions of admitted requests
+// are matched to their transactions and not passed to the admission again.
+type Admission func(req sip.Request) sip.Response
+
+// WithServerTxKeyMaker replaces server transaction matching algorithm.
+// Can be used to tolerate broken endpoints or to add extra isolation to the keys.
+func WithServerTxKeyMaker(maker TxKeyMaker) LayerOption {
+	return withServerTxKeyMaker{maker}
+}
+
+type withServerTxKeyMaker struct {
+	maker TxKeyMaker
+}
+
+func (o withServerTxKeyMaker) ApplyLayer(opts *LayerOptions) {
+	opts.ServerTxKeyMaker = o.maker
+}
+
+// WithClientTxKeyMaker replaces client transaction matching algorithm.
+func WithClientTxKeyMaker(maker TxKeyMaker) LayerOption {
+	return withClientTxKeyMaker{maker}
+}
+
+type withClientTxKeyMaker struct {
+	maker TxKeyMaker
+}
+
+func (o withClientTxKeyMaker) ApplyLayer(opts *LayerOptions) {
+	opts.ClientTxKeyMaker = o.maker
+}
+
+type TxOption interface {
+	ApplyTx(opts *TxOptions)
+}
+
+type TxOptions struct {
+	KeyMaker       TxKeyMaker
+	TryingDelay    time.Duration
+	TryingDisabled bool
+	TimerC         time.Duration
+	Timers         Timers
+	Clock          timing.Clock
+	// Context of the client transaction, see WithContext.
+	Context context.Context
+	// EventBus receives timeouts of the transaction, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+// WithKeyMaker sets transaction key maker used by NewServerTx and NewClientTx.
+func WithKeyMaker(maker TxKeyMaker) TxOption {
+	return withKeyMaker{maker}
+}
+
+type withKeyMaker struct {
+	maker TxKeyMaker
+}
+
+func (o withKeyMaker) ApplyTx(opts *TxOptions) {
+	opts.KeyMaker = o.maker
+}
+
+// WithTryingDelay sets delay before automatic '100 Trying' response
+// for INVITE server transactions, default is Timer_1xx.
+// Zero delay sends '100 Trying' immediately.
+func WithTryingDelay(delay time.Duration) interface {
+	LayerOption
+	TxOption
+} {
+	return withTryingDelay{delay}
+}
+
+type withTryingDelay struct {
+	delay time.Duration
+}
+
+func (o withTryingDelay) ApplyLayer(opts *LayerOptions) {
+	opts.TryingDelay = o.delay
+	opts.TryingDisabled = false
+}
+
+func (o withTryingDelay) ApplyTx(opts *TxOptions) {
+	opts.TryingDelay = o.delay
+	opts.TryingDisabled = false
+}
+
+// WithoutTrying disables automatic '100 Trying' response for INVITE server transactions.
+// Useful for B2BUAs that relay upstream provisional responses.
+func WithoutTrying() interface {
+	LayerOption
+	TxOption
+} {
+	return withoutTrying{}
+}
+
+type withoutTrying struct{}
+
+func (o withoutTrying) ApplyLayer(opts *LayerOptions) {
+	opts.TryingDisabled = true
+}
+
+func (o withoutTrying) ApplyTx(opts *TxOptions) {
+	opts.TryingDisabled = true
+}
+
+// WithTimerC enables Timer C for INVITE client transaction - RFC 3261 16.6 and 16.8.
+// Should be used by stateful proxies for forwarded INVITE requests.
+// Timer C is reset on each provisional response; when it fires the transaction
+// is canceled if a provisional response was received, or timed out otherwise.
+// Duration should be greater than 3 minutes, see Timer_C.
+func WithTimerC(timeout time.Duration) TxOption {
+	return withTimerC{timeout}
+}
+
+type withTimerC struct {
+	timeout time.Duration
+}
+
+func (o withTimerC) ApplyTx(opts *TxOptions) {
+	opts.TimerC = o.timeout
+}
+
+// WithContext binds the client transaction to the context. The context deadline limits sending of the request,
+// when the context is done INVITE transaction is canceled, non-INVITE transaction times out
+// if the deadline is exceeded or fails with the context error otherwise.
+func WithContext(ctx context.Context) TxOption {
+	return withContext{ctx}
+}
+
+type withContext struct {
+	ctx context.Context
+}
+
+func (o withContext) ApplyTx(opts *TxOptions) {
+	opts.Context = o.ctx
+}
+
+// WithTimers overrides base values of transaction timers, zero values are replaced by defaults.
+// Shorter timers speed up failure detection on low latency networks and tests.
+func WithTimers(timers Timers) interface {
+	LayerOption
+	TxOption
+} {
+	return withTimers{timers.withDefaults()}
+}
+
+type withTimers struct {
+	timers Timers
+}
+
+func (o withTimers) ApplyLayer(opts *LayerOptions) {
+	opts.Timers = o.timers
+}
+
+func (o withTimers) ApplyTx(opts *TxOptions) {
+	opts.Timers = o.timers
+}
+
+// WithAdmission sets admission of the new requests.
+func WithAdmission(admission Admission) LayerOption {
+	return withAdmission{admission}
+}
+
+type withAdmission struct {
+	admission Admission
+}
+
+func (o withAdmission) ApplyLayer(opts *LayerOptions) {
+	opts.Admission = o.admission
+}
+
+// WithStrayResponseHandler sets handler of stray responses, like to count or alert on spoofing attempts.
+func WithStrayResponseHandler(handler StrayResponseHandler) LayerOption {
+	return withStrayResponseHandler{handler}
+}
+
+type withStrayResponseHandler struct {
+	handler StrayResponseHandler
+}
+
+func (o withStrayResponseHandler) ApplyLayer(opts *LayerOptions) {
+	opts.StrayResponseHandler = o.handler
+}
+
+// WithTerminatedHandler sets handler of terminated transactions, like to report durations of transactions.
+func WithTerminatedHandler(handler TerminatedHandler) LayerOption {
+	return withTerminatedHandler{handler}
+}
+
+type withTerminatedHandler struct {
+	handler TerminatedHandler
+}
+
+func (o withTerminatedHandler) ApplyLayer(opts *LayerOptions) {
+	opts.TerminatedHandler = o.handler
+}
+
+// WithDrainRetryAfter sets Retry-After value for requests rejected while draining,
+// default is DefaultDrainRetryAfter.
+func WithDrainRetryAfter(retryAfter time.Duration) LayerOption {
+	return withDrainRetryAfter{retryAfter}
+}
+
+type withDrainRetryAfter struct {
+	retryAfter time.Duration
+}
+
+func (o withDrainRetryAfter) ApplyLayer(opts *LayerOptions) {
+	opts.DrainRetryAfter = o.retryAfter
+}
+
+// WithClock runs transaction timers on the clock, like timing.NewWheelClock
+// that schedules retransmission timers of all transactions on the single timing wheel.
+// The clock is owned by the caller.
+func WithClock(clock timing.Clock) interface {
+	LayerOption
+	TxOption
+} {
+	return withClock{clock}
+}
+
+type withClock struct {
+	clock timing.Clock
+}
+
+func (o withClock) ApplyLayer(opts *LayerOptions) {
+	opts.Clock = o.clock
+}
+
+func (o withClock) ApplyTx(opts *TxOptions) {
+	opts.Clock = o.clock
+}
+
+// WithEventBus publishes timeouts of transactions to the bus, like the bus of the server.
+func WithEventBus(bus eventbus.Bus) interface {
+	LayerOption
+	TxOption
+} {
+	return withEventBus{bus}
+}
+
+type withEventBus struct {
+	bus eventbus.Bus
+}
+
+func (o withEventBus) ApplyLayer(opts *LayerOptions) {
+	opts.EventBus = o.bus
+}
+
+func (o withEventBus) ApplyTx(opts *TxOptions) {
+	if o.bus != nil {
+		opts.EventBus = o.bus
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/discoviking/fsm"
 
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/timing"
@@ -21,26 +22,38 @@ type ServerTx interface {
 
 type serverTx struct {
 	commonTx
-	lastAck      sip.Request
-	lastCancel   sip.Request
-	acks         chan sip.Request
-	cancels      chan sip.Request
-	timer_g      timing.Timer
-	timer_g_time time.Duration
-	timer_h      timing.Timer
-	timer_i      timing.Timer
-	timer_i_time time.Duration
-	timer_j      timing.Timer
-	timer_1xx    timing.Timer
-	timer_l      timing.Timer
-	reliable     bool
+	lastAck        sip.Request
+	lastCancel     sip.Request
+	acks           chan sip.Request
+	cancels        chan sip.Request
+	timer_g        timing.Timer
+	timer_g_time   time.Duration
+	timer_h        timing.Timer
+	timer_i        timing.Timer
+	timer_i_time   time.Duration
+	timer_j        timing.Timer
+	timer_1xx      timing.Timer
+	timer_l        timing.Timer
+	timer_1xx_time time.Duration
+	trying         bool
+	reliable       bool
 
 	mu        sync.RWMutex
 	closeOnce sync.Once
 }
 
-func NewServerTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (ServerTx, error) {
-	key, err := MakeServerTxKey(origin)
+func NewServerTx(origin sip.Request, tpl sip.Transport, logger log.Logger, options ...TxOption) (ServerTx, error) {
+	optsHash := TxOptions{
+		KeyMaker:    MakeServerTxKey,
+		TryingDelay: Timer_1xx,
+		Timers:      DefaultTimers(),
+		EventBus:    eventbus.Default,
+	}
+	for _, opt := range options {
+		opt.ApplyTx(&optsHash)
+	}
+
+	key, err := optsHash.KeyMaker(origin)
 	if err != nil {
 		return nil, err
 	}
@@ -48,6 +61,9 @@ func NewServerTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (Serv
 	tx := new(serverTx)
 	tx.key = key
 	tx.tpl = tpl
+	tx.timers = optsHash.Timers
+	tx.clock = optsHash.Clock
+	tx.bus = optsHash.EventBus
 	// about ~10 retransmits
 	tx.acks = make(chan sip.Request, 64)
 	tx.cancels = make(chan sip.Request, 64)
@@ -66,6 +82,8 @@ func NewServerTx(origin sip.Request, tpl sip.Transport, logger log.Logger) (Serv
 		"transaction_key": tx.key,
 	}).(sip.Request)
 	tx.reliable = tx.tpl.IsReliable(origin.Transport())
+	tx.trying = !optsHash.TryingDisabled
+	tx.timer_1xx_time = optsHash.TryingDelay
 
 	return tx, nil
 }
@@ -78,18 +96,18 @@ func (tx *serverTx) Init() error {
 	if tx.reliable {
 		tx.timer_i_time = 0
 	} else {
-		tx.timer_g_time = Timer_G
-		tx.timer_i_time = Timer_I
+		tx.timer_g_time = tx.timers.T1
+		tx.timer_i_time = tx.timers.T4
 	}
 
 	tx.mu.Unlock()
 
 	// RFC 3261 - 17.2.1
-	if tx.Origin().IsInvite() {
-		tx.Log().Tracef("set timer_1xx to %v", Timer_1xx)
+	if tx.Origin().IsInvite() && tx.trying {
+		tx.Log().Tracef("set timer_1xx to %v", tx.timer_1xx_time)
 
 		tx.mu.Lock()
-		tx.timer_1xx = timing.AfterFunc(Timer_1xx, func() {
+		tx.timer_1xx = tx.afterFunc(tx.timer_1xx_time, func() {
 			select {
 			case <-tx.done:
 				return
@@ -447,10 +465,15 @@ func (tx *serverTx) timeoutErr() {
 	defer func() { recover() }()
 
 	err := &TxTimeoutError{
-		fmt.Errorf("transaction timed out"),
+		&sip.TransactionTimeout{Key: tx.Key().String(), Method: tx.Origin().Method()},
 		tx.Key(),
 		fmt.Sprintf("%p", tx),
 	}
+	tx.bus.Publish(&eventbus.TransactionTimeoutEvent{
+		Key:    tx.Key().String(),
+		Method: tx.Origin().Method(),
+		Client: false,
+	})
 
 	select {
 	case <-tx.done:
@@ -506,6 +529,16 @@ func (tx *serverTx) delete() {
 	tx.mu.Unlock()
 }
 
+// send sends the response, its wire form is kept for retransmissions of the response.
+func (tx *serverTx) send(res sip.Response) error {
+	if err := tx.tpl.Send(res); err != nil {
+		return err
+	}
+	sip.CacheWire(res)
+
+	return nil
+}
+
 // Define actions.
 // Send response
 func (tx *serverTx) act_respond() fsm.Input {
@@ -519,7 +552,7 @@ func (tx *serverTx) act_respond() fsm.Input {
 
 	tx.Log().Debug("act_respond")
 
-	lastErr := tx.tpl.Send(lastResp)
+	lastErr := tx.send(lastResp)
 
 	tx.mu.Lock()
 	tx.lastErr = lastErr
@@ -543,7 +576,7 @@ func (tx *serverTx) act_respond_complete() fsm.Input {
 
 	tx.Log().Debug("act_respond_complete")
 
-	lastErr := tx.tpl.Send(lastResp)
+	lastErr := tx.send(lastResp)
 
 	tx.mu.Lock()
 	tx.lastErr = lastErr
@@ -558,7 +591,7 @@ func (tx *serverTx) act_respond_complete() fsm.Input {
 		if tx.timer_g == nil {
 			tx.Log().Tracef("timer_g set to %v", tx.timer_g_time)
 
-			tx.timer_g = timing.AfterFunc(tx.timer_g_time, func() {
+			tx.timer_g = tx.afterFunc(tx.timer_g_time, func() {
 				select {
 				case <-tx.done:
 					return
@@ -575,8 +608,8 @@ func (tx *serverTx) act_respond_complete() fsm.Input {
 			})
 		} else {
 			tx.timer_g_time *= 2
-			if tx.timer_g_time > T2 {
-				tx.timer_g_time = T2
+			if tx.timer_g_time > tx.timers.T2 {
+				tx.timer_g_time = tx.timers.T2
 			}
 
 			tx.Log().Tracef("timer_g reset to %v", tx.timer_g_time)
@@ -588,9 +621,9 @@ func (tx *serverTx) act_respond_complete() fsm.Input {
 
 	tx.mu.Lock()
 	if tx.timer_h == nil {
-		tx.Log().Tracef("timer_h set to %v", Timer_H)
+		tx.Log().Tracef("timer_h set to %v", tx.timers.timeout())
 
-		tx.timer_h = timing.AfterFunc(Timer_H, func() {
+		tx.timer_h = tx.afterFunc(tx.timers.timeout(), func() {
 			select {
 			case <-tx.done:
 				return
@@ -622,7 +655,7 @@ func (tx *serverTx) act_respond_accept() fsm.Input {
 
 	tx.Log().Debug("act_respond_accept")
 
-	lastErr := tx.tpl.Send(lastResp)
+	lastErr := tx.send(lastResp)
 
 	tx.mu.Lock()
 	tx.lastErr = lastErr
@@ -633,9 +666,9 @@ func (tx *serverTx) act_respond_accept() fsm.Input {
 	}
 
 	tx.mu.Lock()
-	tx.Log().Tracef("timer_l set to %v", Timer_L)
+	tx.Log().Tracef("timer_l set to %v", tx.timers.timeout())
 
-	tx.timer_l = timing.AfterFunc(Timer_L, func() {
+	tx.timer_l = tx.afterFunc(tx.timers.timeout(), func() {
 		select {
 		case <-tx.done:
 			return
@@ -684,7 +717,7 @@ func (tx *serverTx) act_final() fsm.Input {
 
 	tx.Log().Debug("act_final")
 
-	lastErr := tx.tpl.Send(tx.lastResp)
+	lastErr := tx.send(tx.lastResp)
 
 	tx.mu.Lock()
 	tx.lastErr = lastErr
@@ -696,9 +729,9 @@ func (tx *serverTx) act_final() fsm.Input {
 
 	tx.mu.Lock()
 
-	tx.Log().Tracef("timer_j set to %v", Timer_J)
+	tx.Log().Tracef("timer_j set to %v", tx.timers.timeout())
 
-	tx.timer_j = timing.AfterFunc(Timer_J, func() {
+	tx.timer_j = tx.afterFunc(tx.timers.timeout(), func() {
 		select {
 		case <-tx.done:
 			return
@@ -753,7 +786,7 @@ func (tx *serverTx) act_respond_delete() fsm.Input {
 	tx.delete()
 
 	tx.mu.RLock()
-	lastErr := tx.tpl.Send(tx.lastResp)
+	lastErr := tx.send(tx.lastResp)
 	tx.mu.RUnlock()
 
 	tx.mu.Lock()
@@ -785,9 +818,9 @@ func (tx *serverTx) act_confirm() fsm.Input {
 		tx.timer_h = nil
 	}
 
-	tx.Log().Tracef("timer_i set to %v", Timer_I)
+	tx.Log().Tracef("timer_i set to %v", tx.timers.T4)
 
-	tx.timer_i = timing.AfterFunc(Timer_I, func() {
+	tx.timer_i = tx.afterFunc(tx.timers.T4, func() {
 		select {
 		case <-tx.done:
 			return
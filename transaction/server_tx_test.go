@@ -1,6 +1,7 @@
 package transaction_test
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -112,6 +113,11 @@ var _ = Describe("ServerTx", func() {
 			tx := <-txl.Requests()
 			Expect(tx).ToNot(BeNil())
 			Expect(tx.Origin().String()).To(Equal(invite.String()))
+
+			values, ok := tx.(sip.Values)
+			Expect(ok).To(BeTrue(), "transaction should keep application values")
+			values.SetValue("call-state", "ringing")
+			Expect(values.Value("call-state")).To(Equal("ringing"))
 		})
 
 		Context("when INVITE server tx created", func() {
@@ -243,3 +249,287 @@ var _ = Describe("ServerTx", func() {
 		})
 	})
 })
+
+var _ = Describe("ServerTx with custom key maker", func() {
+	var (
+		tpl *testutils.MockTransportLayer
+		txl transaction.Layer
+	)
+
+	clientAddr := "localhost:9001"
+
+	BeforeEach(func() {
+		tpl = testutils.NewMockTransportLayer()
+		// ignores Via branch, matches by Call-ID and CSeq only
+		txl = transaction.NewLayer(
+			tpl,
+			testutils.NewLogrusLogger(),
+			transaction.WithServerTxKeyMaker(func(msg sip.Message) (transaction.TxKey, error) {
+				callID, ok := msg.CallID()
+				if !ok {
+					return "", fmt.Errorf("'Call-ID' header not found")
+				}
+				cseq, ok := msg.CSeq()
+				if !ok {
+					return "", fmt.Errorf("'CSeq' header not found")
+				}
+
+				return transaction.TxKey(fmt.Sprintf("%s__%d", callID.Value(), cseq.SeqNo)), nil
+			}),
+		)
+	})
+	AfterEach(func(done Done) {
+		txl.Cancel()
+		<-txl.Done()
+		close(done)
+	}, 3)
+
+	It("should match retransmission with mutated branch to the same transaction", func(done Done) {
+		defer close(done)
+
+		msg := func() sip.Message {
+			return testutils.Request([]string{
+				"OPTIONS sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+				"Call-ID: custom-key-call",
+				"CSeq: 1 OPTIONS",
+				"",
+				"",
+			})
+		}
+
+		go func() {
+			tpl.InMsgs <- msg()
+		}()
+		tx := <-txl.Requests()
+		Expect(tx).ToNot(BeNil())
+		Expect(tx.Key()).To(Equal(transaction.TxKey("custom-key-call__1")))
+
+		go func() {
+			tpl.InMsgs <- msg()
+		}()
+
+		select {
+		case <-txl.Requests():
+			Fail("retransmission passed up as new transaction")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+})
+
+var _ = Describe("ServerTx with 100 Trying policy", func() {
+	var (
+		tpl    *testutils.MockTransportLayer
+		txl    transaction.Layer
+		invite sip.Message
+	)
+
+	clientAddr := "localhost:9001"
+
+	BeforeEach(func() {
+		tpl = testutils.NewMockTransportLayer()
+		invite = testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+	})
+	AfterEach(func(done Done) {
+		txl.Cancel()
+		<-txl.Done()
+		close(done)
+	}, 3)
+
+	Context("when 100 Trying disabled", func() {
+		BeforeEach(func() {
+			txl = transaction.NewLayer(tpl, testutils.NewLogrusLogger(), transaction.WithoutTrying())
+		})
+
+		It("should not send 100 Trying", func(done Done) {
+			defer close(done)
+
+			go func() {
+				tpl.InMsgs <- invite.Clone()
+			}()
+			Expect(<-txl.Requests()).ToNot(BeNil())
+
+			select {
+			case msg := <-tpl.OutMsgs:
+				Fail(fmt.Sprintf("unexpected %s sent", msg.Short()))
+			case <-time.After(transaction.Timer_1xx + 50*time.Millisecond):
+			}
+		})
+	})
+
+	Context("when 100 Trying is immediate", func() {
+		BeforeEach(func() {
+			txl = transaction.NewLayer(tpl, testutils.NewLogrusLogger(), transaction.WithTryingDelay(0))
+		})
+
+		It("should send 100 Trying before Timer_1xx fired", func(done Done) {
+			defer close(done)
+
+			go func() {
+				tpl.InMsgs <- invite.Clone()
+			}()
+			Expect(<-txl.Requests()).ToNot(BeNil())
+
+			select {
+			case msg := <-tpl.OutMsgs:
+				res, ok := msg.(sip.Response)
+				Expect(ok).To(BeTrue())
+				Expect(res.StatusCode()).To(Equal(sip.StatusCode(100)))
+			case <-time.After(transaction.Timer_1xx / 2):
+				Fail("100 Trying was not sent")
+			}
+		})
+	})
+})
+
+var _ = Describe("Layer draining", func() {
+	var (
+		tpl *testutils.MockTransportLayer
+		txl transaction.Layer
+	)
+
+	clientAddr := "localhost:9001"
+
+	BeforeEach(func() {
+		tpl = testutils.NewMockTransportLayer()
+		txl = transaction.NewLayer(tpl, testutils.NewLogrusLogger(), transaction.WithDrainRetryAfter(10*time.Second))
+	})
+	AfterEach(func(done Done) {
+		txl.Cancel()
+		<-txl.Done()
+		close(done)
+	}, 3)
+
+	It("should reject new requests with 503 and finish when transactions are done", func(done Done) {
+		defer close(done)
+
+		options := testutils.Request([]string{
+			"OPTIONS sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+			"CSeq: 1 OPTIONS",
+			"",
+			"",
+		})
+		go func() {
+			tpl.InMsgs <- options
+		}()
+		tx := <-txl.Requests()
+		Expect(tx).ToNot(BeNil())
+
+		drained := make(chan error)
+		go func() {
+			drained <- txl.Drain(context.Background())
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		go func() {
+			tpl.InMsgs <- testutils.Request([]string{
+				"INVITE sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+				"CSeq: 1 INVITE",
+				"",
+				"",
+			})
+		}()
+		msg := <-tpl.OutMsgs
+		res, ok := msg.(sip.Response)
+		Expect(ok).To(BeTrue())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(503)))
+		hdrs := res.GetHeaders("Retry-After")
+		Expect(hdrs).To(HaveLen(1))
+		Expect(hdrs[0].Value()).To(Equal("10"))
+
+		tx.(transaction.ServerTx).Terminate()
+		Expect(<-drained).ToNot(HaveOccurred())
+	}, 3)
+
+	It("should round up sub-second Retry-After", func(done Done) {
+		defer close(done)
+
+		txl.Cancel()
+		<-txl.Done()
+		txl = transaction.NewLayer(tpl, testutils.NewLogrusLogger(), transaction.WithDrainRetryAfter(200*time.Millisecond))
+		Expect(txl.Drain(context.Background())).To(Succeed())
+
+		go func() {
+			tpl.InMsgs <- testutils.Request([]string{
+				"INVITE sip:bob@example.com SIP/2.0",
+				"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+				"CSeq: 1 INVITE",
+				"",
+				"",
+			})
+		}()
+		res, ok := (<-tpl.OutMsgs).(sip.Response)
+		Expect(ok).To(BeTrue())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(503)))
+		hdrs := res.GetHeaders("Retry-After")
+		Expect(hdrs).To(HaveLen(1))
+		Expect(hdrs[0].Value()).To(Equal("1"))
+	}, 3)
+})
+
+var _ = Describe("Layer admission", func() {
+	var (
+		tpl *testutils.MockTransportLayer
+		txl transaction.Layer
+	)
+
+	clientAddr := "localhost:9001"
+	request := func(method sip.RequestMethod) sip.Message {
+		return testutils.Request([]string{
+			string(method) + " sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP " + clientAddr + ";branch=" + sip.GenerateBranch(),
+			"CSeq: 1 " + string(method),
+			"",
+			"",
+		})
+	}
+
+	BeforeEach(func() {
+		tpl = testutils.NewMockTransportLayer()
+		txl = transaction.NewLayer(tpl, testutils.NewLogrusLogger(), transaction.WithAdmission(
+			func(req sip.Request) sip.Response {
+				if req.Method() == sip.OPTIONS {
+					return nil
+				}
+				return sip.NewReply(req, 403, "", "")
+			},
+		))
+	})
+	AfterEach(func(done Done) {
+		txl.Cancel()
+		<-txl.Done()
+		close(done)
+	}, 3)
+
+	It("should reject not admitted requests without transaction", func(done Done) {
+		defer close(done)
+
+		go func() {
+			tpl.InMsgs <- request(sip.INVITE)
+		}()
+		msg := <-tpl.OutMsgs
+		res, ok := msg.(sip.Response)
+		Expect(ok).To(BeTrue())
+		Expect(res.StatusCode()).To(Equal(sip.StatusCode(403)))
+		Expect(txl.Count()).To(BeZero())
+
+		go func() {
+			tpl.InMsgs <- request(sip.OPTIONS)
+		}()
+		Expect(<-txl.Requests()).ToNot(BeNil())
+
+		txl.SetAdmission(nil)
+		go func() {
+			tpl.InMsgs <- request(sip.INVITE)
+		}()
+		Expect(<-txl.Requests()).ToNot(BeNil())
+	}, 3)
+})
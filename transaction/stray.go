@@ -0,0 +1,108 @@
+package transaction
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// StrayResponseReason tells why the response is not accepted by client transactions.
+type StrayResponseReason string
+
+const (
+	// StrayUnmatched means no client transaction has the branch and the method of the response.
+	// Such responses are still passed up to the TU - RFC 3261 17.1.1.2.
+	StrayUnmatched StrayResponseReason = "unmatched"
+	// StrayMismatched means the response is matched to the client transaction by the branch,
+	// but does not echo CSeq or Via sent-by of the request, like the response spoofed over UDP
+	// by the attacker that guessed the branch. Such responses are dropped.
+	StrayMismatched StrayResponseReason = "mismatched"
+)
+
+// StrayResponseError describes the response that is not accepted by client transactions.
+type StrayResponseError struct {
+	Err      error
+	Reason   StrayResponseReason
+	Response sip.Response
+}
+
+func (err *StrayResponseError) Unwrap() error { return err.Err }
+func (err *StrayResponseError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	fields := log.Fields{
+		"reason":      err.Reason,
+		"source_addr": "???",
+	}
+	if err.Response != nil && err.Response.Source() != "" {
+		fields["source_addr"] = err.Response.Source()
+	}
+
+	return fmt.Sprintf("transaction.StrayResponseError<%s>: %s", fields, err.Err)
+}
+
+// StrayResponseHandler is called on each stray response, err is *StrayResponseError.
+// It is called synchronously from the transaction layer, so it must not block.
+type StrayResponseHandler func(res sip.Response, err error)
+
+// sentRequest identifies the request sent by the client transaction,
+// responses of the transaction must echo it - RFC 3261 8.1.3.3, 17.1.3.
+type sentRequest struct {
+	method sip.RequestMethod
+	seqNo  uint32
+	sentBy string
+}
+
+func newSentRequest(req sip.Request) sentRequest {
+	sent := sentRequest{method: req.Method()}
+	if cseq, ok := req.CSeq(); ok {
+		sent.seqNo = cseq.SeqNo
+	}
+	if viaHop, ok := req.ViaHop(); ok {
+		sent.sentBy = viaSentBy(viaHop)
+	}
+
+	return sent
+}
+
+// verify checks that the response echoes the request,
+// responses on CANCEL are matched to INVITE transaction and echo its sequence number - RFC 3261 9.1.
+func (sent sentRequest) verify(res sip.Response) error {
+	cseq, ok := res.CSeq()
+	if !ok {
+		return fmt.Errorf("'CSeq' header not found in response '%s'", res.Short())
+	}
+	if cseq.MethodName != sent.method && !(sent.method == sip.INVITE && cseq.MethodName == sip.CANCEL) {
+		return fmt.Errorf("CSeq method %s of response '%s' does not match request method %s",
+			cseq.MethodName, res.Short(), sent.method)
+	}
+	if cseq.SeqNo != sent.seqNo {
+		return fmt.Errorf("CSeq number %d of response '%s' does not match request number %d",
+			cseq.SeqNo, res.Short(), sent.seqNo)
+	}
+
+	viaHop, ok := res.ViaHop()
+	if !ok {
+		return fmt.Errorf("'Via' header not found or empty in response '%s'", res.Short())
+	}
+	if sentBy := viaSentBy(viaHop); sentBy != sent.sentBy {
+		return fmt.Errorf("Via sent-by %s of response '%s' does not match request sent-by %s",
+			sentBy, res.Short(), sent.sentBy)
+	}
+
+	return nil
+}
+
+// viaSentBy returns sent-by of the Via hop with the explicit port.
+func viaSentBy(viaHop *sip.ViaHop) string {
+	port := sip.DefaultPort(viaHop.Transport)
+	if viaHop.Port != nil {
+		port = *viaHop.Port
+	}
+
+	return fmt.Sprintf("%s:%d", strings.ToLower(viaHop.Host), port)
+}
@@ -27,8 +27,49 @@ const (
 	Timer_1xx = 200 * time.Millisecond
 	Timer_L   = 64 * T1
 	Timer_M   = 64 * T1
+	// Timer_C is a proxy INVITE transaction timeout - RFC 3261 16.6.
+	Timer_C = 3 * time.Minute
+
+	DefaultDrainRetryAfter = 30 * time.Second
 )
 
+// Timers are base values of transaction timers - RFC 3261 17 and Table 4.
+// Other timers are derived from them: A, E, G start at T1 and are capped at T2;
+// B, F, H, J, L, M are 64*T1; I is T4. Timer D is not derived and stays Timer_D.
+type Timers struct {
+	// T1 is an RTT estimate, default is T1.
+	T1 time.Duration
+	// T2 is a maximum retransmit interval for non-INVITE requests and INVITE responses, default is T2.
+	T2 time.Duration
+	// T4 is a maximum duration a message will remain in the network, default is T4.
+	T4 time.Duration
+}
+
+// DefaultTimers returns timers recommended by RFC 3261.
+func DefaultTimers() Timers {
+	return Timers{T1: T1, T2: T2, T4: T4}
+}
+
+// withDefaults fills zero timers with default values.
+func (t Timers) withDefaults() Timers {
+	if t.T1 <= 0 {
+		t.T1 = T1
+	}
+	if t.T2 <= 0 {
+		t.T2 = T2
+	}
+	if t.T4 <= 0 {
+		t.T4 = T4
+	}
+
+	return t
+}
+
+// timeout returns transaction timeout 64*T1 used by timers B, F, H, J, L, M.
+func (t Timers) timeout() time.Duration {
+	return 64 * t.T1
+}
+
 type TxError interface {
 	error
 	Key() TxKey
@@ -3,11 +3,14 @@ package transaction
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/discoviking/fsm"
 
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
 )
 
 type TxKey = sip.TransactionKey
@@ -33,14 +36,30 @@ type commonTx struct {
 	origin   sip.Request
 	tpl      sip.Transport
 	lastResp sip.Response
+	timers   Timers
+	// clock of the transaction timers, nil is the current clock of the timing package
+	clock timing.Clock
+	// bus receives timeouts of the transaction
+	bus eventbus.Bus
 
 	errs    chan error
 	lastErr error
 	done    chan bool
 
+	sip.ValueStore
+
 	log log.Logger
 }
 
+// afterFunc starts the transaction timer.
+func (tx *commonTx) afterFunc(d time.Duration, f func()) timing.Timer {
+	if tx.clock != nil {
+		return tx.clock.AfterFunc(d, f)
+	}
+
+	return timing.AfterFunc(d, f)
+}
+
 func (tx *commonTx) String() string {
 	if tx == nil {
 		return "<nil>"
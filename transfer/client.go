@@ -0,0 +1,294 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// State is a transfer progress state on the transferor side.
+type State int
+
+const (
+	// Init is a state before the response on REFER.
+	Init State = iota
+	// Accepted means that the transferee accepted REFER.
+	Accepted
+	// Proceeding means that the transferee received provisional response from the transfer target.
+	Proceeding
+	Succeeded
+	Failed
+)
+
+func (state State) String() string {
+	switch state {
+	case Init:
+		return "init"
+	case Accepted:
+		return "accepted"
+	case Proceeding:
+		return "proceeding"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Config describes transferor options.
+type Config struct {
+	// ReferredBy is added as Referred-By header - RFC 3892.
+	ReferredBy *sip.Address
+	Authorizer sip.Authorizer
+	// Headers are appended to REFER request.
+	Headers []sip.Header
+	// OnProgress is called on each NOTIFY with the status line of the transfer target response.
+	OnProgress func(t Transfer, code sip.StatusCode, reason string)
+	// OnDone is called once when the transfer is finished.
+	OnDone func(t Transfer)
+}
+
+// Transfer is the transferor side of the transfer - RFC 3515 2.4.
+type Transfer interface {
+	State() State
+	// Status returns the last reported status of the transfer target response.
+	Status() (sip.StatusCode, string)
+	Dialog() dialog.Dialog
+	ReferTo() *sip.Address
+	// Refer sends REFER request and waits for the response.
+	Refer(ctx context.Context) error
+	// Match checks that the NOTIFY request belongs to the implicit subscription of the transfer.
+	Match(req sip.Request) bool
+	// HandleNotify processes NOTIFY request with transfer progress and builds the response.
+	HandleNotify(req sip.Request) sip.Response
+	// Done returns channel that is closed when the transfer is succeeded or failed.
+	Done() <-chan struct{}
+	String() string
+}
+
+type transfer struct {
+	requester gosip.Requester
+	dlg       dialog.Dialog
+	referTo   *sip.Address
+	config    Config
+
+	mu         sync.RWMutex
+	event      event.Event
+	state      State
+	code       sip.StatusCode
+	reason     string
+	done       chan struct{}
+	finishOnce sync.Once
+
+	log log.Logger
+}
+
+// NewTransfer creates transfer of the dialog remote party to the referTo address.
+// Use AttendedReferTo for attended transfer.
+func NewTransfer(
+	requester gosip.Requester,
+	dlg dialog.Dialog,
+	referTo *sip.Address,
+	config Config,
+	logger log.Logger,
+) Transfer {
+	t := &transfer{
+		requester: requester,
+		dlg:       dlg,
+		referTo:   referTo,
+		config:    config,
+		done:      make(chan struct{}),
+	}
+	t.log = logger.
+		WithPrefix("transfer.Transfer").
+		WithFields(log.Fields{
+			"dialog_id":    dlg.ID(),
+			"transfer_ptr": fmt.Sprintf("%p", t),
+		})
+
+	return t
+}
+
+func (t *transfer) Log() log.Logger {
+	return t.log
+}
+
+func (t *transfer) String() string {
+	return fmt.Sprintf("Transfer<%s, %s>", t.referTo, t.State())
+}
+
+func (t *transfer) State() State {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.state
+}
+
+func (t *transfer) Status() (sip.StatusCode, string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.code, t.reason
+}
+
+func (t *transfer) Dialog() dialog.Dialog {
+	return t.dlg
+}
+
+func (t *transfer) ReferTo() *sip.Address {
+	return t.referTo
+}
+
+func (t *transfer) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *transfer) Refer(ctx context.Context) error {
+	hdrs := []sip.Header{ReferToHeader(t.referTo)}
+	if t.config.ReferredBy != nil {
+		hdrs = append(hdrs, &sip.GenericHeader{
+			HeaderName: "Referred-By",
+			Contents:   t.config.ReferredBy.String(),
+		})
+	}
+	for _, hdr := range t.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	req, err := t.dlg.NewRequest(sip.REFER, "", hdrs...)
+	if err != nil {
+		t.finish(Failed, 0, "")
+
+		return err
+	}
+
+	t.mu.Lock()
+	t.event = referEvent(req)
+	t.mu.Unlock()
+
+	options := make([]gosip.RequestWithContextOption, 0)
+	if t.config.Authorizer != nil {
+		options = append(options, gosip.WithAuthorizer(t.config.Authorizer))
+	}
+
+	res, err := t.requester.RequestWithContext(ctx, req, options...)
+	if err != nil {
+		if reqErr, ok := err.(*sip.RequestError); ok {
+			t.finish(Failed, sip.StatusCode(reqErr.Code), reqErr.Reason)
+		} else {
+			t.finish(Failed, 0, "")
+		}
+
+		return err
+	}
+
+	t.mu.Lock()
+	// authorized request is sent with another CSeq
+	if cseq, ok := res.CSeq(); ok {
+		t.event.ID = fmt.Sprintf("%d", cseq.SeqNo)
+	}
+	if t.state == Init {
+		t.state = Accepted
+	}
+	t.mu.Unlock()
+
+	return nil
+}
+
+func (t *transfer) Match(req sip.Request) bool {
+	if req.Method() != sip.NOTIFY || !t.dlg.Match(req) {
+		return false
+	}
+	evt, ok := event.GetEvent(req)
+	if !ok || evt.Package != EventPackage {
+		return false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// RFC 3515 2.4.6. id param can be omitted for the first REFER in the dialog
+	return t.event.Package != "" && (evt.ID == "" || evt.ID == t.event.ID)
+}
+
+func (t *transfer) HandleNotify(req sip.Request) sip.Response {
+	if !t.Match(req) {
+		return sip.NewResponseFromRequest("", req, 481, "Subscription Does Not Exist", "")
+	}
+
+	ss, ok := event.GetSubscriptionState(req)
+	if !ok {
+		return sip.NewResponseFromRequest("", req, 400, "Bad Request", "")
+	}
+	if err := t.dlg.ReceiveRequest(req); err != nil {
+		t.Log().WithFields(req.Fields()).Warnf("NOTIFY rejected: %s", err)
+
+		return sip.NewResponseFromRequest("", req, 500, "Server Internal Error", "")
+	}
+
+	var code sip.StatusCode
+	var reason string
+	if req.Body() != "" {
+		var err error
+		code, reason, err = ParseSipfrag(req.Body())
+		if err != nil {
+			t.Log().WithFields(req.Fields()).Warnf("NOTIFY rejected: %s", err)
+
+			return sip.NewResponseFromRequest("", req, 400, "Bad Request", "")
+		}
+	}
+
+	if code > 0 {
+		t.mu.Lock()
+		t.code, t.reason = code, reason
+		if code >= 180 && t.state < Proceeding {
+			t.state = Proceeding
+		} else if t.state == Init {
+			t.state = Accepted
+		}
+		t.mu.Unlock()
+
+		if t.config.OnProgress != nil {
+			t.config.OnProgress(t, code, reason)
+		}
+	}
+
+	switch {
+	case code >= 200 && code < 300:
+		t.finish(Succeeded, code, reason)
+	case code >= 300:
+		t.finish(Failed, code, reason)
+	case ss.State == event.Terminated:
+		// subscription is terminated without final status
+		t.finish(Failed, code, reason)
+	}
+
+	return sip.NewResponseFromRequest("", req, 200, "OK", "")
+}
+
+func (t *transfer) finish(state State, code sip.StatusCode, reason string) {
+	t.finishOnce.Do(func() {
+		t.mu.Lock()
+		t.state = state
+		if code > 0 {
+			t.code, t.reason = code, reason
+		}
+		t.mu.Unlock()
+
+		close(t.done)
+
+		t.Log().Debugf("transfer %s with '%d %s'", state, code, reason)
+
+		if t.config.OnDone != nil {
+			t.config.OnDone(t)
+		}
+	})
+}
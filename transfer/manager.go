@@ -0,0 +1,236 @@
+package transfer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// ManagerConfig describes transfer manager options.
+type ManagerConfig struct {
+	// Transfer is a template config of the outgoing transfers.
+	Transfer Config
+	// Referral is a template config of the incoming referrals, Dialog field is managed by the manager.
+	Referral ReferralConfig
+	// OnRefer is called on each incoming REFER,
+	// handler should Accept or Reject the referral through the transaction.
+	OnRefer func(ref Referral, tx sip.ServerTransaction)
+	// OutOfDialogRefer is a policy of REFER requests without To tag, like click-to-dial requests,
+	// by default they are rejected with 403.
+	OutOfDialogRefer event.OutOfDialogPolicy
+}
+
+// Manager sends and receives REFER requests and routes NOTIFY requests of the implicit subscriptions.
+type Manager interface {
+	// Blind transfers remote party of the dialog to the target.
+	Blind(ctx context.Context, dlg dialog.Dialog, target *sip.Address) (Transfer, error)
+	// Attended transfers remote party of the dialog to the remote party of the consultation dialog.
+	Attended(ctx context.Context, dlg, consultation dialog.Dialog) (Transfer, error)
+	// AddDialog registers existing dialog, so in-dialog REFER requests can be matched.
+	AddDialog(dlg dialog.Dialog)
+	// ServeRefer handles REFER request, can be passed directly to gosip.Server OnRequest.
+	ServeRefer(req sip.Request, tx sip.ServerTransaction)
+	// ServeNotify handles NOTIFY request of "refer" event package.
+	ServeNotify(req sip.Request, tx sip.ServerTransaction)
+	Transfers() []Transfer
+	Referrals() []Referral
+}
+
+type manager struct {
+	requester gosip.Requester
+	config    ManagerConfig
+
+	mu        sync.RWMutex
+	transfers map[Transfer]bool
+	referrals map[Referral]bool
+	dialogs   map[string]dialog.Dialog
+
+	log log.Logger
+}
+
+// NewManager creates transfer manager.
+func NewManager(requester gosip.Requester, config ManagerConfig, logger log.Logger) Manager {
+	m := &manager{
+		requester: requester,
+		config:    config,
+		transfers: make(map[Transfer]bool),
+		referrals: make(map[Referral]bool),
+		dialogs:   make(map[string]dialog.Dialog),
+	}
+	m.log = logger.WithPrefix("transfer.Manager")
+
+	return m
+}
+
+func (m *manager) Log() log.Logger {
+	return m.log
+}
+
+func (m *manager) Blind(ctx context.Context, dlg dialog.Dialog, target *sip.Address) (Transfer, error) {
+	return m.transfer(ctx, dlg, target)
+}
+
+func (m *manager) Attended(ctx context.Context, dlg, consultation dialog.Dialog) (Transfer, error) {
+	return m.transfer(ctx, dlg, AttendedReferTo(consultation))
+}
+
+func (m *manager) transfer(ctx context.Context, dlg dialog.Dialog, referTo *sip.Address) (Transfer, error) {
+	m.AddDialog(dlg)
+
+	t := NewTransfer(m.requester, dlg, referTo, m.config.Transfer, m.Log())
+
+	m.mu.Lock()
+	m.transfers[t] = true
+	m.mu.Unlock()
+
+	go func() {
+		<-t.Done()
+
+		m.mu.Lock()
+		delete(m.transfers, t)
+		m.mu.Unlock()
+	}()
+
+	if err := t.Refer(ctx); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (m *manager) AddDialog(dlg dialog.Dialog) {
+	m.mu.Lock()
+	if _, ok := m.dialogs[dlg.ID()]; ok {
+		m.mu.Unlock()
+		return
+	}
+	m.dialogs[dlg.ID()] = dlg
+	m.mu.Unlock()
+
+	go func() {
+		<-dlg.Done()
+
+		m.mu.Lock()
+		delete(m.dialogs, dlg.ID())
+		m.mu.Unlock()
+	}()
+}
+
+func (m *manager) Transfers() []Transfer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	transfers := make([]Transfer, 0, len(m.transfers))
+	for t := range m.transfers {
+		transfers = append(transfers, t)
+	}
+
+	return transfers
+}
+
+func (m *manager) Referrals() []Referral {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	referrals := make([]Referral, 0, len(m.referrals))
+	for ref := range m.referrals {
+		referrals = append(referrals, ref)
+	}
+
+	return referrals
+}
+
+func (m *manager) ServeNotify(req sip.Request, tx sip.ServerTransaction) {
+	var res sip.Response
+	if evt, ok := event.GetEvent(req); !ok || evt.Package != EventPackage {
+		res = sip.NewResponseFromRequest("", req, 489, "Bad Event", "")
+	} else {
+		for _, t := range m.Transfers() {
+			if t.Match(req) {
+				res = t.HandleNotify(req)
+				break
+			}
+		}
+	}
+	if res == nil {
+		res = sip.NewResponseFromRequest("", req, 481, "Subscription Does Not Exist", "")
+	}
+
+	m.respond(tx, res)
+}
+
+func (m *manager) ServeRefer(req sip.Request, tx sip.ServerTransaction) {
+	config := m.config.Referral
+	config.Dialog = nil
+
+	to, _ := req.To()
+	if to != nil && getTag(to.Params) != "" {
+		dialogID, err := sip.MakeDialogIDFromMessage(req)
+		if err != nil {
+			m.respond(tx, sip.NewResponseFromRequest("", req, 400, "Bad Request", ""))
+
+			return
+		}
+
+		m.mu.RLock()
+		dlg, ok := m.dialogs[dialogID]
+		m.mu.RUnlock()
+		if !ok {
+			m.respond(tx, sip.NewResponseFromRequest("", req, 481, "Call/Transaction Does Not Exist", ""))
+
+			return
+		}
+		config.Dialog = dlg
+	} else if res := m.config.OutOfDialogRefer.Check(req, 403, "Forbidden"); res != nil {
+		m.Log().WithFields(req.Fields()).Debugf("out-of-dialog REFER rejected with %d", res.StatusCode())
+		m.respond(tx, res)
+
+		return
+	}
+
+	ref, err := NewReferral(req, m.requester, config, m.Log())
+	if err != nil {
+		m.Log().WithFields(req.Fields()).Warnf("invalid REFER: %s", err)
+		m.respond(tx, sip.NewResponseFromRequest("", req, 400, "Bad Request", ""))
+
+		return
+	}
+
+	m.mu.Lock()
+	m.referrals[ref] = true
+	m.mu.Unlock()
+
+	go func() {
+		<-ref.Done()
+
+		m.mu.Lock()
+		delete(m.referrals, ref)
+		m.mu.Unlock()
+	}()
+
+	if m.config.OnRefer == nil {
+		_ = ref.Reject(tx, 603, "Decline")
+
+		return
+	}
+
+	m.config.OnRefer(ref, tx)
+
+	if dlg := ref.Dialog(); dlg != nil {
+		m.AddDialog(dlg)
+	}
+}
+
+func (m *manager) respond(tx sip.ServerTransaction, res sip.Response) {
+	if tx == nil {
+		return
+	}
+	if err := tx.Respond(res); err != nil {
+		m.Log().WithFields(res.Fields()).Errorf("respond '%s' failed: %s", res.Short(), err)
+	}
+}
@@ -0,0 +1,129 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// ReplacesConfig describes handling of the INVITE with Replaces header.
+type ReplacesConfig struct {
+	// Dialogs is the registry of the dialogs that can be replaced.
+	// Replaced dialog is torn down with dialog.Registry Hangup, so early dialogs of the UAS
+	// must be added with the hangup that rejects their INVITE.
+	Dialogs dialog.Registry
+	// OnReplace is called when the INVITE matches the dialog, e.g. to authorize call pickup.
+	// Returned *sip.RequestError rejects the INVITE with its code, other errors reject it with 603 Decline.
+	OnReplace func(req sip.Request, replaced dialog.Dialog) error
+}
+
+// ReplacesHandler handles INVITE with Replaces header on the UAS side - RFC 3891 3.
+// It completes attended transfer and call pickup by replacing the matched dialog with the new one.
+type ReplacesHandler interface {
+	// Match returns the dialog replaced by the INVITE, nil if the INVITE has no Replaces header.
+	// Failure is *sip.RequestError with the code the INVITE must be rejected with.
+	Match(req sip.Request) (dialog.Dialog, error)
+	// HandleInvite matches the INVITE and asks the application, the rejected INVITE is responded through the transaction.
+	// Replaced dialog is returned on accept, the application answers the INVITE and calls Complete.
+	HandleInvite(req sip.Request, tx sip.ServerTransaction) (dialog.Dialog, error)
+	// Complete tears down the replaced dialog when the new dialog is established.
+	Complete(ctx context.Context, replaced dialog.Dialog) error
+}
+
+type replacesHandler struct {
+	config ReplacesConfig
+
+	log log.Logger
+}
+
+// NewReplacesHandler creates handler of the INVITE with Replaces header.
+func NewReplacesHandler(config ReplacesConfig, logger log.Logger) ReplacesHandler {
+	h := &replacesHandler{
+		config: config,
+	}
+	h.log = logger.
+		WithPrefix("transfer.ReplacesHandler").
+		WithFields(log.Fields{
+			"replaces_handler_ptr": fmt.Sprintf("%p", h),
+		})
+
+	return h
+}
+
+func (h *replacesHandler) Log() log.Logger {
+	return h.log
+}
+
+func (h *replacesHandler) Match(req sip.Request) (dialog.Dialog, error) {
+	hdrs := req.GetHeaders("Replaces")
+	if len(hdrs) == 0 {
+		return nil, nil
+	}
+	if req.Method() != sip.INVITE || len(hdrs) > 1 {
+		return nil, sip.NewRequestError(400, "Bad Request", req, nil)
+	}
+
+	replaces, err := ParseReplaces(hdrs[0].Value())
+	if err != nil {
+		return nil, sip.NewRequestError(400, "Bad Request", req, nil)
+	}
+
+	dlg, ok := h.config.Dialogs.Get(replaces.DialogID())
+	if !ok {
+		return nil, sip.NewRequestError(481, "Call/Transaction Does Not Exist", req, nil)
+	}
+
+	switch dlg.State() {
+	case dialog.Terminated:
+		return nil, sip.NewRequestError(603, "Decline", req, nil)
+	case dialog.Confirmed:
+		if replaces.EarlyOnly {
+			return nil, sip.NewRequestError(486, "Busy Here", req, nil)
+		}
+	case dialog.Early:
+		// only early dialogs of incoming calls can be picked up
+		if dlg.IsUAC() {
+			return nil, sip.NewRequestError(481, "Call/Transaction Does Not Exist", req, nil)
+		}
+	}
+
+	return dlg, nil
+}
+
+func (h *replacesHandler) HandleInvite(req sip.Request, tx sip.ServerTransaction) (dialog.Dialog, error) {
+	dlg, err := h.Match(req)
+	if err == nil && dlg != nil && h.config.OnReplace != nil {
+		err = h.config.OnReplace(req, dlg)
+	}
+	if err == nil {
+		if dlg != nil {
+			h.Log().WithFields(req.Fields()).Debugf("INVITE replaces %s", dlg)
+		}
+
+		return dlg, nil
+	}
+
+	var reqErr *sip.RequestError
+	if !errors.As(err, &reqErr) {
+		reqErr = sip.NewRequestError(603, "Decline", req, nil)
+	}
+
+	h.Log().WithFields(req.Fields()).Debugf("INVITE with Replaces rejected: %s", err)
+	if err := tx.Respond(newResponse(req, sip.StatusCode(reqErr.Code), reqErr.Reason)); err != nil {
+		return nil, err
+	}
+
+	return nil, err
+}
+
+func (h *replacesHandler) Complete(ctx context.Context, replaced dialog.Dialog) error {
+	if replaced.State() == dialog.Terminated {
+		return nil
+	}
+
+	return h.config.Dialogs.Hangup(ctx, replaced.ID())
+}
@@ -0,0 +1,156 @@
+package transfer_test
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/transfer"
+)
+
+var _ = Describe("ReplacesHandler", func() {
+	var (
+		registry dialog.Registry
+		handler  transfer.ReplacesHandler
+		byes     chan sip.Request
+	)
+
+	newInvite := func(replaces string) sip.Request {
+		lines := []string{
+			"INVITE sip:bob@10.0.0.2 SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.3:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:carol@example.com>;tag=carol-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: pickup-call",
+			"CSeq: 1 INVITE",
+		}
+		if replaces != "" {
+			lines = append(lines, "Replaces: "+replaces)
+		}
+		return testutils.Request(append(lines, "", ""))
+	}
+
+	BeforeEach(func() {
+		byes = make(chan sip.Request, 10)
+		requester := testutils.NewLoopback()
+		_ = requester.OnRequest(sip.BYE, func(req sip.Request, tx sip.ServerTransaction) {
+			byes <- req
+			_ = tx.Respond(sip.NewResponseFromRequest("", req, 200, "OK", ""))
+		})
+		registry = dialog.NewRegistry(requester, dialog.RegistryConfig{}, testutils.NewLogrusLogger())
+		handler = transfer.NewReplacesHandler(transfer.ReplacesConfig{Dialogs: registry}, testutils.NewLogrusLogger())
+	})
+
+	It("should replace the confirmed dialog and release it with BYE", func() {
+		_, bobDlg := newDialogs("replaced-call")
+		Expect(registry.Add(bobDlg, nil)).To(Succeed())
+
+		req := newInvite("replaced-call;to-tag=bob-tag;from-tag=alice-tag")
+		tx := testutils.NewMockServerTx(req)
+		replaced, err := handler.HandleInvite(req, tx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(replaced).To(Equal(bobDlg))
+		Expect(tx.Response()).To(BeNil())
+
+		Expect(handler.Complete(context.Background(), replaced)).To(Succeed())
+		Eventually(byes).Should(Receive())
+		Expect(bobDlg.State()).To(Equal(dialog.Terminated))
+		Expect(registry.Count()).To(BeZero())
+	})
+
+	It("should reject INVITE that does not match the replaceable dialog", func() {
+		aliceDlg, bobDlg := newDialogs("replaced-call")
+		Expect(registry.Add(aliceDlg, nil)).To(Succeed())
+		Expect(registry.Add(bobDlg, nil)).To(Succeed())
+
+		replaced, err := handler.Match(newInvite(""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(replaced).To(BeNil())
+
+		for replaces, code := range map[string]uint{
+			"unknown-call;to-tag=bob-tag;from-tag=alice-tag":             481,
+			"replaced-call;to-tag=bob-tag":                               400,
+			"replaced-call;to-tag=bob-tag;from-tag=alice-tag;early-only": 486,
+		} {
+			req := newInvite(replaces)
+			tx := testutils.NewMockServerTx(req)
+			_, err := handler.HandleInvite(req, tx)
+			reqErr, ok := err.(*sip.RequestError)
+			Expect(ok).To(BeTrue(), replaces)
+			Expect(reqErr.Code).To(Equal(code), replaces)
+			Expect(tx.Response().StatusCode()).To(Equal(sip.StatusCode(code)), replaces)
+			to, _ := tx.Response().To()
+			Expect(to.Params.Has("tag")).To(BeTrue())
+		}
+	})
+
+	It("should pick up the early dialog of the incoming call only", func() {
+		invite := testutils.Request([]string{
+			"INVITE sip:bob@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>",
+			"Call-ID: ringing-call",
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+		ringing := testutils.Response([]string{
+			"SIP/2.0 180 Ringing",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1",
+			"From: <sip:alice@example.com>;tag=alice-tag",
+			"To: <sip:bob@example.com>;tag=bob-tag",
+			"Call-ID: ringing-call",
+			"CSeq: 1 INVITE",
+			"",
+			"",
+		})
+		incoming, err := dialog.NewUASDialog(invite, ringing, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		outgoing, err := dialog.NewUACDialog(invite, ringing, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+
+		rejected := make(chan dialog.Dialog, 1)
+		Expect(registry.Add(incoming, func(ctx context.Context, dlg dialog.Dialog) error {
+			// the ringing INVITE is rejected with 487 by the application
+			rejected <- dlg
+			return nil
+		})).To(Succeed())
+		Expect(registry.Add(outgoing, nil)).To(Succeed())
+
+		_, err = handler.Match(newInvite("ringing-call;to-tag=alice-tag;from-tag=bob-tag"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*sip.RequestError).Code).To(Equal(uint(481)))
+
+		replaced, err := handler.Match(newInvite("ringing-call;to-tag=bob-tag;from-tag=alice-tag;early-only"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler.Complete(context.Background(), replaced)).To(Succeed())
+		Expect(rejected).To(Receive(Equal(incoming)))
+		Expect(incoming.State()).To(Equal(dialog.Terminated))
+		Consistently(byes).ShouldNot(Receive())
+	})
+
+	It("should reject the replacement declined by the application", func() {
+		handler = transfer.NewReplacesHandler(transfer.ReplacesConfig{
+			Dialogs: registry,
+			OnReplace: func(req sip.Request, replaced dialog.Dialog) error {
+				return fmt.Errorf("pickup is not allowed")
+			},
+		}, testutils.NewLogrusLogger())
+
+		_, bobDlg := newDialogs("replaced-call")
+		Expect(registry.Add(bobDlg, nil)).To(Succeed())
+
+		req := newInvite("replaced-call;to-tag=bob-tag;from-tag=alice-tag")
+		tx := testutils.NewMockServerTx(req)
+		_, err := handler.HandleInvite(req, tx)
+		Expect(err).To(HaveOccurred())
+		Expect(tx.Response().StatusCode()).To(Equal(sip.StatusCode(603)))
+		Expect(bobDlg.State()).To(Equal(dialog.Confirmed))
+	})
+})
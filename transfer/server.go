@@ -0,0 +1,299 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip"
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/eventbus"
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// ReferralConfig describes transferee options.
+type ReferralConfig struct {
+	// Contact is added to the response on out-of-dialog REFER.
+	Contact *sip.ContactHeader
+	// Expires is a duration of the implicit subscription, default is DefaultExpires.
+	Expires time.Duration
+	// Headers are appended to each NOTIFY request.
+	Headers []sip.Header
+	// Dialog is the dialog of in-dialog REFER, a new dialog is created on accept of out-of-dialog REFER.
+	Dialog dialog.Dialog
+	// OnDone is called once when the final NOTIFY is sent or the referral is rejected.
+	OnDone func(ref Referral)
+	// EventBus receives creation and termination of the dialog of out-of-dialog REFER, default is eventbus.Default.
+	EventBus eventbus.Bus
+}
+
+// Referral is the transferee side of the transfer - RFC 3515 2.4.2.
+// Application accepts the referral, sends INVITE to the Target with Replaces header if any
+// and reports the progress with Notify.
+type Referral interface {
+	Request() sip.Request
+	Dialog() dialog.Dialog
+	ReferTo() *sip.Address
+	// Target returns Refer-To URI without embedded headers.
+	Target() sip.Uri
+	// Replaces returns Replaces header embedded into Refer-To URI for attended transfer.
+	Replaces() (Replaces, bool)
+	// ReferredBy returns value of Referred-By header.
+	ReferredBy() (*sip.Address, bool)
+	// Accept responds with 202 and sends NOTIFY with "100 Trying" status - RFC 3515 2.4.4.
+	Accept(ctx context.Context, tx sip.ServerTransaction) error
+	// Reject responds on REFER with the failure response.
+	Reject(tx sip.ServerTransaction, code sip.StatusCode, reason string) error
+	// Notify reports the status of the transfer target response,
+	// final status terminates the implicit subscription - RFC 3515 2.4.5.
+	Notify(ctx context.Context, code sip.StatusCode, reason string) error
+	Done() <-chan struct{}
+	String() string
+}
+
+type referral struct {
+	requester gosip.Requester
+	request   sip.Request
+	referTo   *sip.Address
+	config    ReferralConfig
+	event     event.Event
+
+	mu         sync.RWMutex
+	dlg        dialog.Dialog
+	accepted   bool
+	expiresAt  time.Time
+	done       chan struct{}
+	finishOnce sync.Once
+
+	log log.Logger
+}
+
+// NewReferral creates transferee side of the transfer from the REFER request.
+func NewReferral(req sip.Request, requester gosip.Requester, config ReferralConfig, logger log.Logger) (Referral, error) {
+	if req.Method() != sip.REFER {
+		return nil, fmt.Errorf("request '%s' is not REFER", req.Short())
+	}
+	referTo, err := GetReferTo(req)
+	if err != nil {
+		return nil, err
+	}
+	if config.Expires <= 0 {
+		config.Expires = DefaultExpires
+	}
+
+	ref := &referral{
+		requester: requester,
+		request:   req,
+		referTo:   referTo,
+		config:    config,
+		event:     referEvent(req),
+		dlg:       config.Dialog,
+		done:      make(chan struct{}),
+	}
+	ref.log = logger.
+		WithPrefix("transfer.Referral").
+		WithFields(log.Fields{
+			"refer_to":     referTo.String(),
+			"referral_ptr": fmt.Sprintf("%p", ref),
+		})
+
+	return ref, nil
+}
+
+func (ref *referral) Log() log.Logger {
+	return ref.log
+}
+
+func (ref *referral) String() string {
+	return fmt.Sprintf("Referral<%s>", ref.referTo)
+}
+
+func (ref *referral) Request() sip.Request {
+	return ref.request
+}
+
+func (ref *referral) Dialog() dialog.Dialog {
+	ref.mu.RLock()
+	defer ref.mu.RUnlock()
+
+	return ref.dlg
+}
+
+func (ref *referral) ReferTo() *sip.Address {
+	return ref.referTo
+}
+
+func (ref *referral) Target() sip.Uri {
+	uri := ref.referTo.Uri.Clone()
+	uri.SetHeaders(sip.NewParams())
+
+	return uri
+}
+
+func (ref *referral) Replaces() (Replaces, bool) {
+	headers := ref.referTo.Uri.Headers()
+	if headers == nil {
+		return Replaces{}, false
+	}
+	for _, key := range headers.Keys() {
+		if !strings.EqualFold(key, "Replaces") {
+			continue
+		}
+		val, ok := headers.Get(key)
+		if !ok || val == nil {
+			return Replaces{}, false
+		}
+		r, err := ParseReplaces(val.String())
+		if err != nil {
+			return Replaces{}, false
+		}
+
+		return r, true
+	}
+
+	return Replaces{}, false
+}
+
+func (ref *referral) ReferredBy() (*sip.Address, bool) {
+	hdrs := ref.request.GetHeaders("Referred-By")
+	if len(hdrs) == 0 {
+		hdrs = ref.request.GetHeaders("b")
+	}
+	if len(hdrs) == 0 {
+		return nil, false
+	}
+
+	displayName, uri, params, err := parser.ParseAddressValue(hdrs[0].Value())
+	if err != nil {
+		return nil, false
+	}
+
+	return &sip.Address{DisplayName: displayName, Uri: uri, Params: params}, true
+}
+
+func (ref *referral) Done() <-chan struct{} {
+	return ref.done
+}
+
+func (ref *referral) Accept(ctx context.Context, tx sip.ServerTransaction) error {
+	ref.mu.Lock()
+	if ref.accepted {
+		ref.mu.Unlock()
+
+		return fmt.Errorf("%s is already accepted", ref)
+	}
+
+	res := newResponse(ref.request, 202, "Accepted")
+	if ref.config.Contact != nil {
+		res.AppendHeader(ref.config.Contact.Clone())
+	}
+	if ref.dlg == nil {
+		dlg, err := dialog.NewUASDialog(ref.request, res, ref.Log(), dialog.WithEventBus(ref.config.EventBus))
+		if err != nil {
+			ref.mu.Unlock()
+
+			return err
+		}
+		ref.dlg = dlg
+	} else if err := ref.dlg.ReceiveRequest(ref.request); err != nil {
+		ref.mu.Unlock()
+		_ = tx.Respond(sip.NewResponseFromRequest("", ref.request, 500, "Server Internal Error", ""))
+
+		return err
+	}
+	ref.dlg.AddUsage()
+	ref.accepted = true
+	ref.expiresAt = timing.Now().Add(ref.config.Expires)
+	ref.mu.Unlock()
+
+	if err := tx.Respond(res); err != nil {
+		ref.finish()
+
+		return err
+	}
+
+	return ref.Notify(ctx, 100, "Trying")
+}
+
+func (ref *referral) Reject(tx sip.ServerTransaction, code sip.StatusCode, reason string) error {
+	ref.finish()
+
+	return tx.Respond(newResponse(ref.request, code, reason))
+}
+
+func (ref *referral) Notify(ctx context.Context, code sip.StatusCode, reason string) error {
+	ref.mu.RLock()
+	accepted, dlg, expiresAt := ref.accepted, ref.dlg, ref.expiresAt
+	ref.mu.RUnlock()
+
+	if !accepted {
+		return fmt.Errorf("%s is not accepted", ref)
+	}
+	select {
+	case <-ref.done:
+		return fmt.Errorf("%s is done", ref)
+	default:
+	}
+
+	ss := event.SubscriptionState{State: event.Active}
+	if code >= 200 {
+		ss = event.SubscriptionState{State: event.Terminated, Reason: event.ReasonNoResource}
+	} else if expires := expiresAt.Sub(timing.Now()); expires > 0 {
+		ss.Expires = expires
+	} else {
+		ss = event.SubscriptionState{State: event.Terminated, Reason: event.ReasonTimeout}
+	}
+
+	ct := sip.ContentType(SipfragContentType)
+	hdrs := []sip.Header{
+		ref.event.Header(),
+		ss.Header(),
+		&ct,
+	}
+	for _, hdr := range ref.config.Headers {
+		hdrs = append(hdrs, hdr.Clone())
+	}
+
+	req, err := dlg.NewRequest(sip.NOTIFY, Sipfrag(code, reason), hdrs...)
+	if err != nil {
+		return err
+	}
+
+	if ss.State == event.Terminated {
+		defer ref.finish()
+	}
+
+	_, err = ref.requester.RequestWithContext(ctx, req)
+	if err != nil {
+		// RFC 3515 2.4.5. the transferor is not interested in progress anymore
+		ref.finish()
+	}
+
+	return err
+}
+
+func (ref *referral) finish() {
+	ref.finishOnce.Do(func() {
+		ref.mu.RLock()
+		dlg, accepted := ref.dlg, ref.accepted
+		ref.mu.RUnlock()
+
+		if dlg != nil && accepted {
+			dlg.ReleaseUsage()
+		}
+
+		close(ref.done)
+
+		ref.Log().Debug("referral done")
+
+		if ref.config.OnDone != nil {
+			ref.config.OnDone(ref)
+		}
+	})
+}
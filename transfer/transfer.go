@@ -0,0 +1,187 @@
+// transfer package implements call transfer with REFER method - RFC 3515, RFC 5589.
+// Blind transfer sends REFER with the target URI in Refer-To header,
+// attended transfer embeds Replaces header of the consultation dialog into Refer-To URI - RFC 3891.
+// Transfer progress is reported by NOTIFY requests of the implicit "refer" subscription with message/sipfrag bodies.
+package transfer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/util"
+)
+
+const (
+	EventPackage       = "refer"
+	SipfragContentType = "message/sipfrag"
+
+	// DefaultExpires is a duration of the implicit subscription granted by the transferee.
+	DefaultExpires = time.Minute
+)
+
+// Replaces is a value of the Replaces header - RFC 3891 6.1.
+// Tags are from the perspective of the UA that receives the header.
+type Replaces struct {
+	CallID    sip.CallID
+	ToTag     string
+	FromTag   string
+	EarlyOnly bool
+}
+
+func (r Replaces) String() string {
+	str := fmt.Sprintf("%s;to-tag=%s;from-tag=%s", string(r.CallID), r.ToTag, r.FromTag)
+	if r.EarlyOnly {
+		str += ";early-only"
+	}
+
+	return str
+}
+
+func (r Replaces) Header() sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Replaces",
+		Contents:   r.String(),
+	}
+}
+
+// DialogID returns ID of the replaced dialog as it is seen by the UA that receives the header.
+func (r Replaces) DialogID() string {
+	return sip.MakeDialogID(string(r.CallID), r.ToTag, r.FromTag)
+}
+
+// ParseReplaces parses Replaces header value.
+func ParseReplaces(value string) (Replaces, error) {
+	parts := strings.Split(value, ";")
+	r := Replaces{CallID: sip.CallID(strings.TrimSpace(parts[0]))}
+	if r.CallID == "" {
+		return r, fmt.Errorf("empty Call-ID in Replaces '%s'", value)
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		switch strings.ToLower(kv[0]) {
+		case "to-tag":
+			if len(kv) == 2 {
+				r.ToTag = kv[1]
+			}
+		case "from-tag":
+			if len(kv) == 2 {
+				r.FromTag = kv[1]
+			}
+		case "early-only":
+			r.EarlyOnly = true
+		}
+	}
+	if r.ToTag == "" || r.FromTag == "" {
+		return r, fmt.Errorf("missing tags in Replaces '%s'", value)
+	}
+
+	return r, nil
+}
+
+// ReplacesOf builds Replaces of the dialog that is sent to the remote side of the dialog.
+func ReplacesOf(dlg dialog.Dialog) Replaces {
+	return Replaces{
+		CallID:  dlg.CallID(),
+		ToTag:   dlg.RemoteTag(),
+		FromTag: dlg.LocalTag(),
+	}
+}
+
+// AttendedReferTo builds Refer-To address for attended transfer - RFC 5589 7.
+// URI is the remote URI of the consultation dialog with embedded Replaces header.
+func AttendedReferTo(consultation dialog.Dialog) *sip.Address {
+	uri := consultation.RemoteUri().Clone()
+	headers := sip.NewParams()
+	if uri.Headers() != nil {
+		headers = uri.Headers().Clone()
+	}
+	headers.Add("Replaces", sip.String{Str: ReplacesOf(consultation).String()})
+	uri.SetHeaders(headers)
+
+	return &sip.Address{Uri: uri}
+}
+
+// ReferToHeader builds Refer-To header with the address.
+func ReferToHeader(addr *sip.Address) sip.Header {
+	return &sip.GenericHeader{
+		HeaderName: "Refer-To",
+		Contents:   addr.String(),
+	}
+}
+
+// GetReferTo returns parsed Refer-To address of the REFER request, also matches compact form 'r'.
+func GetReferTo(req sip.Request) (*sip.Address, error) {
+	hdrs := req.GetHeaders("Refer-To")
+	if len(hdrs) == 0 {
+		hdrs = req.GetHeaders("r")
+	}
+	if len(hdrs) != 1 {
+		return nil, fmt.Errorf("request '%s' must have exactly one 'Refer-To' header", req.Short())
+	}
+
+	displayName, uri, params, err := parser.ParseAddressValue(hdrs[0].Value())
+	if err != nil {
+		return nil, fmt.Errorf("parse 'Refer-To' header: %w", err)
+	}
+
+	return &sip.Address{DisplayName: displayName, Uri: uri, Params: params}, nil
+}
+
+// Sipfrag builds message/sipfrag body with the status line - RFC 3420.
+func Sipfrag(code sip.StatusCode, reason string) string {
+	return fmt.Sprintf("SIP/2.0 %d %s", code, reason)
+}
+
+// ParseSipfrag parses status line of the message/sipfrag body.
+func ParseSipfrag(body string) (sip.StatusCode, string, error) {
+	line := strings.TrimSpace(strings.SplitN(body, "\n", 2)[0])
+	_, code, reason, err := parser.ParseStatusLine(line)
+	if err != nil {
+		return 0, "", fmt.Errorf("parse sipfrag: %w", err)
+	}
+	if code < 100 || code > 699 {
+		return 0, "", fmt.Errorf("parse sipfrag: invalid status code %d", code)
+	}
+
+	return code, reason, nil
+}
+
+func referEvent(req sip.Request) event.Event {
+	evt := event.Event{Package: EventPackage}
+	if cseq, ok := req.CSeq(); ok {
+		evt.ID = fmt.Sprintf("%d", cseq.SeqNo)
+	}
+
+	return evt
+}
+
+// newResponse builds response on the dialog creating request with To tag.
+func newResponse(req sip.Request, code sip.StatusCode, reason string) sip.Response {
+	res := sip.NewResponseFromRequest("", req, code, reason, "")
+	if to, ok := res.To(); ok && getTag(to.Params) == "" {
+		to := to.Clone().(*sip.ToHeader)
+		if to.Params == nil {
+			to.Params = sip.NewParams()
+		}
+		to.Params.Add("tag", sip.String{Str: util.RandString(8)})
+		res.ReplaceHeaders("To", []sip.Header{to})
+	}
+
+	return res
+}
+
+func getTag(params sip.Params) string {
+	if params == nil {
+		return ""
+	}
+	if tag, ok := params.Get("tag"); ok && tag != nil {
+		return tag.String()
+	}
+
+	return ""
+}
@@ -0,0 +1,231 @@
+package transfer_test
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/dialog"
+	"github.com/ghettovoice/gosip/event"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/transfer"
+)
+
+func newDialogs(callID string) (dialog.Dialog, dialog.Dialog) {
+	invite := testutils.Request([]string{
+		"INVITE sip:bob@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+		"From: <sip:alice@example.com>;tag=alice-tag",
+		"To: <sip:bob@example.com>",
+		"Call-ID: " + callID,
+		"CSeq: 1 INVITE",
+		"Contact: <sip:alice@10.0.0.1>",
+		"",
+		"",
+	})
+	ok := testutils.Response([]string{
+		"SIP/2.0 200 OK",
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1",
+		"From: <sip:alice@example.com>;tag=alice-tag",
+		"To: <sip:bob@example.com>;tag=bob-tag",
+		"Call-ID: " + callID,
+		"CSeq: 1 INVITE",
+		"Contact: <sip:bob@10.0.0.2>",
+		"",
+		"",
+	})
+	logger := testutils.NewLogrusLogger()
+	uac, err := dialog.NewUACDialog(invite, ok, logger)
+	Expect(err).ToNot(HaveOccurred())
+	uas, err := dialog.NewUASDialog(invite, ok, logger)
+	Expect(err).ToNot(HaveOccurred())
+	// INVITE session usage
+	uac.AddUsage()
+	uas.AddUsage()
+
+	return uac, uas
+}
+
+var _ = Describe("Transfer", func() {
+	It("should build and parse Refer-To with Replaces", func() {
+		_, consultation := newDialogs("consult-call")
+		referTo := transfer.AttendedReferTo(consultation)
+
+		req := testutils.Request([]string{
+			"REFER sip:bob@10.0.0.2 SIP/2.0",
+			"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+			"From: <sip:alice@example.com>;tag=a",
+			"To: <sip:bob@example.com>",
+			"Call-ID: refer-call",
+			"CSeq: 1 REFER",
+			"Refer-To: " + referTo.String(),
+			"",
+			"",
+		})
+		ref, err := transfer.NewReferral(req, nil, transfer.ReferralConfig{}, testutils.NewLogrusLogger())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref.Target().String()).To(Equal("sip:alice@example.com"))
+
+		replaces, ok := ref.Replaces()
+		Expect(ok).To(BeTrue())
+		Expect(replaces).To(Equal(transfer.Replaces{CallID: "consult-call", ToTag: "alice-tag", FromTag: "bob-tag"}))
+		// seen from the consultation dialog peer
+		uac, _ := newDialogs("consult-call")
+		Expect(replaces.DialogID()).To(Equal(uac.ID()))
+
+		code, reason, err := transfer.ParseSipfrag("SIP/2.0 180 Ringing\r\n")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(code).To(Equal(sip.StatusCode(180)))
+		Expect(reason).To(Equal("Ringing"))
+	})
+
+	Describe("Manager", func() {
+		var (
+			alice, bob   transfer.Manager
+			aliceDlg     dialog.Dialog
+			bobDlg       dialog.Dialog
+			referrals    chan transfer.Referral
+			progress     chan sip.StatusCode
+			acceptRefers bool
+		)
+
+		BeforeEach(func() {
+			logger := testutils.NewLogrusLogger()
+			referrals = make(chan transfer.Referral, 10)
+			progress = make(chan sip.StatusCode, 10)
+			acceptRefers = true
+			aliceDlg, bobDlg = newDialogs("call-1")
+
+			toAlice := testutils.NewLoopback()
+			toBob := testutils.NewLoopback()
+
+			alice = transfer.NewManager(toBob, transfer.ManagerConfig{
+				Transfer: transfer.Config{
+					OnProgress: func(t transfer.Transfer, code sip.StatusCode, reason string) {
+						progress <- code
+					},
+				},
+			}, logger)
+			bob = transfer.NewManager(toAlice, transfer.ManagerConfig{
+				OnRefer: func(ref transfer.Referral, tx sip.ServerTransaction) {
+					if acceptRefers {
+						Expect(ref.Accept(context.Background(), tx)).To(Succeed())
+					} else {
+						Expect(ref.Reject(tx, 603, "Decline")).To(Succeed())
+					}
+					referrals <- ref
+				},
+			}, logger)
+			bob.AddDialog(bobDlg)
+
+			_ = toAlice.OnRequest(sip.NOTIFY, alice.ServeNotify)
+			_ = toBob.OnRequest(sip.REFER, bob.ServeRefer)
+		})
+
+		It("should perform blind transfer", func() {
+			carol := &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "carol"}, FHost: "example.com"}}
+			t, err := alice.Blind(context.Background(), aliceDlg, carol)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(<-progress).To(Equal(sip.StatusCode(100)))
+			Expect(t.State()).To(Equal(transfer.Accepted))
+
+			ref := <-referrals
+			Expect(ref.Dialog()).To(Equal(bobDlg))
+			Expect(ref.Target().String()).To(Equal("sip:carol@example.com"))
+			_, ok := ref.Replaces()
+			Expect(ok).To(BeFalse())
+
+			Expect(ref.Notify(context.Background(), 180, "Ringing")).To(Succeed())
+			Expect(<-progress).To(Equal(sip.StatusCode(180)))
+			Expect(t.State()).To(Equal(transfer.Proceeding))
+
+			Expect(ref.Notify(context.Background(), 200, "OK")).To(Succeed())
+			Expect(<-progress).To(Equal(sip.StatusCode(200)))
+			Eventually(t.Done()).Should(BeClosed())
+			Eventually(ref.Done()).Should(BeClosed())
+			Expect(t.State()).To(Equal(transfer.Succeeded))
+			Eventually(alice.Transfers).Should(BeEmpty())
+			// INVITE session usage is kept
+			Expect(bobDlg.Usages()).To(Equal(1))
+		})
+
+		It("should report failed attended transfer", func() {
+			_, consultation := newDialogs("consult-call")
+			t, err := alice.Attended(context.Background(), aliceDlg, consultation)
+			Expect(err).ToNot(HaveOccurred())
+			<-progress
+
+			ref := <-referrals
+			replaces, ok := ref.Replaces()
+			Expect(ok).To(BeTrue())
+			Expect(replaces.CallID).To(Equal(sip.CallID("consult-call")))
+
+			Expect(ref.Notify(context.Background(), 486, "Busy Here")).To(Succeed())
+			Eventually(t.Done()).Should(BeClosed())
+			Expect(t.State()).To(Equal(transfer.Failed))
+			code, reason := t.Status()
+			Expect(code).To(Equal(sip.StatusCode(486)))
+			Expect(reason).To(Equal("Busy Here"))
+		})
+
+		It("should fail rejected transfer", func() {
+			acceptRefers = false
+			carol := &sip.Address{Uri: &sip.SipUri{FUser: sip.String{Str: "carol"}, FHost: "example.com"}}
+			_, err := alice.Blind(context.Background(), aliceDlg, carol)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*sip.RequestError).Code).To(Equal(uint(603)))
+			Eventually(alice.Transfers).Should(BeEmpty())
+		})
+
+		It("should apply out-of-dialog REFER policy", func() {
+			refer := func(from string) sip.Request {
+				return testutils.Request([]string{
+					"REFER sip:bob@10.0.0.2 SIP/2.0",
+					"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=" + sip.GenerateBranch(),
+					"From: <sip:" + from + "@example.com>;tag=a",
+					"To: <sip:bob@example.com>",
+					"Call-ID: click-to-dial",
+					"CSeq: 1 REFER",
+					"Refer-To: <sip:carol@example.com>",
+					"",
+					"",
+				})
+			}
+			serve := func(m transfer.Manager, req sip.Request) sip.StatusCode {
+				tx := testutils.NewMockServerTx(req)
+				m.ServeRefer(req, tx)
+				return tx.Response().StatusCode()
+			}
+
+			Expect(serve(bob, refer("alice"))).To(Equal(sip.StatusCode(403)))
+			Expect(referrals).ToNot(Receive())
+
+			m := transfer.NewManager(nil, transfer.ManagerConfig{
+				OutOfDialogRefer: event.OutOfDialogPolicy{
+					Accept: true,
+					Authorize: func(req sip.Request) error {
+						if from, _ := req.From(); from.Address.User().String() != "portal" {
+							return errors.New("unknown referrer")
+						}
+						return nil
+					},
+				},
+				OnRefer: func(ref transfer.Referral, tx sip.ServerTransaction) {
+					Expect(ref.Reject(tx, 603, "Decline")).To(Succeed())
+					referrals <- ref
+				},
+			}, testutils.NewLogrusLogger())
+
+			Expect(serve(m, refer("alice"))).To(Equal(sip.StatusCode(403)))
+			Expect(referrals).ToNot(Receive())
+			Expect(serve(m, refer("portal"))).To(Equal(sip.StatusCode(603)))
+			var ref transfer.Referral
+			Expect(referrals).To(Receive(&ref))
+			Expect(ref.Dialog()).To(BeNil())
+			Expect(ref.Target().String()).To(Equal("sip:carol@example.com"))
+		})
+	})
+})
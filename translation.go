@@ -0,0 +1,137 @@
+package gosip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// TranslatedFromField is a field of the translated response with the original status code.
+const TranslatedFromField = "translated_from"
+
+// ResponseTranslation rewrites responses sent to the peer.
+type ResponseTranslation struct {
+	// Codes translates codes of final error responses, like 480 to 486 for peers that do not retry on 480.
+	// Both codes must be 300-699, since codes of provisional and successful responses drive transactions and dialogs.
+	Codes map[sip.StatusCode]sip.StatusCode
+	// Reasons replaces reason phrases of codes after the translation of codes.
+	Reasons map[sip.StatusCode]string
+	// StripReasons replaces reason phrases of error responses by default phrases of codes
+	// and removes Warning and Reason headers, so details of failures are not leaked to untrusted peers.
+	StripReasons bool
+}
+
+// ResponseTranslationRule applies the translation to peers.
+type ResponseTranslationRule struct {
+	// Peers lists networks of peers in CIDR notation or single IP addresses.
+	Peers       []string
+	Translation ResponseTranslation
+}
+
+// ResponseTranslationConfig describes translation of responses sent by the server,
+// including responses of transactions sent by handlers.
+type ResponseTranslationConfig struct {
+	// Translation of responses to all peers.
+	Translation ResponseTranslation
+	// Exceptions override Translation for peers, the first rule with the network of the peer wins.
+	Exceptions []ResponseTranslationRule
+}
+
+type responseTranslationRule struct {
+	peers       []*net.IPNet
+	translation ResponseTranslation
+}
+
+// responseTranslation is a parsed ResponseTranslationConfig.
+type responseTranslation struct {
+	translation ResponseTranslation
+	exceptions  []responseTranslationRule
+}
+
+func (config *ResponseTranslationConfig) compile() (*responseTranslation, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	if err := config.Translation.validate(); err != nil {
+		return nil, err
+	}
+	rt := &responseTranslation{translation: config.Translation}
+	for i, rule := range config.Exceptions {
+		if err := rule.Translation.validate(); err != nil {
+			return nil, fmt.Errorf("response translation exception %d: %w", i, err)
+		}
+		peers, err := parseNetworks(rule.Peers)
+		if err != nil {
+			return nil, fmt.Errorf("parse peers of response translation exception %d: %w", i, err)
+		}
+		rt.exceptions = append(rt.exceptions, responseTranslationRule{peers, rule.Translation})
+	}
+
+	return rt, nil
+}
+
+func (translation ResponseTranslation) validate() error {
+	for from, to := range translation.Codes {
+		if from < 300 || from > 699 || to < 300 || to > 699 {
+			return fmt.Errorf("invalid translation of response code %d to %d", from, to)
+		}
+	}
+
+	return nil
+}
+
+// translationOf returns translation of responses to the peer.
+func (rt *responseTranslation) translationOf(res sip.Response) ResponseTranslation {
+	addr, _ := res.Fields()[transport.ReceivedFromField].(string)
+	if addr == "" {
+		addr = res.Destination()
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return rt.translation
+	}
+
+	for _, rule := range rt.exceptions {
+		for _, network := range rule.peers {
+			if network.Contains(ip) {
+				return rule.translation
+			}
+		}
+	}
+
+	return rt.translation
+}
+
+// apply translates the response once, retransmissions of the response are not translated again.
+func (rt *responseTranslation) apply(res sip.Response) {
+	if _, ok := res.Fields()[TranslatedFromField]; ok {
+		return
+	}
+
+	translation := rt.translationOf(res)
+	code := res.StatusCode()
+	if to, ok := translation.Codes[code]; ok {
+		res.SetStatusCode(to)
+		res.SetReason(sip.ReasonPhrase(to))
+	}
+	if reason, ok := translation.Reasons[res.StatusCode()]; ok {
+		res.SetReason(reason)
+	}
+	if translation.StripReasons && res.StatusCode() >= 300 {
+		res.SetReason(sip.ReasonPhrase(res.StatusCode()))
+		res.RemoveHeader("Warning")
+		res.RemoveHeader("Reason")
+	}
+
+	res.WithFields(log.Fields{
+		TranslatedFromField: code,
+	})
+}
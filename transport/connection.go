@@ -5,9 +5,13 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/redact"
+	"github.com/ghettovoice/gosip/sip"
 )
 
 var (
@@ -35,6 +39,11 @@ type connection struct {
 	raddr    net.Addr
 	streamed bool
 	mu       sync.RWMutex
+	closed   bool
+	// env is set when the connection is put into the pool of the layer
+	env atomic.Value
+
+	sip.ValueStore
 
 	log log.Logger
 }
@@ -66,6 +75,37 @@ func NewConnection(baseConn net.Conn, key ConnectionKey, network string, logger
 	return conn
 }
 
+// opened publishes the connection put into the pool to the bus of the environment,
+// the connection is closed into the same bus. Faults of the environment are injected since then.
+func (conn *connection) opened(env *environment) {
+	conn.env.Store(env)
+	if env.faults != nil {
+		env.faults.ConnectionOpened(conn)
+	}
+	env.bus.Publish(&eventbus.ConnectionUpEvent{
+		Network:    conn.network,
+		LocalAddr:  addrString(conn.laddr),
+		RemoteAddr: addrString(conn.raddr),
+	})
+}
+
+// faults returns the fault injector of the environment or nil.
+func (conn *connection) faults() FaultInjector {
+	if env, ok := conn.env.Load().(*environment); ok {
+		return env.faults
+	}
+
+	return nil
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
+
 func (conn *connection) String() string {
 	if conn == nil {
 		return "<nil>"
@@ -103,7 +143,12 @@ func (conn *connection) Read(buf []byte) (int, error) {
 		err error
 	)
 
-	num, err = conn.baseConn.Read(buf)
+	for {
+		num, err = conn.baseConn.Read(buf)
+		if err != nil || !conn.injectRead(buf, &num) {
+			break
+		}
+	}
 
 	if err != nil {
 		return num, &ConnectionError{
@@ -116,13 +161,18 @@ func (conn *connection) Read(buf []byte) (int, error) {
 		}
 	}
 
-	conn.Log().Tracef("read %d bytes %s <- %s:\n%s", num, conn.LocalAddr(), conn.RemoteAddr(), buf[:num])
+	conn.Log().Tracef("read %d bytes %s <- %s:\n%s", num, conn.LocalAddr(), conn.RemoteAddr(), redact.Bytes(buf[:num]))
 
 	return num, err
 }
 
 func (conn *connection) ReadFrom(buf []byte) (num int, raddr net.Addr, err error) {
-	num, raddr, err = conn.baseConn.(net.PacketConn).ReadFrom(buf)
+	for {
+		num, raddr, err = conn.baseConn.(net.PacketConn).ReadFrom(buf)
+		if err != nil || !conn.injectRead(buf, &num) {
+			break
+		}
+	}
 	if err != nil {
 		return num, raddr, &ConnectionError{
 			err,
@@ -134,7 +184,7 @@ func (conn *connection) ReadFrom(buf []byte) (num int, raddr net.Addr, err error
 		}
 	}
 
-	conn.Log().Tracef("read %d bytes %s <- %s:\n%s", num, conn.LocalAddr(), raddr, buf[:num])
+	conn.Log().Tracef("read %d bytes %s <- %s:\n%s", num, conn.LocalAddr(), raddr, redact.Bytes(buf[:num]))
 
 	return num, raddr, err
 }
@@ -145,7 +195,12 @@ func (conn *connection) Write(buf []byte) (int, error) {
 		err error
 	)
 
-	num, err = conn.baseConn.Write(buf)
+	data, ok := conn.injectWrite(buf)
+	if !ok {
+		return len(buf), nil
+	}
+
+	num, err = conn.baseConn.Write(data)
 	if err != nil {
 		return num, &ConnectionError{
 			err,
@@ -157,13 +212,18 @@ func (conn *connection) Write(buf []byte) (int, error) {
 		}
 	}
 
-	conn.Log().Tracef("write %d bytes %s -> %s:\n%s", num, conn.LocalAddr(), conn.RemoteAddr(), buf[:num])
+	conn.Log().Tracef("write %d bytes %s -> %s:\n%s", num, conn.LocalAddr(), conn.RemoteAddr(), redact.Bytes(data[:num]))
 
 	return num, err
 }
 
 func (conn *connection) WriteTo(buf []byte, raddr net.Addr) (num int, err error) {
-	num, err = conn.baseConn.(net.PacketConn).WriteTo(buf, raddr)
+	data, ok := conn.injectWrite(buf)
+	if !ok {
+		return len(buf), nil
+	}
+
+	num, err = conn.baseConn.(net.PacketConn).WriteTo(data, raddr)
 	if err != nil {
 		return num, &ConnectionError{
 			err,
@@ -175,11 +235,39 @@ func (conn *connection) WriteTo(buf []byte, raddr net.Addr) (num int, err error)
 		}
 	}
 
-	conn.Log().Tracef("write %d bytes %s -> %s:\n%s", num, conn.LocalAddr(), raddr, buf[:num])
+	conn.Log().Tracef("write %d bytes %s -> %s:\n%s", num, conn.LocalAddr(), raddr, redact.Bytes(data[:num]))
 
 	return num, err
 }
 
+// injectRead applies the fault injector to the read data, returns true if the data is dropped.
+func (conn *connection) injectRead(buf []byte, num *int) bool {
+	fi := conn.faults()
+	if fi == nil {
+		return false
+	}
+
+	data := fi.AfterRead(conn, buf[:*num])
+	if data == nil {
+		return true
+	}
+	*num = copy(buf, data)
+
+	return false
+}
+
+// injectWrite applies the fault injector to the written data, returns false if the write is dropped.
+func (conn *connection) injectWrite(buf []byte) ([]byte, bool) {
+	fi := conn.faults()
+	if fi == nil {
+		return buf, true
+	}
+
+	data := fi.BeforeWrite(conn, buf)
+
+	return data, data != nil
+}
+
 func (conn *connection) LocalAddr() net.Addr {
 	return conn.baseConn.LocalAddr()
 }
@@ -189,6 +277,21 @@ func (conn *connection) RemoteAddr() net.Addr {
 }
 
 func (conn *connection) Close() error {
+	conn.mu.Lock()
+	closed := conn.closed
+	if !closed {
+		conn.closed = true
+	}
+	conn.mu.Unlock()
+
+	if env, ok := conn.env.Load().(*environment); ok && !closed {
+		env.bus.Publish(&eventbus.ConnectionDownEvent{
+			Network:    conn.network,
+			LocalAddr:  addrString(conn.laddr),
+			RemoteAddr: addrString(conn.raddr),
+		})
+	}
+
 	err := conn.baseConn.Close()
 	if err != nil {
 		return &ConnectionError{
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ghettovoice/gosip/log"
@@ -51,9 +52,19 @@ type ConnectionHandler interface {
 	Serve()
 }
 
+// connectionPool is sharded by connection key, so lookups of different connections do not contend on the single lock.
+// Each shard expires its connections by own TTL wheel.
 type connectionPool struct {
-	store     map[ConnectionKey]ConnectionHandler
+	shards    [connectionShards]*connectionShard
 	msgMapper sip.MessageMapper
+	// parsers parse datagrams of packet connections, they are started with the first packet connection
+	parsers     *parserPool
+	parsersOnce sync.Once
+	// normalizer holds normalizerHolder
+	normalizer atomic.Value
+	// limits holds parser.Limits of messages
+	limits atomic.Value
+	environmentHolder
 
 	output chan<- sip.Message
 	errs   chan<- error
@@ -64,7 +75,7 @@ type connectionPool struct {
 	herrs chan error
 
 	hwg sync.WaitGroup
-	mu  sync.RWMutex
+	swg sync.WaitGroup
 
 	log log.Logger
 }
@@ -77,7 +88,6 @@ func NewConnectionPool(
 	logger log.Logger,
 ) ConnectionPool {
 	pool := &connectionPool{
-		store:     make(map[ConnectionKey]ConnectionHandler),
 		msgMapper: msgMapper,
 
 		output: output,
@@ -94,11 +104,15 @@ func NewConnectionPool(
 		WithFields(log.Fields{
 			"connection_pool_ptr": fmt.Sprintf("%p", pool),
 		})
+	for i := range pool.shards {
+		pool.shards[i] = newConnectionShard()
+	}
 
 	go func() {
 		<-pool.cancel
 		pool.dispose()
 	}()
+	pool.swg.Add(1)
 	go pool.serveHandlers()
 
 	return pool
@@ -142,69 +156,96 @@ func (pool *connectionPool) Put(connection Connection, ttl time.Duration) error
 		}
 	}
 
-	pool.mu.Lock()
-	defer pool.mu.Unlock()
+	shard := pool.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	return pool.put(key, connection, ttl)
+	return pool.put(shard, key, connection, ttl)
 }
 
 func (pool *connectionPool) Get(key ConnectionKey) (Connection, error) {
-	pool.mu.RLock()
-	defer pool.mu.RUnlock()
+	shard := pool.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 
-	return pool.getConnection(key)
+	return pool.getConnection(shard, key)
 }
 
 func (pool *connectionPool) Drop(key ConnectionKey) error {
-	pool.mu.Lock()
-	defer pool.mu.Unlock()
+	shard := pool.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	return pool.drop(key)
+	return pool.drop(shard, key)
 }
 
 func (pool *connectionPool) DropAll() error {
-	pool.mu.Lock()
-	for key := range pool.store {
-		if err := pool.drop(key); err != nil {
-			pool.Log().Errorf("drop connection %s failed: %s", key, err)
+	for _, shard := range pool.shards {
+		shard.mu.Lock()
+		for key := range shard.store {
+			if err := pool.drop(shard, key); err != nil {
+				pool.Log().Errorf("drop connection %s failed: %s", key, err)
+			}
 		}
+		shard.mu.Unlock()
 	}
-	pool.mu.Unlock()
 
 	return nil
 }
 
 func (pool *connectionPool) All() []Connection {
-	pool.mu.RLock()
 	conns := make([]Connection, 0)
-	for _, handler := range pool.store {
-		conns = append(conns, handler.Connection())
+	for _, shard := range pool.shards {
+		shard.mu.RLock()
+		for _, handler := range shard.store {
+			conns = append(conns, handler.Connection())
+		}
+		shard.mu.RUnlock()
 	}
-	pool.mu.RUnlock()
 
 	return conns
 }
 
 func (pool *connectionPool) Length() int {
-	pool.mu.RLock()
-	defer pool.mu.RUnlock()
+	var length int
+	for _, shard := range pool.shards {
+		shard.mu.RLock()
+		length += len(shard.store)
+		shard.mu.RUnlock()
+	}
 
-	return len(pool.store)
+	return length
+}
+
+func (pool *connectionPool) shard(key ConnectionKey) *connectionShard {
+	return pool.shards[shardIndex(key)]
 }
 
 func (pool *connectionPool) dispose() {
 	// clean pool
 	pool.DropAll()
+	for _, shard := range pool.shards {
+		shard.mu.Lock()
+		shard.wheel.reschedule(time.Time{}, nil)
+		shard.mu.Unlock()
+	}
 	pool.hwg.Wait()
+	pool.parsersOnce.Do(func() {})
+	if pool.parsers != nil {
+		pool.parsers.stop()
+	}
 
 	// stop serveHandlers goroutine
 	close(pool.hmess)
 	close(pool.herrs)
+	pool.swg.Wait()
 
 	close(pool.done)
 }
 
 func (pool *connectionPool) serveHandlers() {
+	defer pool.swg.Done()
+
 	pool.Log().Debug("begin serve connection handlers")
 	defer pool.Log().Debug("stop serve connection handlers")
 
@@ -252,15 +293,22 @@ func (pool *connectionPool) serveHandlers() {
 				continue
 			}
 
-			pool.mu.RLock()
-			handler, gerr := pool.get(herr.Key)
-			pool.mu.RUnlock()
+			shard := pool.shard(herr.Key)
+			shard.mu.RLock()
+			handler, gerr := pool.get(shard, herr.Key)
+			shard.mu.RUnlock()
 			if gerr != nil {
 				// ignore, handler already dropped out
 				logger.Tracef("ignore error from already dropped out connection %s: %s", herr.Key, gerr)
 
 				continue
 			}
+			if handler != herr.handler {
+				// the key was reused by the new connection, i.e. the listener was restarted
+				logger.Tracef("ignore error from already replaced connection %s: %s", herr.Key, herr)
+
+				continue
+			}
 
 			logger = logger.WithFields(log.Fields{
 				"connection_handler": handler.String(),
@@ -298,7 +346,11 @@ func (pool *connectionPool) serveHandlers() {
 
 				var connErr *ConnectionError
 				if errors.As(herr.Err, &connErr) {
-					pool.errs <- herr.Err
+					select {
+					case <-pool.cancel:
+						return
+					case pool.errs <- herr.Err:
+					}
 				}
 
 				continue
@@ -326,8 +378,8 @@ func (pool *connectionPool) serveHandlers() {
 	}
 }
 
-func (pool *connectionPool) put(key ConnectionKey, conn Connection, ttl time.Duration) error {
-	if _, err := pool.get(key); err == nil {
+func (pool *connectionPool) put(shard *connectionShard, key ConnectionKey, conn Connection, ttl time.Duration) error {
+	if _, err := pool.get(shard, key); err == nil {
 		return &PoolError{
 			fmt.Errorf("key %s already exists in the pool", key),
 			"put connection",
@@ -335,20 +387,39 @@ func (pool *connectionPool) put(key ConnectionKey, conn Connection, ttl time.Dur
 		}
 	}
 
-	// wrap to handler
-	handler := NewConnectionHandler(
+	// wrap to handler, the expiry time is tracked by the TTL wheel of the shard
+	handler := newConnectionHandler(
 		conn,
 		ttl,
 		pool.hmess,
 		pool.herrs,
 		pool.msgMapper,
 		pool.Log(),
+		false,
 	)
+	if !conn.Streamed() {
+		pool.parsersOnce.Do(func() {
+			pool.parsers = newParserPool(pool.getEnvironment().parserWorkers(), pool.Log())
+		})
+		handler.env = pool.getEnvironment()
+		handler.parsers = pool.parsers
+		handler.parsed = make(chan parsedPacket, parserQueueSize)
+		handler.normalizer = pool.getNormalizer
+	}
+	handler.limits = pool.getMessageLimits
 
 	logger := log.AddFieldsFrom(pool.Log(), handler)
 	logger.Tracef("put connection to the pool with TTL = %s", ttl)
 
-	pool.store[handler.Key()] = handler
+	shard.store[handler.Key()] = handler
+	if c, ok := conn.(*connection); ok {
+		c.opened(pool.getEnvironment())
+	}
+	if ttl > 0 {
+		deadline := timing.Now().Add(ttl)
+		shard.wheel.add(key, deadline)
+		shard.wheel.schedule(deadline, func() { pool.expire(shard) })
+	}
 
 	// start serving
 	pool.hwg.Add(1)
@@ -361,9 +432,9 @@ func (pool *connectionPool) put(key ConnectionKey, conn Connection, ttl time.Dur
 	return nil
 }
 
-func (pool *connectionPool) drop(key ConnectionKey) error {
+func (pool *connectionPool) drop(shard *connectionShard, key ConnectionKey) error {
 	// check existence in pool
-	handler, err := pool.get(key)
+	handler, err := pool.get(shard, key)
 	if err != nil {
 		return err
 	}
@@ -374,13 +445,48 @@ func (pool *connectionPool) drop(key ConnectionKey) error {
 	logger.Trace("drop connection from the pool")
 
 	// modify store
-	delete(pool.store, key)
+	delete(shard.store, key)
+	shard.wheel.remove(key)
 
 	return nil
 }
 
-func (pool *connectionPool) get(key ConnectionKey) (ConnectionHandler, error) {
-	if handler, ok := pool.store[key]; ok {
+// expire drops expired connections of the shard, it is called by the timer of the TTL wheel.
+// Connections that received data since they were scheduled are scheduled again.
+func (pool *connectionPool) expire(shard *connectionShard) {
+	now := timing.Now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	for _, key := range shard.wheel.due(now) {
+		handler, ok := shard.store[key]
+		if !ok {
+			continue
+		}
+
+		logger := log.AddFieldsFrom(pool.Log(), handler)
+		if !handler.Expired() {
+			logger.Trace("connection expiry time is updated, schedule it again")
+
+			shard.wheel.add(key, handler.Expiry())
+
+			continue
+		}
+
+		logger.Debug("connection expired, drop it and go further")
+
+		if err := pool.drop(shard, key); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	next, _ := shard.wheel.earliest()
+	shard.wheel.reschedule(next, func() { pool.expire(shard) })
+}
+
+func (pool *connectionPool) get(shard *connectionShard, key ConnectionKey) (ConnectionHandler, error) {
+	if handler, ok := shard.store[key]; ok {
 		return handler, nil
 	}
 
@@ -391,9 +497,9 @@ func (pool *connectionPool) get(key ConnectionKey) (ConnectionHandler, error) {
 	}
 }
 
-func (pool *connectionPool) getConnection(key ConnectionKey) (Connection, error) {
+func (pool *connectionPool) getConnection(shard *connectionShard, key ConnectionKey) (Connection, error) {
 	var conn Connection
-	handler, err := pool.get(key)
+	handler, err := pool.get(shard, key)
 	if err == nil {
 		conn = handler.Connection()
 	}
@@ -405,9 +511,11 @@ type connectionHandler struct {
 	connection Connection
 	msgMapper  sip.MessageMapper
 
-	timer  timing.Timer
-	ttl    time.Duration
-	expiry time.Time
+	// timer is nil if the expiry time is tracked by the pool
+	timer timing.Timer
+	ttl   time.Duration
+	// expiry is the expiry time in Unix nanoseconds, zero is unlimited
+	expiry int64
 
 	output     chan<- sip.Message
 	errs       chan<- error
@@ -415,10 +523,24 @@ type connectionHandler struct {
 	canceled   chan struct{}
 	done       chan struct{}
 	addrs      util.ElasticChan
+	// readAt is a time of the last data written to the stream parser in Unix nanoseconds
+	readAt int64
+	// parsers parse datagrams of the packet connection, nil parses them in the reading goroutine
+	parsers *parserPool
+	parsing sync.WaitGroup
+	// parsed passes datagrams parsed by the parser pool to the connection, see parserPool
+	parsed chan parsedPacket
+	// env counts datagrams dropped when parsed is full
+	env *environment
+	// normalizer returns normalizer of datagrams, nil does not normalize them
+	normalizer func() Normalizer
+	// limits returns limits of messages, nil does not limit them
+	limits func() parser.Limits
 
 	log log.Logger
 }
 
+// NewConnectionHandler creates handler of the connection, it sends ExpireError when the connection expires.
 func NewConnectionHandler(
 	conn Connection,
 	ttl time.Duration,
@@ -427,6 +549,18 @@ func NewConnectionHandler(
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
 ) ConnectionHandler {
+	return newConnectionHandler(conn, ttl, output, errs, msgMapper, logger, true)
+}
+
+func newConnectionHandler(
+	conn Connection,
+	ttl time.Duration,
+	output chan<- sip.Message,
+	errs chan<- error,
+	msgMapper sip.MessageMapper,
+	logger log.Logger,
+	ownTimer bool,
+) *connectionHandler {
 	handler := &connectionHandler{
 		connection: conn,
 		msgMapper:  msgMapper,
@@ -437,6 +571,7 @@ func NewConnectionHandler(
 		done:     make(chan struct{}),
 
 		ttl: ttl,
+		env: defaultEnvironment,
 	}
 
 	handler.log = logger.
@@ -450,13 +585,16 @@ func NewConnectionHandler(
 
 	// handler.Update(ttl)
 	if ttl > 0 {
-		handler.expiry = time.Now().Add(ttl)
-		handler.timer = timing.NewTimer(ttl)
-	} else {
-		handler.expiry = time.Time{}
-		handler.timer = timing.NewTimer(0)
-		if !handler.timer.Stop() {
-			<-handler.timer.C()
+		handler.expiry = timing.Now().Add(ttl).UnixNano()
+	}
+	if ownTimer {
+		if ttl > 0 {
+			handler.timer = timing.NewTimer(ttl)
+		} else {
+			handler.timer = timing.NewTimer(0)
+			if !handler.timer.Stop() {
+				<-handler.timer.C()
+			}
 		}
 	}
 
@@ -490,11 +628,16 @@ func (handler *connectionHandler) Connection() Connection {
 }
 
 func (handler *connectionHandler) Expiry() time.Time {
-	return handler.expiry
+	expiry := atomic.LoadInt64(&handler.expiry)
+	if expiry == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, expiry)
 }
 
 func (handler *connectionHandler) Expired() bool {
-	return !handler.Expiry().IsZero() && handler.Expiry().Before(time.Now())
+	return !handler.Expiry().IsZero() && !handler.Expiry().After(timing.Now())
 }
 
 // resets the timeout timer.
@@ -543,7 +686,10 @@ func (handler *connectionHandler) readConnection() (<-chan sip.Message, <-chan e
 	)
 	if streamed {
 		strPrs = parser.NewParser(msgs, errs, streamed, handler.Log())
-	} else {
+		if limiter, ok := strPrs.(parser.Limiter); ok {
+			limiter.SetLimits(handler.messageLimits())
+		}
+	} else if handler.parsers == nil {
 		pktPrs = parser.NewPacketParser(handler.Log())
 	}
 
@@ -559,6 +705,8 @@ func (handler *connectionHandler) readConnection() (<-chan sip.Message, <-chan e
 	go func() {
 		defer func() {
 			handler.Connection().Close()
+			// wait for datagrams queued to the parser pool
+			handler.parsing.Wait()
 			if streamed {
 				strPrs.Stop()
 			} else {
@@ -624,17 +772,23 @@ func (handler *connectionHandler) readConnection() (<-chan sip.Message, <-chan e
 				continue
 			}
 
+			if !streamed && handler.normalizer != nil {
+				if normalizer := handler.normalizer(); normalizer != nil {
+					data = normalizer.Normalize(data, fmt.Sprintf("%v", raddr))
+				}
+			}
+
 			// parse received data
 			if streamed {
+				atomic.StoreInt64(&handler.readAt, time.Now().UnixNano())
 				if _, err := strPrs.Write(data); err != nil {
 					handler.handleError(err, fmt.Sprintf("%v", raddr))
 				}
+			} else if handler.parsers != nil {
+				// the buffer is reused by the next read
+				handler.parsers.parse(handler, append([]byte(nil), data...), fmt.Sprintf("%v", raddr), time.Now())
 			} else {
-				if msg, err := pktPrs.ParseMessage(data); err == nil {
-					handler.handleMessage(msg, fmt.Sprintf("%v", raddr))
-				} else {
-					handler.handleError(err, fmt.Sprintf("%v", raddr))
-				}
+				handler.parsePacket(pktPrs, data, fmt.Sprintf("%v", raddr), time.Now())
 			}
 		}
 	}()
@@ -648,9 +802,14 @@ func (handler *connectionHandler) pipeOutputs(msgs <-chan sip.Message, errs <-ch
 	handler.Log().Debug("begin pipe outputs")
 	defer handler.Log().Debug("stop pipe outputs")
 
+	var expired <-chan time.Time
+	if handler.timer != nil {
+		expired = handler.timer.C()
+	}
+
 	for {
 		select {
-		case <-handler.timer.C():
+		case <-expired:
 			var raddr string
 			if streamed {
 				raddr = fmt.Sprintf("%v", handler.Connection().RemoteAddr())
@@ -664,14 +823,20 @@ func (handler *connectionHandler) pipeOutputs(msgs <-chan sip.Message, errs <-ch
 
 			// pass up to the pool
 			handler.handleError(ExpireError("connection expired"), raddr)
+		case pkt := <-handler.parsed:
+			handler.handlePacket(pkt)
 		case msg, ok := <-msgs:
 			if !ok {
+				handler.flushPackets()
 				return
 			}
 
-			handler.handleMessage(msg, handler.getRemoteAddr())
+			// stream message is parsed from the last read data
+			parseDuration := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&handler.readAt))
+			handler.handleMessage(msg, handler.getRemoteAddr(), parseDuration)
 		case err, ok := <-errs:
 			if !ok {
+				handler.flushPackets()
 				return
 			}
 
@@ -680,6 +845,51 @@ func (handler *connectionHandler) pipeOutputs(msgs <-chan sip.Message, errs <-ch
 	}
 }
 
+// parsePacket parses the datagram and passes up the message, readAt is a time the datagram was read.
+func (handler *connectionHandler) parsePacket(prs *parser.PacketParser, data []byte, raddr string, readAt time.Time) {
+	prs.SetLimits(handler.messageLimits())
+	if msg, err := prs.ParseMessage(data); err == nil {
+		handler.handleMessage(msg, raddr, time.Since(readAt))
+	} else {
+		handler.handleError(err, raddr)
+	}
+}
+
+// queuePacket parses the datagram and passes it to the connection without blocking,
+// so the stalled output of the connection does not block the parser worker of other flows.
+// The datagram is dropped and counted when the queue of the connection is full, like lost in the network.
+func (handler *connectionHandler) queuePacket(prs *parser.PacketParser, data []byte, raddr string, readAt time.Time) {
+	prs.SetLimits(handler.messageLimits())
+	msg, err := prs.ParseMessage(data)
+	select {
+	case handler.parsed <- parsedPacket{msg, err, raddr, time.Since(readAt)}:
+	default:
+		dropped := atomic.AddUint64(&handler.env.dropped, 1)
+		handler.Log().Warnf("drop datagram from %s: queue of the connection is full, %d datagrams dropped", raddr, dropped)
+	}
+}
+
+func (handler *connectionHandler) handlePacket(pkt parsedPacket) {
+	if pkt.err != nil {
+		handler.handleError(pkt.err, pkt.raddr)
+		return
+	}
+
+	handler.handleMessage(pkt.msg, pkt.raddr, pkt.parseDuration)
+}
+
+// flushPackets passes up datagrams parsed before the connection was closed.
+func (handler *connectionHandler) flushPackets() {
+	for {
+		select {
+		case pkt := <-handler.parsed:
+			handler.handlePacket(pkt)
+		default:
+			return
+		}
+	}
+}
+
 func (handler *connectionHandler) getRemoteAddr() string {
 	if handler.Connection().Streamed() {
 		return fmt.Sprintf("%v", handler.Connection().RemoteAddr())
@@ -695,7 +905,46 @@ func (handler *connectionHandler) getRemoteAddr() string {
 	}
 }
 
-func (handler *connectionHandler) handleMessage(msg sip.Message, raddr string) {
+// ReceivedFromField is a field of the incoming message with the address the message actually arrived from,
+// Source of UDP requests without 'rport' is the sent-by port of Via instead - RFC 3261 18.2.2.
+const ReceivedFromField = "received_from"
+
+func (handler *connectionHandler) handleMessage(msg sip.Message, raddr string, parseDuration time.Duration) {
+	receivedFrom := raddr
+	raddr, ok := handler.setAddrs(msg, raddr)
+	if !ok {
+		handler.Log().Warn("ignore message without 'Via' header")
+
+		return
+	}
+
+	msg = handler.msgMapper(msg.WithFields(log.Fields{
+		"connection_key":  handler.Connection().Key(),
+		"received_at":     time.Now(),
+		"parse_duration":  parseDuration,
+		"direction":       "in",
+		"remote_addr":     raddr,
+		ReceivedFromField: receivedFrom,
+	}))
+
+	// pass up
+	select {
+	case <-handler.canceled:
+		return
+	case handler.output <- msg:
+	}
+
+	if handler.ttl > 0 {
+		atomic.StoreInt64(&handler.expiry, timing.Now().Add(handler.ttl).UnixNano())
+		if handler.timer != nil {
+			handler.timer.Reset(handler.ttl)
+		}
+	}
+}
+
+// setAddrs fills the transport, source and destination of the incoming message received from raddr,
+// it returns the source address. Requests without Via are not accepted.
+func (handler *connectionHandler) setAddrs(msg sip.Message, raddr string) (string, bool) {
 	msg.SetDestination(handler.Connection().LocalAddr().String())
 	rhost, rport, _ := net.SplitHostPort(raddr)
 
@@ -704,9 +953,7 @@ func (handler *connectionHandler) handleMessage(msg sip.Message, raddr string) {
 		// RFC 3261 - 18.2.1
 		viaHop, ok := msg.ViaHop()
 		if !ok {
-			handler.Log().Warn("ignore message without 'Via' header")
-
-			return
+			return raddr, false
 		}
 
 		if rhost != "" && rhost != viaHop.Host {
@@ -738,33 +985,34 @@ func (handler *connectionHandler) handleMessage(msg sip.Message, raddr string) {
 		msg.SetSource(raddr)
 	}
 
-	msg = handler.msgMapper(msg.WithFields(log.Fields{
-		"connection_key": handler.Connection().Key(),
-		"received_at":    time.Now(),
-	}))
-
-	// pass up
-	handler.output <- msg
-
-	if !handler.Expiry().IsZero() {
-		handler.expiry = time.Now().Add(handler.ttl)
-		handler.timer.Reset(handler.ttl)
-	}
+	return raddr, true
 }
 
 func (handler *connectionHandler) handleError(err error, raddr string) {
+	// the request over limits is answered by the transaction user
+	var lerr *parser.LimitError
+	if errors.As(err, &lerr) {
+		lerr.Source = raddr
+		if lerr.Msg != nil {
+			if _, ok := handler.setAddrs(lerr.Msg, raddr); !ok {
+				lerr.Msg = nil
+			}
+		}
+	}
+
 	if isSyntaxError(err) {
 		handler.Log().Tracef("ignore error: %s", err)
 		return
 	}
 
 	err = &ConnectionHandlerError{
-		err,
-		handler.Key(),
-		fmt.Sprintf("%p", handler),
-		handler.Connection().Network(),
-		fmt.Sprintf("%v", handler.Connection().LocalAddr()),
-		raddr,
+		Err:        err,
+		Key:        handler.Key(),
+		HandlerPtr: fmt.Sprintf("%p", handler),
+		Net:        handler.Connection().Network(),
+		LAddr:      fmt.Sprintf("%v", handler.Connection().LocalAddr()),
+		RAddr:      raddr,
+		handler:    handler,
 	}
 
 	select {
@@ -0,0 +1,89 @@
+package transport_test
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+const benchPoolConnections = 1024
+
+func newBenchPool(b *testing.B) (transport.ConnectionPool, []transport.ConnectionKey, func()) {
+	output := make(chan sip.Message)
+	errs := make(chan error)
+	cancel := make(chan struct{})
+	logger := testutils.NewLogrusLogger()
+	pool := transport.NewConnectionPool(output, errs, cancel, nil, logger)
+
+	keys := make([]transport.ConnectionKey, benchPoolConnections)
+	for i := range keys {
+		keys[i] = transport.ConnectionKey(fmt.Sprintf("tcp:10.0.%d.%d:5060", i/256, i%256))
+		server, _ := net.Pipe()
+		if err := pool.Put(transport.NewConnection(server, keys[i], "tcp", logger), time.Hour); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return pool, keys, func() {
+		close(cancel)
+		<-pool.Done()
+	}
+}
+
+// BenchmarkConnectionPool_Get measures lookups of connections by concurrent senders,
+// run with -cpu=1,2,4,8 to see how it scales.
+func BenchmarkConnectionPool_Get(b *testing.B) {
+	pool, keys, stop := newBenchPool(b)
+	defer stop()
+
+	var seq uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&seq, 7919))
+		for pb.Next() {
+			i++
+			if _, err := pool.Get(keys[i%len(keys)]); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkConnectionPool_GetPut measures lookups mixed with connections coming and going,
+// every 16th operation replaces the connection.
+func BenchmarkConnectionPool_GetPut(b *testing.B) {
+	pool, keys, stop := newBenchPool(b)
+	defer stop()
+
+	logger := testutils.NewLogrusLogger()
+	var seq uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		worker := atomic.AddUint32(&seq, 1)
+		key := transport.ConnectionKey(fmt.Sprintf("tcp:10.1.0.%d:5060", worker))
+		i := int(worker * 7919)
+		for pb.Next() {
+			i++
+			if i%16 != 0 {
+				_, _ = pool.Get(keys[i%len(keys)])
+				continue
+			}
+
+			_ = pool.Drop(key)
+			server, _ := net.Pipe()
+			if err := pool.Put(transport.NewConnection(server, key, "tcp", logger), time.Hour); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
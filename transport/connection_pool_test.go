@@ -98,7 +98,7 @@ var _ = Describe("ConnectionHandler", func() {
 			var expectedExpire time.Time
 			BeforeEach(func() {
 				ttl = 100 * time.Millisecond
-				expectedExpire = time.Now().Add(ttl)
+				expectedExpire = timing.Now().Add(ttl)
 			})
 			HasCorrectKeyAndConn()
 			It("should set expiry time to Now() + 0.1 * time.Second", func() {
@@ -106,9 +106,8 @@ var _ = Describe("ConnectionHandler", func() {
 			})
 			It("should not be expired before TTL", func() {
 				Expect(handler.Expired()).To(BeFalse())
-				Eventually(func() bool {
-					return handler.Expired()
-				}).Should(BeTrue())
+				timing.Elapse(ttl + time.Nanosecond)
+				Expect(handler.Expired()).To(BeTrue())
 			})
 		})
 	})
@@ -417,6 +416,22 @@ var _ = Describe("ConnectionPool", func() {
 			})
 		})
 
+		Context("put connection server1 with TTL", func() {
+			ttl := 100 * time.Millisecond
+
+			BeforeEach(func() {
+				Expect(pool.Put(server1, ttl)).ToNot(HaveOccurred())
+			})
+
+			It("should drop the connection when the clock passes TTL", func() {
+				timing.Elapse(ttl / 2)
+				Expect(pool.Get(key1)).To(Equal(server1))
+
+				timing.Elapse(ttl / 2)
+				Eventually(pool.Length).Should(Equal(0))
+			})
+		})
+
 		Context("has connection server1 with key1", func() {
 			BeforeEach(func() {
 				Expect(pool.Put(server1, 0)).ToNot(HaveOccurred())
@@ -536,6 +551,37 @@ var _ = Describe("ConnectionPool", func() {
 				ShouldBeEmpty()
 			})
 		})
+
+		Context("has connection server1 with key1 and TTL > 0 that receives data", func() {
+			var ttl time.Duration
+
+			BeforeEach(func() {
+				ttl = 30 * time.Millisecond
+				Expect(pool.Put(server1, ttl)).ToNot(HaveOccurred())
+				timing.Elapse(20 * time.Millisecond)
+				go testutils.WriteToConn(client1, []byte(msg1))
+				testutils.AssertMessageArrived(output, msg1, "pipe", server1.LocalAddr().String())
+				time.Sleep(time.Millisecond)
+			})
+
+			Context("after initial expiry time of server1", func() {
+				BeforeEach(func() {
+					timing.Elapse(ttl - 20*time.Millisecond + time.Nanosecond)
+					time.Sleep(time.Millisecond)
+				})
+				It("should keep connection", func() {
+					Expect(pool.Length()).To(Equal(1))
+				})
+
+				Context("after updated expiry time of server1", func() {
+					BeforeEach(func() {
+						timing.Elapse(ttl)
+						time.Sleep(time.Millisecond)
+					})
+					ShouldBeEmpty()
+				})
+			})
+		})
 		// TODO refactor later, extract base helpers and assertions
 		Context("has multiple connections: key1=>server1 (TTL=0), key2=>server2 (TTL=time.Millisecond), "+
 			"key3=>server3 (TTL=100*time.Millisecond)", func() {
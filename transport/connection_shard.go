@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/timing"
+)
+
+const (
+	// connectionShards is a number of shards of the connection pool, must be a power of two.
+	connectionShards = 32
+	// wheelSlots and wheelTick define the span of the TTL wheel of the shard,
+	// expiry times beyond the span stay in their slots for the next rounds.
+	wheelSlots = 64
+	wheelTick  = time.Second
+)
+
+// connectionShard is a part of the connection pool with own lock,
+// connections are distributed between shards by hash of the connection key.
+type connectionShard struct {
+	mu    sync.RWMutex
+	store map[ConnectionKey]ConnectionHandler
+	wheel ttlWheel
+}
+
+func newConnectionShard() *connectionShard {
+	return &connectionShard{
+		store: make(map[ConnectionKey]ConnectionHandler),
+		wheel: ttlWheel{
+			deadlines: make(map[ConnectionKey]time.Time),
+		},
+	}
+}
+
+// shardIndex returns shard of the key, FNV-1a hash.
+func shardIndex(key ConnectionKey) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+
+	return int(hash & (connectionShards - 1))
+}
+
+// ttlWheel is a hashed timing wheel of expiry times of connections of the shard.
+// The wheel has the single timer armed for the earliest expiry time, so connections
+// do not hold own timers and the timer is not reset on each incoming message.
+// The wheel uses the clock of the timing package.
+type ttlWheel struct {
+	slots     [wheelSlots]map[ConnectionKey]time.Time
+	deadlines map[ConnectionKey]time.Time
+	// cursor is the time the wheel was processed last
+	cursor time.Time
+	timer  timing.Timer
+	next   time.Time
+}
+
+func wheelTickOf(t time.Time) int64 {
+	return t.UnixNano() / int64(wheelTick)
+}
+
+func (w *ttlWheel) slot(t time.Time) map[ConnectionKey]time.Time {
+	i := int(uint64(wheelTickOf(t)) % wheelSlots)
+	if w.slots[i] == nil {
+		w.slots[i] = make(map[ConnectionKey]time.Time)
+	}
+
+	return w.slots[i]
+}
+
+func (w *ttlWheel) add(key ConnectionKey, deadline time.Time) {
+	w.remove(key)
+	w.slot(deadline)[key] = deadline
+	w.deadlines[key] = deadline
+}
+
+func (w *ttlWheel) remove(key ConnectionKey) {
+	if deadline, ok := w.deadlines[key]; ok {
+		delete(w.slot(deadline), key)
+		delete(w.deadlines, key)
+	}
+}
+
+// due removes and returns keys with expiry time not after now.
+func (w *ttlWheel) due(now time.Time) []ConnectionKey {
+	var keys []ConnectionKey
+
+	from, to := wheelTickOf(w.cursor), wheelTickOf(now)
+	if to-from >= wheelSlots {
+		from = to - wheelSlots + 1
+	}
+	for tick := from; tick <= to; tick++ {
+		for key, deadline := range w.slots[uint64(tick)%wheelSlots] {
+			if !deadline.After(now) {
+				keys = append(keys, key)
+				w.remove(key)
+			}
+		}
+	}
+	w.cursor = now
+
+	return keys
+}
+
+// earliest returns the earliest expiry time of the wheel.
+func (w *ttlWheel) earliest() (time.Time, bool) {
+	if len(w.deadlines) == 0 {
+		return time.Time{}, false
+	}
+
+	// look through the slots of the current round first
+	tick := wheelTickOf(w.cursor)
+	for i := int64(0); i < wheelSlots; i++ {
+		var (
+			next  time.Time
+			found bool
+		)
+		end := time.Unix(0, (tick+i+1)*int64(wheelTick))
+		for _, deadline := range w.slots[uint64(tick+i)%wheelSlots] {
+			if deadline.Before(end) && (!found || deadline.Before(next)) {
+				next, found = deadline, true
+			}
+		}
+		if found {
+			return next, true
+		}
+	}
+
+	// all connections expire in the next rounds
+	var next time.Time
+	for _, deadline := range w.deadlines {
+		if next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+
+	return next, true
+}
+
+// schedule arms the timer of the wheel to call expire at the earliest expiry time.
+func (w *ttlWheel) schedule(deadline time.Time, expire func()) {
+	if w.timer != nil && !w.next.After(deadline) {
+		return
+	}
+	w.reschedule(deadline, expire)
+}
+
+// reschedule rearms the timer of the wheel, zero deadline stops it.
+func (w *ttlWheel) reschedule(deadline time.Time, expire func()) {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if deadline.IsZero() {
+		return
+	}
+	w.next = deadline
+	w.timer = timing.AfterFunc(deadline.Sub(timing.Now()), expire)
+}
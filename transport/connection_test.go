@@ -7,6 +7,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/testutils"
 	"github.com/ghettovoice/gosip/transport"
 )
@@ -53,6 +54,21 @@ var _ = Describe("Connection", func() {
 				}
 			})
 		})
+
+		It("should keep application values", func() {
+			cUdpConn, sUdpConn := testutils.CreatePacketClientServer("udp", localAddr1)
+			defer func() {
+				cUdpConn.Close()
+				sUdpConn.Close()
+			}()
+			conn := transport.NewConnection(sUdpConn, "dummy", "udp", logger)
+			defer conn.Close()
+
+			values, ok := conn.(sip.Values)
+			Expect(ok).To(BeTrue())
+			values.SetValue("account", "alice")
+			Expect(conn.(sip.Values).Value("account")).To(Equal("alice"))
+		})
 	})
 
 	Describe("read and write", func() {
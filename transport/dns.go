@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// LookupTargets resolves ordered list of targets for the host - RFC 3263 4.2.
+// If port is not provided, SRV records are tried first, then A/AAAA records with the default port.
+// Returned targets are ordered by SRV priority and weight and can be used for failover.
+// NAPTR records are not queried, since the transport of the request is always known - RFC 3263 4.1.
+func LookupTargets(
+	ctx context.Context,
+	resolver *net.Resolver,
+	network string,
+	host string,
+	port *sip.Port,
+) ([]*Target, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		if port == nil {
+			p := sip.DefaultPort(network)
+			port = &p
+		}
+
+		return []*Target{newTargetFromIP(ip, *port)}, nil
+	}
+
+	targets := make([]*Target, 0)
+	if port == nil {
+		proto := "udp"
+		switch strings.ToUpper(network) {
+		case "TCP", "TLS", "WS", "WSS":
+			proto = "tcp"
+		}
+		service := "sip"
+		if strings.ToUpper(network) == "TLS" || strings.ToUpper(network) == "WSS" {
+			service = "sips"
+		}
+
+		if _, addrs, err := resolver.LookupSRV(ctx, service, proto, host); err == nil {
+			for _, addr := range addrs {
+				ips, err := resolver.LookupIPAddr(ctx, strings.TrimSuffix(addr.Target, "."))
+				if err != nil {
+					continue
+				}
+				for _, ip := range ips {
+					target := newTargetFromIP(ip.IP, sip.Port(addr.Port))
+					target.Priority = addr.Priority
+					target.Weight = addr.Weight
+					targets = append(targets, target)
+				}
+			}
+		}
+	}
+
+	if len(targets) > 0 {
+		return targets, nil
+	}
+
+	if port == nil {
+		p := sip.DefaultPort(network)
+		port = &p
+	}
+
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, &sip.DNSError{Host: host, Type: "A", Err: err}
+	}
+	for _, ip := range ips {
+		targets = append(targets, newTargetFromIP(ip.IP, *port))
+	}
+
+	return targets, nil
+}
+
+func newTargetFromIP(ip net.IP, port sip.Port) *Target {
+	var host string
+	if ip.To4() == nil {
+		host = fmt.Sprintf("[%v]", ip.String())
+	} else {
+		host = ip.String()
+	}
+
+	return &Target{Host: host, Port: &port}
+}
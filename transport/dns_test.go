@@ -0,0 +1,215 @@
+package transport_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+type srvRecord struct {
+	priority, weight, port uint16
+	target                 string
+}
+
+// stubResolver answers SRV queries by the records and A queries by the hosts,
+// other names do not exist. Names of queries are collected in the order they are received.
+func stubResolver(records map[string][]srvRecord, hosts map[string]net.IP, queries chan<- string) *net.Resolver {
+	answer := func(query []byte) []byte {
+		labels := make([]string, 0)
+		i := 12
+		for query[i] != 0 {
+			labels = append(labels, string(query[i+1:i+1+int(query[i])]))
+			i += int(query[i]) + 1
+		}
+		name := strings.ToLower(strings.Join(labels, "."))
+		qtype := binary.BigEndian.Uint16(query[i+1:])
+		if queries != nil {
+			select {
+			case queries <- name:
+			default:
+			}
+		}
+
+		answers := make([][]byte, 0)
+		_, exists := hosts[name]
+		switch qtype {
+		case 33:
+			for _, record := range records[name] {
+				exists = true
+				rdata := make([]byte, 6)
+				binary.BigEndian.PutUint16(rdata, record.priority)
+				binary.BigEndian.PutUint16(rdata[2:], record.weight)
+				binary.BigEndian.PutUint16(rdata[4:], record.port)
+				for _, label := range strings.Split(record.target, ".") {
+					rdata = append(append(rdata, byte(len(label))), label...)
+				}
+				rdata = append(rdata, 0)
+				answers = append(answers, append([]byte{0xc0, 0x0c, 0, 33, 0, 1, 0, 0, 0, 60, 0, byte(len(rdata))}, rdata...))
+			}
+		case 1:
+			if ip, ok := hosts[name]; ok {
+				answers = append(answers, append([]byte{0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4}, ip.To4()...))
+			}
+		}
+
+		rcode := byte(0x80)
+		if !exists {
+			rcode |= 3
+		}
+		res := append([]byte{}, query[0], query[1], 0x81, rcode, 0, 1, 0, byte(len(answers)), 0, 0, 0, 0)
+		res = append(res, query[12:i+5]...)
+		for _, record := range answers {
+			res = append(res, record...)
+		}
+
+		return res
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+
+				var l [2]byte
+				if _, err := io.ReadFull(server, l[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(server, query); err != nil {
+					return
+				}
+				res := answer(query)
+				binary.BigEndian.PutUint16(l[:], uint16(len(res)))
+				_, _ = server.Write(append(l[:], res...))
+			}()
+
+			return client, nil
+		},
+	}
+}
+
+var _ = Describe("LookupTargets", func() {
+	It("should return IP target with explicit port", func() {
+		port := sip.Port(5080)
+		targets, err := transport.LookupTargets(context.Background(), nil, "udp", "127.0.0.1", &port)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(HaveLen(1))
+		Expect(targets[0].Addr()).To(Equal("127.0.0.1:5080"))
+	})
+
+	It("should return IP target with default port", func() {
+		targets, err := transport.LookupTargets(context.Background(), nil, "tls", "127.0.0.1", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(HaveLen(1))
+		Expect(targets[0].Addr()).To(Equal("127.0.0.1:5061"))
+	})
+
+	It("should wrap IPv6 host in brackets", func() {
+		port := sip.Port(5060)
+		targets, err := transport.LookupTargets(context.Background(), nil, "udp", "[::1]", &port)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(HaveLen(1))
+		Expect(targets[0].Addr()).To(Equal("[::1]:5060"))
+	})
+
+	Context("with SRV records", func() {
+		hosts := map[string]net.IP{
+			"a.example.test":     net.ParseIP("192.0.2.1"),
+			"b.example.test":     net.ParseIP("192.0.2.2"),
+			"c.example.test":     net.ParseIP("192.0.2.3"),
+			"proxy.example.test": net.ParseIP("192.0.2.10"),
+		}
+		addrs := func(targets []*transport.Target) []string {
+			result := make([]string, 0, len(targets))
+			for _, target := range targets {
+				result = append(result, target.Addr())
+			}
+			return result
+		}
+
+		It("should order targets by priority and weight", func() {
+			resolver := stubResolver(map[string][]srvRecord{
+				"_sip._udp.proxy.example.test": {
+					{priority: 20, weight: 10, port: 5063, target: "c.example.test"},
+					{priority: 10, weight: 0, port: 5062, target: "b.example.test"},
+					{priority: 10, weight: 10, port: 5061, target: "a.example.test"},
+				},
+			}, hosts, nil)
+
+			// targets of zero weight follow other targets of the priority - RFC 2782
+			for i := 0; i < 5; i++ {
+				targets, err := transport.LookupTargets(context.Background(), resolver, "udp", "proxy.example.test", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(addrs(targets)).To(Equal([]string{"192.0.2.1:5061", "192.0.2.2:5062", "192.0.2.3:5063"}))
+				Expect(targets[0].Priority).To(Equal(uint16(10)))
+				Expect(targets[0].Weight).To(Equal(uint16(10)))
+				Expect(targets[2].Priority).To(Equal(uint16(20)))
+			}
+		})
+
+		It("should skip SRV targets without addresses", func() {
+			resolver := stubResolver(map[string][]srvRecord{
+				"_sip._tcp.proxy.example.test": {
+					{priority: 10, port: 5060, target: "missing.example.test"},
+					{priority: 20, port: 5070, target: "b.example.test"},
+				},
+			}, hosts, nil)
+
+			targets, err := transport.LookupTargets(context.Background(), resolver, "tcp", "proxy.example.test", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addrs(targets)).To(Equal([]string{"192.0.2.2:5070"}))
+		})
+
+		It("should query the SIPS service of secure transports", func() {
+			queries := make(chan string, 10)
+			resolver := stubResolver(map[string][]srvRecord{
+				"_sips._tcp.proxy.example.test": {{priority: 10, port: 5061, target: "a.example.test"}},
+			}, hosts, queries)
+
+			targets, err := transport.LookupTargets(context.Background(), resolver, "tls", "proxy.example.test", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addrs(targets)).To(Equal([]string{"192.0.2.1:5061"}))
+			Expect(queries).To(Receive(Equal("_sips._tcp.proxy.example.test")))
+		})
+
+		It("should resolve A records with the default port without SRV records", func() {
+			resolver := stubResolver(nil, hosts, nil)
+
+			targets, err := transport.LookupTargets(context.Background(), resolver, "udp", "proxy.example.test", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addrs(targets)).To(Equal([]string{"192.0.2.10:5060"}))
+		})
+
+		It("should not query SRV records of the host with explicit port", func() {
+			queries := make(chan string, 10)
+			resolver := stubResolver(map[string][]srvRecord{
+				"_sip._udp.proxy.example.test": {{priority: 10, port: 5061, target: "a.example.test"}},
+			}, hosts, queries)
+
+			port := sip.Port(5080)
+			targets, err := transport.LookupTargets(context.Background(), resolver, "udp", "proxy.example.test", &port)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addrs(targets)).To(Equal([]string{"192.0.2.10:5080"}))
+			Consistently(queries, 50*time.Millisecond).ShouldNot(Receive(HavePrefix("_sip")))
+		})
+
+		It("should fail on the host without records", func() {
+			_, err := transport.LookupTargets(context.Background(), stubResolver(nil, hosts, nil), "udp", "missing.example.test", nil)
+			var dnsErr *sip.DNSError
+			Expect(errors.As(err, &dnsErr)).To(BeTrue())
+			Expect(dnsErr.Host).To(Equal("missing.example.test"))
+		})
+	})
+})
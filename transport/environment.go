@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/ghettovoice/gosip/eventbus"
+)
+
+// environment is shared by protocols, pools and connections of the transport layer,
+// so servers of the same process don't share events of their transports.
+type environment struct {
+	// dropped counts datagrams dropped because connections do not keep up with parser workers,
+	// it is accessed atomically.
+	dropped uint64
+	// bus receives events of connections and listeners.
+	bus eventbus.Bus
+	// faults breaks connections, nil disables faults.
+	faults FaultInjector
+	// parsers is the number of parser workers of each connection pool, zero is GOMAXPROCS.
+	parsers int
+}
+
+// defaultEnvironment is used by protocols created out of the transport layer.
+var defaultEnvironment = &environment{
+	bus: eventbus.Default,
+}
+
+func newEnvironment(opts LayerOptions) *environment {
+	env := &environment{
+		bus:    opts.EventBus,
+		faults: opts.FaultInjector,
+	}
+	if opts.ParserWorkers > 0 {
+		env.parsers = opts.ParserWorkers
+	}
+	if env.bus == nil {
+		env.bus = eventbus.Default
+	}
+
+	return env
+}
+
+// parserWorkers returns the number of goroutines parsing datagrams of packet connections of each protocol.
+func (env *environment) parserWorkers() int {
+	if env.parsers > 0 {
+		return env.parsers
+	}
+
+	return runtime.GOMAXPROCS(0)
+}
+
+// environmentHolder keeps the environment set after the protocol or the pool is created.
+type environmentHolder struct {
+	env atomic.Value
+}
+
+func (holder *environmentHolder) setEnvironment(env *environment) {
+	holder.env.Store(env)
+}
+
+func (holder *environmentHolder) getEnvironment() *environment {
+	if env, ok := holder.env.Load().(*environment); ok {
+		return env
+	}
+
+	return defaultEnvironment
+}
+
+// environmental is implemented by protocols and pools of the transport layer.
+type environmental interface {
+	setEnvironment(env *environment)
+}
+
+func (p *udpProtocol) setEnvironment(env *environment) {
+	p.protocol.setEnvironment(env)
+	if pool, ok := p.connections.(environmental); ok {
+		pool.setEnvironment(env)
+	}
+}
+
+func (p *tcpProtocol) setEnvironment(env *environment) {
+	p.protocol.setEnvironment(env)
+	if pool, ok := p.listeners.(environmental); ok {
+		pool.setEnvironment(env)
+	}
+	if pool, ok := p.connections.(environmental); ok {
+		pool.setEnvironment(env)
+	}
+}
+
+func (p *wsProtocol) setEnvironment(env *environment) {
+	p.protocol.setEnvironment(env)
+	if pool, ok := p.listeners.(environmental); ok {
+		pool.setEnvironment(env)
+	}
+	if pool, ok := p.connections.(environmental); ok {
+		pool.setEnvironment(env)
+	}
+}
@@ -0,0 +1,190 @@
+package transport
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/timing"
+)
+
+// FaultInjector breaks connections of the transport layer for resilience testing
+// of retransmissions and failover. It is disabled by default, see WithFaultInjector.
+type FaultInjector interface {
+	// ConnectionOpened is called for each new connection of the layer, the injector may close it later to emulate reset.
+	ConnectionOpened(conn Connection)
+	// BeforeWrite is called before the data is written to the connection, it may block to delay the write.
+	// Returned data is written, nil drops the write silently.
+	BeforeWrite(conn Connection, data []byte) []byte
+	// AfterRead is called after the data is read from the connection.
+	// Returned data is passed to the parser, nil drops the datagram.
+	AfterRead(conn Connection, data []byte) []byte
+	Stats() FaultStats
+}
+
+// FaultConfig defines faults of the default injector.
+type FaultConfig struct {
+	// DropRate is a probability in range [0, 1] of the datagram loss, applied to reads and writes.
+	// Datagrams are dropped only on packet connections (UDP), streams would lose framing.
+	DropRate float64
+	// Delay delays each write.
+	Delay time.Duration
+	// Jitter is a maximum random delay added to Delay.
+	Jitter time.Duration
+	// CorruptRate is a probability in range [0, 1] of the write with one corrupted byte.
+	CorruptRate float64
+	// ResetInterval closes stream connections (TCP, TLS, WS) after the interval since they were opened.
+	ResetInterval time.Duration
+	// Networks limits faults to the networks, like "udp" or "tcp". All networks are affected if empty.
+	Networks []string
+	// Seed initializes random generator, so the faults are repeated on each run.
+	Seed int64
+}
+
+// FaultStats are counters of injected faults.
+type FaultStats struct {
+	Dropped   uint64
+	Delayed   uint64
+	Corrupted uint64
+	Reset     uint64
+}
+
+type faultInjector struct {
+	config   FaultConfig
+	networks map[string]bool
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	dropped   uint64
+	delayed   uint64
+	corrupted uint64
+	reset     uint64
+
+	log log.Logger
+}
+
+// NewFaultInjector creates injector of the faults defined by the config.
+func NewFaultInjector(config FaultConfig, logger log.Logger) FaultInjector {
+	fi := &faultInjector{
+		config:   config,
+		networks: make(map[string]bool, len(config.Networks)),
+		rand:     rand.New(rand.NewSource(config.Seed)),
+	}
+	for _, network := range config.Networks {
+		fi.networks[strings.ToUpper(network)] = true
+	}
+	fi.log = logger.
+		WithPrefix("transport.FaultInjector").
+		WithFields(log.Fields{
+			"fault_injector_ptr": fmt.Sprintf("%p", fi),
+		})
+
+	return fi
+}
+
+func (fi *faultInjector) Log() log.Logger {
+	return fi.log
+}
+
+func (fi *faultInjector) affects(conn Connection) bool {
+	return len(fi.networks) == 0 || fi.networks[conn.Network()]
+}
+
+// chance returns true with the probability p.
+func (fi *faultInjector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	return fi.rand.Float64() < p
+}
+
+func (fi *faultInjector) ConnectionOpened(conn Connection) {
+	if fi.config.ResetInterval <= 0 || !conn.Streamed() || !fi.affects(conn) {
+		return
+	}
+
+	timing.AfterFunc(fi.config.ResetInterval, func() {
+		atomic.AddUint64(&fi.reset, 1)
+		fi.Log().Debugf("reset connection %s", conn.Key())
+
+		conn.Close()
+	})
+}
+
+func (fi *faultInjector) BeforeWrite(conn Connection, data []byte) []byte {
+	if !fi.affects(conn) {
+		return data
+	}
+
+	if !conn.Streamed() && fi.chance(fi.config.DropRate) {
+		atomic.AddUint64(&fi.dropped, 1)
+		fi.Log().Tracef("drop %d bytes write to %s", len(data), conn.Key())
+
+		return nil
+	}
+
+	if delay := fi.delay(); delay > 0 {
+		atomic.AddUint64(&fi.delayed, 1)
+		timing.Sleep(delay)
+	}
+
+	if fi.chance(fi.config.CorruptRate) && len(data) > 0 {
+		atomic.AddUint64(&fi.corrupted, 1)
+
+		fi.mu.Lock()
+		i := fi.rand.Intn(len(data))
+		fi.mu.Unlock()
+
+		corrupted := append([]byte{}, data...)
+		corrupted[i] ^= 0xff
+		fi.Log().Tracef("corrupt byte %d of write to %s", i, conn.Key())
+
+		return corrupted
+	}
+
+	return data
+}
+
+func (fi *faultInjector) delay() time.Duration {
+	delay := fi.config.Delay
+	if fi.config.Jitter > 0 {
+		fi.mu.Lock()
+		delay += time.Duration(fi.rand.Int63n(int64(fi.config.Jitter)))
+		fi.mu.Unlock()
+	}
+
+	return delay
+}
+
+func (fi *faultInjector) AfterRead(conn Connection, data []byte) []byte {
+	if !fi.affects(conn) || conn.Streamed() {
+		return data
+	}
+
+	if fi.chance(fi.config.DropRate) {
+		atomic.AddUint64(&fi.dropped, 1)
+		fi.Log().Tracef("drop %d bytes read from %s", len(data), conn.Key())
+
+		return nil
+	}
+
+	return data
+}
+
+func (fi *faultInjector) Stats() FaultStats {
+	return FaultStats{
+		Dropped:   atomic.LoadUint64(&fi.dropped),
+		Delayed:   atomic.LoadUint64(&fi.delayed),
+		Corrupted: atomic.LoadUint64(&fi.corrupted),
+		Reset:     atomic.LoadUint64(&fi.reset),
+	}
+}
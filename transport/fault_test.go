@@ -0,0 +1,141 @@
+package transport_test
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+var _ = Describe("FaultInjector", func() {
+	var (
+		udpConn1, udpConn2 *net.UDPConn
+		conn               transport.Connection
+	)
+
+	logger := testutils.NewLogrusLogger()
+	timing.MockMode = true
+
+	BeforeEach(func() {
+		var err error
+		udpConn1, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5270})
+		Expect(err).NotTo(HaveOccurred())
+		udpConn2, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5271})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		udpConn1.Close()
+		udpConn2.Close()
+	})
+
+	It("should drop and corrupt datagrams", func() {
+		conn = transport.NewConnection(udpConn1, "udp:127.0.0.1:5270", "udp", logger)
+		fi := transport.NewFaultInjector(transport.FaultConfig{DropRate: 1}, logger)
+		Expect(fi.BeforeWrite(conn, []byte("lost"))).To(BeNil())
+		Expect(fi.AfterRead(conn, []byte("lost"))).To(BeNil())
+		Expect(fi.Stats()).To(Equal(transport.FaultStats{Dropped: 2}))
+
+		data := []byte("corrupted")
+		corrupted := transport.NewFaultInjector(transport.FaultConfig{CorruptRate: 1}, logger).BeforeWrite(conn, data)
+		Expect(corrupted).To(HaveLen(len(data)))
+		Expect(corrupted).NotTo(Equal(data))
+		Expect(string(data)).To(Equal("corrupted"))
+	})
+
+	It("should drop datagrams of the selected networks only", func() {
+		conn = transport.NewConnection(udpConn2, "udp:127.0.0.1:5271", "udp", logger)
+		fi := transport.NewFaultInjector(transport.FaultConfig{DropRate: 1, Networks: []string{"tcp"}}, logger)
+		Expect(fi.BeforeWrite(conn, []byte("delivered"))).To(Equal([]byte("delivered")))
+		Expect(fi.AfterRead(conn, []byte("delivered"))).To(Equal([]byte("delivered")))
+		Expect(fi.Stats()).To(Equal(transport.FaultStats{}))
+	})
+
+	It("should delay writes and reset stream connections", func() {
+		fi := transport.NewFaultInjector(transport.FaultConfig{
+			Delay:         time.Second,
+			ResetInterval: time.Minute,
+		}, logger)
+
+		client, server := net.Pipe()
+		defer server.Close()
+		conn = transport.NewConnection(client, "tcp:127.0.0.1:5272", "tcp", logger)
+		fi.ConnectionOpened(conn)
+
+		written := make(chan []byte, 1)
+		go func() {
+			written <- fi.BeforeWrite(conn, []byte("delayed"))
+		}()
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			buf := make([]byte, 100)
+			for {
+				if _, err := server.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+
+		Consistently(written, 50*time.Millisecond).ShouldNot(Receive())
+		timing.Elapse(time.Second)
+		Eventually(written).Should(Receive(Equal([]byte("delayed"))))
+
+		Consistently(closed, 50*time.Millisecond).ShouldNot(BeClosed())
+		timing.Elapse(time.Minute)
+		Eventually(closed).Should(BeClosed())
+
+		Expect(fi.Stats()).To(Equal(transport.FaultStats{Delayed: 1, Reset: 1}))
+	})
+
+	It("should inject faults into connections of the layer only", func() {
+		// sockets of the layers are opened by them
+		udpConn1.Close()
+		udpConn2.Close()
+
+		fi := transport.NewFaultInjector(transport.FaultConfig{DropRate: 1}, logger)
+		faulty := transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger,
+			transport.WithFaultInjector(fi))
+		defer func() {
+			faulty.Cancel()
+			<-faulty.Done()
+		}()
+		Expect(faulty.Listen("udp", "127.0.0.1:5270")).To(Succeed())
+		healthy := transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+		defer func() {
+			healthy.Cancel()
+			<-healthy.Done()
+		}()
+		Expect(healthy.Listen("udp", "127.0.0.1:5271")).To(Succeed())
+
+		peer, err := net.ListenPacket("udp", "127.0.0.1:5273")
+		Expect(err).NotTo(HaveOccurred())
+		defer peer.Close()
+		msg := "OPTIONS sip:bob@127.0.0.1 SIP/2.0\r\n" +
+			"Via: SIP/2.0/UDP 127.0.0.1:5273;branch=z9hG4bK.fault\r\n" +
+			"From: <sip:alice@127.0.0.1>;tag=fault-tag\r\n" +
+			"To: <sip:bob@127.0.0.1>\r\n" +
+			"Call-ID: fault-call-id\r\n" +
+			"CSeq: 1 OPTIONS\r\n" +
+			"Content-Length: 0\r\n\r\n"
+		for _, addr := range []string{"127.0.0.1:5270", "127.0.0.1:5271"} {
+			raddr, err := net.ResolveUDPAddr("udp", addr)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = peer.WriteTo([]byte(msg), raddr)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Eventually(healthy.Messages()).Should(Receive())
+		Eventually(func() uint64 { return fi.Stats().Dropped }).Should(BeEquivalentTo(1))
+		Consistently(faulty.Messages(), 100*time.Millisecond).ShouldNot(Receive())
+	})
+})
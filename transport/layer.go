@@ -8,9 +8,11 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/redact"
 	"github.com/ghettovoice/gosip/sip"
 )
 
@@ -26,13 +28,47 @@ type Layer interface {
 	Errors() <-chan error
 	// Listen starts listening on `addr` for each registered protocol.
 	Listen(network string, addr string, options ...ListenOption) error
+	// ListenContext starts listening on `addr` until the context is done.
+	ListenContext(ctx context.Context, network string, addr string, options ...ListenOption) error
+	// Unlisten stops listening on `addr`, established connections are kept until they are closed.
+	Unlisten(network string, addr string) error
 	// Send sends message on suitable protocol.
 	Send(msg sip.Message) error
+	// SendContext sends message on suitable protocol, the context deadline limits DNS lookup
+	// and establishing of the new connection.
+	SendContext(ctx context.Context, msg sip.Message) error
 	String() string
 	IsReliable(network string) bool
 	IsStreamed(network string) bool
 }
 
+// ProtocolLayer is implemented by transport layers that expose their protocols,
+// so optional interfaces of protocols like HTTPUpgrader, WsClient, TLSClient and Normalizable are used
+// by type assertion.
+type ProtocolLayer interface {
+	// Protocol returns the protocol of the network, it is created on the first call.
+	Protocol(network string) (Protocol, error)
+}
+
+// ConnectionCounter is implemented by transport layers that count open connections of their protocols,
+// so servers of the same process report only their own connections.
+type ConnectionCounter interface {
+	// OpenConnections returns number of open connections by network.
+	OpenConnections() map[string]int
+}
+
+// DropCounter is implemented by transport layers that count incoming datagrams dropped
+// because connections do not keep up with parser workers.
+type DropCounter interface {
+	// DroppedDatagrams returns number of dropped datagrams since the layer was created.
+	DroppedDatagrams() uint64
+}
+
+// pooledProtocol is implemented by protocols that keep connections in the pool.
+type pooledProtocol interface {
+	connectionCount() int
+}
+
 var protocolFactory ProtocolFactory = func(
 	network string,
 	output chan<- sip.Message,
@@ -67,13 +103,28 @@ func GetProtocolFactory() ProtocolFactory {
 	return protocolFactory
 }
 
+// NewProtocol creates protocol for the network by the current protocol factory,
+// the protocol is stopped when the context is done.
+func NewProtocol(
+	ctx context.Context,
+	network string,
+	output chan<- sip.Message,
+	errs chan<- error,
+	msgMapper sip.MessageMapper,
+	logger log.Logger,
+) (Protocol, error) {
+	return protocolFactory(network, output, errs, ctx.Done(), msgMapper, logger)
+}
+
 // TransportLayer implementation.
 type layer struct {
 	protocols   *protocolStore
+	listenMu    sync.RWMutex
 	listenPorts map[string][]sip.Port
 	ip          net.IP
 	dnsResolver *net.Resolver
 	msgMapper   sip.MessageMapper
+	env         *environment
 
 	msgs     chan sip.Message
 	errs     chan error
@@ -91,18 +142,26 @@ type layer struct {
 // NewLayer creates transport layer.
 // - ip - host IP
 // - dnsAddr - DNS server address, default is 127.0.0.1:53
+// - options - layer options, like WithEventBus
 func NewLayer(
 	ip net.IP,
 	dnsResolver *net.Resolver,
 	msgMapper sip.MessageMapper,
 	logger log.Logger,
+	options ...LayerOption,
 ) Layer {
+	opts := LayerOptions{}
+	for _, opt := range options {
+		opt.ApplyLayer(&opts)
+	}
+
 	tpl := &layer{
 		protocols:   newProtocolStore(),
 		listenPorts: make(map[string][]sip.Port),
 		ip:          ip,
 		dnsResolver: dnsResolver,
 		msgMapper:   msgMapper,
+		env:         newEnvironment(opts),
 
 		msgs:     make(chan sip.Message),
 		errs:     make(chan error),
@@ -175,12 +234,38 @@ func (tpl *layer) IsStreamed(network string) bool {
 	return false
 }
 
+func (tpl *layer) Protocol(network string) (Protocol, error) {
+	return tpl.getProtocol(network)
+}
+
+func (tpl *layer) OpenConnections() map[string]int {
+	counts := make(map[string]int)
+	for _, protocol := range tpl.protocols.all() {
+		if pooled, ok := protocol.(pooledProtocol); ok {
+			counts[protocol.Network()] += pooled.connectionCount()
+		}
+	}
+
+	return counts
+}
+
+func (tpl *layer) DroppedDatagrams() uint64 {
+	return atomic.LoadUint64(&tpl.env.dropped)
+}
+
 func (tpl *layer) Listen(network string, addr string, options ...ListenOption) error {
+	return tpl.ListenContext(context.Background(), network, addr, options...)
+}
+
+func (tpl *layer) ListenContext(ctx context.Context, network string, addr string, options ...ListenOption) error {
 	select {
 	case <-tpl.canceled:
 		return fmt.Errorf("transport layer is canceled")
 	default:
 	}
+	if err := ctx.Err(); err != nil {
+		return transportError("listen", network, addr, err)
+	}
 
 	protocol, err := tpl.getProtocol(network)
 	if err != nil {
@@ -192,20 +277,90 @@ func (tpl *layer) Listen(network string, addr string, options ...ListenOption) e
 	}
 	target = FillTargetHostAndPort(protocol.Network(), target)
 
-	err = protocol.Listen(target, options...)
-	if err == nil {
-		if _, ok := tpl.listenPorts[protocol.Network()]; !ok {
-			if tpl.listenPorts[protocol.Network()] == nil {
-				tpl.listenPorts[protocol.Network()] = make([]sip.Port, 0)
+	if err := protocol.Listen(target, options...); err != nil {
+		return transportError("listen", protocol.Network(), target.Addr(), err)
+	}
+
+	tpl.listenMu.Lock()
+	if _, ok := tpl.listenPorts[protocol.Network()]; !ok {
+		if tpl.listenPorts[protocol.Network()] == nil {
+			tpl.listenPorts[protocol.Network()] = make([]sip.Port, 0)
+		}
+		tpl.listenPorts[protocol.Network()] = append(tpl.listenPorts[protocol.Network()], *target.Port)
+	}
+	// dispose locks listenPorts after cancel, so the watcher is never added after wg.Wait
+	watch := false
+	if ctx.Done() != nil {
+		select {
+		case <-tpl.canceled:
+		default:
+			tpl.wg.Add(1)
+			watch = true
+		}
+	}
+	tpl.listenMu.Unlock()
+
+	if watch {
+		go func() {
+			defer tpl.wg.Done()
+
+			select {
+			case <-tpl.canceled:
+			case <-ctx.Done():
+				if err := tpl.Unlisten(network, addr); err != nil {
+					tpl.Log().Debugf("stop listening on %s %s failed: %s", network, addr, err)
+				}
 			}
-			tpl.listenPorts[protocol.Network()] = append(tpl.listenPorts[protocol.Network()], *target.Port)
+		}()
+	}
+
+	return nil
+}
+
+func (tpl *layer) Unlisten(network string, addr string) error {
+	select {
+	case <-tpl.canceled:
+		return fmt.Errorf("transport layer is canceled")
+	default:
+	}
+
+	protocol, err := tpl.getProtocol(network)
+	if err != nil {
+		return err
+	}
+	target, err := NewTargetFromAddr(addr)
+	if err != nil {
+		return err
+	}
+	target = FillTargetHostAndPort(protocol.Network(), target)
+
+	if err := protocol.Unlisten(target); err != nil {
+		return transportError("unlisten", protocol.Network(), target.Addr(), err)
+	}
+
+	tpl.listenMu.Lock()
+	defer tpl.listenMu.Unlock()
+	ports := tpl.listenPorts[protocol.Network()]
+	for i, port := range ports {
+		if port == *target.Port {
+			ports = append(ports[:i:i], ports[i+1:]...)
+			break
 		}
 	}
+	if len(ports) == 0 {
+		delete(tpl.listenPorts, protocol.Network())
+	} else {
+		tpl.listenPorts[protocol.Network()] = ports
+	}
 
-	return err
+	return nil
 }
 
 func (tpl *layer) Send(msg sip.Message) error {
+	return tpl.SendContext(context.Background(), msg)
+}
+
+func (tpl *layer) SendContext(ctx context.Context, msg sip.Message) error {
 	select {
 	case <-tpl.canceled:
 		return fmt.Errorf("transport layer is canceled")
@@ -224,6 +379,7 @@ func (tpl *layer) Send(msg sip.Message) error {
 	// RFC 3261 - 18.1.1.
 	case sip.Request:
 		network := msg.Transport()
+		sentProto, sentBy := viaHop.Transport, viaHop.SentBy()
 		// rewrite sent-by transport
 		viaHop.Transport = strings.ToUpper(network)
 		viaHop.Host = tpl.ip.String()
@@ -235,6 +391,7 @@ func (tpl *layer) Send(msg sip.Message) error {
 
 		// rewrite sent-by port
 		if viaHop.Port == nil {
+			tpl.listenMu.RLock()
 			if ports, ok := tpl.listenPorts[network]; ok {
 				port := ports[rand.Intn(len(ports))]
 				viaHop.Port = &port
@@ -242,6 +399,12 @@ func (tpl *layer) Send(msg sip.Message) error {
 				defPort := sip.DefaultPort(network)
 				viaHop.Port = &defPort
 			}
+			tpl.listenMu.RUnlock()
+		}
+		// Via is changed in place, so the cached wire form of the request is dropped,
+		// retransmissions keep it as they have the same sent-by
+		if viaHop.Transport != sentProto || viaHop.SentBy() != sentBy {
+			sip.InvalidateWire(msg)
 		}
 
 		target, err := NewTargetFromAddr(msg.Destination())
@@ -249,9 +412,12 @@ func (tpl *layer) Send(msg sip.Message) error {
 			return fmt.Errorf("build address target for %s: %w", msg.Destination(), err)
 		}
 
+		if network == "TLS" {
+			target.Domain = tlsDomain(msg)
+		}
+
 		// dns srv lookup
 		if net.ParseIP(target.Host) == nil {
-			ctx := context.Background()
 			proto := strings.ToLower(network)
 			if _, addrs, err := tpl.dnsResolver.LookupSRV(ctx, "sip", proto, target.Host); err == nil && len(addrs) > 0 {
 				addr := addrs[0]
@@ -287,11 +453,15 @@ func (tpl *layer) Send(msg sip.Message) error {
 			}
 		}
 
-		logger := log.AddFieldsFrom(tpl.Log(), protocol, msg)
-		logger.Debugf("sending SIP request:\n%s", msg)
+		// fields of the send are added to the logger only, the message is not changed
+		logger := log.AddFieldsFrom(tpl.Log(), protocol, msg).WithFields(log.Fields{
+			"direction":   "out",
+			"remote_addr": target.Addr(),
+		})
+		logger.Debugf("sending SIP request:\n%s", redact.Message(msg))
 
-		if err = protocol.Send(target, msg); err != nil {
-			return fmt.Errorf("send SIP message through %s protocol to %s: %w", protocol.Network(), target.Addr(), err)
+		if err = protocol.SendContext(ctx, target, msg); err != nil {
+			return transportError("send", protocol.Network(), target.Addr(), err)
 		}
 
 		return nil
@@ -308,11 +478,14 @@ func (tpl *layer) Send(msg sip.Message) error {
 			return fmt.Errorf("build address target for %s: %w", msg.Destination(), err)
 		}
 
-		logger := log.AddFieldsFrom(tpl.Log(), protocol, msg)
-		logger.Debugf("sending SIP response:\n%s", msg)
+		logger := log.AddFieldsFrom(tpl.Log(), protocol, msg).WithFields(log.Fields{
+			"direction":   "out",
+			"remote_addr": target.Addr(),
+		})
+		logger.Debugf("sending SIP response:\n%s", redact.Message(msg))
 
-		if err = protocol.Send(target, msg); err != nil {
-			return fmt.Errorf("send SIP message through %s protocol to %s: %w", protocol.Network(), target.Addr(), err)
+		if err = protocol.SendContext(ctx, target, msg); err != nil {
+			return transportError("send", protocol.Network(), target.Addr(), err)
 		}
 
 		return nil
@@ -324,10 +497,21 @@ func (tpl *layer) Send(msg sip.Message) error {
 	}
 }
 
+// transportError wraps error of the protocol into sip.TransportError,
+// resolution failures are wrapped into sip.DNSError too.
+func transportError(op, network, addr string, err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && !errors.Is(err, sip.ErrDNS) {
+		err = &sip.DNSError{Host: dnsErr.Name, Type: "A", Err: err}
+	}
+
+	return &sip.TransportError{Op: op, Network: network, Addr: addr, Err: err}
+}
+
 func (tpl *layer) getProtocol(network string) (Protocol, error) {
 	network = strings.ToLower(network)
 	return tpl.protocols.getOrPutNew(protocolKey(network), func() (Protocol, error) {
-		return protocolFactory(
+		protocol, err := protocolFactory(
 			network,
 			tpl.pmsgs,
 			tpl.perrs,
@@ -335,12 +519,21 @@ func (tpl *layer) getProtocol(network string) (Protocol, error) {
 			tpl.msgMapper,
 			tpl.Log(),
 		)
+		if err != nil {
+			return nil, err
+		}
+		if p, ok := protocol.(environmental); ok {
+			p.setEnvironment(tpl.env)
+		}
+
+		return protocol, nil
 	})
 }
 
 func (tpl *layer) serveProtocols() {
 	defer func() {
 		tpl.dispose()
+		tpl.wg.Wait()
 		close(tpl.done)
 	}()
 
@@ -367,7 +560,9 @@ func (tpl *layer) dispose() {
 		<-protocol.Done()
 	}
 
+	tpl.listenMu.Lock()
 	tpl.listenPorts = make(map[string][]sip.Port)
+	tpl.listenMu.Unlock()
 
 	close(tpl.pmsgs)
 	close(tpl.perrs)
@@ -380,7 +575,7 @@ func (tpl *layer) dispose() {
 func (tpl *layer) handleMessage(msg sip.Message) {
 	logger := tpl.Log().WithFields(msg.Fields())
 
-	logger.Debugf("received SIP message:\n%s", msg)
+	logger.Debugf("received SIP message:\n%s", redact.Message(msg))
 	logger.Trace("passing up SIP message...")
 
 	// pass up message
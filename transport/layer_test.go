@@ -1,6 +1,8 @@
 package transport_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -132,7 +134,11 @@ var _ = Describe("TransportLayer", func() {
 					}()
 					time.Sleep(time.Second)
 					By(fmt.Sprintf("tpl sends response to %s", response.Destination()))
-					Expect(tpl.Send(sip.CopyResponse(response))).ToNot(HaveOccurred())
+					sent := sip.CopyResponse(response)
+					fields := sent.Fields()
+					Expect(tpl.Send(sent)).ToNot(HaveOccurred())
+					// fields of the send are logged without changes of the message
+					Expect(sent.Fields()).To(Equal(fields))
 
 					twg.Wait()
 					close(done)
@@ -242,4 +248,40 @@ var _ = Describe("TransportLayer", func() {
 			}, 3)
 		})
 	})
+	Context("with context", func() {
+		ctxAddr := "127.0.0.1:5278"
+
+		It("should stop listening when the context is canceled", func(done Done) {
+			ctx, cancel := context.WithCancel(context.Background())
+			Expect(tpl.ListenContext(ctx, "tcp", ctxAddr)).To(Succeed())
+
+			conn, err := net.Dial("tcp", ctxAddr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.Close()).To(Succeed())
+
+			cancel()
+			Eventually(func() error {
+				_, err := net.Dial("tcp", ctxAddr)
+				return err
+			}, 2).Should(HaveOccurred())
+			close(done)
+		}, 3)
+
+		It("should not send message with canceled context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			req := testutils.Request([]string{
+				"INVITE sip:bob@127.0.0.1:5279 SIP/2.0",
+				"Via: SIP/2.0/UDP 127.0.0.1:5278;branch=z9hG4bK776asdhds",
+				"CSeq: 1 INVITE",
+				"",
+				"",
+			})
+			err := tpl.SendContext(ctx, req)
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(errors.Is(err, sip.ErrTransport)).To(BeTrue())
+		})
+	})
 })
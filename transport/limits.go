@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// Limitable is implemented by protocols that bound headers of incoming messages while they are framed.
+// Messages over limits are passed up as *parser.LimitError instead of messages,
+// the error of the request has the message with Via, From, To, Call-ID and CSeq to answer it statelessly.
+type Limitable interface {
+	// SetMessageLimits sets limits of datagrams received and of streams connected after the call,
+	// zero limits disable them.
+	SetMessageLimits(limits parser.Limits)
+}
+
+func (pool *connectionPool) SetMessageLimits(limits parser.Limits) {
+	pool.limits.Store(limits)
+}
+
+func (pool *connectionPool) getMessageLimits() parser.Limits {
+	limits, _ := pool.limits.Load().(parser.Limits)
+
+	return limits
+}
+
+func (p *udpProtocol) SetMessageLimits(limits parser.Limits) {
+	if pool, ok := p.connections.(Limitable); ok {
+		pool.SetMessageLimits(limits)
+	}
+}
+
+func (p *tcpProtocol) SetMessageLimits(limits parser.Limits) {
+	if pool, ok := p.connections.(Limitable); ok {
+		pool.SetMessageLimits(limits)
+	}
+}
+
+func (p *wsProtocol) SetMessageLimits(limits parser.Limits) {
+	if pool, ok := p.connections.(Limitable); ok {
+		pool.SetMessageLimits(limits)
+	}
+}
+
+// messageLimits returns limits of messages of the connection.
+func (handler *connectionHandler) messageLimits() parser.Limits {
+	if handler.limits == nil {
+		return parser.Limits{}
+	}
+
+	return handler.limits()
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/log"
 )
 
@@ -45,6 +46,7 @@ type ListenerHandler interface {
 
 type listenerPool struct {
 	hwg   sync.WaitGroup
+	swg   sync.WaitGroup
 	mu    sync.RWMutex
 	store map[ListenerKey]ListenerHandler
 
@@ -56,6 +58,8 @@ type listenerPool struct {
 	hconns chan Connection
 	herrs  chan error
 
+	environmentHolder
+
 	log log.Logger
 }
 
@@ -86,6 +90,7 @@ func NewListenerPool(
 		<-pool.cancel
 		pool.dispose()
 	}()
+	pool.swg.Add(1)
 	go pool.serveHandlers()
 
 	return pool
@@ -184,11 +189,14 @@ func (pool *listenerPool) dispose() {
 	// stop serveHandlers goroutine
 	close(pool.hconns)
 	close(pool.herrs)
+	pool.swg.Wait()
 
 	close(pool.done)
 }
 
 func (pool *listenerPool) serveHandlers() {
+	defer pool.swg.Done()
+
 	pool.Log().Debug("start serve listener handlers")
 	defer pool.Log().Debug("stop serve listener handlers")
 
@@ -226,7 +234,8 @@ func (pool *listenerPool) serveHandlers() {
 				pool.mu.RLock()
 				handler, gerr := pool.get(lerr.Key)
 				pool.mu.RUnlock()
-				if gerr == nil {
+				// the listener of the same key could be put again after the failed one was dropped
+				if gerr == nil && fmt.Sprintf("%p", handler) == lerr.HandlerPtr {
 					logger = logger.WithFields(handler.Log().Fields())
 
 					if lerr.Network() {
@@ -274,6 +283,9 @@ func (pool *listenerPool) put(key ListenerKey, listener net.Listener) error {
 
 	// wrap to handler
 	handler := NewListenerHandler(key, listener, pool.hconns, pool.herrs, pool.Log())
+	if h, ok := handler.(*listenerHandler); ok {
+		h.env = pool.getEnvironment
+	}
 
 	pool.Log().WithFields(handler.Log().Fields()).Trace("put listener to the pool")
 
@@ -334,6 +346,8 @@ type listenerHandler struct {
 
 	output chan<- Connection
 	errs   chan<- error
+	// env returns the environment of the pool
+	env func() *environment
 
 	cancelOnce sync.Once
 	canceled   chan struct{}
@@ -355,6 +369,9 @@ func NewListenerHandler(
 
 		output: output,
 		errs:   errs,
+		env: func() *environment {
+			return defaultEnvironment
+		},
 
 		canceled: make(chan struct{}),
 		done:     make(chan struct{}),
@@ -439,6 +456,16 @@ func (handler *listenerHandler) acceptConnections(wg *sync.WaitGroup) {
 				handler.Listener().Addr().String(),
 			}
 
+			select {
+			case <-handler.canceled:
+			default:
+				handler.env().bus.Publish(&eventbus.ListenerFailedEvent{
+					Network: listenerNetwork(handler.Listener()),
+					Addr:    handler.Listener().Addr().String(),
+					Err:     err,
+				})
+			}
+
 			select {
 			case <-handler.canceled:
 			case handler.errs <- err:
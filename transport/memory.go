@@ -0,0 +1,455 @@
+package transport
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// DefaultReorderDelay is a default extra delay of reordered packets in the MemoryNetwork.
+const DefaultReorderDelay = 50 * time.Millisecond
+
+// MemoryConfig defines delivery conditions of the MemoryNetwork.
+type MemoryConfig struct {
+	// Latency is a delay of each packet.
+	Latency time.Duration
+	// Jitter is a maximum random delay added to Latency.
+	Jitter time.Duration
+	// Loss is a probability of the packet loss in range [0, 1].
+	Loss float64
+	// Reorder is a probability in range [0, 1] of the packet to be delayed by ReorderDelay,
+	// so the next packets overtake it.
+	Reorder float64
+	// ReorderDelay is an extra delay of reordered packets, default is DefaultReorderDelay.
+	ReorderDelay time.Duration
+	// Drop is called for each packet, the packet is lost when it returns true.
+	// It allows to lose exact messages, like the first INVITE or the last ACK.
+	Drop func(src, dst string, data []byte) bool
+	// Seed initializes random generator of jitter, loss and reordering,
+	// so the network behaves the same way on each run.
+	Seed int64
+}
+
+// MemoryStats are packet counters of the MemoryNetwork.
+type MemoryStats struct {
+	Sent      uint64
+	Delivered uint64
+	Lost      uint64
+	Reordered uint64
+}
+
+// MemoryNetwork is an in-process packet network that connects transport layers
+// of several stacks without sockets. Packets are delivered in the send order,
+// excluding packets delayed by jitter or reordering.
+type MemoryNetwork interface {
+	// ListenPacket binds the packet connection to addr, port 0 allocates a free port.
+	// Returned connection implements net.Conn as *net.UDPConn does.
+	ListenPacket(addr string) (net.PacketConn, error)
+	// ProtocolFactory returns factory of protocols connected to the network, it serves UDP only.
+	// Pass it to SetProtocolFactory before creation of the transport layers.
+	ProtocolFactory() ProtocolFactory
+	// SetConfig changes delivery conditions of the next packets.
+	SetConfig(config MemoryConfig)
+	Stats() MemoryStats
+	// Close closes all connections of the network.
+	Close()
+}
+
+type memoryNetwork struct {
+	mu       sync.Mutex
+	config   MemoryConfig
+	rand     *rand.Rand
+	conns    map[string]*memoryConn
+	nextPort int
+	stats    MemoryStats
+
+	queue  packetQueue
+	seq    uint64
+	wake   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+
+	log log.Logger
+}
+
+// NewMemoryNetwork creates network and starts packets delivery.
+func NewMemoryNetwork(config MemoryConfig, logger log.Logger) MemoryNetwork {
+	mn := &memoryNetwork{
+		conns:    make(map[string]*memoryConn),
+		nextPort: 49152,
+		wake:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	mn.setConfig(config)
+	mn.log = logger.
+		WithPrefix("transport.MemoryNetwork").
+		WithFields(log.Fields{
+			"memory_network_ptr": fmt.Sprintf("%p", mn),
+		})
+
+	go mn.deliver()
+
+	return mn
+}
+
+func (mn *memoryNetwork) Log() log.Logger {
+	return mn.log
+}
+
+func (mn *memoryNetwork) String() string {
+	if mn == nil {
+		return "<nil>"
+	}
+
+	return fmt.Sprintf("transport.MemoryNetwork<%s>", mn.Log().Fields())
+}
+
+func (mn *memoryNetwork) SetConfig(config MemoryConfig) {
+	mn.mu.Lock()
+	mn.setConfig(config)
+	mn.mu.Unlock()
+}
+
+func (mn *memoryNetwork) setConfig(config MemoryConfig) {
+	if config.ReorderDelay <= 0 {
+		config.ReorderDelay = DefaultReorderDelay
+	}
+
+	mn.config = config
+	mn.rand = rand.New(rand.NewSource(config.Seed))
+}
+
+func (mn *memoryNetwork) Stats() MemoryStats {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	return mn.stats
+}
+
+func (mn *memoryNetwork) ProtocolFactory() ProtocolFactory {
+	return func(
+		network string,
+		output chan<- sip.Message,
+		errs chan<- error,
+		cancel <-chan struct{},
+		msgMapper sip.MessageMapper,
+		logger log.Logger,
+	) (Protocol, error) {
+		if network != "udp" {
+			return nil, UnsupportedProtocolError(fmt.Sprintf("protocol %s is not supported by %s", network, mn))
+		}
+
+		p := NewUdpProtocol(output, errs, cancel, msgMapper, logger).(*udpProtocol)
+		p.listen = func(laddr *net.UDPAddr) (net.Conn, error) {
+			conn, err := mn.ListenPacket(laddr.String())
+			if err != nil {
+				return nil, err
+			}
+
+			return conn.(net.Conn), nil
+		}
+
+		return p, nil
+	}
+}
+
+func (mn *memoryNetwork) ListenPacket(addr string) (net.PacketConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	select {
+	case <-mn.closed:
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: laddr, Err: errMemoryClosed}
+	default:
+	}
+
+	if laddr.Port == 0 {
+		for mn.lookup(&net.UDPAddr{IP: laddr.IP, Port: mn.nextPort}) != nil {
+			mn.nextPort++
+		}
+		laddr.Port = mn.nextPort
+		mn.nextPort++
+	}
+	if mn.lookup(laddr) != nil {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: laddr, Err: errors.New("address already in use")}
+	}
+
+	conn := &memoryConn{
+		network: mn,
+		laddr:   laddr,
+		in:      make(chan memoryPacket, 1024),
+		closed:  make(chan struct{}),
+	}
+	mn.conns[laddr.String()] = conn
+
+	return conn, nil
+}
+
+// lookup returns connection bound to the address or to the unspecified address with the same port.
+func (mn *memoryNetwork) lookup(addr *net.UDPAddr) *memoryConn {
+	if conn, ok := mn.conns[addr.String()]; ok {
+		return conn
+	}
+	for _, ip := range []net.IP{net.IPv4zero, net.IPv6unspecified} {
+		if conn, ok := mn.conns[(&net.UDPAddr{IP: ip, Port: addr.Port}).String()]; ok {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+func (mn *memoryNetwork) Close() {
+	mn.once.Do(func() {
+		close(mn.closed)
+
+		mn.mu.Lock()
+		conns := make([]*memoryConn, 0, len(mn.conns))
+		for _, conn := range mn.conns {
+			conns = append(conns, conn)
+		}
+		mn.mu.Unlock()
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+}
+
+// send schedules delivery of the packet according to the network conditions.
+func (mn *memoryNetwork) send(data []byte, src, dst *net.UDPAddr) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	mn.stats.Sent++
+
+	config := mn.config
+	if (config.Drop != nil && config.Drop(src.String(), dst.String(), data)) ||
+		(config.Loss > 0 && mn.rand.Float64() < config.Loss) {
+		mn.stats.Lost++
+		mn.Log().Tracef("packet %s -> %s lost", src, dst)
+
+		return
+	}
+
+	delay := config.Latency
+	if config.Jitter > 0 {
+		delay += time.Duration(mn.rand.Int63n(int64(config.Jitter)))
+	}
+	if config.Reorder > 0 && mn.rand.Float64() < config.Reorder {
+		delay += config.ReorderDelay
+		mn.stats.Reordered++
+	}
+
+	mn.seq++
+	heap.Push(&mn.queue, &memoryPacket{
+		data: append([]byte{}, data...),
+		src:  src,
+		dst:  dst,
+		at:   time.Now().Add(delay),
+		seq:  mn.seq,
+	})
+
+	select {
+	case mn.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver passes due packets to the connections in order of delivery time and send order.
+func (mn *memoryNetwork) deliver() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		mn.mu.Lock()
+		wait := time.Hour
+		for mn.queue.Len() > 0 {
+			pkt := mn.queue[0]
+			if d := time.Until(pkt.at); d > 0 {
+				wait = d
+				break
+			}
+
+			heap.Pop(&mn.queue)
+			if conn := mn.lookup(pkt.dst); conn != nil && conn.put(*pkt) {
+				mn.stats.Delivered++
+			} else {
+				mn.stats.Lost++
+				mn.Log().Tracef("packet %s -> %s lost: destination unreachable", pkt.src, pkt.dst)
+			}
+		}
+		mn.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-mn.closed:
+			return
+		case <-mn.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+func (mn *memoryNetwork) remove(conn *memoryConn) {
+	mn.mu.Lock()
+	if mn.conns[conn.laddr.String()] == conn {
+		delete(mn.conns, conn.laddr.String())
+	}
+	mn.mu.Unlock()
+}
+
+type memoryPacket struct {
+	data []byte
+	src  *net.UDPAddr
+	dst  *net.UDPAddr
+	at   time.Time
+	seq  uint64
+}
+
+// packetQueue is a min-heap of packets by delivery time and send order.
+type packetQueue []*memoryPacket
+
+func (q packetQueue) Len() int { return len(q) }
+
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+
+	return q[i].at.Before(q[j].at)
+}
+
+func (q packetQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *packetQueue) Push(x interface{}) {
+	*q = append(*q, x.(*memoryPacket))
+}
+
+func (q *packetQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	pkt := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+
+	return pkt
+}
+
+var errMemoryClosed = errors.New("use of closed network connection")
+
+// memoryConn is the packet connection of the MemoryNetwork.
+type memoryConn struct {
+	network *memoryNetwork
+	laddr   *net.UDPAddr
+	in      chan memoryPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// put queues the packet without blocking of the network, packet is dropped on full buffer like in UDP.
+func (conn *memoryConn) put(pkt memoryPacket) bool {
+	select {
+	case <-conn.closed:
+		return false
+	case conn.in <- pkt:
+		return true
+	default:
+		return false
+	}
+}
+
+func (conn *memoryConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	select {
+	case <-conn.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: conn.laddr, Err: errMemoryClosed}
+	case pkt := <-conn.in:
+		return copy(buf, pkt.data), pkt.src, nil
+	}
+}
+
+func (conn *memoryConn) Read(buf []byte) (int, error) {
+	num, _, err := conn.ReadFrom(buf)
+
+	return num, err
+}
+
+func (conn *memoryConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: errMemoryClosed}
+	default:
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: err}
+	}
+
+	src := conn.laddr
+	if src.IP == nil || src.IP.IsUnspecified() {
+		// like the system picks address of the outgoing interface
+		src = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: src.Port}
+	}
+	conn.network.send(buf, src, raddr)
+
+	return len(buf), nil
+}
+
+func (conn *memoryConn) Write(buf []byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "udp", Addr: conn.laddr, Err: errors.New("destination address required")}
+}
+
+func (conn *memoryConn) Close() error {
+	closed := false
+	conn.once.Do(func() {
+		close(conn.closed)
+		closed = true
+	})
+	if !closed {
+		return &net.OpError{Op: "close", Net: "udp", Addr: conn.laddr, Err: errMemoryClosed}
+	}
+
+	conn.network.remove(conn)
+
+	return nil
+}
+
+func (conn *memoryConn) LocalAddr() net.Addr {
+	return conn.laddr
+}
+
+func (conn *memoryConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (conn *memoryConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *memoryConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,172 @@
+package transport_test
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/timing"
+	"github.com/ghettovoice/gosip/transaction"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+var _ = Describe("MemoryNetwork", func() {
+	var mn transport.MemoryNetwork
+
+	logger := testutils.NewLogrusLogger()
+	timing.MockMode = true
+
+	BeforeEach(func() {
+		mn = transport.NewMemoryNetwork(transport.MemoryConfig{}, logger)
+	})
+
+	AfterEach(func() {
+		mn.Close()
+	})
+
+	read := func(conn net.PacketConn) string {
+		buf := make([]byte, 100)
+		num, _, err := conn.ReadFrom(buf)
+		Expect(err).NotTo(HaveOccurred())
+		return string(buf[:num])
+	}
+
+	It("should deliver packets in order with latency", func() {
+		mn.SetConfig(transport.MemoryConfig{Latency: 50 * time.Millisecond})
+
+		conn1, err := mn.ListenPacket("127.0.0.1:5260")
+		Expect(err).NotTo(HaveOccurred())
+		conn2, err := mn.ListenPacket("127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = mn.ListenPacket("127.0.0.1:5260")
+		Expect(err).To(HaveOccurred())
+
+		start := time.Now()
+		for _, data := range []string{"first", "second", "third"} {
+			_, err := conn2.WriteTo([]byte(data), conn1.LocalAddr())
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		buf := make([]byte, 100)
+		num, raddr, err := conn1.ReadFrom(buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		Expect(string(buf[:num])).To(Equal("first"))
+		Expect(raddr.String()).To(Equal(conn2.LocalAddr().String()))
+		Expect(read(conn1)).To(Equal("second"))
+		Expect(read(conn1)).To(Equal("third"))
+
+		Expect(mn.Stats()).To(Equal(transport.MemoryStats{Sent: 3, Delivered: 3}))
+	})
+
+	It("should lose and reorder packets", func() {
+		conn1, err := mn.ListenPacket("127.0.0.1:5260")
+		Expect(err).NotTo(HaveOccurred())
+		conn2, err := mn.ListenPacket("127.0.0.1:5261")
+		Expect(err).NotTo(HaveOccurred())
+
+		mn.SetConfig(transport.MemoryConfig{
+			Drop: func(src, dst string, data []byte) bool {
+				return bytes.Equal(data, []byte("lost"))
+			},
+		})
+		_, err = conn2.WriteTo([]byte("lost"), conn1.LocalAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		mn.SetConfig(transport.MemoryConfig{Reorder: 1, ReorderDelay: 20 * time.Millisecond})
+		_, err = conn2.WriteTo([]byte("delayed"), conn1.LocalAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		mn.SetConfig(transport.MemoryConfig{})
+		_, err = conn2.WriteTo([]byte("overtaking"), conn1.LocalAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		mn.SetConfig(transport.MemoryConfig{Loss: 1})
+		_, err = conn2.WriteTo([]byte("random"), conn1.LocalAddr())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(read(conn1)).To(Equal("overtaking"))
+		Expect(read(conn1)).To(Equal("delayed"))
+		Expect(mn.Stats()).To(Equal(transport.MemoryStats{Sent: 4, Delivered: 2, Lost: 2, Reordered: 1}))
+	})
+
+	Context("connecting two stacks", func() {
+		var (
+			prevFactory transport.ProtocolFactory
+			tpl1, tpl2  transport.Layer
+			txl1, txl2  transaction.Layer
+		)
+
+		BeforeEach(func() {
+			prevFactory = transport.GetProtocolFactory()
+			transport.SetProtocolFactory(mn.ProtocolFactory())
+
+			tpl1 = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+			Expect(tpl1.Listen("udp", "127.0.0.1:5260")).To(Succeed())
+			Expect(tpl1.Listen("tcp", "127.0.0.1:5260")).NotTo(Succeed())
+			tpl2 = transport.NewLayer(net.ParseIP("127.0.0.1"), net.DefaultResolver, nil, logger)
+			Expect(tpl2.Listen("udp", "127.0.0.1:5261")).To(Succeed())
+
+			txl1 = transaction.NewLayer(tpl1, logger)
+			txl2 = transaction.NewLayer(tpl2, logger)
+		})
+
+		AfterEach(func() {
+			txl1.Cancel()
+			<-txl1.Done()
+			txl2.Cancel()
+			<-txl2.Done()
+			tpl1.Cancel()
+			<-tpl1.Done()
+			tpl2.Cancel()
+			<-tpl2.Done()
+
+			transport.SetProtocolFactory(prevFactory)
+		})
+
+		It("should recover the lost request by retransmission", func() {
+			var dropped int32
+			mn.SetConfig(transport.MemoryConfig{
+				Latency: time.Millisecond,
+				Drop: func(src, dst string, data []byte) bool {
+					return bytes.HasPrefix(data, []byte("OPTIONS")) && atomic.CompareAndSwapInt32(&dropped, 0, 1)
+				},
+			})
+
+			req := testutils.Request([]string{
+				"OPTIONS sip:bob@127.0.0.1:5261 SIP/2.0",
+				"Via: SIP/2.0/UDP 127.0.0.1:5260;branch=" + sip.GenerateBranch(),
+				"From: <sip:alice@127.0.0.1>;tag=1928301774",
+				"To: <sip:bob@127.0.0.1>",
+				"Call-ID: a84b4c76e66710",
+				"CSeq: 1 OPTIONS",
+				"Content-Length: 0",
+				"",
+				"",
+			})
+			tx, err := txl1.Request(req)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(func() uint64 { return mn.Stats().Lost }).Should(BeEquivalentTo(1))
+			Consistently(txl2.Requests(), 100*time.Millisecond).ShouldNot(Receive())
+			// timer A fires the retransmission
+			timing.Elapse(transaction.Timer_A)
+
+			var srvTx sip.ServerTransaction
+			Eventually(txl2.Requests(), 2).Should(Receive(&srvTx))
+			_, err = txl2.Respond(sip.NewResponseFromRequest("", srvTx.Origin(), 200, "OK", ""))
+			Expect(err).NotTo(HaveOccurred())
+
+			var res sip.Response
+			Eventually(tx.Responses(), 2).Should(Receive(&res))
+			Expect(res.StatusCode()).To(BeEquivalentTo(200))
+			Expect(mn.Stats()).To(Equal(transport.MemoryStats{Sent: 3, Delivered: 2, Lost: 1}))
+		}, 5)
+	})
+})
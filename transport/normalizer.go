@@ -0,0 +1,44 @@
+package transport
+
+// Normalizer repairs raw data of incoming messages of broken peers before the data is parsed,
+// like messages with bare LF line endings or wrong Content-Length.
+// It is called from the reading goroutine of the connection, so it must not block.
+type Normalizer interface {
+	// Normalize returns repaired datagram received from the source address, it may modify the data in place.
+	Normalize(data []byte, source string) []byte
+}
+
+// NormalizerFunc is an adapter of the function to Normalizer.
+type NormalizerFunc func(data []byte, source string) []byte
+
+func (fn NormalizerFunc) Normalize(data []byte, source string) []byte {
+	return fn(data, source)
+}
+
+// Normalizable is implemented by protocols that normalize incoming data.
+// Only datagrams of packet protocols are normalized, since messages of streams are framed by Content-Length.
+type Normalizable interface {
+	// SetNormalizer sets normalizer of the data received after the call, nil disables normalization.
+	SetNormalizer(normalizer Normalizer)
+}
+
+// normalizerHolder keeps the normalizer in atomic.Value, since it stores values of the same type only.
+type normalizerHolder struct {
+	normalizer Normalizer
+}
+
+func (pool *connectionPool) SetNormalizer(normalizer Normalizer) {
+	pool.normalizer.Store(normalizerHolder{normalizer})
+}
+
+func (pool *connectionPool) getNormalizer() Normalizer {
+	holder, _ := pool.normalizer.Load().(normalizerHolder)
+
+	return holder.normalizer
+}
+
+func (p *udpProtocol) SetNormalizer(normalizer Normalizer) {
+	if pool, ok := p.connections.(Normalizable); ok {
+		pool.SetNormalizer(normalizer)
+	}
+}
@@ -3,6 +3,7 @@ package transport
 import (
 	"net"
 
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
 )
@@ -20,6 +21,13 @@ type LayerOption interface {
 type LayerOptions struct {
 	Options
 	DNSResolver *net.Resolver
+	// EventBus receives events of connections and listeners of the layer, default is eventbus.Default.
+	EventBus eventbus.Bus
+	// FaultInjector breaks connections of the layer, nil disables faults.
+	FaultInjector FaultInjector
+	// ParserWorkers is the number of goroutines parsing datagrams of packet connections of each protocol,
+	// default is GOMAXPROCS.
+	ParserWorkers int
 }
 
 type ProtocolOption interface {
@@ -80,6 +88,47 @@ func (o withDnsResolver) ApplyLayer(opts *LayerOptions) {
 	opts.DNSResolver = o.resolver
 }
 
+// WithEventBus publishes events of connections and listeners of the layer to the bus,
+// like the bus of the server to keep events of servers of the process apart.
+func WithEventBus(bus eventbus.Bus) LayerOption {
+	return withEventBus{bus}
+}
+
+type withEventBus struct {
+	bus eventbus.Bus
+}
+
+func (o withEventBus) ApplyLayer(opts *LayerOptions) {
+	opts.EventBus = o.bus
+}
+
+// WithFaultInjector plugs the injector into connections of the layer for resilience testing.
+func WithFaultInjector(fi FaultInjector) LayerOption {
+	return withFaultInjector{fi}
+}
+
+type withFaultInjector struct {
+	fi FaultInjector
+}
+
+func (o withFaultInjector) ApplyLayer(opts *LayerOptions) {
+	opts.FaultInjector = o.fi
+}
+
+// WithParserWorkers sets the number of goroutines parsing datagrams of packet connections of each protocol,
+// n <= 0 keeps the default GOMAXPROCS.
+func WithParserWorkers(n int) LayerOption {
+	return withParserWorkers{n}
+}
+
+type withParserWorkers struct {
+	n int
+}
+
+func (o withParserWorkers) ApplyLayer(opts *LayerOptions) {
+	opts.ParserWorkers = o.n
+}
+
 // Listen method options
 type ListenOption interface {
 	ApplyListen(opts *ListenOptions)
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+)
+
+// parserQueueSize is a number of datagrams queued to the parser worker,
+// the reading of the connection blocks while the queue of its worker is full.
+// It is also a number of parsed datagrams waiting for the output of the connection,
+// datagrams parsed over it are dropped and counted, see DropCounter.
+const parserQueueSize = 64
+
+// parserPool parses datagrams of packet connections of the connection pool by the bounded number of workers,
+// instead of parsing them inline in the reading goroutine of the connection.
+// Datagrams of the same flow, i.e. the connection and the remote address, are always parsed by the same worker
+// in the order they were read, so messages of the flow are passed up in order
+// while datagrams of different flows are parsed in parallel.
+// Workers do not wait for the output of the connection: parsed datagrams are queued to the connection,
+// so the stalled connection does not block datagrams of other flows of the worker.
+type parserPool struct {
+	queues []chan parseTask
+	wg     sync.WaitGroup
+}
+
+type parseTask struct {
+	handler *connectionHandler
+	data    []byte
+	raddr   string
+	readAt  time.Time
+}
+
+type parsedPacket struct {
+	msg           sip.Message
+	err           error
+	raddr         string
+	parseDuration time.Duration
+}
+
+func newParserPool(workers int, logger log.Logger) *parserPool {
+	pp := &parserPool{
+		queues: make([]chan parseTask, workers),
+	}
+	for i := range pp.queues {
+		pp.queues[i] = make(chan parseTask, parserQueueSize)
+		pp.wg.Add(1)
+		go pp.work(pp.queues[i], logger)
+	}
+
+	return pp
+}
+
+// parse queues the datagram to the worker of the flow, data must not be modified after the call.
+func (pp *parserPool) parse(handler *connectionHandler, data []byte, raddr string, readAt time.Time) {
+	handler.parsing.Add(1)
+	pp.queues[flowIndex(handler.Key(), raddr, len(pp.queues))] <- parseTask{handler, data, raddr, readAt}
+}
+
+// stop stops workers after they parse all queued datagrams.
+func (pp *parserPool) stop() {
+	for _, queue := range pp.queues {
+		close(queue)
+	}
+	pp.wg.Wait()
+}
+
+func (pp *parserPool) work(queue <-chan parseTask, logger log.Logger) {
+	defer pp.wg.Done()
+
+	prs := parser.NewPacketParser(logger)
+	defer prs.Stop()
+
+	for task := range queue {
+		task.handler.queuePacket(prs, task.data, task.raddr, task.readAt)
+		task.handler.parsing.Done()
+	}
+}
+
+// flowIndex returns worker of the flow, FNV-1a hash.
+func flowIndex(key ConnectionKey, raddr string, n int) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	for i := 0; i < len(raddr); i++ {
+		hash ^= uint32(raddr[i])
+		hash *= 16777619
+	}
+
+	return int(hash % uint32(n))
+}
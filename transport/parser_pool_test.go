@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+func newPacketHandler(t *testing.T, pp *parserPool, env *environment, output chan sip.Message) (*connectionHandler, string) {
+	t.Helper()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udpConn.LocalAddr().String()
+	logger := log.NewDefaultLogrusLogger()
+	conn := NewConnection(udpConn.(net.Conn), ConnectionKey("udp:"+addr), "udp", logger)
+
+	handler := newConnectionHandler(conn, 0, output, make(chan error, 100), nil, logger, false)
+	handler.env = env
+	handler.parsers = pp
+	handler.parsed = make(chan parsedPacket, parserQueueSize)
+	go handler.Serve()
+
+	return handler, addr
+}
+
+func TestParserPoolStalledOutput(t *testing.T) {
+	pp := newParserPool(1, log.NewDefaultLogrusLogger())
+	defer pp.stop()
+
+	env := newEnvironment(LayerOptions{})
+	// nobody reads the output of the stalled connection
+	stalled, stalledAddr := newPacketHandler(t, pp, env, make(chan sip.Message))
+	defer stalled.Cancel()
+	output := make(chan sip.Message, 1)
+	handler, addr := newPacketHandler(t, pp, env, output)
+	defer handler.Cancel()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	send := func(addr, callID string) {
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := "OPTIONS sip:bob@example.com SIP/2.0\r\n" +
+			"Via: SIP/2.0/UDP " + client.LocalAddr().String() + ";branch=z9hG4bK" + callID + "\r\n" +
+			"From: <sip:alice@example.com>;tag=1928301774\r\n" +
+			"To: <sip:bob@example.com>\r\n" +
+			"Call-ID: " + callID + "\r\n" +
+			"CSeq: 1 OPTIONS\r\n" +
+			"Content-Length: 0\r\n\r\n"
+		if _, err := client.WriteTo([]byte(data), raddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// datagrams of the stalled connection overflow its queue
+	for i := 0; i < 2*parserQueueSize; i++ {
+		send(stalledAddr, fmt.Sprintf("stalled-%d", i))
+	}
+	for deadline := time.Now().Add(3 * time.Second); len(stalled.parsed) < parserQueueSize; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected full queue of the stalled connection, got %d datagrams", len(stalled.parsed))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	send(addr, "flowing")
+
+	select {
+	case msg := <-output:
+		if callID, _ := msg.CallID(); callID.Value() != "flowing" {
+			t.Errorf("expected message of the flowing connection, got %s", callID.Value())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the stalled connection blocked the parser worker")
+	}
+
+	// datagrams over the queue of the stalled connection are counted, one more datagram is blocked on its output
+	expected := uint64(parserQueueSize - 1)
+	for deadline := time.Now().Add(3 * time.Second); atomic.LoadUint64(&env.dropped) < expected; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d dropped datagrams, got %d", expected, atomic.LoadUint64(&env.dropped))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParserWorkers(t *testing.T) {
+	if n := newEnvironment(LayerOptions{ParserWorkers: 3}).parserWorkers(); n != 3 {
+		t.Errorf("expected 3 parser workers, got %d", n)
+	}
+	if n := newEnvironment(LayerOptions{}).parserWorkers(); n != runtime.GOMAXPROCS(0) {
+		t.Errorf("expected GOMAXPROCS parser workers, got %d", n)
+	}
+}
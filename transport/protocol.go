@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -21,7 +22,11 @@ type Protocol interface {
 	Reliable() bool
 	Streamed() bool
 	Listen(target *Target, options ...ListenOption) error
+	// Unlisten stops listening on the target, established connections are kept.
+	Unlisten(target *Target) error
 	Send(target *Target, msg sip.Message) error
+	// SendContext sends message, the context deadline limits establishing of the new connection.
+	SendContext(ctx context.Context, target *Target, msg sip.Message) error
 	String() string
 }
 
@@ -35,6 +40,7 @@ type ProtocolFactory func(
 ) (Protocol, error)
 
 type protocol struct {
+	environmentHolder
 	network  string
 	reliable bool
 	streamed bool
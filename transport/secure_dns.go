@@ -0,0 +1,289 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultSecureDNSTimeout = 5 * time.Second
+
+const (
+	dnsHeaderLen  = 12
+	dnsFlagAD     = 0x20
+	dnsRCodeMask  = 0x0f
+	dnsRCodeFail  = 2
+	dnsMessageMax = 65535
+)
+
+// SecureDNSConfig describes the resolver of RFC 3263 lookups that can't be trivially spoofed on hostile networks,
+// like lookups of SRV records used to route calls toward carriers.
+// Queries are sent to the trusted upstream over TLS or HTTPS instead of plain UDP of the local network.
+type SecureDNSConfig struct {
+	// Upstream is the DNS server:
+	//
+	//	tls://dns.example.com:853         - DNS over TLS, RFC 7858, the default port is 853
+	//	https://dns.example.com/dns-query - DNS over HTTPS, RFC 8484
+	//	udp://127.0.0.1:53                - plain DNS, e.g. of the validating resolver on the loopback
+	//	tcp://127.0.0.1:53
+	Upstream string
+	// TLSConfig verifies the upstream of DNS over TLS and HTTPS, nil verifies it by system roots.
+	TLSConfig *tls.Config
+	// RequireDNSSEC accepts only answers the upstream authenticated by DNSSEC, i.e. with AD flag - RFC 4035 3.2.3,
+	// other answers fail the lookup like the server failure. The flag itself is not protected,
+	// so the upstream must be the validating resolver reached over TLS, HTTPS or the loopback.
+	RequireDNSSEC bool
+	// Timeout of the query, default is DefaultSecureDNSTimeout.
+	Timeout time.Duration
+}
+
+// NewSecureResolver creates resolver that sends all queries to the upstream of the config,
+// pass it to the transport layer by WithDNSResolver or to the server by gosip.WithResolver.
+func NewSecureResolver(config SecureDNSConfig) (*net.Resolver, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultSecureDNSTimeout
+	}
+
+	u, err := url.Parse(config.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("parse DNS upstream %s: %w", config.Upstream, err)
+	}
+
+	var exchange dnsExchange
+	switch strings.ToLower(u.Scheme) {
+	case "tls":
+		exchange = newDoTExchange(u.Host, config.TLSConfig)
+	case "https":
+		exchange = newDoHExchange(u.String(), config.TLSConfig)
+	case "udp", "tcp":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("DNS upstream %s has no port", config.Upstream)
+		}
+		exchange = newPlainExchange(strings.ToLower(u.Scheme), u.Host)
+	default:
+		return nil, fmt.Errorf("DNS upstream %s has unsupported scheme", config.Upstream)
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dnsConn{
+				exchange:      exchange,
+				requireDNSSEC: config.RequireDNSSEC,
+				timeout:       config.Timeout,
+				addr:          dnsAddr(config.Upstream),
+			}, nil
+		},
+	}, nil
+}
+
+// dnsExchange sends the query to the upstream and returns the response, messages are not framed.
+type dnsExchange func(ctx context.Context, query []byte) ([]byte, error)
+
+func newDoTExchange(host string, config *tls.Config) dnsExchange {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "853")
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(host)
+	}
+	// the connection is dialed per query, so resumed sessions save full handshakes
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		dialer := &net.Dialer{}
+		if deadline, ok := ctx.Deadline(); ok {
+			dialer.Deadline = deadline
+		}
+		conn, err := tls.DialWithDialer(dialer, "tcp", host, config)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+
+		return streamExchange(conn, query)
+	}
+}
+
+func newDoHExchange(endpoint string, config *tls.Config) dnsExchange {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   config,
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("DNS over HTTPS upstream responded with %s", res.Status)
+		}
+
+		return ioutil.ReadAll(io.LimitReader(res.Body, dnsMessageMax))
+	}
+}
+
+func newPlainExchange(network, addr string) dnsExchange {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+
+		if network == "tcp" {
+			return streamExchange(conn, query)
+		}
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsMessageMax)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+}
+
+// streamExchange exchanges messages prefixed by the length - RFC 1035 4.2.2.
+func streamExchange(conn net.Conn, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	res := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// dnsConn is the stream connection the Go resolver exchanges length prefixed messages over,
+// each query written to it is sent to the upstream and the response is read back.
+type dnsConn struct {
+	exchange      dnsExchange
+	requireDNSSEC bool
+	timeout       time.Duration
+	addr          net.Addr
+
+	mu       sync.Mutex
+	deadline time.Time
+	res      bytes.Buffer
+}
+
+func (c *dnsConn) Write(b []byte) (int, error) {
+	if len(b) < 2+dnsHeaderLen || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return 0, errors.New("DNS query is not a single framed message")
+	}
+	query := make([]byte, len(b)-2)
+	copy(query, b[2:])
+	if c.requireDNSSEC {
+		// ask the upstream to report the authentication - RFC 6840 5.7
+		query[3] |= dnsFlagAD
+	}
+
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	if limit := time.Now().Add(c.timeout); deadline.IsZero() || deadline.After(limit) {
+		deadline = limit
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	res, err := c.exchange(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	if len(res) < dnsHeaderLen {
+		return 0, errors.New("DNS response is too short")
+	}
+	if c.requireDNSSEC && res[3]&dnsFlagAD == 0 {
+		// unauthenticated answer fails the lookup like the server failure
+		res[3] = res[3]&^dnsRCodeMask | dnsRCodeFail
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(res)))
+	c.res.Write(l[:])
+	c.res.Write(res)
+
+	return len(b), nil
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.res.Read(b)
+}
+
+func (c *dnsConn) Close() error                    { return nil }
+func (c *dnsConn) LocalAddr() net.Addr             { return c.addr }
+func (c *dnsConn) RemoteAddr() net.Addr            { return c.addr }
+func (c *dnsConn) SetReadDeadline(time.Time) error { return nil }
+func (c *dnsConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+
+	return nil
+}
+
+type dnsAddr string
+
+func (a dnsAddr) Network() string { return "dns" }
+func (a dnsAddr) String() string  { return string(a) }
@@ -0,0 +1,150 @@
+package transport_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// answerA answers A query by the IP, other queries are answered without records.
+func answerA(query []byte, ip net.IP, authenticated bool) []byte {
+	i := 12
+	for query[i] != 0 {
+		i += int(query[i]) + 1
+	}
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	question := query[12 : i+5]
+
+	var count byte
+	if qtype == 1 {
+		count = 1
+	}
+	flags := byte(0x80)
+	if authenticated {
+		flags |= 0x20
+	}
+	res := append([]byte{}, query[0], query[1], 0x80|query[2]&0x01, flags, 0, 1, 0, count, 0, 0, 0, 0)
+	res = append(res, question...)
+	if count > 0 {
+		res = append(res, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		res = append(res, ip.To4()...)
+	}
+
+	return res
+}
+
+var _ = Describe("NewSecureResolver", func() {
+	var (
+		server        *httptest.Server
+		tlsConfig     *tls.Config
+		authenticated int32
+		adQueries     int32
+	)
+
+	ip := net.ParseIP("192.0.2.10")
+	answer := func(query []byte) []byte {
+		if query[3]&0x20 != 0 {
+			atomic.AddInt32(&adQueries, 1)
+		}
+
+		return answerA(query, ip, atomic.LoadInt32(&authenticated) == 1)
+	}
+	lookup := func(config transport.SecureDNSConfig) ([]net.IPAddr, error) {
+		config.TLSConfig = tlsConfig
+		resolver, err := transport.NewSecureResolver(config)
+		Expect(err).ToNot(HaveOccurred())
+
+		return resolver.LookupIPAddr(context.Background(), "sip.example.test")
+	}
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&authenticated, 0)
+		atomic.StoreInt32(&adQueries, 0)
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			Expect(r.Method).To(Equal(http.MethodPost))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/dns-message"))
+			query, err := ioutil.ReadAll(r.Body)
+			Expect(err).ToNot(HaveOccurred())
+			w.Header().Set("Content-Type", "application/dns-message")
+			_, _ = w.Write(answer(query))
+		}))
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		tlsConfig = &tls.Config{RootCAs: roots}
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should reject unsupported upstream", func() {
+		_, err := transport.NewSecureResolver(transport.SecureDNSConfig{Upstream: "ftp://127.0.0.1"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should resolve over HTTPS", func() {
+		addrs, err := lookup(transport.SecureDNSConfig{Upstream: server.URL + "/dns-query"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addrs).To(HaveLen(1))
+		Expect(addrs[0].IP.Equal(ip)).To(BeTrue())
+	})
+
+	It("should resolve over TLS", func() {
+		listener, err := tls.Listen("tcp", "127.0.0.1:5309", server.TLS)
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					for {
+						var l [2]byte
+						if _, err := io.ReadFull(conn, l[:]); err != nil {
+							return
+						}
+						query := make([]byte, binary.BigEndian.Uint16(l[:]))
+						if _, err := io.ReadFull(conn, query); err != nil {
+							return
+						}
+						res := answer(query)
+						binary.BigEndian.PutUint16(l[:], uint16(len(res)))
+						_, _ = conn.Write(append(l[:], res...))
+					}
+				}()
+			}
+		}()
+
+		addrs, err := lookup(transport.SecureDNSConfig{Upstream: "tls://127.0.0.1:5309"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addrs).To(HaveLen(1))
+		Expect(addrs[0].IP.Equal(ip)).To(BeTrue())
+	})
+
+	It("should require answers authenticated by DNSSEC", func() {
+		_, err := lookup(transport.SecureDNSConfig{Upstream: server.URL, RequireDNSSEC: true})
+		Expect(err).To(HaveOccurred())
+		Expect(atomic.LoadInt32(&adQueries)).To(BeNumerically(">", 0))
+
+		atomic.StoreInt32(&authenticated, 1)
+		addrs, err := lookup(transport.SecureDNSConfig{Upstream: server.URL, RequireDNSSEC: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addrs).To(HaveLen(1))
+	})
+})
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
@@ -24,8 +25,9 @@ type tcpProtocol struct {
 	listeners   ListenerPool
 	connections ConnectionPool
 	conns       chan Connection
+	done        chan struct{}
 	listen      func(addr *net.TCPAddr, options ...ListenOption) (net.Listener, error)
-	dial        func(addr *net.TCPAddr) (net.Conn, error)
+	dial        func(ctx context.Context, addr *net.TCPAddr, domain string) (net.Conn, error)
 	resolveAddr func(addr string) (*net.TCPAddr, error)
 }
 
@@ -41,6 +43,7 @@ func NewTcpProtocol(
 	p.reliable = true
 	p.streamed = true
 	p.conns = make(chan Connection)
+	p.done = make(chan struct{})
 	p.log = logger.
 		WithPrefix("transport.Protocol").
 		WithFields(log.Fields{
@@ -62,21 +65,31 @@ func (p *tcpProtocol) defaultListen(addr *net.TCPAddr, options ...ListenOption)
 	return net.ListenTCP(p.network, addr)
 }
 
-func (p *tcpProtocol) defaultDial(addr *net.TCPAddr) (net.Conn, error) {
-	return net.DialTCP(p.network, nil, addr)
+func (p *tcpProtocol) defaultDial(ctx context.Context, addr *net.TCPAddr, domain string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, p.network, addr.String())
 }
 
 func (p *tcpProtocol) defaultResolveAddr(addr string) (*net.TCPAddr, error) {
 	return net.ResolveTCPAddr(p.network, addr)
 }
 
+func (p *tcpProtocol) connectionCount() int {
+	return p.connections.Length()
+}
+
 func (p *tcpProtocol) Done() <-chan struct{} {
-	return p.connections.Done()
+	return p.done
 }
 
 // piping new connections to connection pool for serving
 func (p *tcpProtocol) pipePools() {
-	defer close(p.conns)
+	defer func() {
+		close(p.conns)
+		// protocol is done when both pools are disposed and the pipe is stopped
+		<-p.connections.Done()
+		close(p.done)
+	}()
 
 	p.Log().Debug("start pipe pools")
 	defer p.Log().Debug("stop pipe pools")
@@ -124,7 +137,7 @@ func (p *tcpProtocol) Listen(target *Target, options ...ListenOption) error {
 
 	// index listeners by local address
 	// should live infinitely
-	key := ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, target.Port))
+	key := ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, *target.Port))
 	err = p.listeners.Put(key, &tcpListener{
 		Listener: listener,
 		network:  p.network,
@@ -139,7 +152,27 @@ func (p *tcpProtocol) Listen(target *Target, options ...ListenOption) error {
 	return err // should be nil here
 }
 
+func (p *tcpProtocol) Unlisten(target *Target) error {
+	target = FillTargetHostAndPort(p.Network(), target)
+	key := ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, *target.Port))
+	if err := p.listeners.Drop(key); err != nil {
+		return &ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("drop %s listener from the pool", key),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	p.Log().Debugf("stop listening on %s %s", p.Network(), target.Addr())
+
+	return nil
+}
+
 func (p *tcpProtocol) Send(target *Target, msg sip.Message) error {
+	return p.SendContext(context.Background(), target, msg)
+}
+
+func (p *tcpProtocol) SendContext(ctx context.Context, target *Target, msg sip.Message) error {
 	target = FillTargetHostAndPort(p.Network(), target)
 
 	// validate remote address
@@ -162,7 +195,7 @@ func (p *tcpProtocol) Send(target *Target, msg sip.Message) error {
 	}
 
 	// find or create connection
-	conn, err := p.getOrCreateConnection(raddr)
+	conn, err := p.getOrCreateConnection(ctx, raddr, target.Domain)
 	if err != nil {
 		return &ProtocolError{
 			Err:      err,
@@ -175,7 +208,7 @@ func (p *tcpProtocol) Send(target *Target, msg sip.Message) error {
 	logger.Tracef("writing SIP message to %s %s", p.Network(), raddr)
 
 	// send message
-	_, err = conn.Write([]byte(msg.String()))
+	_, err = conn.Write(sip.Wire(msg))
 	if err != nil {
 		err = &ProtocolError{
 			Err:      err,
@@ -187,13 +220,18 @@ func (p *tcpProtocol) Send(target *Target, msg sip.Message) error {
 	return err
 }
 
-func (p *tcpProtocol) getOrCreateConnection(raddr *net.TCPAddr) (Connection, error) {
+func (p *tcpProtocol) getOrCreateConnection(ctx context.Context, raddr *net.TCPAddr, domain string) (Connection, error) {
 	key := ConnectionKey(p.network + ":" + raddr.String())
+	if domain != "" {
+		// TLS connections are authenticated for the domain, so they are not reused for other domains
+		// of the same address - RFC 5922 7.2
+		key += ConnectionKey("#" + strings.ToLower(domain))
+	}
 	conn, err := p.connections.Get(key)
 	if err != nil {
 		p.Log().Debugf("connection for remote address %s %s not found, create a new one", p.Network(), raddr)
 
-		tcpConn, err := p.dial(raddr)
+		tcpConn, err := p.dial(ctx, raddr, domain)
 		if err != nil {
 			return nil, fmt.Errorf("dial to %s %s: %w", p.Network(), raddr, err)
 		}
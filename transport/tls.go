@@ -1,10 +1,11 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
@@ -12,6 +13,9 @@ import (
 
 type tlsProtocol struct {
 	tcpProtocol
+
+	clientMu sync.RWMutex
+	client   TLSClientConfig
 }
 
 func NewTlsProtocol(
@@ -26,6 +30,7 @@ func NewTlsProtocol(
 	p.reliable = true
 	p.streamed = true
 	p.conns = make(chan Connection)
+	p.done = make(chan struct{})
 	p.log = logger.
 		WithPrefix("transport.Protocol").
 		WithFields(log.Fields{
@@ -50,12 +55,13 @@ func NewTlsProtocol(
 			Certificates: []tls.Certificate{cert},
 		})
 	}
-	p.dial = func(addr *net.TCPAddr) (net.Conn, error) {
-		return tls.Dial("tcp", addr.String(), &tls.Config{
-			VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-				return nil
-			},
-		})
+	p.dial = func(ctx context.Context, addr *net.TCPAddr, domain string) (net.Conn, error) {
+		// tls.Dialer with context requires Go 1.15, so only the deadline is propagated
+		dialer := &net.Dialer{}
+		if deadline, ok := ctx.Deadline(); ok {
+			dialer.Deadline = deadline
+		}
+		return tls.DialWithDialer(dialer, "tcp", addr.String(), clientTLSConfig(p.tlsClientConfig(), domain, addr))
 	}
 	p.resolveAddr = func(addr string) (*net.TCPAddr, error) {
 		return net.ResolveTCPAddr("tcp", addr)
@@ -65,3 +71,16 @@ func NewTlsProtocol(
 
 	return p
 }
+
+func (p *tlsProtocol) SetTLSClientConfig(config TLSClientConfig) {
+	p.clientMu.Lock()
+	p.client = config
+	p.clientMu.Unlock()
+}
+
+func (p *tlsProtocol) tlsClientConfig() TLSClientConfig {
+	p.clientMu.RLock()
+	defer p.clientMu.RUnlock()
+
+	return p.client
+}
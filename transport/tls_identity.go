@@ -0,0 +1,210 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ghettovoice/gosip/log"
+	"github.com/ghettovoice/gosip/sip"
+)
+
+// TLSVerificationReason tells which step of the verification of the TLS peer failed.
+type TLSVerificationReason string
+
+const (
+	// TLSChainInvalid means the certificate chain is not trusted.
+	TLSChainInvalid TLSVerificationReason = "chain"
+	// TLSIdentityMismatch means the certificate is not issued for the target domain - RFC 5922 7.2.
+	TLSIdentityMismatch TLSVerificationReason = "identity"
+	// TLSPolicyRejected means the certificate is rejected by TLSClientConfig.VerifyPeer.
+	TLSPolicyRejected TLSVerificationReason = "policy"
+)
+
+// TLSVerificationError is returned when the TLS server fails to prove identity of the target.
+type TLSVerificationError struct {
+	Err    error
+	Reason TLSVerificationReason
+	// Domain is the SIP domain of the target, empty if the target is addressed by IP.
+	Domain string
+	Addr   string
+	// Certificate is the leaf certificate of the peer.
+	Certificate *x509.Certificate
+}
+
+func (err *TLSVerificationError) Unwrap() error { return err.Err }
+func (err *TLSVerificationError) Error() string {
+	if err == nil {
+		return "<nil>"
+	}
+
+	fields := log.Fields{
+		"reason":      err.Reason,
+		"domain":      "???",
+		"remote_addr": "???",
+	}
+	if err.Domain != "" {
+		fields["domain"] = err.Domain
+	}
+	if err.Addr != "" {
+		fields["remote_addr"] = err.Addr
+	}
+
+	return fmt.Sprintf("transport.TLSVerificationError<%s> verify TLS peer failed: %s", fields, err.Err)
+}
+
+// TLSClientConfig describes verification of servers the TLS protocol connects to.
+//
+// The server of the target with SIP domain, i.e. the host of the next hop URI, must present the certificate
+// issued for the domain like RFC 5922 requires, not for the host name the domain is resolved to.
+// The server of the target addressed by IP must present the certificate issued for the IP.
+// The identity is verified when the connection is established, connections are reused
+// only for targets of the same domain resolved to the same address.
+type TLSClientConfig struct {
+	// RootCAs verify certificate chains of servers, nil uses roots of the system.
+	RootCAs *x509.CertPool
+	// VerifyPeer is called after the chain and identity of the server are verified, like to pin certificates
+	// or public keys of the known peers. The domain is empty if the target is addressed by IP.
+	// Returned error rejects the connection.
+	VerifyPeer func(domain string, chain []*x509.Certificate) error
+}
+
+// TLSClient is implemented by the TLS protocol.
+type TLSClient interface {
+	// SetTLSClientConfig configures connections dialed after the call.
+	SetTLSClientConfig(config TLSClientConfig)
+}
+
+// VerifyTLSIdentity checks that the certificate is issued for the SIP domain - RFC 5922 7.1, 7.2.
+// SIP URIs and DNS names of subjectAltName are matched with the domain, wildcards are not accepted.
+// The common name is checked only if the certificate has no subjectAltName.
+func VerifyTLSIdentity(cert *x509.Certificate, domain string) error {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for _, id := range tlsIdentities(cert) {
+		if id == domain {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("certificate is not valid for SIP domain %s", domain)
+}
+
+// tlsIdentities returns SIP domains of the certificate.
+func tlsIdentities(cert *x509.Certificate) []string {
+	ids := make([]string, 0)
+	for _, uri := range cert.URIs {
+		switch strings.ToLower(uri.Scheme) {
+		case "sip", "sips":
+			// only URIs without user part identify domains
+			if uri.Opaque != "" && !strings.Contains(uri.Opaque, "@") {
+				ids = appendTLSIdentity(ids, uri.Opaque)
+			}
+		}
+	}
+	for _, name := range cert.DNSNames {
+		ids = appendTLSIdentity(ids, name)
+	}
+	if len(cert.URIs) == 0 && len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 0 && len(cert.EmailAddresses) == 0 {
+		ids = appendTLSIdentity(ids, cert.Subject.CommonName)
+	}
+
+	return ids
+}
+
+func appendTLSIdentity(ids []string, id string) []string {
+	if i := strings.IndexAny(id, ";?"); i >= 0 {
+		id = id[:i]
+	}
+	id = strings.TrimSuffix(strings.ToLower(id), ".")
+	if id == "" || strings.Contains(id, "*") {
+		return ids
+	}
+
+	return append(ids, id)
+}
+
+// tlsDomain returns SIP domain the TLS server of the next hop of the request must be authenticated for,
+// i.e. the host of the first Route or the Request-URI, empty if it is IP.
+func tlsDomain(req sip.Request) string {
+	uri := req.Recipient()
+	if hdrs := req.GetHeaders("Route"); len(hdrs) > 0 {
+		if route, ok := hdrs[0].(*sip.RouteHeader); ok && len(route.Addresses) > 0 {
+			uri = route.Addresses[0]
+		}
+	}
+	if uri == nil {
+		return ""
+	}
+
+	host := strings.Trim(uri.Host(), "[]")
+	if host == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+
+	return host
+}
+
+// clientTLSConfig returns configuration of the connection to the server of the domain,
+// the chain and the identity are verified by VerifyPeerCertificate since the identity is not the host name.
+func clientTLSConfig(config TLSClientConfig, domain string, addr *net.TCPAddr) *tls.Config {
+	return &tls.Config{
+		ServerName:         domain,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyTLSPeer(config, domain, addr, rawCerts)
+		},
+	}
+}
+
+func verifyTLSPeer(config TLSClientConfig, domain string, addr *net.TCPAddr, rawCerts [][]byte) error {
+	fail := func(reason TLSVerificationReason, cert *x509.Certificate, err error) error {
+		return &TLSVerificationError{
+			Err:         err,
+			Reason:      reason,
+			Domain:      domain,
+			Addr:        addr.String(),
+			Certificate: cert,
+		}
+	}
+
+	chain := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fail(TLSChainInvalid, nil, err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return fail(TLSChainInvalid, nil, fmt.Errorf("no certificate"))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         config.RootCAs,
+		Intermediates: intermediates,
+	}); err != nil {
+		return fail(TLSChainInvalid, chain[0], err)
+	}
+
+	if domain != "" {
+		if err := VerifyTLSIdentity(chain[0], domain); err != nil {
+			return fail(TLSIdentityMismatch, chain[0], err)
+		}
+	} else if err := chain[0].VerifyHostname(addr.IP.String()); err != nil {
+		return fail(TLSIdentityMismatch, chain[0], err)
+	}
+
+	if config.VerifyPeer != nil {
+		if err := config.VerifyPeer(domain, chain); err != nil {
+			return fail(TLSPolicyRejected, chain[0], err)
+		}
+	}
+
+	return nil
+}
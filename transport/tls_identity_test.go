@@ -0,0 +1,199 @@
+package transport_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+func newIdentityCert(cn string, uris []string, dnsNames []string) (*x509.Certificate, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              dnsNames,
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		Expect(err).ToNot(HaveOccurred())
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	return cert, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+var _ = Describe("TLS identity", func() {
+	Context("VerifyTLSIdentity", func() {
+		It("should match SIP URIs and DNS names of subjectAltName", func() {
+			cert, _ := newIdentityCert("proxy.example.com", []string{"sip:example.com", "sip:alice@example.org"}, []string{"Example.NET"})
+			Expect(transport.VerifyTLSIdentity(cert, "example.com")).To(Succeed())
+			Expect(transport.VerifyTLSIdentity(cert, "example.net")).To(Succeed())
+			Expect(transport.VerifyTLSIdentity(cert, "example.org")).ToNot(Succeed())
+			Expect(transport.VerifyTLSIdentity(cert, "proxy.example.com")).ToNot(Succeed())
+		})
+		It("should not accept wildcards", func() {
+			cert, _ := newIdentityCert("", nil, []string{"*.example.com"})
+			Expect(transport.VerifyTLSIdentity(cert, "sip.example.com")).ToNot(Succeed())
+		})
+		It("should match common name without subjectAltName", func() {
+			cert, _ := newIdentityCert("example.com", nil, nil)
+			Expect(transport.VerifyTLSIdentity(cert, "example.com")).To(Succeed())
+		})
+	})
+
+	Context("when TLS protocol connects to the server of the domain", func() {
+		var (
+			output   chan sip.Message
+			errs     chan error
+			cancel   chan struct{}
+			protocol transport.Protocol
+			listener net.Listener
+			received chan string
+			roots    *x509.CertPool
+		)
+
+		port := 5308
+		msg := []string{
+			"OPTIONS sip:example.com SIP/2.0",
+			"Via: SIP/2.0/TLS 127.0.0.1:5061;branch=z9hG4bK776asdhds",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+			"",
+			"",
+		}
+
+		BeforeEach(func() {
+			output = make(chan sip.Message)
+			errs = make(chan error)
+			cancel = make(chan struct{})
+			protocol = transport.NewTlsProtocol(output, errs, cancel, nil, testutils.NewLogrusLogger())
+
+			cert, tlsCert := newIdentityCert("proxy.example.com", []string{"sip:example.com"}, nil)
+			// the other domain is served from the same address
+			orgCert, orgTLSCert := newIdentityCert("proxy.example.org", []string{"sip:example.org"}, nil)
+			roots = x509.NewCertPool()
+			roots.AddCert(cert)
+			roots.AddCert(orgCert)
+
+			var err error
+			listener, err = tls.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{
+				GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+					if hello.ServerName == "example.org" {
+						return &orgTLSCert, nil
+					}
+					return &tlsCert, nil
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			received = make(chan string, 3)
+			go func(listener net.Listener, received chan<- string) {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						data, _ := ioutil.ReadAll(conn)
+						received <- string(data)
+					}()
+				}
+			}(listener, received)
+		})
+		AfterEach(func(done Done) {
+			listener.Close()
+			select {
+			case <-cancel:
+			default:
+				close(cancel)
+			}
+			<-protocol.Done()
+			close(output)
+			close(errs)
+			close(done)
+		}, 3)
+
+		send := func(domain string) error {
+			target := transport.NewTarget("127.0.0.1", port)
+			target.Domain = domain
+			return protocol.Send(target, testutils.Request(msg))
+		}
+		verificationError := func(err error) *transport.TLSVerificationError {
+			var verr *transport.TLSVerificationError
+			Expect(errors.As(err, &verr)).To(BeTrue(), fmt.Sprintf("%v", err))
+
+			return verr
+		}
+
+		It("should verify SIP domain of the certificate", func() {
+			protocol.(transport.TLSClient).SetTLSClientConfig(transport.TLSClientConfig{RootCAs: roots})
+			Expect(send("example.com")).To(Succeed())
+			close(cancel)
+			Eventually(received, time.Second).Should(Receive(ContainSubstring("OPTIONS sip:example.com")))
+		})
+		It("should not reuse connection of the other domain on the same address", func() {
+			protocol.(transport.TLSClient).SetTLSClientConfig(transport.TLSClientConfig{RootCAs: roots})
+			Expect(send("example.com")).To(Succeed())
+			Expect(send("example.org")).To(Succeed())
+			verr := verificationError(send("example.net"))
+			Expect(verr.Reason).To(Equal(transport.TLSIdentityMismatch))
+			Expect(verr.Domain).To(Equal("example.net"))
+			close(cancel)
+			Eventually(received, time.Second).Should(Receive(ContainSubstring("OPTIONS sip:example.com")))
+			Eventually(received, time.Second).Should(Receive(ContainSubstring("OPTIONS sip:example.com")))
+		})
+		It("should reject certificate of the other domain", func() {
+			protocol.(transport.TLSClient).SetTLSClientConfig(transport.TLSClientConfig{RootCAs: roots})
+			verr := verificationError(send("proxy.example.com"))
+			Expect(verr.Reason).To(Equal(transport.TLSIdentityMismatch))
+			Expect(verr.Domain).To(Equal("proxy.example.com"))
+			Expect(verr.Certificate).ToNot(BeNil())
+		})
+		It("should reject untrusted certificate", func() {
+			verr := verificationError(send("example.com"))
+			Expect(verr.Reason).To(Equal(transport.TLSChainInvalid))
+		})
+		It("should reject certificate by the policy", func() {
+			protocol.(transport.TLSClient).SetTLSClientConfig(transport.TLSClientConfig{
+				RootCAs: roots,
+				VerifyPeer: func(domain string, chain []*x509.Certificate) error {
+					Expect(domain).To(Equal("example.com"))
+					Expect(chain).To(HaveLen(1))
+					return fmt.Errorf("certificate is not pinned")
+				},
+			})
+			verr := verificationError(send("example.com"))
+			Expect(verr.Reason).To(Equal(transport.TLSPolicyRejected))
+		})
+	})
+})
@@ -31,6 +31,11 @@ const (
 type Target struct {
 	Host string
 	Port *sip.Port
+	// Domain is SIP domain the TLS server of the target must be authenticated for, see TLSClientConfig.
+	Domain string
+	// Priority and Weight of the SRV record the target is resolved from, zero if it is not resolved by SRV.
+	Priority uint16
+	Weight   uint16
 }
 
 func (trg *Target) Addr() string {
@@ -224,6 +229,8 @@ type ConnectionHandlerError struct {
 	Net        string
 	LAddr      string
 	RAddr      string
+	// handler emitted the error, the pool drops it only if the key is not reused by the new handler
+	handler ConnectionHandler
 }
 
 func (err *ConnectionHandlerError) Unwrap() error   { return err.Err }
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
@@ -13,6 +14,8 @@ import (
 type udpProtocol struct {
 	protocol
 	connections ConnectionPool
+	// listen opens the packet connection, net.ListenUDP by default
+	listen func(laddr *net.UDPAddr) (net.Conn, error)
 }
 
 func NewUdpProtocol(
@@ -33,10 +36,22 @@ func NewUdpProtocol(
 		})
 	// TODO: add separate errs chan to listen errors from pool for reconnection?
 	p.connections = NewConnectionPool(output, errs, cancel, msgMapper, p.Log())
+	p.listen = func(laddr *net.UDPAddr) (net.Conn, error) {
+		conn, err := net.ListenUDP(p.network, laddr)
+		if err != nil {
+			return nil, err
+		}
+
+		return newBatchConn(conn), nil
+	}
 
 	return p
 }
 
+func (p *udpProtocol) connectionCount() int {
+	return p.connections.Length()
+}
+
 func (p *udpProtocol) Done() <-chan struct{} {
 	return p.connections.Done()
 }
@@ -54,7 +69,7 @@ func (p *udpProtocol) Listen(target *Target, options ...ListenOption) error {
 		}
 	}
 	// create UDP connection
-	udpConn, err := net.ListenUDP(p.network, laddr)
+	udpConn, err := p.listen(laddr)
 	if err != nil {
 		return &ProtocolError{
 			err,
@@ -81,7 +96,35 @@ func (p *udpProtocol) Listen(target *Target, options ...ListenOption) error {
 	return err // should be nil here
 }
 
+func (p *udpProtocol) Unlisten(target *Target) error {
+	target = FillTargetHostAndPort(p.Network(), target)
+	key := ConnectionKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, *target.Port))
+	if err := p.connections.Drop(key); err != nil {
+		return &ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("drop %s connection from the pool", key),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	p.Log().Debugf("stop listening on %s %s", p.Network(), target.Addr())
+
+	return nil
+}
+
 func (p *udpProtocol) Send(target *Target, msg sip.Message) error {
+	return p.SendContext(context.Background(), target, msg)
+}
+
+func (p *udpProtocol) SendContext(ctx context.Context, target *Target, msg sip.Message) error {
+	if err := ctx.Err(); err != nil {
+		return &ProtocolError{
+			err,
+			fmt.Sprintf("send SIP message to %s %s", p.Network(), target.Addr()),
+			fmt.Sprintf("%p", p),
+		}
+	}
+
 	target = FillTargetHostAndPort(p.Network(), target)
 
 	// validate remote address
@@ -118,7 +161,7 @@ func (p *udpProtocol) Send(target *Target, msg sip.Message) error {
 			logger := log.AddFieldsFrom(p.Log(), conn, msg)
 			logger.Tracef("writing SIP message to %s %s", p.Network(), raddr)
 
-			if _, err = conn.WriteTo([]byte(msg.String()), raddr); err != nil {
+			if _, err = conn.WriteTo(sip.Wire(msg), raddr); err != nil {
 				return &ProtocolError{
 					Err:      err,
 					Op:       fmt.Sprintf("write SIP message to the %s connection", conn.Key()),
@@ -0,0 +1,330 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// udpBatchSize is a max number of datagrams read or written by the single recvmmsg or sendmmsg call.
+const udpBatchSize = 16
+
+// batchConn reads and writes datagrams of the UDP socket in batches with recvmmsg and sendmmsg,
+// so the syscall overhead is amortized between datagrams under load.
+// Reads fill the batch of buffers with all datagrams already queued in the socket and return them one by one.
+// Concurrent writes are grouped: while one writer sends the batch, others queue their datagrams to the next one,
+// so a single write is sent immediately and does not wait for the batch to fill up.
+type batchConn struct {
+	*net.UDPConn
+	raw   syscall.RawConn
+	inet6 bool
+
+	rmu   sync.Mutex
+	rbufs [udpBatchSize][]byte
+	rmsgs [udpBatchSize]mmsghdr
+	riovs [udpBatchSize]unix.Iovec
+	raddr [udpBatchSize]unix.RawSockaddrAny
+	rnext int
+	rlen  int
+
+	wmu      sync.Mutex
+	pending  []*batchWrite
+	flushing bool
+	wmsgs    [udpBatchSize]mmsghdr
+	wiovs    [udpBatchSize]unix.Iovec
+	waddr    [udpBatchSize]unix.RawSockaddrInet6
+}
+
+// mmsghdr is struct mmsghdr of Linux.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+type batchWrite struct {
+	buf  []byte
+	addr *net.UDPAddr
+	num  int
+	err  error
+	done chan struct{}
+}
+
+// newBatchConn wraps the UDP socket to batch reads and writes.
+// Sockets that do not provide the raw access are returned as is.
+func newBatchConn(conn *net.UDPConn) net.Conn {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return conn
+	}
+
+	var (
+		sa    unix.Sockaddr
+		saErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		sa, saErr = unix.Getsockname(int(fd))
+	}); err != nil || saErr != nil {
+		return conn
+	}
+
+	c := &batchConn{UDPConn: conn, raw: raw}
+	switch sa.(type) {
+	case *unix.SockaddrInet4:
+	case *unix.SockaddrInet6:
+		c.inet6 = true
+	default:
+		return conn
+	}
+
+	for i := range c.rmsgs {
+		c.rbufs[i] = make([]byte, bufferSize)
+		c.riovs[i].Base = &c.rbufs[i][0]
+		c.riovs[i].SetLen(len(c.rbufs[i]))
+		c.rmsgs[i].hdr.Iov = &c.riovs[i]
+		c.rmsgs[i].hdr.SetIovlen(1)
+		c.rmsgs[i].hdr.Name = (*byte)(unsafe.Pointer(&c.raddr[i]))
+	}
+	for i := range c.wmsgs {
+		c.wmsgs[i].hdr.Iov = &c.wiovs[i]
+		c.wmsgs[i].hdr.SetIovlen(1)
+		c.wmsgs[i].hdr.Name = (*byte)(unsafe.Pointer(&c.waddr[i]))
+	}
+
+	return c
+}
+
+func (c *batchConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if c.rnext >= c.rlen {
+		if err := c.recv(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	i := c.rnext
+	c.rnext++
+
+	num := copy(buf, c.rbufs[i][:c.rmsgs[i].len])
+
+	return num, sockaddrToUDPAddr(&c.raddr[i]), nil
+}
+
+// recv waits for datagrams and reads all of them up to the batch size.
+func (c *batchConn) recv() error {
+	for i := range c.rmsgs {
+		c.rmsgs[i].hdr.Namelen = unix.SizeofSockaddrAny
+		c.rmsgs[i].hdr.Flags = 0
+		c.rmsgs[i].len = 0
+	}
+
+	var (
+		num   int
+		errno syscall.Errno
+	)
+	err := c.raw.Read(func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&c.rmsgs[0])), udpBatchSize, 0, 0, 0)
+		if e == unix.EAGAIN || e == unix.EINTR {
+			return false
+		}
+		num, errno = int(r), e
+		return true
+	})
+	if err == nil && errno != 0 {
+		err = os.NewSyscallError("recvmmsg", errno)
+	}
+	if err != nil {
+		return c.opError("read", nil, err)
+	}
+
+	c.rnext, c.rlen = 0, num
+
+	return nil
+}
+
+func (c *batchConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || (!c.inet6 && udpAddr.IP.To4() == nil) {
+		return c.UDPConn.WriteTo(buf, addr)
+	}
+
+	w := &batchWrite{buf: buf, addr: udpAddr}
+
+	c.wmu.Lock()
+	if c.flushing {
+		// the current writer sends the datagram with the next batch
+		w.done = make(chan struct{})
+		c.pending = append(c.pending, w)
+		c.wmu.Unlock()
+		<-w.done
+
+		return w.num, w.err
+	}
+
+	c.flushing = true
+	c.pending = append(c.pending, w)
+	for len(c.pending) > 0 {
+		batch := c.pending
+		c.pending = nil
+		c.wmu.Unlock()
+
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > udpBatchSize {
+				n = udpBatchSize
+			}
+			c.send(batch[:n])
+			for _, bw := range batch[:n] {
+				if bw != w {
+					close(bw.done)
+				}
+			}
+			batch = batch[n:]
+		}
+
+		c.wmu.Lock()
+	}
+	c.flushing = false
+	c.wmu.Unlock()
+
+	return w.num, w.err
+}
+
+// send writes the batch of datagrams, the failed datagram gets the error and the rest are sent again.
+func (c *batchConn) send(batch []*batchWrite) {
+	for len(batch) > 0 {
+		for i, w := range batch {
+			var namelen uint32
+			if c.inet6 {
+				namelen = putSockaddrInet6(&c.waddr[i], w.addr)
+			} else {
+				namelen = putSockaddrInet4((*unix.RawSockaddrInet4)(unsafe.Pointer(&c.waddr[i])), w.addr)
+			}
+			c.wmsgs[i].hdr.Namelen = namelen
+			c.wmsgs[i].len = 0
+			if len(w.buf) > 0 {
+				c.wiovs[i].Base = &w.buf[0]
+			} else {
+				c.wiovs[i].Base = nil
+			}
+			c.wiovs[i].SetLen(len(w.buf))
+		}
+
+		var (
+			num   int
+			errno syscall.Errno
+		)
+		err := c.raw.Write(func(fd uintptr) bool {
+			r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&c.wmsgs[0])), uintptr(len(batch)), 0, 0, 0)
+			if e == unix.EAGAIN || e == unix.EINTR {
+				return false
+			}
+			if e != 0 {
+				// sendmmsg returns -1 if the first datagram fails
+				num, errno = 0, e
+				return true
+			}
+			num = int(r)
+			return true
+		})
+		for i := range c.wiovs[:len(batch)] {
+			c.wiovs[i].Base = nil
+		}
+		if err != nil {
+			// the socket is closed or the deadline is exceeded
+			for _, w := range batch {
+				w.err = c.opError("write", w.addr, err)
+			}
+			return
+		}
+
+		for i := 0; i < num; i++ {
+			batch[i].num = int(c.wmsgs[i].len)
+		}
+		batch = batch[num:]
+		if errno != 0 && len(batch) > 0 {
+			batch[0].err = c.opError("write", batch[0].addr, os.NewSyscallError("sendmmsg", errno))
+			batch = batch[1:]
+		}
+	}
+}
+
+func (c *batchConn) opError(op string, addr net.Addr, err error) error {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+
+	return &net.OpError{Op: op, Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: addr, Err: err}
+}
+
+func sockaddrToUDPAddr(rsa *unix.RawSockaddrAny) net.Addr {
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+
+		return &net.UDPAddr{IP: ip, Port: ntohs(sa.Port)}
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		var zone string
+		if sa.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+				zone = ifi.Name
+			} else {
+				zone = strconv.Itoa(int(sa.Scope_id))
+			}
+		}
+
+		return &net.UDPAddr{IP: ip, Port: ntohs(sa.Port), Zone: zone}
+	default:
+		return nil
+	}
+}
+
+func putSockaddrInet4(sa *unix.RawSockaddrInet4, addr *net.UDPAddr) uint32 {
+	*sa = unix.RawSockaddrInet4{Family: unix.AF_INET, Port: htons(addr.Port)}
+	copy(sa.Addr[:], addr.IP.To4())
+
+	return unix.SizeofSockaddrInet4
+}
+
+func putSockaddrInet6(sa *unix.RawSockaddrInet6, addr *net.UDPAddr) uint32 {
+	*sa = unix.RawSockaddrInet6{Family: unix.AF_INET6, Port: htons(addr.Port)}
+	// IPv4 addresses are mapped to IPv6 on the dual-stack socket
+	copy(sa.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		} else if index, err := strconv.Atoi(addr.Zone); err == nil {
+			sa.Scope_id = uint32(index)
+		}
+	}
+
+	return unix.SizeofSockaddrInet6
+}
+
+// htons and ntohs convert the port of the raw socket address that is stored in the network byte order.
+func htons(port int) uint16 {
+	var b [2]byte
+	b[0], b[1] = byte(port>>8), byte(port)
+
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+
+	return int(b[0])<<8 | int(b[1])
+}
@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func newTestBatchConn(t *testing.T) (*batchConn, *net.UDPConn, func()) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, ok := newBatchConn(conn).(*batchConn)
+	if !ok {
+		conn.Close()
+		t.Skip("batched syscalls are not available")
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+
+	return bc, peer, func() {
+		conn.Close()
+		peer.Close()
+	}
+}
+
+func TestBatchConnWriteError(t *testing.T) {
+	c, peer, closeConns := newTestBatchConn(t)
+	defer closeConns()
+
+	// the datagram over the max UDP payload fails with EMSGSIZE
+	if _, err := c.WriteTo(make([]byte, 70000), peer.LocalAddr()); err == nil {
+		t.Error("oversized datagram is sent")
+	}
+	// the zero port is not a valid destination
+	if _, err := c.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err == nil {
+		t.Error("datagram to the zero port is sent")
+	}
+	if num, err := c.WriteTo([]byte("ping"), peer.LocalAddr()); err != nil || num != 4 {
+		t.Errorf("send datagram after failures: num = %d, err = %v", num, err)
+	}
+}
+
+func TestBatchConnWriteErrorInBatch(t *testing.T) {
+	c, peer, closeConns := newTestBatchConn(t)
+	defer closeConns()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3*udpBatchSize)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := []byte("ping")
+			if i%3 == 0 {
+				buf = make([]byte, 70000)
+			}
+			_, errs[i] = c.WriteTo(buf, peer.LocalAddr())
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if i%3 == 0 && err == nil {
+			t.Errorf("oversized datagram %d is sent", i)
+		}
+		if i%3 != 0 && err != nil {
+			t.Errorf("send datagram %d: %v", i, err)
+		}
+	}
+}
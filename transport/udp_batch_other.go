@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import "net"
+
+// newBatchConn returns the UDP socket as is, batched syscalls are available on Linux only.
+func newBatchConn(conn *net.UDPConn) net.Conn {
+	return conn
+}
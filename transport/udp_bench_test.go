@@ -0,0 +1,71 @@
+package transport_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/sip/parser"
+	"github.com/ghettovoice/gosip/testutils"
+	"github.com/ghettovoice/gosip/transport"
+)
+
+// BenchmarkUdpProtocol_Send measures sending of requests from many goroutines through the single socket,
+// like responses to the registration storm.
+func BenchmarkUdpProtocol_Send(b *testing.B) {
+	output := make(chan sip.Message)
+	errs := make(chan error)
+	cancel := make(chan struct{})
+	protocol := transport.NewUdpProtocol(output, errs, cancel, nil, testutils.NewLogrusLogger())
+	defer func() {
+		close(cancel)
+		<-protocol.Done()
+	}()
+
+	if err := protocol.Listen(transport.NewTarget("127.0.0.1", 5300)); err != nil {
+		b.Fatal(err)
+	}
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:5301")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer peer.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			if _, _, err := peer.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	target := transport.NewTarget("127.0.0.1", 5301)
+	req, err := parser.ParseMessage([]byte("REGISTER sip:127.0.0.1:5301 SIP/2.0\r\n"+
+		"Via: SIP/2.0/UDP 127.0.0.1:5300;branch=z9hG4bK776asdhds\r\n"+
+		"From: <sip:alice@wonderland.com>;tag=1928301774\r\n"+
+		"To: <sip:alice@wonderland.com>\r\n"+
+		"Call-ID: register-storm\r\n"+
+		"CSeq: 1 REGISTER\r\n"+
+		"Contact: <sip:alice@127.0.0.1:5300>\r\n"+
+		"Content-Length: 0\r\n"+
+		"\r\n"), testutils.NewLogrusLogger())
+	if err != nil {
+		b.Fatal(err)
+	}
+	req.SetSource("127.0.0.1:5300")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := protocol.Send(target, req); err != nil {
+				panic(fmt.Sprintf("send failed: %s", err))
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+}
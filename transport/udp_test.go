@@ -3,6 +3,7 @@ package transport_test
 import (
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -236,6 +237,152 @@ var _ = Describe("UdpProtocol", func() {
 			}, 3)
 		})
 
+		Context("when client sends burst of requests", func() {
+			const count = 64
+			var client net.PacketConn
+
+			BeforeEach(func() {
+				var err error
+				client, err = net.ListenPacket(network, "127.0.0.1:5298")
+				Expect(err).ToNot(HaveOccurred())
+				raddr, err := net.ResolveUDPAddr(network, localTarget1.Addr())
+				Expect(err).ToNot(HaveOccurred())
+				for i := 0; i < count; i++ {
+					_, err := client.WriteTo([]byte(testutils.Request([]string{
+						"OPTIONS sip:bob@far-far-away.com SIP/2.0",
+						fmt.Sprintf("Via: SIP/2.0/UDP 127.0.0.1:5298;branch=z9hG4bK%d", i),
+						"From: <sip:alice@wonderland.com>;tag=1928301774",
+						"To: <sip:bob@far-far-away.com>",
+						fmt.Sprintf("Call-ID: burst-%d", i),
+						"CSeq: 1 OPTIONS",
+						"Content-Length: 0",
+						"",
+						"",
+					}).String()), raddr)
+					Expect(err).ToNot(HaveOccurred())
+				}
+			})
+			AfterEach(func() {
+				client.Close()
+			})
+			It("should pipe all requests in order", func(done Done) {
+				for i := 0; i < count; i++ {
+					msg := <-output
+					callID, ok := msg.CallID()
+					Expect(ok).To(BeTrue())
+					Expect(callID.Value()).To(Equal(fmt.Sprintf("burst-%d", i)))
+					Expect(msg.Source()).To(Equal("127.0.0.1:5298"))
+				}
+				close(done)
+			}, 3)
+		})
+
+		Context("when several clients send interleaved bursts of requests", func() {
+			const count = 16
+			clientAddrs := []string{"127.0.0.1:5302", "127.0.0.1:5303", "127.0.0.1:5304", "127.0.0.1:5305"}
+			var clients []net.PacketConn
+
+			BeforeEach(func() {
+				clients = clients[:0]
+				for _, addr := range clientAddrs {
+					client, err := net.ListenPacket(network, addr)
+					Expect(err).ToNot(HaveOccurred())
+					clients = append(clients, client)
+				}
+				raddr, err := net.ResolveUDPAddr(network, localTarget1.Addr())
+				Expect(err).ToNot(HaveOccurred())
+				for i := 0; i < count; i++ {
+					for j, client := range clients {
+						_, err := client.WriteTo([]byte(testutils.Request([]string{
+							"OPTIONS sip:bob@far-far-away.com SIP/2.0",
+							fmt.Sprintf("Via: SIP/2.0/UDP %s;branch=z9hG4bK%d-%d", clientAddrs[j], j, i),
+							"From: <sip:alice@wonderland.com>;tag=1928301774",
+							"To: <sip:bob@far-far-away.com>",
+							fmt.Sprintf("Call-ID: %d", i),
+							"CSeq: 1 OPTIONS",
+							"Content-Length: 0",
+							"",
+							"",
+						}).String()), raddr)
+						Expect(err).ToNot(HaveOccurred())
+					}
+				}
+			})
+			AfterEach(func() {
+				for _, client := range clients {
+					client.Close()
+				}
+			})
+			It("should pipe requests of each client in order", func(done Done) {
+				next := make(map[string]int)
+				for i := 0; i < count*len(clients); i++ {
+					msg := <-output
+					callID, ok := msg.CallID()
+					Expect(ok).To(BeTrue())
+					Expect(callID.Value()).To(Equal(fmt.Sprintf("%d", next[msg.Source()])))
+					next[msg.Source()]++
+				}
+				for _, addr := range clientAddrs {
+					Expect(next[addr]).To(Equal(count))
+				}
+				close(done)
+			}, 3)
+		})
+
+		Context("when many goroutines send requests concurrently", func() {
+			const count = 64
+			var server net.PacketConn
+
+			BeforeEach(func() {
+				var err error
+				server, err = net.ListenPacket(network, "127.0.0.1:5299")
+				Expect(err).ToNot(HaveOccurred())
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+			It("should send all requests", func(done Done) {
+				target := transport.NewTarget("127.0.0.1", 5299)
+				swg := new(sync.WaitGroup)
+				for i := 0; i < count; i++ {
+					req := testutils.Request([]string{
+						"OPTIONS sip:bob@127.0.0.1:5299 SIP/2.0",
+						fmt.Sprintf("Via: SIP/2.0/UDP 127.0.0.1:%d;branch=z9hG4bK%d", port1, i),
+						"From: <sip:alice@wonderland.com>;tag=1928301774",
+						"To: <sip:bob@far-far-away.com>",
+						fmt.Sprintf("Call-ID: send-%d", i),
+						"CSeq: 1 OPTIONS",
+						"Content-Length: 0",
+						"",
+						"",
+					})
+					req.SetSource(fmt.Sprintf("127.0.0.1:%d", port1))
+					swg.Add(1)
+					go func() {
+						defer swg.Done()
+						defer GinkgoRecover()
+						Expect(protocol.Send(target, req)).To(Succeed())
+					}()
+				}
+
+				received := make(map[string]bool)
+				buf := make([]byte, 65535)
+				Expect(server.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+				for len(received) < count {
+					num, raddr, err := server.ReadFrom(buf)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(raddr.(*net.UDPAddr).Port).To(Equal(port1))
+					for _, line := range strings.Split(string(buf[:num]), "\r\n") {
+						if strings.HasPrefix(line, "Call-ID: ") {
+							received[strings.TrimPrefix(line, "Call-ID: ")] = true
+						}
+					}
+				}
+				swg.Wait()
+				close(done)
+			}, 3)
+		})
+
 		Context("after cancel signal received", func() {
 			BeforeEach(func() {
 				time.Sleep(time.Millisecond)
@@ -1,28 +1,79 @@
 package transport
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/log"
 	"github.com/ghettovoice/gosip/sip"
+	"github.com/ghettovoice/gosip/timing"
 )
 
 var (
 	wsSubProtocol = "sip"
 )
 
+const (
+	DefaultWsReconnectMinDelay = time.Second
+	DefaultWsReconnectMaxDelay = 30 * time.Second
+)
+
+// WsClientConfig describes outgoing connections of WS and WSS protocols,
+// like connections to WebRTC platforms that authorize the upgrade request by cookies or tokens.
+type WsClientConfig struct {
+	// Path of the upgrade request, default is the root.
+	Path string
+	// Header is added to the upgrade request, e.g. Cookie or Authorization.
+	Header http.Header
+	// Binary sends messages in binary frames instead of text frames.
+	// Accepted connections always answer in frames of the last message received from the peer.
+	Binary bool
+	// Reconnect re-establishes connections closed by the peer or broken by the network,
+	// connections closed locally, e.g. dropped from the pool or closed on shutdown, are not re-established,
+	// nil disables reconnection. Reconnected connections never expire.
+	Reconnect *WsReconnectConfig
+}
+
+// WsReconnectConfig describes reconnection of outgoing WebSocket connections.
+// The connection is redialed with exponential backoff until it is established or the protocol is canceled,
+// then eventbus.ConnectionReconnectedEvent is published, see registration.RefreshOnReconnect.
+type WsReconnectConfig struct {
+	// MinDelay before the first attempt, default is DefaultWsReconnectMinDelay.
+	MinDelay time.Duration
+	// MaxDelay between attempts, default is DefaultWsReconnectMaxDelay.
+	MaxDelay time.Duration
+}
+
+// WsClient is implemented by WS and WSS protocols.
+type WsClient interface {
+	// SetClientConfig configures connections dialed after the call.
+	SetClientConfig(config WsClientConfig)
+}
+
 type wsConn struct {
 	net.Conn
 	client bool
+	// op is the opcode of written frames, zero means text
+	op int32
+	// broken is called once when the reading fails, if not nil,
+	// it is not called after the connection is closed locally
+	broken     func()
+	brokenOnce sync.Once
+	// closed is set by Close, it is accessed atomically
+	closed int32
 }
 
 func (wc *wsConn) Read(b []byte) (n int, err error) {
@@ -34,6 +85,7 @@ func (wc *wsConn) Read(b []byte) (n int, err error) {
 		msg, op, err = wsutil.ReadClientData(wc.Conn)
 	}
 	if err != nil {
+		wc.fail()
 		// handle error
 		var wsErr wsutil.ClosedError
 		if errors.As(err, &wsErr) {
@@ -42,17 +94,38 @@ func (wc *wsConn) Read(b []byte) (n int, err error) {
 		return n, err
 	}
 	if op == ws.OpClose {
+		wc.fail()
 		return n, io.EOF
 	}
+	if !wc.client && (op == ws.OpText || op == ws.OpBinary) {
+		atomic.StoreInt32(&wc.op, int32(op))
+	}
 	copy(b, msg)
 	return len(msg), err
 }
 
+func (wc *wsConn) fail() {
+	if wc.broken != nil && atomic.LoadInt32(&wc.closed) == 0 {
+		wc.brokenOnce.Do(wc.broken)
+	}
+}
+
+// Close closes the connection without the reconnection, e.g. when the pool drops it or the protocol stops.
+func (wc *wsConn) Close() error {
+	atomic.StoreInt32(&wc.closed, 1)
+
+	return wc.Conn.Close()
+}
+
 func (wc *wsConn) Write(b []byte) (n int, err error) {
+	op := ws.OpCode(atomic.LoadInt32(&wc.op))
+	if op == 0 {
+		op = ws.OpText
+	}
 	if wc.client {
-		err = wsutil.WriteClientMessage(wc.Conn, ws.OpText, b)
+		err = wsutil.WriteClientMessage(wc.Conn, op, b)
 	} else {
-		err = wsutil.WriteServerMessage(wc.Conn, ws.OpText, b)
+		err = wsutil.WriteServerMessage(wc.Conn, op, b)
 	}
 	if err != nil {
 		// handle error
@@ -65,6 +138,28 @@ func (wc *wsConn) Write(b []byte) (n int, err error) {
 	return len(b), nil
 }
 
+// bufferedConn reads data the HTTP server has already buffered before the connection was hijacked.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+// HTTPUpgrader is implemented by WS and WSS protocols,
+// they serve connections upgraded by the HTTP server of the application in addition to own listeners.
+type HTTPUpgrader interface {
+	// UpgradeHandler returns handler that upgrades HTTP requests to WebSocket connections served by the protocol,
+	// so the protocol shares the port and certificates with the web application:
+	//
+	//	mux.Handle("/sip", protocol.(transport.HTTPUpgrader).UpgradeHandler())
+	//
+	// Mount the handler of WSS protocol to HTTPS server and the handler of WS protocol to plain HTTP server.
+	UpgradeHandler() http.Handler
+}
+
 type wsListener struct {
 	net.Listener
 	network string
@@ -110,9 +205,14 @@ type wsProtocol struct {
 	listeners   ListenerPool
 	connections ConnectionPool
 	conns       chan Connection
+	done        chan struct{}
 	listen      func(addr *net.TCPAddr, options ...ListenOption) (net.Listener, error)
 	resolveAddr func(addr string) (*net.TCPAddr, error)
 	dialer      ws.Dialer
+	canceled    <-chan struct{}
+
+	clientMu sync.RWMutex
+	client   WsClientConfig
 }
 
 func NewWsProtocol(
@@ -127,6 +227,8 @@ func NewWsProtocol(
 	p.reliable = true
 	p.streamed = true
 	p.conns = make(chan Connection)
+	p.done = make(chan struct{})
+	p.canceled = cancel
 	p.log = logger.
 		WithPrefix("transport.Protocol").
 		WithFields(log.Fields{
@@ -153,13 +255,22 @@ func (p *wsProtocol) defaultResolveAddr(addr string) (*net.TCPAddr, error) {
 	return net.ResolveTCPAddr("tcp", addr)
 }
 
+func (p *wsProtocol) connectionCount() int {
+	return p.connections.Length()
+}
+
 func (p *wsProtocol) Done() <-chan struct{} {
-	return p.connections.Done()
+	return p.done
 }
 
 //piping new connections to connection pool for serving
 func (p *wsProtocol) pipePools() {
-	defer close(p.conns)
+	defer func() {
+		close(p.conns)
+		// protocol is done when both pools are disposed and the pipe is stopped
+		<-p.connections.Done()
+		close(p.done)
+	}()
 
 	p.Log().Debug("start pipe pools")
 	defer p.Log().Debug("stop pipe pools")
@@ -207,7 +318,7 @@ func (p *wsProtocol) Listen(target *Target, options ...ListenOption) error {
 
 	//index listeners by local address
 	// should live infinitely
-	key := ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, target.Port))
+	key := ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, *target.Port))
 	err = p.listeners.Put(key, NewWsListener(listener, p.network, p.Log()))
 	if err != nil {
 		err = &ProtocolError{
@@ -220,7 +331,57 @@ func (p *wsProtocol) Listen(target *Target, options ...ListenOption) error {
 	return err //should be nil here
 }
 
+func (p *wsProtocol) UpgradeHandler() http.Handler {
+	u := ws.HTTPUpgrader{
+		Protocol: func(val string) bool {
+			return val == wsSubProtocol
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		baseConn, rw, _, err := u.Upgrade(r, w)
+		if err != nil {
+			// the error response is already written by the upgrader
+			p.Log().Warnf("upgrade HTTP request from %s to %s failed: %s", r.RemoteAddr, p.Network(), err)
+
+			return
+		}
+		if rw != nil && rw.Reader.Buffered() > 0 {
+			baseConn = &bufferedConn{Conn: baseConn, r: rw.Reader}
+		}
+
+		key := ConnectionKey(p.network + ":" + baseConn.RemoteAddr().String())
+		conn := NewConnection(&wsConn{Conn: baseConn, client: false}, key, p.network, p.Log())
+		if err := p.connections.Put(conn, sockTTL); err != nil {
+			logger := log.AddFieldsFrom(p.Log(), conn)
+			logger.Errorf("put %s connection to the pool failed: %s", conn.Key(), err)
+
+			conn.Close()
+		}
+	})
+}
+
+func (p *wsProtocol) Unlisten(target *Target) error {
+	target = FillTargetHostAndPort(p.Network(), target)
+	key := ListenerKey(fmt.Sprintf("%s:0.0.0.0:%d", p.network, *target.Port))
+	if err := p.listeners.Drop(key); err != nil {
+		return &ProtocolError{
+			Err:      err,
+			Op:       fmt.Sprintf("drop %s listener from the pool", key),
+			ProtoPtr: fmt.Sprintf("%p", p),
+		}
+	}
+
+	p.Log().Debugf("stop listening on %s %s", p.Network(), target.Addr())
+
+	return nil
+}
+
 func (p *wsProtocol) Send(target *Target, msg sip.Message) error {
+	return p.SendContext(context.Background(), target, msg)
+}
+
+func (p *wsProtocol) SendContext(ctx context.Context, target *Target, msg sip.Message) error {
 	target = FillTargetHostAndPort(p.Network(), target)
 
 	//validate remote address
@@ -242,7 +403,7 @@ func (p *wsProtocol) Send(target *Target, msg sip.Message) error {
 	}
 
 	//find or create connection
-	conn, err := p.getOrCreateConnection(raddr)
+	conn, err := p.getOrCreateConnection(ctx, raddr)
 	if err != nil {
 		return &ProtocolError{
 			Err:      err,
@@ -255,7 +416,7 @@ func (p *wsProtocol) Send(target *Target, msg sip.Message) error {
 	logger.Tracef("writing SIP message to %s %s", p.Network(), raddr)
 
 	//send message
-	_, err = conn.Write([]byte(msg.String()))
+	_, err = conn.Write(sip.Wire(msg))
 	if err != nil {
 		err = &ProtocolError{
 			Err:      err,
@@ -267,35 +428,159 @@ func (p *wsProtocol) Send(target *Target, msg sip.Message) error {
 	return err
 }
 
-func (p *wsProtocol) getOrCreateConnection(raddr *net.TCPAddr) (Connection, error) {
+func (p *wsProtocol) SetClientConfig(config WsClientConfig) {
+	if config.Reconnect != nil {
+		reconnect := *config.Reconnect
+		if reconnect.MinDelay <= 0 {
+			reconnect.MinDelay = DefaultWsReconnectMinDelay
+		}
+		if reconnect.MaxDelay <= 0 {
+			reconnect.MaxDelay = DefaultWsReconnectMaxDelay
+		}
+		if reconnect.MaxDelay < reconnect.MinDelay {
+			reconnect.MaxDelay = reconnect.MinDelay
+		}
+		config.Reconnect = &reconnect
+	}
+
+	p.clientMu.Lock()
+	p.client = config
+	p.clientMu.Unlock()
+}
+
+func (p *wsProtocol) clientConfig() WsClientConfig {
+	p.clientMu.RLock()
+	defer p.clientMu.RUnlock()
+
+	return p.client
+}
+
+func (p *wsProtocol) getOrCreateConnection(ctx context.Context, raddr *net.TCPAddr) (Connection, error) {
 	key := ConnectionKey(p.network + ":" + raddr.String())
 	conn, err := p.connections.Get(key)
 	if err != nil {
 		p.Log().Debugf("connection for address %s %s not found; create a new one", p.Network(), raddr)
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-		defer cancel()
-		url := fmt.Sprintf("%s://%s", p.network, raddr)
-		baseConn, _, _, err := p.dialer.Dial(ctx, url)
-		if err == nil {
-			baseConn = &wsConn{
-				Conn:   baseConn,
-				client: true,
-			}
-		} else {
-			if baseConn == nil {
-				return nil, fmt.Errorf("dial to %s %s: %w", p.Network(), raddr, err)
-			}
+		return p.dial(ctx, key, raddr)
+	}
+
+	return conn, nil
+}
+
+// dial establishes the new connection and puts it to the pool,
+// the connection falls back to TCP if the WebSocket upgrade fails.
+func (p *wsProtocol) dial(ctx context.Context, key ConnectionKey, raddr *net.TCPAddr) (Connection, error) {
+	config := p.clientConfig()
 
-			p.Log().Warnf("fallback to TCP connection due to WS upgrade error: %s", err)
+	baseConn, err := p.upgrade(ctx, raddr, config)
+	if err != nil {
+		if baseConn == nil {
+			return nil, fmt.Errorf("dial to %s %s: %w", p.Network(), raddr, err)
 		}
 
-		conn = NewConnection(baseConn, key, p.network, p.Log())
+		p.Log().Warnf("fallback to TCP connection due to WS upgrade error: %s", err)
+	}
 
-		if err := p.connections.Put(conn, sockTTL); err != nil {
-			return conn, fmt.Errorf("put %s connection to the pool: %w", conn.Key(), err)
+	return p.put(key, raddr, baseConn, config)
+}
+
+// upgrade dials the peer and upgrades the connection to WebSocket,
+// if the upgrade fails, the dialed TCP connection is returned with the error.
+func (p *wsProtocol) upgrade(ctx context.Context, raddr *net.TCPAddr, config WsClientConfig) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	dialer := p.dialer
+	if config.Header != nil {
+		dialer.Header = ws.HandshakeHeaderHTTP(config.Header)
+	}
+	url := fmt.Sprintf("%s://%s%s", p.network, raddr, config.Path)
+	baseConn, _, _, err := dialer.Dial(ctx, url)
+	if err != nil {
+		return baseConn, err
+	}
+
+	wc := &wsConn{
+		Conn:   baseConn,
+		client: true,
+	}
+	if config.Binary {
+		wc.op = int32(ws.OpBinary)
+	}
+
+	return wc, nil
+}
+
+// put wraps the dialed connection and puts it to the pool.
+func (p *wsProtocol) put(key ConnectionKey, raddr *net.TCPAddr, baseConn net.Conn, config WsClientConfig) (Connection, error) {
+	conn := NewConnection(baseConn, key, p.network, p.Log())
+
+	ttl := sockTTL
+	if wc, ok := baseConn.(*wsConn); ok && config.Reconnect != nil {
+		ttl = 0
+		reconnect := *config.Reconnect
+		wc.broken = func() {
+			go p.reconnect(key, raddr, conn, reconnect)
 		}
 	}
 
+	if err := p.connections.Put(conn, ttl); err != nil {
+		return conn, fmt.Errorf("put %s connection to the pool: %w", conn.Key(), err)
+	}
+
 	return conn, nil
 }
+
+// reconnect redials the broken connection until it is established or the protocol is canceled.
+func (p *wsProtocol) reconnect(key ConnectionKey, raddr *net.TCPAddr, broken Connection, config WsReconnectConfig) {
+	logger := log.AddFieldsFrom(p.Log(), broken)
+
+	delay := config.MinDelay
+	for {
+		select {
+		case <-p.canceled:
+			return
+		case <-timing.After(delay):
+		}
+
+		if conn, err := p.connections.Get(key); err == nil {
+			if conn != broken {
+				// already re-established by the sending
+				return
+			}
+			// the pool has not dropped the broken connection yet
+			_ = p.connections.Drop(key)
+		}
+
+		// the TCP fallback is not the reconnection, the upgrade is retried
+		var conn Connection
+		clientConfig := p.clientConfig()
+		baseConn, err := p.upgrade(context.Background(), raddr, clientConfig)
+		if err == nil {
+			conn, err = p.put(key, raddr, baseConn, clientConfig)
+		} else if baseConn != nil {
+			baseConn.Close()
+			err = fmt.Errorf("upgrade to %s: %w", p.Network(), err)
+		}
+		if err == nil {
+			logger.Infof("%s connection to %s re-established", p.Network(), raddr)
+
+			p.getEnvironment().bus.Publish(&eventbus.ConnectionReconnectedEvent{
+				Network:    p.network,
+				LocalAddr:  addrString(conn.LocalAddr()),
+				RemoteAddr: addrString(conn.RemoteAddr()),
+			})
+
+			return
+		}
+		if conn != nil {
+			conn.Close()
+		}
+
+		logger.Debugf("reconnect %s connection to %s failed, next attempt in %s: %s", p.Network(), raddr, delay, err)
+
+		delay *= 2
+		if delay > config.MaxDelay {
+			delay = config.MaxDelay
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWsConnBroken(t *testing.T) {
+	newConn := func() (*wsConn, net.Conn, *int32) {
+		local, remote := net.Pipe()
+		var broken int32
+		wc := &wsConn{
+			Conn:   local,
+			client: true,
+			broken: func() { atomic.AddInt32(&broken, 1) },
+		}
+
+		return wc, remote, &broken
+	}
+
+	// the peer closes the connection
+	wc, remote, broken := newConn()
+	remote.Close()
+	if _, err := wc.Read(make([]byte, 100)); err == nil {
+		t.Fatalf("expected error of the read from the closed connection")
+	}
+	_, _ = wc.Read(make([]byte, 100))
+	if n := atomic.LoadInt32(broken); n != 1 {
+		t.Errorf("expected connection closed by the peer to be broken once, got %d", n)
+	}
+	wc.Close()
+
+	// the connection is closed locally, e.g. dropped from the pool
+	wc, remote, broken = newConn()
+	defer remote.Close()
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wc.Read(make([]byte, 100)); err == nil {
+		t.Fatalf("expected error of the read from the closed connection")
+	}
+	if n := atomic.LoadInt32(broken); n != 0 {
+		t.Errorf("expected connection closed locally not to be broken, got %d", n)
+	}
+}
@@ -3,8 +3,11 @@ package transport_test
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
@@ -12,6 +15,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/ghettovoice/gosip/eventbus"
 	"github.com/ghettovoice/gosip/sip"
 	"github.com/ghettovoice/gosip/testutils"
 	"github.com/ghettovoice/gosip/timing"
@@ -125,6 +129,213 @@ var _ = Describe("WsProtocol", func() {
 		})
 	})
 
+	Context("when mounted to HTTP server", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			mux := http.NewServeMux()
+			mux.Handle("/sip", protocol.(transport.HTTPUpgrader).UpgradeHandler())
+			server = httptest.NewServer(mux)
+
+			targetUrl, err := url.Parse(fmt.Sprintf("ws://%s/sip", server.Listener.Addr()))
+			Expect(err).ToNot(HaveOccurred())
+			client1 = testutils.CreateClient(network, server.Listener.Addr().String(), "")
+			_, _, err = wsDial.Upgrade(client1, targetUrl)
+			Expect(err).ToNot(HaveOccurred())
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				Expect(wsutil.WriteClientText(client1, []byte(msg1))).Should(Succeed())
+			}()
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+		It("should serve upgraded connections", func(done Done) {
+			By("msg1 arrives")
+			testutils.AssertMessageArrived(output, fmt.Sprintf(expectedMsg1, client1.LocalAddr().(*net.TCPAddr).IP), client1.LocalAddr().String(), server.Listener.Addr().String())
+
+			By("sends response 200 OK over the upgraded connection")
+			clientTarget, err := transport.NewTargetFromAddr(client1.LocalAddr().String())
+			Expect(err).ToNot(HaveOccurred())
+			msg := sip.NewResponse(
+				"",
+				"SIP/2.0",
+				200,
+				"OK",
+				[]sip.Header{
+					&sip.CSeq{SeqNo: 2, MethodName: sip.INVITE},
+				},
+				"",
+				nil,
+			)
+			Expect(protocol.Send(clientTarget, msg)).To(Succeed())
+			buf, err := wsutil.ReadServerText(client1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf)).To(Equal(msg.String()))
+			close(done)
+		}, 3)
+	})
+
+	Context("when dials out as a client", func() {
+		var (
+			server   *httptest.Server
+			upgrades chan *http.Request
+			conns    chan net.Conn
+			accepted []net.Conn
+			mu       sync.Mutex
+			// reject fails upgrades when set, it is accessed atomically
+			reject int32
+		)
+
+		BeforeEach(func() {
+			upgrades = make(chan *http.Request, 4)
+			conns = make(chan net.Conn, 4)
+			accepted = nil
+			atomic.StoreInt32(&reject, 0)
+			u := ws.HTTPUpgrader{
+				Protocol: func(val string) bool {
+					return val == "sip"
+				},
+			}
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.LoadInt32(&reject) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					select {
+					case upgrades <- r:
+					default:
+					}
+					return
+				}
+				conn, _, _, err := u.Upgrade(r, w)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				accepted = append(accepted, conn)
+				mu.Unlock()
+				upgrades <- r
+				conns <- conn
+			}))
+
+			protocol.(transport.WsClient).SetClientConfig(transport.WsClientConfig{
+				Path:   "/sip",
+				Header: http.Header{"Cookie": []string{"session=secret"}},
+				Binary: true,
+				Reconnect: &transport.WsReconnectConfig{
+					MinDelay: 50 * time.Millisecond,
+				},
+			})
+		})
+		AfterEach(func() {
+			server.Close()
+			mu.Lock()
+			for _, conn := range accepted {
+				conn.Close()
+			}
+			mu.Unlock()
+		})
+
+		It("should upgrade with headers, send binary frames and reconnect", func(done Done) {
+			reconnected := make(chan *eventbus.ConnectionReconnectedEvent, 1)
+			unsubscribe := eventbus.Default.Subscribe(func(ev eventbus.Event) {
+				select {
+				case reconnected <- ev.(*eventbus.ConnectionReconnectedEvent):
+				default:
+				}
+			}, eventbus.ConnectionReconnected)
+			defer unsubscribe()
+
+			target, err := transport.NewTargetFromAddr(server.Listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			msg := sip.NewResponse(
+				"",
+				"SIP/2.0",
+				200,
+				"OK",
+				[]sip.Header{
+					&sip.CSeq{SeqNo: 2, MethodName: sip.INVITE},
+				},
+				"",
+				nil,
+			)
+			Expect(protocol.Send(target, msg)).To(Succeed())
+
+			req := <-upgrades
+			Expect(req.URL.Path).To(Equal("/sip"))
+			Expect(req.Header.Get("Cookie")).To(Equal("session=secret"))
+			conn := <-conns
+			data, op, err := wsutil.ReadClientData(conn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op).To(Equal(ws.OpBinary))
+			Expect(string(data)).To(Equal(msg.String()))
+
+			By("server closes the connection")
+			conn.Close()
+			// the reconnect delay runs on the mocked clock
+			var ev *eventbus.ConnectionReconnectedEvent
+			Eventually(func() *eventbus.ConnectionReconnectedEvent {
+				timing.Elapse(50 * time.Millisecond)
+				select {
+				case ev = <-reconnected:
+				default:
+				}
+				return ev
+			}).ShouldNot(BeNil())
+			Expect(ev.RemoteAddr).To(Equal(server.Listener.Addr().String()))
+			req = <-upgrades
+			Expect(req.Header.Get("Cookie")).To(Equal("session=secret"))
+			conn = <-conns
+
+			By("sends over the reconnected connection")
+			Expect(protocol.Send(target, msg)).To(Succeed())
+			data, op, err = wsutil.ReadClientData(conn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op).To(Equal(ws.OpBinary))
+			Expect(string(data)).To(Equal(msg.String()))
+			close(done)
+		}, 5)
+
+		It("should not report the TCP fallback after the failed upgrade as reconnected", func(done Done) {
+			reconnected := make(chan *eventbus.ConnectionReconnectedEvent, 1)
+			unsubscribe := eventbus.Default.Subscribe(func(ev eventbus.Event) {
+				select {
+				case reconnected <- ev.(*eventbus.ConnectionReconnectedEvent):
+				default:
+				}
+			}, eventbus.ConnectionReconnected)
+			defer unsubscribe()
+
+			target, err := transport.NewTargetFromAddr(server.Listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			msg := sip.NewResponse("", "SIP/2.0", 200, "OK", []sip.Header{&sip.CSeq{SeqNo: 2, MethodName: sip.INVITE}}, "", nil)
+			Expect(protocol.Send(target, msg)).To(Succeed())
+			<-upgrades
+			conn := <-conns
+
+			By("server rejects upgrades of the reconnection")
+			atomic.StoreInt32(&reject, 1)
+			conn.Close()
+			Eventually(func() int {
+				timing.Elapse(50 * time.Millisecond)
+				return len(upgrades)
+			}).Should(BeNumerically(">=", 1))
+			Consistently(reconnected, 100*time.Millisecond).ShouldNot(Receive())
+
+			By("server accepts upgrades again")
+			for len(upgrades) > 0 {
+				<-upgrades
+			}
+			atomic.StoreInt32(&reject, 0)
+			Eventually(func() bool {
+				timing.Elapse(50 * time.Millisecond)
+				return len(conns) > 0
+			}).Should(BeTrue())
+			Eventually(reconnected).Should(Receive())
+			close(done)
+		}, 5)
+	})
+
 	Context(fmt.Sprintf("listens target: %s", localTarget1), func() {
 		BeforeEach(func() {
 			Expect(protocol.Listen(localTarget1)).To(Succeed())
@@ -27,6 +27,7 @@ func NewWssProtocol(
 	p.reliable = true
 	p.streamed = true
 	p.conns = make(chan Connection)
+	p.done = make(chan struct{})
 	p.log = logger.
 		WithPrefix("transport.Protocol").
 		WithFields(log.Fields{